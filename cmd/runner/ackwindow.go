@@ -0,0 +1,81 @@
+package main
+
+// This file contains the implementation of adaptive acknowledgement windows.  The durations
+// of the work done for each queue are tracked and used to size the period for which a
+// message is held by the runner before the queue platform will consider redelivering it,
+// for example the pubsub maximum extension or the SQS visibility timeout.  Queues with
+// long running work get long windows while queues with short work free up messages held
+// by failed runners quickly.
+
+import (
+	"flag"
+	"math"
+	"sort"
+	"time"
+)
+
+var (
+	ackWindowMultipleOpt = flag.Float64("ack-window-multiple", 3.0, "the multiple of the 95th percentile of the durations of work from a queue used as the acknowledgement window for its messages, 0 disables adaptive windows")
+	ackWindowFloorOpt    = flag.Duration("ack-window-floor", 30*time.Second, "the smallest adaptive acknowledgement window that will be used for a queue")
+	ackWindowCeilingOpt  = flag.Duration("ack-window-ceiling", 12*time.Hour, "the largest adaptive acknowledgement window that will be used for a queue")
+)
+
+const (
+	ackWindowSamples    = 100 // The number of recent durations retained for each queue
+	ackWindowMinSamples = 5   // The number of durations needed before the window is adapted
+)
+
+// adaptiveWindow computes an acknowledgement window from the durations observed for a queue,
+// 0 is returned if there is not enough information to compute one
+//
+func adaptiveWindow(durations []time.Duration, multiple float64, floor time.Duration, ceiling time.Duration) (window time.Duration) {
+	if multiple <= 0 || len(durations) < ackWindowMinSamples {
+		return 0
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	p95 := sorted[int(math.Ceil(0.95*float64(len(sorted))))-1]
+
+	window = time.Duration(float64(p95) * multiple)
+	if window < floor {
+		window = floor
+	}
+	if ceiling > 0 && window > ceiling {
+		window = ceiling
+	}
+	return window
+}
+
+// setDuration records how long a work item from a queue took to be processed
+//
+func (subs *Subscriptions) setDuration(name string, duration time.Duration) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	q, isPresent := subs.subs[name]
+	if !isPresent {
+		return
+	}
+
+	q.durations = append(q.durations, duration)
+	if len(q.durations) > ackWindowSamples {
+		q.durations = q.durations[len(q.durations)-ackWindowSamples:]
+	}
+}
+
+// ackWindow returns the acknowledgement window for messages from a queue, 0 is returned
+// if the queue implementation should use its default
+//
+func (subs *Subscriptions) ackWindow(name string) (window time.Duration) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	q, isPresent := subs.subs[name]
+	if !isPresent {
+		return 0
+	}
+	return adaptiveWindow(q.durations, *ackWindowMultipleOpt, *ackWindowFloorOpt, *ackWindowCeilingOpt)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestAdaptiveWindow checks that acknowledgement windows follow the durations of the work
+// seen for a queue within the bounds supplied
+//
+func TestAdaptiveWindow(t *testing.T) {
+
+	durations := []time.Duration{}
+	if window := adaptiveWindow(durations, 3, time.Second, time.Hour); window != 0 {
+		t.Fatalf("window %v was produced without any durations", window)
+	}
+
+	for i := 1; i <= 20; i++ {
+		durations = append(durations, time.Duration(i)*time.Minute)
+	}
+
+	// The 95th percentile of 20 samples is the 19th
+	if window := adaptiveWindow(durations, 2, time.Second, 12*time.Hour); window != 38*time.Minute {
+		t.Fatalf("window %v was produced, expected %v", window, 38*time.Minute)
+	}
+	if window := adaptiveWindow(durations, 2, time.Second, 10*time.Minute); window != 10*time.Minute {
+		t.Fatalf("window %v was not limited by the ceiling", window)
+	}
+	if window := adaptiveWindow(durations, 2, time.Hour, 12*time.Hour); window != time.Hour {
+		t.Fatalf("window %v was not limited by the floor", window)
+	}
+	if window := adaptiveWindow(durations, 0, time.Second, 12*time.Hour); window != 0 {
+		t.Fatalf("window %v was produced with adaptive windows disabled", window)
+	}
+}
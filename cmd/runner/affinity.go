@@ -0,0 +1,82 @@
+package main
+
+// This file contains the implementation of experiment affinity.  Experiments that reuse large
+// inputs run faster on the nodes that already hold those inputs in their artifact cache.
+// The completion events of experiments record the artifacts a node now holds in its cache,
+// and clients can use these to add an affinity hint naming the preferred nodes when they
+// queue later experiments.  Other nodes leave an experiment with a hint in its queue for a
+// limited period, after which any node will run it so that an experiment is not starved
+// when its preferred nodes are unavailable.  Only the message with the hint is left, other
+// work on the same queue continues to be run.
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+var (
+	affinityMaxWaitOpt = flag.Duration("affinity-max-wait", 5*time.Minute, "the period after an experiment was added that it is left for the nodes named in its affinity hint before any node runs it, when it does not supply its own")
+)
+
+// preferredNode returns true when this node is one of those named in the affinity hint of an
+// experiment, or the experiment has no hint
+//
+func preferredNode(affinity *runner.Affinity) (preferred bool) {
+	if affinity == nil || len(affinity.Hosts) == 0 {
+		return true
+	}
+	for _, name := range affinity.Hosts {
+		if strings.EqualFold(name, host) {
+			return true
+		}
+	}
+	// Cloud instance IDs are only discovered when the host name did not match
+	if instanceID := runner.GetNodeMeta().InstanceID; len(instanceID) != 0 {
+		for _, name := range affinity.Hosts {
+			if name == instanceID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// leaveForAffinity returns true when an experiment should be left in its queue for the nodes
+// named in its affinity hint.  The hint is only honored until the maximum wait has passed.
+//
+func leaveForAffinity(rqst *runner.Request) (leave bool) {
+	affinity := rqst.Experiment.Affinity
+	if preferredNode(affinity) {
+		return false
+	}
+
+	maxWait := *affinityMaxWaitOpt
+	if len(affinity.MaxWait) != 0 {
+		if wait, errGo := time.ParseDuration(affinity.MaxWait); errGo == nil {
+			maxWait = wait
+		}
+	}
+	return maxWait > 0 && time.Since(addedAt(rqst, maxWait)) <= maxWait
+}
+
+// cachedArtifacts returns the locations of the artifacts of an experiment that this node holds
+// in its artifact cache at the time of the call, artifacts evicted from the cache since they
+// were fetched are not included and none are returned when the cache is not enabled
+//
+func cachedArtifacts(rqst *runner.Request) (cached []string) {
+	for group, art := range rqst.Experiment.Artifacts {
+		if art.Mutable || len(art.Qualified) == 0 || group == "_metadata" || strings.HasPrefix(art.Qualified, "file://") {
+			continue
+		}
+		if !runner.CacheHolds(art.Resolved) {
+			continue
+		}
+		cached = append(cached, art.Qualified)
+	}
+	sort.Strings(cached)
+	return cached
+}
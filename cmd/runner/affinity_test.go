@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/rs/xid"
+)
+
+// TestAffinity checks that experiments with an affinity hint naming other nodes are left for
+// those nodes only until their maximum wait has passed
+//
+func TestAffinity(t *testing.T) {
+
+	rqst := &runner.Request{}
+	rqst.Experiment.Key = xid.New().String()
+	rqst.Experiment.TimeAdded = float64(time.Now().Unix())
+
+	if leaveForAffinity(rqst) {
+		t.Fatal("experiment without an affinity hint was left for other nodes")
+	}
+
+	rqst.Experiment.Affinity = &runner.Affinity{Hosts: []string{host}}
+	if leaveForAffinity(rqst) {
+		t.Fatal("experiment was left by a preferred node")
+	}
+
+	rqst.Experiment.Affinity = &runner.Affinity{Hosts: []string{"preferred-" + xid.New().String()}}
+	if !leaveForAffinity(rqst) {
+		t.Fatal("experiment was not left for its preferred nodes")
+	}
+
+	// Once the experiment has waited for the maximum period any node runs it
+	rqst.Experiment.TimeAdded = float64(time.Now().Add(-2 * *affinityMaxWaitOpt).Unix())
+	if leaveForAffinity(rqst) {
+		t.Fatal("experiment was left for its preferred nodes after its maximum wait")
+	}
+
+	rqst.Experiment.Affinity.MaxWait = "24h"
+	if !leaveForAffinity(rqst) {
+		t.Fatal("maximum wait of the experiment was not used")
+	}
+}
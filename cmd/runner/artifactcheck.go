@@ -0,0 +1,233 @@
+package main
+
+// This file contains the implementation of the 'artifact check' diagnostic command.  The
+// command uploads a small test artifact to each of the storage locations supplied on the
+// command line and then downloads it again, verifying its contents, using the same
+// storage implementations the runner uses for experiment artifacts.
+//
+// For example
+//
+//    runner artifact check s3://s3.us-west-2.amazonaws.com/my-bucket gs://my-bucket
+//
+// S3 and minio credentials are taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_DEFAULT_REGION environment variables.  Google Cloud Storage credentials are taken from
+// the first json file found in the google-certs directory.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	artifactCheckSize = 1024 * 1024
+	artifactCheckFile = "artifact-check.bin"
+)
+
+// artifactCheckResult records the outcome of a round trip to a single storage location
+//
+type artifactCheckResult struct {
+	target     string
+	upload     time.Duration
+	download   time.Duration
+	permission bool
+	err        errors.Error
+}
+
+// isArtifactCheck tests the positional arguments that remain after the options were parsed
+// to see if the artifact check command was requested
+//
+func isArtifactCheck(args []string) bool {
+	return len(args) >= 2 && args[0] == "artifact" && args[1] == "check"
+}
+
+// runArtifactCheck performs the round trip for each of the targets and prints a report, false
+// is returned if any of the targets failed
+//
+func runArtifactCheck(ctx context.Context, targets []string) (ok bool) {
+
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: runner artifact check [s3://endpoint/bucket | gs://bucket] ...")
+		return false
+	}
+
+	ok = true
+	for _, target := range targets {
+		result := checkArtifactTarget(ctx, target)
+		if result.err != nil {
+			ok = false
+			kind := "FAILED"
+			if result.permission {
+				kind = "PERMISSION DENIED"
+			}
+			fmt.Printf("%-40s %s %s\n", target, kind, result.err.Error())
+			continue
+		}
+		fmt.Printf("%-40s OK upload %s (%s/s) download %s (%s/s)\n", target,
+			result.upload.Round(time.Millisecond), throughput(result.upload),
+			result.download.Round(time.Millisecond), throughput(result.download))
+	}
+	return ok
+}
+
+func throughput(elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "-"
+	}
+	return humanize.Bytes(uint64(float64(artifactCheckSize) / elapsed.Seconds()))
+}
+
+// isPermissionErr looks for the signs of authentication or authorization failures in
+// errors returned by the storage platforms
+//
+func isPermissionErr(err errors.Error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range []string{"access denied", "accessdenied", "forbidden", "403", "401", "permission", "signaturedoesnotmatch", "invalidaccesskeyid", "unauthorized"} {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// artifactCheckOpts builds the storage options for a target location and the test object
+//
+func artifactCheckOpts(target string, key string) (opts *runner.StoreOpts, err errors.Error) {
+	uri, errGo := url.Parse(target)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("target", target).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	art := &runner.Artifact{
+		Key: key,
+	}
+	opts = &runner.StoreOpts{
+		Art:      art,
+		Env:      map[string]string{},
+		Validate: true,
+	}
+
+	switch uri.Scheme {
+	case "s3":
+		bucket := strings.Trim(uri.Path, "/")
+		if len(uri.Host) == 0 || len(bucket) == 0 {
+			return nil, errors.New("s3 targets need an endpoint and bucket, s3://endpoint/bucket").With("target", target).With("stack", stack.Trace().TrimRuntime())
+		}
+		art.Bucket = bucket
+		art.Qualified = "s3://" + uri.Host + "/" + bucket + "/" + key
+		for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_DEFAULT_REGION"} {
+			if value, isPresent := os.LookupEnv(env); isPresent {
+				opts.Env[env] = value
+			}
+		}
+	case "gs":
+		if len(uri.Host) == 0 {
+			return nil, errors.New("gs targets need a bucket, gs://bucket").With("target", target).With("stack", stack.Trace().TrimRuntime())
+		}
+		art.Bucket = uri.Host
+		art.Qualified = "gs://" + uri.Host + "/" + key
+		creds, _ := filepath.Glob(filepath.Join(googleCertsSetting(), "*.json"))
+		if len(creds) == 0 {
+			return nil, errors.New("no google credentials found").With("dir", googleCertsSetting()).With("stack", stack.Trace().TrimRuntime())
+		}
+		opts.Creds = creds[0]
+	default:
+		return nil, errors.New("storage scheme not supported by the runner, s3 or gs expected").With("target", target).With("stack", stack.Trace().TrimRuntime())
+	}
+	return opts, nil
+}
+
+func checkArtifactTarget(ctx context.Context, target string) (result *artifactCheckResult) {
+
+	result = &artifactCheckResult{target: target}
+	defer func() {
+		if result.err != nil {
+			result.permission = isPermissionErr(result.err)
+		}
+	}()
+
+	// Each host uses the same key so that repeated checks replace the previous test object
+	key := "studioml-runner-check/" + host + ".tar"
+
+	opts, err := artifactCheckOpts(target, key)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	workDir, errGo := ioutil.TempDir("", "artifact-check")
+	if errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	defer os.RemoveAll(workDir)
+
+	srcDir := filepath.Join(workDir, "upload")
+	dstDir := filepath.Join(workDir, "download")
+	for _, dir := range []string{srcDir, dstDir} {
+		if errGo = os.MkdirAll(dir, 0700); errGo != nil {
+			result.err = errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+			return result
+		}
+	}
+
+	content := make([]byte, artifactCheckSize)
+	if _, errGo = io.ReadFull(rand.Reader, content); errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(srcDir, artifactCheckFile), content, 0600); errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	storage, err := runner.NewStorage(ctx, opts)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer storage.Close()
+
+	start := time.Now()
+	if _, err = storage.Deposit(ctx, srcDir, key); err != nil {
+		result.err = err
+		return result
+	}
+	result.upload = time.Since(start)
+
+	start = time.Now()
+	if _, err = storage.Fetch(ctx, key, true, dstDir, nil); err != nil {
+		result.err = err
+		return result
+	}
+	result.download = time.Since(start)
+
+	downloaded, errGo := ioutil.ReadFile(filepath.Join(dstDir, artifactCheckFile))
+	if errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	if sent, received := sha256.Sum256(content), sha256.Sum256(downloaded); !bytes.Equal(sent[:], received[:]) {
+		result.err = errors.New("downloaded artifact did not match the upload").With("key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return result
+}
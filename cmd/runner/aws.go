@@ -34,35 +34,41 @@ var (
 type awsCred struct {
 }
 
+// validate checks that every account and region described by the credential files can list
+// its SQS queues, returning the first set of credentials
+//
 func (*awsCred) validate(ctx context.Context, filenames []string) (cred *runner.AWSCred, err errors.Error) {
 
-	cred, err = runner.AWSExtractCreds(filenames)
+	creds, err := runner.AWSExtractCredSets(filenames)
 	if err != nil {
-		return cred, err
+		return nil, err
 	}
 
-	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(cred.Region),
-			Credentials:                   cred.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
-	})
-
-	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-	}
+	for _, aCred := range creds {
+		sess, errGo := session.NewSessionWithOptions(session.Options{
+			Config: aws.Config{
+				Region:                        aws.String(aCred.Region),
+				Credentials:                   aCred.Creds,
+				CredentialsChainVerboseErrors: aws.Bool(true),
+			},
+			Profile: aCred.Profile,
+		})
+
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
 
-	// Create a SQS client
-	svc := sqs.New(sess)
+		// Create a SQS client
+		svc := sqs.New(sess)
 
-	_, errGo = svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{})
-	if errGo != nil {
-		return nil, errors.Wrap(errGo, "unable to list SQS queues").With("stack", stack.Trace().TrimRuntime()).With("filenames", filenames).With("region", cred.Region)
+		_, errGo = svc.ListQueuesWithContext(ctx, &sqs.ListQueuesInput{})
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, "unable to list SQS queues").With("stack", stack.Trace().TrimRuntime()).With("filenames", filenames).
+				With("region", aCred.Region, "profile", aCred.Profile)
+		}
 	}
 
-	return cred, nil
+	return creds[0], nil
 }
 
 func (awsC *awsCred) refreshAWSCert(dir string, timeout time.Duration) (project string, awsFiles []string, err errors.Error) {
@@ -127,7 +133,7 @@ func (awsC *awsCred) refreshAWSCerts(dir string, timeout time.Duration) (found m
 
 func serviceSQS(ctx context.Context, connTimeout time.Duration) {
 
-	if len(*sqsCertsDirOpt) == 0 {
+	if len(sqsCertsSetting()) == 0 {
 		logger.Info("user disabled the SQS service")
 		return
 	}
@@ -168,16 +174,8 @@ func serviceSQS(ctx context.Context, connTimeout time.Duration) {
 	for {
 		select {
 		case <-ctx.Done():
-
-			live.Lock()
-			defer live.Unlock()
-
 			// When shutting down stop all projects
-			for _, quiter := range live.projects {
-				if quiter != nil {
-					quiter()
-				}
-			}
+			live.stopAll()
 			return
 
 		case state = <-lifecycleC:
@@ -189,7 +187,7 @@ func serviceSQS(ctx context.Context, connTimeout time.Duration) {
 			}
 			credCheck = time.Duration(15 * time.Second)
 
-			found, err := awsC.refreshAWSCerts(*sqsCertsDirOpt, connTimeout)
+			found, err := awsC.refreshAWSCerts(sqsCertsSetting(), connTimeout)
 			if err != nil {
 				logger.Warn(fmt.Sprintf("unable to refresh AWS certs due to %v", err))
 				continue
@@ -0,0 +1,222 @@
+package main
+
+// This file contains the implementation of the tracking of the health of the queue backends
+// the runner retrieves work from.  The outcomes of refreshing and reading queues are
+// recorded for each backend and a backend whose failure rate over a window exceeds a
+// threshold is marked as degraded.  Only network and authentication failures count
+// against a backend, errors caused by the messages a backend returned do not.  Degraded
+// backends are reported by the healthz endpoint so that orchestration can react, and
+// recover once the backend has succeeded a number of times in a row.
+
+import (
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	backendWindowOpt   = flag.Duration("backend-health-window", 5*time.Minute, "the period over which queue backend failure rates are measured")
+	backendDegradedOpt = flag.Float64("backend-degraded-ratio", 0.5, "the fraction of queue backend operations within the window that must fail for the backend to be marked degraded")
+	backendSamplesOpt  = flag.Uint("backend-min-samples", 4, "the number of queue backend operations within the window needed before a backend can be marked degraded")
+	backendRecoveryOpt = flag.Uint("backend-recovery", 3, "the number of consecutive successful queue backend operations that clear the degraded state")
+
+	backends = newBackendHealth()
+)
+
+// backendOutcome is the result of a single operation against a backend
+//
+type backendOutcome struct {
+	at time.Time
+	ok bool
+}
+
+// backendTracker holds the recent outcomes for a single backend
+//
+type backendTracker struct {
+	outcomes  []backendOutcome
+	succeeded uint      // consecutive successes
+	degraded  time.Time // when the backend was marked degraded, zero if healthy
+}
+
+// backendStatus is the reported form of the health of a backend
+//
+type backendStatus struct {
+	Backend     string     `json:"backend"`
+	Degraded    bool       `json:"degraded"`
+	Since       *time.Time `json:"degraded_since,omitempty"`
+	FailureRate float64    `json:"failure_rate"`
+	Samples     int        `json:"samples"`
+}
+
+// backendHealth tracks the health of each backend
+//
+type backendHealth struct {
+	trackers map[string]*backendTracker
+	sync.Mutex
+}
+
+func newBackendHealth() (bh *backendHealth) {
+	return &backendHealth{
+		trackers: map[string]*backendTracker{},
+	}
+}
+
+// validateBackendHealth checks the options used to judge the health of backends
+//
+func validateBackendHealth() (err errors.Error) {
+	if *backendWindowOpt <= 0 {
+		return errors.New("backend-health-window must be positive").With("backend-health-window", backendWindowOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if *backendDegradedOpt <= 0 || *backendDegradedOpt > 1 {
+		return errors.New("backend-degraded-ratio must be greater than 0 and no more than 1").With("backend-degraded-ratio", *backendDegradedOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if *backendRecoveryOpt == 0 {
+		return errors.New("backend-recovery must be at least 1").With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// backendFailure returns true when an error returned by a backend was caused by the backend
+// being unreachable, or rejecting the credentials of the runner, rather than by the messages
+// it returned
+//
+func backendFailure(errGo error) (failed bool) {
+	return runner.IsTransient(errGo) || runner.IsAuthFailure(errGo)
+}
+
+// record adds the outcome of an operation against a backend
+//
+func (bh *backendHealth) record(backend string, ok bool) {
+	bh.recordAt(backend, ok, time.Now())
+}
+
+func (bh *backendHealth) recordAt(backend string, ok bool, now time.Time) {
+	bh.Lock()
+	defer bh.Unlock()
+
+	tracker, isPresent := bh.trackers[backend]
+	if !isPresent {
+		tracker = &backendTracker{}
+		bh.trackers[backend] = tracker
+	}
+
+	tracker.outcomes = append(tracker.outcomes, backendOutcome{at: now, ok: ok})
+	tracker.expire(now)
+
+	if !ok {
+		tracker.succeeded = 0
+		rate, samples := tracker.failureRate()
+		if tracker.degraded.IsZero() && samples >= int(*backendSamplesOpt) && rate >= *backendDegradedOpt {
+			tracker.degraded = now
+			logger.Warn("queue backend degraded", "backend", backend, "failure_rate", rate, "samples", samples)
+		}
+		return
+	}
+
+	tracker.succeeded++
+	if !tracker.degraded.IsZero() && tracker.succeeded >= *backendRecoveryOpt {
+		logger.Info("queue backend recovered", "backend", backend, "degraded_for", now.Sub(tracker.degraded).Round(time.Second).String())
+		tracker.degraded = time.Time{}
+	}
+}
+
+// expire drops outcomes that have fallen outside of the window
+//
+func (bt *backendTracker) expire(now time.Time) {
+	cutoff := now.Add(-*backendWindowOpt)
+	keep := 0
+	for keep < len(bt.outcomes) && bt.outcomes[keep].at.Before(cutoff) {
+		keep++
+	}
+	bt.outcomes = bt.outcomes[keep:]
+}
+
+func (bt *backendTracker) failureRate() (rate float64, samples int) {
+	failures := 0
+	for _, outcome := range bt.outcomes {
+		if !outcome.ok {
+			failures++
+		}
+	}
+	if len(bt.outcomes) == 0 {
+		return 0, 0
+	}
+	return float64(failures) / float64(len(bt.outcomes)), len(bt.outcomes)
+}
+
+// status returns the health of every backend that has been used, ordered by name
+//
+func (bh *backendHealth) status() (statuses []backendStatus, degraded bool) {
+	bh.Lock()
+	defer bh.Unlock()
+
+	now := time.Now()
+	statuses = make([]backendStatus, 0, len(bh.trackers))
+	for backend, tracker := range bh.trackers {
+		tracker.expire(now)
+		rate, samples := tracker.failureRate()
+		status := backendStatus{
+			Backend:     backend,
+			Degraded:    !tracker.degraded.IsZero(),
+			FailureRate: rate,
+			Samples:     samples,
+		}
+		if status.Degraded {
+			since := tracker.degraded
+			status.Since = &since
+			degraded = true
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Backend < statuses[j].Backend })
+	return statuses, degraded
+}
+
+// healthzStatus is the document returned by the healthz endpoint
+//
+type healthzStatus struct {
+	Host     string          `json:"host"`
+	Status   string          `json:"status"`
+	Backends []backendStatus `json:"backends"`
+	Canary   *canaryStatus   `json:"canary,omitempty"`
+	Clock    *clockStatus    `json:"clock,omitempty"`
+}
+
+// healthzHandler reports the health of the queue backends, of the canary experiment, and of
+// the clock, a service unavailable status is returned while any backend is degraded, until
+// the canary has passed, or while the clock is skewed
+//
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, degraded := backends.status()
+
+	doc := healthzStatus{
+		Host:     host,
+		Status:   "ok",
+		Backends: statuses,
+		Canary:   canary.get(),
+		Clock:    clock.get(),
+	}
+	if degraded {
+		doc.Status = "degraded"
+	}
+	ready := doc.Canary == nil || doc.Canary.Status == canaryPassed
+	if !ready {
+		doc.Status = "canary " + doc.Canary.Status
+	}
+	if doc.Clock != nil && doc.Clock.Skewed {
+		doc.Status = "clock skewed"
+		ready = false
+	}
+	if degraded || !ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, doc)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestBackendHealth checks that a backend is marked degraded once its failure rate exceeds the
+// threshold, that old failures age out of the window, and that sustained success recovers it
+//
+func TestBackendHealth(t *testing.T) {
+
+	bh := newBackendHealth()
+	start := time.Now().Add(-time.Hour)
+
+	degraded := func() bool {
+		bh.Lock()
+		defer bh.Unlock()
+		return !bh.trackers["sqs"].degraded.IsZero()
+	}
+
+	// Occasional failures do not degrade the backend
+	for i, ok := range []bool{true, false, true, true, false, true} {
+		bh.recordAt("sqs", ok, start.Add(time.Duration(i)*time.Second))
+	}
+	if degraded() {
+		t.Fatal("backend degraded by occasional failures")
+	}
+
+	// Failures that continue push the rate over the threshold
+	for i := 0; i != 6; i++ {
+		bh.recordAt("sqs", false, start.Add(time.Duration(10+i)*time.Second))
+	}
+	if !degraded() {
+		t.Fatal("backend not degraded by sustained failures")
+	}
+
+	// A single success is not enough to recover
+	bh.recordAt("sqs", true, start.Add(20*time.Second))
+	if !degraded() {
+		t.Fatal("backend recovered after a single success")
+	}
+	for i := 0; i != int(*backendRecoveryOpt); i++ {
+		bh.recordAt("sqs", true, start.Add(time.Duration(21+i)*time.Second))
+	}
+	if degraded() {
+		t.Fatal("backend not recovered after sustained successes")
+	}
+
+	// Failures outside of the window are forgotten
+	bh.recordAt("sqs", false, start.Add(*backendWindowOpt+time.Minute))
+	bh.Lock()
+	rate, samples := bh.trackers["sqs"].failureRate()
+	bh.Unlock()
+	if samples != 1 || rate != 1 {
+		t.Fatalf("outcomes outside of the window were kept, %d samples with a failure rate of %f", samples, rate)
+	}
+
+	// Only errors caused by the backend count against it, not those caused by its messages
+	for _, errGo := range []error{
+		&net.DNSError{Err: "no such host", Name: "sqs.us-west-2.amazonaws.com"},
+		fmt.Errorf("WRONGPASS invalid username-password pair"),
+	} {
+		if !backendFailure(errGo) {
+			t.Fatalf("%v was not counted as a backend failure", errGo)
+		}
+	}
+	for _, errGo := range []error{nil, fmt.Errorf("unexpected end of JSON input")} {
+		if backendFailure(errGo) {
+			t.Fatalf("%v was counted as a backend failure", errGo)
+		}
+	}
+
+	// The healthz endpoint reports degraded backends as unavailable
+	saved := backends
+	defer func() { backends = saved }()
+
+	backends = newBackendHealth()
+	for i := 0; i != int(*backendSamplesOpt); i++ {
+		backends.record("rmq", false)
+	}
+
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("degraded backend reported with status %d", recorder.Code)
+	}
+
+	backends = newBackendHealth()
+	recorder = httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("healthy runner reported with status %d", recorder.Code)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+// This file contains the implementation of the inspection and clearing of the backoffs the
+// runner is observing.  Backoffs are normally left to expire, however an operator that has
+// fixed the cause of a backoff, for example freeing disk space or repairing a dependency,
+// can clear it so that work is retrieved again without waiting.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/karlmutch/go-cache"
+)
+
+// backoffEntry is a backoff along with when it expires
+//
+type backoffEntry struct {
+	Key       string
+	Project   string
+	Queue     string
+	ExpiresAt time.Time
+}
+
+// listBackoffs returns the backoffs that have yet to expire ordered by their key
+//
+func listBackoffs() (entries []backoffEntry) {
+	now := time.Now()
+
+	items := snapshotBackoffs()
+
+	entries = make([]backoffEntry, 0, len(items))
+	for key, item := range items {
+		entry := backoffEntry{
+			Key: key,
+		}
+		if key != nodeBackoff {
+			parts := strings.SplitN(key, ":", 2)
+			entry.Project = parts[0]
+			if len(parts) == 2 {
+				entry.Queue = parts[1]
+			}
+		}
+		if item.Expiration > 0 {
+			entry.ExpiresAt = time.Unix(0, item.Expiration)
+		}
+		if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(now) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// snapshotBackoffs copies the contents of the backoffs cache.  The Items method of the cache
+// returns the map the cache continues to modify so instead the contents are serialized while
+// the cache holds its lock, allowing the producer and consumers to carry on using it.
+//
+func snapshotBackoffs() (items map[string]cache.Item) {
+	items = map[string]cache.Item{}
+
+	buffer := &bytes.Buffer{}
+	if errGo := backoffs.Save(buffer); errGo != nil {
+		logger.Warn("backoffs could not be listed", "error", errGo.Error())
+		return items
+	}
+	if errGo := gob.NewDecoder(buffer).Decode(&items); errGo != nil {
+		logger.Warn("backoffs could not be listed", "error", errGo.Error())
+	}
+	return items
+}
+
+// clearBackoffs removes the backoff with the supplied key, or every backoff when all is true,
+// and returns the keys of the backoffs that were removed.  Each removal is a single operation
+// on the cache so a backoff that is set again while clearing is in progress is treated as
+// having been set after the clear.
+//
+func clearBackoffs(key string, all bool) (cleared []string) {
+	cleared = []string{}
+
+	keys := []string{key}
+	if all {
+		keys = keys[:0]
+		for _, entry := range listBackoffs() {
+			keys = append(keys, entry.Key)
+		}
+	}
+
+	for _, key := range keys {
+		if _, isPresent := backoffs.Get(key); !isPresent {
+			continue
+		}
+		backoffs.Delete(key)
+		cleared = append(cleared, key)
+	}
+	sort.Strings(cleared)
+	return cleared
+}
@@ -0,0 +1,513 @@
+package main
+
+// This file contains the implementation of the 'benchmark' diagnostic command.  The command
+// runs a canned experiment on the node end-to-end using the same processor, storage, and
+// python virtualenv code paths as experiments received from queues and reports the time
+// taken by each phase, along with the utilization of any GPU given to the experiment.
+//
+// For example
+//
+//    runner benchmark
+//    runner --benchmark-pips=torch benchmark s3://s3.us-west-2.amazonaws.com/my-bucket
+//
+// Without a storage location the workspace of the experiment is fetched from the local file
+// system, otherwise it is first uploaded to the location given which is then used by the
+// experiment.  Credentials are found in the same way as for the 'artifact check' command.
+//
+// The workload exercises a GPU when pytorch is installed into the experiments environment,
+// using the benchmark-pips option, and a GPU is free on the node, otherwise the CPU is used.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/dustin/go-humanize"
+	"github.com/mholt/archiver"
+	"github.com/rs/xid"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	benchmarkWorkloadOpt = flag.Duration("benchmark-workload", time.Duration(30*time.Second), "the duration of the workload run by the benchmark command once its environment is built")
+	benchmarkPipsOpt     = flag.String("benchmark-pips", "", "a comma separated list of pips installed into the environment of the benchmark command, for example torch to exercise a GPU")
+	benchmarkPythonOpt   = flag.String("benchmark-python", "3", "the python version used by the benchmark command")
+	benchmarkSizeOpt     = flag.String("benchmark-artifact-size", "64MB", "the size of the data file included in the workspace fetched by the benchmark command")
+)
+
+const (
+	benchmarkScript = "benchmark.py"
+	benchmarkData   = "benchmark.bin"
+
+	// benchmarkWorkload is run by the experiment, it reports the device used and the number of
+	// iterations of its work that were completed
+	benchmarkWorkload = `import json
+import sys
+import time
+
+duration = float(sys.argv[1]) if len(sys.argv) > 1 else 30.0
+deadline = time.time() + duration
+
+
+def gpu():
+    try:
+        import torch
+    except ImportError:
+        return None
+    if not torch.cuda.is_available():
+        return None
+    a = torch.randn(4096, 4096, device='cuda')
+    iterations = 0
+    while time.time() < deadline:
+        torch.mm(a, a)
+        torch.cuda.synchronize()
+        iterations += 1
+    return iterations
+
+
+def cpu():
+    iterations = 0
+    while time.time() < deadline:
+        total = 0
+        for i in range(100000):
+            total += i * i
+        iterations += 1
+    return iterations
+
+
+device = 'gpu'
+iterations = gpu()
+if iterations is None:
+    device = 'cpu'
+    iterations = cpu()
+
+print(json.dumps({'studioml': {'benchmark': {'device': device, 'iterations': iterations}}}))
+sys.stdout.flush()
+`
+)
+
+// isBenchmark tests the command line arguments for the benchmark command
+//
+func isBenchmark(args []string) bool {
+	return len(args) != 0 && args[0] == "benchmark"
+}
+
+// benchmarkResult contains the timings for each phase of the benchmark experiment
+//
+type benchmarkResult struct {
+	upload   time.Duration // Time taken to upload the workspace, zero for local workspaces
+	fetch    time.Duration // Time taken by the experiment to fetch its workspace
+	build    time.Duration // Time taken from starting the experiment script to the workload starting
+	workload time.Duration // Time taken by the workload itself
+	total    time.Duration
+
+	artifactSize uint64
+
+	device     string // The device the workload used, cpu or gpu
+	iterations uint64 // The iterations of its work the workload completed
+
+	gpuSamples int  // The number of GPU utilization samples taken while the workload ran
+	gpuMean    uint // The mean GPU utilization, as a percentage, for the samples
+	gpuPeak    uint // The highest GPU utilization, as a percentage, seen in the samples
+
+	err errors.Error
+}
+
+// runBenchmark runs the benchmark experiment, using the optional storage location for its
+// workspace, and prints a report.  false is returned if the experiment failed.
+//
+func runBenchmark(ctx context.Context, targets []string) (ok bool) {
+
+	if len(targets) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: runner benchmark [s3://endpoint/bucket | gs://bucket]")
+		return false
+	}
+	target := ""
+	if len(targets) != 0 {
+		target = targets[0]
+	}
+
+	result := benchmark(ctx, target)
+
+	report := func(phase string, elapsed time.Duration, detail string) {
+		fmt.Println(strings.TrimRight(fmt.Sprintf("%-20s %12s  %s", phase, elapsed.Round(time.Millisecond), detail), " "))
+	}
+
+	if len(target) != 0 {
+		report("artifact upload", result.upload, throughputOf(result.artifactSize, result.upload))
+	}
+	report("artifact fetch", result.fetch, throughputOf(result.artifactSize, result.fetch))
+	report("environment build", result.build, "")
+	workload := ""
+	if len(result.device) != 0 {
+		workload = fmt.Sprintf("%d iterations on the %s (%.2f/s)", result.iterations, result.device, float64(result.iterations)/result.workload.Seconds())
+	}
+	report("workload", result.workload, workload)
+	report("total", result.total, "")
+
+	if result.gpuSamples == 0 {
+		fmt.Printf("%-20s %12s\n", "gpu utilization", "n/a")
+	} else {
+		fmt.Printf("%-20s %11d%%  peak %d%%, %d samples\n", "gpu utilization", result.gpuMean, result.gpuPeak, result.gpuSamples)
+	}
+
+	if result.err != nil {
+		fmt.Printf("%-20s %s\n", "FAILED", result.err.Error())
+		return false
+	}
+	return true
+}
+
+// throughputOf describes the rate at which a number of bytes was transferred
+//
+func throughputOf(size uint64, elapsed time.Duration) string {
+	if elapsed <= 0 || size == 0 {
+		return ""
+	}
+	return humanize.Bytes(uint64(float64(size)/elapsed.Seconds())) + "/s"
+}
+
+// benchmarkWorkspace creates the workspace for the benchmark experiment, a directory containing
+// the workload and a file of random data
+//
+func benchmarkWorkspace(dir string) (size uint64, err errors.Error) {
+
+	size, errGo := humanize.ParseBytes(*benchmarkSizeOpt)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("size", *benchmarkSizeOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo = os.MkdirAll(dir, 0700); errGo != nil {
+		return 0, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(dir, benchmarkScript), []byte(benchmarkWorkload), 0600); errGo != nil {
+		return 0, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	data, errGo := os.Create(filepath.Join(dir, benchmarkData))
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer data.Close()
+
+	if _, errGo = io.CopyN(data, rand.Reader, int64(size)); errGo != nil {
+		return 0, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// benchmarkRequest produces the request for the benchmark experiment
+//
+func benchmarkRequest(workspace runner.Artifact, env map[string]string) (rqst *runner.Request) {
+
+	rqst = &runner.Request{}
+
+	rqst.Config.Database.ProjectId = "benchmark"
+	rqst.Config.Env = env
+
+	rqst.Experiment.Key = "benchmark-" + xid.New().String()
+	rqst.Experiment.Project = "benchmark"
+	rqst.Experiment.Filename = benchmarkScript
+	rqst.Experiment.Args = []string{strconv.FormatFloat(benchmarkWorkloadOpt.Seconds(), 'f', -1, 64)}
+	rqst.Experiment.PythonVer = json.Number(*benchmarkPythonOpt)
+	rqst.Experiment.MaxDuration = (*benchmarkWorkloadOpt + time.Hour).String()
+	rqst.Experiment.Artifacts = map[string]runner.Artifact{
+		"workspace": workspace,
+	}
+
+	for _, pip := range strings.Split(*benchmarkPipsOpt, ",") {
+		if pip = strings.TrimSpace(pip); len(pip) != 0 {
+			rqst.Experiment.Pythonenv = append(rqst.Experiment.Pythonenv, pip)
+		}
+	}
+
+	// A GPU is requested only when the node has one
+	rqst.Experiment.Resource = runner.Resource{
+		Cpus: 1,
+		Ram:  "2gb",
+		Hdd:  "10gb",
+	}
+	if runner.GPUCount() != 0 {
+		rqst.Experiment.Resource.Gpus = 1
+	}
+
+	return rqst
+}
+
+func benchmark(ctx context.Context, target string) (result *benchmarkResult) {
+
+	result = &benchmarkResult{}
+
+	benchStart := time.Now()
+	defer func() {
+		result.total = time.Since(benchStart)
+	}()
+
+	// The resources used by the experiment are limited in the same way as a runner would be
+	limitCores, limitMem, limitDisk, errGo := resourceLimits()
+	if errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	if errGo = runner.SetCPULimits(limitCores, limitMem); errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	if _, errGo = runner.SetDiskLimits(*tempOpt, limitDisk); errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+
+	workDir, errGo := ioutil.TempDir("", "benchmark")
+	if errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+	defer os.RemoveAll(workDir)
+
+	wsDir := filepath.Join(workDir, "workspace")
+	size, err := benchmarkWorkspace(wsDir)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.artifactSize = size
+
+	// Prepare the workspace artifact, either as a local archive, or uploaded to the storage
+	// location being benchmarked
+	workspace := runner.Artifact{}
+	env := map[string]string{}
+	creds := ""
+	if len(target) == 0 {
+		archive := filepath.Join(workDir, "workspace.tar")
+		if errGo = archiver.Tar.Make(archive, []string{filepath.Join(wsDir, benchmarkScript), filepath.Join(wsDir, benchmarkData)}); errGo != nil {
+			result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+			return result
+		}
+		workspace.Key = archive
+		workspace.Qualified = "file://" + archive
+	} else {
+		key := "studioml-runner-benchmark/" + host + "/workspace.tar"
+		opts, err := artifactCheckOpts(target, key)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		storage, err := runner.NewStorage(ctx, opts)
+		if err != nil {
+			result.err = err
+			return result
+		}
+		start := time.Now()
+		_, err = storage.Deposit(ctx, wsDir, key)
+		storage.Close()
+		if err != nil {
+			result.err = err
+			return result
+		}
+		result.upload = time.Since(start)
+
+		workspace = *opts.Art
+		env = opts.Env
+		creds = opts.Creds
+	}
+	workspace.Unpack = true
+
+	msg, errGo := json.Marshal(benchmarkRequest(workspace, env))
+	if errGo != nil {
+		result.err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return result
+	}
+
+	// From here on the experiment is handled as if it had arrived from a queue
+	p, err := newProcessor(ctx, "benchmark", msg, creds)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer func() {
+		p.Close()
+		tempRoot.Lock()
+		os.RemoveAll(tempRoot.dir)
+		tempRoot.Unlock()
+	}()
+
+	alloc, err := p.allocate()
+	if err != nil {
+		result.err = err
+		return result
+	}
+	defer p.deallocate(alloc)
+
+	p.applyEnv(alloc)
+
+	start := time.Now()
+	if result.err = p.fetchAll(ctx); result.err != nil {
+		return result
+	}
+	result.fetch = time.Since(start)
+
+	// GPU utilization is sampled for the whole run and then narrowed to the workload
+	sampleCtx, stopSampling := context.WithCancel(ctx)
+	samplesC := make(chan []gpuSample, 1)
+	go func() {
+		samplesC <- sampleGPUs(sampleCtx, alloc.GPU.UUIDs(), time.Second)
+	}()
+
+	start = time.Now()
+	result.err = p.run(ctx, alloc, "benchmark")
+
+	stopSampling()
+	samples := <-samplesC
+
+	phases, err := benchmarkPhases(filepath.Join(p.ExprDir, "output", "output"))
+	if err != nil {
+		if result.err == nil {
+			result.err = err
+		}
+		return result
+	}
+	if !phases.started.IsZero() {
+		result.build = phases.started.Sub(start)
+		if !phases.stopped.IsZero() {
+			result.workload = phases.stopped.Sub(phases.started)
+		}
+	}
+	result.device = phases.device
+	result.iterations = phases.iterations
+	result.gpuSamples, result.gpuMean, result.gpuPeak = gpuSummary(samples, phases.started, phases.stopped)
+
+	return result
+}
+
+// benchmarkOutput contains the details of the benchmark experiment found in its output
+//
+type benchmarkOutput struct {
+	started time.Time
+	stopped time.Time
+
+	device     string
+	iterations uint64
+}
+
+// benchmarkPhases extracts the start and stop times of the workload from the experiment output,
+// along with the report made by the workload
+//
+func benchmarkPhases(outputFN string) (phases *benchmarkOutput, err errors.Error) {
+
+	output, errGo := os.Open(outputFN)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("output", outputFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer output.Close()
+
+	phases = &benchmarkOutput{}
+
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		doc := struct {
+			Studioml struct {
+				StartTime string `json:"start_time"`
+				StopTime  string `json:"stop_time"`
+				Benchmark *struct {
+					Device     string `json:"device"`
+					Iterations uint64 `json:"iterations"`
+				} `json:"benchmark"`
+			} `json:"studioml"`
+		}{}
+		if errGo = json.Unmarshal(line, &doc); errGo != nil {
+			continue
+		}
+		if len(doc.Studioml.StartTime) != 0 {
+			phases.started, _ = time.Parse(time.RFC3339Nano, doc.Studioml.StartTime)
+		}
+		if len(doc.Studioml.StopTime) != 0 {
+			phases.stopped, _ = time.Parse(time.RFC3339Nano, doc.Studioml.StopTime)
+		}
+		if doc.Studioml.Benchmark != nil {
+			phases.device = doc.Studioml.Benchmark.Device
+			phases.iterations = doc.Studioml.Benchmark.Iterations
+		}
+	}
+	if errGo = scanner.Err(); errGo != nil {
+		return nil, errors.Wrap(errGo).With("output", outputFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	return phases, nil
+}
+
+// gpuSample is the mean utilization of the GPUs given to the experiment at a point in time
+//
+type gpuSample struct {
+	at   time.Time
+	util uint
+}
+
+// sampleGPUs periodically samples the utilization of the identified GPUs until the context is
+// cancelled
+//
+func sampleGPUs(ctx context.Context, uuids []string, interval time.Duration) (samples []gpuSample) {
+
+	if len(uuids) == 0 {
+		return samples
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			utils, err := runner.GPUUtilization()
+			if err != nil {
+				continue
+			}
+			total := uint(0)
+			for _, uuid := range uuids {
+				total += utils[uuid]
+			}
+			samples = append(samples, gpuSample{at: time.Now(), util: total / uint(len(uuids))})
+		case <-ctx.Done():
+			return samples
+		}
+	}
+}
+
+// gpuSummary returns the mean and peak utilization for samples taken while the workload was
+// running
+//
+func gpuSummary(samples []gpuSample, from time.Time, to time.Time) (count int, mean uint, peak uint) {
+	total := uint(0)
+	for _, sample := range samples {
+		if sample.at.Before(from) || (!to.IsZero() && sample.at.After(to)) {
+			continue
+		}
+		count++
+		total += sample.util
+		if sample.util > peak {
+			peak = sample.util
+		}
+	}
+	if count != 0 {
+		mean = total / uint(count)
+	}
+	return count, mean, peak
+}
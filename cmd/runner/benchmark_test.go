@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestBenchmarkPhases checks that the phases of the benchmark experiment are recovered from its
+// output, and that GPU utilization is summarized only for the time the workload was running
+//
+func TestBenchmarkPhases(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "benchmark")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	output := `+ pip freeze
+{"studioml":{"start_time":"2020-01-02T03:04:05.000000000+00:00"}}
+{"studioml":{"host":"node-1"}}
+{"studioml": {"benchmark": {"device": "gpu", "iterations": 1200}}}
+0
+{"studioml":{"stop_time":"2020-01-02T03:04:35.500000000+00:00"}}
+`
+	fn := filepath.Join(dir, "output")
+	if errGo = ioutil.WriteFile(fn, []byte(output), 0600); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	phases, err := benchmarkPhases(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := phases.stopped.Sub(phases.started); elapsed != 30500*time.Millisecond {
+		t.Fatalf("unexpected workload duration %v", elapsed)
+	}
+	if phases.device != "gpu" || phases.iterations != 1200 {
+		t.Fatalf("unexpected workload report %+v", *phases)
+	}
+
+	// Samples taken while the environment was being built are ignored
+	samples := []gpuSample{
+		{at: phases.started.Add(-time.Second), util: 0},
+		{at: phases.started.Add(time.Second), util: 80},
+		{at: phases.started.Add(2 * time.Second), util: 100},
+		{at: phases.stopped.Add(time.Second), util: 0},
+	}
+	count, mean, peak := gpuSummary(samples, phases.started, phases.stopped)
+	if count != 2 || mean != 90 || peak != 100 {
+		t.Fatalf("unexpected utilization %d samples, mean %d, peak %d", count, mean, peak)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+// This file contains the implementation of the leases used to mark subscriptions as busy
+// while a worker is servicing them.  Leases are renewed by the work being done for the
+// worker as it makes progress, such as a message being received or an experiment being
+// started, rather than on a timer.  A reaper clears leases that have not
+// been renewed, so that a worker that stopped, or hung, without releasing its subscription
+// cannot leave the subscription starved of workers forever.
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+var (
+	busyLeaseOpt = flag.Duration("busy-lease", time.Minute, "the period after which a subscription marked busy by a worker that has stopped making progress is released")
+)
+
+// busyLease records a worker holding a subscription
+//
+type busyLease struct {
+	acquired time.Time
+	renewed  time.Time
+}
+
+// acquire marks a subscription as busy, false is returned if it already was
+//
+func (sb *SubsBusy) acquire(key string) (lease *busyLease, ok bool) {
+	sb.Lock()
+	defer sb.Unlock()
+
+	if _, busy := sb.subs[key]; busy {
+		return nil, false
+	}
+	now := time.Now()
+	lease = &busyLease{acquired: now, renewed: now}
+	sb.subs[key] = lease
+	return lease, true
+}
+
+// release frees a subscription, the lease is only removed if it has not already been reaped
+// and the subscription acquired by another worker
+//
+func (sb *SubsBusy) release(key string, lease *busyLease) {
+	sb.Lock()
+	defer sb.Unlock()
+
+	if sb.subs[key] == lease {
+		delete(sb.subs, key)
+	}
+}
+
+// renew records that the worker holding a lease is still making progress
+//
+func (sb *SubsBusy) renew(lease *busyLease) {
+	sb.Lock()
+	lease.renewed = time.Now()
+	sb.Unlock()
+}
+
+// busyLeaseKey is the key of the lease carried by the context of a worker
+//
+type busyLeaseKey struct{}
+
+// withLease returns a context carrying the lease of a worker so that the work done for the
+// worker can renew it using progressed
+//
+func withLease(ctx context.Context, lease *busyLease) (leased context.Context) {
+	return context.WithValue(ctx, busyLeaseKey{}, lease)
+}
+
+// progressed renews the lease carried by the context, if any, and is called as the work done
+// for a worker makes progress
+//
+func progressed(ctx context.Context) {
+	if lease, isPresent := ctx.Value(busyLeaseKey{}).(*busyLease); isPresent {
+		busyQs.renew(lease)
+	}
+}
+
+// reap releases subscriptions whose leases have not been renewed within the ttl
+//
+func (sb *SubsBusy) reap(ttl time.Duration) (reaped map[string]time.Duration) {
+	sb.Lock()
+	defer sb.Unlock()
+
+	reaped = map[string]time.Duration{}
+	for key, lease := range sb.subs {
+		if time.Since(lease.renewed) > ttl {
+			reaped[key] = time.Since(lease.acquired)
+			delete(sb.subs, key)
+		}
+	}
+	return reaped
+}
+
+// reapBusy periodically clears stale busy subscriptions along with expired backoffs
+//
+func reapBusy(ctx context.Context, ttl time.Duration) {
+	sweep := time.NewTicker(ttl / 2)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-sweep.C:
+			backoffs.DeleteExpired()
+
+			for key, held := range busyQs.reap(ttl) {
+				logger.Warn("stale busy subscription released", "subscription", key, "held", held.Round(time.Second).String())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestBusyLease checks that subscriptions held by workers making progress are kept busy while
+// those whose workers have stopped renewing their leases are released
+//
+func TestBusyLease(t *testing.T) {
+	sb := &SubsBusy{subs: map[string]*busyLease{}}
+
+	live, ok := sb.acquire("project:live")
+	if !ok {
+		t.Fatal("free subscription could not be acquired")
+	}
+	if _, ok = sb.acquire("project:live"); ok {
+		t.Fatal("busy subscription was acquired a second time")
+	}
+	stale, _ := sb.acquire("project:stale")
+
+	// Only the worker making progress renews its lease
+	for i := 0; i != 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		sb.renew(live)
+	}
+
+	reaped := sb.reap(50 * time.Millisecond)
+	if _, isPresent := reaped["project:stale"]; !isPresent || len(reaped) != 1 {
+		t.Fatalf("expected only the stale subscription to be reaped, %v", reaped)
+	}
+
+	// Once reaped the subscription can be acquired by another worker, the original worker
+	// releasing it late must not free it from under the new one
+	replacement, ok := sb.acquire("project:stale")
+	if !ok {
+		t.Fatal("reaped subscription could not be acquired")
+	}
+	sb.release("project:stale", stale)
+	if _, ok = sb.acquire("project:stale"); ok {
+		t.Fatal("late release freed a subscription held by another worker")
+	}
+	sb.release("project:stale", replacement)
+	if _, ok = sb.acquire("project:stale"); !ok {
+		t.Fatal("released subscription could not be acquired")
+	}
+}
+
+// TestBusyProgress checks that the lease carried by the context of a worker is renewed by
+// the progress of the work being done
+//
+func TestBusyProgress(t *testing.T) {
+	lease, ok := busyQs.acquire("project:progress")
+	if !ok {
+		t.Fatal("free subscription could not be acquired")
+	}
+	defer busyQs.release("project:progress", lease)
+
+	lease.renewed = time.Now().Add(-time.Hour)
+	progressed(context.Background())
+	if time.Since(lease.renewed) < time.Minute {
+		t.Fatal("lease renewed by work for another worker")
+	}
+	progressed(withLease(context.Background(), lease))
+	if time.Since(lease.renewed) > time.Minute {
+		t.Fatal("lease not renewed by progress")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+// This file contains the implementation of the experiment completion webhook.  Experiments
+// can supply a callbackURL, or webhook notify destinations, within their configuration and
+// once the experiment has finished the completion event is POSTed to them as a JSON document.  When the runner has been given
+// a callback secret the document is signed using HMAC-SHA256 and the signature is placed in
+// the X-Studioml-Signature header as 'sha256=<hex digest>' so that receivers can check the
+// callback came from a runner.
+//
+// The URLs come from experiments so the runner refuses to send callbacks to addresses that
+// are not public, such as loopback, private networks, and the link local metadata services of
+// cloud providers.  Names are checked once resolved, and again for the address connected to,
+// so that a name cannot be changed to a private address between the two.  Operators can
+// instead restrict callbacks to a list of hosts, which are then trusted wherever they resolve.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	callbackSecretOpt   = flag.String("callback-secret", "", "a secret used to sign the experiment completion callbacks sent to the callbackURL of experiments")
+	callbackAttemptsOpt = flag.Int("callback-attempts", 3, "the number of times an experiment completion callback is attempted before giving up")
+	callbackAllowOpt    = flag.String("callback-allow", "", "an optional comma separated list of the hosts experiment callbacks and notifications can be sent to, names starting with a '.' match any sub domain, when empty any host with a public address can be used")
+
+	// callbackClient connects directly to the receiver, rather than through any proxy, so that
+	// the addresses connected to can be checked, and does not follow redirects
+	callbackClient = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         callbackDial,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+const (
+	callbackSignatureHeader = "X-Studioml-Signature"
+)
+
+// callbackSignature returns the value of the signature header for a callback body
+//
+func callbackSignature(secret string, body []byte) (signature string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendCallback POSTs the completion event to a webhook URL
+//
+func sendCallback(url string, event *resultEvent, attempts int, delay time.Duration) (err errors.Error) {
+	body, errGo := json.Marshal(event)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return deliver(url, body, attempts, delay)
+}
+
+// deliver POSTs a JSON document to a URL retrying failures that might succeed if repeated,
+// with the delay between attempts doubling each time
+//
+func deliver(url string, body []byte, attempts int, delay time.Duration) (err errors.Error) {
+	for attempt := 1; ; attempt++ {
+		retry, err := postCallback(url, body)
+		if err == nil || !retry || attempt >= attempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// callbackAllowed tests if the host is one the operator allows callbacks to be sent to, the
+// host of the slack-hook option is always allowed
+//
+func callbackAllowed(host string) (allowed bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if hook, errGo := url.Parse(*slackHookOpt); errGo == nil && len(hook.Hostname()) != 0 && strings.ToLower(hook.Hostname()) == host {
+		return true
+	}
+	for _, permitted := range strings.Split(*callbackAllowOpt, ",") {
+		if permitted = strings.ToLower(strings.TrimSpace(permitted)); len(permitted) == 0 {
+			continue
+		}
+		if host == permitted {
+			return true
+		}
+		if strings.HasPrefix(permitted, ".") && (strings.HasSuffix(host, permitted) || host == permitted[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCallbackURL tests that a callback can be sent to the URL, the host must either be
+// allowed by the operator, or when no hosts are listed resolve only to public addresses
+//
+func checkCallbackURL(callback string) (err errors.Error) {
+	uri, errGo := url.Parse(callback)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", callback).With("stack", stack.Trace().TrimRuntime())
+	}
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return errors.New("callback URLs must use http or https").With("url", callback).With("stack", stack.Trace().TrimRuntime())
+	}
+	if callbackAllowed(uri.Hostname()) {
+		return nil
+	}
+	if len(strings.TrimSpace(*callbackAllowOpt)) != 0 {
+		return errors.New("callback host is not in callback-allow").With("url", callback).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	addrs, errGo := net.LookupIP(uri.Hostname())
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", callback).With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, addr := range addrs {
+		if !runner.IsPublic(addr) {
+			return errors.New("callback host does not have a public address").With("url", callback, "address", addr.String()).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// callbackDial connects to callback receivers, refusing addresses that are not public for
+// hosts the operator has not allowed
+//
+func callbackDial(ctx context.Context, network string, addr string) (conn net.Conn, errGo error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if host, _, errGo := net.SplitHostPort(addr); errGo != nil || !callbackAllowed(host) {
+		dialer.Control = runner.PublicOnly
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// postCallback makes a single attempt to deliver the callback, retry is true if the
+// failure might succeed if repeated
+//
+func postCallback(url string, body []byte) (retry bool, err errors.Error) {
+	if err = checkCallbackURL(url); err != nil {
+		return false, err
+	}
+
+	req, errGo := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if errGo != nil {
+		return false, errors.Wrap(errGo).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(*callbackSecretOpt) != 0 {
+		req.Header.Set(callbackSignatureHeader, callbackSignature(*callbackSecretOpt, body))
+	}
+
+	resp, errGo := callbackClient.Do(req)
+	if errGo != nil {
+		return true, errors.Wrap(errGo).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			errors.New(fmt.Sprintf("callback returned %s", resp.Status)).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	return false, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestCallback checks that completion callbacks are signed and retried when the receiver
+// fails temporarily
+//
+func TestCallback(t *testing.T) {
+
+	secret, allow := *callbackSecretOpt, *callbackAllowOpt
+	*callbackSecretOpt, *callbackAllowOpt = "test-secret", "127.0.0.1"
+	defer func() {
+		*callbackSecretOpt, *callbackAllowOpt = secret, allow
+	}()
+
+	attempts := 0
+	signed := false
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		signed = r.Header.Get(callbackSignatureHeader) == callbackSignature("test-secret", body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	event := &resultEvent{Key: "experiment", Status: resultCompleted}
+	if err := sendCallback(receiver.URL, event, 3, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, %d were made", attempts)
+	}
+	if !signed {
+		t.Fatal("callback signature did not match")
+	}
+
+	// Callbacks rejected by the receiver are not retried
+	attempts = 0
+	rejecter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer rejecter.Close()
+
+	if err := sendCallback(rejecter.URL, event, 3, 10*time.Millisecond); err == nil {
+		t.Fatal("rejected callback was reported as delivered")
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 attempt, %d were made", attempts)
+	}
+}
+
+// TestCallbackAddresses checks that callbacks are not sent to addresses that are not public,
+// such as the runner itself or cloud metadata services, unless the operator allows the host,
+// and that only the hosts the operator lists can be used once any are listed
+//
+func TestCallbackAddresses(t *testing.T) {
+	allow := *callbackAllowOpt
+	defer func() { *callbackAllowOpt = allow }()
+
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	event := &resultEvent{Key: "experiment", Status: resultCompleted}
+
+	*callbackAllowOpt = ""
+	for _, target := range []string{receiver.URL, "http://169.254.169.254/latest/meta-data/", "http://10.1.2.3/", "http://[::1]/", "http://100.100.100.200/", "file:///etc/passwd"} {
+		if err := sendCallback(target, event, 3, 10*time.Millisecond); err == nil {
+			t.Fatalf("callback to %s was sent", target)
+		}
+	}
+	if attempts != 0 {
+		t.Fatalf("callback reached a loopback receiver %d times", attempts)
+	}
+
+	// The dialer refuses addresses that are not public even when the name was not checked
+	if _, errGo := callbackClient.Get(receiver.URL); errGo == nil {
+		t.Fatal("callback client connected to a loopback address")
+	}
+
+	*callbackAllowOpt = "127.0.0.1"
+	if err := sendCallback(receiver.URL, event, 3, 10*time.Millisecond); err != nil || attempts != 1 {
+		t.Fatalf("callback to an allowed host failed %v", err)
+	}
+	*callbackAllowOpt = ".example.com"
+	if err := checkCallbackURL("https://hooks.example.com/done"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCallbackURL("https://example.org/done"); err == nil {
+		t.Fatal("callback to a host that is not allowed was accepted")
+	}
+}
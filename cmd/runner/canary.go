@@ -0,0 +1,206 @@
+package main
+
+// This file contains the implementation of the canary experiment that can be run when the
+// runner starts.  The canary is a small experiment supplied by the operator, for example one
+// that builds a virtualenv, imports a framework, and touches the GPU, that is run using the
+// same code paths as experiments received from queues.  The queues are only serviced once the
+// canary has succeeded so that a node with a broken environment does not take work it would
+// fail.  Until then the healthz endpoint reports the runner as not ready, and should the
+// canary fail the runner remains not ready and the failure is sent to the destinations the
+// canary request asks to be notified at.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/rs/xid"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	canaryRequestOpt = flag.String("canary-request", "", "the file name of a StudioML request for a small experiment run at startup, the queues are only serviced once it succeeds, by default no canary is run")
+	canaryTimeoutOpt = flag.Duration("canary-timeout", 30*time.Minute, "the maximum time the canary experiment can take to build its environment and run")
+
+	canary = &canaryState{}
+)
+
+const (
+	canaryPending = "pending"
+	canaryPassed  = "passed"
+	canaryFailed  = "failed"
+)
+
+// canaryStatus is the outcome of the canary experiment as reported by the healthz endpoint
+//
+type canaryStatus struct {
+	Status     string     `json:"status"`
+	Key        string     `json:"experiment_key"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// canaryState tracks the canary experiment, if one was configured
+//
+type canaryState struct {
+	status *canaryStatus
+	sync.Mutex
+}
+
+// get returns the state of the canary, nil if no canary was configured
+//
+func (cs *canaryState) get() (status *canaryStatus) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.status == nil {
+		return nil
+	}
+	result := *cs.status
+	return &result
+}
+
+func (cs *canaryState) set(status *canaryStatus) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.status = status
+}
+
+// loadCanary reads and validates the canary request, nil is returned when no canary was
+// configured.  It is called during startup so that a request that cannot be used is caught
+// along with other option errors.
+//
+func loadCanary() (rqst *runner.Request, err errors.Error) {
+	if len(*canaryRequestOpt) == 0 {
+		return nil, nil
+	}
+
+	data, errGo := ioutil.ReadFile(*canaryRequestOpt)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "canary-request could not be read").With("file", *canaryRequestOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if rqst, err = runner.UnmarshalRequest(data); err != nil {
+		return nil, err.With("file", *canaryRequestOpt)
+	}
+	if err = rqst.Validate(); err != nil {
+		return nil, err.With("file", *canaryRequestOpt)
+	}
+	return rqst, nil
+}
+
+// startAfterCanary calls start once the canary experiment has succeeded, or immediately when
+// no canary was configured
+//
+func startAfterCanary(ctx context.Context, rqst *runner.Request, start func()) {
+	if rqst == nil {
+		start()
+		return
+	}
+
+	// Each run of the canary has a key of its own so that its directories are not reused
+	rqst.Experiment.Key = "canary-" + xid.New().String()
+
+	canary.set(&canaryStatus{
+		Status:    canaryPending,
+		Key:       rqst.Experiment.Key,
+		StartedAt: time.Now(),
+	})
+	logger.Info("canary experiment started, queues will be serviced once it succeeds", "experiment_id", rqst.Experiment.Key)
+
+	go func() {
+		canaryCtx, cancel := context.WithTimeout(ctx, *canaryTimeoutOpt)
+		defer cancel()
+
+		err := runCanary(canaryCtx, rqst)
+		finished := time.Now()
+
+		status := canary.get()
+		status.FinishedAt = &finished
+
+		if err != nil {
+			// The runner is stopping so the failure says nothing about the node
+			if ctx.Err() != nil {
+				return
+			}
+			status.Status = canaryFailed
+			status.Error = err.Error()
+			canary.set(status)
+
+			logger.Error("canary experiment failed, queues will not be serviced", "experiment_id", rqst.Experiment.Key, "error", err.Error())
+			notify(canaryEvent(rqst, status))
+			return
+		}
+
+		status.Status = canaryPassed
+		canary.set(status)
+
+		logger.Info("canary experiment passed", "experiment_id", rqst.Experiment.Key, "duration", finished.Sub(status.StartedAt).Round(time.Second).String())
+		start()
+	}()
+}
+
+// runCanary runs the canary experiment in the same way the benchmark command runs its
+// experiment, the artifacts of the experiment are fetched but nothing is returned.  The
+// directory of a failed canary is kept so that its output can be examined.
+//
+func runCanary(ctx context.Context, rqst *runner.Request) (err errors.Error) {
+	msg, errGo := json.Marshal(rqst)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	p, err := newProcessor(ctx, "canary", msg, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			p.Close()
+			return
+		}
+		activeExprs.remove(p.ExprDir)
+		logger.Info("canary experiment kept", "dir", p.ExprDir)
+	}()
+
+	alloc, err := p.allocate()
+	if err != nil {
+		return err
+	}
+	defer p.deallocate(alloc)
+
+	p.applyEnv(alloc)
+
+	if err = p.fetchAll(ctx); err != nil {
+		return err
+	}
+	return p.run(ctx, alloc, "canary")
+}
+
+// canaryEvent describes the outcome of the canary to the notification destinations
+//
+func canaryEvent(rqst *runner.Request, status *canaryStatus) (event *resultEvent) {
+	event = &resultEvent{
+		Key:       status.Key,
+		Project:   "canary",
+		Host:      host,
+		Status:    status.Status,
+		ExitCode:  -1,
+		Error:     status.Error,
+		StartedAt: status.StartedAt,
+		notify:    rqst.NotifyDestinations(),
+	}
+	if status.FinishedAt != nil {
+		event.FinishedAt = *status.FinishedAt
+		event.Duration = status.FinishedAt.Sub(status.StartedAt).Seconds()
+	}
+	return event
+}
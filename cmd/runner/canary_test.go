@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestCanary checks that the queues are started at once without a canary, and that a canary
+// that fails leaves the queues stopped, the runner not ready, and sends a notification
+//
+func TestCanary(t *testing.T) {
+
+	started := false
+	startAfterCanary(context.Background(), nil, func() { started = true })
+	if !started {
+		t.Fatal("queues not started without a canary")
+	}
+
+	eventC := make(chan resultEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := resultEvent{}
+		if errGo := json.NewDecoder(r.Body).Decode(&event); errGo == nil {
+			eventC <- event
+		}
+	}))
+	defer webhook.Close()
+
+	allow := *callbackAllowOpt
+	*callbackAllowOpt = "127.0.0.1"
+	defer func() { *callbackAllowOpt = allow }()
+
+	dir, errGo := ioutil.TempDir("", "canary")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// The workspace of the canary does not exist so it fails before its environment is built
+	fn := filepath.Join(dir, "canary.json")
+	rqst := `{"config": {"notify": {"webhook": ["` + webhook.URL + `"]}},
+	"experiment": {"key": "canary", "filename": "canary.py", "pythonver": "3.6",
+		"resources_needed": {"cpus": 1, "hdd": "1gb", "ram": "1gb"},
+		"artifacts": {"workspace": {"qualified": "file://` + filepath.Join(dir, "missing.tar") + `", "key": "` + filepath.Join(dir, "missing.tar") + `", "unpack": true}}}}`
+	if errGo = ioutil.WriteFile(fn, []byte(rqst), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	saved := *canaryRequestOpt
+	defer func() {
+		*canaryRequestOpt = saved
+		canary.set(nil)
+	}()
+	*canaryRequestOpt = fn
+
+	canaryRqst, err := loadCanary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started = false
+	startAfterCanary(context.Background(), canaryRqst, func() { started = true })
+
+	select {
+	case event := <-eventC:
+		if event.Status != canaryFailed || event.Key != canaryRqst.Experiment.Key {
+			t.Fatalf("unexpected canary notification %+v", event)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("canary failure not notified")
+	}
+	if started {
+		t.Fatal("queues started after the canary failed")
+	}
+
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	doc := healthzStatus{}
+	if errGo = json.NewDecoder(recorder.Body).Decode(&doc); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if recorder.Code != http.StatusServiceUnavailable || doc.Status != "canary failed" || doc.Canary == nil || len(doc.Canary.Error) == 0 {
+		t.Fatalf("failed canary reported with status %d %+v", recorder.Code, doc)
+	}
+}
+
+// TestCanaryScript checks that experiments run directly by the canary and benchmark, rather
+// than from a queue, have the script that runs them generated with the studioml directories
+//
+func TestCanaryScript(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "canary-script")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	workspace := filepath.Join(dir, "workspace.tar")
+	f, errGo := os.Create(workspace)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	script := []byte("print('canary')\n")
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "canary.py", Mode: 0600, Size: int64(len(script))})
+	tw.Write(script)
+	tw.Close()
+	f.Close()
+
+	rqst := benchmarkRequest(runner.Artifact{Qualified: "file://" + workspace, Key: workspace, Unpack: true}, nil)
+	rqst.Experiment.Filename = "canary.py"
+	msg, errGo := json.Marshal(rqst)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	// The same steps as runCanary, the experiment is stopped as soon as its script is written
+	p, err := newProcessor(context.Background(), "canary", msg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	alloc, err := p.allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.deallocate(alloc)
+	p.applyEnv(alloc)
+
+	if err = p.fetchAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx, alloc, "canary")
+
+	if p.StudioDirs == nil {
+		t.Fatal("studioml directories not created")
+	}
+	data, errGo := ioutil.ReadFile(filepath.Join(p.ExprDir, "_runner", "runner.sh"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.Contains(string(data), "export STUDIOML_HOME="+p.StudioDirs.Home) {
+		t.Fatal("studioml directories missing from the experiment script")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// This file contains the implementation of the per queue ceiling on how long a single message
+// can be processed for.  The ceiling is enforced independently of the limits the experiment
+// asks for so that requests with unreasonable durations cannot hold the resources of a
+// node indefinitely.  Experiments stopped by the ceiling are dumped, rather than retried,
+// as they would be stopped in the same way on every attempt.
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// processingCeiling stops an experiment once the processing timeout of its queue has passed
+//
+type processingCeiling struct {
+	timeout  time.Duration
+	timer    *time.Timer
+	exceeded int32
+}
+
+// startCeiling arms the processing timeout of the queue for an experiment, the cancel function
+// is called when the timeout passes.  A nil ceiling is returned when the queue has no timeout.
+//
+func startCeiling(queue string, rqst *runner.Request, cancel context.CancelFunc) (ceiling *processingCeiling) {
+	timeout := queueCfgs.processingTimeout(queue)
+	if timeout <= 0 {
+		return nil
+	}
+
+	// Make it clear when the ceiling is shorter than what the experiment asked for
+	asked := rqst.Experiment.MaxDuration
+	if limit, errGo := time.ParseDuration(asked); errGo != nil || limit > timeout {
+		if len(asked) == 0 {
+			asked = "none"
+		}
+		logger.Info("queue processing timeout overrides the experiment max_duration", "queue", queue, "experiment_id", rqst.Experiment.Key,
+			"processing_timeout", timeout.String(), "max_duration", asked)
+	}
+
+	ceiling = &processingCeiling{timeout: timeout}
+	ceiling.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&ceiling.exceeded, 1)
+		logger.Warn("queue processing timeout exceeded, stopping experiment", "queue", queue, "experiment_id", rqst.Experiment.Key,
+			"processing_timeout", timeout.String())
+		cancel()
+	})
+	return ceiling
+}
+
+// stop disarms the ceiling once processing of the message has finished
+//
+func (ceiling *processingCeiling) stop() {
+	if ceiling != nil {
+		ceiling.timer.Stop()
+	}
+}
+
+// wasExceeded returns true when the experiment was stopped by the ceiling
+//
+func (ceiling *processingCeiling) wasExceeded() (exceeded bool) {
+	return ceiling != nil && atomic.LoadInt32(&ceiling.exceeded) != 0
+}
@@ -0,0 +1,131 @@
+package main
+
+// This file contains the implementation of the watcher for the checkpoint directories that
+// experiments can name.  While the experiment runs the directory is polled and whenever new
+// checkpoints have appeared the newest are uploaded using the checkpoint artifact.  This is
+// more targeted than the periodic saving of the mutable artifacts, which for the workspace
+// would mean snapshotting everything.  On a later run of the experiment the checkpoints are
+// restored before it starts.
+
+import (
+	"context"
+	"flag"
+	"path/filepath"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/karlmutch/errors"
+)
+
+var (
+	checkpointPollOpt = flag.Duration("checkpoint-poll", 30*time.Second, "the interval at which the checkpoint directories of experiments are checked for new checkpoints, files modified within the interval are treated as still being written")
+)
+
+// watchesCheckpoints returns true when the artifact group is returned by the checkpoint
+// watcher rather than along with the other mutable artifacts
+//
+func (p *processor) watchesCheckpoints(group string) (watched bool) {
+	return group == runner.CheckpointGroup && p.Request.Experiment.Checkpoint != nil
+}
+
+// checkpointDir returns the checkpoint directory within the workspace of the experiment, with
+// symbolic links resolved so that the directory cannot lead elsewhere on the host
+//
+func (p *processor) checkpointDir() (dir string, err errors.Error) {
+	dir, err = runner.CheckpointDir(filepath.Join(p.ExprDir, "workspace"), p.Request.Experiment.Checkpoint.Dir)
+	if err != nil {
+		return "", err.With("project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key)
+	}
+	return dir, nil
+}
+
+// restoreCheckpoints places the checkpoints downloaded from a previous run of the experiment
+// into its checkpoint directory
+//
+func (p *processor) restoreCheckpoints() (err errors.Error) {
+	if p.Request.Experiment.Checkpoint == nil {
+		return nil
+	}
+	dir, err := p.checkpointDir()
+	if err != nil {
+		return err
+	}
+	restored, err := runner.RestoreCheckpoints(filepath.Join(p.ExprDir, runner.CheckpointGroup), dir)
+	if err != nil {
+		return err.With("project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key)
+	}
+	if restored != 0 {
+		logger.Info("experiment checkpoints restored", "project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key,
+			"checkpoints", restored)
+	}
+	return nil
+}
+
+// uploadCheckpoints returns the newest checkpoints using the checkpoint artifact if any have
+// appeared since the last upload.  Running out of disk is the only error returned as it
+// prevents the experiment from being able to continue.
+//
+func (p *processor) uploadCheckpoints(timeout time.Duration, settle time.Duration) (err errors.Error) {
+	dir, err := p.checkpointDir()
+	if err != nil {
+		logger.Warn("experiment checkpoints not staged", "project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key,
+			"error", err.Error())
+		return nil
+	}
+	changed, err := runner.SyncCheckpoints(dir, filepath.Join(p.ExprDir, runner.CheckpointGroup), p.Request.Experiment.Checkpoint.Keep, settle)
+	if err != nil {
+		logger.Warn("experiment checkpoints not staged", "project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key,
+			"error", err.Error())
+		return nil
+	}
+	if !changed {
+		return nil
+	}
+
+	uploadCtx, uploadCancel := context.WithTimeout(context.Background(), timeout)
+	defer uploadCancel()
+
+	uploaded, _, errReturn := p.returnOne(uploadCtx, runner.CheckpointGroup, p.Request.Experiment.Artifacts[runner.CheckpointGroup], "")
+	if uploaded {
+		logger.Debug("experiment checkpoints uploaded", "project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key)
+	}
+	if runner.IsOutOfDisk(errReturn) {
+		return errReturn
+	}
+	return nil
+}
+
+// checkpointWatch polls the checkpoint directory of the experiment until the ctx is done, at
+// which point any remaining checkpoints are uploaded and the returned channel is closed
+//
+func (p *processor) checkpointWatch(ctx context.Context, timeout time.Duration, stop func(err errors.Error)) (doneC chan struct{}) {
+	doneC = make(chan struct{})
+	if p.Request.Experiment.Checkpoint == nil {
+		close(doneC)
+		return doneC
+	}
+
+	go func() {
+		defer close(doneC)
+
+		poll := time.NewTicker(*checkpointPollOpt)
+		defer poll.Stop()
+
+		for {
+			select {
+			case <-poll.C:
+				if err := p.uploadCheckpoints(timeout, *checkpointPollOpt); err != nil {
+					stop(err)
+				}
+			case <-ctx.Done():
+				// The experiment has stopped so nothing is still being written
+				if err := p.uploadCheckpoints(timeout, 0); err != nil {
+					stop(err)
+				}
+				return
+			}
+		}
+	}()
+	return doneC
+}
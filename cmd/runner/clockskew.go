@@ -0,0 +1,264 @@
+package main
+
+// This file contains the implementation of the checking of the clock of the node against a
+// reliable time source.  Clocks that have drifted cause AWS signatures to be rejected, ack
+// deadlines to be missed, and telemetry to carry the wrong times, all of which show up as
+// mysterious failures of otherwise healthy experiments.  When the skew exceeds a threshold
+// the runner stops retrieving new work, the healthz endpoint reports the runner as not ready,
+// and an error is logged.  The check is repeated periodically and once the clock has been
+// corrected the runner returns to work.
+//
+// The time source is either an NTP server, ntp://host[:port], or any HTTP server whose Date
+// header can be trusted, for example the metadata server of a cloud provider.
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	clockSkewMaxOpt   = flag.Duration("clock-skew-max", 0, "the largest difference between the clock of the node and the clock-source before the runner stops retrieving work and reports itself not ready, 0 disables checking")
+	clockSourceOpt    = flag.String("clock-source", "ntp://pool.ntp.org", "the time source the clock of the node is checked against, either ntp://host[:port] or an http(s) URL whose Date header is used")
+	clockCheckOpt     = flag.Duration("clock-check-interval", 10*time.Minute, "the interval between checks of the clock of the node")
+	clockQueryTimeout = 10 * time.Second
+
+	clock = &clockState{}
+
+	clockSkewGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "runner_clock_skew_seconds",
+			Help: "The difference between the clock of the node and the clock-source, positive when the node is behind.",
+		},
+		[]string{"host"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(clockSkewGauge)
+}
+
+// ntpEpochOffset is the number of seconds between the NTP epoch, 1900, and the unix epoch
+const ntpEpochOffset = 2208988800
+
+// clockStatus is the outcome of the most recent clock check as reported by the healthz
+// endpoint
+//
+type clockStatus struct {
+	Source    string    `json:"source"`
+	Skew      float64   `json:"skew_seconds"`
+	Skewed    bool      `json:"skewed"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// clockState tracks the clock checks, if they were enabled
+//
+type clockState struct {
+	status *clockStatus
+	sync.Mutex
+}
+
+// get returns the state of the clock, nil if clock checking is disabled
+//
+func (cs *clockState) get() (status *clockStatus) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.status == nil {
+		return nil
+	}
+	result := *cs.status
+	return &result
+}
+
+func (cs *clockState) set(status *clockStatus) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.status = status
+}
+
+// validateClockSource checks the clock options returning the parsed time source, nil is
+// returned when clock checking is disabled
+//
+func validateClockSource() (source *url.URL, err errors.Error) {
+	if *clockSkewMaxOpt == 0 {
+		return nil, nil
+	}
+	if *clockSkewMaxOpt < 0 {
+		return nil, errors.New("clock-skew-max must not be negative").With("clock-skew-max", clockSkewMaxOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if *clockCheckOpt <= 0 {
+		return nil, errors.New("clock-check-interval must be positive").With("clock-check-interval", clockCheckOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	source, errGo := url.Parse(*clockSourceOpt)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "clock-source is invalid").With("clock-source", *clockSourceOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	switch source.Scheme {
+	case "ntp", "http", "https":
+	default:
+		return nil, errors.New("clock-source must use the ntp, http, or https scheme").With("clock-source", *clockSourceOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(source.Hostname()) == 0 {
+		return nil, errors.New("clock-source must name a host").With("clock-source", *clockSourceOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	return source, nil
+}
+
+// clockOffset returns the amount the clock of the node needs to be advanced to match the time
+// source
+//
+func clockOffset(ctx context.Context, source *url.URL) (offset time.Duration, err errors.Error) {
+	if source.Scheme == "ntp" {
+		addr := source.Host
+		if len(source.Port()) == 0 {
+			addr = net.JoinHostPort(source.Hostname(), "123")
+		}
+		return ntpOffset(addr, clockQueryTimeout)
+	}
+	return httpOffset(ctx, source.String(), clockQueryTimeout)
+}
+
+// ntpOffset queries an NTP server using the simple network time protocol, RFC 4330
+//
+func ntpOffset(addr string, timeout time.Duration) (offset time.Duration, err errors.Error) {
+	conn, errGo := net.DialTimeout("udp", addr, timeout)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("server", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer conn.Close()
+
+	if errGo = conn.SetDeadline(time.Now().Add(timeout)); errGo != nil {
+		return 0, errors.Wrap(errGo).With("server", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Leap indicator of 0, version 4, and client mode
+	request := make([]byte, 48)
+	request[0] = 0x23
+
+	sent := time.Now()
+	if _, errGo = conn.Write(request); errGo != nil {
+		return 0, errors.Wrap(errGo).With("server", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+	response := make([]byte, 48)
+	if _, errGo = conn.Read(response); errGo != nil {
+		return 0, errors.Wrap(errGo).With("server", addr).With("stack", stack.Trace().TrimRuntime())
+	}
+	received := time.Now()
+
+	// A stratum of 0 is a kiss of death message refusing the request
+	if mode := response[0] & 0x07; mode != 4 || response[1] == 0 {
+		return 0, errors.New("invalid NTP response").With("server", addr, "mode", mode, "stratum", response[1]).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// ntpTime converts an NTP timestamp, seconds since 1900 and a binary fraction of a second
+//
+func ntpTime(stamp []byte) (at time.Time) {
+	secs := int64(binary.BigEndian.Uint32(stamp[0:4])) - ntpEpochOffset
+	nanos := (int64(binary.BigEndian.Uint32(stamp[4:8])) * 1e9) >> 32
+	return time.Unix(secs, nanos)
+}
+
+// httpOffset uses the Date header of an HTTP server, the header has a resolution of a second
+//
+func httpOffset(ctx context.Context, source string, timeout time.Duration) (offset time.Duration, err errors.Error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	rqst, errGo := http.NewRequest(http.MethodHead, source, nil)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("source", source).With("stack", stack.Trace().TrimRuntime())
+	}
+	sent := time.Now()
+	resp, errGo := http.DefaultClient.Do(rqst.WithContext(ctx))
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("source", source).With("stack", stack.Trace().TrimRuntime())
+	}
+	resp.Body.Close()
+	received := time.Now()
+
+	date, errGo := http.ParseTime(resp.Header.Get("Date"))
+	if errGo != nil {
+		return 0, errors.Wrap(errGo, "time source did not return a valid Date header").With("source", source).With("stack", stack.Trace().TrimRuntime())
+	}
+	// The date is truncated to the second so the middle of that second is used
+	date = date.Add(500 * time.Millisecond)
+	return date.Sub(sent.Add(received.Sub(sent) / 2)), nil
+}
+
+// checkClock measures the skew of the clock and updates the lifecycle of the runner when the
+// skew crosses the threshold.  A source that cannot be reached leaves the runner in the state
+// the previous check put it in.
+//
+func checkClock(ctx context.Context, source *url.URL, maxSkew time.Duration) (status *clockStatus) {
+	previous := clock.get()
+
+	status = &clockStatus{
+		Source:    source.String(),
+		CheckedAt: time.Now(),
+	}
+	offset, err := clockOffset(ctx, source)
+	if err != nil {
+		if previous != nil {
+			status.Skew = previous.Skew
+			status.Skewed = previous.Skewed
+		}
+		status.Error = err.Error()
+		clock.set(status)
+		logger.Warn("clock could not be checked", "source", status.Source, "error", status.Error)
+		return status
+	}
+
+	status.Skew = offset.Seconds()
+	status.Skewed = offset > maxSkew || -offset > maxSkew
+	clock.set(status)
+	clockSkewGauge.With(prometheus.Labels{"host": host}).Set(status.Skew)
+
+	if effective, changed := lifecycle.clockSkewed(status.Skewed); changed {
+		recheckLifecycle()
+		if status.Skewed {
+			logger.Error("clock skew exceeds the maximum, no new work will be started", "skew", offset.String(), "clock-skew-max", maxSkew.String(), "source", status.Source, "state", effective.String())
+		} else {
+			logger.Info("clock skew corrected", "skew", offset.String(), "source", status.Source, "state", effective.String())
+		}
+	}
+	return status
+}
+
+// watchClock periodically checks the clock of the node, the function returns immediately
+// when clock checking is disabled
+//
+func watchClock(ctx context.Context, source *url.URL, maxSkew time.Duration, interval time.Duration) {
+	if source == nil {
+		return
+	}
+
+	check := time.NewTicker(interval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-check.C:
+			checkClock(ctx, source, maxSkew)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+)
+
+// fakeNTP answers NTP requests using the local clock advanced by the offset held in nanoseconds
+//
+func fakeNTP(t *testing.T, offset *int64) (addr string, stop func()) {
+	conn, errGo := net.ListenPacket("udp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	go func() {
+		request := make([]byte, 48)
+		for {
+			_, from, errGo := conn.ReadFrom(request)
+			if errGo != nil {
+				return
+			}
+			now := time.Now().Add(time.Duration(atomic.LoadInt64(offset)))
+			stamp := make([]byte, 8)
+			binary.BigEndian.PutUint32(stamp[0:4], uint32(now.Unix()+ntpEpochOffset))
+			binary.BigEndian.PutUint32(stamp[4:8], uint32((int64(now.Nanosecond())<<32)/1e9))
+
+			response := make([]byte, 48)
+			response[0] = 0x24 // Version 4, server mode
+			response[1] = 2    // Stratum
+			copy(response[32:40], stamp)
+			copy(response[40:48], stamp)
+			conn.WriteTo(response, from)
+		}
+	}()
+	return conn.LocalAddr().String(), func() { conn.Close() }
+}
+
+// TestClockSkew checks that a skewed clock stops work and reports the runner not ready, and
+// that readiness returns once the clock is corrected
+//
+func TestClockSkew(t *testing.T) {
+
+	offset := int64(10 * time.Minute)
+	addr, stop := fakeNTP(t, &offset)
+	defer stop()
+
+	defer func() {
+		lifecycle.clockSkewed(false)
+		clock.set(nil)
+	}()
+
+	source, _ := url.Parse("ntp://" + addr)
+	status := checkClock(context.Background(), source, time.Minute)
+	if !status.Skewed || status.Skew < 599 || status.Skew > 601 || len(status.Error) != 0 {
+		t.Fatalf("skewed clock not detected %+v", status)
+	}
+	if state, _ := lifecycle.get(); state != types.K8sDrainAndSuspend {
+		t.Fatalf("skewed runner left in state %s", state.String())
+	}
+
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	doc := healthzStatus{}
+	if errGo := json.NewDecoder(recorder.Body).Decode(&doc); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if recorder.Code != http.StatusServiceUnavailable || doc.Status != "clock skewed" || doc.Clock == nil {
+		t.Fatalf("skewed clock reported with status %d %+v", recorder.Code, doc)
+	}
+
+	// A source that cannot be reached leaves the runner stopped
+	stop()
+	status = checkClock(context.Background(), source, time.Minute)
+	if !status.Skewed || len(status.Error) == 0 {
+		t.Fatalf("unreachable source changed the skew %+v", status)
+	}
+
+	atomic.StoreInt64(&offset, int64(time.Second))
+	addr, stop = fakeNTP(t, &offset)
+	defer stop()
+	source, _ = url.Parse("ntp://" + addr)
+
+	if status = checkClock(context.Background(), source, time.Minute); status.Skewed {
+		t.Fatalf("corrected clock still skewed %+v", status)
+	}
+	if state, _ := lifecycle.get(); state != types.K8sRunning {
+		t.Fatalf("corrected runner left in state %s", state.String())
+	}
+}
+
+// TestClockSkewHTTP checks the skew is measured using the Date header of an HTTP source
+//
+func TestClockSkewHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	offset, err := httpOffset(context.Background(), server.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset > -59*time.Minute || offset < -61*time.Minute {
+		t.Fatalf("offset of an hour measured as %v", offset)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+// This file contains the implementation of the gRPC management interface of the runner that
+// is defined in the pkg/control package.  The interface is served when the grpc-control
+// option is set and uses the same state as the rest of the runner, the lifecycle state for
+// draining, the paused projects and queues, the registry of running experiments, and the
+// subscriptions of the queues being serviced.
+//
+// The interface is only served without authentication on the loopback interface, other
+// addresses need TLS credentials, a token that clients present as a bearer token in the
+// authorization metadata of each request, or both.
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/pkg/control"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	grpcControlOpt      = flag.String("grpc-control", "", "the address the gRPC management interface is served on, for example 127.0.0.1:9091, addresses other than the loopback interface need TLS or a token, by default the interface is not served")
+	grpcControlCertOpt  = flag.String("grpc-control-cert", "", "the PEM certificate file used to serve the gRPC management interface using TLS")
+	grpcControlKeyOpt   = flag.String("grpc-control-key", "", "the PEM private key file for the grpc-control-cert certificate")
+	grpcControlTokenOpt = flag.String("grpc-control-token", "", "a token that clients of the gRPC management interface must present as a bearer token in their authorization metadata")
+
+	queuers = newQueuerRegistry()
+)
+
+// queuerRegistry tracks the queuers retrieving work so that their queues can be reported
+//
+type queuerRegistry struct {
+	queuers map[*Queuer]struct{}
+	sync.Mutex
+}
+
+func newQueuerRegistry() (registry *queuerRegistry) {
+	return &queuerRegistry{
+		queuers: map[*Queuer]struct{}{},
+	}
+}
+
+// add records a queuer that has started, the returned function is called once it stops
+//
+func (registry *queuerRegistry) add(qr *Queuer) (remove func()) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.queuers[qr] = struct{}{}
+
+	return func() {
+		registry.Lock()
+		defer registry.Unlock()
+
+		delete(registry.queuers, qr)
+	}
+}
+
+// queues describes the queues known to the queuers along with the number of experiments
+// from each that are running
+//
+func (registry *queuerRegistry) queues(exps []runningExperiment) (queues []*control.Queue) {
+	running := map[string]uint32{}
+	for _, exp := range exps {
+		running[exp.Queue]++
+	}
+
+	registry.Lock()
+	qrs := make([]*Queuer, 0, len(registry.queuers))
+	for qr := range registry.queuers {
+		qrs = append(qrs, qr)
+	}
+	registry.Unlock()
+
+	queues = []*control.Queue{}
+	for _, qr := range qrs {
+		for _, sub := range qr.subs.Snapshot() {
+			queues = append(queues, &control.Queue{
+				Project: qr.project,
+				Name:    sub.name,
+				Running: running[sub.name],
+				Paused:  projectPauses.queuePaused(qr.project, sub.name),
+			})
+		}
+	}
+	sort.Slice(queues, func(i, j int) bool {
+		if queues[i].Project != queues[j].Project {
+			return queues[i].Project < queues[j].Project
+		}
+		return queues[i].Name < queues[j].Name
+	})
+	return queues
+}
+
+// cancelExperiment stops the experiment with the supplied key, an experiment that has been
+// cancelled is consumed rather than being retried
+//
+func (registry *experimentRegistry) cancelExperiment(key string) (cancelled runningExperiment, found bool) {
+	now := time.Now()
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	for exp := range registry.experiments {
+		if exp.Key != key {
+			continue
+		}
+		if exp.cancel != nil {
+			exp.Cancelled = true
+			exp.cancel()
+		}
+		if !found || exp.StartedAt.Before(cancelled.StartedAt) {
+			cancelled = *exp
+			cancelled.Elapsed = now.Sub(exp.StartedAt).Round(time.Second).String()
+		}
+		found = true
+	}
+	return cancelled, found
+}
+
+// operatorCancelled tests if the experiment with the supplied key was cancelled by an operator
+//
+func (registry *experimentRegistry) operatorCancelled(key string) (cancelled bool) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for exp := range registry.experiments {
+		if exp.Key == key && exp.Cancelled {
+			return true
+		}
+	}
+	return false
+}
+
+// controlExperiment converts a registry entry into its gRPC form
+//
+func controlExperiment(exp runningExperiment) (result *control.Experiment) {
+	result = &control.Experiment{
+		Key:       exp.Key,
+		Project:   exp.Project,
+		Queue:     exp.Queue,
+		Cancelled: exp.Cancelled,
+	}
+	if startedAt, errGo := ptypes.TimestampProto(exp.StartedAt); errGo == nil {
+		result.StartedAt = startedAt
+	}
+	return result
+}
+
+// controlServer implements the gRPC management interface
+//
+type controlServer struct{}
+
+// Drain stops, or resumes, the runner retrieving new work
+//
+func (*controlServer) Drain(ctx context.Context, rqst *control.DrainRequest) (response *control.DrainResponse, errGo error) {
+	effective, changed := lifecycle.drain(rqst.Drain)
+	if changed {
+		recheckLifecycle()
+		logger.Info("runner drain changed", "drain", rqst.Drain, "state", effective.String())
+	}
+	return &control.DrainResponse{
+		Host:    host,
+		State:   effective.String(),
+		Changed: changed,
+	}, nil
+}
+
+// PauseQueue stops the runner retrieving work from a queue, or the queues of a project
+//
+func (*controlServer) PauseQueue(ctx context.Context, rqst *control.QueueRequest) (response *control.QueueResponse, errGo error) {
+	if len(rqst.Queue) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a queue is required")
+	}
+	changed := !projectPauses.isPaused(rqst.Queue)
+	projectPauses.pause(rqst.Queue)
+	if changed {
+		logger.Info("queue paused", "queue", rqst.Queue)
+	}
+	return &control.QueueResponse{
+		Host:    host,
+		Queue:   rqst.Queue,
+		Paused:  true,
+		Changed: changed,
+	}, nil
+}
+
+// ResumeQueue allows the runner to retrieve work from a queue, or the queues of a project
+//
+func (*controlServer) ResumeQueue(ctx context.Context, rqst *control.QueueRequest) (response *control.QueueResponse, errGo error) {
+	if len(rqst.Queue) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "a queue is required")
+	}
+	changed := projectPauses.resume(rqst.Queue)
+	if changed {
+		logger.Info("queue resumed", "queue", rqst.Queue)
+	}
+	return &control.QueueResponse{
+		Host:    host,
+		Queue:   rqst.Queue,
+		Paused:  false,
+		Changed: changed,
+	}, nil
+}
+
+// CancelExperiment stops an experiment running on the runner
+//
+func (*controlServer) CancelExperiment(ctx context.Context, rqst *control.CancelRequest) (response *control.CancelResponse, errGo error) {
+	if len(rqst.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "an experiment key is required")
+	}
+	response = &control.CancelResponse{
+		Host: host,
+	}
+	cancelled, found := running.cancelExperiment(rqst.Key)
+	if !found {
+		return response, nil
+	}
+	logger.Warn("experiment cancelled by operator", "experiment_id", cancelled.Key, "project_id", cancelled.Project)
+
+	response.Found = true
+	response.Experiment = controlExperiment(cancelled)
+	return response, nil
+}
+
+// Status returns the state of the runner, its queues, and the experiments it is running
+//
+func (*controlServer) Status(ctx context.Context, rqst *control.StatusRequest) (response *control.StatusResponse, errGo error) {
+	state, window := lifecycle.get()
+	exps := running.snapshot()
+
+	response = &control.StatusResponse{
+		Host:              host,
+		State:             state.String(),
+		MaintenanceWindow: window,
+		Experiments:       make([]*control.Experiment, 0, len(exps)),
+		Queues:            queuers.queues(exps),
+		Paused:            projectPauses.pausedNames(),
+	}
+	for _, exp := range exps {
+		response.Experiments = append(response.Experiments, controlExperiment(exp))
+	}
+	return response, nil
+}
+
+// controlBackoffs converts the backoffs that have yet to expire into their gRPC form
+//
+func controlBackoffs() (results []*control.Backoff) {
+	entries := listBackoffs()
+	results = make([]*control.Backoff, 0, len(entries))
+	for _, entry := range entries {
+		result := &control.Backoff{
+			Key:     entry.Key,
+			Project: entry.Project,
+			Queue:   entry.Queue,
+		}
+		if !entry.ExpiresAt.IsZero() {
+			if expiresAt, errGo := ptypes.TimestampProto(entry.ExpiresAt); errGo == nil {
+				result.ExpiresAt = expiresAt
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// ListBackoffs returns the queues the runner is backing off from and when each backoff expires
+//
+func (*controlServer) ListBackoffs(ctx context.Context, rqst *control.BackoffsRequest) (response *control.BackoffsResponse, errGo error) {
+	return &control.BackoffsResponse{
+		Host:     host,
+		Backoffs: controlBackoffs(),
+		Cleared:  []string{},
+	}, nil
+}
+
+// ClearBackoffs removes a backoff, or all of them, so that work is retrieved again immediately
+//
+func (*controlServer) ClearBackoffs(ctx context.Context, rqst *control.ClearBackoffsRequest) (response *control.BackoffsResponse, errGo error) {
+	if len(rqst.Key) == 0 && !rqst.All {
+		return nil, status.Error(codes.InvalidArgument, "a backoff key, or all, is required")
+	}
+	cleared := clearBackoffs(rqst.Key, rqst.All)
+	if len(cleared) != 0 {
+		logger.Info("backoffs cleared by operator", "backoffs", strings.Join(cleared, ","))
+	}
+	return &control.BackoffsResponse{
+		Host:     host,
+		Backoffs: controlBackoffs(),
+		Cleared:  cleared,
+	}, nil
+}
+
+// runControl starts serving the gRPC management interface when it was asked for, the server
+// is stopped when the context is cancelled
+//
+func runControl(ctx context.Context) (err errors.Error) {
+	if len(*grpcControlOpt) == 0 {
+		return nil
+	}
+
+	opts := []grpc.ServerOption{}
+
+	if len(*grpcControlCertOpt) != 0 || len(*grpcControlKeyOpt) != 0 {
+		creds, errGo := credentials.NewServerTLSFromFile(*grpcControlCertOpt, *grpcControlKeyOpt)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("cert", *grpcControlCertOpt).With("key", *grpcControlKeyOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	if len(*grpcControlTokenOpt) != 0 {
+		opts = append(opts, grpc.UnaryInterceptor(controlTokenInterceptor(*grpcControlTokenOpt)))
+	}
+
+	if len(opts) == 0 && !controlLoopback(*grpcControlOpt) {
+		return errors.New("the gRPC management interface needs grpc-control-cert and grpc-control-key, or grpc-control-token, when not served on the loopback interface").With("address", *grpcControlOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	listener, errGo := net.Listen("tcp", *grpcControlOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("address", *grpcControlOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	serveControl(ctx, listener, opts...)
+	return nil
+}
+
+// controlLoopback is used to test whether an address the management interface is served on
+// can only be reached from the local host, an empty host listens on every interface
+//
+func controlLoopback(address string) (loopback bool) {
+	host, _, errGo := net.SplitHostPort(address)
+	if errGo != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// controlTokenInterceptor rejects requests that do not carry the token as a bearer token
+// in their authorization metadata
+//
+func controlTokenInterceptor(token string) (interceptor grpc.UnaryServerInterceptor) {
+	expected := []byte("Bearer " + token)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, errGo error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, auth := range md["authorization"] {
+			if subtle.ConstantTimeCompare([]byte(auth), expected) == 1 {
+				return handler(ctx, req)
+			}
+		}
+		return nil, status.Error(codes.Unauthenticated, "a valid bearer token is needed")
+	}
+}
+
+// serveControl serves the gRPC management interface using the supplied listener until the
+// context is cancelled
+//
+func serveControl(ctx context.Context, listener net.Listener, opts ...grpc.ServerOption) {
+	server := grpc.NewServer(opts...)
+	control.RegisterControlServer(server, &controlServer{})
+
+	go func() {
+		logger.Info("gRPC management interface listening on "+listener.Addr().String(), "stack", stack.Trace().TrimRuntime())
+
+		if errGo := server.Serve(listener); errGo != nil {
+			logger.Warn("gRPC management interface stopped", "error", errGo.Error(), "stack", stack.Trace().TrimRuntime())
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+	"github.com/leaf-ai/studio-go-runner/pkg/control"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestControl exercises the gRPC management interface and checks that repeating a request
+// leaves the runner unchanged
+//
+func TestControl(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	serveControl(ctx, listener)
+
+	conn, errGo := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer conn.Close()
+	client := control.NewControlClient(conn)
+
+	queue := "control-test:queue"
+	defer projectPauses.resume(queue)
+
+	for i, changed := range []bool{true, false} {
+		resp, errGo := client.PauseQueue(ctx, &control.QueueRequest{Queue: queue})
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !resp.Paused || resp.Changed != changed {
+			t.Fatalf("pause %d unexpected response %+v", i, *resp)
+		}
+	}
+	if !projectPauses.queuePaused("control-test", "queue") {
+		t.Fatal("queue was not paused")
+	}
+
+	key := "control-test-experiment"
+	cancelled := make(chan struct{})
+	done := running.addCancellable(key, "control-test", "queue", time.Now(), func() {
+		select {
+		case <-cancelled:
+		default:
+			close(cancelled)
+		}
+	})
+	defer done(true)
+
+	status, errGo := client.Status(ctx, &control.StatusRequest{})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !hasPaused(status.Paused, queue) {
+		t.Fatalf("paused queue missing from status %v", status.Paused)
+	}
+	if !hasExperiment(status.Experiments, key) {
+		t.Fatalf("running experiment missing from status %+v", status.Experiments)
+	}
+
+	for i := 0; i != 2; i++ {
+		resp, errGo := client.CancelExperiment(ctx, &control.CancelRequest{Key: key})
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if !resp.Found || resp.Experiment == nil || !resp.Experiment.Cancelled {
+			t.Fatalf("cancel %d unexpected response %+v", i, *resp)
+		}
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("experiment was not cancelled")
+	}
+	if !running.operatorCancelled(key) {
+		t.Fatal("experiment was not recorded as cancelled by an operator")
+	}
+
+	resp, errGo := client.CancelExperiment(ctx, &control.CancelRequest{Key: "control-test-missing"})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if resp.Found {
+		t.Fatalf("unknown experiment was found %+v", *resp)
+	}
+	if _, errGo = client.CancelExperiment(ctx, &control.CancelRequest{}); errGo == nil {
+		t.Fatal("cancel without an experiment key was accepted")
+	}
+
+	for i, changed := range []bool{true, false} {
+		resp, errGo := client.ResumeQueue(ctx, &control.QueueRequest{Queue: queue})
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if resp.Paused || resp.Changed != changed {
+			t.Fatalf("resume %d unexpected response %+v", i, *resp)
+		}
+	}
+
+	defer func() {
+		lifecycle.drain(false)
+		recheckLifecycle()
+	}()
+
+	for i, changed := range []bool{true, false} {
+		resp, errGo := client.Drain(ctx, &control.DrainRequest{Drain: true})
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if resp.Changed != changed || resp.State != types.K8sDrainAndSuspend.String() {
+			t.Fatalf("drain %d unexpected response %+v", i, *resp)
+		}
+	}
+	drained, errGo := client.Drain(ctx, &control.DrainRequest{Drain: false})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !drained.Changed || drained.State != types.K8sRunning.String() {
+		t.Fatalf("resume unexpected response %+v", *drained)
+	}
+}
+
+// TestControlBackoffs checks that backoffs can be listed and that clearing them, one at a time
+// or all together, is safe while they are being set and checked concurrently
+//
+func TestControlBackoffs(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	serveControl(ctx, listener)
+
+	conn, errGo := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer conn.Close()
+	client := control.NewControlClient(conn)
+
+	first := "backoff-test:first"
+	second := "backoff-test:https://sqs.us-west-2.amazonaws.com/123456789012/second"
+	backoffs.Set(first, true, time.Minute)
+	backoffs.Set(second, true, time.Hour)
+	defer backoffs.Delete(first)
+	defer backoffs.Delete(second)
+
+	listed, errGo := client.ListBackoffs(ctx, &control.BackoffsRequest{})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	found := hasBackoff(listed.Backoffs, second)
+	if found == nil || found.Project != "backoff-test" || found.Queue != "https://sqs.us-west-2.amazonaws.com/123456789012/second" {
+		t.Fatalf("backoff %s not listed %+v", second, listed.Backoffs)
+	}
+	if found.ExpiresAt == nil || found.ExpiresAt.Seconds < time.Now().Add(59*time.Minute).Unix() {
+		t.Fatalf("backoff %s has an unexpected expiry %+v", second, found.ExpiresAt)
+	}
+
+	for i, cleared := range []int{1, 0} {
+		resp, errGo := client.ClearBackoffs(ctx, &control.ClearBackoffsRequest{Key: first})
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if len(resp.Cleared) != cleared || hasBackoff(resp.Backoffs, first) != nil || hasBackoff(resp.Backoffs, second) == nil {
+			t.Fatalf("clear %d unexpected response %+v", i, *resp)
+		}
+	}
+
+	if _, errGo = client.ClearBackoffs(ctx, &control.ClearBackoffsRequest{}); errGo == nil {
+		t.Fatal("clear without a backoff key was accepted")
+	}
+
+	// Set and check backoffs while they are being cleared, the race detector will report any
+	// unsafe access
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, isPresent := backoffs.Get(first); !isPresent {
+				backoffs.Set(first, true, time.Minute)
+			}
+		}
+	}()
+	for i := 0; i != 20; i++ {
+		if _, errGo = client.ClearBackoffs(ctx, &control.ClearBackoffsRequest{All: true}); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	close(stop)
+	<-stopped
+
+	resp, errGo := client.ClearBackoffs(ctx, &control.ClearBackoffsRequest{All: true})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if len(resp.Backoffs) != 0 {
+		t.Fatalf("backoffs remain after clearing all %+v", resp.Backoffs)
+	}
+}
+
+func hasBackoff(backoffs []*control.Backoff, key string) (found *control.Backoff) {
+	for _, backoff := range backoffs {
+		if backoff.Key == key {
+			return backoff
+		}
+	}
+	return nil
+}
+
+func hasPaused(paused []string, queue string) (found bool) {
+	for _, name := range paused {
+		if name == queue {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExperiment(exps []*control.Experiment, key string) (found bool) {
+	for _, exp := range exps {
+		if exp.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// TestControlAuth checks that requests without the token are rejected and that addresses
+// off the loopback interface are recognized
+//
+func TestControlAuth(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	serveControl(ctx, listener, grpc.UnaryInterceptor(controlTokenInterceptor("secret")))
+
+	conn, errGo := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer conn.Close()
+	client := control.NewControlClient(conn)
+
+	for token, expected := range map[string]codes.Code{
+		"":              codes.Unauthenticated,
+		"Bearer wrong":  codes.Unauthenticated,
+		"secret":        codes.Unauthenticated,
+		"Bearer secret": codes.OK,
+	} {
+		reqCtx := ctx
+		if len(token) != 0 {
+			reqCtx = metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", token))
+		}
+		_, errGo := client.Status(reqCtx, &control.StatusRequest{})
+		if code := status.Code(errGo); code != expected {
+			t.Fatalf("token %q returned %v rather than %v", token, code, expected)
+		}
+	}
+
+	for address, loopback := range map[string]bool{
+		":9091":          false,
+		"0.0.0.0:9091":   false,
+		"10.0.0.1:9091":  false,
+		"example.com:80": false,
+		"127.0.0.1:9091": true,
+		"[::1]:9091":     true,
+		"localhost:9091": true,
+	} {
+		if controlLoopback(address) != loopback {
+			t.Fatalf("address %s loopback was not %v", address, loopback)
+		}
+	}
+}
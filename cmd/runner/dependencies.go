@@ -0,0 +1,187 @@
+package main
+
+// This file contains the implementation of experiment dependencies.  Experiments can name
+// prerequisite experiments that must complete successfully before they are started, for
+// example the stages of a pipeline.  Experiments with prerequisites that have not yet
+// completed are returned to their queue and the queue backed off so that they are retried
+// later.  Experiments whose prerequisites have failed, or that have waited for longer than
+// their maximum wait, are dumped.
+//
+// The status of a prerequisite is taken from the experiments completed by this runner and
+// from a status URL, typically a service recording the completion events published by
+// runners.  The status URL is expected to return a JSON document with a status field,
+// for example the completion event documents the runner publishes, or a 404 when the
+// experiment has not finished.  Status URLs supplied by experiments are subject to the same
+// checks as callbacks, so that they cannot be used to reach services on the private network
+// of the runner, while the dependency-status-url option of the operator is trusted.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/karlmutch/go-cache"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	dependencyStatusURLOpt = flag.String("dependency-status-url", "", "a URL returning the status of an experiment as JSON used for experiments that have prerequisites and do not supply their own, {key} is replaced with the experiment key")
+	dependencyMaxWaitOpt   = flag.Duration("dependency-max-wait", 24*time.Hour, "the period after an experiment was added that it will wait for its prerequisites before being dumped when it does not supply its own")
+	dependencyBackoffOpt   = flag.Duration("dependency-backoff", time.Minute, "the period a queue is backed off after an experiment from it was deferred waiting for its prerequisites")
+
+	// completions holds the status of experiments that have finished on this runner
+	completions = cache.New(time.Hour, 10*time.Minute)
+
+	// firstSeen holds when experiments that do not have a time added were first deferred
+	firstSeen = cache.New(time.Hour, 10*time.Minute)
+
+	dependencyClient = &http.Client{Timeout: 15 * time.Second}
+)
+
+const (
+	prereqFailed = "prerequisite experiment failed"
+	prereqWait   = "prerequisite experiments did not complete within the maximum wait"
+)
+
+// recordCompletion remembers the outcome of experiments that have finished on this runner
+//
+func recordCompletion(event *resultEvent) {
+	if event.Status == resultCompleted || event.Status == resultFailed {
+		completions.Set(event.Key, event.Status, 24*time.Hour)
+	}
+}
+
+// prereqStatus returns the status of a prerequisite, an empty string is returned if the
+// status is not known.  trusted is false for status URLs supplied by experiments.
+//
+func prereqStatus(ctx context.Context, key string, statusURL string, trusted bool) (status string, err errors.Error) {
+	if status, isPresent := completions.Get(key); isPresent {
+		return status.(string), nil
+	}
+	if len(statusURL) == 0 {
+		return "", nil
+	}
+
+	statusURL = strings.Replace(statusURL, "{key}", url.PathEscape(key), -1)
+	client := dependencyClient
+	if !trusted {
+		if err = checkCallbackURL(statusURL); err != nil {
+			return "", err
+		}
+		client = callbackClient
+	}
+
+	req, errGo := http.NewRequest(http.MethodGet, statusURL, nil)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("url", statusURL).With("stack", stack.Trace().TrimRuntime())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	resp, errGo := client.Do(req)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("url", statusURL).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", nil
+	default:
+		io.Copy(ioutil.Discard, resp.Body)
+		return "", errors.New(fmt.Sprintf("experiment status returned %s", resp.Status)).With("url", statusURL).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	doc := struct {
+		Status string `json:"status"`
+	}{}
+	if errGo = json.NewDecoder(resp.Body).Decode(&doc); errGo != nil {
+		return "", errors.Wrap(errGo).With("url", statusURL).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// StudioML itself records experiments that have finished as completed, or finished
+	switch strings.ToLower(doc.Status) {
+	case resultCompleted, "finished", "succeeded":
+		return resultCompleted, nil
+	case resultFailed, "error":
+		return resultFailed, nil
+	}
+	return "", nil
+}
+
+// addedAt returns when the experiment was added to its queue, experiments that do not have a
+// time added use the time they were first deferred by this runner, which is remembered for
+// at least the wait supplied
+//
+func addedAt(rqst *runner.Request, wait time.Duration) (added time.Time) {
+	if rqst.Experiment.TimeAdded > 10.0 {
+		return time.Unix(int64(rqst.Experiment.TimeAdded), 0)
+	}
+	if seen, isPresent := firstSeen.Get(rqst.Experiment.Key); isPresent {
+		return seen.(time.Time)
+	}
+	added = time.Now()
+	firstSeen.Set(rqst.Experiment.Key, added, wait+time.Hour)
+	return added
+}
+
+// checkDependencies determines if the prerequisites of an experiment have all completed.  An
+// error is returned when the experiment should be dumped as its prerequisites will never be met.
+//
+func checkDependencies(ctx context.Context, rqst *runner.Request) (ready bool, err errors.Error) {
+	deps := rqst.Experiment.Dependencies
+	if deps == nil || len(deps.Keys) == 0 {
+		return true, nil
+	}
+
+	statusURL, trusted := deps.StatusURL, false
+	if len(statusURL) == 0 {
+		statusURL, trusted = *dependencyStatusURLOpt, true
+	}
+
+	waiting := []string{}
+	for _, key := range deps.Keys {
+		status, err := prereqStatus(ctx, key, statusURL, trusted)
+		if err != nil {
+			// The status source being unavailable is treated as the prerequisite not having completed
+			logger.Warn("prerequisite status unavailable", "experiment_id", rqst.Experiment.Key, "prerequisite", key, "error", err.Error())
+		}
+		switch status {
+		case resultCompleted:
+		case resultFailed:
+			return false, errors.New(prereqFailed).With("experiment_id", rqst.Experiment.Key, "prerequisite", key).With("stack", stack.Trace().TrimRuntime())
+		default:
+			waiting = append(waiting, key)
+		}
+	}
+
+	if len(waiting) == 0 {
+		return true, nil
+	}
+
+	maxWait := *dependencyMaxWaitOpt
+	if len(deps.MaxWait) != 0 {
+		if wait, errGo := time.ParseDuration(deps.MaxWait); errGo == nil {
+			maxWait = wait
+		}
+	}
+
+	if maxWait > 0 && time.Since(addedAt(rqst, maxWait)) > maxWait {
+		return false, errors.New(prereqWait).With("experiment_id", rqst.Experiment.Key, "waiting_for", strings.Join(waiting, ","), "max_wait", maxWait.String()).
+			With("stack", stack.Trace().TrimRuntime())
+	}
+	return false, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestDependencies checks that experiments are held until their prerequisites have completed
+// and are dumped when a prerequisite fails or the wait is exceeded
+//
+func TestDependencies(t *testing.T) {
+
+	statuses := map[string]string{"stage-1": "completed"}
+	requests := 0
+	status := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		key := strings.TrimPrefix(r.URL.Path, "/experiments/")
+		state, isPresent := statuses[key]
+		if !isPresent {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"experiment_key": "%s", "status": "%s"}`, key, state)
+	}))
+	defer status.Close()
+
+	rqst := &runner.Request{}
+	rqst.Experiment.Key = "stage-3"
+	rqst.Experiment.TimeAdded = float64(time.Now().Unix())
+	rqst.Experiment.Dependencies = &runner.Dependencies{
+		Keys:      []string{"stage-1", "stage-2"},
+		StatusURL: status.URL + "/experiments/{key}",
+	}
+
+	ctx := context.Background()
+
+	// Status URLs supplied by experiments cannot be used to reach addresses that are not public
+	if ready, err := checkDependencies(ctx, rqst); err != nil || ready || requests != 0 {
+		t.Fatalf("status URL of the experiment on a loopback address was used, ready %v, error %v, requests %d", ready, err, requests)
+	}
+
+	// The status URL of the operator is trusted
+	saved := *dependencyStatusURLOpt
+	defer func() { *dependencyStatusURLOpt = saved }()
+	*dependencyStatusURLOpt = rqst.Experiment.Dependencies.StatusURL
+	rqst.Experiment.Dependencies.StatusURL = ""
+
+	if ready, err := checkDependencies(ctx, rqst); err != nil || ready {
+		t.Fatalf("experiment with an unfinished prerequisite was not deferred, ready %v, error %v", ready, err)
+	}
+
+	// Experiments completed on this runner are known without the status URL
+	recordCompletion(&resultEvent{Key: "stage-2", Status: resultCompleted})
+	defer completions.Delete("stage-2")
+
+	if ready, err := checkDependencies(ctx, rqst); err != nil || !ready {
+		t.Fatalf("experiment with completed prerequisites was not ready, ready %v, error %v", ready, err)
+	}
+
+	// A failed prerequisite means the experiment will never run
+	statuses["stage-1"] = "failed"
+	if _, err := checkDependencies(ctx, rqst); err == nil {
+		t.Fatal("experiment with a failed prerequisite was not dumped")
+	}
+
+	// Experiments that have waited too long are dumped
+	delete(statuses, "stage-1")
+	rqst.Experiment.Dependencies.MaxWait = "1h"
+	rqst.Experiment.TimeAdded = float64(time.Now().Add(-2 * time.Hour).Unix())
+	if _, err := checkDependencies(ctx, rqst); err == nil {
+		t.Fatal("experiment that exceeded its maximum wait was not dumped")
+	}
+}
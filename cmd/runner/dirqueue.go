@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+
+	"github.com/go-stack/stack"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// This file contains the implementation of a service that retrieves StudioML workloads
+// from request files placed into a local directory, for use in air-gapped or
+// local development scenarios
+
+var (
+	queueDirOpt = flag.String("queue-dir", "", "a local directory whose subdirectories act as queues containing studioml request JSON files")
+)
+
+func serviceDirQueue(ctx context.Context, checkInterval time.Duration) {
+
+	logger.Debug("starting serviceDirQueue", stack.Trace().TrimRuntime())
+	defer logger.Debug("stopping serviceDirQueue", stack.Trace().TrimRuntime())
+
+	if len(*queueDirOpt) == 0 {
+		logger.Info("directory queue services disabled", stack.Trace().TrimRuntime())
+		return
+	}
+
+	live := &Projects{
+		queueType: "dir",
+		projects:  map[string]context.CancelFunc{},
+	}
+
+	// The directory is the only project and it needs no credentials
+	found := map[string]string{"file://" + *queueDirOpt: ""}
+
+	// first time through make sure the directory is checked immediately
+	qCheck := time.Duration(time.Second)
+
+	// Watch for when the server should not be getting new work
+	state := runner.K8sStateUpdate{
+		State: types.K8sRunning,
+	}
+
+	lifecycleC := make(chan runner.K8sStateUpdate, 1)
+	id, err := k8sStateUpdates().Add(lifecycleC)
+	if err == nil {
+		defer func() {
+			k8sStateUpdates().Delete(id)
+			close(lifecycleC)
+		}()
+	} else {
+		logger.Warn(fmt.Sprint(err))
+	}
+
+	host, errGo := os.Hostname()
+	if errGo != nil {
+		logger.Warn(errGo.Error())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// When shutting down stop all projects
+			live.stopAll()
+			return
+		case state = <-lifecycleC:
+		case <-time.After(qCheck):
+			qCheck = checkInterval
+
+			// If the pulling of work is currently suspending bail out of checking the queues
+			if state.State != types.K8sRunning {
+				queueIgnored.With(prometheus.Labels{"host": host, "queue_type": live.queueType, "queue_name": "*"}).Inc()
+				continue
+			}
+
+			if _, errGo := os.Stat(*queueDirOpt); errGo != nil {
+				logger.Warn("queue directory unavailable", "dir", *queueDirOpt, "error", errGo.Error())
+				continue
+			}
+
+			if err := live.Lifecycle(ctx, found); err != nil {
+				logger.Warn(fmt.Sprintf("unable to process %s due to %v", live.queueType, err))
+			}
+		}
+	}
+}
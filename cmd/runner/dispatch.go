@@ -0,0 +1,93 @@
+package main
+
+// This file contains the implementation of the hand off of requests to check queues for
+// work from the producer to the consumer.  The consumer advertises that it has capacity
+// by placing a token into the ready channel and the producer only sends a request after
+// it has taken a token, as a result sending a request never blocks and no request can be
+// lost because the consumer was momentarily busy.
+
+import (
+	"context"
+	"time"
+)
+
+// dispatcher is the rendezvous between a queuers producer and consumer
+//
+type dispatcher struct {
+	ready chan struct{}
+	work  chan *SubRequest
+}
+
+func newDispatcher() (d *dispatcher) {
+	return &dispatcher{
+		ready: make(chan struct{}, 1),
+		work:  make(chan *SubRequest, 1),
+	}
+}
+
+// advertise is used by the consumer to indicate that it can accept a request, it will
+// block until the capacity is taken or the context is done
+//
+func (d *dispatcher) advertise(ctx context.Context) (ok bool) {
+	select {
+	case d.ready <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// acquire is used by the producer to claim the capacity of the consumer, false is returned
+// if the consumer has no capacity.  After a successful acquire the producer must either
+// call dispatch or release.
+//
+func (d *dispatcher) acquire() (ok bool) {
+	select {
+	case <-d.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitReady waits up to the supplied period for the consumer to advertise capacity, the
+// capacity is left in place for a following acquire
+//
+func (d *dispatcher) awaitReady(ctx context.Context, wait time.Duration) (ok bool) {
+	select {
+	case <-d.ready:
+		d.release()
+		return true
+	case <-time.After(wait):
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release returns capacity that the producer acquired but did not use
+//
+func (d *dispatcher) release() {
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch sends a request to the consumer using capacity that was acquired
+//
+func (d *dispatcher) dispatch(request *SubRequest) {
+	d.work <- request
+}
+
+// next is used by the consumer to wait for the request that will use the capacity it
+// advertised
+//
+func (d *dispatcher) next(ctx context.Context) (request *SubRequest) {
+	select {
+	case request = <-d.work:
+		return request
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestDispatcher checks that requests are only dispatched once the consumer has advertised
+// capacity and that unused capacity is returned
+//
+func TestDispatcher(t *testing.T) {
+
+	d := newDispatcher()
+
+	if d.acquire() {
+		t.Fatal("capacity was acquired before the consumer advertised any")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if !d.advertise(ctx) {
+		t.Fatal("consumer could not advertise capacity")
+	}
+
+	// Capacity acquired then released remains available for the next attempt
+	if !d.acquire() {
+		t.Fatal("advertised capacity could not be acquired")
+	}
+	d.release()
+	if !d.acquire() {
+		t.Fatal("released capacity could not be acquired")
+	}
+	if d.acquire() {
+		t.Fatal("capacity was acquired twice")
+	}
+
+	d.dispatch(&SubRequest{subscription: "queue"})
+	if request := d.next(ctx); request == nil || request.subscription != "queue" {
+		t.Fatalf("unexpected request %v", request)
+	}
+
+	cancel()
+	if request := d.next(ctx); request != nil {
+		t.Fatalf("unexpected request %v after cancellation", request)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+// This file contains the implementation of failure classification for experiments.  Failures
+// are split into those caused by the node the experiment ran on, such as GPU faults
+// or exhausted disks, and those that are intrinsic to the experiment itself.
+//
+// Node local failures result in the message being returned to the queue with this host
+// recording that it should avoid the experiment for a period of time, giving other
+// nodes the opportunity to pick up the work.  The host is also added to a hint carried
+// by the message, listing the hosts avoiding it and until when, for queues able to
+// change a message being returned so that the avoidance survives this host being
+// replaced.  Intrinsic failures are retried until a retry cap is reached and are then
+// dead-lettered by removing them from the queue, and optionally saving a copy of the
+// message to a local directory.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/karlmutch/go-cache"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+type failureClass int
+
+const (
+	failCapacity  failureClass = iota // The node could not accommodate the experiment at this time
+	failNodeLocal                     // The node the experiment ran on was at fault
+	failIntrinsic                     // The experiment itself was at fault
+)
+
+const (
+	// avoidHostsKey is the message attribute listing the hosts avoiding an experiment, as
+	// comma separated host=unix-seconds pairs giving the time each host avoids it until
+	avoidHostsKey = "studioml-avoid-hosts"
+)
+
+var (
+	maxRetriesOpt    = flag.Int("max-intrinsic-retries", 3, "the number of times an experiment that failed due to its own errors is retried on this host before being dead-lettered, 0 retries forever")
+	nodeAvoidTTLOpt  = flag.Duration("node-avoid-ttl", 30*time.Minute, "the period of time this host will avoid an experiment that failed due to a problem with the host")
+	deadLetterDirOpt = flag.String("dead-letter-dir", "", "an optional directory into which the messages of dead-lettered experiments will be saved")
+
+	// deadLetterSafe matches the names that are used unchanged in the files of dead letters
+	deadLetterSafe = regexp.MustCompile(`^[A-Za-z0-9._\-]+$`)
+
+	outOfDiskBackoffOpt = flag.Duration("out-of-disk-backoff", time.Minute, "the period of time this host will stop accepting work from all queues after an experiment ran out of disk")
+
+	// nodeLocalFailures contains expressions that when found in an error identify failures due
+	// to problems with the node rather than the experiment
+	nodeLocalFailures = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)no space left on device`),
+		regexp.MustCompile(`(?i)out of disk`),
+		regexp.MustCompile(`(?i)insufficient space`),
+		regexp.MustCompile(`(?i)read-only file system`),
+		regexp.MustCompile(`(?i)input/output error`),
+		regexp.MustCompile(`(?i)shared memory could not be provided`),
+		regexp.MustCompile(`(?i)\bnvml\b`),
+		regexp.MustCompile(`(?i)\becc\b`),
+		regexp.MustCompile(`(?i)cuda (driver|runtime|error)`),
+		regexp.MustCompile(`(?i)gpu (fault|failure|has fallen off the bus)`),
+	}
+
+	// avoids contains the keys of experiments that this host should leave for other hosts
+	avoids = cache.New(time.Minute, 10*time.Minute)
+
+	// retries counts the failed attempts of experiments that failed due to their own errors
+	retries = cache.New(time.Minute, 10*time.Minute)
+)
+
+// classifyFailure inspects an error from processing an experiment and decides
+// what was at fault
+//
+func classifyFailure(err errors.Error) (class failureClass) {
+	if err == nil {
+		return failIntrinsic
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "allocation fail") {
+		return failCapacity
+	}
+	for _, re := range nodeLocalFailures {
+		if re.MatchString(msg) {
+			return failNodeLocal
+		}
+	}
+	return failIntrinsic
+}
+
+// avoid records that this host should not accept the experiment for a period of time and
+// returns the time the avoidance ends
+//
+func avoid(key string) (until time.Time) {
+	until = time.Now().Add(*nodeAvoidTTLOpt)
+	avoids.Set(key, until, *nodeAvoidTTLOpt)
+	return until
+}
+
+// avoiding returns true if this host should leave the experiment for other hosts, along with
+// the time the avoidance ends
+//
+func avoiding(key string) (until time.Time, avoid bool) {
+	value, avoid := avoids.Get(key)
+	if !avoid {
+		return until, false
+	}
+	until, _ = value.(time.Time)
+	return until, true
+}
+
+// avoidHosts extracts the unexpired entries from the hint of the hosts avoiding a message
+//
+func avoidHosts(attrs map[string]string, now time.Time) (hosts map[string]time.Time) {
+	hosts = map[string]time.Time{}
+	for _, entry := range strings.Split(attrs[avoidHostsKey], ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			continue
+		}
+		secs, errGo := strconv.ParseInt(parts[1], 10, 64)
+		if errGo != nil {
+			continue
+		}
+		if until := time.Unix(secs, 0); until.After(now) {
+			hosts[parts[0]] = until
+		}
+	}
+	return hosts
+}
+
+// hintedAvoid returns true when the message carries a hint that this host is to avoid it
+//
+func hintedAvoid(attrs map[string]string) (avoid bool) {
+	_, avoid = avoidHosts(attrs, time.Now())[host]
+	return avoid
+}
+
+// avoidHint returns the attributes to be added to a message being returned to the queue so
+// that it carries the hosts avoiding it, this host being added when until is set
+//
+func avoidHint(attrs map[string]string, until time.Time) (hint map[string]string) {
+	hosts := avoidHosts(attrs, time.Now())
+	if !until.IsZero() {
+		hosts[host] = until
+	}
+
+	entries := make([]string, 0, len(hosts))
+	for name, until := range hosts {
+		entries = append(entries, name+"="+strconv.FormatInt(until.Unix(), 10))
+	}
+	sort.Strings(entries)
+
+	return map[string]string{avoidHostsKey: strings.Join(entries, ",")}
+}
+
+// retryExhausted counts an intrinsic failure of an experiment and returns true
+// when the experiment has used up all of its retries.  The number of retries is taken
+// from the experiment when it supplies one, otherwise from the runners policy.  Only the
+// failed attempts seen by this host are counted, the delivery counts reported by queues
+// also include the times an experiment was left on the queue for reasons unrelated to it
+// failing, such as the host being paused or lacking the hardware the experiment needs.
+//
+func retryExhausted(key string, maxRetries *int) (exhausted bool) {
+	limit := *maxRetriesOpt
+	if maxRetries != nil {
+		limit = *maxRetries
+	} else if limit <= 0 {
+		return false
+	}
+
+	cnt := 1
+	if v, isPresent := retries.Get(key); isPresent {
+		cnt = v.(int) + 1
+	}
+	retries.Set(key, cnt, 24*time.Hour)
+
+	return cnt > limit
+}
+
+// deadLetter saves the message of an experiment that will no longer be retried into the
+// dead letter directory, if one was configured
+//
+func deadLetter(qt *runner.QueueTask, key string) (err errors.Error) {
+	qt.Dumped = true
+	retries.Delete(key)
+
+	if len(*deadLetterDirOpt) == 0 {
+		return nil
+	}
+
+	if errGo := os.MkdirAll(*deadLetterDirOpt, 0700); errGo != nil {
+		return errors.Wrap(errGo).With("dir", *deadLetterDirOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	fn := filepath.Join(*deadLetterDirOpt, deadLetterName(filepath.Base(qt.Subscription))+"_"+deadLetterName(key)+".json")
+	if errGo := ioutil.WriteFile(fn, qt.Msg, 0600); errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// deadLetterName returns a name that can be used within the file name of a dead letter, names
+// that could refer to another directory, or that contain unexpected characters, are replaced
+// with a hex digest of the name
+//
+func deadLetterName(name string) (safe string) {
+	if len(name) != 0 && len(name) <= 128 && !strings.Contains(name, "..") && deadLetterSafe.MatchString(name) {
+		return name
+	}
+	digest := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(digest[:])
+}
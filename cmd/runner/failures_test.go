@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestRetryBudget checks that the retries allowed for an experiment come from the experiment
+// when it supplies them
+//
+func TestRetryBudget(t *testing.T) {
+
+	saved := *maxRetriesOpt
+	defer func() { *maxRetriesOpt = saved }()
+	*maxRetriesOpt = 3
+
+	// The runners policy applies to experiments without a budget of their own
+	for attempt := 1; attempt <= 3; attempt++ {
+		if retryExhausted("policy", nil) {
+			t.Fatalf("experiment dead-lettered after %d attempts", attempt)
+		}
+	}
+	if !retryExhausted("policy", nil) {
+		t.Fatal("experiment not dead-lettered once the policy was exhausted")
+	}
+
+	// An experiment can ask for fewer, or no, retries
+	none := 0
+	if !retryExhausted("no-retries", &none) {
+		t.Fatal("experiment without retries was retried")
+	}
+
+	// An experiment can ask for more retries than the policy allows
+	many := 5
+	for attempt := 1; attempt <= 5; attempt++ {
+		if retryExhausted("many", &many) {
+			t.Fatalf("experiment dead-lettered after %d of 5 retries", attempt)
+		}
+	}
+
+	// Only failed attempts are counted, not the times the experiment was delivered
+	one := 1
+	if retryExhausted("redelivered", &one) {
+		t.Fatal("experiment dead-lettered on its first failure")
+	}
+	if !retryExhausted("redelivered", &one) {
+		t.Fatal("experiment retried beyond its budget")
+	}
+
+	// A policy of zero retries forever unless the experiment supplies a budget
+	*maxRetriesOpt = 0
+	if retryExhausted("forever", nil) {
+		t.Fatal("experiment dead-lettered when retrying forever")
+	}
+}
+
+// TestDeadLetterName checks that experiment keys cannot place dead letters outside of the
+// dead letter directory
+//
+func TestDeadLetterName(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "dead-letter-name")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := *deadLetterDirOpt
+	*deadLetterDirOpt = filepath.Join(dir, "dead")
+	defer func() { *deadLetterDirOpt = saved }()
+
+	qt := &runner.QueueTask{Subscription: "queue", Msg: []byte("{}")}
+	for _, key := range []string{"../../escaped", "/tmp/escaped", "..", "experiment-1.2_a"} {
+		if err := deadLetter(qt, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if escaped, _ := filepath.Glob(filepath.Join(dir, "*escaped*")); len(escaped) != 0 {
+		t.Fatalf("dead letter written outside of its directory %v", escaped)
+	}
+	letters, _ := filepath.Glob(filepath.Join(*deadLetterDirOpt, "queue_*.json"))
+	if len(letters) != 4 {
+		t.Fatalf("dead letters not written %v", letters)
+	}
+	if _, errGo = os.Stat(filepath.Join(*deadLetterDirOpt, "queue_experiment-1.2_a.json")); errGo != nil {
+		t.Fatal("dead letter of a plain key was renamed")
+	}
+}
+
+// TestAvoidHint checks that the hint carried by a message lists the hosts avoiding it, that
+// expired entries are dropped, and that this host is recognized in the hint
+//
+func TestAvoidHint(t *testing.T) {
+
+	now := time.Now()
+	expired := strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)
+	later := now.Add(time.Hour).Truncate(time.Second)
+
+	attrs := map[string]string{avoidHostsKey: "expired-host=" + expired + ",other-host=" + strconv.FormatInt(later.Unix(), 10) + ",garbage"}
+	if hintedAvoid(attrs) {
+		t.Fatal("a hint without this host caused it to be avoided")
+	}
+
+	hint := avoidHint(attrs, later)
+	hosts := avoidHosts(hint, now)
+	if len(hosts) != 2 || !hosts["other-host"].Equal(later) || !hosts[host].Equal(later) {
+		t.Fatalf("unexpected hosts %v in the hint %v", hosts, hint)
+	}
+	if !hintedAvoid(hint) {
+		t.Fatal("a hint including this host did not cause it to be avoided")
+	}
+
+	// Without this host avoiding the experiment the hint is only carried forward
+	if hosts = avoidHosts(avoidHint(attrs, time.Time{}), now); len(hosts) != 1 {
+		t.Fatalf("unexpected hosts %v carried forward", hosts)
+	}
+	if hintedAvoid(nil) {
+		t.Fatal("a message without attributes caused this host to avoid it")
+	}
+
+	// Entries for this host are only honored until they expire
+	if hintedAvoid(map[string]string{avoidHostsKey: host + "=" + expired}) {
+		t.Fatal("an expired hint caused this host to avoid a message")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+// This file contains the implementation of weighted fair sharing of this node across
+// projects.  Each project has a producer that independently looks for work, without
+// fair sharing a project that floods its queues will monopolize the node.  The node
+// time consumed by the experiments of every project is accumulated and decays
+// exponentially over a configurable window.  When other projects that have recently
+// had work are under-served, relative to their weights, the producer for a project
+// that has consumed more than its share will skip looking for work in proportion to
+// how far over its share it is.
+
+import (
+	"flag"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	fairShareWindowOpt  = flag.Duration("fair-share-window", time.Hour, "the period over which node time consumed by projects decays when sharing the node fairly, 0 disables fair sharing")
+	fairShareWeightsOpt = flag.String("fair-share-weights", "", "a comma separated list of project=weight pairs used to give projects a larger share of the node, projects not listed have a weight of 1")
+
+	fairShare = newFairShares()
+)
+
+const (
+	// fairShareActive is the period of time since a project last started an experiment
+	// during which it is considered to be contending for the node
+	fairShareActive = time.Minute
+)
+
+// projectShare is the accounting for the node time consumed by a single project
+//
+type projectShare struct {
+	usage    float64   // Decayed experiment seconds consumed
+	running  int       // Experiments currently running
+	updated  time.Time // When the usage was last brought up to date
+	lastWork time.Time // When the project last started an experiment
+}
+
+// fairShares tracks the node time consumed by all projects
+//
+type fairShares struct {
+	projects map[string]*projectShare
+	weights  map[string]float64
+	window   time.Duration
+	sync.Mutex
+}
+
+func newFairShares() (fs *fairShares) {
+	return &fairShares{
+		projects: map[string]*projectShare{},
+		weights:  map[string]float64{},
+	}
+}
+
+// initFairShare loads the fair sharing options
+//
+func initFairShare() (err errors.Error) {
+	weights, err := parseFairShareWeights(*fairShareWeightsOpt)
+	if err != nil {
+		return err
+	}
+
+	fairShare.Lock()
+	defer fairShare.Unlock()
+
+	fairShare.weights = weights
+	fairShare.window = *fairShareWindowOpt
+
+	return nil
+}
+
+func parseFairShareWeights(spec string) (weights map[string]float64, err errors.Error) {
+	weights = map[string]float64{}
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		// Project names can be URLs so the weight is taken from after the last equals sign
+		split := strings.LastIndex(pair, "=")
+		if split < 1 {
+			return nil, errors.New("fair share weight malformed").With("weight", pair).With("stack", stack.Trace().TrimRuntime())
+		}
+		weight, errGo := strconv.ParseFloat(pair[split+1:], 64)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("weight", pair).With("stack", stack.Trace().TrimRuntime())
+		}
+		if weight <= 0 {
+			return nil, errors.New("fair share weight must be positive").With("weight", pair).With("stack", stack.Trace().TrimRuntime())
+		}
+		weights[pair[:split]] = weight
+	}
+	return weights, nil
+}
+
+// accrue brings the usage of a project up to date, the caller must hold the lock
+//
+func (fs *fairShares) accrue(share *projectShare, now time.Time) {
+	elapsed := now.Sub(share.updated)
+	if elapsed <= 0 {
+		return
+	}
+	decay := math.Exp(-elapsed.Seconds() / fs.window.Seconds())
+	share.usage = share.usage*decay + float64(share.running)*elapsed.Seconds()
+	share.updated = now
+}
+
+func (fs *fairShares) get(project string, now time.Time) (share *projectShare) {
+	share, isPresent := fs.projects[project]
+	if !isPresent {
+		share = &projectShare{updated: now}
+		fs.projects[project] = share
+	}
+	fs.accrue(share, now)
+	return share
+}
+
+func (fs *fairShares) weight(project string) float64 {
+	if weight, isPresent := fs.weights[project]; isPresent {
+		return weight
+	}
+	return 1.0
+}
+
+// started records that an experiment from the project has started, the returned function
+// should be called when the experiment stops
+//
+func (fs *fairShares) started(project string, now time.Time) (stopped func(now time.Time)) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	share := fs.get(project, now)
+	share.running++
+	share.lastWork = now
+
+	once := sync.Once{}
+	return func(now time.Time) {
+		once.Do(func() {
+			fs.Lock()
+			defer fs.Unlock()
+
+			fs.get(project, now).running--
+		})
+	}
+}
+
+// odds returns the probability with which the producer for a project should look for work
+// in order for the node to be shared fairly.  A project that is the most under-served of the
+// projects that have recently had work will always look for work.
+//
+func (fs *fairShares) odds(project string, now time.Time) (odds float64) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if fs.window <= 0 {
+		return 1.0
+	}
+
+	own := fs.get(project, now).usage / fs.weight(project)
+	least := own
+
+	for name, share := range fs.projects {
+		if name == project {
+			continue
+		}
+		fs.accrue(share, now)
+		if share.running == 0 && now.Sub(share.lastWork) > fairShareActive {
+			continue
+		}
+		if usage := share.usage / fs.weight(name); usage < least {
+			least = usage
+		}
+	}
+
+	// Usage is measured in seconds so adding a second avoids dividing by zero and
+	// makes little difference to projects that have been busy
+	return (least + 1.0) / (own + 1.0)
+}
+
+// turn is used by producers to decide if a project should look for work on this pass
+//
+func (fs *fairShares) turn(project string) bool {
+	odds := fs.odds(project, time.Now())
+	return odds >= 1.0 || rand.Float64() < odds
+}
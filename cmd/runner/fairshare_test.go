@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestFairShare checks that a project that has consumed more than its weighted share of
+// the node yields to other projects that have work
+//
+func TestFairShare(t *testing.T) {
+
+	fs := newFairShares()
+	fs.window = time.Hour
+	weights, err := parseFairShareWeights("heavy=1, https://example.com/light=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.weights = weights
+
+	now := time.Now()
+
+	// A single project with no competition always gets to look for work
+	stopHeavy := fs.started("heavy", now)
+	now = now.Add(10 * time.Minute)
+	if odds := fs.odds("heavy", now); odds < 1.0 {
+		t.Fatalf("uncontended project had odds of %f", odds)
+	}
+
+	// Once another project has work the heavy user gives way
+	stopLight := fs.started("https://example.com/light", now)
+	now = now.Add(time.Second)
+	if odds := fs.odds("heavy", now); odds > 0.01 {
+		t.Fatalf("heavy project had odds of %f", odds)
+	}
+	if odds := fs.odds("https://example.com/light", now); odds < 1.0 {
+		t.Fatalf("light project had odds of %f", odds)
+	}
+
+	// After the projects stop and the window has passed several times usage has
+	// decayed and the projects are treated equally again
+	stopHeavy(now)
+	stopLight(now)
+	now = now.Add(10 * time.Hour)
+	if odds := fs.odds("heavy", now); odds < 0.99 {
+		t.Fatalf("decayed project had odds of %f", odds)
+	}
+
+	if _, err = parseFairShareWeights("heavy=-1"); err == nil {
+		t.Fatal("a negative weight was accepted")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+// This file contains the implementation of the accounting used when the producer checks
+// several idle queues for work on a single pass.  The machines free resources do not
+// change until the work that was dispatched has been received and allocated, so the
+// resources expected by each queue dispatched during a pass are deducted from the
+// headroom presented to the queues checked after it, preventing the node from being
+// oversubscribed.
+
+import (
+	"flag"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	queueFanoutOpt = flag.Uint("queue-check-fanout", 1, "the maximum number of idle queues checked for work on each pass of the queue producer, checks stop once the node has no capacity for further work")
+)
+
+// validateFanout checks the queue fan-out option
+//
+func validateFanout() (err errors.Error) {
+	if *queueFanoutOpt == 0 {
+		return errors.New("queue-check-fanout must be at least 1").With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// checkPass holds the resources claimed by the queues dispatched during a single pass of the
+// producer
+//
+type checkPass struct {
+	cpus   uint
+	gpus   uint
+	mem    uint64
+	hdd    uint64
+	gpuMem uint64
+
+	dispatched uint
+}
+
+// deduct removes the resources claimed during the pass from the headroom of the machine
+//
+func (pass *checkPass) deduct(headroom *runner.Resource) (avail *runner.Resource) {
+	if pass == nil || pass.dispatched == 0 || headroom == nil {
+		return headroom
+	}
+	avail = headroom.Clone()
+	if avail == nil {
+		return headroom
+	}
+
+	avail.Cpus = subUint(avail.Cpus, pass.cpus)
+	avail.Gpus = subUint(avail.Gpus, pass.gpus)
+	avail.Ram = subBytes(avail.Ram, pass.mem)
+	avail.Hdd = subBytes(avail.Hdd, pass.hdd)
+	avail.GpuMem = subBytes(avail.GpuMem, pass.gpuMem)
+
+	return avail
+}
+
+// claim records the resources expected by a queue that was dispatched during the pass
+//
+func (pass *checkPass) claim(rsc *runner.Resource) {
+	if pass == nil {
+		return
+	}
+	pass.dispatched++
+
+	if rsc == nil {
+		return
+	}
+
+	cpus := rsc.Cpus
+	if rsc.MinCpus != 0 && rsc.MinCpus < cpus {
+		cpus = rsc.MinCpus
+	}
+	pass.cpus += cpus
+
+	if !rsc.GpuShare {
+		pass.gpus += rsc.Gpus
+	}
+
+	ram := rsc.Ram
+	if len(rsc.MinRam) != 0 {
+		ram = rsc.MinRam
+	}
+	mem, _ := humanize.ParseBytes(ram)
+	shm, _ := runner.ShmSize(rsc)
+	pass.mem += mem + shm
+
+	hdd, _ := humanize.ParseBytes(rsc.Hdd)
+	pass.hdd += hdd
+
+	gpuMem, _ := humanize.ParseBytes(rsc.GpuMem)
+	pass.gpuMem += gpuMem
+}
+
+// subBytes subtracts a number of bytes from a humanized quantity, unparsable quantities are
+// returned unchanged
+//
+func subBytes(quantity string, used uint64) (left string) {
+	if len(quantity) == 0 {
+		return quantity
+	}
+	avail, errGo := humanize.ParseBytes(quantity)
+	if errGo != nil {
+		return quantity
+	}
+	if avail < used {
+		return humanize.Bytes(0)
+	}
+	return humanize.Bytes(avail - used)
+}
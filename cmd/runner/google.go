@@ -137,16 +137,8 @@ func servicePubsub(ctx context.Context, connTimeout time.Duration) {
 	for {
 		select {
 		case <-ctx.Done():
-
-			live.Lock()
-			defer live.Unlock()
-
 			// When shutting down stop all projects
-			for _, quiter := range live.projects {
-				if quiter != nil {
-					quiter()
-				}
-			}
+			live.stopAll()
 			return
 
 		case state = <-lifecycleC:
@@ -158,7 +150,7 @@ func servicePubsub(ctx context.Context, connTimeout time.Duration) {
 			}
 			credCheck = time.Duration(15 * time.Second)
 
-			dir, errGo := filepath.Abs(*googleCertsDirOpt)
+			dir, errGo := filepath.Abs(googleCertsSetting())
 			if errGo != nil {
 				logger.Warn(fmt.Sprintf("%#v", errGo))
 				continue
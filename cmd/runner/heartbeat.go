@@ -0,0 +1,182 @@
+package main
+
+// This file contains the implementation of a publisher that registers the runner with an
+// external fleet registry and regularly sends it heartbeats describing the node, its load,
+// and the experiments it is running.  Heartbeats are sent using HTTP PUT requests to a URL
+// naming the runner, and the runner is removed from the registry using an HTTP DELETE
+// request to the same URL when it shuts down cleanly.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	heartbeatURLOpt      = flag.String("heartbeat-url", "", "the URL of a fleet registry that the runner sends heartbeats to, the host name of the runner is appended to the URL, for example http://registry:8080/runners")
+	heartbeatIntervalOpt = flag.Duration("heartbeat-interval", 30*time.Second, "the interval between heartbeats sent to the fleet registry")
+
+	heartbeats = &heartbeatPublisher{}
+)
+
+// heartbeatDoc is the document sent to the registry, it contains the same status as the
+// status endpoint along with the load on the runner
+//
+type heartbeatDoc struct {
+	runnerStatus
+	Version      string                   `json:"version"`
+	Zone         string                   `json:"zone,omitempty"`
+	InstanceType string                   `json:"instance_type,omitempty"`
+	InstanceID   string                   `json:"instance_id,omitempty"`
+	State        string                   `json:"state"`
+	Resources    *runner.ResourceSnapshot `json:"resources"`
+	Experiments  []runningExperiment      `json:"experiments"`
+	Interval     float64                  `json:"interval_seconds"`
+	SentAt       time.Time                `json:"sent_at"`
+}
+
+// heartbeatPublisher sends heartbeats to the registry in the background
+//
+type heartbeatPublisher struct {
+	endpoint string
+	client   *http.Client
+	stoppedC chan struct{}
+}
+
+// initHeartbeat validates the heartbeat options and when a registry was configured starts
+// sending heartbeats to it
+//
+func initHeartbeat(ctx context.Context) (err errors.Error) {
+	if len(*heartbeatURLOpt) == 0 {
+		return nil
+	}
+
+	registry, errGo := url.Parse(*heartbeatURLOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo, "heartbeat-url is invalid").With("url", *heartbeatURLOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if registry.Scheme != "http" && registry.Scheme != "https" {
+		return errors.New("heartbeat-url must be an http or https URL").With("url", *heartbeatURLOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if *heartbeatIntervalOpt <= 0 {
+		return errors.New("heartbeat-interval must be positive").With("interval", heartbeatIntervalOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	heartbeats.endpoint = strings.TrimRight(registry.String(), "/") + "/" + url.PathEscape(host)
+	heartbeats.client = &http.Client{Timeout: 15 * time.Second}
+	heartbeats.stoppedC = make(chan struct{})
+
+	go heartbeats.run(ctx, *heartbeatIntervalOpt)
+
+	return nil
+}
+
+// heartbeat gathers the current state of the runner
+//
+func heartbeat(interval time.Duration) (doc *heartbeatDoc) {
+	node := runner.GetNodeMeta()
+	state, _ := lifecycle.get()
+
+	return &heartbeatDoc{
+		runnerStatus: currentStatus(),
+		Version:      gitHash,
+		Zone:         node.Zone,
+		InstanceType: node.InstanceType,
+		InstanceID:   node.InstanceID,
+		State:        state.String(),
+		Resources:    runner.SnapshotResources(),
+		Experiments:  running.snapshot(),
+		Interval:     interval.Seconds(),
+		SentAt:       time.Now(),
+	}
+}
+
+func (hb *heartbeatPublisher) run(ctx context.Context, interval time.Duration) {
+	defer close(hb.stoppedC)
+
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	// Failures are logged when the registry first becomes unreachable and when it recovers
+	// rather than for every heartbeat
+	failing := false
+	for {
+		err := hb.send(ctx, http.MethodPut, heartbeat(interval))
+		switch {
+		case err != nil && !failing:
+			logger.Warn("fleet registry unreachable", "url", hb.endpoint, "error", err.Error())
+		case err == nil && failing:
+			logger.Info("fleet registry reachable", "url", hb.endpoint)
+		}
+		failing = err != nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// deregister removes the runner from the registry once heartbeats have stopped
+//
+func (hb *heartbeatPublisher) deregister() {
+	if len(hb.endpoint) == 0 {
+		return
+	}
+	<-hb.stoppedC
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := hb.send(ctx, http.MethodDelete, nil); err != nil {
+		logger.Warn("fleet registry deregistration failed", "url", hb.endpoint, "error", err.Error())
+		return
+	}
+	logger.Info("fleet registry deregistered", "url", hb.endpoint)
+}
+
+func (hb *heartbeatPublisher) send(ctx context.Context, method string, doc *heartbeatDoc) (err errors.Error) {
+	body := io.Reader(nil)
+	if doc != nil {
+		buf, errGo := json.Marshal(doc)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, errGo := http.NewRequest(method, hb.endpoint, body)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", hb.endpoint).With("stack", stack.Trace().TrimRuntime())
+	}
+	req = req.WithContext(ctx)
+	if doc != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, errGo := hb.client.Do(req)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", hb.endpoint).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("fleet registry returned %s", resp.Status)).With("url", hb.endpoint).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHeartbeat checks that heartbeats are sent to the registry while the runner is running,
+// including while the registry is failing, and that the runner deregisters itself when stopped
+//
+func TestHeartbeat(t *testing.T) {
+
+	methods := []string{}
+	methodsLock := sync.Mutex{}
+	beats := make(chan heartbeatDoc, 10)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methodsLock.Lock()
+		methods = append(methods, r.Method)
+		failing := len(methods) == 1
+		methodsLock.Unlock()
+
+		if r.Method == http.MethodPut {
+			doc := heartbeatDoc{}
+			if errGo := json.NewDecoder(r.Body).Decode(&doc); errGo != nil {
+				t.Error(errGo)
+			}
+			select {
+			case beats <- doc:
+			default:
+			}
+		}
+		// The registry being unavailable should not stop the heartbeats
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer registry.Close()
+
+	hb := &heartbeatPublisher{
+		endpoint: registry.URL + "/runners/test-host",
+		client:   &http.Client{Timeout: time.Second},
+		stoppedC: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go hb.run(ctx, 20*time.Millisecond)
+
+	for i := 0; i != 3; i++ {
+		select {
+		case doc := <-beats:
+			if doc.Host != host {
+				t.Fatalf("heartbeat for host %s, expected %s", doc.Host, host)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("heartbeat not received")
+		}
+	}
+
+	cancel()
+	hb.deregister()
+
+	methodsLock.Lock()
+	defer methodsLock.Unlock()
+	if last := methods[len(methods)-1]; last != http.MethodDelete {
+		t.Fatalf("expected the runner to deregister, the last request was %s", last)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+// This file contains the implementation of the advisory logged when a node has gone a long
+// time without running an experiment.  A node that has capacity but finds no messages on its
+// queues is simply idle and is not worth alerting on, however a node that receives messages
+// and keeps returning them to their queues, or that cannot fit the work waiting on a queue,
+// usually has a resource problem such as a full disk that needs attention.
+//
+// The advisory is only raised as a warning when there is evidence that work was waiting for
+// the node, messages that were received but not run, or queues that reported a backlog of
+// messages, when reported by the queue implementation, while the node could not fit their
+// work.  Otherwise the idle period is logged at the debug level.
+
+import (
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	idleAdvisoryOpt       = flag.Duration("idle-advisory", time.Hour, "the period a node can go without running an experiment, while work is waiting for it, before a warning is logged, 0 disables the warning")
+	idleAdvisoryRepeatOpt = flag.Duration("idle-advisory-repeat", 10*time.Minute, "the period between repeats of the idle-advisory warning while the node remains idle")
+
+	idleness = newIdleTracker()
+)
+
+// queueBacklog is the number of messages a queue last reported as waiting
+//
+type queueBacklog struct {
+	waiting  uint64
+	reported time.Time
+}
+
+// idleTracker gathers the evidence of work waiting for the node since an experiment was last
+// run on it
+//
+type idleTracker struct {
+	active   time.Time               // When an experiment was last seen running on the node
+	declined uint64                  // Messages received since active that were not run
+	unfit    uint64                  // Checks since active of queues with a backlog that did not fit the node
+	backlogs map[string]queueBacklog // The messages last reported waiting on queues, when known
+	nextWarn time.Time
+	sync.Mutex
+}
+
+// idleAdvisory describes a period of time during which the node ran no experiments
+//
+type idleAdvisory struct {
+	Idle     time.Duration
+	Declined uint64
+	Unfit    uint64
+	Backlog  uint64
+}
+
+func newIdleTracker() (tracker *idleTracker) {
+	return &idleTracker{
+		active:   time.Now(),
+		backlogs: map[string]queueBacklog{},
+	}
+}
+
+// validateIdleAdvisory checks the idle-advisory options
+//
+func validateIdleAdvisory() (err errors.Error) {
+	if *idleAdvisoryOpt > 0 && *idleAdvisoryRepeatOpt <= 0 {
+		return errors.New("idle-advisory-repeat must be positive").With("idle-advisory-repeat", idleAdvisoryRepeatOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// received records the outcome of a fetch from a queue, msgs is the number of messages
+// received, backlog the number the queue reported as waiting behind them, and ran is true
+// when the work was run
+//
+func (it *idleTracker) received(queue string, msgs uint64, backlog uint64, ran bool) {
+	it.Lock()
+	defer it.Unlock()
+
+	if backlog == 0 {
+		delete(it.backlogs, queue)
+	} else {
+		it.backlogs[queue] = queueBacklog{waiting: backlog, reported: time.Now()}
+	}
+
+	if ran {
+		it.reset(time.Now())
+		return
+	}
+	it.declined += msgs
+}
+
+// noFit records that a queue was checked and its work did not fit the resources of the node,
+// this only counts as work waiting when the queue is known to have a backlog
+//
+func (it *idleTracker) noFit(queue string) {
+	it.Lock()
+	defer it.Unlock()
+
+	if backlog, isPresent := it.backlogs[queue]; isPresent && backlog.waiting != 0 {
+		it.unfit++
+	}
+}
+
+func (it *idleTracker) reset(now time.Time) {
+	it.active = now
+	it.declined = 0
+	it.unfit = 0
+	it.nextWarn = time.Time{}
+}
+
+// advise is called periodically with the running state of the node, when the node has been
+// idle for longer than the idle-advisory period an advisory is returned no more often than
+// the repeat period, nil is returned otherwise
+//
+func (it *idleTracker) advise(now time.Time, running bool) (advisory *idleAdvisory) {
+	it.Lock()
+	defer it.Unlock()
+
+	if running {
+		it.reset(now)
+		return nil
+	}
+	if *idleAdvisoryOpt <= 0 || now.Sub(it.active) < *idleAdvisoryOpt || now.Before(it.nextWarn) {
+		return nil
+	}
+	it.nextWarn = now.Add(*idleAdvisoryRepeatOpt)
+
+	advisory = &idleAdvisory{
+		Idle:     now.Sub(it.active),
+		Declined: it.declined,
+		Unfit:    it.unfit,
+	}
+	// Backlogs reported before the idle period began could be from queues since drained by
+	// other nodes
+	for queue, backlog := range it.backlogs {
+		if backlog.reported.Before(it.active) {
+			delete(it.backlogs, queue)
+			continue
+		}
+		advisory.Backlog += backlog.waiting
+	}
+	return advisory
+}
+
+// workWaiting is true when there was evidence of work waiting for the node while it was idle
+//
+func (advisory *idleAdvisory) workWaiting() (waiting bool) {
+	return advisory.Declined != 0 || advisory.Unfit != 0 || advisory.Backlog != 0
+}
+
+// log outputs the advisory, as a warning only when work was waiting for the node
+//
+func (advisory *idleAdvisory) log() {
+	if !advisory.workWaiting() {
+		logger.Debug("this host has been idle with no work waiting", "idleTime", advisory.Idle.String())
+		return
+	}
+	logger.Warn("this host has been idle for a long period of time while work was waiting, please check for disk space etc resource availability",
+		"idleTime", advisory.Idle.String(), "declined", advisory.Declined, "unfit", advisory.Unfit, "backlog", advisory.Backlog)
+}
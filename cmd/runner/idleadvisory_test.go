@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestIdleAdvisory checks that idle periods are only warned about when work was waiting for
+// the node, that the advisory repeats at its interval, and that running work resets it
+//
+func TestIdleAdvisory(t *testing.T) {
+	savedIdle, savedRepeat := *idleAdvisoryOpt, *idleAdvisoryRepeatOpt
+	defer func() {
+		*idleAdvisoryOpt, *idleAdvisoryRepeatOpt = savedIdle, savedRepeat
+	}()
+	*idleAdvisoryOpt = time.Hour
+	*idleAdvisoryRepeatOpt = 10 * time.Minute
+
+	start := time.Now()
+	tracker := newIdleTracker()
+	tracker.reset(start)
+
+	if advisory := tracker.advise(start.Add(30*time.Minute), false); advisory != nil {
+		t.Fatal("advisory raised before the idle-advisory period")
+	}
+
+	// Idle with empty queues is not a problem
+	tracker.received("project:empty", 0, 0, false)
+	advisory := tracker.advise(start.Add(61*time.Minute), false)
+	if advisory == nil {
+		t.Fatal("no advisory after the idle-advisory period")
+	}
+	if advisory.workWaiting() {
+		t.Fatalf("work reported waiting for an idle node with empty queues %+v", advisory)
+	}
+
+	// Messages that were received and not run are worth warning about, once per repeat
+	tracker.received("project:busy", 1, 4, false)
+	tracker.noFit("project:busy")
+	tracker.noFit("project:empty")
+	if advisory := tracker.advise(start.Add(65*time.Minute), false); advisory != nil {
+		t.Fatal("advisory repeated before the idle-advisory-repeat period")
+	}
+	advisory = tracker.advise(start.Add(72*time.Minute), false)
+	if advisory == nil || !advisory.workWaiting() {
+		t.Fatalf("declined work not reported %+v", advisory)
+	}
+	if advisory.Declined != 1 || advisory.Unfit != 1 || advisory.Backlog != 4 {
+		t.Fatalf("unexpected advisory %+v", advisory)
+	}
+
+	// Running work resets the idle period
+	if advisory := tracker.advise(start.Add(90*time.Minute), true); advisory != nil {
+		t.Fatal("advisory raised while experiments were running")
+	}
+	if advisory := tracker.advise(start.Add(120*time.Minute), false); advisory != nil {
+		t.Fatal("advisory raised before the idle-advisory period after running work")
+	}
+
+	// A zero period disables the advisory
+	*idleAdvisoryOpt = 0
+	if advisory := tracker.advise(start.Add(24*time.Hour), false); advisory != nil {
+		t.Fatal("disabled advisory raised")
+	}
+}
@@ -23,6 +23,15 @@ func initiateK8s(ctx context.Context, namespace string, cfgMap string, errorC ch
 
 	listeners = runner.NewStateBroadcast(ctx, errorC)
 
+	// Kubernetes state changes are merged with any maintenance windows before being
+	// broadcast to the listeners
+	windows, err := parseMaintWindows(*maintWindowsOpt)
+	if err != nil {
+		return err
+	}
+	k8sC := make(chan runner.K8sStateUpdate, 1)
+	go lifecycleMerger(ctx, windows, k8sC, listeners.Master)
+
 	// Watch for k8s events that are of interest
 	go runner.MonitorK8s(ctx, errorC)
 
@@ -44,7 +53,7 @@ func initiateK8s(ctx context.Context, namespace string, cfgMap string, errorC ch
 		// If k8s is specified we need to start a listener for lifecycle
 		// states being set in the k8s config map or within a config map
 		// that matches our pod/hostname
-		if err = runner.ListenK8s(ctx, *cfgNamespace, *cfgConfigMap, podMap, listeners.Master, errorC); err != nil {
+		if err = runner.ListenK8s(ctx, *cfgNamespace, *cfgConfigMap, podMap, k8sC, errorC); err != nil {
 			fmt.Println(errors.Wrap(err).With("stack", stack.Trace().TrimRuntime()).Error())
 			return err
 		}
@@ -0,0 +1,171 @@
+package main
+
+// This file contains the implementation of a publisher that sends experiment completion
+// events to a Kafka topic.  A native Kafka client is not available to the runner so events
+// are produced using the Kafka REST proxy protocol, as implemented by the Confluent REST
+// proxy and Redpanda, with the experiment key used as the record key.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	kafkaResultsProxyOpt = flag.String("results-kafka-proxy", "", "the URL of a Kafka REST proxy used to publish experiment completion events, for example http://kafka-rest:8082")
+	kafkaResultsTopicOpt = flag.String("results-kafka-topic", "studioml-results", "the Kafka topic that experiment completion events are published to")
+
+	kafkaResults = &kafkaPublisher{}
+)
+
+const (
+	kafkaContentType = "application/vnd.kafka.json.v2+json"
+	kafkaAttempts    = 3
+)
+
+// kafkaPublisher sends completion events to a Kafka topic in the background
+//
+type kafkaPublisher struct {
+	endpoint string
+	events   chan *resultEvent
+	client   *http.Client
+}
+
+// initKafkaResults validates the Kafka results options and when a proxy was configured
+// starts the background publisher
+//
+func initKafkaResults(ctx context.Context) (err errors.Error) {
+	if len(*kafkaResultsProxyOpt) == 0 {
+		return nil
+	}
+
+	proxy, errGo := url.Parse(*kafkaResultsProxyOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo, "results-kafka-proxy is invalid").With("url", *kafkaResultsProxyOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if proxy.Scheme != "http" && proxy.Scheme != "https" {
+		return errors.New("results-kafka-proxy must be an http or https URL").With("url", *kafkaResultsProxyOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(*kafkaResultsTopicOpt) == 0 {
+		return errors.New("results-kafka-topic must be set when results-kafka-proxy is used").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	kafkaResults.endpoint = strings.TrimRight(proxy.String(), "/") + "/topics/" + url.PathEscape(*kafkaResultsTopicOpt)
+	kafkaResults.client = &http.Client{Timeout: 30 * time.Second}
+	kafkaResults.events = make(chan *resultEvent, 256)
+
+	go kafkaResults.run(ctx)
+
+	return nil
+}
+
+// publish queues an event for sending, events are dropped rather than blocking the
+// experiment should the proxy be unable to keep up
+//
+func (k *kafkaPublisher) publish(event *resultEvent) {
+	if k.events == nil {
+		return
+	}
+	select {
+	case k.events <- event:
+	default:
+		logger.Warn("kafka result dropped", "experiment_id", event.Key, "topic", *kafkaResultsTopicOpt)
+	}
+}
+
+func (k *kafkaPublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-k.events:
+			if err := k.send(ctx, event); err != nil {
+				logger.Warn("kafka result not published", "experiment_id", event.Key, "topic", *kafkaResultsTopicOpt, "error", err.Error())
+			}
+		}
+	}
+}
+
+// send produces a single event to the topic, retrying failures that might be temporary
+//
+func (k *kafkaPublisher) send(ctx context.Context, event *resultEvent) (err errors.Error) {
+	body, errGo := json.Marshal(map[string]interface{}{
+		"records": []interface{}{
+			map[string]interface{}{
+				"key":   event.Key,
+				"value": event,
+			},
+		},
+	})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := k.produce(ctx, body)
+		if err == nil || !retry || attempt >= kafkaAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// produce makes a single request to the proxy, retry is true if the failure might succeed
+// if repeated
+//
+func (k *kafkaPublisher) produce(ctx context.Context, body []byte) (retry bool, err errors.Error) {
+	req, errGo := http.NewRequest(http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if errGo != nil {
+		return false, errors.Wrap(errGo).With("url", k.endpoint).With("stack", stack.Trace().TrimRuntime())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json, application/json")
+
+	resp, errGo := k.client.Do(req)
+	if errGo != nil {
+		return true, errors.Wrap(errGo).With("url", k.endpoint).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			errors.New(fmt.Sprintf("kafka proxy returned %s", resp.Status)).With("url", k.endpoint, "response", string(respBody)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// The proxy reports failures of individual records within a successful response
+	produced := struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}{}
+	if errGo = json.Unmarshal(respBody, &produced); errGo != nil {
+		return false, nil
+	}
+	for _, offset := range produced.Offsets {
+		if offset.ErrorCode != nil {
+			// Error codes of 1 are retriable errors, 2 are not
+			return *offset.ErrorCode == 1, errors.New("kafka record not produced").With("url", k.endpoint, "error_code", *offset.ErrorCode, "error", offset.Error).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestKafkaResults checks that completion events are produced to the REST proxy using the
+// experiment key as the record key and that temporary failures are retried
+//
+func TestKafkaResults(t *testing.T) {
+
+	attempts := 0
+	received := make(chan map[string]interface{}, 1)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/topics/results" || r.Header.Get("Content-Type") != kafkaContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		records := map[string]interface{}{}
+		if errGo := json.Unmarshal(body, &records); errGo != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- records
+		w.Write([]byte(`{"offsets": [{"partition": 0, "offset": 1}]}`))
+	}))
+	defer proxy.Close()
+
+	publisher := &kafkaPublisher{
+		endpoint: proxy.URL + "/topics/results",
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	event := &resultEvent{Key: "experiment", Status: resultCompleted}
+	if err := publisher.send(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	records := <-received
+	record := records["records"].([]interface{})[0].(map[string]interface{})
+	if record["key"] != "experiment" {
+		t.Fatalf("record key was %v", record["key"])
+	}
+	if value := record["value"].(map[string]interface{}); value["status"] != resultCompleted {
+		t.Fatalf("record status was %v", value["status"])
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, %d were made", attempts)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+// This file contains the implementation of license tokens.  Frameworks that are licensed for a
+// limited number of concurrent jobs across the fleet can have runners lease a token from a
+// license, or quota, server before an experiment is started and release it once the
+// experiment has finished.  When no tokens are free the experiment is returned to its queue
+// and the queue backed off so that it is retried later.
+//
+// Tokens are leased for a limited time and the runner renews the lease while the experiment
+// runs.  A runner that crashes, or a node that is lost, stops renewing its leases and the
+// license server reclaims the tokens once their leases expire so that capacity is never
+// permanently consumed.
+//
+// The license server is expected to implement the following,
+//
+//   POST   {server}/pools/{pool}/leases       leases a token, 200 or 201 with {"id": ...},
+//                                             409 or 429 when no tokens are free
+//   PUT    {server}/pools/{pool}/leases/{id}  renews a lease, 404 when it has expired
+//   DELETE {server}/pools/{pool}/leases/{id}  releases a lease
+//
+// Request documents carry the holder of the lease, the host and experiment key, and the
+// lifetime of the lease in seconds as ttl_secs.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	licenseServerOpt  = flag.String("license-server", "", "the URL of a license, or quota, server from which a token is leased before each experiment using a license pool is started")
+	licensePoolOpt    = flag.String("license-pool", "", "the license pool tokens are leased from for experiments on queues that do not name their own in the queue-config, empty requires no token")
+	licenseTTLOpt     = flag.Duration("license-ttl", 2*time.Minute, "the lifetime of license leases, leases are renewed while experiments run so that those held by a failed runner expire after this period")
+	licenseBackoffOpt = flag.Duration("license-backoff", time.Minute, "the period a queue is backed off after no license token was available for an experiment from it")
+
+	licenseClient = &http.Client{Timeout: 15 * time.Second}
+)
+
+// leaseDoc is the document exchanged with the license server
+//
+type leaseDoc struct {
+	ID     string  `json:"id,omitempty"`
+	Holder string  `json:"holder,omitempty"`
+	TTL    float64 `json:"ttl_secs"`
+}
+
+// licenseLease is a token leased for a running experiment
+//
+type licenseLease struct {
+	pool   string
+	holder string
+	url    string // The URL of the lease on the license server
+	ttl    time.Duration
+
+	cancel context.CancelFunc
+	doneC  chan struct{}
+}
+
+// validateLicense checks the license options
+//
+func validateLicense() (err errors.Error) {
+	if len(*licenseServerOpt) == 0 {
+		if len(*licensePoolOpt) != 0 {
+			return errors.New("license-pool requires a license-server").With("license-pool", *licensePoolOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		return nil
+	}
+	server, errGo := url.Parse(*licenseServerOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo, "license-server is invalid").With("license-server", *licenseServerOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if (server.Scheme != "http" && server.Scheme != "https") || len(server.Host) == 0 {
+		return errors.New("license-server must be an http or https URL").With("license-server", *licenseServerOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if *licenseTTLOpt < 3*time.Second {
+		return errors.New("license-ttl must be at least 3s").With("license-ttl", licenseTTLOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// licensePool returns the license pool experiments from the named queue lease tokens from,
+// empty when they need no token
+//
+func licensePool(queue string) (pool string) {
+	if len(*licenseServerOpt) == 0 {
+		return ""
+	}
+	return queueCfgs.licensePool(queue)
+}
+
+// leasesURL returns the URL of the leases of a pool on the license server
+//
+func leasesURL(pool string) (leases string) {
+	return strings.TrimSuffix(*licenseServerOpt, "/") + "/pools/" + url.PathEscape(pool) + "/leases"
+}
+
+// licenseRequest sends a lease document to the license server returning the status and the
+// lease document of the response, if there was one
+//
+func licenseRequest(ctx context.Context, method string, url string, doc *leaseDoc) (status int, resp *leaseDoc, err errors.Error) {
+	body := io.Reader(nil)
+	if doc != nil {
+		data, errGo := json.Marshal(doc)
+		if errGo != nil {
+			return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		body = bytes.NewReader(data)
+	}
+	req, errGo := http.NewRequest(method, url, body)
+	if errGo != nil {
+		return 0, nil, errors.Wrap(errGo).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	r, errGo := licenseClient.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return 0, nil, errors.Wrap(errGo).With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, io.LimitReader(r.Body, 64*1024))
+		r.Body.Close()
+	}()
+
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusCreated {
+		return r.StatusCode, nil, nil
+	}
+	resp = &leaseDoc{}
+	if errGo = json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(resp); errGo != nil && errGo != io.EOF {
+		return r.StatusCode, nil, errors.Wrap(errGo, "invalid license server response").With("url", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	return r.StatusCode, resp, nil
+}
+
+// lease makes a single attempt to lease a token, available is false when the pool has no free
+// tokens
+//
+func (lease *licenseLease) lease(ctx context.Context) (available bool, err errors.Error) {
+	leases := leasesURL(lease.pool)
+	status, resp, err := licenseRequest(ctx, http.MethodPost, leases, &leaseDoc{Holder: lease.holder, TTL: lease.ttl.Seconds()})
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusConflict, http.StatusTooManyRequests:
+		return false, nil
+	default:
+		return false, errors.New("license server refused the lease").With("url", leases, "status", status).With("stack", stack.Trace().TrimRuntime())
+	}
+	if resp == nil || len(resp.ID) == 0 {
+		return false, errors.New("license server did not identify the lease").With("url", leases).With("stack", stack.Trace().TrimRuntime())
+	}
+	lease.url = leases + "/" + url.PathEscape(resp.ID)
+	return true, nil
+}
+
+// acquireLicense leases a token from the pool for the holder and keeps the lease renewed
+// until it is released.  When the pool is empty no token is needed and a nil lease is
+// returned.
+//
+func acquireLicense(ctx context.Context, pool string, holder string) (lease *licenseLease, available bool, err errors.Error) {
+	if len(pool) == 0 {
+		return nil, true, nil
+	}
+
+	lease = &licenseLease{
+		pool:   pool,
+		holder: holder,
+		ttl:    *licenseTTLOpt,
+		doneC:  make(chan struct{}),
+	}
+	if available, err = lease.lease(ctx); !available || err != nil {
+		return nil, available, err
+	}
+
+	// The lease is renewed independently of the experiment so that it is only stopped by the
+	// release
+	renewCtx, cancel := context.WithCancel(context.Background())
+	lease.cancel = cancel
+	go lease.renew(renewCtx)
+
+	return lease, true, nil
+}
+
+// renew keeps the lease alive renewing it three times within each lifetime so that a single
+// failed renewal does not lose it.  Should the lease expire anyway, for example when the
+// license server could not be reached for a time, a new lease is taken when one is free.
+//
+func (lease *licenseLease) renew(ctx context.Context) {
+	defer close(lease.doneC)
+
+	tick := time.NewTicker(lease.ttl / 3)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if len(lease.url) == 0 {
+			available, err := lease.lease(ctx)
+			if err != nil {
+				logger.Warn("license could not be leased again", "pool", lease.pool, "holder", lease.holder, "error", err.Error())
+			} else if available {
+				logger.Info("license leased again", "pool", lease.pool, "holder", lease.holder)
+			}
+			continue
+		}
+
+		status, _, err := licenseRequest(ctx, http.MethodPut, lease.url, &leaseDoc{TTL: lease.ttl.Seconds()})
+		switch {
+		case err != nil:
+			logger.Warn("license lease not renewed", "pool", lease.pool, "holder", lease.holder, "error", err.Error())
+		case status == http.StatusNotFound:
+			logger.Warn("license lease expired while the experiment was running", "pool", lease.pool, "holder", lease.holder)
+			lease.url = ""
+		case status != http.StatusOK && status != http.StatusCreated && status != http.StatusNoContent:
+			logger.Warn("license lease not renewed", "pool", lease.pool, "holder", lease.holder, "status", status)
+		}
+	}
+}
+
+// release stops renewing the lease and returns the token to the pool, a token that could not
+// be returned is reclaimed by the license server once its lease expires
+//
+func (lease *licenseLease) release() {
+	if lease == nil {
+		return
+	}
+	lease.cancel()
+	<-lease.doneC
+
+	if len(lease.url) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), licenseClient.Timeout)
+	defer cancel()
+
+	status, _, err := licenseRequest(ctx, http.MethodDelete, lease.url, nil)
+	if err != nil {
+		logger.Warn("license not released, it will expire", "pool", lease.pool, "holder", lease.holder, "ttl", lease.ttl.String(), "error", err.Error())
+		return
+	}
+	if status >= 300 && status != http.StatusNotFound {
+		logger.Warn("license not released, it will expire", "pool", lease.pool, "holder", lease.holder, "ttl", lease.ttl.String(), "status", status)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLicenseServer hands out a fixed number of tokens from any pool, leases expire once their
+// lifetime passes without a renewal
+//
+type fakeLicenseServer struct {
+	tokens   int
+	leases   map[string]time.Time
+	renewals int
+	next     int
+	sync.Mutex
+}
+
+func (fls *fakeLicenseServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fls.Lock()
+	defer fls.Unlock()
+
+	for id, expires := range fls.leases {
+		if time.Now().After(expires) {
+			delete(fls.leases, id)
+		}
+	}
+
+	doc := leaseDoc{}
+	json.NewDecoder(r.Body).Decode(&doc)
+	ttl := time.Duration(doc.TTL * float64(time.Second))
+
+	// Paths are /pools/{pool}/leases for new leases and /pools/{pool}/leases/{id} otherwise
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "pools" || parts[2] != "leases" || (r.Method == http.MethodPost) != (len(parts) == 3) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if len(fls.leases) >= fls.tokens {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		fls.next++
+		id := fmt.Sprint(fls.next)
+		fls.leases[id] = time.Now().Add(ttl)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&leaseDoc{ID: id, TTL: doc.TTL})
+	case http.MethodPut:
+		if _, isPresent := fls.leases[parts[3]]; !isPresent {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fls.renewals++
+		fls.leases[parts[3]] = time.Now().Add(ttl)
+	case http.MethodDelete:
+		delete(fls.leases, parts[3])
+	}
+}
+
+func (fls *fakeLicenseServer) counts() (leases int, renewals int) {
+	fls.Lock()
+	defer fls.Unlock()
+	return len(fls.leases), fls.renewals
+}
+
+// TestLicense checks that tokens are leased, renewed while held, refused once the pool is
+// exhausted, and returned when released
+//
+func TestLicense(t *testing.T) {
+	fls := &fakeLicenseServer{tokens: 1, leases: map[string]time.Time{}}
+	server := httptest.NewServer(fls)
+	defer server.Close()
+
+	savedServer, savedTTL := *licenseServerOpt, *licenseTTLOpt
+	defer func() {
+		*licenseServerOpt, *licenseTTLOpt = savedServer, savedTTL
+	}()
+	*licenseServerOpt = server.URL
+	*licenseTTLOpt = 300 * time.Millisecond
+
+	// No pool means no token is needed
+	if lease, available, err := acquireLicense(context.Background(), "", "host/none"); lease != nil || !available || err != nil {
+		t.Fatalf("token leased without a pool %v %v", available, err)
+	}
+
+	lease, available, err := acquireLicense(context.Background(), "matlab", "host/first")
+	if err != nil || !available {
+		t.Fatalf("token not leased %v %v", available, err)
+	}
+
+	// Held longer than its lifetime the lease survives by being renewed
+	time.Sleep(time.Second)
+	if leases, renewals := fls.counts(); leases != 1 || renewals < 2 {
+		t.Fatalf("lease not renewed, %d leases and %d renewals", leases, renewals)
+	}
+
+	if second, available, err := acquireLicense(context.Background(), "matlab", "host/second"); second != nil || available || err != nil {
+		t.Fatalf("token leased from an exhausted pool %v %v", available, err)
+	}
+
+	lease.release()
+	if leases, _ := fls.counts(); leases != 0 {
+		t.Fatal("token not returned on release")
+	}
+
+	second, available, err := acquireLicense(context.Background(), "matlab", "host/second")
+	if err != nil || !available {
+		t.Fatalf("released token not leased %v %v", available, err)
+	}
+	second.release()
+}
+
+// TestLicenseUnreachable checks that a license server that cannot be reached stops
+// experiments from being started
+//
+func TestLicenseUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	saved := *licenseServerOpt
+	defer func() { *licenseServerOpt = saved }()
+	*licenseServerOpt = server.URL
+
+	if lease, _, err := acquireLicense(context.Background(), "matlab", "host/expr"); lease != nil || err == nil {
+		t.Fatal("unreachable license server did not fail the lease")
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+// This file contains the implementation of the delivery of experiment lifecycle events,
+// experiments starting and stopping, to the logging service of a cloud provider, either
+// CloudWatch Logs on AWS or Cloud Logging, formerly Stackdriver, on GCP.  Events are
+// written as structured JSON into a log named after the studioml project, and on AWS into
+// a stream named after the experiment.  Delivery is done in the background, and when the
+// cloud service cannot be reached events are dropped leaving the local log as the record.
+//
+// Clients for the logging services are not vendored with the runner so the CloudWatch
+// Logs JSON protocol is driven using the core of the AWS SDK, and Cloud Logging using its
+// REST API.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/jsonrpc"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	"github.com/karlmutch/go-cache"
+)
+
+var (
+	lifecycleLogOpt       = flag.String("lifecycle-log", "", "the cloud logging service experiment start and stop events are sent to, either cloudwatch or stackdriver")
+	lifecycleLogPrefixOpt = flag.String("lifecycle-log-prefix", "studioml", "the prefix of the log groups, or log names, that lifecycle events are written to, the studioml project is appended")
+	lifecycleLogRegionOpt = flag.String("lifecycle-log-region", "", "the AWS region of the CloudWatch Logs service, defaults to the region of the AWS environment")
+	lifecycleLogGCPOpt    = flag.String("lifecycle-log-project", "", "the GCP project whose Cloud Logging service receives lifecycle events")
+
+	lifecycleLogs = &lifecyclePublisher{}
+
+	// logNameInvalid matches the characters that cannot appear in the name of a log
+	logNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_.\-]`)
+)
+
+const (
+	lifecycleStarted = "started"
+	lifecycleStopped = "stopped"
+)
+
+// lifecycleEvent is the structured form of an experiment starting or stopping
+//
+type lifecycleEvent struct {
+	Event   string       `json:"event"`
+	Key     string       `json:"experiment_key"`
+	Project string       `json:"project"`
+	Queue   string       `json:"queue"`
+	Host    string       `json:"host"`
+	Time    time.Time    `json:"time"`
+	Result  *resultEvent `json:"result,omitempty"`
+}
+
+// lifecycleSink is implemented by the cloud logging services that lifecycle events can be
+// written to
+//
+type lifecycleSink interface {
+	write(ctx context.Context, event *lifecycleEvent) (err errors.Error)
+}
+
+// lifecyclePublisher sends lifecycle events to a sink in the background
+//
+type lifecyclePublisher struct {
+	sink   lifecycleSink
+	events chan *lifecycleEvent
+}
+
+// logProject returns the form of a project name used when naming logs
+//
+func logProject(project string) (name string) {
+	if len(project) == 0 {
+		project = "unknown"
+	}
+	return logNameInvalid.ReplaceAllString(project, "_")
+}
+
+// initLifecycleLogs validates the lifecycle logging options and when a sink was configured
+// starts the background publisher
+//
+func initLifecycleLogs(ctx context.Context) (err errors.Error) {
+	sink := lifecycleSink(nil)
+
+	switch *lifecycleLogOpt {
+	case "":
+		return nil
+	case "cloudwatch":
+		if sink, err = newCloudWatchSink(); err != nil {
+			return err
+		}
+	case "stackdriver":
+		if sink, err = newStackdriverSink(ctx); err != nil {
+			return err
+		}
+	default:
+		return errors.New("lifecycle-log must be either cloudwatch or stackdriver").With("lifecycle-log", *lifecycleLogOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	lifecycleLogs.start(ctx, sink)
+	return nil
+}
+
+func (lp *lifecyclePublisher) start(ctx context.Context, sink lifecycleSink) {
+	lp.sink = sink
+	lp.events = make(chan *lifecycleEvent, 256)
+
+	go lp.run(ctx)
+}
+
+// started records an experiment being started
+//
+func (lp *lifecyclePublisher) started(qt *runner.QueueTask, rqst *runner.Request, startedAt time.Time) {
+	lp.publish(&lifecycleEvent{
+		Event:   lifecycleStarted,
+		Key:     rqst.Experiment.Key,
+		Project: rqst.Config.Database.ProjectId,
+		Queue:   qt.Subscription,
+		Host:    host,
+		Time:    startedAt,
+	})
+}
+
+// stopped records an experiment having stopped along with its outcome
+//
+func (lp *lifecyclePublisher) stopped(result *resultEvent) {
+	lp.publish(&lifecycleEvent{
+		Event:   lifecycleStopped,
+		Key:     result.Key,
+		Project: result.Project,
+		Queue:   result.Queue,
+		Host:    result.Host,
+		Time:    result.FinishedAt,
+		Result:  result,
+	})
+}
+
+// publish queues an event for sending, events are dropped rather than blocking the
+// experiment should the logging service be unable to keep up
+//
+func (lp *lifecyclePublisher) publish(event *lifecycleEvent) {
+	if lp.events == nil {
+		return
+	}
+	select {
+	case lp.events <- event:
+	default:
+		logger.Warn("lifecycle event dropped", "experiment_id", event.Key, "event", event.Event)
+	}
+}
+
+func (lp *lifecyclePublisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-lp.events:
+			sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			if err := lp.sink.write(sendCtx, event); err != nil {
+				logger.Warn("lifecycle event not logged", "experiment_id", event.Key, "event", event.Event, "sink", *lifecycleLogOpt, "error", err.Error())
+			}
+			cancel()
+		}
+	}
+}
+
+// cloudWatchSink writes lifecycle events to CloudWatch Logs, using a log group for each
+// project and a log stream for each experiment
+//
+type cloudWatchSink struct {
+	client  *client.Client
+	created *cache.Cache // The log groups and streams known to exist, expired so that finished experiments are forgotten
+}
+
+type cwCreateLogGroupInput struct {
+	_            struct{} `type:"structure"`
+	LogGroupName *string  `locationName:"logGroupName" type:"string"`
+}
+
+type cwCreateLogStreamInput struct {
+	_             struct{} `type:"structure"`
+	LogGroupName  *string  `locationName:"logGroupName" type:"string"`
+	LogStreamName *string  `locationName:"logStreamName" type:"string"`
+}
+
+type cwInputLogEvent struct {
+	_         struct{} `type:"structure"`
+	Message   *string  `locationName:"message" type:"string"`
+	Timestamp *int64   `locationName:"timestamp" type:"long"`
+}
+
+type cwPutLogEventsInput struct {
+	_             struct{}           `type:"structure"`
+	LogGroupName  *string            `locationName:"logGroupName" type:"string"`
+	LogStreamName *string            `locationName:"logStreamName" type:"string"`
+	LogEvents     []*cwInputLogEvent `locationName:"logEvents" type:"list"`
+}
+
+type cwOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+func newCloudWatchSink() (sink *cloudWatchSink, err errors.Error) {
+	cfg := aws.Config{}
+	if len(*lifecycleLogRegionOpt) != 0 {
+		cfg.Region = aws.String(*lifecycleLogRegionOpt)
+	}
+	sess, errGo := session.NewSessionWithOptions(session.Options{
+		Config:            cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "CloudWatch Logs session could not be created").With("stack", stack.Trace().TrimRuntime())
+	}
+	return newCloudWatchClient(sess), nil
+}
+
+func newCloudWatchClient(p client.ConfigProvider) (sink *cloudWatchSink) {
+	c := p.ClientConfig("logs")
+
+	cl := client.New(
+		*c.Config,
+		metadata.ClientInfo{
+			ServiceName:   "logs",
+			SigningName:   c.SigningName,
+			SigningRegion: c.SigningRegion,
+			Endpoint:      c.Endpoint,
+			APIVersion:    "2014-03-28",
+			JSONVersion:   "1.1",
+			TargetPrefix:  "Logs_20140328",
+		},
+		c.Handlers,
+	)
+	cl.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	cl.Handlers.Build.PushBackNamed(jsonrpc.BuildHandler)
+	cl.Handlers.Unmarshal.PushBackNamed(jsonrpc.UnmarshalHandler)
+	cl.Handlers.UnmarshalMeta.PushBackNamed(jsonrpc.UnmarshalMetaHandler)
+	cl.Handlers.UnmarshalError.PushBackNamed(jsonrpc.UnmarshalErrorHandler)
+
+	return &cloudWatchSink{
+		client:  cl,
+		created: cache.New(time.Hour, 10*time.Minute),
+	}
+}
+
+// call invokes a single CloudWatch Logs operation
+//
+func (cw *cloudWatchSink) call(ctx context.Context, operation string, input interface{}) (errGo error) {
+	req := cw.client.NewRequest(&request.Operation{Name: operation, HTTPMethod: "POST", HTTPPath: "/"}, input, &cwOutput{})
+	req.SetContext(ctx)
+	return req.Send()
+}
+
+// ensure creates a log group or stream, treating one that already exists as created.  Names
+// that have expired from the cache of those known to exist are created again which the
+// service will report as already existing
+//
+func (cw *cloudWatchSink) ensure(ctx context.Context, name string, operation string, input interface{}) (err errors.Error) {
+	if _, isPresent := cw.created.Get(name); isPresent {
+		return nil
+	}
+
+	if errGo := cw.call(ctx, operation, input); errGo != nil {
+		if awsErr, ok := errGo.(awserr.Error); !ok || awsErr.Code() != "ResourceAlreadyExistsException" {
+			return errors.Wrap(errGo).With("operation", operation, "name", name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	cw.created.Set(name, true, cache.DefaultExpiration)
+	return nil
+}
+
+func (cw *cloudWatchSink) write(ctx context.Context, event *lifecycleEvent) (err errors.Error) {
+	group := "/" + *lifecycleLogPrefixOpt + "/" + logProject(event.Project)
+	stream := logNameInvalid.ReplaceAllString(event.Key, "_")
+
+	if err = cw.ensure(ctx, group, "CreateLogGroup", &cwCreateLogGroupInput{LogGroupName: aws.String(group)}); err != nil {
+		return err
+	}
+	if err = cw.ensure(ctx, group+":"+stream, "CreateLogStream",
+		&cwCreateLogStreamInput{LogGroupName: aws.String(group), LogStreamName: aws.String(stream)}); err != nil {
+		return err
+	}
+
+	msg, errGo := json.Marshal(event)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	input := &cwPutLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		LogEvents: []*cwInputLogEvent{{
+			Message:   aws.String(string(msg)),
+			Timestamp: aws.Int64(event.Time.UnixNano() / int64(time.Millisecond)),
+		}},
+	}
+	if errGo = cw.call(ctx, "PutLogEvents", input); errGo != nil {
+		return errors.Wrap(errGo).With("group", group, "stream", stream).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// stackdriverSink writes lifecycle events to Cloud Logging using a log for each project
+//
+type stackdriverSink struct {
+	endpoint string
+	project  string
+	client   *http.Client
+}
+
+func newStackdriverSink(ctx context.Context) (sink *stackdriverSink, err errors.Error) {
+	if len(*lifecycleLogGCPOpt) == 0 {
+		return nil, errors.New("lifecycle-log-project must be set when lifecycle-log is stackdriver").With("stack", stack.Trace().TrimRuntime())
+	}
+	tokens, errGo := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/logging.write")
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "Cloud Logging credentials could not be found").With("stack", stack.Trace().TrimRuntime())
+	}
+	cl := oauth2.NewClient(ctx, tokens)
+	cl.Timeout = 30 * time.Second
+
+	return &stackdriverSink{
+		endpoint: "https://logging.googleapis.com/v2/entries:write",
+		project:  *lifecycleLogGCPOpt,
+		client:   cl,
+	}, nil
+}
+
+func (sd *stackdriverSink) write(ctx context.Context, event *lifecycleEvent) (err errors.Error) {
+	severity := "INFO"
+	if event.Result != nil && event.Result.Status != resultCompleted {
+		severity = "WARNING"
+	}
+
+	body, errGo := json.Marshal(map[string]interface{}{
+		"entries": []interface{}{
+			map[string]interface{}{
+				"logName":   "projects/" + sd.project + "/logs/" + url.PathEscape(*lifecycleLogPrefixOpt+"."+logProject(event.Project)),
+				"resource":  map[string]interface{}{"type": "global"},
+				"timestamp": event.Time.UTC().Format(time.RFC3339Nano),
+				"severity":  severity,
+				"labels": map[string]string{
+					"experiment_key": event.Key,
+					"host":           event.Host,
+					"event":          event.Event,
+				},
+				"jsonPayload": event,
+			},
+		},
+	})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	req, errGo := http.NewRequest(http.MethodPost, sd.endpoint, bytes.NewReader(body))
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, errGo := sd.client.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("cloud logging returned %s", resp.Status)).With("detail", string(detail)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
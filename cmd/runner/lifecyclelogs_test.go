@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// TestCloudWatchLifecycle checks that lifecycle events are written to CloudWatch Logs using a
+// log group for the project and a stream for the experiment, and that groups and streams
+// that already exist are used
+//
+func TestCloudWatchLifecycle(t *testing.T) {
+
+	calls := []string{}
+	messages := []string{}
+	callsLock := sync.Mutex{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Logs_20140328.")
+
+		callsLock.Lock()
+		calls = append(calls, operation)
+		callsLock.Unlock()
+
+		input := map[string]interface{}{}
+		if errGo := json.Unmarshal(body, &input); errGo != nil {
+			t.Error(errGo)
+		}
+		if input["logGroupName"] != "/studioml/project_1" {
+			t.Errorf("unexpected log group %v", input["logGroupName"])
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch operation {
+		case "CreateLogGroup":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"ResourceAlreadyExistsException","message":"exists"}`))
+			return
+		case "CreateLogStream":
+			if input["logStreamName"] != "exp-1" {
+				t.Errorf("unexpected log stream %v", input["logStreamName"])
+			}
+		case "PutLogEvents":
+			for _, event := range input["logEvents"].([]interface{}) {
+				callsLock.Lock()
+				messages = append(messages, event.(map[string]interface{})["message"].(string))
+				callsLock.Unlock()
+			}
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	sess, errGo := session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	sink := newCloudWatchClient(sess)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, event := range []string{lifecycleStarted, lifecycleStopped} {
+		if err := sink.write(ctx, &lifecycleEvent{Event: event, Key: "exp-1", Project: "project/1", Time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := "CreateLogGroup,CreateLogStream,PutLogEvents,PutLogEvents"
+	if strings.Join(calls, ",") != expected {
+		t.Fatalf("unexpected CloudWatch Logs calls %v", calls)
+	}
+	if len(messages) != 2 || !strings.Contains(messages[0], `"event":"started"`) || !strings.Contains(messages[1], `"event":"stopped"`) {
+		t.Fatalf("unexpected log messages %v", messages)
+	}
+}
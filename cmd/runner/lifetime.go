@@ -0,0 +1,81 @@
+package main
+
+// This file contains the implementation of the maximum lifetime of the runner.  Once the
+// lifetime has passed the runner stops taking new work, in the same way as a drain, waits
+// for the experiments that are running to complete, and then exits using a distinct exit
+// code so that an orchestrator can recreate it with rotated credentials or a newer image.
+
+import (
+	"context"
+	"flag"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	maxLifetimeOpt      = flag.Duration("max-lifetime", 0, "the period of time after which the runner stops taking new work and exits once running experiments complete, 0 runs indefinitely")
+	maxLifetimeDrainOpt = flag.Duration("max-lifetime-drain", 2*time.Hour, "the maximum period of time running experiments are given to complete once the max-lifetime has passed before the runner exits")
+
+	// lifetimeExpired is set once the runner is stopping because it reached its maximum lifetime
+	lifetimeExpired = int32(0)
+)
+
+const (
+	// lifetimeExitCode is the exit code used when the runner stops because its lifetime has passed,
+	// it is the sysexits EX_TEMPFAIL code indicating the runner can be started again
+	lifetimeExitCode = 75
+)
+
+// validateLifetime checks the maximum lifetime options
+//
+func validateLifetime() (err errors.Error) {
+	if *maxLifetimeOpt < 0 {
+		return errors.New("the max-lifetime option cannot be negative").With("max-lifetime", maxLifetimeOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if *maxLifetimeDrainOpt < 0 {
+		return errors.New("the max-lifetime-drain option cannot be negative").With("max-lifetime-drain", maxLifetimeDrainOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// lifetimeReached returns true when the runner stopped because its lifetime had passed
+//
+func lifetimeReached() (reached bool) {
+	return atomic.LoadInt32(&lifetimeExpired) != 0
+}
+
+// retireAfter waits for the lifetime of the runner to pass, drains it, and once the experiments
+// that were running have completed, or the drain period has passed, stops the runner using
+// the quit function
+//
+func retireAfter(ctx context.Context, lifetime time.Duration, drain time.Duration, quit context.CancelFunc) {
+	if lifetime <= 0 {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(lifetime):
+	}
+
+	logger.Info("runner lifetime reached, draining", "host", host, "max-lifetime", lifetime.String(), "max-lifetime-drain", drain.String())
+	lifecycle.retire()
+	recheckLifecycle()
+
+	waiting := 0
+	for _, exp := range running.interrupted(drain) {
+		if exp.Message == msgPending {
+			waiting++
+		}
+	}
+	if waiting != 0 {
+		logger.Warn("runner lifetime drain period passed with experiments running", "host", host, "count", waiting)
+	}
+
+	atomic.StoreInt32(&lifetimeExpired, 1)
+	quit()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+)
+
+// TestLifetime checks that once the lifetime of the runner passes it is drained, running
+// experiments are allowed to complete, and only then is the runner stopped
+//
+func TestLifetime(t *testing.T) {
+
+	defer func() {
+		lifecycle.Lock()
+		lifecycle.retiring = false
+		lifecycle.resolve()
+		lifecycle.Unlock()
+		atomic.StoreInt32(&lifetimeExpired, 0)
+	}()
+
+	done := running.add("lifetime-experiment", "project", "queue", time.Now())
+
+	quitCtx, quit := context.WithCancel(context.Background())
+	defer quit()
+
+	go retireAfter(quitCtx, 100*time.Millisecond, time.Minute, quit)
+
+	// Wait for the drain to begin while the experiment is still running
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if state, _ := lifecycle.get(); state == types.K8sDrainAndSuspend {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("runner was not drained once its lifetime passed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An operator resuming the runner does not undo the end of its lifetime
+	if state, _ := lifecycle.drain(false); state != types.K8sDrainAndSuspend {
+		t.Fatalf("runner resumed after its lifetime passed %v", state)
+	}
+
+	select {
+	case <-quitCtx.Done():
+		t.Fatal("runner stopped while an experiment was running")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if lifetimeReached() {
+		t.Fatal("lifetime reported as reached while an experiment was running")
+	}
+
+	done(true)
+
+	select {
+	case <-quitCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("runner did not stop once experiments completed")
+	}
+	if !lifetimeReached() {
+		t.Fatal("lifetime not reported as reached")
+	}
+}
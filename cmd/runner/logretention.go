@@ -0,0 +1,234 @@
+package main
+
+// This file contains the implementation of the retention policy for the logs of experiments
+// whose directories remain on the node after the experiment has finished.  Directories are
+// retained for debugging when the debug option is set, and can also be left behind by
+// experiments that failed before they could be cleaned up.  A background sweeper removes
+// retained experiments once their output/output log falls outside of the policy, either by
+// age, by the total size of the retained logs, or by the number of logs retained, freeing the
+// whole of the experiment directory so that the directory is never kept without its log.
+// Directories that were not meant to be retained are freed in their entirety by the sweeper.
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	logRetentionAgeOpt      = flag.Duration("log-retention-age", 0, "the maximum age of the logs of experiments retained on the node before they, and the experiment directory, are removed, 0 retains logs regardless of their age")
+	logRetentionSizeOpt     = flag.String("log-retention-size", "", "the maximum total size of the logs of experiments retained on the node, the oldest are removed first, by default there is no limit")
+	logRetentionCountOpt    = flag.Int("log-retention-count", 0, "the maximum number of experiment logs retained on the node, the oldest are removed first, 0 retains any number of logs")
+	logRetentionIntervalOpt = flag.Duration("log-retention-interval", 10*time.Minute, "the interval between sweeps of retained experiment logs")
+
+	// activeExprs holds the directories of experiments that are being processed which are
+	// never swept
+	activeExprs = &exprDirs{dirs: map[string]int{}}
+)
+
+// exprDirs is a set of experiment directories, a directory added more than once, for example
+// by two experiments that collided while creating it, remains in the set until it has been
+// removed as many times
+//
+type exprDirs struct {
+	dirs map[string]int
+	sync.Mutex
+}
+
+func (ed *exprDirs) add(dir string) {
+	if len(dir) == 0 {
+		return
+	}
+	ed.Lock()
+	defer ed.Unlock()
+	ed.dirs[dir]++
+}
+
+func (ed *exprDirs) remove(dir string) {
+	ed.Lock()
+	defer ed.Unlock()
+	if ed.dirs[dir] > 1 {
+		ed.dirs[dir]--
+		return
+	}
+	delete(ed.dirs, dir)
+}
+
+func (ed *exprDirs) contains(dir string) (isPresent bool) {
+	ed.Lock()
+	defer ed.Unlock()
+	_, isPresent = ed.dirs[dir]
+	return isPresent
+}
+
+// logRetention is the policy applied to the logs of retained experiments
+//
+type logRetention struct {
+	age   time.Duration
+	size  uint64
+	count int
+}
+
+// enabled tests if any limit has been placed on retained logs
+//
+func (policy *logRetention) enabled() (isEnabled bool) {
+	return policy.age != 0 || policy.size != 0 || policy.count != 0
+}
+
+// logRetentionPolicy returns the retention policy specified by the log-retention options
+//
+func logRetentionPolicy() (policy *logRetention, err errors.Error) {
+	policy = &logRetention{
+		age:   *logRetentionAgeOpt,
+		count: *logRetentionCountOpt,
+	}
+	if policy.age < 0 {
+		return nil, errors.New("log-retention-age must not be negative").With("age", policy.age.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if policy.count < 0 {
+		return nil, errors.New("log-retention-count must not be negative").With("count", policy.count).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(*logRetentionSizeOpt) != 0 {
+		size, errGo := humanize.ParseBytes(*logRetentionSizeOpt)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, "log-retention-size is invalid").With("size", *logRetentionSizeOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		policy.size = size
+	}
+	if policy.enabled() && *logRetentionIntervalOpt <= 0 {
+		return nil, errors.New("log-retention-interval must be positive").With("interval", logRetentionIntervalOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return policy, nil
+}
+
+// retainedLog describes an experiment directory left on the node and its log
+//
+type retainedLog struct {
+	dir      string
+	modified time.Time
+	size     uint64
+}
+
+// retainedLogs returns the experiment directories within the root directory of the runner
+// that are not being processed, ordered from the most recently written log to the oldest
+//
+func retainedLogs(root string) (logs []retainedLog, err errors.Error) {
+	exprRoot := filepath.Join(root, "experiments")
+	entries, errGo := ioutil.ReadDir(exprRoot)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(errGo).With("dir", exprRoot).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	logs = make([]retainedLog, 0, len(entries))
+	for _, entry := range entries {
+		dir := filepath.Join(exprRoot, entry.Name())
+		if !entry.IsDir() || activeExprs.contains(dir) {
+			continue
+		}
+		// Directories without a log are ordered using their own modification time
+		log := retainedLog{dir: dir, modified: entry.ModTime()}
+		if info, errGo := os.Stat(filepath.Join(dir, "output", "output")); errGo == nil {
+			log.modified = info.ModTime()
+			log.size = uint64(info.Size())
+		}
+		logs = append(logs, log)
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].modified.After(logs[j].modified)
+	})
+	return logs, nil
+}
+
+// expired selects the retained logs that fall outside of the policy, when experiment
+// directories are not being retained for debugging every directory found was meant to be
+// removed and all are selected
+//
+func (policy *logRetention) expired(logs []retainedLog, retained bool, now time.Time) (expired []retainedLog) {
+	total := uint64(0)
+	for i, log := range logs {
+		total += log.size
+		switch {
+		case !retained:
+		case policy.age != 0 && now.Sub(log.modified) > policy.age:
+		case policy.count != 0 && i >= policy.count:
+		case policy.size != 0 && total > policy.size:
+		default:
+			continue
+		}
+		expired = append(expired, log)
+	}
+	return expired
+}
+
+// sweepLogs removes the experiment directories whose logs have expired from the root
+// directory of the runner returning the number of directories removed and the space freed
+//
+func sweepLogs(root string, policy *logRetention, retained bool) (removed int, freed uint64, err errors.Error) {
+	logs, err := retainedLogs(root)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, log := range policy.expired(logs, retained, time.Now()) {
+		size, err := runner.ReclaimDir(log.dir)
+		if err != nil {
+			logger.Warn("expired experiment log not removed", "dir", log.dir, "error", err.Error())
+			continue
+		}
+		removed++
+		freed += size
+	}
+	return removed, freed, nil
+}
+
+// sweepLogsEvery periodically applies the log retention policy to the experiment directories
+// retained by the runner, the function returns immediately when no policy was set
+//
+func sweepLogsEvery(ctx context.Context, policy *logRetention, interval time.Duration) {
+	if policy == nil || !policy.enabled() {
+		return
+	}
+
+	sweep := time.NewTicker(interval)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-sweep.C:
+			tempRoot.Lock()
+			root := tempRoot.dir
+			tempRoot.Unlock()
+
+			if len(root) == 0 {
+				continue
+			}
+
+			removed, freed, err := sweepLogs(root, policy, *debugOpt)
+			if err != nil {
+				logger.Warn("experiment logs not swept", "dir", root, "error", err.Error())
+				continue
+			}
+			if removed != 0 {
+				logger.Info("expired experiment logs removed", "experiments", removed, "freed", humanize.Bytes(freed), "disk_free", humanize.Bytes(runner.GetDiskFree()))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
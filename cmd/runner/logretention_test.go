@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/rs/xid"
+)
+
+// TestLogRetention checks that retained experiments are removed oldest first once their logs
+// fall outside of the policy, that experiments being processed are left alone, and that
+// directories not meant to be retained are freed entirely
+//
+func TestLogRetention(t *testing.T) {
+
+	root, errGo := ioutil.TempDir("", "log-retention")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(root)
+
+	// Experiments with logs one hour apart, experiment 0 has the most recent log
+	now := time.Now()
+	dirs := []string{}
+	for i := 0; i < 4; i++ {
+		dir := filepath.Join(root, "experiments", "expr."+string('0'+rune(i)))
+		if errGo = os.MkdirAll(filepath.Join(dir, "output"), 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		log := filepath.Join(dir, "output", "output")
+		if errGo = ioutil.WriteFile(log, []byte(strings.Repeat("x", 1024)), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+		modified := now.Add(-time.Duration(i) * time.Hour)
+		if errGo = os.Chtimes(log, modified, modified); errGo != nil {
+			t.Fatal(errGo)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	exists := func(dir string) bool {
+		_, errGo := os.Stat(dir)
+		return errGo == nil
+	}
+
+	// The oldest log is being written by an experiment that is still running
+	activeExprs.add(dirs[3])
+	defer activeExprs.remove(dirs[3])
+
+	removed, freed, err := sweepLogs(root, &logRetention{age: 90 * time.Minute}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || freed < 1024 || exists(dirs[2]) || !exists(dirs[1]) || !exists(dirs[3]) {
+		t.Fatalf("age policy removed %d experiments freeing %d bytes", removed, freed)
+	}
+
+	if removed, _, err = sweepLogs(root, &logRetention{count: 1}, true); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || exists(dirs[1]) || !exists(dirs[0]) {
+		t.Fatalf("count policy removed %d experiments", removed)
+	}
+
+	// Once debugging retention is off every directory left behind is freed regardless of its age
+	activeExprs.remove(dirs[3])
+	if removed, _, err = sweepLogs(root, &logRetention{age: 24 * time.Hour}, false); err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 || exists(dirs[0]) || exists(dirs[3]) {
+		t.Fatalf("unretained experiments not freed, %d removed", removed)
+	}
+}
+
+// TestLogRetentionSize checks that the size policy keeps the most recent logs within the limit
+//
+func TestLogRetentionSize(t *testing.T) {
+	now := time.Now()
+	logs := []retainedLog{
+		{dir: "a", modified: now, size: 600},
+		{dir: "b", modified: now.Add(-time.Minute), size: 600},
+		{dir: "c", modified: now.Add(-time.Hour), size: 100},
+	}
+	expired := (&logRetention{size: 1000}).expired(logs, true, now)
+	if len(expired) != 2 || expired[0].dir != "b" || expired[1].dir != "c" {
+		t.Fatalf("size policy expired %+v", expired)
+	}
+
+	saved := *logRetentionSizeOpt
+	defer func() { *logRetentionSizeOpt = saved }()
+
+	*logRetentionSizeOpt = "2gb"
+	policy, err := logRetentionPolicy()
+	if err != nil || policy.size != 2000000000 || !policy.enabled() {
+		t.Fatalf("log-retention-size parsed as %+v %v", policy, err)
+	}
+	*logRetentionSizeOpt = "lots"
+	if _, err = logRetentionPolicy(); err == nil {
+		t.Fatal("invalid log-retention-size accepted")
+	}
+}
+
+// TestLogRetentionNewExperiment checks that the directory of a new experiment is protected from
+// sweeps from the moment it is created, and that a directory shared by two experiments remains
+// protected until both have finished with it
+//
+func TestLogRetentionNewExperiment(t *testing.T) {
+
+	root, errGo := ioutil.TempDir("", "log-retention")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(root)
+
+	p := &processor{RootDir: root, Request: &runner.Request{}}
+	p.Request.Experiment.Key = xid.New().String()
+
+	if _, err := p.mkUniqDir(); err != nil {
+		t.Fatal(err)
+	}
+	if !activeExprs.contains(p.ExprDir) {
+		t.Fatalf("new experiment directory %s was not protected", p.ExprDir)
+	}
+
+	if removed, _, err := sweepLogs(root, &logRetention{age: time.Nanosecond}, false); err != nil || removed != 0 {
+		t.Fatalf("new experiment directory swept, %d removed, error %v", removed, err)
+	}
+
+	activeExprs.add(p.ExprDir)
+	activeExprs.remove(p.ExprDir)
+	if !activeExprs.contains(p.ExprDir) {
+		t.Fatalf("experiment directory %s was unprotected while still in use", p.ExprDir)
+	}
+	activeExprs.remove(p.ExprDir)
+	if activeExprs.contains(p.ExprDir) {
+		t.Fatalf("experiment directory %s remained protected", p.ExprDir)
+	}
+}
@@ -110,6 +110,16 @@ func retrieveCallInfo() (info *callInfo) {
 func usage() {
 	fmt.Fprintln(os.Stderr, path.Base(os.Args[0]))
 	fmt.Fprintln(os.Stderr, "usage: ", os.Args[0], "[arguments]      studioml runner      ", gitHash, "    ", buildTime)
+	fmt.Fprintln(os.Stderr, "        ", os.Args[0], "[arguments] artifact check [s3://endpoint/bucket | gs://bucket] ...")
+	fmt.Fprintln(os.Stderr, "        ", os.Args[0], "[arguments] benchmark [s3://endpoint/bucket | gs://bucket]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "The artifact check command uploads and downloads a test artifact to each of the storage")
+	fmt.Fprintln(os.Stderr, "locations listed, reporting the time taken and any failures.  HTTP and Azure storage are")
+	fmt.Fprintln(os.Stderr, "not supported by the runner and cannot be checked.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "The benchmark command runs a canned experiment on this node, fetching its workspace from the")
+	fmt.Fprintln(os.Stderr, "local file system or the storage location listed, and reports the time taken by each phase")
+	fmt.Fprintln(os.Stderr, "along with the utilization of any GPU used.")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Arguments:")
 	fmt.Fprintln(os.Stderr, "")
@@ -145,6 +155,27 @@ func resourceLimits() (cores uint, mem uint64, storage uint64, err error) {
 //
 func main() {
 
+	// Diagnostic commands do not take the exclusive lock so that they can be run on a
+	// node alongside a runner that is processing work
+	flag.Usage = usage
+
+	// Use the go options parser to load command line options that have been set, and look
+	// for these options inside the env variable table
+	//
+	envflag.Parse()
+	if isArtifactCheck(flag.Args()) {
+		if !runArtifactCheck(context.Background(), flag.Args()[2:]) {
+			os.Exit(-1)
+		}
+		return
+	}
+	if isBenchmark(flag.Args()) {
+		if !runBenchmark(context.Background(), flag.Args()[1:]) {
+			os.Exit(-1)
+		}
+		return
+	}
+
 	quitC := make(chan struct{})
 	defer close(quitC)
 
@@ -173,13 +204,9 @@ func Main() {
 
 	fmt.Printf("%s built at %s, against commit id %s\n", os.Args[0], buildTime, gitHash)
 
-	flag.Usage = usage
-
-	// Use the go options parser to load command line options that have been set, and look
-	// for these options inside the env variable table
+	// The command line options, and those set using the env variable table, were loaded by
+	// main before the diagnostic commands were checked for
 	//
-	envflag.Parse()
-
 	doneC := make(chan struct{})
 	quitCtx, cancel := context.WithCancel(context.Background())
 
@@ -197,8 +224,21 @@ func Main() {
 	case <-quitCtx.Done():
 	}
 
+	// Give the experiments that were interrupted a chance to return their messages to the
+	// queues and then report on them
+	reportShutdown(*shutdownWaitOpt)
+
+	// Remove the runner from any fleet registry it was reporting to
+	heartbeats.deregister()
+
 	// Allow the quitC to be sent across the server for a short period of time before exiting
 	time.Sleep(time.Second)
+
+	// A runner that reached the end of its lifetime exits with a code the orchestrator can
+	// recognize
+	if lifetimeReached() {
+		os.Exit(lifetimeExitCode)
+	}
 }
 
 // EntryPoint enables both test and standard production infrastructure to
@@ -268,6 +308,18 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		}
 	}
 
+	// Gather the node details now so that experiments starting later are not delayed by
+	// waiting on cloud metadata services
+	node := runner.GetNodeMeta()
+	logger.Info("node", "zone", node.Zone, "instance_type", node.InstanceType, "instance_id", node.InstanceID)
+
+	versions := runner.GetCUDAVersions()
+	logger.Info("cuda", "driver", versions.Driver, "cuda", versions.CUDA, "cudnn", versions.CuDNN)
+
+	if err := runner.InitTracing(quitCtx, "studio-go-runner"); err != nil {
+		errs = append(errs, err)
+	}
+
 	if err := initiateK8s(quitCtx, *cfgNamespace, *cfgConfigMap, errorC); err != nil {
 		errs = append(errs, err)
 	}
@@ -298,6 +350,10 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 	if len(*tempOpt) == 0 {
 		msg := "the working-dir command line option must be supplied with a valid working directory location, or the TEMP, or TMP env vars need to be set"
 		errs = append(errs, errors.New(msg))
+	} else if bundle, err := runner.LoadCABundle(*tempOpt); err != nil {
+		errs = append(errs, err)
+	} else if len(bundle) != 0 {
+		logger.Info("additional certificate authorities trusted", "bundle", bundle)
 	}
 
 	if _, _, err := getCacheOptions(); err != nil {
@@ -333,21 +389,26 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		errs = append(errs, errors.Wrap(err))
 	}
 
+	// The runner-config file can supply the queue credentials so it is read before they are checked
+	if err := loadRunnerConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
 	// Make at least one of the credentials directories is valid, as long as this is not a test
 	if TestMode {
 		logger.Warn("running in test mode, queue validation not performed")
 	} else {
-		if len(*googleCertsDirOpt) == 0 && len(*sqsCertsDirOpt) == 0 && len(*amqpURL) == 0 {
-			errs = append(errs, errors.New("One of the amqp-url, sqs-certs, or google-certs options must be set for the runner to work"))
+		if len(googleCertsSetting()) == 0 && len(sqsCertsSetting()) == 0 && len(amqpURLSetting()) == 0 && len(*queueDirOpt) == 0 && len(redisURLSetting()) == 0 {
+			errs = append(errs, errors.New("One of the amqp-url, redis-url, sqs-certs, google-certs, or queue-dir options must be set for the runner to work"))
 		} else {
-			stat, err := os.Stat(*googleCertsDirOpt)
+			stat, err := os.Stat(googleCertsSetting())
 			if err != nil || !stat.Mode().IsDir() {
-				stat, err = os.Stat(*sqsCertsDirOpt)
+				stat, err = os.Stat(sqsCertsSetting())
 				if err != nil || !stat.Mode().IsDir() {
-					if len(*amqpURL) == 0 {
+					if len(amqpURLSetting()) == 0 && len(*queueDirOpt) == 0 && len(redisURLSetting()) == 0 {
 						msg := fmt.Sprintf(
 							"One of the sqs-certs, or google-certs options must be set to an existing directory, or amqp-url is specified, for the runner to perform any useful work (%s,%s)",
-							*googleCertsDirOpt, *sqsCertsDirOpt)
+							googleCertsSetting(), sqsCertsSetting())
 						errs = append(errs, errors.New(msg))
 					}
 				}
@@ -355,12 +416,145 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		}
 	}
 
-	if len(*amqpURL) != 0 {
+	if len(amqpURLSetting()) != 0 || len(redisURLSetting()) != 0 {
 		if _, errGo := regexp.Compile(*queueMatch); errGo != nil {
 			errs = append(errs, errors.Wrap(errGo))
 		}
 	}
 
+	if err := initReservation(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := initFairShare(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := initKafkaResults(quitCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := initLifecycleLogs(quitCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := initHeartbeat(quitCtx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := loadQueueConfig(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateQuarantine(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateLifetime(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateSpotNotice(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if *busyLeaseOpt < 3*time.Second {
+		errs = append(errs, errors.New("the busy-lease option must be at least 3 seconds").With("busy-lease", busyLeaseOpt.String()).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	if err := validateBackendHealth(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateFanout(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateIdleAdvisory(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateNoOutputs(*noOutputsOpt); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := runner.ValidateOutputLimit(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := runner.ValidateOutputSinks(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := runner.ValidateArtifactAllow(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := runner.ValidateEnvAllow(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := runner.ValidateScriptShell(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := runner.ValidateNodeLabels(); err != nil {
+		errs = append(errs, err)
+	} else if labels := runner.NodeLabels(); len(labels) != 0 {
+		logger.Info("node labels", "labels", runner.SelectorString(labels))
+	}
+
+	if runAs, err := runner.ValidateRunAs(); err != nil {
+		errs = append(errs, err)
+	} else if len(runAs) != 0 {
+		logger.Info("experiments will be run as", "user", runAs)
+	}
+
+	if policy, err := runner.ValidateEgress(); err != nil {
+		errs = append(errs, err)
+	} else if len(policy) != 0 {
+		logger.Info("experiment network egress restricted", "policy", policy)
+	}
+
+	if rate, err := runner.ValidateUploadBandwidth(); err != nil {
+		errs = append(errs, err)
+	} else if rate != 0 {
+		logger.Info("artifact uploads limited", "upload-bandwidth", humanize.IBytes(rate)+"/s")
+	}
+
+	if max, err := runner.ValidateCoreDumps(); err != nil {
+		errs = append(errs, err)
+	} else if max != 0 {
+		logger.Info("experiment core dumps captured", "core-dump-max", humanize.IBytes(max))
+	}
+
+	if tags, err := runner.ValidateUploadTags(); err != nil {
+		errs = append(errs, err)
+	} else if len(tags) != 0 {
+		logger.Info("artifact uploads tagged", "upload-tags", strings.Join(tags, ", "))
+	}
+
+	if err := validateLicense(); err != nil {
+		errs = append(errs, err)
+	} else if len(*licenseServerOpt) != 0 {
+		logger.Info("experiments lease license tokens", "license-server", *licenseServerOpt, "license-pool", *licensePoolOpt)
+	}
+
+	clockSource, errClock := validateClockSource()
+	if errClock != nil {
+		errs = append(errs, errClock)
+	}
+
+	logPolicy, errLogs := logRetentionPolicy()
+	if errLogs != nil {
+		errs = append(errs, errLogs)
+	}
+
+	canaryRqst, errCanary := loadCanary()
+	if errCanary != nil {
+		errs = append(errs, errCanary)
+	}
+
 	// Now check for any fatal errors before allowing the system to continue.  This allows
 	// all errors that could have ocuured as a result of incorrect options to be flushed
 	// out rather than having a frustrating single failure at a time loop for users
@@ -381,6 +575,25 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 	}
 	go monitoringExporter(quitCtx, promUpdate)
 
+	// Free subscriptions left busy by workers that failed to release them
+	go reapBusy(quitCtx, *busyLeaseOpt)
+
+	// Stop the runner once it has been running for its maximum lifetime, if one was set
+	go retireAfter(quitCtx, *maxLifetimeOpt, *maxLifetimeDrainOpt, cancel)
+
+	// Check the clock of the node before any work is retrieved, and then periodically, stopping
+	// work while it is skewed
+	if clockSource != nil {
+		checkClock(quitCtx, clockSource, *clockSkewMaxOpt)
+	}
+	go watchClock(quitCtx, clockSource, *clockSkewMaxOpt, *clockCheckOpt)
+
+	// Remove the experiment directories left on the node once their logs are outside of the retention policy
+	go sweepLogsEvery(quitCtx, logPolicy, *logRetentionIntervalOpt)
+
+	// Spot, or preemptible, instances drain themselves when the cloud gives notice they will be terminated
+	go watchSpotNotice(quitCtx, selectedSpotSources(), *spotPollOpt, *spotMarginOpt)
+
 	// start the prometheus http server for metrics
 	go func() {
 		if err := runPrometheus(quitCtx); err != nil {
@@ -388,6 +601,11 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		}
 	}()
 
+	// start the gRPC management interface, if one was requested
+	if err := runControl(quitCtx); err != nil {
+		logger.Warn(fmt.Sprint(err, stack.Trace().TrimRuntime()))
+	}
+
 	// The timing for queues being refreshed should me much more frequent when testing
 	// is being done to allow short lived resources such as queues etc to be refreshed
 	// between and within test cases reducing test times etc, but not so quick as to
@@ -397,22 +615,37 @@ func EntryPoint(quitCtx context.Context, cancel context.CancelFunc, doneC chan s
 		serviceIntervals = time.Duration(5 * time.Second)
 	}
 
-	// Create a component that listens to a credentials directory
-	// and starts and stops run methods as needed based on the credentials
-	// it has for the Google cloud infrastructure
-	//
-	go servicePubsub(quitCtx, serviceIntervals)
-
-	// Create a component that listens to AWS credentials directories
-	// and starts and stops run methods as needed based on the credentials
-	// it has for the AWS infrastructure
-	//
-	go serviceSQS(quitCtx, serviceIntervals)
-
-	// Create a component that listens to an amqp (rabbitMQ) exchange for work
-	// queues
-	//
-	go serviceRMQ(quitCtx, serviceIntervals, 15*time.Second)
+	// The queues are serviced once the canary experiment, if one was configured, has succeeded
+	startAfterCanary(quitCtx, canaryRqst, func() {
+		// Apply changes to the runner-config file to the services while they are running
+		//
+		go watchRunnerConfig(quitCtx)
+
+		// Create a component that listens to a credentials directory
+		// and starts and stops run methods as needed based on the credentials
+		// it has for the Google cloud infrastructure
+		//
+		go servicePubsub(quitCtx, serviceIntervals)
+
+		// Create a component that listens to AWS credentials directories
+		// and starts and stops run methods as needed based on the credentials
+		// it has for the AWS infrastructure
+		//
+		go serviceSQS(quitCtx, serviceIntervals)
+
+		// Create a component that listens to an amqp (rabbitMQ) exchange for work
+		// queues
+		//
+		go serviceRMQ(quitCtx, serviceIntervals, 15*time.Second)
+
+		// Create a component that watches a local directory for work queues
+		//
+		go serviceDirQueue(quitCtx, serviceIntervals)
+
+		// Create a component that reads work from redis streams
+		//
+		go serviceRedis(quitCtx, serviceIntervals)
+	})
 
 	return nil
 }
@@ -0,0 +1,344 @@
+package main
+
+// This file contains the implementation of maintenance windows.  While a window is active
+// the runner will stop retrieving new work using the same drain and suspend state
+// that can be set manually using Kubernetes configmaps.  Once the window ends the
+// runner returns to the state most recently requested by Kubernetes, or running if
+// Kubernetes is not being used.
+//
+// Windows are specified as a semi-colon separated list with each window being one
+// of the following forms
+//
+//    2006-01-02T15:04:05Z07:00/2006-01-02T15:04:05Z07:00    An absolute start and end time
+//    daily 02:00-04:00 [timezone]                             A window recurring every day
+//    sat 22:00-02:00 [timezone]                               A window recurring on a day of the week
+//
+// The timezone is an IANA name such as America/Los_Angeles and defaults to UTC.  Recurring
+// windows whose end is earlier than their start are taken to finish on the following day.
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	maintWindowsOpt = flag.String("maintenance-windows", "", "a semi-colon separated list of maintenance windows during which no new work will be started, for example 'sat 22:00-02:00 America/Los_Angeles'")
+
+	// lifecycle holds the state that the runner is operating under after any maintenance
+	// windows have been taken into account
+	lifecycle = &lifecycleState{
+		k8s:       types.K8sRunning,
+		effective: types.K8sRunning,
+	}
+
+	// lifecycleRecheckC is used to have the effective state broadcast after it was changed
+	// outside of the lifecycle merger
+	lifecycleRecheckC = make(chan struct{}, 1)
+)
+
+type maintWindow struct {
+	spec string
+
+	// Absolute windows
+	start time.Time
+	end   time.Time
+
+	// Recurring windows
+	recurring bool
+	daily     bool
+	day       time.Weekday
+	from      time.Duration // Offset from midnight
+	to        time.Duration // Offset from midnight
+	loc       *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseTimeOfDay(spec string) (offset time.Duration, errGo error) {
+	tod, errGo := time.Parse("15:04", spec)
+	if errGo != nil {
+		return 0, errGo
+	}
+	return time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute, nil
+}
+
+// parseMaintWindows converts the text specification of maintenance windows into
+// a form that can be used to test times against
+//
+func parseMaintWindows(specs string) (windows []*maintWindow, err errors.Error) {
+
+	windows = []*maintWindow{}
+
+	for _, spec := range strings.Split(specs, ";") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) == 0 {
+			continue
+		}
+
+		w := &maintWindow{spec: spec}
+
+		if times := strings.Split(spec, "/"); len(times) == 2 && !strings.Contains(spec, " ") {
+			start, errGo := time.Parse(time.RFC3339, times[0])
+			if errGo != nil {
+				return nil, errors.Wrap(errGo).With("window", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+			end, errGo := time.Parse(time.RFC3339, times[1])
+			if errGo != nil {
+				return nil, errors.Wrap(errGo).With("window", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+			if !end.After(start) {
+				return nil, errors.New("window ends before it starts").With("window", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+			w.start = start
+			w.end = end
+			windows = append(windows, w)
+			continue
+		}
+
+		fields := strings.Fields(spec)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, errors.New("unrecognized window").With("window", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		w.recurring = true
+		day := strings.ToLower(fields[0])
+		if day == "daily" {
+			w.daily = true
+		} else {
+			if len(day) > 3 {
+				day = day[:3]
+			}
+			weekday, isPresent := weekdays[day]
+			if !isPresent {
+				return nil, errors.New("unrecognized day").With("window", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+			w.day = weekday
+		}
+
+		tods := strings.Split(fields[1], "-")
+		if len(tods) != 2 {
+			return nil, errors.New("unrecognized time range").With("window", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		var errGo error
+		if w.from, errGo = parseTimeOfDay(tods[0]); errGo != nil {
+			return nil, errors.Wrap(errGo).With("window", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		if w.to, errGo = parseTimeOfDay(tods[1]); errGo != nil {
+			return nil, errors.Wrap(errGo).With("window", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		w.loc = time.UTC
+		if len(fields) == 3 {
+			if w.loc, errGo = time.LoadLocation(fields[2]); errGo != nil {
+				return nil, errors.Wrap(errGo).With("window", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// active tests if the supplied time falls within the window
+//
+func (w *maintWindow) active(now time.Time) bool {
+	if !w.recurring {
+		return !now.Before(w.start) && now.Before(w.end)
+	}
+
+	local := now.In(w.loc)
+	tod := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+
+	today := w.daily || local.Weekday() == w.day
+	yesterday := w.daily || local.Weekday() == (w.day+1)%7
+
+	if w.from <= w.to {
+		return today && tod >= w.from && tod < w.to
+	}
+	// The window wraps past midnight
+	return (today && tod >= w.from) || (yesterday && tod < w.to)
+}
+
+// lifecycleState tracks the state requested by Kubernetes, the maintenance window that
+// is active, if any, any drain requested by an operator, whether the runner has reached
+// the end of its lifetime, whether the clock of the node is skewed, and the resulting state
+// the runner is operating under
+//
+type lifecycleState struct {
+	k8s       types.K8sState
+	window    string
+	drained   bool
+	retiring  bool
+	skewed    bool
+	effective types.K8sState
+	sync.Mutex
+}
+
+func (ls *lifecycleState) get() (effective types.K8sState, window string) {
+	ls.Lock()
+	defer ls.Unlock()
+	return ls.effective, ls.window
+}
+
+// update records a change in either input and returns the new effective state, and true if the
+// effective state changed
+//
+func (ls *lifecycleState) update(k8s types.K8sState, window string) (effective types.K8sState, changed bool) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	ls.k8s = k8s
+	ls.window = window
+
+	return ls.resolve()
+}
+
+// drain records an operator asking for the runner to be drained, or to resume, and returns
+// the new effective state, and true if the request changed what the operator had asked for
+//
+func (ls *lifecycleState) drain(drained bool) (effective types.K8sState, changed bool) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	changed = ls.drained != drained
+	ls.drained = drained
+
+	effective, _ = ls.resolve()
+	return effective, changed
+}
+
+// retire records that the runner has reached the end of its lifetime, or that its instance is
+// being terminated, unlike an operator drain it cannot be undone
+//
+func (ls *lifecycleState) retire() (effective types.K8sState) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	ls.retiring = true
+
+	effective, _ = ls.resolve()
+	return effective
+}
+
+// clockSkewed records whether the clock of the node is too far from the time source for work
+// to be done reliably, and returns the new effective state, and true if the skew changed
+//
+func (ls *lifecycleState) clockSkewed(skewed bool) (effective types.K8sState, changed bool) {
+	ls.Lock()
+	defer ls.Unlock()
+
+	changed = ls.skewed != skewed
+	ls.skewed = skewed
+
+	effective, _ = ls.resolve()
+	return effective, changed
+}
+
+// resolve determines the effective state from the inputs, the caller holds the lock
+//
+func (ls *lifecycleState) resolve() (effective types.K8sState, changed bool) {
+	effective = ls.k8s
+	if (len(ls.window) != 0 || ls.drained || ls.retiring || ls.skewed) && ls.k8s == types.K8sRunning {
+		effective = types.K8sDrainAndSuspend
+	}
+	changed = effective != ls.effective
+	ls.effective = effective
+	return effective, changed
+}
+
+// recheckLifecycle has the lifecycle merger broadcast the effective state
+//
+func recheckLifecycle() {
+	select {
+	case lifecycleRecheckC <- struct{}{}:
+	default:
+	}
+}
+
+func activeWindow(windows []*maintWindow, now time.Time) (spec string) {
+	for _, w := range windows {
+		if w.active(now) {
+			return w.spec
+		}
+	}
+	return ""
+}
+
+// lifecycleMerger sits between the Kubernetes state updates and the listeners that control
+// the retrieval of work.  Kubernetes state changes are passed through unless a maintenance
+// window is active, or an operator has drained the runner, in which case the runner is asked
+// to drain and suspend.
+//
+func lifecycleMerger(ctx context.Context, windows []*maintWindow, k8sC <-chan runner.K8sStateUpdate, masterC chan<- runner.K8sStateUpdate) {
+
+	check := time.NewTicker(15 * time.Second)
+	defer check.Stop()
+
+	// Updates are not dropped when the listeners are slow to accept them, instead an update
+	// waiting to be sent is replaced by the latest one as only the latest state matters
+	var pending *runner.K8sStateUpdate
+	send := func(state types.K8sState) {
+		pending = &runner.K8sStateUpdate{Name: "maintenance", State: state}
+	}
+
+	k8sState, window := types.K8sRunning, activeWindow(windows, time.Now())
+	if len(window) != 0 {
+		logger.Info("maintenance window started", "window", window)
+	}
+	if effective, changed := lifecycle.update(k8sState, window); changed {
+		send(effective)
+	}
+
+	for {
+		outC := chan<- runner.K8sStateUpdate(nil)
+		next := runner.K8sStateUpdate{}
+		if pending != nil {
+			outC = masterC
+			next = *pending
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case outC <- next:
+			pending = nil
+		case update := <-k8sC:
+			k8sState = update.State
+			update.State, _ = lifecycle.update(k8sState, window)
+			// Kubernetes updates are always passed on as they are used to refresh listeners
+			pending = &update
+		case <-lifecycleRecheckC:
+			effective, _ := lifecycle.get()
+			send(effective)
+		case now := <-check.C:
+			newWindow := activeWindow(windows, now)
+			if newWindow != window {
+				if len(newWindow) != 0 {
+					logger.Info("maintenance window started", "window", newWindow)
+				} else {
+					logger.Info("maintenance window ended", "window", window)
+				}
+			}
+			window = newWindow
+			if effective, changed := lifecycle.update(k8sState, window); changed {
+				send(effective)
+			}
+		}
+	}
+}
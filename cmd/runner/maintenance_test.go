@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+)
+
+// TestMaintWindows exercises the parsing and matching of maintenance windows
+//
+func TestMaintWindows(t *testing.T) {
+
+	windows, err := parseMaintWindows("2018-10-01T00:00:00Z/2018-10-01T02:00:00Z; sat 22:00-02:00 UTC; daily 12:00-12:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 {
+		t.Fatalf("expected 3 windows, got %d", len(windows))
+	}
+
+	// 2018-10-06 is a Saturday
+	cases := map[string]string{
+		"2018-10-01T01:00:00Z": windows[0].spec,
+		"2018-10-01T02:00:00Z": "",
+		"2018-10-06T21:59:00Z": "",
+		"2018-10-06T23:00:00Z": windows[1].spec,
+		"2018-10-07T01:59:00Z": windows[1].spec,
+		"2018-10-07T02:00:00Z": "",
+		"2018-10-08T01:00:00Z": "",
+		"2018-10-09T12:15:00Z": windows[2].spec,
+	}
+
+	for at, expected := range cases {
+		now, errGo := time.Parse(time.RFC3339, at)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if window := activeWindow(windows, now); window != expected {
+			t.Fatalf("at %s expected window '%s' got '%s'", at, expected, window)
+		}
+	}
+
+	if _, err = parseMaintWindows("someday 01:00-02:00"); err == nil {
+		t.Fatal("an invalid day was accepted")
+	}
+}
+
+// TestLifecycleMergerCoalesces checks that updates are not dropped when the listeners are slow
+// to accept them, an update waiting to be sent is replaced by the latest one
+//
+func TestLifecycleMergerCoalesces(t *testing.T) {
+
+	saved := lifecycle
+	defer func() { lifecycle = saved }()
+	lifecycle = &lifecycleState{
+		k8s:       types.K8sRunning,
+		effective: types.K8sRunning,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	k8sC := make(chan runner.K8sStateUpdate)
+	masterC := make(chan runner.K8sStateUpdate)
+	go lifecycleMerger(ctx, nil, k8sC, masterC)
+
+	k8sC <- runner.K8sStateUpdate{Name: "first", State: types.K8sDrainAndSuspend}
+	k8sC <- runner.K8sStateUpdate{Name: "second", State: types.K8sRunning}
+
+	select {
+	case update := <-masterC:
+		if update.Name != "second" || update.State != types.K8sRunning {
+			t.Fatalf("unexpected update %+v", update)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the latest update was not sent")
+	}
+
+	select {
+	case update := <-masterC:
+		t.Fatalf("replaced update was sent %+v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -57,6 +57,14 @@ func runPrometheus(ctx context.Context) (err errors.Error) {
 	// via an HTTP server. "/metrics" is the usual endpoint for that.
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/resources", resourcesHandler)
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	if *controlAPIOpt {
+		mux.HandleFunc("/projects/cancel", projectCancelHandler)
+		mux.HandleFunc("/projects/resume", projectResumeHandler)
+	}
 
 	h := http.Server{
 		Addr:    fmt.Sprintf("%s:%d", host, prometheusPort),
@@ -0,0 +1,123 @@
+package main
+
+// This file contains the implementation of the check for experiments that ran to completion
+// without producing any output artifacts.  Misconfigured experiments, for example those
+// writing their model to a directory that is not mapped to an artifact, otherwise look like
+// they succeeded.  The check is opt-in as some experiments legitimately produce nothing
+// other than their logs.
+//
+// The files in the directories of the mutable artifacts, other than the output log, the
+// workspace, and the artifacts the runner maintains itself, are counted once the experiment
+// has finished.  Experiments without any such artifacts count as having produced nothing.
+// Depending upon the policy experiments with no outputs are flagged in their completion event
+// and the runner_experiment_no_outputs metric, or are also failed and dumped.
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	noOutputsIgnore = ""
+	noOutputsFlag   = "flag"
+	noOutputsFail   = "fail"
+
+	// noOutputsReason is the reason given for failing experiments that produced no outputs
+	noOutputsReason = "no outputs produced"
+)
+
+var (
+	noOutputsOpt = flag.String("no-outputs", noOutputsIgnore, "the handling of experiments that complete without producing any output artifacts, 'flag' reports them in completion events and metrics, 'fail' also fails and dumps them, empty ignores them")
+
+	noOutputsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "runner_experiment_no_outputs",
+			Help: "Number of experiments that completed without producing any output artifacts.",
+		},
+		[]string{"host", "queue_name", "project"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(noOutputsCount)
+}
+
+// validateNoOutputs checks a no-outputs policy, either the option or one from the per queue
+// settings
+//
+func validateNoOutputs(policy string) (err errors.Error) {
+	switch policy {
+	case noOutputsIgnore, noOutputsFlag, noOutputsFail:
+		return nil
+	}
+	return errors.New("no-outputs must be one of flag, fail, or empty").With("no-outputs", policy).With("stack", stack.Trace().TrimRuntime())
+}
+
+// isNoOutputs returns true when the experiment was failed as it produced no outputs
+//
+func isNoOutputs(err errors.Error) (noOutputs bool) {
+	return err != nil && strings.Contains(err.Error(), noOutputsReason)
+}
+
+// checkOutputs applies the no-outputs policy of the queue to an experiment that has finished
+// running, an error is returned when the experiment is to be failed
+//
+func (p *processor) checkOutputs() (err errors.Error) {
+	policy := queueCfgs.noOutputs(p.Group)
+	if policy == noOutputsIgnore || p.producedOutputs() {
+		return nil
+	}
+
+	p.NoOutputs = true
+	noOutputsCount.With(prometheus.Labels{"host": host, "queue_name": p.Group, "project": p.Request.Config.Database.ProjectId}).Inc()
+	logger.Warn("experiment produced no outputs", "project_id", p.Request.Config.Database.ProjectId,
+		"experiment_id", p.Request.Experiment.Key, "queue", p.Group, "policy", policy)
+
+	if policy != noOutputsFail {
+		return nil
+	}
+	return errors.New(noOutputsReason).With("project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+}
+
+// producedOutputs returns true when any file is present in the directories of the output
+// artifacts of the experiment
+//
+func (p *processor) producedOutputs() (produced bool) {
+	dirs := []string{}
+	for group, artifact := range p.Request.Experiment.Artifacts {
+		if !artifact.Mutable || group == "output" || group == "workspace" || strings.HasPrefix(group, "_") {
+			continue
+		}
+		if p.watchesCheckpoints(group) {
+			if dir, err := p.checkpointDir(); err == nil {
+				dirs = append(dirs, dir)
+			}
+			continue
+		}
+		dirs = append(dirs, filepath.Join(p.ExprDir, group))
+	}
+
+	for _, dir := range dirs {
+		errGo := filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+			if errGo != nil {
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				produced = true
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if errGo == nil && produced {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestNoOutputs checks that experiments producing nothing in their output artifacts are
+// flagged or failed according to the policy of their queue, and that the output log and
+// workspace do not count as outputs
+//
+func TestNoOutputs(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "no-outputs")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFN := filepath.Join(dir, "queue-config.json")
+	cfg := `[{"match": "^strict$", "no_outputs": "fail"}, {"match": "^logs_only$", "no_outputs": ""}]`
+	if errGo = ioutil.WriteFile(cfgFN, []byte(cfg), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	savedCfg, savedPolicy := *queueCfgOpt, *noOutputsOpt
+	*queueCfgOpt = cfgFN
+	*noOutputsOpt = noOutputsFlag
+	defer func() {
+		*queueCfgOpt, *noOutputsOpt = savedCfg, savedPolicy
+		queueCfgs.Lock()
+		queueCfgs.settings = nil
+		queueCfgs.Unlock()
+	}()
+	if err := loadQueueConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, group := range []string{"output", "workspace", "_metadata"} {
+		os.MkdirAll(filepath.Join(dir, group), 0700)
+		ioutil.WriteFile(filepath.Join(dir, group, "file"), []byte("data"), 0600)
+	}
+	os.MkdirAll(filepath.Join(dir, "modeldir", "empty"), 0700)
+
+	newProc := func(queue string) (p *processor) {
+		return &processor{
+			Group:   queue,
+			ExprDir: dir,
+			Request: &runner.Request{
+				Experiment: runner.Experiment{
+					Key: "experiment",
+					Artifacts: map[string]runner.Artifact{
+						"output":    {Mutable: true},
+						"workspace": {Mutable: true},
+						"_metadata": {Mutable: true},
+						"modeldir":  {Mutable: true},
+					},
+				},
+			},
+		}
+	}
+
+	// The default policy for queues without settings flags the experiment
+	p := newProc("default")
+	if err := p.checkOutputs(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.NoOutputs {
+		t.Fatal("experiment without outputs not flagged")
+	}
+
+	p = newProc("strict")
+	err := p.checkOutputs()
+	if !isNoOutputs(err) || !p.NoOutputs {
+		t.Fatalf("experiment without outputs not failed %v", err)
+	}
+
+	p = newProc("logs_only")
+	if err := p.checkOutputs(); err != nil || p.NoOutputs {
+		t.Fatalf("experiment flagged on a queue that ignores missing outputs %v", err)
+	}
+
+	// A single file in an output artifact is enough
+	ioutil.WriteFile(filepath.Join(dir, "modeldir", "empty", "model.h5"), []byte("model"), 0600)
+	p = newProc("strict")
+	if err := p.checkOutputs(); err != nil || p.NoOutputs {
+		t.Fatalf("experiment with outputs flagged %v", err)
+	}
+
+	if err := validateNoOutputs("sometimes"); err == nil {
+		t.Fatal("invalid no-outputs policy accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+// This file contains the implementation of the routing of experiment completion notifications
+// to the destinations experiments ask for.  Destinations are grouped by notifier, webhooks
+// are sent the JSON completion event, while slack and teams destinations are sent a short
+// message summarizing the outcome of the experiment.  Notifications are sent in the
+// background and a failure to deliver one never alters the outcome of an experiment.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	slackHookOpt = flag.String("slack-hook", "", "the URL of a slack incoming webhook used to deliver the slack notifications experiments ask for, slack destinations are ignored when not set")
+)
+
+// notifySummary returns a short human readable description of the outcome of an experiment
+//
+func notifySummary(event *resultEvent) (summary string) {
+	summary = fmt.Sprintf("experiment %s of project %s %s on %s after %s", event.Key, event.Project, event.Status, event.Host,
+		(time.Duration(event.Duration) * time.Second).String())
+	if len(event.Error) != 0 {
+		summary += ", " + event.Error
+	}
+	return summary
+}
+
+// sendNotification delivers the completion event to a single destination using the notifier
+// named
+//
+func sendNotification(notifier string, dest string, event *resultEvent, attempts int, delay time.Duration) (err errors.Error) {
+	message := map[string]string{"text": notifySummary(event)}
+	url := dest
+
+	switch notifier {
+	case runner.NotifyWebhook:
+		return sendCallback(dest, event, attempts, delay)
+	case runner.NotifySlack:
+		if len(*slackHookOpt) == 0 {
+			return errors.New("slack-hook is not set").With("channel", dest).With("stack", stack.Trace().TrimRuntime())
+		}
+		message["channel"] = dest
+		url = *slackHookOpt
+	case runner.NotifyTeams:
+	default:
+		return errors.New("unknown notifier").With("notifier", notifier).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	body, errGo := json.Marshal(message)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return deliver(url, body, attempts, delay)
+}
+
+// notify sends the completion event to every destination the experiment asked to be notified
+// at in the background, failures are logged and do not change the outcome of the experiment
+//
+func notify(event *resultEvent) {
+	for _, notifier := range event.notify.Notifiers() {
+		for _, dest := range event.notify[notifier] {
+			go func(notifier string, dest string) {
+				if err := sendNotification(notifier, dest, event, *callbackAttemptsOpt, time.Second); err != nil {
+					logger.Warn("experiment notification failed", "experiment_id", event.Key, "project_id", event.Project, "notifier", notifier, "error", err.Error())
+				}
+			}(notifier, dest)
+		}
+	}
+}
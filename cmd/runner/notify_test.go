@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestNotify checks that the legacy slack destination and callback are folded into the notify
+// destinations of a request, and that a completion event fans out to each of them
+//
+func TestNotify(t *testing.T) {
+
+	received := map[string]map[string]interface{}{}
+	guard := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer wg.Done()
+		body, _ := ioutil.ReadAll(r.Body)
+		doc := map[string]interface{}{}
+		if errGo := json.Unmarshal(body, &doc); errGo != nil {
+			t.Error(errGo)
+		}
+		guard.Lock()
+		received[r.URL.Path] = doc
+		guard.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	hook := *slackHookOpt
+	*slackHookOpt = receiver.URL + "/slack"
+	defer func() {
+		*slackHookOpt = hook
+	}()
+
+	rqst := &runner.Request{}
+	rqst.Experiment.Key = "notified"
+	rqst.Config.Runner.SlackDest = "@legacy"
+	rqst.Config.CallbackURL = receiver.URL + "/callback"
+	rqst.Config.Notify = runner.Notify{
+		runner.NotifyWebhook: {receiver.URL + "/webhook", receiver.URL + "/callback"},
+		runner.NotifyTeams:   {receiver.URL + "/teams"},
+	}
+
+	dests := rqst.NotifyDestinations()
+	if len(dests[runner.NotifySlack]) != 1 || dests[runner.NotifySlack][0] != "@legacy" {
+		t.Fatalf("legacy slack destination not mapped %v", dests)
+	}
+	if len(dests[runner.NotifyWebhook]) != 2 {
+		t.Fatalf("legacy callback not merged with the webhook destinations %v", dests)
+	}
+
+	event := &resultEvent{Key: "notified", Project: "project", Status: resultFailed, Error: "exit status 1", notify: dests}
+
+	wg.Add(4)
+	notify(event)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("notifications not delivered")
+	}
+
+	guard.Lock()
+	defer guard.Unlock()
+
+	if channel, _ := received["/slack"]["channel"].(string); channel != "@legacy" {
+		t.Fatalf("slack notification not sent to the legacy destination %v", received["/slack"])
+	}
+	if text, _ := received["/teams"]["text"].(string); text != notifySummary(event) {
+		t.Fatalf("unexpected teams notification %v", received["/teams"])
+	}
+	for _, path := range []string{"/webhook", "/callback"} {
+		if key, _ := received[path]["experiment_key"].(string); key != "notified" {
+			t.Fatalf("webhook %s was not sent the completion event %v", path, received[path])
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+// This file contains the interface through which the scheduler observes the resources of the
+// machine it is running on.  The host implementation queries the CPU, disk, and GPU trackers,
+// tests can replace it with synthetic capacities to drive the scheduling decisions.
+
+import (
+	"sync"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// resourceProber is implemented by sources of the free resources of a machine
+//
+type resourceProber interface {
+	// CPUFree returns the free cores and memory
+	CPUFree() (cores uint, mem uint64)
+	// DiskFree returns the free space for experiment working directories
+	DiskFree() (free uint64)
+	// GPUSlots returns the total and free GPU slots across all cards
+	GPUSlots() (cnt uint, free uint)
+	// LargestFreeGPUMem returns the free memory of the GPU that has the most available
+	LargestFreeGPUMem() (free uint64)
+	// CUDAVersions returns the CUDA runtime versions installed
+	CUDAVersions() (versions runner.CUDAVersions)
+}
+
+// hostProber observes the resources of the machine the runner is running on
+//
+type hostProber struct{}
+
+func (hostProber) CPUFree() (cores uint, mem uint64) {
+	return runner.CPUFree()
+}
+
+func (hostProber) DiskFree() (free uint64) {
+	return runner.GetDiskFree()
+}
+
+func (hostProber) GPUSlots() (cnt uint, free uint) {
+	return runner.GPUSlots()
+}
+
+func (hostProber) LargestFreeGPUMem() (free uint64) {
+	return runner.LargestFreeGPUMem()
+}
+
+func (hostProber) CUDAVersions() (versions runner.CUDAVersions) {
+	return runner.GetCUDAVersions()
+}
+
+var (
+	probers = struct {
+		prober resourceProber
+		sync.Mutex
+	}{prober: hostProber{}}
+)
+
+// machine returns the prober currently used to observe the machine
+//
+func machine() (prober resourceProber) {
+	probers.Lock()
+	defer probers.Unlock()
+	return probers.prober
+}
+
+// setProber replaces the prober used to observe the machine and discards any cached probe,
+// the previous prober is returned so that it can be restored
+//
+func setProber(prober resourceProber) (previous resourceProber) {
+	probers.Lock()
+	previous = probers.prober
+	probers.prober = prober
+	probers.Unlock()
+
+	machineRsc.invalidate()
+	return previous
+}
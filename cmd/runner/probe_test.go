@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// syntheticProber supplies fixed machine resources
+//
+type syntheticProber struct {
+	cores    uint
+	mem      uint64
+	disk     uint64
+	gpus     uint
+	gpuMem   uint64
+	versions runner.CUDAVersions
+}
+
+func (sp *syntheticProber) CPUFree() (cores uint, mem uint64) {
+	return sp.cores, sp.mem
+}
+
+func (sp *syntheticProber) DiskFree() (free uint64) {
+	return sp.disk
+}
+
+func (sp *syntheticProber) GPUSlots() (cnt uint, free uint) {
+	return sp.gpus, sp.gpus
+}
+
+func (sp *syntheticProber) LargestFreeGPUMem() (free uint64) {
+	return sp.gpuMem
+}
+
+func (sp *syntheticProber) CUDAVersions() (versions runner.CUDAVersions) {
+	return sp.versions
+}
+
+// countingProber supplies fixed machine resources and counts the probes made of it
+//
+type countingProber struct {
+	syntheticProber
+	probes int32
+}
+
+func (cp *countingProber) CPUFree() (cores uint, mem uint64) {
+	atomic.AddInt32(&cp.probes, 1)
+	return cp.syntheticProber.CPUFree()
+}
+
+// TestMachineProbeCache checks that the free resources of the machine are only probed again
+// once the cached probe is older than the resource-probe-ttl option, or has been invalidated
+//
+func TestMachineProbeCache(t *testing.T) {
+
+	const gb = uint64(1024 * 1024 * 1024)
+
+	prober := &countingProber{syntheticProber: syntheticProber{cores: 8, mem: 32 * gb, disk: 100 * gb}}
+	previous := setProber(prober)
+	defer setProber(previous)
+
+	savedTTL := *machineRscTTLOpt
+	defer func() { *machineRscTTLOpt = savedTTL }()
+	*machineRscTTLOpt = time.Hour
+
+	probes := func() (count int32) {
+		return atomic.LoadInt32(&prober.probes)
+	}
+
+	mp := &machineProbe{}
+	rsc := mp.get()
+	if probes() != 1 || rsc.Cpus != 8 {
+		t.Fatalf("the first get probed %d times giving %+v, expected a single probe", probes(), rsc)
+	}
+
+	// A get within the TTL uses the cached probe, and callers are given their own copy of it
+	rsc.Cpus = 1
+	if rsc = mp.get(); probes() != 1 {
+		t.Fatalf("a get within the TTL probed the machine, %d probes", probes())
+	}
+	if rsc.Cpus != 8 {
+		t.Fatalf("a change to the resources returned altered the cached probe, %d cores", rsc.Cpus)
+	}
+
+	// Allocating, or releasing, resources invalidates the cached probe
+	prober.cores = 6
+	mp.invalidate()
+	if rsc = mp.get(); probes() != 2 || rsc.Cpus != 6 {
+		t.Fatalf("a get after invalidation probed %d times giving %+v, expected a second probe", probes(), rsc)
+	}
+	mp.get()
+	if probes() != 2 {
+		t.Fatalf("a get after the probe following invalidation probed again, %d probes", probes())
+	}
+
+	// Once the TTL has passed the machine is probed again
+	*machineRscTTLOpt = 250 * time.Millisecond
+	time.Sleep(300 * time.Millisecond)
+	prober.cores = 4
+	if rsc = mp.get(); probes() != 3 || rsc.Cpus != 4 {
+		t.Fatalf("a get after the TTL probed %d times giving %+v, expected a third probe", probes(), rsc)
+	}
+	if mp.get(); probes() != 3 {
+		t.Fatalf("a get within the TTL of the new probe probed again, %d probes", probes())
+	}
+}
+
+// TestSchedulerFit checks the decisions made by the queue check when the machine is under
+// different resource pressures
+//
+func TestSchedulerFit(t *testing.T) {
+
+	const gb = uint64(1024 * 1024 * 1024)
+
+	idle := &syntheticProber{cores: 8, mem: 32 * gb, disk: 100 * gb, gpus: 2, gpuMem: 16 * gb,
+		versions: runner.CUDAVersions{CUDA: "10.1", CuDNN: "7.6.5"}}
+	cpuOnly := &syntheticProber{cores: 8, mem: 32 * gb, disk: 100 * gb}
+	busy := &syntheticProber{cores: 1, mem: 2 * gb, disk: 100 * gb, gpus: 2, gpuMem: 16 * gb}
+	full := &syntheticProber{cores: 8, mem: 32 * gb, disk: 1 * gb, gpus: 2, gpuMem: 16 * gb}
+
+	cpuJob := &runner.Resource{Cpus: 2, Ram: "4gb", Hdd: "10gb"}
+	gpuJob := &runner.Resource{Cpus: 2, Gpus: 1, Ram: "4gb", Hdd: "10gb", GpuMem: "8gb"}
+	cudaJob := &runner.Resource{Cpus: 2, Gpus: 1, Ram: "4gb", Hdd: "10gb", GpuMem: "8gb", Cuda: "11.0"}
+	rangeJob := &runner.Resource{Cpus: 4, MinCpus: 1, Ram: "8gb", MinRam: "1gb", Hdd: "10gb"}
+
+	cases := []struct {
+		name     string
+		machine  *syntheticProber
+		rsc      *runner.Resource
+		dispatch bool
+	}{
+		{name: "cpu job on idle machine", machine: idle, rsc: cpuJob, dispatch: true},
+		{name: "gpu job on idle machine", machine: idle, rsc: gpuJob, dispatch: true},
+		{name: "gpu job without gpus", machine: cpuOnly, rsc: gpuJob, dispatch: false},
+		{name: "cpu job under cpu pressure", machine: busy, rsc: cpuJob, dispatch: false},
+		{name: "cpu job without disk", machine: full, rsc: cpuJob, dispatch: false},
+		{name: "cuda job with an old runtime", machine: idle, rsc: cudaJob, dispatch: false},
+		{name: "range job under cpu pressure", machine: busy, rsc: rangeJob, dispatch: true},
+		{name: "unknown resources", machine: busy, rsc: nil, dispatch: true},
+	}
+
+	previous := setProber(idle)
+	defer setProber(previous)
+
+	for _, tc := range cases {
+		setProber(tc.machine)
+
+		qr := &Queuer{
+			project: "synthetic",
+			subs:    Subscriptions{subs: map[string]*Subscription{"rmq_queue": {name: "rmq_queue", rsc: tc.rsc}}},
+		}
+
+		rQ := newDispatcher()
+		if !rQ.advertise(context.Background()) {
+			t.Fatal("consumer capacity could not be advertised")
+		}
+		if err := qr.check(context.Background(), "rmq_queue", rQ, nil); err != nil {
+			t.Fatal(tc.name, err)
+		}
+
+		dispatched := false
+		select {
+		case <-rQ.work:
+			dispatched = true
+		default:
+		}
+		if dispatched != tc.dispatch {
+			t.Fatalf("%s dispatched %v, expected %v", tc.name, dispatched, tc.dispatch)
+		}
+	}
+}
+
+// TestCheckFanout checks that queues dispatched during a single pass of the producer consume
+// the headroom seen by the queues checked after them
+//
+func TestCheckFanout(t *testing.T) {
+
+	const gb = uint64(1024 * 1024 * 1024)
+
+	previous := setProber(&syntheticProber{cores: 8, mem: 32 * gb, disk: 100 * gb})
+	defer setProber(previous)
+
+	job := &runner.Resource{Cpus: 3, Ram: "4gb", Hdd: "10gb"}
+	qr := &Queuer{
+		project: "synthetic",
+		subs: Subscriptions{subs: map[string]*Subscription{
+			"queue_1": {name: "queue_1", rsc: job},
+			"queue_2": {name: "queue_2", rsc: job},
+			"queue_3": {name: "queue_3", rsc: job},
+		}},
+	}
+
+	rQ := newDispatcher()
+	pass := &checkPass{}
+	for _, name := range []string{"queue_1", "queue_2", "queue_3"} {
+		if !rQ.advertise(context.Background()) {
+			t.Fatal("consumer capacity could not be advertised")
+		}
+		if err := qr.check(context.Background(), name, rQ, pass); err != nil {
+			t.Fatal(name, err)
+		}
+		select {
+		case <-rQ.work:
+		default:
+		}
+	}
+
+	// Two of the three queues fit within the eight cores of the machine
+	if pass.dispatched != 2 || pass.cpus != 6 {
+		t.Fatalf("pass dispatched %d queues claiming %d cores, expected 2 queues claiming 6 cores", pass.dispatched, pass.cpus)
+	}
+}
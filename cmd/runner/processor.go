@@ -25,6 +25,8 @@ import (
 
 	"github.com/valyala/fastjson"
 
+	"go.opencensus.io/trace"
+
 	"github.com/dgryski/go-farm"
 
 	"github.com/leaf-ai/studio-go-runner/internal/runner"
@@ -38,16 +40,24 @@ import (
 )
 
 type processor struct {
-	Group      string            `json:"group"` // A caller specific grouping for work that can share sensitive resources
-	RootDir    string            `json:"root_dir"`
-	ExprDir    string            `json:"expr_dir"`
-	ExprSubDir string            `json:"expr_sub_dir"`
-	ExprEnvs   map[string]string `json:"expr_envs"`
-	Request    *runner.Request   `json:"request"` // merge these two fields, to avoid split data in a DB and some in JSON
-	Creds      string            `json:"credentials_file"`
-	Artifacts  *runner.ArtifactCache
-	Executor   Executor
-	ready      chan bool // Used by the processor to indicate it has released resources or state has changed
+	Group       string            `json:"group"` // A caller specific grouping for work that can share sensitive resources
+	RootDir     string            `json:"root_dir"`
+	ExprDir     string            `json:"expr_dir"`
+	ExprSubDir  string            `json:"expr_sub_dir"`
+	ExprEnvs    map[string]string `json:"expr_envs"`
+	Request     *runner.Request   `json:"request"` // merge these two fields, to avoid split data in a DB and some in JSON
+	Creds       string            `json:"credentials_file"`
+	Artifacts   *runner.ArtifactCache
+	Executor    Executor
+	Telemetry   *runner.Telemetry        `json:"-"`         // The studioml telemetry gathered from the experiment output, nil when not gathered
+	Utilization *runner.Utilization      `json:"-"`         // The resources consumed by the experiment over time, nil when not sampled
+	Allocated   *runner.Resource         `json:"allocated"` // The resources given to the experiment, set once they have been allocated
+	StudioDirs  *runner.StudioDirs       `json:"-"`         // The studioml directory layout used by the experiment, set once it has been created
+	NoOutputs   bool                     `json:"-"`         // The experiment finished without producing any output artifacts
+	Result      *runner.ExperimentResult `json:"-"`         // The final status of the experiment from its result line, nil when it was not run
+	ready       chan bool                // Used by the processor to indicate it has released resources or state has changed
+
+	inherited map[string]string // Variables ExprEnvs received from the runners own environment
 }
 
 type tempSafe struct {
@@ -74,6 +84,10 @@ var (
 	// A shared cache for all projects exists that is used by processors
 	artifactCache = runner.NewArtifactCache()
 
+	// processorFactory creates the processors for messages, tests replace it to exercise the
+	// handling of messages
+	processorFactory = newProcessor
+
 	// Used to initialize a logger sink into which the artifact caching code in the runner
 	// can send error messages for the application to determine what action is taken with
 	// caching errors that might be short lived
@@ -117,6 +131,12 @@ type Executor interface {
 	// Run will execute the worker task used by the experiment
 	Run(ctx context.Context, refresh map[string]runner.Artifact) (err errors.Error)
 
+	// OutputTruncated indicates that output from the experiment was discarded due to its size
+	OutputTruncated() (truncated bool)
+
+	// Result returns the final status of the experiment written to its result line, nil if it was not run
+	Result() (result *runner.ExperimentResult)
+
 	// Close can be used to tidy up after an experiment has completed
 	Close() (err errors.Error)
 }
@@ -169,6 +189,20 @@ func newProcessor(ctx context.Context, group string, msg []byte, creds string) (
 	if err != nil {
 		return nil, err
 	}
+	logger.Debug("request layout detected", "shape", p.Request.Shape(), "experiment_id", p.Request.Experiment.Key)
+
+	// Requests that cannot be run on this runner are rejected before any work is done
+	if err = p.Request.Validate(); err != nil {
+		return nil, err
+	}
+
+	// The directory is excluded from log retention sweeps while it is in use, mkUniqDir adds it
+	// before creating it so that a sweep cannot see the directory before it is protected
+	defer func() {
+		if err != nil {
+			activeExprs.remove(p.ExprDir)
+		}
+	}()
 
 	if _, err = p.mkUniqDir(); err != nil {
 		return nil, err
@@ -195,9 +229,14 @@ func newProcessor(ctx context.Context, group string, msg []byte, creds string) (
 
 	switch mode {
 	case ExecPythonVEnv:
-		if p.Executor, err = runner.NewVirtualEnv(p.Request, p.ExprDir); err != nil {
+		env, err := runner.NewVirtualEnv(p.Request, p.ExprDir)
+		if err != nil {
 			return nil, err
 		}
+		env.Stderr = queueCfgs.stderrPolicy(group)
+		p.Executor = env
+		p.Telemetry = env.Telemetry
+		p.Utilization = env.Utilization
 	case ExecSingularity:
 		if p.Executor, err = runner.NewSingularity(p.Request, p.ExprDir); err != nil {
 			return nil, err
@@ -212,6 +251,14 @@ func newProcessor(ctx context.Context, group string, msg []byte, creds string) (
 	return p, nil
 }
 
+const (
+	// telemetryGroup is the artifact the telemetry document of an experiment is returned as
+	telemetryGroup = "telemetry"
+
+	// metricsGroup is the artifact the utilization time-series of an experiment is returned as
+	metricsGroup = "metrics"
+)
+
 const (
 	// ExecUnknown is an unused guard value
 	ExecUnknown = iota
@@ -225,12 +272,17 @@ const (
 // was used by the studioml work
 //
 func (p *processor) Close() (err error) {
+	defer activeExprs.remove(p.ExprDir)
+
 	if *debugOpt || 0 == len(p.ExprDir) {
 		logger.Info("experiment kept", "dir", p.ExprDir, "stack", stack.Trace().TrimRuntime())
 		return nil
 	}
 
 	logger.Info("experiment removed", "dir", p.ExprDir, "stack", stack.Trace().TrimRuntime())
+	if err := p.StudioDirs.Remove(); err != nil {
+		logger.Warn("experiment studioml directories not removed", "experiment_id", p.Request.Experiment.Key, "error", err.Error())
+	}
 	return os.RemoveAll(p.ExprDir)
 }
 
@@ -239,8 +291,25 @@ func (p *processor) Close() (err error) {
 //
 func (p *processor) fetchAll(ctx context.Context) (err errors.Error) {
 
+	// Artifacts with checksums are verified in the background while the others are downloaded
+	verifier := runner.NewVerifier()
+	defer func() {
+		warns, errVerify := verifier.Wait()
+		for _, warn := range warns {
+			logger.Debug("artifact verification failed", "Experiment", p.Request.Experiment.Key, "warning", warn)
+		}
+		if err == nil && errVerify != nil {
+			err = errVerify.With("project", p.Request.Config.Database.ProjectId, "Experiment", p.Request.Experiment.Key)
+		}
+	}()
+
 	for group, artifact := range p.Request.Experiment.Artifacts {
 
+		// Stop downloading once a required artifact has failed its verification
+		if verifier.Err() != nil {
+			return nil
+		}
+
 		// Artifacts that have no qualified location will be ignored
 		if 0 == len(artifact.Qualified) {
 			continue
@@ -256,7 +325,11 @@ func (p *processor) fetchAll(ctx context.Context) (err errors.Error) {
 		// The current convention is that the archives include the directory name under which
 		// the files are unpacked in their table of contents
 		//
-		warns, err := artifactCache.Fetch(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.ExprEnvs, p.ExprDir)
+		warns, err := artifactCache.FetchRetry(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.ExprEnvs, p.ExprDir, verifier)
+		if err == nil {
+			// The version of the object fetched is kept for the experiment telemetry
+			p.Request.Experiment.Artifacts[group] = artifact
+		}
 
 		if err != nil {
 			msg := "artifact fetch failed"
@@ -267,7 +340,7 @@ func (p *processor) fetchAll(ctx context.Context) (err errors.Error) {
 				"stack", stack.Trace().TrimRuntime(),
 				"err", err,
 			}
-			if artifact.Mutable {
+			if artifact.IsOptional() {
 				logger.Debug(msg, msgDetail)
 			} else {
 				logger.Warn(msg, msgDetail)
@@ -275,17 +348,29 @@ func (p *processor) fetchAll(ctx context.Context) (err errors.Error) {
 			msgDetail[len(msgDetail)-2] = "warning"
 			for _, warn := range warns {
 				msgDetail[len(msgDetail)-1] = warn
-				if artifact.Mutable {
+				if artifact.IsOptional() {
 					logger.Debug(msg, msgDetail)
 				} else {
 					logger.Warn(msg, msgDetail)
 				}
 			}
 
-			// Mutable artifacts can be create only items that dont yet exist on the storage platform
-			if !artifact.Mutable {
+			// Optional artifacts, which include mutable artifacts that might not yet exist on the
+			// storage platform, do not stop the experiment, their failures are kept with the
+			// experiment telemetry
+			if !artifact.IsOptional() {
 				return err.With(msgDetail...)
 			}
+			if p.Telemetry == nil {
+				p.Telemetry = runner.NewTelemetry()
+			}
+			p.Telemetry.Record(map[string]interface{}{
+				"runner": map[string]interface{}{
+					"failed_artifacts": map[string]interface{}{
+						group: err.Error(),
+					},
+				},
+			})
 		}
 	}
 	return nil
@@ -406,7 +491,26 @@ func (p *processor) returnOne(ctx context.Context, group string, artifact runner
 		}
 	}
 
-	uploaded, warns, err = artifactCache.Restore(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.ExprEnvs, p.ExprDir)
+	// Reserve the space needed to stage the artifact for uploading, should the node have run out
+	// of disk the artifact cannot be returned
+	reserved, _ := humanize.ParseBytes(p.Request.Experiment.Resource.Hdd)
+	staging, err := runner.AllocStaging(filepath.Join(p.ExprDir, group), p.ExprDir, reserved)
+	if err != nil {
+		logger.Warn("artifact could not be staged", "project_id", p.Request.Config.Database.ProjectId,
+			"experiment_id", p.Request.Experiment.Key, "group", group, "error", err.Error())
+		return false, warns, err
+	}
+	defer staging.Release()
+
+	// Uploads are tagged with the experiment they came from for lifecycle rules and cost reports
+	tags := runner.UploadTags(map[string]string{
+		"experiment": p.Request.Experiment.Key,
+		"project":    p.Request.Config.Database.ProjectId,
+		"group":      group,
+		"host":       host,
+	})
+
+	uploaded, warns, err = artifactCache.Restore(ctx, &artifact, p.Request.Config.Database.ProjectId, group, p.Creds, p.ExprEnvs, p.ExprDir, tags)
 	if err != nil {
 		logger.Warn("artifact could not be returned", "project_id", p.Request.Config.Database.ProjectId,
 			"experiment_id", p.Request.Experiment.Key, "artifact", artifact, "error", err.Error())
@@ -414,6 +518,39 @@ func (p *processor) returnOne(ctx context.Context, group string, artifact runner
 	return uploaded, warns, err
 }
 
+// besideOutput describes where a document the runner produced for the experiment, such as its
+// telemetry, is returned to.  It is placed beside the output artifact using the group name in
+// place of output, for example output.tar becomes telemetry.tar.  Experiments that supply
+// their own artifact for the group have it returned along with their other artifacts.
+//
+func (p *processor) besideOutput(group string, fn string) (artifact runner.Artifact, isPresent bool) {
+	if _, isPresent = p.Request.Experiment.Artifacts[group]; isPresent {
+		return artifact, false
+	}
+	if _, errGo := os.Stat(filepath.Join(p.ExprDir, group, fn)); errGo != nil {
+		return artifact, false
+	}
+
+	output, isPresent := p.Request.Experiment.Artifacts["output"]
+	if !isPresent || len(output.Qualified) == 0 {
+		return artifact, false
+	}
+	base := path.Base(output.Key)
+	if !strings.HasPrefix(base, "output") || !strings.HasSuffix(output.Qualified, base) {
+		return artifact, false
+	}
+	name := group + strings.TrimPrefix(base, "output")
+
+	artifact = output
+	artifact.Key = strings.TrimSuffix(output.Key, base) + name
+	artifact.Qualified = strings.TrimSuffix(output.Qualified, base) + name
+	artifact.Hash = ""
+	artifact.Local = ""
+	artifact.Version = ""
+	artifact.Mutable = true
+	return artifact, true
+}
+
 // returnAll creates tar archives of the experiments artifacts and then puts them
 // back to the studioml shared storage
 //
@@ -434,7 +571,9 @@ func (p *processor) returnAll(ctx context.Context, accessionID string) (warns []
 
 	for _, group := range keys {
 		if artifact, isPresent := p.Request.Experiment.Artifacts[group]; isPresent {
-			if artifact.Mutable {
+			// Checkpoints are returned as they appear and are not overwritten here in case
+			// the experiment did not get as far as restoring them
+			if artifact.Mutable && !p.watchesCheckpoints(group) {
 				if _, warns, err = p.returnOne(ctx, group, artifact, accessionID); err != nil {
 					return warns, err
 				}
@@ -442,6 +581,30 @@ func (p *processor) returnAll(ctx context.Context, accessionID string) (warns []
 		}
 	}
 
+	// The telemetry and utilization documents are returned next to the output artifact, failing
+	// to do so does not fail the experiment
+	if artifact, isPresent := p.besideOutput(telemetryGroup, runner.TelemetryFile); isPresent {
+		if _, _, errTelemetry := p.returnOne(ctx, telemetryGroup, artifact, ""); errTelemetry != nil {
+			logger.Warn("experiment telemetry not returned", "project_id", p.Request.Config.Database.ProjectId,
+				"experiment_id", p.Request.Experiment.Key, "error", errTelemetry.Error())
+		}
+	}
+	if artifact, isPresent := p.besideOutput(metricsGroup, runner.UtilizationFile); isPresent {
+		if _, _, errMetrics := p.returnOne(ctx, metricsGroup, artifact, ""); errMetrics != nil {
+			logger.Warn("experiment utilization not returned", "project_id", p.Request.Config.Database.ProjectId,
+				"experiment_id", p.Request.Experiment.Key, "error", errMetrics.Error())
+		}
+	}
+
+	// Core dumps captured after the experiment crashed are returned for debugging, they can be
+	// large and so are staged against the disk of the node like any other artifact
+	if artifact, isPresent := p.besideOutput(runner.CoreGroup, runner.CoreIndexFile); isPresent {
+		if _, _, errCores := p.returnOne(ctx, runner.CoreGroup, artifact, ""); errCores != nil {
+			logger.Warn("experiment core dumps not returned", "project_id", p.Request.Config.Database.ProjectId,
+				"experiment_id", p.Request.Experiment.Key, "error", errCores.Error())
+		}
+	}
+
 	if len(returned) != 0 {
 		logger.Info("project returning", "project_id", p.Request.Config.Database.ProjectId, "result", strings.Join(returned, ", "))
 	}
@@ -457,7 +620,9 @@ func (p *processor) returnAll(ctx context.Context, accessionID string) (warns []
 //
 func (p *processor) allocate() (alloc *runner.Allocated, err errors.Error) {
 
-	rqst := runner.AllocRequest{}
+	rqst := runner.AllocRequest{
+		Owner: p.Request.Experiment.Key,
+	}
 
 	// Before continuing locate GPU resources for the task that has been received
 	//
@@ -471,11 +636,27 @@ func (p *processor) allocate() (alloc *runner.Allocated, err errors.Error) {
 	}
 
 	rqst.MaxGPU = uint(p.Request.Experiment.Resource.Gpus)
+	rqst.GPUPack = p.Request.Experiment.Resource.GpuShare
 
 	rqst.MaxCPU = uint(p.Request.Experiment.Resource.Cpus)
 	if rqst.MaxMem, errGo = humanize.ParseBytes(p.Request.Experiment.Resource.Ram); errGo != nil {
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
+	// Shared memory is provided from RAM
+	shm, err := runner.ShmSize(&p.Request.Experiment.Resource)
+	if err != nil {
+		return nil, err
+	}
+	rqst.MaxMem += shm
+
+	// Requests using a range are given as much as is free between the minimum and preferred amounts
+	rqst.MinCPU = p.Request.Experiment.Resource.MinCpus
+	if len(p.Request.Experiment.Resource.MinRam) != 0 {
+		if rqst.MinMem, errGo = humanize.ParseBytes(p.Request.Experiment.Resource.MinRam); errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		rqst.MinMem += shm
+	}
 	if rqst.MaxDisk, errGo = humanize.ParseBytes(p.Request.Experiment.Resource.Hdd); errGo != nil {
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
@@ -483,6 +664,7 @@ func (p *processor) allocate() (alloc *runner.Allocated, err errors.Error) {
 	if alloc, err = resources.AllocResources(rqst); err != nil {
 		return nil, err
 	}
+	machineRsc.invalidate()
 
 	logger.Debug(fmt.Sprintf("alloc %s, gave %s", Spew.Sdump(rqst), Spew.Sdump(*alloc)))
 
@@ -499,6 +681,7 @@ func (p *processor) deallocate(alloc *runner.Allocated) {
 	} else {
 		logger.Debug(fmt.Sprintf("released %s", Spew.Sdump(*alloc)))
 	}
+	machineRsc.invalidate()
 
 	// Only wait a second to alter others that the resources have been released
 	//
@@ -539,6 +722,16 @@ func (p *processor) Process(ctx context.Context) (wait time.Duration, ack bool,
 	// resource reservations to become known to the running applications.
 	// This call will block until the task stops processing.
 	if _, err = p.deployAndRun(ctx, alloc, accessionID); err != nil {
+		// Experiments that exceed their disk space, whose workspace does not contain the file
+		// to be run, or that produced no outputs, will fail again when retried so they are dumped
+		if runner.IsDiskQuotaExceeded(err) || runner.IsEntrypointMissing(err) || isNoOutputs(err) {
+			return time.Duration(10 * time.Second), true, err
+		}
+		// Running out of disk is a problem with this node and so the experiment is returned
+		// to the queue for another node to run
+		if runner.IsOutOfDisk(err) {
+			return *outOfDiskBackoffOpt, false, err
+		}
 		return time.Duration(10 * time.Second), false, err
 	}
 
@@ -605,8 +798,11 @@ func (p *processor) mkUniqDir() (dir string, err errors.Error) {
 			break
 		}
 
-		// Create the next directory in sequence with another directory containing our signature
+		// Create the next directory in sequence with another directory containing our signature,
+		// the directory is protected from log retention sweeps before it exists
+		activeExprs.add(p.ExprDir)
 		if errGo = os.MkdirAll(filepath.Join(p.ExprDir, self), 0700); errGo != nil {
+			activeExprs.remove(p.ExprDir)
 			p.ExprDir = ""
 			return dir, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
@@ -621,6 +817,7 @@ func (p *processor) mkUniqDir() (dir string, err errors.Error) {
 
 		if len(files) != 1 {
 			logger.Debug(fmt.Sprintf("looking in what should be a single file inside our experiment and find %s", Spew.Sdump(files)))
+			activeExprs.remove(p.ExprDir)
 			// Increment the instance for the next pass
 			inst++
 
@@ -674,6 +871,10 @@ func extractValidEnv() (envs map[string]string) {
 func (p *processor) applyEnv(alloc *runner.Allocated) {
 
 	p.ExprEnvs = extractValidEnv()
+	p.inherited = make(map[string]string, len(p.ExprEnvs))
+	for k, v := range p.ExprEnvs {
+		p.inherited[k] = v
+	}
 
 	// Expand %...% pairs by iterating the env table for the process and explicitly replacing on each line
 	re := regexp.MustCompile(`(?U)(?:\%(.*)*\%)+`)
@@ -701,6 +902,22 @@ func (p *processor) applyEnv(alloc *runner.Allocated) {
 	// a set of env variables as an array that will be written into the script using the receiever
 	// contents.
 	//
+	// Experiments are told the CPU resources they were given as requests using a range may
+	// receive less than they preferred, shared memory is not included in the RAM
+	if alloc.CPU != nil {
+		ram := alloc.CPU.Mem()
+		if shm, err := runner.ShmSize(&p.Request.Experiment.Resource); err == nil && shm < ram {
+			ram -= shm
+		}
+		p.ExprEnvs["STUDIOML_ALLOCATED_CPUS"] = strconv.FormatUint(uint64(alloc.CPU.Cores()), 10)
+		p.ExprEnvs["STUDIOML_ALLOCATED_RAM"] = strconv.FormatUint(ram, 10)
+	}
+	// GPUs are given as slots, and with packing as memory within a shared board
+	p.ExprEnvs["STUDIOML_ALLOCATED_GPUS"] = strconv.FormatUint(uint64(alloc.GPU.Slots()), 10)
+	p.ExprEnvs["STUDIOML_ALLOCATED_GPU_MEM"] = strconv.FormatUint(alloc.GPU.Mem(), 10)
+
+	p.Allocated = runner.AllocatedResource(alloc, &p.Request.Experiment.Resource)
+
 	for _, gpu := range alloc.GPU {
 		for env, gpuVar := range gpu.Env {
 			if len(gpuVar) != 0 {
@@ -714,6 +931,23 @@ func (p *processor) applyEnv(alloc *runner.Allocated) {
 	}
 }
 
+// ExperimentEnvs returns the variables the experiment asked for and those set by the runner for
+// it.  Variables in ExprEnvs that were inherited unchanged from the runner are left out, the
+// executors add those that are allowed from the runners environment.
+//
+func (p *processor) ExperimentEnvs() (envs map[string]string) {
+	envs = make(map[string]string, len(p.ExprEnvs))
+	for k, v := range p.ExprEnvs {
+		if inherited, isPresent := p.inherited[k]; isPresent && inherited == v {
+			if _, requested := p.Request.Config.Env[k]; !requested {
+				continue
+			}
+		}
+		envs[k] = v
+	}
+	return envs
+}
+
 func (p *processor) calcTimeLimit() (maxDuration time.Duration) {
 	// Determine when the life time of the experiment is over and then check it before starting
 	// the experiment.  when running this function also checks to ensure the lifetime has not expired
@@ -756,7 +990,7 @@ func (p *processor) calcTimeLimit() (maxDuration time.Duration) {
 	return maxDuration
 }
 
-func (p *processor) checkpointStart(ctx context.Context, accessionID string, refresh map[string]runner.Artifact, saveTimeout time.Duration) (doneC chan struct{}) {
+func (p *processor) checkpointStart(ctx context.Context, accessionID string, refresh map[string]runner.Artifact, saveTimeout time.Duration, stop func(err errors.Error)) (doneC chan struct{}) {
 	doneC = make(chan struct{}, 1)
 
 	// On a regular basis we will flush the log and compress it for uploading to
@@ -776,25 +1010,30 @@ func (p *processor) checkpointStart(ctx context.Context, accessionID string, ref
 		}
 	}
 
-	go p.checkpointer(ctx, saveDuration, saveTimeout, accessionID, refresh, doneC)
+	go p.checkpointer(ctx, saveDuration, saveTimeout, accessionID, refresh, stop, doneC)
 
 	return doneC
 }
 
 // checkpointArtifacts will run through the artifacts within a refresh list
 // and make sure they are all commited to the data store used by the
-// experiment
-func (p *processor) checkpointArtifacts(ctx context.Context, accessionID string, refresh map[string]runner.Artifact) {
+// experiment.  Running out of disk is the only error returned as it
+// prevents the experiment from being able to continue.
+func (p *processor) checkpointArtifacts(ctx context.Context, accessionID string, refresh map[string]runner.Artifact) (err errors.Error) {
 	for group, artifact := range refresh {
-		p.returnOne(ctx, group, artifact, accessionID)
+		if _, _, errReturn := p.returnOne(ctx, group, artifact, accessionID); runner.IsOutOfDisk(errReturn) {
+			err = errReturn
+		}
 	}
+	return err
 }
 
 // checkpointer is designed to take items such as progress tracking artifacts and on a regular basis
 // save these to the artifact store while the experiment is running.  The refresh collection contains
-// a list of the artifacts that need to be checkpointed
+// a list of the artifacts that need to be checkpointed.  Should the node run out of disk while
+// checkpointing the stop function is called to cancel the experiment.
 //
-func (p *processor) checkpointer(ctx context.Context, saveInterval time.Duration, saveTimeout time.Duration, accessionID string, refresh map[string]runner.Artifact, doneC chan struct{}) {
+func (p *processor) checkpointer(ctx context.Context, saveInterval time.Duration, saveTimeout time.Duration, accessionID string, refresh map[string]runner.Artifact, stop func(err errors.Error), doneC chan struct{}) {
 
 	defer close(doneC)
 
@@ -812,8 +1051,11 @@ func (p *processor) checkpointer(ctx context.Context, saveInterval time.Duration
 			// Here a regular checkpoint of the artifacts is being done.  Before doing this
 			// we should copy meta data related files from the output directory and other
 			// locations into the _metadata artifact area
-			p.checkpointArtifacts(uploadCtx, accessionID, refresh)
+			err := p.checkpointArtifacts(uploadCtx, accessionID, refresh)
 			uploadCancel()
+			if err != nil {
+				stop(err)
+			}
 
 		case <-ctx.Done():
 			// The context that is supplied by the caller relates to the experiment itself, however what we dont want
@@ -825,7 +1067,9 @@ func (p *processor) checkpointer(ctx context.Context, saveInterval time.Duration
 			// The context can be canncelled externally in which case
 			// we should still push any changes that occured since the last
 			// checkpoint
-			p.checkpointArtifacts(uploadCtx, accessionID, refresh)
+			if err := p.checkpointArtifacts(uploadCtx, accessionID, refresh); err != nil {
+				stop(err)
+			}
 			return
 		}
 	}
@@ -842,6 +1086,19 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 	// completes normally and terminates by returning
 	runCtx, runCancel := context.WithCancel(ctx)
 
+	// The checkpointer can stop the experiment, for example if the node runs out of disk, and
+	// the reason it did so takes precedence over the error from the cancelled experiment
+	stopErr := errors.Error(nil)
+	stopLock := sync.Mutex{}
+	stop := func(err errors.Error) {
+		stopLock.Lock()
+		if stopErr == nil {
+			stopErr = err
+		}
+		stopLock.Unlock()
+		runCancel()
+	}
+
 	// Start a checkpointer for our output files and pass it the channel used
 	// to notify when it is to stop.  Save a reference to the channel used to
 	// indicate when the checkpointer has flushed files etc.
@@ -849,10 +1106,37 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 	// This function also ensures that the queue related to the work being
 	// processed is still present, if not the task should be terminated.
 	//
-	doneC := p.checkpointStart(runCtx, accessionID, refresh, refreshTimeout)
+	doneC := p.checkpointStart(runCtx, accessionID, refresh, refreshTimeout, stop)
+
+	// Experiments that name a checkpoint directory have it watched for new checkpoints
+	checkpointC := p.checkpointWatch(runCtx, refreshTimeout, stop)
 
 	// Blocking call to run the process that uses the ctx for timeouts etc
 	err = p.Executor.Run(runCtx, refresh)
+	p.Result = p.Executor.Result()
+
+	switch {
+	case runner.IsSetupTimeout(err):
+		logger.Warn("experiment setup timed out", "experiment_id", p.Request.Experiment.Key, "setup_timeout", p.Request.Experiment.SetupTimeout)
+	case runner.IsRunTimeout(err):
+		logger.Warn("experiment run timed out", "experiment_id", p.Request.Experiment.Key, "run_timeout", p.Request.Experiment.RunTimeout)
+	}
+
+	if p.Executor.OutputTruncated() {
+		logger.Warn("experiment output truncated", "experiment_id", p.Request.Experiment.Key)
+	}
+
+	// The studioml telemetry lines found in the output are saved as a document of their own
+	if !p.Telemetry.Empty() {
+		if _, errTelemetry := p.Telemetry.Save(filepath.Join(p.ExprDir, telemetryGroup)); errTelemetry != nil {
+			logger.Warn("experiment telemetry not saved", "experiment_id", p.Request.Experiment.Key, "error", errTelemetry.Error())
+		}
+	}
+	if !p.Utilization.Empty() {
+		if _, errMetrics := p.Utilization.Save(filepath.Join(p.ExprDir, metricsGroup)); errMetrics != nil {
+			logger.Warn("experiment utilization not saved", "experiment_id", p.Request.Experiment.Key, "error", errMetrics.Error())
+		}
+	}
 
 	// When the runner itself stops then we can cancel the context which will signal the checkpointer
 	// to do one final save of the experiment data and return after closing its own doneC channel
@@ -861,7 +1145,13 @@ func (p *processor) runScript(ctx context.Context, accessionID string, refresh m
 	// Make sure any checkpointing is done before continuing to handle results
 	// and artifact uploads
 	<-doneC
+	<-checkpointC
 
+	stopLock.Lock()
+	defer stopLock.Unlock()
+	if stopErr != nil {
+		return stopErr.With("experiment_id", p.Request.Experiment.Key)
+	}
 	return err
 }
 
@@ -890,6 +1180,21 @@ func (p *processor) run(ctx context.Context, alloc *runner.Allocated, accessionI
 		logger.Trace("on disk manifest", "dir", searchDir, "files", strings.Join(files, ", "))
 	}
 
+	// Check the experiment can be started before the environment is built
+	if _, isPresent := p.Request.Experiment.Artifacts["workspace"]; isPresent {
+		if err = runner.CheckEntrypoint(filepath.Join(p.ExprDir, "workspace"), p.Request.Experiment.Filename); err != nil {
+			return err.With("project_id", p.Request.Config.Database.ProjectId, "experiment_id", p.Request.Experiment.Key)
+		}
+	}
+
+	// The studioml directories are used by the generated script, callers such as the benchmark
+	// and canary that run experiments directly will not have created them
+	if p.StudioDirs == nil {
+		if p.StudioDirs, err = runner.NewStudioDirs(p.RootDir, p.Request.Experiment.Key); err != nil {
+			return err
+		}
+	}
+
 	// Now we have the files locally stored we can begin the work
 	if err = p.Executor.Make(alloc, p); err != nil {
 		return err
@@ -897,7 +1202,7 @@ func (p *processor) run(ctx context.Context, alloc *runner.Allocated, accessionI
 
 	refresh := make(map[string]runner.Artifact, len(p.Request.Experiment.Artifacts))
 	for k, v := range p.Request.Experiment.Artifacts {
-		if v.Mutable {
+		if v.Mutable && !p.watchesCheckpoints(k) {
 			refresh[k] = v
 		}
 	}
@@ -967,10 +1272,18 @@ func (p *processor) deployAndRun(ctx context.Context, alloc *runner.Allocated, a
 		// We should always upload results even in the event of an error to
 		// help give the experimenter some clues as to what might have
 		// failed if there is a problem
-		p.returnAll(ctx, accessionID)
+		uploadCtx, span := trace.StartSpan(ctx, "artifact-upload")
+		_, errUpload := p.returnAll(uploadCtx, accessionID)
+		runner.EndSpan(span, errUpload)
+
+		// Results that could not be returned because this node ran out of disk are retried elsewhere
+		if err == nil && runner.IsOutOfDisk(errUpload) {
+			err = errUpload
+		}
 
 		if !*debugOpt {
 			defer os.RemoveAll(p.ExprDir)
+			p.StudioDirs.Remove()
 		}
 	}()
 
@@ -988,9 +1301,20 @@ func (p *processor) deployAndRun(ctx context.Context, alloc *runner.Allocated, a
 	//
 	outputFN := filepath.Join(p.ExprDir, "output", "output")
 
+	// The directories studioml uses are created here rather than by the experiment script
+	if p.StudioDirs, err = runner.NewStudioDirs(p.RootDir, p.Request.Experiment.Key); err != nil {
+		if errO := outputErr(outputFN, err); errO != nil {
+			warns = append(warns, errO)
+		}
+		return warns, err
+	}
+
 	// fetchAll when called will have access to the environment variables used by the experiment in order that
 	// credentials can be used
-	if err = p.fetchAll(ctx); err != nil {
+	fetchCtx, span := trace.StartSpan(ctx, "artifact-download")
+	err = p.fetchAll(fetchCtx)
+	runner.EndSpan(span, err)
+	if err != nil {
 		// A failure here should result in a warning being written to the processor
 		// output file in the hope that it will be returned.  Likewise further on down in
 		// this function
@@ -1001,6 +1325,14 @@ func (p *processor) deployAndRun(ctx context.Context, alloc *runner.Allocated, a
 		return warns, err
 	}
 
+	// Checkpoints from a previous run of the experiment are put back where it expects them
+	if err = p.restoreCheckpoints(); err != nil {
+		if errO := outputErr(outputFN, err); errO != nil {
+			warns = append(warns, errO)
+		}
+		return warns, err
+	}
+
 	// Blocking call to run the task
 	if err = p.run(ctx, alloc, accessionID); err != nil {
 		// TODO: We could push work back onto the queue at this point if needed
@@ -1010,5 +1342,12 @@ func (p *processor) deployAndRun(ctx context.Context, alloc *runner.Allocated, a
 		}
 		return warns, err
 	}
+
+	// Experiments that produced nothing are flagged, or failed, depending on the queue
+	if err = p.checkOutputs(); err != nil {
+		if errO := outputErr(outputFN, err); errO != nil {
+			warns = append(warns, errO)
+		}
+	}
 	return warns, err
 }
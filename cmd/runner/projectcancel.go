@@ -0,0 +1,213 @@
+package main
+
+// This file contains the implementation of the cancellation of all of the work for a project,
+// used when a project is decommissioned or a customer is offboarded.  Cancelling a project
+// stops its running experiments and pauses the node servicing the project, any of its requests
+// that are received are returned to their queue while the queues themselves, which can be
+// shared with other projects, continue to be serviced.  A project can be resumed to undo the
+// pause.
+//
+// Projects are identified by either the studioml project id found in requests, or the queue
+// project the runner retrieves work using, such as a PubSub project or rabbitMQ URL.  Single
+// queues can also be paused, they are identified using the queue project and the queue name
+// separated by a colon.
+
+import (
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	controlAPIOpt = flag.Bool("control-api", false, "enables the endpoints on the metrics server used to cancel, and resume, all of the work for a project")
+
+	projectPauses = newPausedProjects()
+)
+
+// pausedProjects tracks the projects this node is no longer servicing and the queues that
+// requests for each project have been seen on
+//
+type pausedProjects struct {
+	paused map[string]time.Time
+	queues map[string]map[string]struct{}
+	sync.Mutex
+}
+
+func newPausedProjects() (pp *pausedProjects) {
+	return &pausedProjects{
+		paused: map[string]time.Time{},
+		queues: map[string]map[string]struct{}{},
+	}
+}
+
+// seen records the queue that a request for a project arrived on
+//
+func (pp *pausedProjects) seen(project string, queue string) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if _, isPresent := pp.queues[project]; !isPresent {
+		pp.queues[project] = map[string]struct{}{}
+	}
+	pp.queues[project][queue] = struct{}{}
+}
+
+// isPaused tests if any of the supplied projects has been paused
+//
+func (pp *pausedProjects) isPaused(projects ...string) (paused bool) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	for _, project := range projects {
+		if _, isPresent := pp.paused[project]; isPresent {
+			return true
+		}
+	}
+	return false
+}
+
+// queuePaused tests if a queue, identified using its queue project and subscription, has
+// been paused or belongs to a paused queue project.  Queues that have carried requests for a
+// paused studioml project are not paused as other projects can share them.
+//
+func (pp *pausedProjects) queuePaused(project string, subscription string) (paused bool) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if _, isPresent := pp.paused[project]; isPresent {
+		return true
+	}
+	_, paused = pp.paused[project+":"+subscription]
+	return paused
+}
+
+// pause stops the node servicing a project and returns the queues known to carry its work,
+// requests for the project found on them are left for other nodes
+//
+func (pp *pausedProjects) pause(project string) (queues []string) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	if _, isPresent := pp.paused[project]; !isPresent {
+		pp.paused[project] = time.Now()
+	}
+	queues = []string{}
+	for queue := range pp.queues[project] {
+		queues = append(queues, queue)
+	}
+	sort.Strings(queues)
+	return queues
+}
+
+// resume allows the node to service a project again
+//
+func (pp *pausedProjects) resume(project string) (wasPaused bool) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	_, wasPaused = pp.paused[project]
+	delete(pp.paused, project)
+	return wasPaused
+}
+
+// pausedNames returns the projects, and queues, that have been paused
+//
+func (pp *pausedProjects) pausedNames() (names []string) {
+	pp.Lock()
+	defer pp.Unlock()
+
+	names = make([]string, 0, len(pp.paused))
+	for name := range pp.paused {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cancelProject stops the running experiments belonging to a studioml project and returns them
+//
+func (registry *experimentRegistry) cancelProject(project string) (cancelled []runningExperiment) {
+	now := time.Now()
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	cancelled = []runningExperiment{}
+	for exp := range registry.experiments {
+		if exp.Project != project {
+			continue
+		}
+		if exp.cancel != nil {
+			exp.cancel()
+		}
+		report := *exp
+		report.Elapsed = now.Sub(exp.StartedAt).Round(time.Second).String()
+		cancelled = append(cancelled, report)
+	}
+	sort.Slice(cancelled, func(i, j int) bool { return cancelled[i].StartedAt.Before(cancelled[j].StartedAt) })
+	return cancelled
+}
+
+// projectCancelStatus is the document returned by the project cancellation endpoint
+//
+type projectCancelStatus struct {
+	Host        string              `json:"host"`
+	Project     string              `json:"project"`
+	Experiments []runningExperiment `json:"experiments"`
+	Queues      []string            `json:"queues"`
+}
+
+// projectCancelHandler pauses the project named by the project query parameter and cancels
+// its running experiments
+//
+func projectCancelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "project cancellation must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	project := r.URL.Query().Get("project")
+	if len(project) == 0 {
+		http.Error(w, "the project query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// Pausing first prevents new work for the project starting while the running
+	// experiments are being cancelled
+	queues := projectPauses.pause(project)
+	cancelled := running.cancelProject(project)
+
+	logger.Warn("project cancelled", "project", project, "experiments", len(cancelled), "queues", len(queues))
+
+	writeJSON(w, projectCancelStatus{
+		Host:        host,
+		Project:     project,
+		Experiments: cancelled,
+		Queues:      queues,
+	})
+}
+
+// projectResumeHandler allows the node to service the project named by the project query
+// parameter again
+//
+func projectResumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "project resumption must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	project := r.URL.Query().Get("project")
+	if !projectPauses.resume(project) {
+		http.Error(w, "the project is not paused", http.StatusNotFound)
+		return
+	}
+
+	logger.Info("project resumed", "project", project)
+
+	writeJSON(w, projectCancelStatus{
+		Host:        host,
+		Project:     project,
+		Experiments: []runningExperiment{},
+		Queues:      []string{},
+	})
+}
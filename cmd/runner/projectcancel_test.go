@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestProjectCancel checks that cancelling a project stops only its running experiments, leaves
+// the queues that carried its work being serviced, and that resuming the project clears the pause
+//
+func TestProjectCancel(t *testing.T) {
+
+	savedRunning, savedPauses := running, projectPauses
+	defer func() { running, projectPauses = savedRunning, savedPauses }()
+
+	running = newExperimentRegistry()
+	projectPauses = newPausedProjects()
+
+	offboardCtx, offboardCancel := context.WithCancel(context.Background())
+	otherCtx, otherCancel := context.WithCancel(context.Background())
+	defer otherCancel()
+
+	projectPauses.seen("offboard", "rmq:queue_a")
+	projectPauses.seen("other", "rmq:queue_b")
+
+	running.addCancellable("exp-1", "offboard", "queue_a", time.Now(), offboardCancel)
+	running.addCancellable("exp-2", "other", "queue_b", time.Now(), otherCancel)
+
+	// An experiment for another project whose queue subscription shares the name of the project
+	// being cancelled
+	sharedCtx, sharedCancel := context.WithCancel(context.Background())
+	defer sharedCancel()
+	running.addCancellable("exp-3", "other", "offboard", time.Now(), sharedCancel)
+
+	recorder := httptest.NewRecorder()
+	projectCancelHandler(recorder, httptest.NewRequest(http.MethodPost, "/projects/cancel?project=offboard", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("project cancel failed with status %d", recorder.Code)
+	}
+
+	status := projectCancelStatus{}
+	if errGo := json.Unmarshal(recorder.Body.Bytes(), &status); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if len(status.Experiments) != 1 || status.Experiments[0].Key != "exp-1" {
+		t.Fatalf("unexpected experiments cancelled %+v", status.Experiments)
+	}
+	if len(status.Queues) != 1 || status.Queues[0] != "rmq:queue_a" {
+		t.Fatalf("unexpected queues paused %+v", status.Queues)
+	}
+
+	if offboardCtx.Err() == nil {
+		t.Fatal("experiment for the cancelled project was left running")
+	}
+	if otherCtx.Err() != nil || sharedCtx.Err() != nil {
+		t.Fatal("experiment for another project was cancelled")
+	}
+
+	if projectPauses.queuePaused("rmq", "queue_a") {
+		t.Fatal("queue shared with other projects was paused")
+	}
+	if !projectPauses.isPaused("offboard") {
+		t.Fatal("cancelled project was not paused")
+	}
+
+	recorder = httptest.NewRecorder()
+	projectResumeHandler(recorder, httptest.NewRequest(http.MethodPost, "/projects/resume?project=offboard", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("project resume failed with status %d", recorder.Code)
+	}
+	if projectPauses.isPaused("offboard") {
+		t.Fatal("project still paused after being resumed")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+// This file contains the implementation of the experiment quarantine.  Operators can list the
+// keys of experiments that are known to be harmful, for example experiments that crash
+// nodes or trigger driver faults, in a file that every runner in a fleet reads.  Experiments
+// matching the list are dead-lettered as soon as they are seen rather than being run.
+//
+// The file is read again whenever it changes so that it can be kept on a shared mount, or
+// distributed using a config map, and updated without restarting the runners.
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	quarantineOpt = flag.String("quarantine-file", "", "the location of a file listing experiments that are dead-lettered without being run, one glob pattern per line matched against the experiment key, or against project/key when it contains a /, text following a # is used as the reason")
+
+	quarantine = quarantineList{}
+)
+
+// quarantineEntry is a single pattern from the quarantine file along with the reason given
+// for it
+//
+type quarantineEntry struct {
+	pattern string
+	reason  string
+}
+
+// quarantineList holds the entries from the last version of the quarantine file that was read
+//
+type quarantineList struct {
+	entries  []quarantineEntry
+	modified time.Time
+	size     int64
+	failed   string // The reason the file could not be used, only reported again once it changes
+	sync.Mutex
+}
+
+// parseQuarantine extracts the entries from the contents of a quarantine file
+//
+func parseQuarantine(data []byte) (entries []quarantineEntry, err errors.Error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := quarantineEntry{}
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			entry.reason = strings.TrimSpace(text[i+1:])
+			text = text[:i]
+		}
+		if entry.pattern = strings.TrimSpace(text); len(entry.pattern) == 0 {
+			continue
+		}
+		if _, errGo := path.Match(entry.pattern, ""); errGo != nil {
+			return nil, errors.Wrap(errGo, "quarantine contains an invalid pattern").With("pattern", entry.pattern, "line", line).With("stack", stack.Trace().TrimRuntime())
+		}
+		entries = append(entries, entry)
+	}
+	if errGo := scanner.Err(); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return entries, nil
+}
+
+// refresh reads the quarantine file if it has changed since it was last read, a file that
+// cannot be read leaves the previous entries in place.  A file that cannot be used is only
+// reported the first time it is seen rather than for every experiment
+//
+func (q *quarantineList) refresh() (err errors.Error) {
+	if len(*quarantineOpt) == 0 {
+		return nil
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	info, errGo := os.Stat(*quarantineOpt)
+	if errGo != nil {
+		return q.fail(errors.Wrap(errGo).With("file", *quarantineOpt).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Once the file can be seen again later failures are reported, an unchanged file that
+	// could not be used is not read again
+	q.failed = ""
+
+	if info.ModTime().Equal(q.modified) && info.Size() == q.size {
+		return nil
+	}
+
+	data, errGo := ioutil.ReadFile(*quarantineOpt)
+	if errGo != nil {
+		return q.fail(errors.Wrap(errGo).With("file", *quarantineOpt).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// Invalid contents are remembered by the version of the file so that they are not parsed
+	// and reported again until the file is changed
+	q.modified = info.ModTime()
+	q.size = info.Size()
+
+	entries, err := parseQuarantine(data)
+	if err != nil {
+		return q.fail(err.With("file", *quarantineOpt))
+	}
+
+	q.entries = entries
+
+	logger.Info("quarantine loaded", "file", *quarantineOpt, "entries", len(entries))
+	return nil
+}
+
+// fail records the reason the quarantine file could not be used and returns it, unless the
+// same reason was the last to be returned
+//
+func (q *quarantineList) fail(err errors.Error) (reported errors.Error) {
+	reason := err.Error()
+	if reason == q.failed {
+		return nil
+	}
+	q.failed = reason
+	return err
+}
+
+// match returns the entry matching an experiment, patterns containing a / are matched
+// against the project and key of the experiment
+//
+func (q *quarantineList) match(project string, key string) (entry *quarantineEntry) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, candidate := range q.entries {
+		name := key
+		if strings.Contains(candidate.pattern, "/") {
+			name = project + "/" + key
+		}
+		if matched, _ := path.Match(candidate.pattern, name); matched {
+			return &q.entries[i]
+		}
+	}
+	return nil
+}
+
+// quarantined returns an error describing why an experiment is quarantined, or nil if the
+// experiment can be run
+//
+func quarantined(rqst *runner.Request) (err errors.Error) {
+	if len(*quarantineOpt) == 0 {
+		return nil
+	}
+	if err = quarantine.refresh(); err != nil {
+		logger.Warn("quarantine could not be refreshed", "error", err.Error())
+	}
+
+	project := rqst.Config.Database.ProjectId
+	if len(project) == 0 {
+		if name, isString := rqst.Experiment.Project.(string); isString {
+			project = name
+		}
+	}
+
+	entry := quarantine.match(project, rqst.Experiment.Key)
+	if entry == nil {
+		return nil
+	}
+	return errors.New("quarantined").With("pattern", entry.pattern, "reason", entry.reason, "project", project, "experiment_id", rqst.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+}
+
+// validateQuarantine checks that the quarantine file, if one was specified, can be used
+//
+func validateQuarantine() (err errors.Error) {
+	return quarantine.refresh()
+}
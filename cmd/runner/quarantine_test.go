@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestQuarantine checks that experiments are matched against the quarantine file using their
+// keys, or their projects and keys, and that changes to the file are picked up
+//
+func TestQuarantine(t *testing.T) {
+
+	qFile, errGo := ioutil.TempFile("", "quarantine")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Remove(qFile.Name())
+
+	list := `
+# Experiments crashing the nvidia driver
+1588000000_abcdef   # driver fault
+batch-17-*
+vision/*            # project leaking file handles
+`
+	if _, errGo = qFile.WriteString(list); errGo != nil {
+		t.Fatal(errGo)
+	}
+	qFile.Close()
+
+	saved := *quarantineOpt
+	*quarantineOpt = qFile.Name()
+	defer func() {
+		*quarantineOpt = saved
+		quarantine.Lock()
+		quarantine.entries = nil
+		quarantine.modified = time.Time{}
+		quarantine.size = 0
+		quarantine.failed = ""
+		quarantine.Unlock()
+	}()
+
+	if err := validateQuarantine(); err != nil {
+		t.Fatal(err)
+	}
+
+	rqst := func(project string, key string) (r *runner.Request) {
+		r = &runner.Request{}
+		r.Config.Database.ProjectId = project
+		r.Experiment.Key = key
+		return r
+	}
+
+	for _, tc := range []struct {
+		project string
+		key     string
+		reason  string
+		matched bool
+	}{
+		{project: "nlp", key: "1588000000_abcdef", reason: "driver fault", matched: true},
+		{project: "nlp", key: "1588000000_abcdeg", matched: false},
+		{project: "nlp", key: "batch-17-0001", matched: true},
+		{project: "nlp", key: "batch-18-0001", matched: false},
+		{project: "vision", key: "1588000001_000000", reason: "project leaking file handles", matched: true},
+	} {
+		err := quarantined(rqst(tc.project, tc.key))
+		if (err != nil) != tc.matched {
+			t.Fatalf("experiment %s/%s quarantined %v, expected %v", tc.project, tc.key, err != nil, tc.matched)
+		}
+		if err == nil || len(tc.reason) == 0 {
+			continue
+		}
+		if entry := quarantine.match(tc.project, tc.key); entry == nil || entry.reason != tc.reason {
+			t.Fatalf("experiment %s/%s quarantined with reason %v, expected %s", tc.project, tc.key, entry, tc.reason)
+		}
+	}
+
+	// Lifting the quarantine is seen without a restart
+	if errGo = ioutil.WriteFile(qFile.Name(), []byte("vision/*\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if err := quarantined(rqst("nlp", "batch-17-0001")); err != nil {
+		t.Fatalf("experiment remained quarantined after the file changed %v", err)
+	}
+
+	// Invalid patterns are rejected and the previous entries kept
+	if errGo = ioutil.WriteFile(qFile.Name(), []byte("vision/[\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if err := validateQuarantine(); err == nil {
+		t.Fatal("invalid quarantine pattern was accepted")
+	}
+	if err := quarantined(rqst("vision", "1588000001_000000")); err == nil {
+		t.Fatal("quarantine entries were lost after an invalid update")
+	}
+
+	// An invalid file is only reported once until it is changed again
+	if err := quarantine.refresh(); err != nil {
+		t.Fatalf("unchanged invalid quarantine was reported again %v", err)
+	}
+	if errGo = ioutil.WriteFile(qFile.Name(), []byte("vision/[\nnlp/[\n"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if err := quarantine.refresh(); err == nil {
+		t.Fatal("changed invalid quarantine was not reported")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+// This file contains the implementation of per queue configuration.  Operators can supply
+// a JSON file containing a list of entries, each of which has a regular expression
+// that is matched against queue names to select the settings for that queue.  The
+// first matching entry is used.
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	queueCfgOpt           = flag.String("queue-config", "", "the location of a JSON file containing a list of per queue settings, each with a 'match' regular expression for queue names")
+	queueCheckIntervalOpt = flag.Duration("queue-check-interval", 0, "the minimum period of time between checks of a single queue for work, 0 checks queues on every pass")
+	queueProcessingOpt    = flag.Duration("queue-processing-timeout", 0, "the maximum period of time a single message can be processed for before its experiment is stopped and dumped, regardless of the duration the experiment asks for, 0 has no limit")
+
+	queueCfgs = queueSettings{}
+)
+
+// queueConfig is the form in which per queue settings are supplied by operators
+//
+type queueConfig struct {
+	Match      string   `json:"match"`
+	StderrFail []string `json:"stderr_fail"` // Regular expressions that if seen on stderr fail the experiment
+
+	// The resources experiments on the queue are expected to need, used for capacity checks until
+	// the actual needs are learnt from a request
+	Resources *runner.Resource `json:"resources,omitempty"`
+
+	// The minimum period of time between checks of the queue for work, overriding the
+	// queue-check-interval option
+	CheckInterval string `json:"check_interval,omitempty"`
+
+	// The maximum period of time a message from the queue can be processed for, overriding the
+	// queue-processing-timeout option
+	ProcessingTimeout string `json:"processing_timeout,omitempty"`
+
+	// The license pool experiments from the queue lease a token from before being started,
+	// overriding the license-pool option
+	License string `json:"license,omitempty"`
+
+	// The names of the transforms applied in order to messages from the queue to extract the
+	// request from the envelope it arrives in, for example sns
+	Transforms []string `json:"transforms,omitempty"`
+
+	// The handling of experiments from the queue that produce no output artifacts, overriding
+	// the no-outputs option
+	NoOutputs *string `json:"no_outputs,omitempty"`
+}
+
+// queueSetting is the validated form of a queueConfig
+//
+type queueSetting struct {
+	match             *regexp.Regexp
+	cfg               queueConfig
+	stderr            *runner.StderrPolicy
+	checkInterval     *time.Duration
+	processingTimeout *time.Duration
+}
+
+type queueSettings struct {
+	settings []*queueSetting
+	sync.Mutex
+}
+
+// loadQueueConfig will read and validate the per queue settings file if one was specified
+//
+func loadQueueConfig() (err errors.Error) {
+	if len(*queueCfgOpt) == 0 {
+		return nil
+	}
+
+	data, errGo := ioutil.ReadFile(*queueCfgOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", *queueCfgOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	cfgs := []queueConfig{}
+	if errGo = json.Unmarshal(data, &cfgs); errGo != nil {
+		return errors.Wrap(errGo).With("file", *queueCfgOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	settings := make([]*queueSetting, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		match, errGo := regexp.Compile(cfg.Match)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("file", *queueCfgOpt, "match", cfg.Match).With("stack", stack.Trace().TrimRuntime())
+		}
+		setting := &queueSetting{
+			match: match,
+			cfg:   cfg,
+		}
+		if len(cfg.StderrFail) != 0 {
+			if setting.stderr, err = runner.NewStderrPolicy(cfg.StderrFail); err != nil {
+				return err.With("file", *queueCfgOpt, "match", cfg.Match)
+			}
+		}
+		if rsc := cfg.Resources; rsc != nil {
+			for name, size := range map[string]string{"ram": rsc.Ram, "hdd": rsc.Hdd, "gpuMem": rsc.GpuMem} {
+				if len(size) == 0 {
+					continue
+				}
+				if _, errGo := humanize.ParseBytes(size); errGo != nil {
+					return errors.Wrap(errGo, "resources "+name+" is invalid").With("file", *queueCfgOpt, "match", cfg.Match, name, size).With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+		}
+		if setting.checkInterval, err = parseQueueDuration("check_interval", cfg.CheckInterval); err != nil {
+			return err.With("file", *queueCfgOpt, "match", cfg.Match)
+		}
+		if setting.processingTimeout, err = parseQueueDuration("processing_timeout", cfg.ProcessingTimeout); err != nil {
+			return err.With("file", *queueCfgOpt, "match", cfg.Match)
+		}
+		if err = runner.ValidateTransforms(cfg.Transforms); err != nil {
+			return err.With("file", *queueCfgOpt, "match", cfg.Match)
+		}
+		if cfg.NoOutputs != nil {
+			if err = validateNoOutputs(*cfg.NoOutputs); err != nil {
+				return err.With("file", *queueCfgOpt, "match", cfg.Match)
+			}
+		}
+		settings = append(settings, setting)
+	}
+
+	queueCfgs.Lock()
+	queueCfgs.settings = settings
+	queueCfgs.Unlock()
+
+	return nil
+}
+
+// parseQueueDuration validates an optional duration from the per queue settings, nil is returned
+// when the duration was not supplied
+//
+func parseQueueDuration(name string, value string) (duration *time.Duration, err errors.Error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	parsed, errGo := time.ParseDuration(value)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, name+" is invalid").With(name, value).With("stack", stack.Trace().TrimRuntime())
+	}
+	if parsed < 0 {
+		return nil, errors.New(name+" must not be negative").With(name, value).With("stack", stack.Trace().TrimRuntime())
+	}
+	return &parsed, nil
+}
+
+// lookup returns the settings for the first entry matching the queue name, or nil if there
+// are none
+//
+func (qs *queueSettings) lookup(queue string) (setting *queueSetting) {
+	qs.Lock()
+	defer qs.Unlock()
+
+	for _, setting := range qs.settings {
+		if setting.match.MatchString(queue) {
+			return setting
+		}
+	}
+	return nil
+}
+
+// stderrPolicy returns the policy used to judge experiments using their stderr output
+// for the named queue
+//
+func (qs *queueSettings) stderrPolicy(queue string) (policy *runner.StderrPolicy) {
+	if setting := qs.lookup(queue); setting != nil {
+		return setting.stderr
+	}
+	return nil
+}
+
+// defaultResources returns a copy of the resources experiments on the named queue are
+// expected to need, or nil if none were configured
+//
+func (qs *queueSettings) defaultResources(queue string) (rsc *runner.Resource) {
+	if setting := qs.lookup(queue); setting != nil {
+		return setting.cfg.Resources.Clone()
+	}
+	return nil
+}
+
+// checkInterval returns the minimum period of time between checks of the named queue for work
+//
+func (qs *queueSettings) checkInterval(queue string) (interval time.Duration) {
+	if setting := qs.lookup(queue); setting != nil && setting.checkInterval != nil {
+		return *setting.checkInterval
+	}
+	return *queueCheckIntervalOpt
+}
+
+// processingTimeout returns the maximum period of time a message from the named queue can be
+// processed for, 0 when there is no limit
+//
+func (qs *queueSettings) processingTimeout(queue string) (timeout time.Duration) {
+	if setting := qs.lookup(queue); setting != nil && setting.processingTimeout != nil {
+		return *setting.processingTimeout
+	}
+	return *queueProcessingOpt
+}
+
+// licensePool returns the license pool experiments from the named queue lease tokens from,
+// empty when they need no token
+//
+func (qs *queueSettings) licensePool(queue string) (pool string) {
+	if setting := qs.lookup(queue); setting != nil && len(setting.cfg.License) != 0 {
+		return setting.cfg.License
+	}
+	return *licensePoolOpt
+}
+
+// transforms returns the names of the transforms applied to messages from the named queue
+//
+func (qs *queueSettings) transforms(queue string) (names []string) {
+	if setting := qs.lookup(queue); setting != nil {
+		return setting.cfg.Transforms
+	}
+	return nil
+}
+
+// noOutputs returns the handling of experiments from the named queue that produce no output
+// artifacts
+//
+func (qs *queueSettings) noOutputs(queue string) (policy string) {
+	if setting := qs.lookup(queue); setting != nil && setting.cfg.NoOutputs != nil {
+		return *setting.cfg.NoOutputs
+	}
+	return *noOutputsOpt
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestQueueDefaultResources checks that queues with configured resources have them in place
+// before any requests are seen, and that they are replaced by the resources learnt from requests
+//
+func TestQueueDefaultResources(t *testing.T) {
+
+	cfgFile, errGo := ioutil.TempFile("", "queue-config")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Remove(cfgFile.Name())
+
+	cfg := `[{"match": "^rmq_gpu_.*$", "resources": {"cpus": 4, "gpus": 1, "ram": "16gb", "hdd": "10gb", "gpuMem": "8gb"}}]`
+	if _, errGo = cfgFile.WriteString(cfg); errGo != nil {
+		t.Fatal(errGo)
+	}
+	cfgFile.Close()
+
+	saved := *queueCfgOpt
+	*queueCfgOpt = cfgFile.Name()
+	defer func() {
+		*queueCfgOpt = saved
+		queueCfgs.Lock()
+		queueCfgs.settings = nil
+		queueCfgs.Unlock()
+	}()
+
+	if err := loadQueueConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	subs := &Subscriptions{subs: map[string]*Subscription{}}
+	subs.align(map[string]interface{}{"rmq_gpu_train": nil, "rmq_cpu_eval": nil})
+
+	if rsc := subs.subs["rmq_gpu_train"].rsc; rsc == nil || rsc.Gpus != 1 || rsc.Ram != "16gb" {
+		t.Fatalf("configured resources not used for the queue %v", rsc)
+	}
+	if rsc := subs.subs["rmq_cpu_eval"].rsc; rsc != nil {
+		t.Fatalf("resources used for a queue without configured resources %v", rsc)
+	}
+
+	learnt := &runner.Resource{Cpus: 2, Gpus: 2, Ram: "32gb", Hdd: "10gb", GpuMem: "8gb"}
+	if err := subs.setResources("rmq_gpu_train", learnt); err != nil {
+		t.Fatal(err)
+	}
+	if rsc := subs.subs["rmq_gpu_train"].rsc; rsc.Gpus != 2 || rsc.Ram != "32gb" {
+		t.Fatalf("learnt resources did not replace the configured resources %v", rsc)
+	}
+}
+
+// TestQueueCheckInterval checks that queues use the check interval from their settings, falling
+// back to the runner option, and that invalid intervals are rejected
+//
+func TestQueueCheckInterval(t *testing.T) {
+
+	cfgFile, errGo := ioutil.TempFile("", "queue-config")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Remove(cfgFile.Name())
+
+	saved := *queueCfgOpt
+	savedInterval := *queueCheckIntervalOpt
+	*queueCfgOpt = cfgFile.Name()
+	*queueCheckIntervalOpt = 20 * time.Second
+	defer func() {
+		*queueCfgOpt = saved
+		*queueCheckIntervalOpt = savedInterval
+		queueCfgs.Lock()
+		queueCfgs.settings = nil
+		queueCfgs.Unlock()
+	}()
+
+	write := func(cfg string) {
+		if errGo := ioutil.WriteFile(cfgFile.Name(), []byte(cfg), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	write(`[{"match": "^rmq_batch_.*$", "check_interval": "2m"}, {"match": "^rmq_fast_.*$", "check_interval": "0s"}]`)
+	if err := loadQueueConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for queue, expected := range map[string]time.Duration{
+		"rmq_batch_nightly": 2 * time.Minute,
+		"rmq_fast_eval":     0,
+		"rmq_other":         20 * time.Second,
+	} {
+		if interval := queueCfgs.checkInterval(queue); interval != expected {
+			t.Fatalf("unexpected check interval %v for %s, expected %v", interval, queue, expected)
+		}
+	}
+
+	for _, cfg := range []string{`[{"match": ".*", "check_interval": "often"}]`, `[{"match": ".*", "check_interval": "-1m"}]`} {
+		write(cfg)
+		if err := loadQueueConfig(); err == nil {
+			t.Fatalf("invalid check interval accepted %s", cfg)
+		}
+	}
+}
+
+// TestQueueProcessingTimeout checks that queues use the processing timeout from their settings,
+// falling back to the runner option, and that the ceiling cancels experiments that exceed it
+//
+func TestQueueProcessingTimeout(t *testing.T) {
+
+	cfgFile, errGo := ioutil.TempFile("", "queue-config")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Remove(cfgFile.Name())
+
+	saved := *queueCfgOpt
+	savedTimeout := *queueProcessingOpt
+	*queueCfgOpt = cfgFile.Name()
+	*queueProcessingOpt = time.Hour
+	defer func() {
+		*queueCfgOpt = saved
+		*queueProcessingOpt = savedTimeout
+		queueCfgs.Lock()
+		queueCfgs.settings = nil
+		queueCfgs.Unlock()
+	}()
+
+	write := func(cfg string) {
+		if errGo := ioutil.WriteFile(cfgFile.Name(), []byte(cfg), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	write(`[{"match": "^rmq_short_.*$", "processing_timeout": "50ms"}, {"match": "^rmq_open_.*$", "processing_timeout": "0s"}]`)
+	if err := loadQueueConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for queue, expected := range map[string]time.Duration{
+		"rmq_short_eval": 50 * time.Millisecond,
+		"rmq_open_train": 0,
+		"rmq_other":      time.Hour,
+	} {
+		if timeout := queueCfgs.processingTimeout(queue); timeout != expected {
+			t.Fatalf("unexpected processing timeout %v for %s, expected %v", timeout, queue, expected)
+		}
+	}
+
+	rqst := &runner.Request{}
+	rqst.Experiment.Key = "ceiling"
+	rqst.Experiment.MaxDuration = "20h"
+
+	// Queues without a timeout do not limit experiments
+	if ceiling := startCeiling("rmq_open_train", rqst, func() {}); ceiling != nil {
+		t.Fatal("ceiling started for a queue without a processing timeout")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ceiling := startCeiling("rmq_short_eval", rqst, cancel)
+	defer ceiling.stop()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("experiment not cancelled by the queue processing timeout")
+	}
+	if !ceiling.wasExceeded() {
+		t.Fatal("queue processing timeout not reported as exceeded")
+	}
+
+	// Experiments that finish within the timeout are left alone
+	ceiling = startCeiling("rmq_other", rqst, func() { t.Fatal("experiment cancelled within the processing timeout") })
+	ceiling.stop()
+	if ceiling.wasExceeded() {
+		t.Fatal("queue processing timeout reported as exceeded after being stopped")
+	}
+
+	for _, cfg := range []string{`[{"match": ".*", "processing_timeout": "forever"}]`, `[{"match": ".*", "processing_timeout": "-1h"}]`} {
+		write(cfg)
+		if err := loadQueueConfig(); err == nil {
+			t.Fatalf("invalid processing timeout accepted %s", cfg)
+		}
+	}
+}
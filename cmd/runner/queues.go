@@ -9,9 +9,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"math/rand"
-	"regexp"
 	"runtime/debug"
 	"sort"
 	"strings"
@@ -24,6 +24,8 @@ import (
 	"github.com/dustin/go-humanize" // MIT License
 	uberatomic "go.uber.org/atomic" // MIT License
 
+	"go.opencensus.io/trace"
+
 	"github.com/karlmutch/go-cache"
 
 	"github.com/go-stack/stack"
@@ -46,10 +48,28 @@ var (
 	//
 	backoffs = cache.New(10*time.Second, time.Minute)
 
+	// throttles are a set of subscriptions to queues that have been checked for work recently
+	// and that will not be checked again until their entries expire, this limits the rate at
+	// which queues that are being drained successfully are polled.  Unlike backoffs these
+	// entries are not cleared by events on the queue.
+	//
+	throttles = cache.New(10*time.Second, time.Minute)
+
+	// nodeBackoff is the key within backoffs used to stop work being retrieved from all queues,
+	// for example when this node has run out of disk
+	nodeBackoff = ":node"
+
 	// busyQs is used to indicate when a worker is active for a named project:subscription so
 	// that only one worker is activate at a time
 	//
-	busyQs = SubsBusy{subs: map[string]bool{}}
+	busyQs = SubsBusy{subs: map[string]*busyLease{}}
+
+	// machineRsc holds the most recent probe of the machines free resources, probing
+	// the hardware can be expensive so the probe is reused until it becomes stale
+	//
+	machineRsc = &machineProbe{}
+
+	machineRscTTLOpt = flag.Duration("resource-probe-ttl", 2*time.Second, "the maximum age of a probe of the machines free resources before the machine is probed again")
 
 	refreshSuccesses = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -114,10 +134,32 @@ func init() {
 //
 type Projects struct {
 	queueType string
-	projects  map[string]context.CancelFunc
+	projects  map[string]context.CancelFunc // Stops a project and cancels the experiments it is running
+	stops     map[string]context.CancelFunc // Stops a project taking new work while its running experiments complete
+	creds     map[string]string             // The credentials each running project was started with
+	runs      map[string]uint64             // Identifies each start of a running project
+	draining  map[uint64]context.CancelFunc // Projects that were stopped and are waiting for their experiments to complete
+	lastRun   uint64
 	sync.Mutex
 }
 
+// stopAll is used when the runner is shutting down to stop all projects, including those
+// waiting for their running experiments to complete
+//
+func (live *Projects) stopAll() {
+	live.Lock()
+	defer live.Unlock()
+
+	for _, quiter := range live.projects {
+		if quiter != nil {
+			quiter()
+		}
+	}
+	for _, quiter := range live.draining {
+		quiter()
+	}
+}
+
 func (*Projects) startStateWatcher(ctx context.Context) (err errors.Error) {
 	lifecycleC := make(chan runner.K8sStateUpdate, 1)
 	id, err := k8sStateUpdates().Add(lifecycleC)
@@ -144,6 +186,15 @@ func (*Projects) startStateWatcher(ctx context.Context) (err errors.Error) {
 	return err
 }
 
+// forget removes a project from the running set of projects, the caller holds the lock
+//
+func (live *Projects) forget(proj string) {
+	delete(live.projects, proj)
+	delete(live.stops, proj)
+	delete(live.creds, proj)
+	delete(live.runs, proj)
+}
+
 // Lifecycle is used to run a single pass across all of the found queues and subscriptions
 // quering for work and any needed updates to the list of queues found within the various queue
 // servers that are configured
@@ -171,13 +222,35 @@ func (live *Projects) Lifecycle(ctx context.Context, found map[string]string) (e
 	}
 
 	// If projects have disappeared from the credentials then kill them from the
-	// running set of projects if they are still running
+	// running set of projects if they are still running, projects whose credentials
+	// have changed stop taking new work, and are started again using the new ones, while
+	// the experiments they are running complete
 	live.Lock()
+	if live.creds == nil {
+		live.creds = map[string]string{}
+	}
+	if live.stops == nil {
+		live.stops = map[string]context.CancelFunc{}
+		live.runs = map[string]uint64{}
+		live.draining = map[uint64]context.CancelFunc{}
+	}
 	for proj, quiter := range live.projects {
-		if _, isPresent := found[proj]; !isPresent {
+		cred, isPresent := found[proj]
+		if !isPresent {
 			quiter()
-			delete(live.projects, proj)
+			live.forget(proj)
 			logger.Info(proj+" no longer available", "stack", stack.Trace().TrimRuntime())
+			continue
+		}
+		if started, isKnown := live.creds[proj]; isKnown && started != cred {
+			if stop, isPresent := live.stops[proj]; isPresent {
+				stop()
+				live.draining[live.runs[proj]] = quiter
+			} else {
+				quiter()
+			}
+			live.forget(proj)
+			logger.Info(proj+" credentials changed, completing running experiments", "stack", stack.Trace().TrimRuntime())
 		}
 	}
 	live.Unlock()
@@ -198,23 +271,40 @@ func (live *Projects) Lifecycle(ctx context.Context, found map[string]string) (e
 				live.Unlock()
 				continue
 			}
+			// The work context is used by running experiments, the project stops taking new
+			// work when its poll context is cancelled
 			ctx, cancel := context.WithCancel(context.Background())
+			pollCtx, stop := context.WithCancel(ctx)
+			live.lastRun++
+			run := live.lastRun
 			live.projects[proj] = cancel
+			live.stops[proj] = stop
+			live.creds[proj] = cred
+			live.runs[proj] = run
 
 			// Start the projects runner and let it go off and do its thing until it dies
 			// for no longer has a matching credentials file
-			go func(ctx context.Context, proj string) {
+			go func(ctx context.Context, pollCtx context.Context, cancel context.CancelFunc, proj string, run uint64) {
+				defer cancel()
+
 				logger.Debug("queue runner processing", "project_id", proj,
 					"stack", stack.Trace().TrimRuntime())
 
-				if err := qr.run(ctx, 5*time.Minute); err != nil {
+				removeQueuer := queuers.add(qr)
+				if err := qr.run(pollCtx, ctx, 5*time.Minute); err != nil {
 					logger.Warn("queue runner failed", "project", proj, "error", err)
 				}
+				removeQueuer()
 
+				// Projects that were stopped have already been removed, and might have been
+				// started again using new credentials
 				live.Lock()
-				delete(live.projects, proj)
+				if live.runs[proj] == run {
+					live.forget(proj)
+				}
+				delete(live.draining, run)
 				live.Unlock()
-			}(ctx, proj)
+			}(ctx, pollCtx, cancel, proj, run)
 		}
 		live.Unlock()
 	}
@@ -225,7 +315,7 @@ func (live *Projects) Lifecycle(ctx context.Context, found map[string]string) (e
 // SubsBusy is used to track subscriptions and queues that are currently being actively serviced
 // by this runner
 type SubsBusy struct {
-	subs map[string]bool // The catalog of all known queues (subscriptions) within the project this server is handling
+	subs map[string]*busyLease // The catalog of all known queues (subscriptions) within the project this server is handling
 	sync.Mutex
 }
 
@@ -237,6 +327,8 @@ type Subscription struct {
 	name string           // The subscription name that represents a queue of potential for our purposes
 	rsc  *runner.Resource // If known the resources that experiments asked for in this subscription
 	cnt  uint             // The number of instances that are running for this queue
+
+	durations []time.Duration // The durations of recently completed work from this queue
 }
 
 // Subscriptions stores the known activate queues/subscriptions that this runner has observed
@@ -254,6 +346,8 @@ type Queuer struct {
 	subs    Subscriptions // The subscriptions that exist within this project
 	timeout time.Duration // The queue query timeout
 	tasker  runner.TaskQueue
+
+	inflight sync.WaitGroup // Tracks the queue checks, and the work they started, that have not completed
 }
 
 // SubRequest encapsulates the simple access details for a subscription.  This structure
@@ -290,14 +384,20 @@ func (qr *Queuer) refresh() (err errors.Error) {
 	ctx, cancel := context.WithTimeout(context.Background(), qr.timeout)
 	defer cancel()
 
-	matcher, _ := regexp.Compile(*queueMatch)
-	known, err := qr.tasker.Refresh(ctx, matcher)
+	known, err := qr.tasker.Refresh(ctx, queueMatcher())
+	backends.record(qr.project, !backendFailure(err))
 	if err != nil {
 		refreshFailures.With(prometheus.Labels{"host": host, "project": qr.project}).Inc()
 		return err
 	}
 	refreshSuccesses.With(prometheus.Labels{"host": host, "project": qr.project}).Inc()
 
+	for queue := range known {
+		if queueExcluded(queue) {
+			delete(known, queue)
+		}
+	}
+
 	// Bring the queues collection uptodate with what the system has in terms
 	// of functioning queues
 	//
@@ -325,7 +425,9 @@ func (subs *Subscriptions) align(expected map[string]interface{}) (added []strin
 	for sub := range expected {
 		if _, isPresent := subs.subs[sub]; !isPresent {
 
-			subs.subs[sub] = &Subscription{name: sub}
+			// Queues with configured resources can be checked for fit before any of their
+			// requests have been seen
+			subs.subs[sub] = &Subscription{name: sub, rsc: queueCfgs.defaultResources(sub)}
 			added = append(added, sub)
 		}
 	}
@@ -341,8 +443,37 @@ func (subs *Subscriptions) align(expected map[string]interface{}) (added []strin
 	return added, removed
 }
 
+// Snapshot returns a copy of the subscriptions catalog that can be used for reporting
+// and ranking without holding the lock or sharing the resource specifications
+// with the catalog
+//
+func (subs *Subscriptions) Snapshot() (snap []Subscription) {
+	subs.Lock()
+	defer subs.Unlock()
+
+	snap = make([]Subscription, 0, len(subs.subs))
+	for _, sub := range subs.subs {
+		copied := Subscription{
+			name: sub.name,
+			cnt:  sub.cnt,
+
+			durations: append([]time.Duration{}, sub.durations...),
+		}
+		// Queues whose resources are not yet known have none to copy, Clone cannot encode them
+		if sub.rsc != nil {
+			copied.rsc = sub.rsc.Clone()
+		}
+		snap = append(snap, copied)
+	}
+
+	sort.Slice(snap, func(i, j int) bool { return snap[i].name < snap[j].name })
+
+	return snap
+}
+
 // setResources is used to update the resources a queue will generally need for
-// its individual work items
+// its individual work items, the resources learnt from requests replace any defaults
+// configured for the queue
 //
 func (subs *Subscriptions) setResources(name string, rsc *runner.Resource) (err errors.Error) {
 	if rsc == nil {
@@ -365,7 +496,7 @@ func (subs *Subscriptions) setResources(name string, rsc *runner.Resource) (err
 // producer is used to examine the subscriptions that are available and determine if
 // capacity is available to service any of the work that might be waiting
 //
-func (qr *Queuer) producer(ctx context.Context, rqst chan *SubRequest) {
+func (qr *Queuer) producer(ctx context.Context, rqst *dispatcher) {
 
 	logger.Trace("started queue producer")
 	defer logger.Trace("stopped queue producer")
@@ -376,9 +507,6 @@ func (qr *Queuer) producer(ctx context.Context, rqst chan *SubRequest) {
 	nextQDbg := time.Now()
 	lastQs := 0
 
-	lastReady := time.Now()
-	lastReadyAbs := time.Now()
-
 	for {
 		select {
 		case <-check.C:
@@ -408,6 +536,13 @@ func (qr *Queuer) producer(ctx context.Context, rqst chan *SubRequest) {
 				}
 			}
 
+			// Projects that have consumed more than their share of the node give way to other
+			// projects that have work
+			if !fairShare.turn(qr.project) {
+				logger.Trace("yielding to under-served projects", "project", qr.project)
+				continue
+			}
+
 			// track the first queue that has not been checked for the longest period of time that
 			// also has no traffic on this node.  This queue will be check but it wont be until the next
 			// pass that a new empty or idle queue will be checked.
@@ -421,6 +556,10 @@ func (qr *Queuer) producer(ctx context.Context, rqst chan *SubRequest) {
 						logger.Trace(fmt.Sprintf("backed off %s:%s", qr.project, sub.name), "stack", stack.Trace().TrimRuntime())
 						continue
 					}
+					if _, isPresent := throttles.Get(qr.project + ":" + sub.name); isPresent {
+						logger.Trace(fmt.Sprintf("throttled %s:%s", qr.project, sub.name), "stack", stack.Trace().TrimRuntime())
+						continue
+					}
 					// Save the queue that has been waiting the longest into the
 					// idle slot that we will be processing on this pass
 					idle = append(idle, sub)
@@ -429,31 +568,42 @@ func (qr *Queuer) producer(ctx context.Context, rqst chan *SubRequest) {
 
 			if len(idle) != 0 {
 
-				// Shuffle the queues to pick one at random, fisher yates shuffle introduced in
+				// Shuffle the queues to pick them at random, fisher yates shuffle introduced in
 				// go 1.10, c.f. https://golang.org/pkg/math/rand/#Shuffle
 				rand.Shuffle(len(idle), func(i, j int) {
 					idle[i], idle[j] = idle[j], idle[i]
 				})
 
-				if err := qr.check(ctx, idle[0].name, rqst); err != nil {
+				// Up to the fan-out number of idle queues are checked on each pass, the resources
+				// of the queues dispatched are deducted from those available to the queues after them
+				pass := &checkPass{}
+				for i, sub := range idle {
+					if uint(i) >= *queueFanoutOpt {
+						break
+					}
+					// Later checks wait briefly for the consumer to accept the previous request
+					if i != 0 && !rqst.awaitReady(ctx, time.Second) {
+						break
+					}
+
+					if interval := queueCfgs.checkInterval(sub.name); interval > 0 {
+						throttles.Set(qr.project+":"+sub.name, true, interval)
+					}
+
+					if err := qr.check(ctx, sub.name, rqst, pass); err != nil {
 
-					backoffs.Set(qr.project+":"+idle[0].name, true, time.Duration(time.Minute))
+						backoffs.Set(qr.project+":"+sub.name, true, time.Duration(time.Minute))
 
-					logger.Warn(fmt.Sprintf("checking %s for work failed due to %s, backoff 1 minute", qr.project+":"+idle[0].name, err.Error()))
-					break
+						logger.Warn(fmt.Sprintf("checking %s for work failed due to %s, backoff 1 minute", qr.project+":"+sub.name, err.Error()))
+						break
+					}
 				}
-				lastReady = time.Now()
-				lastReadyAbs = time.Now()
 			}
 
-			// Check to see if we were last ready for work more than one hour ago as
-			// this could be a resource problem
-			if lastReady.Before(time.Now().Add(-1 * time.Hour)) {
-				// If we have been unavailable for work alter slack once every 10 minutes and then
-				// bump the ready timer for wait for another 10 before resending the advisory
-				lastReady = lastReady.Add(10 * time.Minute)
-				logger.Warn("this host has been idle for a long period of time please check for disk space etc resource availability",
-					"idleTime", time.Now().Sub(lastReadyAbs))
+			// Having run no experiments for a long time while work was waiting for the node
+			// could be a resource problem
+			if advisory := idleness.advise(time.Now(), len(running.snapshot()) != 0); advisory != nil {
+				advisory.log()
 			}
 		case <-ctx.Done():
 			return
@@ -475,13 +625,7 @@ func (qr *Queuer) getResources(name string) (rsc *runner.Resource) {
 // Retrieve the queues and count their occupancy, then sort ascending into
 // an array
 func (qr *Queuer) rank() (ranked []Subscription) {
-	qr.subs.Lock()
-	defer qr.subs.Unlock()
-
-	ranked = make([]Subscription, 0, len(qr.subs.subs))
-	for _, sub := range qr.subs.subs {
-		ranked = append(ranked, *sub)
-	}
+	ranked = qr.subs.Snapshot()
 
 	// sort the queues by their frequency of work, not their occupany of resources
 	// so this is approximate but good enough for now
@@ -494,59 +638,119 @@ func (qr *Queuer) rank() (ranked []Subscription) {
 // getMachineResources extracts the current system state in terms of memory etc
 // and coverts this into the resource specification used by jobs.  Because resources
 // specified by users are not exact quantities the resource is used for the machines
-// resources even in the face of some loss of precision
+// resources even in the face of some loss of precision.  Any capacity reserved for
+// other queues is removed from the resources presented to the named queue.
 //
-func getMachineResources() (rsc *runner.Resource) {
+func getMachineResources(queue string) (rsc *runner.Resource) {
+	return reservation.apply(queue, machineRsc.get())
+}
+
+// machineProbe caches the result of probing the machines free resources
+//
+type machineProbe struct {
+	rsc    *runner.Resource
+	probed time.Time
+	sync.Mutex
+}
+
+// get returns a copy of the machines free resources, probing the machine only when
+// the previous probe is older than the configured TTL or has been invalidated
+//
+func (mp *machineProbe) get() (rsc *runner.Resource) {
+	mp.Lock()
+	defer mp.Unlock()
+
+	if mp.rsc == nil || time.Since(mp.probed) > *machineRscTTLOpt {
+		mp.rsc = probeMachineResources()
+		mp.probed = time.Now()
+	}
+	return mp.rsc.Clone()
+}
+
+// invalidate discards the cached probe, used when resources are allocated or released
+// so that the next fit decision is made using the current state of the machine
+//
+func (mp *machineProbe) invalidate() {
+	mp.Lock()
+	mp.rsc = nil
+	mp.Unlock()
+}
+
+// probeMachineResources queries the machine prober, by default the CPU, disk, and GPU
+// trackers, for the resources that are free
+//
+func probeMachineResources() (rsc *runner.Resource) {
 
 	rsc = &runner.Resource{}
+	prober := machine()
 
 	// For specified queue look for any free slots on existing GPUs is
 	// applicable and fill them, or find empty GPUs and groups to fill
 	// in with work
 
-	cpus, v := runner.CPUFree()
+	cpus, v := prober.CPUFree()
 	rsc.Cpus = uint(cpus)
 	rsc.Ram = humanize.Bytes(v)
 
-	rsc.Hdd = humanize.Bytes(runner.GetDiskFree())
+	rsc.Hdd = humanize.Bytes(prober.DiskFree())
 
 	// go runner allows GPU resources at the board level so obtain the total slots across
 	// all board form factors and use that as our max
 	//
-	rsc.Gpus = runner.TotalFreeGPUSlots()
-	rsc.GpuMem = humanize.Bytes(runner.LargestFreeGPUMem())
+	_, rsc.Gpus = prober.GPUSlots()
+	rsc.GpuMem = humanize.Bytes(prober.LargestFreeGPUMem())
+
+	versions := prober.CUDAVersions()
+	rsc.Cuda = versions.CUDA
+	rsc.Cudnn = versions.CuDNN
+
+	rsc.NodeSelector = runner.NodeLabels()
 
 	return rsc
 }
 
 // check will first validate a subscription and will add it to the list of subscriptions
-// to be processed, which is in turn used by the scheduler later.
+// to be processed, which is in turn used by the scheduler later.  When the check is one of
+// several made during a pass the resources claimed by the pass are removed from those the
+// subscription is fitted against, a nil pass is used for a single check.
 //
-func (qr *Queuer) check(ctx context.Context, name string, rQ chan *SubRequest) (err errors.Error) {
+func (qr *Queuer) check(ctx context.Context, name string, rQ *dispatcher, pass *checkPass) (err errors.Error) {
 
-	// Check to see if anyone is listening for a queue to check by sending a dummy request, and then
-	// send the real request if the check message is consumed
-	select {
-	case rQ <- &SubRequest{}:
-	default:
-		return errors.New("busy consumer, at the 1ˢᵗ stage").With("stack", stack.Trace().TrimRuntime())
+	// Only proceed if the consumer has advertised that it is able to accept a request
+	if !rQ.acquire() {
+		return errors.New("busy consumer").With("stack", stack.Trace().TrimRuntime())
 	}
+	dispatched := false
+	defer func() {
+		if !dispatched {
+			rQ.release()
+		}
+	}()
 
+	qr.subs.Lock()
 	sub, isPresent := qr.subs.subs[name]
+	rsc := (*runner.Resource)(nil)
+	if isPresent && sub.rsc != nil {
+		rsc = sub.rsc.Clone()
+	}
+	qr.subs.Unlock()
+
 	if !isPresent {
 		return errors.New("subscription not found").With("project", qr.project, "subscription", name).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	if sub.rsc != nil {
-		if fit, err := sub.rsc.Fit(getMachineResources()); !fit {
+	if rsc != nil {
+		headroom := pass.deduct(getMachineResources(name))
+		if fit, err := rsc.Fit(headroom); !fit {
 			if err != nil {
 				return err
 			}
 
 			if logger.IsTrace() {
-				logger.Trace("no fit", "project", qr.project, "subscription", name, "rsc", sub.rsc, "headroom", getMachineResources(),
+				logger.Trace("no fit", "project", qr.project, "subscription", name, "rsc", rsc, "headroom", headroom,
 					"stack", stack.Trace().TrimRuntime())
 			}
+			idleness.noFit(qr.project + ":" + name)
 			return nil
 		}
 		if logger.IsTrace() {
@@ -558,13 +762,12 @@ func (qr *Queuer) check(ctx context.Context, name string, rQ chan *SubRequest) (
 		}
 	}
 
-	select {
 	// Enough needs to be sent at this point that the queue could be found and checked
 	// by the message queue handling implementation
-	case rQ <- &SubRequest{project: qr.project, subscription: name, creds: qr.cred}:
-	case <-time.After(2 * time.Second):
-		return errors.New("busy checking consumer, at the 2ⁿᵈ stage").With("stack", stack.Trace().TrimRuntime())
-	}
+	rQ.dispatch(&SubRequest{project: qr.project, subscription: name, creds: qr.cred})
+	dispatched = true
+
+	pass.claim(rsc)
 
 	return nil
 }
@@ -573,16 +776,30 @@ func (qr *Queuer) check(ctx context.Context, name string, rQ chan *SubRequest) (
 // or old subscriptions and adding them or removing them as needed
 //
 // This function will block except in the case a fatal issue occurs that prevents it
-// from being able to perform the function that it is intended to do
+// from being able to perform the function that it is intended to do.  New work is taken
+// until the context is done, the work itself uses the work context.  Before returning the
+// work already taken is waited for.
 //
-func (qr *Queuer) run(ctx context.Context, refreshInterval time.Duration) (err errors.Error) {
+func (qr *Queuer) run(ctx context.Context, workCtx context.Context, refreshInterval time.Duration) (err errors.Error) {
+
+	ctx, stop := context.WithCancel(ctx)
+
+	// Start a single worker that advertises its readiness for requests to check queues
+	sendWork := newDispatcher()
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		qr.consumer(ctx, workCtx, sendWork)
+	}()
 
-	// Start a single unbuffered worker that we have for now to trigger for work
-	sendWork := make(chan *SubRequest)
-	go qr.consumer(ctx, sendWork)
+	defer func() {
+		stop()
+		<-consumerDone
+		qr.inflight.Wait()
+	}()
 
-	// start work producer that looks at subscriptions and then checks the
-	// sendWork listener to ensure there is capacity
+	// start work producer that looks at subscriptions and then dispatches requests
+	// when the consumer has capacity
 
 	go qr.producer(ctx, sendWork)
 
@@ -602,27 +819,27 @@ func (qr *Queuer) run(ctx context.Context, refreshInterval time.Duration) (err e
 	}
 }
 
-func (qr *Queuer) consumer(ctx context.Context, readyC chan *SubRequest) {
+// consumer takes requests to check queues until the context is done, the checks use the
+// work context and are tracked using the inflight wait group of the queuer
+//
+func (qr *Queuer) consumer(ctx context.Context, workCtx context.Context, readyC *dispatcher) {
 
 	logger.Debug("started consumer", "project", qr.project)
 	defer logger.Debug("stopped consumer", "project", qr.project)
 
 	for {
-		select {
-		case request := <-readyC:
-			// The channel looks to have been closed so stop handling work
-			if request == nil {
-				return
-			}
-			// An empty structure will be sent when the sender want to check if
-			// the worker is ready for a scheduling request for a queue
-			if len(request.subscription) == 0 {
-				continue
-			}
-			go qr.filterWork(ctx, request)
-		case <-ctx.Done():
+		if !readyC.advertise(ctx) {
+			return
+		}
+		request := readyC.next(ctx)
+		if request == nil {
 			return
 		}
+		qr.inflight.Add(1)
+		go func() {
+			defer qr.inflight.Done()
+			qr.filterWork(workCtx, request)
+		}()
 	}
 }
 
@@ -636,6 +853,14 @@ func (qr *Queuer) filterWork(ctx context.Context, request *SubRequest) {
 		logger.Trace(fmt.Sprintf("backoff on for %v", request))
 		return
 	}
+	if _, isPresent := backoffs.Get(nodeBackoff); isPresent {
+		logger.Trace(fmt.Sprintf("node backoff on for %v", request))
+		return
+	}
+	if projectPauses.queuePaused(request.project, request.subscription) {
+		logger.Trace(fmt.Sprintf("project paused for %v", request))
+		return
+	}
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -643,28 +868,22 @@ func (qr *Queuer) filterWork(ctx context.Context, request *SubRequest) {
 		}
 	}()
 
-	busyQs.Lock()
-	_, busy := busyQs.subs[request.project+":"+request.subscription]
-	if !busy {
-		busyQs.subs[request.project+":"+request.subscription] = true
-	}
-	busyQs.Unlock()
-
-	if busy {
+	lease, ok := busyQs.acquire(request.project + ":" + request.subscription)
+	if !ok {
 		logger.Trace(fmt.Sprintf("busy %v", request))
 		return
 	}
 	logger.Trace(fmt.Sprintf("mark as busy %v", request))
 
+	// The lease is renewed by the work as it makes progress, the reaper frees the subscription
+	// should the worker stop, or hang, without reaching the release below
 	defer func() {
-		busyQs.Lock()
-		delete(busyQs.subs, request.project+":"+request.subscription)
-		busyQs.Unlock()
+		busyQs.release(request.project+":"+request.subscription, lease)
 
 		logger.Trace(fmt.Sprintf("mark as free %v", request))
 	}()
 
-	qr.doWork(ctx, request)
+	qr.doWork(withLease(ctx, lease), request)
 }
 
 // HandleMsg takes a message describing a queued task and handles the request, running and validating it
@@ -673,11 +892,17 @@ func (qr *Queuer) filterWork(ctx context.Context, request *SubRequest) {
 func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource, consume bool) {
 
 	rsc = nil
+	progressed(ctx)
 
+	// A panic leaves the outcome for the message decided here rather than relying on the queue
+	// redelivering it once the acknowledgement deadline has passed.  The fate of the message
+	// is only recorded for a running experiment once that outcome is known
+	runningDone := func(ack bool) {}
 	defer func() {
 		if r := recover(); r != nil {
-			logger.Warn(fmt.Sprintf("%#v", r), "stack", stack.Trace().TrimRuntime())
+			rsc, consume = nil, recoverMsg(qt, r)
 		}
+		runningDone(consume)
 	}()
 
 	// Check for the back off and self destruct if one is seen for this subscription, leave the message for
@@ -689,17 +914,56 @@ func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource,
 		logger.Debug("stopping checking backing off", "project_id", qt.Project, "subscription", qt.Subscription)
 		return rsc, false
 	}
+	if _, isPresent := backoffs.Get(nodeBackoff); isPresent {
+		logger.Debug("stopping checking node backing off", "project_id", qt.Project, "subscription", qt.Subscription)
+		return rsc, false
+	}
 
-	logger.Debug("msg processing started", "project_id", qt.Project, "subscription", qt.Subscription)
-	defer logger.Debug("msg processing done", "project_id", qt.Project, "subscription", qt.Subscription)
+	// The span covering the experiment continues any trace the submitter started
+	ctx, span := runner.StartMsgSpan(ctx, qt)
+	spanErr := errors.Error(nil)
+	defer func() {
+		runner.EndSpan(span, spanErr)
+	}()
+	traceID, spanID := runner.TraceIDs(ctx)
+
+	logger.Debug("msg processing started", "project_id", qt.Project, "subscription", qt.Subscription, "trace_id", traceID, "span_id", spanID)
+	defer logger.Debug("msg processing done", "project_id", qt.Project, "subscription", qt.Subscription, "trace_id", traceID, "span_id", spanID)
+
+	// Damaged messages will never succeed so rather than having them redelivered they are
+	// consumed and retained in the dead letter directory for investigation
+	if err := runner.VerifyMessage(qt); err != nil {
+		key := "corrupt_" + strings.TrimPrefix(runner.MessageDigest(qt.Msg), "sha256:")[:16]
+		logger.Warn("corrupt msg dead lettered", "project_id", qt.Project, "subscription", qt.Subscription, "trace_id", traceID, "error", err.Error())
+		spanErr = err
+		if err := deadLetter(qt, key); err != nil {
+			logger.Warn("unable to dead letter msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		}
+		return rsc, true
+	}
+
+	// Queues whose messages wrap the request in another envelope have it extracted, envelopes
+	// that do not hold a request never will and so are retained in the dead letter directory
+	msg, err := requestMsg(qt)
+	if err != nil {
+		key := "malformed_" + strings.TrimPrefix(runner.MessageDigest(qt.Msg), "sha256:")[:16]
+		logger.Warn("malformed envelope dead lettered", "project_id", qt.Project, "subscription", qt.Subscription, "trace_id", traceID, "error", err.Error())
+		spanErr = err
+		if err := deadLetter(qt, key); err != nil {
+			logger.Warn("unable to dead letter msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		}
+		return rsc, true
+	}
 
 	// allocate the processor and sub the subscription as
 	// the group mechanism for work coming down the
 	// pipe that is sent to the resource allocation
 	// module
-	proc, err := newProcessor(ctx, qt.Subscription, qt.Msg, qt.Credentials)
+	proc, err := processorFactory(ctx, qt.Subscription, msg, qt.Credentials)
 	if err != nil {
-		logger.Warn("unable to process msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		logger.Warn("unable to process msg", "project_id", qt.Project, "subscription", qt.Subscription, "trace_id", traceID, "error", err.Error())
+		spanErr = err
+		qt.Dumped = true
 
 		backoffs.Set(qt.Project+":"+qt.Subscription, true, time.Duration(10*time.Second))
 		return rsc, true
@@ -708,6 +972,109 @@ func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource,
 
 	rsc = proc.Request.Experiment.Resource.Clone()
 
+	// Experiments operators have quarantined are dumped before anything else is done with them
+	if err := quarantined(proc.Request); err != nil {
+		logger.Warn("experiment quarantined, dumping", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key, "error", err.Error())
+		spanErr = err
+		if err := deadLetter(qt, proc.Request.Experiment.Key); err != nil {
+			logger.Warn("unable to dead letter msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		}
+		return rsc, true
+	}
+
+	// Work for projects that have been cancelled is returned to the queue untouched, the queue
+	// is not backed off as it can carry work for other projects
+	projectPauses.seen(proc.Request.Config.Database.ProjectId, qt.Project+":"+qt.Subscription)
+	if projectPauses.isPaused(proc.Request.Config.Database.ProjectId, qt.Project, qt.Project+":"+qt.Subscription) {
+		logger.Info("project paused, leaving experiment", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key)
+		return rsc, false
+	}
+
+	// If this host, or the hint carried by the message, says the experiment failed due to a
+	// problem with this host then leave it for other hosts.  Queues able to change a returned
+	// message place it at the back of the queue carrying the hint, others make it available
+	// again immediately, often to the same consumer, so the queue is also backed off briefly
+	// to give other hosts the chance to take the message
+	if until, isAvoided := avoiding(proc.Request.Experiment.Key); isAvoided || hintedAvoid(qt.Attributes) {
+		logger.Info("avoiding experiment", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key)
+		qt.Requeue = avoidHint(qt.Attributes, until)
+		backoffs.Set(qt.Project+":"+qt.Subscription, true, time.Duration(10*time.Second))
+		return rsc, false
+	}
+
+	// Experiments needing a CUDA runtime this node does not have are left for other nodes, the
+	// resources returned will then prevent the queue being fitted to this node
+	needs := proc.Request.Experiment.Resource
+	if versions := machine().CUDAVersions(); !runner.VersionAtLeast(versions.CUDA, needs.Cuda) || !runner.VersionAtLeast(versions.CuDNN, needs.Cudnn) {
+		logger.Info("experiment needs a newer cuda runtime", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key,
+			"cuda", needs.Cuda, "cudnn", needs.Cudnn, "node_cuda", versions.CUDA, "node_cudnn", versions.CuDNN)
+		backoffs.Set(qt.Project+":"+qt.Subscription, true, time.Duration(10*time.Second))
+		return rsc, false
+	}
+
+	// Experiments asking for hardware this node is not labelled as having are left for other
+	// nodes in the same way
+	if labels := runner.NodeLabels(); !runner.SelectorMatch(needs.NodeSelector, labels) {
+		logger.Info("experiment node selector does not match", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key,
+			"node_selector", runner.SelectorString(needs.NodeSelector), "node_labels", runner.SelectorString(labels))
+		backoffs.Set(qt.Project+":"+qt.Subscription, true, time.Duration(10*time.Second))
+		return rsc, false
+	}
+
+	// Experiments whose python packages recently failed to build are dumped with the error seen
+	// rather than repeating a build that is expected to fail again
+	if err := runner.EnvBuildFailed(proc.Request); err != nil {
+		logger.Warn("experiment environment recently failed to build, dumping", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key, "error", err.Error())
+		spanErr = err
+		if err := deadLetter(qt, proc.Request.Experiment.Key); err != nil {
+			logger.Warn("unable to dead letter msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		}
+		return rsc, true
+	}
+
+	// Experiments that depend upon others are left in the queue until their prerequisites have
+	// completed, or dumped if they never will
+	ready, err := checkDependencies(ctx, proc.Request)
+	if err != nil {
+		logger.Warn("experiment prerequisites not met, dumping", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key, "error", err.Error())
+		spanErr = err
+		if err := deadLetter(qt, proc.Request.Experiment.Key); err != nil {
+			logger.Warn("unable to dead letter msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		}
+		return rsc, true
+	}
+	if !ready {
+		logger.Info("experiment waiting on prerequisites", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key)
+		backoffs.Set(qt.Project+":"+qt.Subscription, true, *dependencyBackoffOpt)
+		return rsc, false
+	}
+
+	// Experiments with an affinity hint naming other nodes are left for those nodes for a while,
+	// only this message is returned as the other work on the queue can still be run here
+	if leaveForAffinity(proc.Request) {
+		logger.Info("experiment left for preferred nodes", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key,
+			"hosts", strings.Join(proc.Request.Experiment.Affinity.Hosts, ","))
+		return rsc, false
+	}
+
+	// Experiments using a licensed framework lease a token before being started, when none are
+	// free, or the license server cannot be reached, the experiment is left for later
+	pool := licensePool(qt.Subscription)
+	lease, available, err := acquireLicense(ctx, pool, host+"/"+proc.Request.Experiment.Key)
+	if err != nil {
+		logger.Warn("license not leased, leaving experiment", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key,
+			"pool", pool, "error", err.Error())
+		spanErr = err
+		backoffs.Set(qt.Project+":"+qt.Subscription, true, *licenseBackoffOpt)
+		return rsc, false
+	}
+	if !available {
+		logger.Info("no license available, leaving experiment", "project_id", qt.Project, "subscription", qt.Subscription, "experiment_id", proc.Request.Experiment.Key, "pool", pool)
+		backoffs.Set(qt.Project+":"+qt.Subscription, true, *licenseBackoffOpt)
+		return rsc, false
+	}
+	defer lease.release()
+
 	labels := prometheus.Labels{
 		"host":       host,
 		"queue_type": "rmq",
@@ -728,15 +1095,77 @@ func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource,
 		queueRan.With(labels).Inc()
 	}()
 
+	span.AddAttributes(trace.StringAttribute("experiment.key", proc.Request.Experiment.Key),
+		trace.StringAttribute("experiment.project", proc.Request.Config.Database.ProjectId))
+
 	logger.Info("validating experiment", "project_id", proc.Request.Config.Database.ProjectId,
-		"experiment_id", proc.Request.Experiment.Key)
+		"experiment_id", proc.Request.Experiment.Key, "trace_id", traceID, "span_id", spanID)
 
 	startTime := time.Now()
 
+	// Record the experiment so that it can be reported on should the runner be stopped, or
+	// cancelled should its project be cancelled
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	runningDone = running.addCancellable(proc.Request.Experiment.Key, proc.Request.Config.Database.ProjectId, qt.Subscription, startTime, cancel)
+	if resumable(proc.Request) {
+		running.markResumable(proc.Request.Experiment.Key)
+	}
+	lifecycleLogs.started(qt, proc.Request, startTime)
+
+	// Operators can limit how long a message from the queue is processed for, whatever the
+	// experiment asks for
+	ceiling := startCeiling(qt.Subscription, proc.Request, cancel)
+	defer ceiling.stop()
+
+	// Account for the node time used by the project
+	shareStopped := fairShare.started(qt.FQProject, startTime)
+	defer func() {
+		shareStopped(time.Now())
+	}()
+
+	// Work from queues able to use reserved capacity is tracked so that the reservation
+	// can be presented accurately to other queues
+	reservation.acquire(qt.Subscription, rsc)
+	defer reservation.release(qt.Subscription, rsc)
+
 	// Blocking call to run the entire task and only return on termination due to the context
 	// being cancelled or its own error / success
+	progressed(ctx)
 	backoff, ack, err := proc.Process(ctx)
+	progressed(ctx)
+
+	// Experiments cancelled by an operator are consumed so that they are not retried
+	if running.operatorCancelled(proc.Request.Experiment.Key) {
+		logger.Info("experiment cancelled", "project_id", proc.Request.Config.Database.ProjectId, "experiment_id", proc.Request.Experiment.Key)
+		ack = true
+	}
+
+	// Experiments stopped by the processing timeout of their queue would be stopped again if
+	// retried so they are dumped
+	if err != nil && ceiling.wasExceeded() {
+		logger.Warn("experiment exceeded the queue processing timeout, dumping", "project_id", proc.Request.Config.Database.ProjectId,
+			"experiment_id", proc.Request.Experiment.Key, "queue", qt.Subscription, "processing_timeout", ceiling.timeout.String())
+		if errDL := deadLetter(qt, proc.Request.Experiment.Key); errDL != nil {
+			logger.Warn("dead letter not saved", "project_id", proc.Request.Config.Database.ProjectId,
+				"experiment_id", proc.Request.Experiment.Key, "error", errDL.Error())
+		}
+		ack = true
+	}
+
+	// Completion events are published once the outcome of the experiment is known
+	defer func() {
+		event := newResultEvent(qt, proc.Request, startTime, err, ack, ctx.Err() != nil)
+		event.OutputTruncated = proc.Executor != nil && proc.Executor.OutputTruncated()
+		event.NoOutputs = proc.NoOutputs
+		event.allocation(proc.Allocated)
+		event.outcome(proc.Result)
+		publishResult(event)
+	}()
+
 	if err != nil {
+		spanErr = err
 
 		// Do at least a minimal backoff
 		if backoff == time.Duration(0) {
@@ -745,10 +1174,36 @@ func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource,
 
 		backoffs.Set(qt.Project+":"+qt.Subscription, true, backoff)
 
+		// A node that has run out of disk should not accept more work from any of its
+		// queues until space has had a chance to be released
+		if runner.IsOutOfDisk(err) {
+			backoffs.Set(nodeBackoff, true, *outOfDiskBackoffOpt)
+			logger.Warn("out of disk, backing off all queues", "host", host, "backoff", outOfDiskBackoffOpt.String(), "error", err.Error())
+		}
+
+		// Failures caused by the runner stopping are not counted against the experiment
+		if !ack && ctx.Err() == nil {
+			switch classifyFailure(err) {
+			case failNodeLocal:
+				qt.Requeue = avoidHint(qt.Attributes, avoid(proc.Request.Experiment.Key))
+				logger.Warn("node failure, experiment left for other hosts", "project_id", proc.Request.Config.Database.ProjectId,
+					"experiment_id", proc.Request.Experiment.Key, "host", host, "error", err.Error())
+			case failIntrinsic:
+				if retryExhausted(proc.Request.Experiment.Key, proc.Request.Experiment.MaxRetries) {
+					if errDL := deadLetter(qt, proc.Request.Experiment.Key); errDL != nil {
+						logger.Warn("dead letter not saved", "project_id", proc.Request.Config.Database.ProjectId,
+							"experiment_id", proc.Request.Experiment.Key, "error", errDL.Error())
+					}
+					ack = true
+				}
+			}
+		}
+
 		if !ack {
-			logger.Info("retry experiment", "project_id", proc.Request.Config.Database.ProjectId, "experiment_id", proc.Request.Experiment.Key, "error", err.Error())
+			logger.Info("retry experiment", "project_id", proc.Request.Config.Database.ProjectId, "experiment_id", proc.Request.Experiment.Key, "trace_id", traceID, "error", err.Error())
 		} else {
-			logger.Warn("dump experiment", "project_id", proc.Request.Config.Database.ProjectId, "experiment_id", proc.Request.Experiment.Key, "error", err.Error())
+			qt.Dumped = true
+			logger.Warn("dump experiment", "project_id", proc.Request.Config.Database.ProjectId, "experiment_id", proc.Request.Experiment.Key, "trace_id", traceID, "error", err.Error())
 		}
 
 		return rsc, ack
@@ -756,6 +1211,7 @@ func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource,
 
 	logger.Info("completed experiment", "project_id", proc.Request.Config.Database.ProjectId,
 		"experiment_id", proc.Request.Experiment.Key, "duration", time.Since(startTime).String(),
+		"trace_id", traceID, "span_id", spanID,
 		"stack", stack.Trace().TrimRuntime())
 
 	// At this point we could look for a backoff for this queue and set it to a small value as we are about to release resources
@@ -765,6 +1221,38 @@ func HandleMsg(ctx context.Context, qt *runner.QueueTask) (rsc *runner.Resource,
 	return rsc, ack
 }
 
+// recoverMsg is used after the handling of a message has panicked to decide if the message is
+// returned to the queue, or dumped when it is malformed and would fail in the same way
+// when redelivered
+//
+func recoverMsg(qt *runner.QueueTask, r interface{}) (consume bool) {
+	err := errors.New(fmt.Sprint("panic handling msg, ", r)).With("project_id", qt.Project, "subscription", qt.Subscription).With("stack", stack.Trace().TrimRuntime())
+
+	msg, errDecode := requestMsg(qt)
+	if errDecode == nil {
+		_, errDecode = runner.UnmarshalRequest(msg)
+	}
+	if errDecode != nil {
+		logger.Error("malformed msg dead lettered after a panic", "error", err.Error(), "decode_error", errDecode.Error(), "panic_stack", string(debug.Stack()))
+		key := "malformed_" + strings.TrimPrefix(runner.MessageDigest(qt.Msg), "sha256:")[:16]
+		if err := deadLetter(qt, key); err != nil {
+			logger.Warn("unable to dead letter msg", "project_id", qt.Project, "subscription", qt.Subscription, "error", err.Error())
+		}
+		return true
+	}
+
+	logger.Error("msg returned to the queue after a panic", "error", err.Error(), "panic_stack", string(debug.Stack()))
+	backoffs.Set(qt.Project+":"+qt.Subscription, true, time.Duration(10*time.Second))
+	return false
+}
+
+// requestMsg returns the request carried by a message, applying the transforms configured
+// for its queue
+//
+func requestMsg(qt *runner.QueueTask) (msg []byte, err errors.Error) {
+	return runner.TransformMsg(queueCfgs.transforms(qt.Subscription), qt.Msg)
+}
+
 func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 
 	if _, isPresent := backoffs.Get(request.project + ":" + request.subscription); isPresent {
@@ -783,7 +1271,11 @@ func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 
 	cCtx, workCancel := context.WithTimeout(context.Background(), qr.timeout)
 
+	// The work can continue after this function returns and so is tracked separately
+	qr.inflight.Add(1)
 	go func() {
+		defer qr.inflight.Done()
+
 		logger.Trace(fmt.Sprintf("started queue check %#v", *request))
 		defer logger.Trace(fmt.Sprintf("completed queue check for %#v", *request))
 
@@ -795,6 +1287,7 @@ func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 			Project:      request.project,
 			Subscription: request.subscription,
 			Handler:      HandleMsg,
+			AckWindow:    qr.subs.ackWindow(request.subscription),
 		}
 
 		// Establish new context with the timeouts for the queue runner in place.
@@ -802,10 +1295,21 @@ func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 		//
 		defer workCancel()
 
+		progressed(ctx)
+		started := time.Now()
 		cnt, rsc, errGo := qr.tasker.Work(ctx, qt)
+		backends.record(qr.project, !backendFailure(errGo))
+		if errGo == nil {
+			idleness.received(qr.project+":"+request.subscription, cnt, qt.Backlog, rsc != nil)
+		}
 
 		if errGo != nil {
+			// Permanent errors such as authentication failures back the queue off, network blips that
+			// outlasted the retries done by the queue implementation are checked again sooner
 			backoffTime := time.Duration(2 * time.Minute)
+			if runner.IsTransient(errGo) {
+				backoffTime = time.Duration(15 * time.Second)
+			}
 			msg := fmt.Sprint(errGo)
 			if err, ok := errGo.(errors.Error); ok {
 				msg = fmt.Sprint(err)
@@ -830,6 +1334,7 @@ func (qr *Queuer) doWork(ctx context.Context, request *SubRequest) {
 		if err := qr.subs.setResources(request.subscription, rsc); err != nil {
 			logger.Info(fmt.Sprintf("%s:%s resources not updated due to %s", request.project, request.subscription, err))
 		}
+		qr.subs.setDuration(request.subscription, time.Since(started))
 
 	}()
 
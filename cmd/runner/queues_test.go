@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/karlmutch/errors"
+	"github.com/rs/xid"
+)
+
+// TestHandleMsgPanic checks that a panic while a message is being handled returns the message
+// to the queue, unless the message is malformed in which case it is dumped
+//
+func TestHandleMsgPanic(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "handle-msg-panic")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	savedFactory := processorFactory
+	savedDir := *deadLetterDirOpt
+	*deadLetterDirOpt = dir
+	defer func() {
+		processorFactory = savedFactory
+		*deadLetterDirOpt = savedDir
+	}()
+
+	processorFactory = func(ctx context.Context, group string, msg []byte, creds string) (proc *processor, err errors.Error) {
+		panic("injected processor failure")
+	}
+
+	// A request that can be decoded is nacked so that it is redelivered
+	qt := &runner.QueueTask{
+		Project:      "project",
+		Subscription: "panic_" + xid.New().String(),
+		Msg:          []byte(`{"experiment": {"key": "panic-experiment"}}`),
+	}
+	if rsc, consume := HandleMsg(context.Background(), qt); consume || rsc != nil {
+		t.Fatalf("message was consumed after a panic %v", rsc)
+	}
+	if _, isPresent := backoffs.Get(qt.Project + ":" + qt.Subscription); !isPresent {
+		t.Fatal("queue was not backed off after a panic")
+	}
+	backoffs.Delete(qt.Project + ":" + qt.Subscription)
+
+	// A message that cannot be decoded into a request would panic again so it is dumped
+	qt = &runner.QueueTask{
+		Project:      "project",
+		Subscription: "panic_" + xid.New().String(),
+		Msg:          []byte(`{"experiment": "panic-experiment"}`),
+	}
+	if _, consume := HandleMsg(context.Background(), qt); !consume {
+		t.Fatal("malformed message was not dumped after a panic")
+	}
+	if dumped, _ := filepath.Glob(filepath.Join(dir, qt.Subscription+"_malformed_*.json")); len(dumped) != 1 {
+		t.Fatalf("malformed message was not dead lettered %v", dumped)
+	}
+}
+
+// TestHandleMsgAvoid checks that an experiment this host is avoiding, either because it saw the
+// experiment fail or because the message says so, is returned to the queue carrying the hint
+// and that the queue is backed off so that other hosts can take it
+//
+func TestHandleMsgAvoid(t *testing.T) {
+
+	savedFactory := processorFactory
+	defer func() { processorFactory = savedFactory }()
+
+	key := "avoid-" + xid.New().String()
+	processorFactory = func(ctx context.Context, group string, msg []byte, creds string) (proc *processor, err errors.Error) {
+		proc = &processor{Request: &runner.Request{}}
+		proc.Request.Experiment.Key = key
+		return proc, nil
+	}
+
+	for _, hinted := range []bool{false, true} {
+		qt := &runner.QueueTask{
+			Project:      "project",
+			Subscription: "avoid_" + xid.New().String(),
+			Msg:          []byte(`{"experiment": {"key": "` + key + `"}}`),
+		}
+		if hinted {
+			qt.Attributes = avoidHint(nil, time.Now().Add(time.Minute))
+		} else {
+			avoid(key)
+		}
+
+		if _, consume := HandleMsg(context.Background(), qt); consume {
+			t.Fatalf("avoided message was consumed, hinted %v", hinted)
+		}
+		if !hintedAvoid(qt.Requeue) {
+			t.Fatalf("avoided message was not returned with a hint for this host %v, hinted %v", qt.Requeue, hinted)
+		}
+		if _, isPresent := backoffs.Get(qt.Project + ":" + qt.Subscription); !isPresent {
+			t.Fatalf("queue was not backed off after avoiding a message, hinted %v", hinted)
+		}
+		backoffs.Delete(qt.Project + ":" + qt.Subscription)
+		avoids.Delete(key)
+	}
+}
+
+// TestHandleMsgTransform checks that messages from queues configured with transforms are
+// unwrapped before being decoded, and that envelopes without a request are dead lettered
+//
+func TestHandleMsgTransform(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "handle-msg-transform")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFn := filepath.Join(dir, "queue-config.json")
+	if errGo = ioutil.WriteFile(cfgFn, []byte(`[{"match": "^sns_", "transforms": ["sns"]}]`), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	savedFactory := processorFactory
+	savedDir, savedCfg := *deadLetterDirOpt, *queueCfgOpt
+	*deadLetterDirOpt, *queueCfgOpt = dir, cfgFn
+	defer func() {
+		processorFactory = savedFactory
+		*deadLetterDirOpt, *queueCfgOpt = savedDir, savedCfg
+		queueCfgs.Lock()
+		queueCfgs.settings = nil
+		queueCfgs.Unlock()
+	}()
+	if err := loadQueueConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := ""
+	processorFactory = func(ctx context.Context, group string, msg []byte, creds string) (proc *processor, err errors.Error) {
+		received = string(msg)
+		return nil, errors.New("injected processor failure")
+	}
+
+	request := `{"experiment": {"key": "sns-experiment"}}`
+	qt := &runner.QueueTask{
+		Project:      "project",
+		Subscription: "sns_" + xid.New().String(),
+		Msg:          []byte(`{"Type": "Notification", "TopicArn": "arn:aws:sns:us-west-2:123456789012:studioml", "Message": ` + strconv.Quote(request) + `}`),
+	}
+	HandleMsg(context.Background(), qt)
+	if received != request {
+		t.Fatalf("request not unwrapped from the notification, received %q", received)
+	}
+	backoffs.Delete(qt.Project + ":" + qt.Subscription)
+
+	received = ""
+	qt = &runner.QueueTask{
+		Project:      "project",
+		Subscription: "sns_" + xid.New().String(),
+		Msg:          []byte(request),
+	}
+	if _, consume := HandleMsg(context.Background(), qt); !consume || len(received) != 0 {
+		t.Fatal("malformed envelope was not dumped")
+	}
+	if dumped, _ := filepath.Glob(filepath.Join(dir, qt.Subscription+"_malformed_*.json")); len(dumped) != 1 {
+		t.Fatalf("malformed envelope was not dead lettered %v", dumped)
+	}
+}
+
+// drainTasker is a task queue whose work blocks until it is released
+//
+type drainTasker struct {
+	started chan context.Context
+	release chan struct{}
+}
+
+func (tq *drainTasker) Refresh(ctx context.Context, qNameMatch *regexp.Regexp) (known map[string]interface{}, err errors.Error) {
+	return map[string]interface{}{}, nil
+}
+
+func (tq *drainTasker) Work(ctx context.Context, qt *runner.QueueTask) (msgs uint64, resource *runner.Resource, err errors.Error) {
+	tq.started <- ctx
+	<-tq.release
+	return 0, nil, nil
+}
+
+func (tq *drainTasker) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+	return true, nil
+}
+
+// TestQueuerDrain checks that a queuer that stops taking new work, for example when its
+// credentials change, waits for the work it has started without cancelling it
+//
+func TestQueuerDrain(t *testing.T) {
+
+	tasker := &drainTasker{
+		started: make(chan context.Context, 1),
+		release: make(chan struct{}),
+	}
+	qr := &Queuer{
+		project: "drain-test",
+		subs:    Subscriptions{subs: map[string]*Subscription{}},
+		timeout: 50 * time.Millisecond,
+		tasker:  tasker,
+	}
+
+	workCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pollCtx, stop := context.WithCancel(workCtx)
+
+	doneC := make(chan errors.Error, 1)
+	go func() {
+		doneC <- qr.run(pollCtx, workCtx, time.Minute)
+	}()
+
+	qr.inflight.Add(1)
+	go func() {
+		defer qr.inflight.Done()
+		qr.doWork(workCtx, &SubRequest{project: "drain-test", subscription: "drain-" + xid.New().String()})
+	}()
+
+	var working context.Context
+	select {
+	case working = <-tasker.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("work was not started")
+	}
+
+	stop()
+	select {
+	case <-doneC:
+		t.Fatal("queuer stopped before its work completed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if working.Err() != nil {
+		t.Fatal("running work was cancelled when the queuer stopped taking new work")
+	}
+
+	close(tasker.release)
+	select {
+	case err := <-doneC:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queuer did not stop once its work completed")
+	}
+}
+
+// TestSubscriptionsSnapshot checks that a snapshot of the subscriptions is a deep copy that can be
+// changed by its caller, and read while the resources of the subscriptions are being learnt,
+// without altering, or racing with, the catalog
+//
+func TestSubscriptionsSnapshot(t *testing.T) {
+
+	subs := &Subscriptions{subs: map[string]*Subscription{
+		"queue_1": {name: "queue_1", rsc: &runner.Resource{Cpus: 2, Ram: "4gb"}, cnt: 1, durations: []time.Duration{time.Minute}},
+		"queue_2": {name: "queue_2"},
+	}}
+
+	snap := subs.Snapshot()
+	if len(snap) != 2 || snap[0].name != "queue_1" || snap[1].name != "queue_2" {
+		t.Fatalf("unexpected snapshot %+v", snap)
+	}
+	if snap[0].rsc == subs.subs["queue_1"].rsc || snap[0].rsc.Cpus != 2 || snap[0].cnt != 1 || len(snap[0].durations) != 1 {
+		t.Fatalf("snapshot did not copy the subscription %+v", snap[0])
+	}
+
+	snap[0].rsc.Cpus = 16
+	snap[0].rsc.Ram = "64gb"
+	snap[0].cnt = 8
+	snap[0].durations[0] = time.Hour
+	snap[1].rsc = &runner.Resource{Cpus: 1}
+
+	original := subs.subs["queue_1"]
+	if original.rsc.Cpus != 2 || original.rsc.Ram != "4gb" || original.cnt != 1 || original.durations[0] != time.Minute {
+		t.Fatalf("changing the snapshot altered the subscription %+v %+v", original, original.rsc)
+	}
+	if subs.subs["queue_2"].rsc != nil {
+		t.Fatal("changing the snapshot gave resources to a subscription without any")
+	}
+
+	// Snapshots taken, and changed, while resources are being learnt do not race with the
+	// catalog, run using -race to check
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint(0); ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := subs.setResources("queue_1", &runner.Resource{Cpus: i, Ram: "4gb"}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i != 1000; i++ {
+		for _, sub := range subs.Snapshot() {
+			if sub.rsc != nil {
+				sub.rsc.Cpus++
+				sub.rsc.Ram = "1gb"
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	subs.Lock()
+	defer subs.Unlock()
+	if subs.subs["queue_1"].rsc.Ram != "4gb" {
+		t.Fatalf("changing snapshots altered the learnt resources %+v", subs.subs["queue_1"].rsc)
+	}
+}
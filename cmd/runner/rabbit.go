@@ -4,7 +4,6 @@ import (
 	"context"
 	"net/url"
 	"os"
-	"regexp"
 	"time"
 
 	"github.com/leaf-ai/studio-go-runner/internal/runner"
@@ -24,7 +23,7 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 	logger.Debug("starting serviceRMQ", stack.Trace().TrimRuntime())
 	defer logger.Debug("stopping serviceRMQ", stack.Trace().TrimRuntime())
 
-	if len(*amqpURL) == 0 {
+	if len(amqpURLSetting()) == 0 {
 		logger.Info("rabbitMQ services disabled", stack.Trace().TrimRuntime())
 		return
 	}
@@ -34,26 +33,10 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 		projects:  map[string]context.CancelFunc{},
 	}
 
-	// NewRabbitMQ takes a URL that has no credentials or tokens attached as the
-	// first parameter and the user name password as the second parameter
-	creds := ""
-	qURL, errGo := url.Parse(os.ExpandEnv(*amqpURL))
-	if errGo != nil {
-		logger.Warn(errors.Wrap(errGo).With("url", *amqpURL).With("stack", stack.Trace().TrimRuntime()).Error())
-	}
-	if qURL.User != nil {
-		creds = qURL.User.String()
-	} else {
-		logger.Warn(errors.New("missing credentials in url").With("url", *amqpURL).With("stack", stack.Trace().TrimRuntime()).Error())
-	}
-	qURL.User = nil
-	rmq, err := runner.NewRabbitMQ(qURL.String(), creds)
-	if err != nil {
-		logger.Error(err.Error())
-	}
-
-	// The regular expression is validated in the main.go file
-	matcher, _ := regexp.Compile(*queueMatch)
+	// The server is connected to when it is first checked, and again whenever the runner-config
+	// file changes it
+	amqp := ""
+	rmq := (*runner.RabbitMQ)(nil)
 
 	// first time through make sure the credentials are checked immediately
 	qCheck := time.Duration(time.Second)
@@ -65,10 +48,14 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 
 	lifecycleC := make(chan runner.K8sStateUpdate, 1)
 	id, err := k8sStateUpdates().Add(lifecycleC)
-	defer func() {
-		k8sStateUpdates().Delete(id)
-		close(lifecycleC)
-	}()
+	if err == nil {
+		defer func() {
+			k8sStateUpdates().Delete(id)
+			close(lifecycleC)
+		}()
+	} else {
+		logger.Warn(err.Error())
+	}
 
 	host, errGo := os.Hostname()
 	if errGo != nil {
@@ -78,15 +65,8 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 	for {
 		select {
 		case <-ctx.Done():
-			live.Lock()
-			defer live.Unlock()
-
 			// When shutting down stop all projects
-			for _, quiter := range live.projects {
-				if quiter != nil {
-					quiter()
-				}
-			}
+			live.stopAll()
 			return
 		case state = <-lifecycleC:
 		case <-time.After(qCheck):
@@ -99,14 +79,29 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 				continue
 			}
 
+			if current := amqpURLSetting(); current != amqp || rmq == nil {
+				server, err := connectRMQ(current)
+				if err != nil {
+					logger.Warn("unable to use RMQ server", "error", err.Error())
+					continue
+				}
+				rmq, amqp = server, current
+			}
+
 			// Intentional shadowing with ctx
 			ctx, cancel := context.WithTimeout(ctx, connTimeout)
 
 			// Found returns a map that contains the queues that were found
 			// on the rabbitMQ server specified by the rmq data structure
-			found, err := rmq.GetKnown(ctx, matcher)
+			found, err := rmq.GetKnown(ctx, queueMatcher())
 			cancel()
 
+			for queue := range found {
+				if queueExcluded(queue) {
+					delete(found, queue)
+				}
+			}
+
 			if err != nil {
 				logger.Warn("unable to refresh RMQ manifest", err.Error())
 				qCheck = qCheck * 2
@@ -124,3 +119,24 @@ func serviceRMQ(ctx context.Context, checkInterval time.Duration, connTimeout ti
 		}
 	}
 }
+
+// connectRMQ creates the rabbitMQ server used for an amqp URL
+//
+func connectRMQ(amqp string) (rmq *runner.RabbitMQ, err errors.Error) {
+
+	// NewRabbitMQ takes a URL that has no credentials or tokens attached as the
+	// first parameter and the user name password as the second parameter
+	creds := ""
+	qURL, errGo := url.Parse(os.ExpandEnv(amqp))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("url", amqp).With("stack", stack.Trace().TrimRuntime())
+	}
+	if qURL.User != nil {
+		creds = qURL.User.String()
+	} else {
+		logger.Warn(errors.New("missing credentials in url").With("url", amqp).With("stack", stack.Trace().TrimRuntime()).Error())
+	}
+	qURL.User = nil
+
+	return runner.NewRabbitMQ(qURL.String(), creds)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/runner"
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// This file contains the implementation of a service that retrieves StudioML workloads
+// from Redis streams
+
+var (
+	redisURLOpt = flag.String("redis-url", "", "the URL of a redis server whose streams are read for StudioML work, for example redis://:password@host:6379/0, use rediss:// for TLS")
+)
+
+func serviceRedis(ctx context.Context, checkInterval time.Duration) {
+
+	logger.Debug("starting serviceRedis", stack.Trace().TrimRuntime())
+	defer logger.Debug("stopping serviceRedis", stack.Trace().TrimRuntime())
+
+	if len(redisURLSetting()) == 0 {
+		logger.Info("redis services disabled", stack.Trace().TrimRuntime())
+		return
+	}
+
+	live := &Projects{
+		queueType: "redis",
+		projects:  map[string]context.CancelFunc{},
+	}
+
+	// first time through make sure the server is checked immediately
+	qCheck := time.Duration(time.Second)
+
+	// Watch for when the server should not be getting new work
+	state := runner.K8sStateUpdate{
+		State: types.K8sRunning,
+	}
+
+	lifecycleC := make(chan runner.K8sStateUpdate, 1)
+	id, err := k8sStateUpdates().Add(lifecycleC)
+	if err == nil {
+		defer func() {
+			k8sStateUpdates().Delete(id)
+			close(lifecycleC)
+		}()
+	} else {
+		logger.Warn(fmt.Sprint(err))
+	}
+
+	host, errGo := os.Hostname()
+	if errGo != nil {
+		logger.Warn(errGo.Error())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// When shutting down stop all projects
+			live.stopAll()
+			return
+		case state = <-lifecycleC:
+		case <-time.After(qCheck):
+			qCheck = checkInterval
+
+			// If the pulling of work is currently suspending bail out of checking the queues
+			if state.State != types.K8sRunning {
+				queueIgnored.With(prometheus.Labels{"host": host, "queue_type": live.queueType, "queue_name": "*"}).Inc()
+				continue
+			}
+
+			// The server is the only project, it is determined each time as the runner-config
+			// file can change it
+			found, err := redisServer(redisURLSetting())
+			if err != nil {
+				logger.Warn(err.Error())
+				continue
+			}
+
+			if err := live.Lifecycle(ctx, found); err != nil {
+				logger.Warn(fmt.Sprintf("unable to process %s due to %v", live.queueType, err))
+			}
+		}
+	}
+}
+
+// redisServer returns the project used for a redis server, the credentials are kept out of the
+// project name so that they do not appear in logs or metrics, in the same way as is done for
+// rabbitMQ
+//
+func redisServer(redisURL string) (found map[string]string, err errors.Error) {
+	creds := ""
+	qURL, errGo := url.Parse(os.ExpandEnv(redisURL))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if qURL.User != nil {
+		creds = qURL.User.String()
+	}
+	qURL.User = nil
+
+	return map[string]string{qURL.String(): creds}, nil
+}
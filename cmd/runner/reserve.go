@@ -0,0 +1,215 @@
+package main
+
+// This file contains the implementation of a capacity reservation that sets aside a portion
+// of the machines resources for the exclusive use of queues that match a configured
+// regular expression.  Queues that do not match will see the machines capacity reduced
+// by the unused portion of the reservation.
+
+import (
+	"flag"
+	"regexp"
+	"sync"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	reserveQueueOpt = flag.String("reserve-queue", "", "a regular expression for queue names that are permitted to use the reserved capacity")
+	reserveCPUOpt   = flag.Uint("reserve-cpus", 0, "the number of CPU cores reserved for queues matching reserve-queue")
+	reserveMemOpt   = flag.String("reserve-mem", "0gb", "the amount of RAM reserved for queues matching reserve-queue")
+	reserveGPUOpt   = flag.Uint("reserve-gpus", 0, "the number of GPU slots reserved for queues matching reserve-queue")
+
+	reservation = &capacityReservation{}
+)
+
+// capacityReservation tracks the resources set aside for privileged queues along with
+// the amount of those resources currently being consumed by work from those queues
+//
+type capacityReservation struct {
+	match *regexp.Regexp
+
+	cpus uint
+	mem  uint64
+	gpus uint
+
+	usedCpus uint
+	usedMem  uint64
+	usedGpus uint
+
+	sync.Mutex
+}
+
+// reservationStatus is the externally visible representation of a capacity reservation
+// used when reporting on the runners state
+//
+type reservationStatus struct {
+	Queue    string `json:"queue"`
+	Cpus     uint   `json:"cpus"`
+	Ram      string `json:"ram"`
+	Gpus     uint   `json:"gpus"`
+	UsedCpus uint   `json:"used_cpus"`
+	UsedRam  string `json:"used_ram"`
+	UsedGpus uint   `json:"used_gpus"`
+}
+
+// initReservation loads the capacity reservation from the command line options
+//
+func initReservation() (err errors.Error) {
+	if len(*reserveQueueOpt) == 0 {
+		return nil
+	}
+
+	match, errGo := regexp.Compile(*reserveQueueOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("reserve-queue", *reserveQueueOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	mem, errGo := humanize.ParseBytes(*reserveMemOpt)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("reserve-mem", *reserveMemOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	reservation.Lock()
+	defer reservation.Unlock()
+
+	reservation.match = match
+	reservation.cpus = *reserveCPUOpt
+	reservation.mem = mem
+	reservation.gpus = *reserveGPUOpt
+
+	return nil
+}
+
+// privileged returns true when the named queue is permitted to use the reserved capacity
+//
+func (cr *capacityReservation) privileged(queue string) bool {
+	cr.Lock()
+	defer cr.Unlock()
+	return cr.match != nil && cr.match.MatchString(queue)
+}
+
+// apply takes the free resources of the machine and, for queues that are not privileged,
+// removes the portion of the reservation that is not currently in use by privileged work
+//
+func (cr *capacityReservation) apply(queue string, rsc *runner.Resource) (avail *runner.Resource) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	if cr.match == nil || cr.match.MatchString(queue) {
+		return rsc
+	}
+	return cr.restrict(rsc)
+}
+
+// restrict removes the unused portion of the reservation from the supplied resources,
+// the caller is expected to hold the reservations lock
+//
+func (cr *capacityReservation) restrict(rsc *runner.Resource) (avail *runner.Resource) {
+	avail = rsc.Clone()
+	if avail == nil {
+		return rsc
+	}
+
+	if cr.cpus > cr.usedCpus {
+		avail.Cpus = subUint(avail.Cpus, cr.cpus-cr.usedCpus)
+	}
+	if cr.gpus > cr.usedGpus {
+		avail.Gpus = subUint(avail.Gpus, cr.gpus-cr.usedGpus)
+	}
+	if cr.mem > cr.usedMem {
+		if ram, errGo := humanize.ParseBytes(avail.Ram); errGo == nil {
+			held := cr.mem - cr.usedMem
+			if ram > held {
+				ram -= held
+			} else {
+				ram = 0
+			}
+			avail.Ram = humanize.Bytes(ram)
+		}
+	}
+	return avail
+}
+
+func subUint(left uint, right uint) uint {
+	if left < right {
+		return 0
+	}
+	return left - right
+}
+
+// acquire records resources consumed by work from a privileged queue against the reservation
+//
+func (cr *capacityReservation) acquire(queue string, rsc *runner.Resource) {
+	if rsc == nil || !cr.privileged(queue) {
+		return
+	}
+
+	mem, _ := humanize.ParseBytes(rsc.Ram)
+
+	cr.Lock()
+	defer cr.Unlock()
+
+	cr.usedCpus += rsc.Cpus
+	cr.usedGpus += rsc.Gpus
+	cr.usedMem += mem
+}
+
+// release returns resources previously recorded using acquire
+//
+func (cr *capacityReservation) release(queue string, rsc *runner.Resource) {
+	if rsc == nil || !cr.privileged(queue) {
+		return
+	}
+
+	mem, _ := humanize.ParseBytes(rsc.Ram)
+
+	cr.Lock()
+	defer cr.Unlock()
+
+	cr.usedCpus = subUint(cr.usedCpus, rsc.Cpus)
+	cr.usedGpus = subUint(cr.usedGpus, rsc.Gpus)
+	if cr.usedMem > mem {
+		cr.usedMem -= mem
+	} else {
+		cr.usedMem = 0
+	}
+}
+
+// status returns the reservation and its current utilization, or nil if no reservation
+// has been configured
+//
+func (cr *capacityReservation) status() (status *reservationStatus) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	if cr.match == nil {
+		return nil
+	}
+
+	return &reservationStatus{
+		Queue:    cr.match.String(),
+		Cpus:     cr.cpus,
+		Ram:      humanize.Bytes(cr.mem),
+		Gpus:     cr.gpus,
+		UsedCpus: cr.usedCpus,
+		UsedRam:  humanize.Bytes(cr.usedMem),
+		UsedGpus: cr.usedGpus,
+	}
+}
+
+// unreserved returns the supplied resources with any unused reservation removed
+//
+func (cr *capacityReservation) unreserved(rsc *runner.Resource) (avail *runner.Resource) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	if cr.match == nil {
+		return rsc
+	}
+	return cr.restrict(rsc)
+}
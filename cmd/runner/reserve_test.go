@@ -0,0 +1,66 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+)
+
+// TestCapacityReservation checks that queues outside of a reservation see the machine with the
+// unused part of the reservation removed, that the privileged queue sees all of it, and that
+// work from the privileged queue is reported against the reservation
+//
+func TestCapacityReservation(t *testing.T) {
+
+	cr := &capacityReservation{
+		match: regexp.MustCompile("^urgent"),
+		cpus:  4,
+		mem:   8 * 1000 * 1000 * 1000,
+		gpus:  1,
+	}
+
+	free := &runner.Resource{Cpus: 16, Gpus: 2, Ram: "32 GB"}
+
+	if avail := cr.apply("urgent-jobs", free); avail.Cpus != 16 || avail.Gpus != 2 || avail.Ram != "32 GB" {
+		t.Fatalf("the privileged queue was offered %+v rather than all of %+v", avail, free)
+	}
+
+	avail := cr.apply("batch", free)
+	if avail.Cpus != 12 || avail.Gpus != 1 || avail.Ram != "24 GB" {
+		t.Fatalf("a batch queue was offered %+v, expected 12 cpus, 1 gpu and 24 GB", avail)
+	}
+	if free.Cpus != 16 || free.Ram != "32 GB" {
+		t.Fatalf("the free resources were modified, %+v", free)
+	}
+
+	// Work from the privileged queue uses the reservation before the shared capacity so the
+	// amount held back from other queues shrinks as it is consumed
+	work := &runner.Resource{Cpus: 3, Gpus: 1, Ram: "6 GB"}
+	cr.acquire("batch", work)
+	cr.acquire("urgent-jobs", work)
+
+	free = &runner.Resource{Cpus: 13, Gpus: 1, Ram: "26 GB"}
+	if avail = cr.apply("batch", free); avail.Cpus != 12 || avail.Gpus != 1 || avail.Ram != "24 GB" {
+		t.Fatalf("a batch queue was offered %+v while the reservation was in use, expected 12 cpus, 1 gpu and 24 GB", avail)
+	}
+
+	status := cr.status()
+	if status == nil {
+		t.Fatal("a configured reservation had no status")
+	}
+	if status.Queue != "^urgent" || status.UsedCpus != 3 || status.UsedGpus != 1 || status.UsedRam != "6.0 GB" {
+		t.Fatalf("unexpected reservation status %+v", *status)
+	}
+
+	// Releasing more than was acquired must not wrap the utilization
+	cr.release("urgent-jobs", work)
+	cr.release("urgent-jobs", work)
+	if status = cr.status(); status.UsedCpus != 0 || status.UsedGpus != 0 || status.UsedRam != "0 B" {
+		t.Fatalf("unexpected reservation status %+v after release", *status)
+	}
+
+	if (&capacityReservation{}).status() != nil {
+		t.Fatal("a status was returned without a reservation being configured")
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/leaf-ai/studio-go-runner/internal/runner"
-
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 
@@ -62,13 +60,15 @@ func init() {
 }
 
 func updateGauges() {
-	cores, mem := runner.CPUFree()
+	prober := machine()
+
+	cores, mem := prober.CPUFree()
 	cpuFree.With(prometheus.Labels{"host": host}).Set(float64(cores))
 	ramFree.With(prometheus.Labels{"host": host}).Set(float64(mem))
 
-	free := runner.GetDiskFree()
+	free := prober.DiskFree()
 	diskFree.With(prometheus.Labels{"host": host}).Set(float64(free))
 
-	_, freeGPU := runner.GPUSlots()
+	_, freeGPU := prober.GPUSlots()
 	gpuFree.With(prometheus.Labels{"host": host}).Set(float64(freeGPU))
 }
@@ -0,0 +1,155 @@
+package main
+
+// This file contains the implementation of the completion events that describe the outcome
+// of experiments.  Events are produced when the runner has finished with an experiment and
+// are handed to the result publishers that have been configured, independently of the
+// queues the work came from.  Publishing is done in the background and a failure to publish
+// never alters the outcome of an experiment.
+
+import (
+	"os/exec"
+	"sort"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/karlmutch/errors"
+)
+
+const (
+	resultCompleted = "completed" // The experiment ran to completion
+	resultFailed    = "failed"    // The experiment failed and will not be retried
+	resultRequeued  = "requeued"  // The experiment failed and was returned to its queue to be retried
+
+	resultInterrupted = "interrupted" // The experiment was stopped by the runner shutting down and was returned to its queue
+)
+
+// resultEvent is the structured description of the outcome of running an experiment
+//
+type resultEvent struct {
+	Key        string            `json:"experiment_key"`
+	Project    string            `json:"project"`
+	Queue      string            `json:"queue"`
+	Host       string            `json:"host"`
+	Status     string            `json:"status"`
+	ExitCode   int               `json:"exit_code"`
+	Error      string            `json:"error,omitempty"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Duration   float64           `json:"duration_seconds"`
+	Artifacts  map[string]string `json:"artifacts,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+
+	CachedArtifacts []string `json:"cached_artifacts,omitempty"` // The artifacts the host now holds in its artifact cache, used for affinity hints
+
+	OutputTruncated bool `json:"output_truncated,omitempty"` // Output from the experiment was discarded as it exceeded the output limit
+	NoOutputs       bool `json:"no_outputs,omitempty"`       // The experiment finished without producing any output artifacts
+
+	Requested  *runner.Resource `json:"requested_resources,omitempty"` // The resources the experiment asked for
+	Allocated  *runner.Resource `json:"allocated_resources,omitempty"` // The resources the experiment was given, absent if it was not started
+	Downgraded bool             `json:"downgraded,omitempty"`          // The experiment was given less than it preferred
+
+	Result *runner.ExperimentResult `json:"result,omitempty"` // The final status written to the result line of the experiment output, absent if it was not run
+
+	notify runner.Notify // The destinations the experiment asked to be notified at when it has finished
+}
+
+// exitCode extracts the exit code of the experiment process from the error returned
+// when processing it, -1 is returned if the error did not come from the process exiting
+//
+func exitCode(err errors.Error) (code int) {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// newResultEvent builds the completion event for an experiment once processing has finished
+//
+func newResultEvent(qt *runner.QueueTask, rqst *runner.Request, startedAt time.Time, err errors.Error, ack bool, stopping bool) (event *resultEvent) {
+	finishedAt := time.Now()
+
+	event = &resultEvent{
+		Key:        rqst.Experiment.Key,
+		Project:    rqst.Config.Database.ProjectId,
+		Queue:      qt.Subscription,
+		Host:       host,
+		Status:     resultCompleted,
+		ExitCode:   exitCode(err),
+		StartedAt:  startedAt,
+		FinishedAt: finishedAt,
+		Duration:   finishedAt.Sub(startedAt).Seconds(),
+		Artifacts:  map[string]string{},
+		Metadata:   runner.SanitizeMetadata(rqst.Experiment.Metadata),
+
+		notify: rqst.NotifyDestinations(),
+	}
+	event.Requested = &rqst.Experiment.Resource
+
+	if err != nil {
+		event.Error = err.Error()
+		switch {
+		case ack:
+			event.Status = resultFailed
+		case stopping:
+			event.Status = resultInterrupted
+		default:
+			event.Status = resultRequeued
+		}
+	}
+
+	groups := make([]string, 0, len(rqst.Experiment.Artifacts))
+	for group := range rqst.Experiment.Artifacts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		if art := rqst.Experiment.Artifacts[group]; len(art.Qualified) != 0 {
+			event.Artifacts[group] = art.Qualified
+		}
+	}
+
+	if event.Status == resultCompleted {
+		event.CachedArtifacts = cachedArtifacts(rqst)
+	}
+
+	return event
+}
+
+// allocation records the resources the experiment was given against those it requested
+//
+func (event *resultEvent) allocation(allocated *runner.Resource) {
+	if allocated == nil || event.Requested == nil {
+		return
+	}
+	event.Allocated = allocated
+	event.Downgraded = runner.Downgraded(event.Requested, allocated)
+}
+
+// outcome records the final status of the experiment written to the result line of its output,
+// the exit code it contains is the one the experiment script returned even when processing
+// wrapped the error of the script
+//
+func (event *resultEvent) outcome(result *runner.ExperimentResult) {
+	if result == nil {
+		return
+	}
+	event.Result = result
+	event.ExitCode = result.ExitCode
+}
+
+// publishResult hands a completion event to each of the configured result publishers, and
+// when the experiment has finished to any destinations the experiment asked to be notified at
+//
+func publishResult(event *resultEvent) {
+	recordCompletion(event)
+	kafkaResults.publish(event)
+	lifecycleLogs.stopped(event)
+
+	if event.Status == resultCompleted || event.Status == resultFailed {
+		notify(event)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/karlmutch/errors"
+)
+
+// TestResultOutcome checks that the final status of the experiment from its result line is
+// carried by the completion event, along with the exit code of the experiment script, and that
+// events for experiments that were not run omit it
+//
+func TestResultOutcome(t *testing.T) {
+
+	qt := &runner.QueueTask{Subscription: "queue"}
+	rqst := &runner.Request{}
+	rqst.Experiment.Key = "experiment"
+
+	// Errors from processing wrap the error from the script and so do not carry its exit code
+	event := newResultEvent(qt, rqst, time.Now(), errors.New("experiment failed"), true, false)
+	event.outcome(&runner.ExperimentResult{ExitCode: 3, Status: runner.ResultFailed})
+
+	if event.ExitCode != 3 || event.Status != resultFailed {
+		t.Fatalf("unexpected exit code %d and status %s", event.ExitCode, event.Status)
+	}
+
+	doc := struct {
+		Result *runner.ExperimentResult `json:"result"`
+	}{}
+	encoded, errGo := json.Marshal(event)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = json.Unmarshal(encoded, &doc); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if doc.Result == nil || *doc.Result != (runner.ExperimentResult{ExitCode: 3, Status: runner.ResultFailed}) {
+		t.Fatalf("unexpected result in the completion event %s", string(encoded))
+	}
+
+	// The lifecycle stopped event carries the completion event, and so the result, as is
+	lifecycle, errGo := json.Marshal(&lifecycleEvent{Event: lifecycleStopped, Result: event})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	stopped := struct {
+		Result struct {
+			Result *runner.ExperimentResult `json:"result"`
+		} `json:"result"`
+	}{}
+	if errGo = json.Unmarshal(lifecycle, &stopped); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if stopped.Result.Result == nil || stopped.Result.Result.Status != runner.ResultFailed {
+		t.Fatalf("unexpected result in the lifecycle event %s", string(lifecycle))
+	}
+
+	// Experiments that were not run have no result
+	event = newResultEvent(qt, rqst, time.Now(), errors.New("experiment not started"), true, false)
+	event.outcome(nil)
+	doc.Result = nil
+	if encoded, _ = json.Marshal(event); event.ExitCode != -1 || json.Unmarshal(encoded, &doc) != nil || doc.Result != nil {
+		t.Fatalf("unexpected completion event for an experiment that was not run %s", string(encoded))
+	}
+}
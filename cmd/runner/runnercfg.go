@@ -0,0 +1,259 @@
+package main
+
+// This file contains the implementation of the runner configuration file.  The file holds
+// the patterns selecting the queues the runner services and the credentials used to
+// reach the queue servers, overriding the equivalent command line options.  The file is
+// watched and changes are applied to the running services without a restart, allowing
+// operators to move a fleet between queues.  A change is validated before being applied,
+// and when it is invalid the previous configuration remains in use.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	runnerCfgOpt = flag.String("runner-config", "", "the location of a JSON file containing queue include and exclude patterns, and the credentials used to reach queue servers, that override the queue-match, amqp-url, redis-url, sqs-certs and google-certs options, changes to the file are applied without a restart")
+
+	runnerCfgCheckOpt = flag.Duration("runner-config-check", 15*time.Second, "the interval at which the runner-config file is checked for changes")
+
+	runnerCfg = liveRunnerConfig{}
+)
+
+// runnerConfig is the form in which the runner configuration file is supplied by operators
+//
+type runnerConfig struct {
+	Queues struct {
+		Include []string `json:"include"` // Regular expressions of which at least one must match a queue name for it to be serviced
+		Exclude []string `json:"exclude"` // Regular expressions that prevent a matching queue being serviced
+	} `json:"queues"`
+
+	// Credentials reference the locations of credentials, URLs can refer to environment variables
+	// using ${NAME}
+	Credentials struct {
+		AMQPURL     string `json:"amqp_url"`
+		RedisURL    string `json:"redis_url"`
+		SQSCerts    string `json:"sqs_certs"`
+		GoogleCerts string `json:"google_certs"`
+	} `json:"credentials"`
+}
+
+// runnerSettings is the validated form of a runnerConfig
+//
+type runnerSettings struct {
+	include *regexp.Regexp
+	exclude []*regexp.Regexp
+	cfg     runnerConfig
+}
+
+// liveRunnerConfig holds the settings from the last valid version of the configuration file
+//
+type liveRunnerConfig struct {
+	settings *runnerSettings
+	modified time.Time
+	size     int64
+	sync.Mutex
+}
+
+// parseRunnerConfig validates the contents of a runner configuration file
+//
+func parseRunnerConfig(data []byte) (settings *runnerSettings, err errors.Error) {
+	settings = &runnerSettings{}
+	if errGo := json.Unmarshal(data, &settings.cfg); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	cfg := &settings.cfg
+
+	if len(cfg.Queues.Include) != 0 {
+		alternates := make([]string, 0, len(cfg.Queues.Include))
+		for _, include := range cfg.Queues.Include {
+			if _, errGo := regexp.Compile(include); errGo != nil {
+				return nil, errors.Wrap(errGo, "queues include is invalid").With("include", include).With("stack", stack.Trace().TrimRuntime())
+			}
+			alternates = append(alternates, "(?:"+include+")")
+		}
+		settings.include = regexp.MustCompile(strings.Join(alternates, "|"))
+	}
+	for _, exclude := range cfg.Queues.Exclude {
+		match, errGo := regexp.Compile(exclude)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, "queues exclude is invalid").With("exclude", exclude).With("stack", stack.Trace().TrimRuntime())
+		}
+		settings.exclude = append(settings.exclude, match)
+	}
+
+	for name, value := range map[string]string{"amqp_url": cfg.Credentials.AMQPURL, "redis_url": cfg.Credentials.RedisURL} {
+		if len(value) == 0 {
+			continue
+		}
+		if _, errGo := url.Parse(os.ExpandEnv(value)); errGo != nil {
+			return nil, errors.Wrap(errGo, "credentials "+name+" is invalid").With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	for name, dir := range map[string]string{"sqs_certs": cfg.Credentials.SQSCerts, "google_certs": cfg.Credentials.GoogleCerts} {
+		if len(dir) == 0 {
+			continue
+		}
+		if info, errGo := os.Stat(dir); errGo != nil || !info.IsDir() {
+			return nil, errors.New("credentials "+name+" is not a directory").With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return settings, nil
+}
+
+// reload reads the runner configuration file if it has changed since it was last read,
+// changed is true when a new configuration was applied
+//
+func (rc *liveRunnerConfig) reload() (changed bool, err errors.Error) {
+	if len(*runnerCfgOpt) == 0 {
+		return false, nil
+	}
+
+	info, errGo := os.Stat(*runnerCfgOpt)
+	if errGo != nil {
+		return false, errors.Wrap(errGo).With("file", *runnerCfgOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	if info.ModTime().Equal(rc.modified) && info.Size() == rc.size {
+		return false, nil
+	}
+
+	data, errGo := ioutil.ReadFile(*runnerCfgOpt)
+	if errGo != nil {
+		return false, errors.Wrap(errGo).With("file", *runnerCfgOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// An invalid file is remembered so that the error is only reported once for each change
+	rc.modified = info.ModTime()
+	rc.size = info.Size()
+
+	settings, err := parseRunnerConfig(data)
+	if err != nil {
+		return false, err.With("file", *runnerCfgOpt)
+	}
+	rc.settings = settings
+	return true, nil
+}
+
+// current returns the settings in use, or nil if no configuration file is being used
+//
+func (rc *liveRunnerConfig) current() (settings *runnerSettings) {
+	rc.Lock()
+	defer rc.Unlock()
+	return rc.settings
+}
+
+// loadRunnerConfig reads the runner configuration file, if one was specified, before the
+// services are started
+//
+func loadRunnerConfig() (err errors.Error) {
+	_, err = runnerCfg.reload()
+	return err
+}
+
+// watchRunnerConfig checks the runner configuration file for changes until the context is
+// cancelled
+//
+func watchRunnerConfig(ctx context.Context) {
+	if len(*runnerCfgOpt) == 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*runnerCfgCheckOpt):
+			changed, err := runnerCfg.reload()
+			if err != nil {
+				logger.Warn("runner-config change rejected, the previous configuration remains in use", "error", err.Error())
+				continue
+			}
+			if changed {
+				logger.Info("runner-config change applied", "file", *runnerCfgOpt)
+			}
+		}
+	}
+}
+
+// queueMatcher returns the expression queue names must match to be serviced
+//
+func queueMatcher() (matcher *regexp.Regexp) {
+	if settings := runnerCfg.current(); settings != nil && settings.include != nil {
+		return settings.include
+	}
+	// The queue-match option is validated in the main.go file
+	matcher, _ = regexp.Compile(*queueMatch)
+	return matcher
+}
+
+// queueExcluded tests if a queue has been excluded from being serviced, the queue can be
+// given as a name or using the forms produced by the queue implementations which end in
+// the name
+//
+func queueExcluded(queue string) (excluded bool) {
+	settings := runnerCfg.current()
+	if settings == nil || len(settings.exclude) == 0 {
+		return false
+	}
+	name := queue
+	if i := strings.LastIndexAny(name, "/?"); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, exclude := range settings.exclude {
+		if exclude.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// amqpURLSetting returns the URL of the rabbitMQ server being used
+//
+func amqpURLSetting() (amqp string) {
+	if settings := runnerCfg.current(); settings != nil && len(settings.cfg.Credentials.AMQPURL) != 0 {
+		return settings.cfg.Credentials.AMQPURL
+	}
+	return *amqpURL
+}
+
+// redisURLSetting returns the URL of the redis server being used
+//
+func redisURLSetting() (redis string) {
+	if settings := runnerCfg.current(); settings != nil && len(settings.cfg.Credentials.RedisURL) != 0 {
+		return settings.cfg.Credentials.RedisURL
+	}
+	return *redisURLOpt
+}
+
+// sqsCertsSetting returns the directory holding the AWS credentials being used
+//
+func sqsCertsSetting() (dir string) {
+	if settings := runnerCfg.current(); settings != nil && len(settings.cfg.Credentials.SQSCerts) != 0 {
+		return settings.cfg.Credentials.SQSCerts
+	}
+	return *sqsCertsDirOpt
+}
+
+// googleCertsSetting returns the directory holding the Google credentials being used
+//
+func googleCertsSetting() (dir string) {
+	if settings := runnerCfg.current(); settings != nil && len(settings.cfg.Credentials.GoogleCerts) != 0 {
+		return settings.cfg.Credentials.GoogleCerts
+	}
+	return *googleCertsDirOpt
+}
@@ -0,0 +1,171 @@
+package main
+
+// This file contains the implementation of a registry of the experiments running on this
+// node and the report produced from it when the runner shuts down.  The report lists
+// the experiments that were interrupted, how long they had been running, and whether
+// their messages were returned to the queue so that they will be retried, to help
+// operators reconcile which work needs to be rerun after a deployment.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	shutdownWaitOpt = flag.Duration("shutdown-report-wait", 15*time.Second, "the maximum period of time to wait for interrupted experiments to release their messages before the shutdown report is logged")
+
+	running = newExperimentRegistry()
+)
+
+const (
+	msgPending = "pending" // The experiment had not released its message when the report was produced
+	msgNacked  = "nacked"  // The message was returned to the queue for the experiment to be retried
+	msgAcked   = "acked"   // The message was consumed and will not be retried
+)
+
+// runningExperiment is the registry entry for an experiment that is being processed
+//
+type runningExperiment struct {
+	Key       string    `json:"experiment_key"`
+	Project   string    `json:"project"`
+	Queue     string    `json:"queue"`
+	StartedAt time.Time `json:"started_at"`
+	Elapsed   string    `json:"elapsed"`
+	Message   string    `json:"message"`
+	Cancelled bool      `json:"cancelled,omitempty"` // An operator cancelled the experiment
+	Resumable bool      `json:"resumable,omitempty"` // The experiment checkpoints artifacts it can be resumed from
+
+	cancel context.CancelFunc // Stops the experiment, nil if it cannot be cancelled
+}
+
+// experimentRegistry tracks the experiments that are being processed by this node
+//
+type experimentRegistry struct {
+	experiments map[*runningExperiment]struct{}
+	changed     *sync.Cond
+	sync.Mutex
+}
+
+func newExperimentRegistry() (registry *experimentRegistry) {
+	registry = &experimentRegistry{
+		experiments: map[*runningExperiment]struct{}{},
+	}
+	registry.changed = sync.NewCond(&registry.Mutex)
+	return registry
+}
+
+// add records that an experiment has started, the returned function is called with the
+// fate of the experiments message when processing of it has stopped
+//
+func (registry *experimentRegistry) add(key string, project string, queue string, startedAt time.Time) (done func(ack bool)) {
+	return registry.addCancellable(key, project, queue, startedAt, nil)
+}
+
+// addCancellable records that an experiment has started along with the function that will
+// stop it should its project be cancelled
+//
+func (registry *experimentRegistry) addCancellable(key string, project string, queue string, startedAt time.Time, cancel context.CancelFunc) (done func(ack bool)) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	exp := &runningExperiment{
+		Key:       key,
+		Project:   project,
+		Queue:     queue,
+		StartedAt: startedAt,
+		Message:   msgPending,
+		cancel:    cancel,
+	}
+	registry.experiments[exp] = struct{}{}
+
+	return func(ack bool) {
+		registry.Lock()
+		defer registry.Unlock()
+
+		exp.Message = msgNacked
+		if ack {
+			exp.Message = msgAcked
+		}
+		delete(registry.experiments, exp)
+		registry.changed.Broadcast()
+	}
+}
+
+// snapshot returns a description of the experiments that are running
+//
+func (registry *experimentRegistry) snapshot() (exps []runningExperiment) {
+	now := time.Now()
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	exps = make([]runningExperiment, 0, len(registry.experiments))
+	for exp := range registry.experiments {
+		report := *exp
+		report.Elapsed = now.Sub(exp.StartedAt).Round(time.Second).String()
+		exps = append(exps, report)
+	}
+	sort.Slice(exps, func(i, j int) bool { return exps[i].StartedAt.Before(exps[j].StartedAt) })
+
+	return exps
+}
+
+// interrupted waits for up to the period supplied for the experiments that are running to
+// stop and returns a description of each of them
+//
+func (registry *experimentRegistry) interrupted(wait time.Duration) (exps []runningExperiment) {
+	now := time.Now()
+	deadline := now.Add(wait)
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	tracking := make([]*runningExperiment, 0, len(registry.experiments))
+	for exp := range registry.experiments {
+		tracking = append(tracking, exp)
+	}
+
+	// Wake the waiting loop at the deadline so that it can give up on experiments that
+	// have yet to stop
+	timer := time.AfterFunc(wait, func() {
+		registry.Lock()
+		defer registry.Unlock()
+		registry.changed.Broadcast()
+	})
+	defer timer.Stop()
+
+	for len(registry.experiments) != 0 && time.Now().Before(deadline) {
+		registry.changed.Wait()
+	}
+
+	exps = make([]runningExperiment, 0, len(tracking))
+	for _, exp := range tracking {
+		report := *exp
+		report.Elapsed = now.Sub(exp.StartedAt).Round(time.Second).String()
+		exps = append(exps, report)
+	}
+	sort.Slice(exps, func(i, j int) bool { return exps[i].StartedAt.Before(exps[j].StartedAt) })
+
+	return exps
+}
+
+// reportShutdown logs a summary of the experiments interrupted by the runner stopping
+//
+func reportShutdown(wait time.Duration) {
+	exps := running.interrupted(wait)
+	if len(exps) == 0 {
+		logger.Info("shutdown interrupted no experiments", "host", host)
+		return
+	}
+
+	for _, exp := range exps {
+		logger.Warn("shutdown interrupted experiment", "host", host, "experiment_id", exp.Key, "project_id", exp.Project,
+			"queue", exp.Queue, "elapsed", exp.Elapsed, "message", exp.Message)
+	}
+	summary, _ := json.Marshal(exps)
+	logger.Warn("shutdown interrupted experiments", "host", host, "count", len(exps), "experiments", string(summary))
+}
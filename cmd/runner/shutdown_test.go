@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestShutdownReport checks that the experiments running when the runner stops are reported
+// along with the fate of their messages
+//
+func TestShutdownReport(t *testing.T) {
+
+	registry := newExperimentRegistry()
+
+	done := registry.add("stopped", "project", "queue", time.Now().Add(-time.Minute))
+	registry.add("hung", "project", "queue", time.Now())
+
+	finished := registry.add("finished", "project", "queue", time.Now())
+	finished(true)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		done(false)
+	}()
+
+	exps := registry.interrupted(time.Second)
+	if len(exps) != 2 {
+		t.Fatalf("expected 2 interrupted experiments, %d were reported", len(exps))
+	}
+	if exps[0].Key != "stopped" || exps[0].Message != msgNacked {
+		t.Fatalf("unexpected report for the stopped experiment %#v", exps[0])
+	}
+	if exps[1].Key != "hung" || exps[1].Message != msgPending {
+		t.Fatalf("unexpected report for the hung experiment %#v", exps[1])
+	}
+}
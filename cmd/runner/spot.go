@@ -0,0 +1,276 @@
+package main
+
+// This file contains the implementation of the handling of spot, or preemptible, instance
+// termination notices.  Cloud providers give a short warning before reclaiming these
+// instances, about two minutes on AWS and thirty seconds on GCP.  When a notice is seen
+// the runner is drained, experiments that can be resumed are stopped at once so that
+// their mutable artifacts are checkpointed and their messages returned to the queue,
+// and the remaining experiments are given until shortly before the instance is
+// terminated to finish before they too are stopped and returned to the queue.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	spotNoticeOpt    = flag.String("spot-notice", "", "the cloud whose spot, or preemptible, instance termination notices are polled for, aws, gcp, or auto to poll both, empty disables polling")
+	spotNoticeURLOpt = flag.String("spot-notice-url", "", "overrides the metadata URL polled for termination notices of the cloud selected using spot-notice")
+	spotPollOpt      = flag.Duration("spot-poll", 5*time.Second, "the interval at which the cloud metadata service is polled for termination notices")
+	spotMarginOpt    = flag.Duration("spot-requeue-margin", 15*time.Second, "the period before the instance is terminated that experiments which cannot be resumed are stopped so that their messages are returned to the queue")
+
+	spotClient = &http.Client{Timeout: 2 * time.Second}
+)
+
+// spotSource describes a cloud metadata endpoint that reports termination notices
+//
+type spotSource struct {
+	cloud    string
+	url      string
+	header   map[string]string
+	tokenURL string        // The URL used to obtain an IMDSv2 session token, AWS only
+	lead     time.Duration // The warning typically given before the instance is terminated
+}
+
+var (
+	spotSources = map[string]spotSource{
+		"aws": {
+			cloud:    "aws",
+			url:      "http://169.254.169.254/latest/meta-data/spot/instance-action",
+			tokenURL: "http://169.254.169.254/latest/api/token",
+			lead:     2 * time.Minute,
+		},
+		"gcp": {
+			cloud:  "gcp",
+			url:    "http://metadata.google.internal/computeMetadata/v1/instance/preempted",
+			header: map[string]string{"Metadata-Flavor": "Google"},
+			lead:   30 * time.Second,
+		},
+	}
+)
+
+// validateSpotNotice checks the spot termination notice options
+//
+func validateSpotNotice() (err errors.Error) {
+	switch *spotNoticeOpt {
+	case "", "aws", "gcp", "auto":
+	default:
+		return errors.New("spot-notice must be one of aws, gcp, or auto").With("spot-notice", *spotNoticeOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(*spotNoticeURLOpt) != 0 {
+		if *spotNoticeOpt != "aws" && *spotNoticeOpt != "gcp" {
+			return errors.New("spot-notice-url needs spot-notice to select either aws or gcp").With("spot-notice", *spotNoticeOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		if uri, errGo := url.Parse(*spotNoticeURLOpt); errGo != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
+			return errors.New("spot-notice-url must be an http or https URL").With("spot-notice-url", *spotNoticeURLOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if *spotPollOpt <= 0 {
+		return errors.New("spot-poll must be greater than 0").With("spot-poll", spotPollOpt.String()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// selectedSpotSources returns the endpoints chosen using the spot notice options
+//
+func selectedSpotSources() (sources []spotSource) {
+	switch *spotNoticeOpt {
+	case "aws", "gcp":
+		src := spotSources[*spotNoticeOpt]
+		if len(*spotNoticeURLOpt) != 0 {
+			src.url = *spotNoticeURLOpt
+			src.tokenURL = ""
+		}
+		return []spotSource{src}
+	case "auto":
+		return []spotSource{spotSources["aws"], spotSources["gcp"]}
+	}
+	return nil
+}
+
+// token obtains an IMDSv2 session token, instances that only support IMDSv1 are polled
+// without one
+//
+func (src *spotSource) token(ctx context.Context) (token string) {
+	if len(src.tokenURL) == 0 {
+		return ""
+	}
+	req, errGo := http.NewRequest(http.MethodPut, src.tokenURL, nil)
+	if errGo != nil {
+		return ""
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	resp, errGo := spotClient.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	body, errGo := ioutil.ReadAll(resp.Body)
+	if errGo != nil || resp.StatusCode != http.StatusOK {
+		return ""
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// poll checks the endpoint for a termination notice, returning the time the instance is
+// expected to be terminated when one has been given
+//
+func (src *spotSource) poll(ctx context.Context) (noticed bool, deadline time.Time, err errors.Error) {
+	req, errGo := http.NewRequest(http.MethodGet, src.url, nil)
+	if errGo != nil {
+		return false, deadline, errors.Wrap(errGo).With("url", src.url).With("stack", stack.Trace().TrimRuntime())
+	}
+	for k, v := range src.header {
+		req.Header.Set(k, v)
+	}
+	if token := src.token(ctx); len(token) != 0 {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+
+	resp, errGo := spotClient.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return false, deadline, errors.Wrap(errGo).With("url", src.url).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	body, errGo := ioutil.ReadAll(resp.Body)
+	if errGo != nil {
+		return false, deadline, errors.Wrap(errGo).With("url", src.url).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// AWS returns a 404 until a notice is given, GCP returns FALSE
+	if resp.StatusCode != http.StatusOK {
+		return false, deadline, nil
+	}
+	deadline = time.Now().Add(src.lead)
+
+	switch src.cloud {
+	case "gcp":
+		if !strings.EqualFold(strings.TrimSpace(string(body)), "TRUE") {
+			return false, deadline, nil
+		}
+	case "aws":
+		action := struct {
+			Action string    `json:"action"`
+			Time   time.Time `json:"time"`
+		}{}
+		if errGo = json.Unmarshal(body, &action); errGo == nil && !action.Time.IsZero() {
+			deadline = action.Time
+		}
+	}
+	return true, deadline, nil
+}
+
+// markResumable records that a running experiment can be resumed from its checkpoints
+//
+func (registry *experimentRegistry) markResumable(key string) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for exp := range registry.experiments {
+		if exp.Key == key {
+			exp.Resumable = true
+		}
+	}
+}
+
+// stopRunning stops the running experiments that either can, or cannot, be resumed.  Unlike
+// an operator cancellation the messages of the experiments are returned to their queues.
+//
+func (registry *experimentRegistry) stopRunning(resumable bool) (stopped []runningExperiment) {
+	now := time.Now()
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	for exp := range registry.experiments {
+		if exp.Resumable != resumable || exp.cancel == nil {
+			continue
+		}
+		exp.cancel()
+		report := *exp
+		report.Elapsed = now.Sub(exp.StartedAt).Round(time.Second).String()
+		stopped = append(stopped, report)
+	}
+	sort.Slice(stopped, func(i, j int) bool { return stopped[i].StartedAt.Before(stopped[j].StartedAt) })
+	return stopped
+}
+
+// resumable returns true when an experiment has mutable artifacts that are checkpointed when
+// it is stopped, and so can continue from the checkpoint when it is run again
+//
+func resumable(rqst *runner.Request) (resumable bool) {
+	for group, art := range rqst.Experiment.Artifacts {
+		if art.Mutable && len(art.Qualified) != 0 && group != "output" && group != "_metadata" {
+			return true
+		}
+	}
+	return false
+}
+
+// spotTerminate drains the runner and stops its experiments ahead of the instance being
+// terminated at the deadline supplied
+//
+func spotTerminate(ctx context.Context, deadline time.Time, margin time.Duration) {
+	logger.Warn("instance termination notice, draining", "host", host, "deadline", deadline.Format(time.RFC3339))
+	lifecycle.retire()
+	recheckLifecycle()
+
+	for _, exp := range running.stopRunning(true) {
+		logger.Warn("instance terminating, checkpointing experiment", "host", host, "experiment_id", exp.Key, "project_id", exp.Project, "elapsed", exp.Elapsed)
+	}
+
+	// Experiments that cannot be resumed are given as long as possible to complete
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Until(deadline.Add(-margin))):
+	}
+	for _, exp := range running.stopRunning(false) {
+		logger.Warn("instance terminating, requeuing experiment", "host", host, "experiment_id", exp.Key, "project_id", exp.Project, "elapsed", exp.Elapsed)
+	}
+}
+
+// watchSpotNotice polls the cloud metadata service for termination notices until one is seen
+// or the runner stops
+//
+func watchSpotNotice(ctx context.Context, sources []spotSource, interval time.Duration, margin time.Duration) {
+	if len(sources) == 0 {
+		return
+	}
+
+	check := time.NewTicker(interval)
+	defer check.Stop()
+
+	for {
+		for i := range sources {
+			noticed, deadline, err := sources[i].poll(ctx)
+			if err != nil {
+				logger.Trace("termination notice poll failed", "cloud", sources[i].cloud, "error", err.Error())
+				continue
+			}
+			if noticed {
+				spotTerminate(ctx, deadline, margin)
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-check.C:
+		}
+	}
+}
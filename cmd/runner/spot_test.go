@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/leaf-ai/studio-go-runner/internal/types"
+)
+
+// TestSpotNoticePoll checks that termination notices are recognized in the forms used by
+// the AWS and GCP metadata services
+//
+func TestSpotNoticePoll(t *testing.T) {
+
+	terminating := int32(0)
+	terminateAt := time.Now().Add(90 * time.Second).UTC().Truncate(time.Second)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/aws":
+			if atomic.LoadInt32(&terminating) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, `{"action": "terminate", "time": "%s"}`, terminateAt.Format(time.RFC3339))
+		case "/gcp":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				http.Error(w, "missing header", http.StatusForbidden)
+				return
+			}
+			if atomic.LoadInt32(&terminating) == 0 {
+				fmt.Fprint(w, "FALSE")
+				return
+			}
+			fmt.Fprint(w, "TRUE")
+		}
+	}))
+	defer server.Close()
+
+	aws := spotSources["aws"]
+	aws.url, aws.tokenURL = server.URL+"/aws", ""
+	gcp := spotSources["gcp"]
+	gcp.url = server.URL + "/gcp"
+
+	ctx := context.Background()
+	for _, src := range []spotSource{aws, gcp} {
+		noticed, _, err := src.poll(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if noticed {
+			t.Fatalf("%s notice seen before one was given", src.cloud)
+		}
+	}
+
+	atomic.StoreInt32(&terminating, 1)
+
+	noticed, deadline, err := aws.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !noticed || !deadline.Equal(terminateAt) {
+		t.Fatalf("aws notice not recognized %v %v", noticed, deadline)
+	}
+	noticed, deadline, err = gcp.poll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !noticed || time.Until(deadline) > gcp.lead {
+		t.Fatalf("gcp notice not recognized %v %v", noticed, deadline)
+	}
+}
+
+// TestSpotTerminate checks that a termination notice drains the runner, stops experiments that
+// can be resumed at once, and stops the others shortly before the instance is terminated
+//
+func TestSpotTerminate(t *testing.T) {
+
+	defer func() {
+		lifecycle.Lock()
+		lifecycle.retiring = false
+		lifecycle.resolve()
+		lifecycle.Unlock()
+	}()
+
+	resumed, finished := int32(0), int32(0)
+	doneResumable := running.addCancellable("spot-resumable", "project", "queue", time.Now(), func() { atomic.StoreInt32(&resumed, 1) })
+	defer doneResumable(false)
+	running.markResumable("spot-resumable")
+	doneOther := running.addCancellable("spot-other", "project", "queue", time.Now(), func() { atomic.StoreInt32(&finished, 1) })
+	defer doneOther(false)
+
+	margin := time.Second
+	stoppedC := make(chan struct{})
+	go func() {
+		spotTerminate(context.Background(), time.Now().Add(margin+500*time.Millisecond), margin)
+		close(stoppedC)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&resumed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("resumable experiment was not stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state, _ := lifecycle.get(); state != types.K8sDrainAndSuspend {
+		t.Fatalf("runner was not drained %v", state)
+	}
+	if atomic.LoadInt32(&finished) != 0 {
+		t.Fatal("experiment that cannot be resumed was stopped before the requeue margin")
+	}
+
+	select {
+	case <-stoppedC:
+	case <-time.After(5 * time.Second):
+		t.Fatal("experiments were not stopped ahead of the termination")
+	}
+	if atomic.LoadInt32(&finished) == 0 {
+		t.Fatal("experiment that cannot be resumed was not stopped")
+	}
+}
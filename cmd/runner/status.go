@@ -0,0 +1,101 @@
+package main
+
+// This file contains the implementation of http handlers that report the state of the
+// runner as JSON documents for use by operators and external tooling
+
+import (
+	"encoding/json"
+	"net/http"
+
+	runner "github.com/leaf-ai/studio-go-runner/internal/runner"
+
+	"github.com/dustin/go-humanize"
+)
+
+// runnerStatus is the document returned by the status endpoint
+//
+type runnerStatus struct {
+	Host        string               `json:"host"`
+	CUDA        *runner.CUDAVersions `json:"cuda,omitempty"`
+	Reservation *reservationStatus   `json:"reservation,omitempty"`
+}
+
+// currentStatus returns the current state of the runner
+//
+func currentStatus() (status runnerStatus) {
+	status = runnerStatus{
+		Host:        host,
+		Reservation: reservation.status(),
+	}
+	if versions := runner.GetCUDAVersions(); versions != (runner.CUDAVersions{}) {
+		status.CUDA = &versions
+	}
+	return status
+}
+
+// statusHandler returns the current state of the runner as JSON
+//
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentStatus())
+}
+
+// resourcesStatus is the document returned by the resources endpoint.  Unreserved
+// contains the free resources as the capacity check for queues that cannot use the
+// reservation would see them.
+//
+type resourcesStatus struct {
+	Host        string                   `json:"host"`
+	Resources   *runner.ResourceSnapshot `json:"resources"`
+	Unreserved  *runner.Resource         `json:"unreserved"`
+	Reservation *reservationStatus       `json:"reservation,omitempty"`
+}
+
+// resourcesHandler returns the capacity, allocated, and free resources of the runner
+// along with the resources held by each running experiment
+//
+func resourcesHandler(w http.ResponseWriter, r *http.Request) {
+	snap := runner.SnapshotResources()
+
+	free := &runner.Resource{
+		Cpus:   snap.Free.Cpus,
+		Ram:    humanize.Bytes(snap.Free.Ram),
+		Gpus:   snap.Free.Gpus,
+		Hdd:    humanize.Bytes(snap.Free.Disk),
+		GpuMem: humanize.Bytes(runner.LargestFreeGPUMem()),
+	}
+
+	writeJSON(w, resourcesStatus{
+		Host:        host,
+		Resources:   snap,
+		Unreserved:  reservation.unreserved(free),
+		Reservation: reservation.status(),
+	})
+}
+
+// healthStatus is the document returned by the health endpoint
+//
+type healthStatus struct {
+	Host              string `json:"host"`
+	State             string `json:"state"`
+	MaintenanceWindow string `json:"maintenance_window,omitempty"`
+}
+
+// healthHandler returns the lifecycle state of the runner along with any maintenance window
+// that is currently active
+//
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	state, window := lifecycle.get()
+
+	writeJSON(w, healthStatus{
+		Host:              host,
+		State:             state.String(),
+		MaintenanceWindow: window,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, doc interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if errGo := json.NewEncoder(w).Encode(doc); errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusInternalServerError)
+	}
+}
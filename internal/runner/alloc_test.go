@@ -300,3 +300,120 @@ func TestCUDALargeAlloc(t *testing.T) {
 		}
 	}
 }
+
+// TestCUDAPackedAlloc checks that experiments sharing a GPU are packed onto a device until its
+// memory is exhausted and that whole board allocations are kept off packed devices
+//
+func TestCUDAPackedAlloc(t *testing.T) {
+	card := xid.New().String()
+
+	testAlloc := gpuTracker{
+		Allocs: map[string]*GPUTrack{
+			card: {
+				UUID:      card,
+				Slots:     4,
+				Mem:       16,
+				FreeSlots: 4,
+				FreeMem:   16,
+				Tracking:  map[string]struct{}{},
+			},
+		},
+	}
+
+	packed := GPUAllocations{}
+	for i := 0; i != 3; i++ {
+		allocs, err := testAlloc.PackGPU(5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed = append(packed, allocs...)
+	}
+
+	// The board has 1 unit of memory left so neither packing nor whole board allocation should succeed
+	if _, err := testAlloc.PackGPU(5); err == nil {
+		t.Fatal(errors.New("packing succeeded with insufficient memory").With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, err := testAlloc.AllocGPU(4, 1, []uint{4}); err == nil {
+		t.Fatal(errors.New("whole board allocation succeeded on a packed device").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	for _, anAlloc := range packed {
+		if err := testAlloc.ReturnGPU(anAlloc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once the packed allocations are returned the board is available as a whole
+	allocs, err := testAlloc.AllocGPU(4, 16, []uint{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whole board allocations in turn prevent the device from being packed
+	if _, err := testAlloc.PackGPU(1); err == nil {
+		t.Fatal(errors.New("packing succeeded on a device with a whole board allocation").With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	for _, anAlloc := range allocs {
+		if err = testAlloc.ReturnGPU(anAlloc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestCPURangeAlloc checks that requests using a range are given as much as is free up to
+// their preferred amount and are refused only when their minimum cannot be met
+//
+func TestCPURangeAlloc(t *testing.T) {
+
+	cpuTrack.Lock()
+	softMaxCores, softMaxMem, allocCores, allocMem, initErr := cpuTrack.SoftMaxCores, cpuTrack.SoftMaxMem, cpuTrack.AllocCores, cpuTrack.AllocMem, cpuTrack.InitErr
+	cpuTrack.SoftMaxCores, cpuTrack.SoftMaxMem, cpuTrack.AllocCores, cpuTrack.AllocMem, cpuTrack.InitErr = 8, 8*1024, 0, 0, nil
+	cpuTrack.Unlock()
+
+	defer func() {
+		cpuTrack.Lock()
+		cpuTrack.SoftMaxCores, cpuTrack.SoftMaxMem, cpuTrack.AllocCores, cpuTrack.AllocMem, cpuTrack.InitErr = softMaxCores, softMaxMem, allocCores, allocMem, initErr
+		cpuTrack.Unlock()
+	}()
+
+	first, err := AllocCPU(6, 6*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only 2 cores and 2K remain, less than preferred but above the minimums
+	ranged, err := AllocCPURange(2, 4, 1024, 4*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ranged.Cores() != 2 || ranged.Mem() != 2*1024 {
+		t.Fatalf("ranged allocation given %d cores and %d memory, expected 2 and 2048", ranged.Cores(), ranged.Mem())
+	}
+	ranged.Release()
+
+	// A minimum above what is free is refused
+	if alloc, err := AllocCPURange(3, 4, 1024, 4*1024); err == nil {
+		alloc.Release()
+		t.Fatal("allocation below the minimum cores succeeded")
+	}
+
+	// With room to spare the preferred amounts are given
+	first.Release()
+	if ranged, err = AllocCPURange(2, 4, 1024, 4*1024); err != nil {
+		t.Fatal(err)
+	}
+	if ranged.Cores() != 4 || ranged.Mem() != 4*1024 {
+		t.Fatalf("ranged allocation given %d cores and %d memory, expected 4 and 4096", ranged.Cores(), ranged.Mem())
+	}
+	ranged.Release()
+
+	// Fitting uses the minimums of ranges
+	rsc := &Resource{Cpus: 4, MinCpus: 2, Ram: "4gb", MinRam: "1gb", Hdd: "1gb"}
+	if fit, err := rsc.Fit(&Resource{Cpus: 2, Ram: "2gb", Hdd: "1gb"}); err != nil || !fit {
+		t.Fatalf("ranged request did not fit a node meeting its minimums, error %v", err)
+	}
+	if fit, _ := rsc.Fit(&Resource{Cpus: 1, Ram: "2gb", Hdd: "1gb"}); fit {
+		t.Fatal("ranged request fitted a node below its minimum cores")
+	}
+}
@@ -0,0 +1,118 @@
+package runner
+
+// This file contains the reporting of the resources given to an experiment.  Requests using
+// ranges, and GPU packing, can result in an experiment receiving less than it preferred.
+// The resources given are described using the same form as those requested so that the
+// two can be compared by the experiment, in its telemetry, and in completion events.
+
+import (
+	"encoding/json"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// Slots returns the number of GPU slots given by the allocations
+//
+func (allocs GPUAllocations) Slots() (slots uint) {
+	for _, alloc := range allocs {
+		slots += alloc.slots
+	}
+	return slots
+}
+
+// Mem returns the amount of GPU memory given by the allocations
+//
+func (allocs GPUAllocations) Mem() (mem uint64) {
+	for _, alloc := range allocs {
+		mem += alloc.mem
+	}
+	return mem
+}
+
+// UUIDs returns the identifiers of the GPU devices the allocations were made against
+//
+func (allocs GPUAllocations) UUIDs() (uuids []string) {
+	for _, alloc := range allocs {
+		uuids = append(uuids, alloc.uuid)
+	}
+	return uuids
+}
+
+// AllocatedResource describes the resources given by an allocation made for the requested
+// resources.  Shared memory is reported separately from the RAM, as it is requested.
+//
+func AllocatedResource(alloc *Allocated, requested *Resource) (allocated *Resource) {
+	allocated = &Resource{
+		Shm:      requested.Shm,
+		GpuShare: requested.GpuShare,
+		Cuda:     requested.Cuda,
+		Cudnn:    requested.Cudnn,
+	}
+	if alloc == nil {
+		return allocated
+	}
+
+	if alloc.CPU != nil {
+		ram := alloc.CPU.Mem()
+		if shm, err := ShmSize(requested); err == nil && shm < ram {
+			ram -= shm
+		}
+		allocated.Cpus = alloc.CPU.Cores()
+		allocated.Ram = humanize.Bytes(ram)
+	}
+
+	allocated.Gpus = alloc.GPU.Slots()
+	if mem := alloc.GPU.Mem(); mem != 0 {
+		allocated.GpuMem = humanize.Bytes(mem)
+	}
+
+	if alloc.Disk != nil {
+		allocated.Hdd = humanize.Bytes(alloc.Disk.size)
+	}
+	return allocated
+}
+
+// Downgraded tests if the allocated resources are less than the preferred amounts that were
+// requested
+//
+func Downgraded(requested *Resource, allocated *Resource) (downgraded bool) {
+	if allocated.Cpus < requested.Cpus {
+		return true
+	}
+	if !requested.GpuShare && allocated.Gpus < requested.Gpus {
+		return true
+	}
+	less := func(req string, alloc string) bool {
+		reqBytes, errGo := humanize.ParseBytes(req)
+		if errGo != nil || reqBytes == 0 {
+			return false
+		}
+		allocBytes, _ := humanize.ParseBytes(alloc)
+		return allocBytes < reqBytes
+	}
+	return less(requested.Ram, allocated.Ram) || less(requested.GpuMem, allocated.GpuMem)
+}
+
+// allocationTelemetry produces the JSON telemetry line describing the resources requested by,
+// and given to, an experiment quoted for use by bash
+//
+func allocationTelemetry(alloc *Allocated, requested *Resource) (quoted string, err errors.Error) {
+	allocated := AllocatedResource(alloc, requested)
+
+	doc, errGo := json.Marshal(map[string]interface{}{
+		"studioml": map[string]interface{}{
+			"resources": map[string]interface{}{
+				"requested":  requested,
+				"allocated":  allocated,
+				"downgraded": Downgraded(requested, allocated),
+			},
+		},
+	})
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return shellQuote(string(doc)), nil
+}
@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+)
+
+// TestAllocationReport checks that the resources given to an experiment are reported against
+// those requested, and that experiments given less than they preferred are identified
+//
+func TestAllocationReport(t *testing.T) {
+
+	const gb = uint64(1000 * 1000 * 1000)
+
+	requested := &Resource{Cpus: 8, MinCpus: 2, Ram: "16gb", MinRam: "4gb", Gpus: 2, GpuMem: "8gb", Hdd: "10gb", Shm: "1gb"}
+
+	alloc := &Allocated{
+		CPU:  &CPUAllocated{cores: 4, mem: 9 * gb},
+		GPU:  GPUAllocations{{slots: 1, mem: 4 * gb}, {slots: 1, mem: 4 * gb}},
+		Disk: &DiskAllocated{size: 10 * gb},
+	}
+
+	allocated := AllocatedResource(alloc, requested)
+	if allocated.Cpus != 4 || allocated.Ram != "8.0 GB" || allocated.Gpus != 2 || allocated.GpuMem != "8.0 GB" || allocated.Hdd != "10 GB" {
+		t.Fatalf("unexpected allocated resources %+v", *allocated)
+	}
+	if !Downgraded(requested, allocated) {
+		t.Fatal("experiment given fewer cores and less RAM was not reported as downgraded")
+	}
+
+	full := &Allocated{
+		CPU: &CPUAllocated{cores: 8, mem: 17 * gb},
+		GPU: GPUAllocations{{slots: 2, mem: 8 * gb}},
+	}
+	if allocated = AllocatedResource(full, requested); Downgraded(requested, allocated) {
+		t.Fatalf("experiment given its preferred resources was reported as downgraded %+v", *allocated)
+	}
+
+	// The telemetry line must survive being echoed by the experiment script
+	quoted, err := allocationTelemetry(alloc, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, errGo := exec.Command("bash", "-c", "echo "+quoted).Output()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	doc := struct {
+		Studioml struct {
+			Resources struct {
+				Allocated  Resource `json:"allocated"`
+				Downgraded bool     `json:"downgraded"`
+			} `json:"resources"`
+		} `json:"studioml"`
+	}{}
+	if errGo = json.Unmarshal(output, &doc); errGo != nil {
+		t.Fatal(errGo, string(output))
+	}
+	if !doc.Studioml.Resources.Downgraded || doc.Studioml.Resources.Allocated.Cpus != 4 {
+		t.Fatalf("unexpected telemetry %s", string(output))
+	}
+}
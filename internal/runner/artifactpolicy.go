@@ -0,0 +1,154 @@
+package runner
+
+// This file contains the implementation of the retry and timeout policies used when downloading
+// artifacts.  Artifacts an experiment cannot run without are retried a number of times before the
+// experiment fails, optional artifacts, those marked as optional or mutable, are given a single
+// attempt, with a timeout when the optional-artifact-timeout option is set, so that a missing
+// optional artifact does not hold up the experiment.  Mutable artifacts such as checkpoints can
+// be large and so are not given a timeout by default.  Experiments can override the policy for
+// each of their artifacts.
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	artifactRetriesOpt         = flag.Int("artifact-retries", 3, "the number of times the download of a required artifact is retried after a failure")
+	artifactTimeoutOpt         = flag.Duration("artifact-timeout", 0, "the maximum period of time for each attempt to download a required artifact, 0 waits indefinitely")
+	optionalArtifactRetriesOpt = flag.Int("optional-artifact-retries", 0, "the number of times the download of an optional, or mutable, artifact is retried after a failure")
+	optionalArtifactTimeoutOpt = flag.Duration("optional-artifact-timeout", 0, "the maximum period of time for each attempt to download an optional, or mutable, artifact, 0 waits indefinitely")
+
+	// artifactRetryBackoff is the initial period waited between download attempts, it doubles
+	// with each attempt
+	artifactRetryBackoff = time.Second
+)
+
+const (
+	// artifactRetryBackoffMax is the longest period waited between download attempts
+	artifactRetryBackoffMax = 30 * time.Second
+)
+
+// ArtifactPolicy describes how hard the runner tries to download an artifact
+//
+type ArtifactPolicy struct {
+	Optional bool          // The experiment can proceed without the artifact
+	Retries  int           // The number of times a failed download is retried
+	Timeout  time.Duration // The maximum period of time for each attempt, 0 for no limit
+}
+
+// IsOptional returns true when an experiment can proceed without the artifact, artifacts that
+// are mutable are typically outputs that do not yet exist and so are treated as optional
+//
+func (art *Artifact) IsOptional() (optional bool) {
+	return art.Optional || art.Mutable
+}
+
+// Policy returns the download policy for the artifact using the overrides the experiment
+// supplied and the runner defaults for required and optional artifacts
+//
+func (art *Artifact) Policy() (policy ArtifactPolicy, err errors.Error) {
+	policy = ArtifactPolicy{
+		Optional: art.IsOptional(),
+		Retries:  *artifactRetriesOpt,
+		Timeout:  *artifactTimeoutOpt,
+	}
+	if policy.Optional {
+		policy.Retries = *optionalArtifactRetriesOpt
+		policy.Timeout = *optionalArtifactTimeoutOpt
+	}
+
+	if art.Retries != nil {
+		if *art.Retries < 0 {
+			return policy, errors.New("artifact retries must not be negative").With("key", art.Key, "retries", *art.Retries).With("stack", stack.Trace().TrimRuntime())
+		}
+		policy.Retries = *art.Retries
+	}
+	if len(art.Timeout) != 0 {
+		timeout, errGo := time.ParseDuration(art.Timeout)
+		if errGo != nil {
+			return policy, errors.Wrap(errGo, "artifact timeout is invalid").With("key", art.Key, "timeout", art.Timeout).With("stack", stack.Trace().TrimRuntime())
+		}
+		if timeout < 0 {
+			return policy, errors.New("artifact timeout must not be negative").With("key", art.Key, "timeout", art.Timeout).With("stack", stack.Trace().TrimRuntime())
+		}
+		policy.Timeout = timeout
+	}
+	return policy, nil
+}
+
+// FetchRetry retrieves an artifact in the same way as FetchVerify, applying the retry and
+// timeout policy of the artifact.  The failures of attempts that were retried are returned
+// as warnings.
+//
+func (cache *ArtifactCache) FetchRetry(ctx context.Context, art *Artifact, projectId string, group string, cred string, env map[string]string, dir string,
+	verifier *Verifier) (warns []errors.Error, err errors.Error) {
+
+	policy, err := art.Policy()
+	if err != nil {
+		return warns, err.With("group", group)
+	}
+
+	backoff := artifactRetryBackoff
+	for attempt := 0; ; attempt++ {
+		attemptWarns, err := cache.fetchAttempt(ctx, art, projectId, group, cred, env, dir, verifier, policy.Timeout)
+		warns = append(warns, attemptWarns...)
+		if err == nil {
+			return warns, nil
+		}
+		if attempt >= policy.Retries || ctx.Err() != nil {
+			return warns, err.With("attempts", attempt+1, "optional", policy.Optional)
+		}
+		warns = append(warns, err.With("attempt", attempt+1))
+
+		select {
+		case <-ctx.Done():
+			return warns, err.With("attempts", attempt+1, "optional", policy.Optional)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > artifactRetryBackoffMax {
+			backoff = artifactRetryBackoffMax
+		}
+	}
+}
+
+// fetchAttempt makes a single attempt at downloading an artifact within the timeout supplied.
+// The attempt context is always released when the attempt returns, verification of a successful
+// download that continues after this function returns uses the context of the caller.
+//
+func (cache *ArtifactCache) fetchAttempt(ctx context.Context, art *Artifact, projectId string, group string, cred string, env map[string]string, dir string,
+	verifier *Verifier, timeout time.Duration) (warns []errors.Error, err errors.Error) {
+
+	if timeout <= 0 {
+		return cache.FetchVerify(ctx, art, projectId, group, cred, env, dir, verifier)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(context.WithValue(ctx, verifyCtxKey{}, ctx), timeout)
+	defer cancel()
+
+	warns, err = cache.FetchVerify(attemptCtx, art, projectId, group, cred, env, dir, verifier)
+
+	if err != nil && attemptCtx.Err() == context.DeadlineExceeded {
+		err = err.With("timeout", timeout.String())
+	}
+	return warns, err
+}
+
+// verifyCtxKey is the context key holding the context that verification outliving a download
+// attempt uses
+//
+type verifyCtxKey struct{}
+
+// verifyContext returns the context verification of a download is done using, this is the
+// context of the download unless the download was made by an attempt with a timeout
+//
+func verifyContext(ctx context.Context) (verifyCtx context.Context) {
+	if parent, ok := ctx.Value(verifyCtxKey{}).(context.Context); ok {
+		return parent
+	}
+	return ctx
+}
@@ -0,0 +1,154 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestArtifactPolicy checks that required and optional artifacts are given the runner defaults
+// and that experiments can override them for individual artifacts
+//
+func TestArtifactPolicy(t *testing.T) {
+
+	policy, err := (&Artifact{Key: "workspace.tar"}).Policy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Optional || policy.Retries != *artifactRetriesOpt || policy.Timeout != *artifactTimeoutOpt {
+		t.Fatalf("unexpected policy for a required artifact %+v", policy)
+	}
+
+	for _, art := range []*Artifact{{Key: "output.tar", Mutable: true}, {Key: "cache.tar", Optional: true}} {
+		if policy, err = art.Policy(); err != nil {
+			t.Fatal(err)
+		}
+		if !policy.Optional || policy.Retries != *optionalArtifactRetriesOpt || policy.Timeout != *optionalArtifactTimeoutOpt {
+			t.Fatalf("unexpected policy for optional artifact %s %+v", art.Key, policy)
+		}
+	}
+
+	retries := 7
+	if policy, err = (&Artifact{Key: "cache.tar", Optional: true, Retries: &retries, Timeout: "90s"}).Policy(); err != nil {
+		t.Fatal(err)
+	}
+	if policy.Retries != retries || policy.Timeout != 90*time.Second {
+		t.Fatalf("artifact overrides were not used %+v", policy)
+	}
+
+	if _, err = (&Artifact{Key: "cache.tar", Timeout: "soon"}).Policy(); err == nil {
+		t.Fatal("invalid artifact timeout was accepted")
+	}
+	retries = -1
+	if _, err = (&Artifact{Key: "cache.tar", Retries: &retries}).Policy(); err == nil {
+		t.Fatal("negative artifact retries were accepted")
+	}
+}
+
+// TestArtifactRetry checks that failed downloads are retried up to the number of times in the
+// artifact policy
+//
+func TestArtifactRetry(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "artifact-retry")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	saved := artifactRetryBackoff
+	artifactRetryBackoff = 100 * time.Millisecond
+	defer func() {
+		artifactRetryBackoff = saved
+	}()
+
+	cache := NewArtifactCache()
+	ctx := context.Background()
+
+	// An optional artifact that is missing is given a single attempt
+	missing := filepath.Join(dir, "missing.txt")
+	none := 0
+	art := &Artifact{Key: missing, Qualified: "file:///" + missing, Optional: true, Retries: &none}
+	_, err := cache.FetchRetry(ctx, art, "project", "cache", "", map[string]string{}, filepath.Join(dir, "optional"), nil)
+	if err == nil {
+		t.Fatal("missing artifact was fetched")
+	}
+	if !strings.Contains(err.Error(), "attempts=1") {
+		t.Fatalf("optional artifact was retried %v", err)
+	}
+
+	// A required artifact that appears while the download is being retried is fetched
+	late := filepath.Join(dir, "late.txt")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(late, []byte("0123456789\n"), 0600)
+	}()
+	retries := 3
+	art = &Artifact{Key: late, Qualified: "file:///" + late, Retries: &retries}
+	exprDir := filepath.Join(dir, "required")
+	warns, err := cache.FetchRetry(ctx, art, "project", "data", "", map[string]string{}, exprDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retried := false
+	for _, warn := range warns {
+		retried = retried || strings.Contains(warn.Error(), "attempt=1")
+	}
+	if !retried {
+		t.Fatalf("failed attempts were not returned as warnings %v", warns)
+	}
+	if _, errGo = os.Stat(filepath.Join(exprDir, "data", "late.txt")); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestArtifactAttemptContext checks that an attempt with a timeout releases its context when it
+// returns while the verification of the download it started continues using the callers context
+//
+func TestArtifactAttemptContext(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "artifact-attempt")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	if verifyContext(ctx) != ctx {
+		t.Fatal("verification of a download without an attempt context changed context")
+	}
+	attemptCtx, cancel := context.WithCancel(context.WithValue(ctx, verifyCtxKey{}, ctx))
+	cancel()
+	if verifyContext(attemptCtx).Err() != nil {
+		t.Fatal("verification used the released attempt context")
+	}
+
+	data := []byte("0123456789\n")
+	plain := filepath.Join(dir, "data.txt")
+	if errGo = ioutil.WriteFile(plain, data, 0600); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	sum := sha256.Sum256(data)
+
+	verifier := NewVerifier()
+	art := &Artifact{Key: plain, Qualified: "file:///" + plain, Hash: "sha256:" + hex.EncodeToString(sum[:])}
+	exprDir := filepath.Join(dir, "expr")
+	if _, err := NewArtifactCache().fetchAttempt(ctx, art, "project", "data", "", map[string]string{}, exprDir, verifier, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = os.Stat(filepath.Join(exprDir, "data", "data.txt")); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
@@ -123,6 +123,15 @@ func (cache *ArtifactCache) Hash(ctx context.Context, art *Artifact, projectId s
 // passing through the lens of a caching filter that prevents unneeded downloads.
 //
 func (cache *ArtifactCache) Fetch(ctx context.Context, art *Artifact, projectId string, group string, cred string, env map[string]string, dir string) (warns []errors.Error, err errors.Error) {
+	return cache.FetchVerify(ctx, art, projectId, group, cred, env, dir, nil)
+}
+
+// FetchVerify retrieves an artifact in the same way as Fetch.  Artifacts that have a checksum
+// are verified before being unpacked, when a verifier is supplied the verification is done
+// by its workers after this function returns and its result is obtained from the verifier.
+//
+func (cache *ArtifactCache) FetchVerify(ctx context.Context, art *Artifact, projectId string, group string, cred string, env map[string]string, dir string,
+	verifier *Verifier) (warns []errors.Error, err errors.Error) {
 
 	errors := errors.With("artifact", fmt.Sprintf("%#v", *art)).With("project", projectId).With("group", group)
 
@@ -152,6 +161,11 @@ func (cache *ArtifactCache) Fetch(ctx context.Context, art *Artifact, projectId
 		return warns, errors.New("the unpack flag was set for an unsupported file format (tar gzip/bzip2 only supported)").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	if algo, digest, isPresent := ArtifactChecksum(art); isPresent && group != "_metadata" {
+		defer storage.Close()
+		return cache.fetchVerified(ctx, storage, art, group, algo, digest, dir, dest, verifier)
+	}
+
 	switch group {
 	case "_metadata":
 		warns, err = storage.Gather(ctx, "metadata/", dest)
@@ -163,6 +177,7 @@ func (cache *ArtifactCache) Fetch(ctx context.Context, art *Artifact, projectId
 	if err != nil {
 		return warns, errors.Wrap(err)
 	}
+	art.Resolved = storage.Resolved()
 
 	// Immutable artifacts need just to be downloaded and nothing else
 	if !art.Mutable && !strings.HasPrefix(art.Qualified, "file://") {
@@ -224,7 +239,7 @@ func (cache *ArtifactCache) Local(group string, dir string, file string) (fn str
 
 // Restore the artifacts that have been marked mutable and that have changed
 //
-func (cache *ArtifactCache) Restore(ctx context.Context, art *Artifact, projectId string, group string, cred string, env map[string]string, dir string) (uploaded bool, warns []errors.Error, err errors.Error) {
+func (cache *ArtifactCache) Restore(ctx context.Context, art *Artifact, projectId string, group string, cred string, env map[string]string, dir string, tags map[string]string) (uploaded bool, warns []errors.Error, err errors.Error) {
 
 	// Immutable artifacts need just to be downloaded and nothing else
 	if !art.Mutable {
@@ -250,6 +265,7 @@ func (cache *ArtifactCache) Restore(ctx context.Context, art *Artifact, projectI
 			Creds:     cred,
 			Env:       env,
 			Validate:  true,
+			Tags:      tags,
 		},
 		cache.ErrorC)
 	if err != nil {
@@ -0,0 +1,212 @@
+package runner
+
+// This file contains the verification of artifacts that were supplied with a checksum.  An
+// artifact with a checksum is downloaded as is and its checksum computed before it is
+// unpacked.  Checksums are computed by a bounded pool of workers so that the artifacts
+// already downloaded are checked while the remainder are still being downloaded.
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	artifactHashWorkersOpt = flag.Int("artifact-hash-workers", 4, "the maximum number of artifact checksums computed at the same time for an experiment")
+)
+
+// ArtifactChecksum extracts the algorithm and hex digest from the hash of an artifact, artifacts
+// with a hash that is not prefixed using sha256:, md5:, or crc32c: are not verified
+//
+func ArtifactChecksum(art *Artifact) (algo string, digest string, isPresent bool) {
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(art.Hash)), ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return "", "", false
+	}
+	switch parts[0] {
+	case "sha256", "md5", "crc32c":
+		return parts[0], parts[1], true
+	}
+	return "", "", false
+}
+
+// checkArtifactSum computes the checksum of a downloaded artifact and compares it with the
+// one that was expected
+//
+func checkArtifactSum(fn string, algo string, digest string) (err errors.Error) {
+	var h hash.Hash
+	switch algo {
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	case "crc32c":
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	default:
+		return errors.New("artifact checksum algorithm not recognized").With("algorithm", algo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer f.Close()
+
+	if _, errGo = io.Copy(h, f); errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != digest {
+		return errors.New("artifact checksum mismatch").With("expected", algo+":"+digest, "actual", algo+":"+actual).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Verifier checks the checksums of the artifacts of an experiment using a bounded number of
+// workers.  Failures of required artifacts are returned by Wait, failures of artifacts that
+// are not required are returned as warnings.
+//
+type Verifier struct {
+	workers chan struct{}
+	wait    sync.WaitGroup
+
+	err   errors.Error
+	warns []errors.Error
+	sync.Mutex
+}
+
+// NewVerifier creates a verifier using the number of workers given by the artifact-hash-workers
+// option
+//
+func NewVerifier() (verifier *Verifier) {
+	workers := *artifactHashWorkersOpt
+	if workers < 1 {
+		workers = 1
+	}
+	return &Verifier{
+		workers: make(chan struct{}, workers),
+	}
+}
+
+// verify runs a check once a worker is available without blocking the caller
+//
+func (v *Verifier) verify(required bool, check func() errors.Error) {
+	v.wait.Add(1)
+	go func() {
+		defer v.wait.Done()
+
+		v.workers <- struct{}{}
+		err := check()
+		<-v.workers
+
+		if err == nil {
+			return
+		}
+
+		v.Lock()
+		defer v.Unlock()
+		if !required {
+			v.warns = append(v.warns, err)
+			return
+		}
+		if v.err == nil {
+			v.err = err
+		}
+	}()
+}
+
+// Err returns the first failure of a required artifact seen so far, it can be used to stop
+// downloading other artifacts early
+//
+func (v *Verifier) Err() (err errors.Error) {
+	v.Lock()
+	defer v.Unlock()
+	return v.err
+}
+
+// Wait blocks until all of the checks have completed
+//
+func (v *Verifier) Wait() (warns []errors.Error, err errors.Error) {
+	v.wait.Wait()
+
+	v.Lock()
+	defer v.Unlock()
+	return v.warns, v.err
+}
+
+// fetchVerified downloads an artifact that has a checksum without unpacking it, once the
+// checksum has been verified the artifact is unpacked, or moved, into the destination
+//
+func (cache *ArtifactCache) fetchVerified(ctx context.Context, storage *ObjStore, art *Artifact, group string, algo string, digest string,
+	dir string, dest string, verifier *Verifier) (warns []errors.Error, err errors.Error) {
+
+	staging := filepath.Join(dir, ".verify", group)
+	if errGo := os.MkdirAll(staging, 0700); errGo != nil {
+		return warns, errors.Wrap(errGo).With("dir", staging).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if warns, err = storage.Fetch(ctx, art.Key, false, staging); err != nil {
+		os.RemoveAll(staging)
+		return warns, err
+	}
+	download := filepath.Join(staging, filepath.Base(art.Key))
+	art.Resolved = storage.Resolved()
+
+	// The check can run after the caller has moved on and reused the artifact, and after
+	// the context of a download attempt has been released
+	artifact := *art
+	art = &artifact
+	ctx = verifyContext(ctx)
+
+	check := func() (err errors.Error) {
+		defer os.RemoveAll(staging)
+
+		if err = checkArtifactSum(download, algo, digest); err != nil {
+			return err.With("group", group, "key", art.Key)
+		}
+
+		if !art.Unpack {
+			if errGo := os.Rename(download, filepath.Join(dest, filepath.Base(art.Key))); errGo != nil {
+				return errors.Wrap(errGo).With("group", group, "file", download).With("stack", stack.Trace().TrimRuntime())
+			}
+		} else {
+			local, err := NewStorage(ctx, &StoreOpts{
+				Art: &Artifact{
+					Qualified: "file:///" + download,
+				},
+				Validate: true,
+			})
+			if err != nil {
+				return err.With("group", group)
+			}
+			defer local.Close()
+
+			if _, err = local.Fetch(ctx, download, true, dest, nil); err != nil {
+				return err.With("group", group, "key", art.Key)
+			}
+		}
+
+		if cache != nil && (art.Mutable || strings.HasPrefix(art.Qualified, "file://")) {
+			return cache.updateHash(dest)
+		}
+		return nil
+	}
+
+	// Without a verifier the check is done before returning
+	if verifier == nil {
+		return warns, check()
+	}
+	verifier.verify(!art.IsOptional(), check)
+	return warns, nil
+}
@@ -0,0 +1,145 @@
+package runner
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestArtifactVerify checks that artifacts with checksums are unpacked once verified, that a
+// mismatch on a required artifact fails the fetch, and that mismatches on mutable artifacts
+// are only reported as warnings
+//
+func TestArtifactVerify(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "artifact-verify")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	// Create an archive containing a single file and a plain file to act as artifacts
+	archive := filepath.Join(dir, "workspace.tar")
+	f, errGo := os.Create(archive)
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	content := []byte("print('hello')\n")
+	tw := tar.NewWriter(f)
+	if errGo = tw.WriteHeader(&tar.Header{Name: "main.py", Mode: 0600, Size: int64(len(content))}); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo = tw.Write(content); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	tw.Close()
+	f.Close()
+
+	plain := filepath.Join(dir, "data.txt")
+	if errGo = ioutil.WriteFile(plain, []byte("0123456789\n"), 0600); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	archiveData, _ := ioutil.ReadFile(archive)
+	archiveSum := sha256.Sum256(archiveData)
+	plainData, _ := ioutil.ReadFile(plain)
+	plainSum := crc32.Checksum(plainData, crc32.MakeTable(crc32.Castagnoli))
+
+	cache := NewArtifactCache()
+	ctx := context.Background()
+
+	fetch := func(exprDir string, verifier *Verifier, arts map[string]*Artifact) (err errors.Error) {
+		for group, art := range arts {
+			if _, err = cache.FetchVerify(ctx, art, "project", group, "", map[string]string{}, exprDir, verifier); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Artifacts with good checksums verified by the worker pool
+	exprDir := filepath.Join(dir, "good")
+	verifier := NewVerifier()
+	err := fetch(exprDir, verifier, map[string]*Artifact{
+		"workspace": {
+			Key:       archive,
+			Qualified: "file:///" + archive,
+			Hash:      "sha256:" + hex.EncodeToString(archiveSum[:]),
+			Unpack:    true,
+		},
+		"data": {
+			Key:       plain,
+			Qualified: "file:///" + plain,
+			Hash:      fmt.Sprintf("CRC32C:%08x", plainSum),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = os.Stat(filepath.Join(exprDir, "workspace", "main.py")); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo = os.Stat(filepath.Join(exprDir, "data", "data.txt")); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if _, errGo = os.Stat(filepath.Join(exprDir, ".verify")); errGo == nil {
+		if entries, _ := ioutil.ReadDir(filepath.Join(exprDir, ".verify")); len(entries) != 0 {
+			t.Fatal("artifact verification staging files were not removed")
+		}
+	}
+
+	// A bad checksum on a mutable artifact is a warning while one on a required artifact fails
+	exprDir = filepath.Join(dir, "bad")
+	verifier = NewVerifier()
+	err = fetch(exprDir, verifier, map[string]*Artifact{
+		"workspace": {
+			Key:       archive,
+			Qualified: "file:///" + archive,
+			Hash:      "sha256:" + hex.EncodeToString(make([]byte, sha256.Size)),
+			Unpack:    true,
+		},
+		"output": {
+			Key:       plain,
+			Qualified: "file:///" + plain,
+			Hash:      "crc32c:00000000",
+			Mutable:   true,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	warns, err := verifier.Wait()
+	if err == nil {
+		t.Fatal("required artifact with a bad checksum was accepted")
+	}
+	if len(warns) != 1 {
+		t.Fatalf("expected a warning for the mutable artifact, got %v", warns)
+	}
+	if _, errGo = os.Stat(filepath.Join(exprDir, "workspace", "main.py")); errGo == nil {
+		t.Fatal("artifact with a bad checksum was unpacked")
+	}
+
+	// Without a verifier the check is done before the fetch returns
+	if err = fetch(filepath.Join(dir, "inline"), nil, map[string]*Artifact{
+		"data": {
+			Key:       plain,
+			Qualified: "file:///" + plain,
+			Hash:      "md5:00000000000000000000000000000000",
+		},
+	}); err == nil {
+		t.Fatal("artifact with a bad checksum was accepted")
+	}
+}
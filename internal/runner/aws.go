@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -24,57 +25,148 @@ import (
 type AWSCred struct {
 	Project string
 	Region  string
+	Profile string // The profile within the credentials file that the credentials were loaded from
 	Creds   *credentials.Credentials
 }
 
 // AWSExtractCreds can be used to populate a set of credentials from a pair of config and
-// credentials files typicall found in the ~/.aws directory by AWS clients
+// credentials files typicall found in the ~/.aws directory by AWS clients.  When the files
+// hold more than one profile the credentials of the default profile are returned.
 //
 func AWSExtractCreds(filenames []string) (cred *AWSCred, err errors.Error) {
+	creds, err := AWSExtractCredSets(filenames)
+	if err != nil {
+		return nil, err
+	}
+	return creds[0], nil
+}
 
-	cred = &AWSCred{
-		Project: fmt.Sprintf("aws_%s", filepath.Base(filepath.Dir(filenames[0]))),
+// AWSExtractCredSets populates the credentials for every account and region described by the
+// files supplied.  Files are grouped into pairs of config and credentials files using the
+// directory they are in.  Within a pair every profile of the credentials file becomes a
+// set of credentials using the region of the matching profile in the config file, or the
+// region of the default profile when it has none of its own.  Sets are returned with the
+// default profile first followed by the other profiles in name order, in the order the
+// directories were supplied.
+//
+func AWSExtractCredSets(filenames []string) (creds []*AWSCred, err errors.Error) {
+	if len(filenames) == 0 {
+		return nil, errors.New("no credential files supplied").With("stack", stack.Trace().TrimRuntime())
 	}
 
-	credsDone := false
+	project := fmt.Sprintf("aws_%s", filepath.Base(filepath.Dir(filenames[0])))
 
-	// AWS Does not read the region automatically from the config so lets read it here
+	dirs := []string{}
+	pairs := map[string][]string{}
 	for _, aFile := range filenames {
-		wasConfig := func() bool {
-			f, err := os.Open(aFile)
+		dir := filepath.Dir(aFile)
+		if _, isPresent := pairs[dir]; !isPresent {
+			dirs = append(dirs, dir)
+		}
+		pairs[dir] = append(pairs[dir], aFile)
+	}
+
+	for _, dir := range dirs {
+		regions := map[string]string{}
+		credFile := ""
+		profiles := []string{}
+
+		// AWS Does not read the region automatically from the config so lets read it here
+		for _, aFile := range pairs[dir] {
+			sections, err := awsSections(aFile)
 			if err != nil {
-				return false
+				continue
 			}
-			if len(cred.Region) == 0 {
-				scan := bufio.NewScanner(f)
-				for scan.Scan() {
-					line := scan.Text()
-					if strings.HasPrefix(strings.ToLower(line), "region=") {
-						tokens := strings.SplitN(line, "=", 2)
-						cred.Region = tokens[1]
-						return true
-					}
+			wasConfig := false
+			for profile, values := range sections {
+				if region, isPresent := values["region"]; isPresent {
+					regions[profile] = region
+					wasConfig = true
 				}
 			}
+			if !wasConfig && len(credFile) == 0 {
+				credFile = aFile
+				for profile := range sections {
+					profiles = append(profiles, profile)
+				}
+			}
+		}
 
-			f.Close()
-			return false
-		}()
+		if len(regions) == 0 {
+			return nil, errors.New("none of the supplied files defined a region").With("stack", stack.Trace().TrimRuntime()).With("files", pairs[dir])
+		}
+		if len(credFile) == 0 {
+			return nil, errors.New("credentials never loaded").With("stack", stack.Trace().TrimRuntime()).With("files", pairs[dir])
+		}
 
-		if !credsDone && !wasConfig {
-			cred.Creds = credentials.NewSharedCredentials(aFile, "default")
-			credsDone = true
+		sort.Slice(profiles, func(i, j int) bool {
+			if profiles[i] == "default" || profiles[j] == "default" {
+				return profiles[i] == "default"
+			}
+			return profiles[i] < profiles[j]
+		})
+		for _, profile := range profiles {
+			region, isPresent := regions[profile]
+			if !isPresent {
+				if region, isPresent = regions["default"]; !isPresent {
+					return nil, errors.New("profile has no region").With("stack", stack.Trace().TrimRuntime()).With("files", pairs[dir], "profile", profile)
+				}
+			}
+			creds = append(creds, &AWSCred{
+				Project: project,
+				Region:  region,
+				Profile: profile,
+				Creds:   credentials.NewSharedCredentials(credFile, profile),
+			})
 		}
 	}
 
-	if len(cred.Region) == 0 {
-		return nil, errors.New("none of the supplied files defined a region").With("stack", stack.Trace().TrimRuntime()).With("files", filenames)
+	if len(creds) == 0 {
+		return nil, errors.New("credentials never loaded").With("stack", stack.Trace().TrimRuntime()).With("files", filenames)
 	}
+	return creds, nil
+}
 
-	if !credsDone {
-		return nil, errors.New("credentials never loaded").With("stack", stack.Trace().TrimRuntime()).With("files", filenames)
+// awsSections reads the profiles, and their values, from an AWS config or credentials file.
+// Values that appear before any profile belong to the default profile, and the profile
+// prefix used by config files is removed from the profile names.
+//
+func awsSections(fn string) (sections map[string]map[string]string, err errors.Error) {
+	f, errGo := os.Open(fn)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
+	}
+	defer f.Close()
+
+	sections = map[string]map[string]string{}
+	profile := "default"
+
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			profile = strings.TrimSpace(strings.TrimPrefix(strings.Trim(line, "[]"), "profile "))
+			if _, isPresent := sections[profile]; !isPresent {
+				sections[profile] = map[string]string{}
+			}
+			continue
+		}
+		tokens := strings.SplitN(line, "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		if _, isPresent := sections[profile]; !isPresent {
+			sections[profile] = map[string]string{}
+		}
+		sections[profile][strings.ToLower(strings.TrimSpace(tokens[0]))] = strings.TrimSpace(tokens[1])
+	}
+	if errGo = scan.Err(); errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("file", fn)
 	}
-	return cred, nil
+	return sections, nil
 }
 
 // IsAWS can detect if pods running within a Kubernetes cluster are actually being hosted on an EC2 instance
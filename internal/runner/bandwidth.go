@@ -0,0 +1,157 @@
+package runner
+
+// This file contains the implementation of the cap placed on the bandwidth used to upload
+// artifacts to object stores.  Large checkpoints uploaded by many experiments at once can
+// saturate the egress of a node, interfering with other nodes sharing the link, and cause
+// spikes in the egress charges of cloud providers.  The bodies of requests made by the
+// storage clients are read through a token bucket shared by all uploads on the runner so
+// that their combined rate stays within the cap, the experiments themselves are not
+// throttled.
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	uploadBandwidthOpt = flag.String("upload-bandwidth", "", "the maximum combined rate, in bytes per second, at which artifacts are uploaded to object stores across all experiments, for example 50MiB, empty or 0 is unlimited")
+
+	uploadBucket *tokenBucket
+)
+
+const (
+	// bandwidthChunk is the largest read passed through the bucket at once so that
+	// concurrent uploads interleave
+	bandwidthChunk = 32 * 1024
+)
+
+// tokenBucket meters bytes at a fixed rate allowing a burst of up to a second of traffic.
+// Callers reserve the bytes they send and wait until the bucket has refilled to cover
+// them, so concurrent callers share the rate in the order they arrived.
+//
+type tokenBucket struct {
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(rate uint64) (tb *tokenBucket) {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes can be sent without exceeding the rate of the bucket
+//
+func (tb *tokenBucket) wait(ctx context.Context, n int) (errGo error) {
+	tb.Lock()
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+	tb.tokens -= float64(n)
+	delay := time.Duration(0)
+	if tb.tokens < 0 {
+		delay = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ValidateUploadBandwidth checks the upload-bandwidth option and prepares the bucket shared
+// by uploads, the rate is returned and is 0 when uploads are not limited
+//
+func ValidateUploadBandwidth() (rate uint64, err errors.Error) {
+	uploadBucket = nil
+	if len(*uploadBandwidthOpt) == 0 {
+		return 0, nil
+	}
+	rate, errGo := humanize.ParseBytes(*uploadBandwidthOpt)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo, "upload-bandwidth is invalid").With("upload-bandwidth", *uploadBandwidthOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if rate == 0 {
+		return 0, nil
+	}
+	uploadBucket = newTokenBucket(rate)
+	return rate, nil
+}
+
+// limitUploads wraps a transport so that the bodies of the requests it makes are read at no
+// more than the upload bandwidth, the transport is returned unchanged when there is no limit
+//
+func limitUploads(base http.RoundTripper) (transport http.RoundTripper) {
+	if uploadBucket == nil {
+		return base
+	}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &uploadTransport{base: base, bucket: uploadBucket}
+}
+
+// uploadTransport meters the bodies of requests through a token bucket
+//
+type uploadTransport struct {
+	base   http.RoundTripper
+	bucket *tokenBucket
+}
+
+func (t *uploadTransport) RoundTrip(req *http.Request) (resp *http.Response, errGo error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return t.base.RoundTrip(req)
+	}
+	// Transports must not modify the request they are given
+	metered := req.Clone(req.Context())
+	metered.Body = &meteredBody{ReadCloser: req.Body, ctx: req.Context(), bucket: t.bucket}
+	return t.base.RoundTrip(metered)
+}
+
+// meteredBody waits on the bucket for the bytes read from a request body
+//
+type meteredBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (body *meteredBody) Read(p []byte) (n int, errGo error) {
+	if len(p) > bandwidthChunk {
+		p = p[:bandwidthChunk]
+	}
+	n, errGo = body.ReadCloser.Read(p)
+	if n > 0 {
+		if errWait := body.bucket.wait(body.ctx, n); errWait != nil {
+			return n, errWait
+		}
+	}
+	return n, errGo
+}
@@ -0,0 +1,74 @@
+package runner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestUploadBandwidth checks that concurrent uploads share the upload bandwidth and that their
+// bodies arrive intact
+//
+func TestUploadBandwidth(t *testing.T) {
+	saved := *uploadBandwidthOpt
+	defer func() {
+		*uploadBandwidthOpt = saved
+		ValidateUploadBandwidth()
+	}()
+
+	*uploadBandwidthOpt = "not a rate"
+	if _, err := ValidateUploadBandwidth(); err == nil {
+		t.Fatal("invalid upload-bandwidth accepted")
+	}
+
+	*uploadBandwidthOpt = "256KiB"
+	rate, err := ValidateUploadBandwidth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 256*1024 {
+		t.Fatalf("upload-bandwidth parsed as %d", rate)
+	}
+
+	received := make(chan int, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		received <- len(data)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: limitUploads(nil)}
+	payload := bytes.Repeat([]byte{'x'}, 384*1024)
+
+	// The first second of traffic is a burst, the remaining 512KiB of the two uploads takes at
+	// least two seconds at the limit
+	started := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, errGo := client.Post(server.URL, "application/octet-stream", bytes.NewReader(payload))
+			if errGo != nil {
+				t.Error(errGo)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	for i := 0; i < 2; i++ {
+		if size := <-received; size != len(payload) {
+			t.Fatalf("upload received with %d of %d bytes", size, len(payload))
+		}
+	}
+	if elapsed < 1800*time.Millisecond {
+		t.Fatalf("uploads not limited, took %v", elapsed)
+	}
+}
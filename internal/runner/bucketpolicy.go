@@ -0,0 +1,94 @@
+package runner
+
+// This file contains the implementation of the operator supplied allow-list of the
+// buckets that experiments can download artifacts from and upload artifacts to.  When
+// the list is used experiments naming other buckets are rejected before any data is
+// transferred.
+
+import (
+	"flag"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	artifactAllowOpt = flag.String("artifact-allow", "", "a comma separated list of glob patterns of the buckets experiments can use for artifacts, for example s3://minio.example.com:9000/studioml-*,gs://my-models, patterns without a scheme match the host and bucket of S3 artifacts, or the bucket of GCS artifacts, empty allows any bucket")
+)
+
+const (
+	bucketNotAllowed = "artifact bucket is not in the artifact-allow list"
+)
+
+// artifactTarget returns the scheme and bucket used by an artifact, S3 buckets include the
+// host holding them as a bucket name is only unique for a single endpoint
+//
+func artifactTarget(art *Artifact) (scheme string, target string, err errors.Error) {
+	uri, errGo := url.ParseRequestURI(art.Qualified)
+	if errGo != nil {
+		return "", "", errors.Wrap(errGo).With("qualified", art.Qualified).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	switch uri.Scheme {
+	case "gs":
+		bucket := art.Bucket
+		if len(bucket) == 0 {
+			bucket = uri.Host
+		}
+		return uri.Scheme, bucket, nil
+	case "s3":
+		bucket := art.Bucket
+		if len(bucket) == 0 {
+			if uriPath := strings.Split(uri.EscapedPath(), "/"); len(uriPath) > 1 {
+				bucket = uriPath[1]
+			}
+		}
+		return uri.Scheme, uri.Host + "/" + bucket, nil
+	}
+	return uri.Scheme, "", nil
+}
+
+// CheckArtifactAllowed returns an error if the artifact uses a bucket that is not in the
+// allow-list, artifacts held on the local file system are not subject to the list
+//
+func CheckArtifactAllowed(art *Artifact) (err errors.Error) {
+	if len(strings.TrimSpace(*artifactAllowOpt)) == 0 || len(art.Qualified) == 0 {
+		return nil
+	}
+
+	scheme, target, err := artifactTarget(art)
+	if err != nil {
+		return err
+	}
+	if scheme == "file" {
+		return nil
+	}
+
+	for _, pattern := range strings.Split(*artifactAllowOpt, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 0 {
+			continue
+		}
+		if matched, _ := path.Match(pattern, scheme+"://"+target); matched {
+			return nil
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return nil
+		}
+	}
+	return errors.New(bucketNotAllowed).With("qualified", art.Qualified, "bucket", scheme+"://"+target).With("stack", stack.Trace().TrimRuntime())
+}
+
+// ValidateArtifactAllow checks that the patterns in the allow-list can be used for matching
+//
+func ValidateArtifactAllow() (err errors.Error) {
+	for _, pattern := range strings.Split(*artifactAllowOpt, ",") {
+		if _, errGo := path.Match(strings.TrimSpace(pattern), ""); errGo != nil {
+			return errors.Wrap(errGo, "artifact-allow contains an invalid pattern").With("pattern", pattern).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
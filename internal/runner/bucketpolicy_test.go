@@ -0,0 +1,47 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestArtifactAllow checks the matching of artifact buckets against the allow-list
+//
+func TestArtifactAllow(t *testing.T) {
+	allow := *artifactAllowOpt
+	*artifactAllowOpt = "s3://minio.example.com:9000/studioml-*, gs://models, data.example.com/shared"
+	defer func() {
+		*artifactAllowOpt = allow
+	}()
+
+	cases := map[string]bool{
+		"s3://minio.example.com:9000/studioml-output/experiment/output.tar": true,
+		"s3://minio.example.com:9000/private/experiment/output.tar":         false,
+		"s3://other.example.com:9000/studioml-output/experiment/output.tar": false,
+		"gs://models/resnet/weights.tar":                                    true,
+		"gs://other-models/resnet/weights.tar":                              false,
+		"s3://data.example.com/shared/dataset.tar":                          true,
+		"file:///tmp/experiment/output.tar":                                 true,
+	}
+	for qualified, allowed := range cases {
+		err := CheckArtifactAllowed(&Artifact{Qualified: qualified})
+		if allowed != (err == nil) {
+			t.Fatalf("%s expected allowed %v, error %v", qualified, allowed, err)
+		}
+	}
+
+	// An explicit bucket takes precedence over the one in the URL
+	if err := CheckArtifactAllowed(&Artifact{Qualified: "s3://minio.example.com:9000/studioml-output/output.tar", Bucket: "private"}); err == nil {
+		t.Fatal("artifact with a bucket outside of the allow-list was allowed")
+	}
+
+	rqst := &Request{}
+	rqst.Experiment.Key = "allow-list"
+	rqst.Experiment.PythonVer = "3.6"
+	rqst.Experiment.Artifacts = map[string]Artifact{
+		"output": {Qualified: "s3://minio.example.com:9000/private/experiment/output.tar"},
+	}
+	if err := rqst.Validate(); err == nil || !strings.Contains(err.Error(), bucketNotAllowed) {
+		t.Fatalf("request with an artifact outside of the allow-list was not rejected, %v", err)
+	}
+}
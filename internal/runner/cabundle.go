@@ -0,0 +1,183 @@
+package runner
+
+// This file contains the implementation of an additional CA bundle trusted by the runner and
+// by experiments, for example the CA of a corporate proxy that inspects TLS traffic.  The
+// bundle is combined with the system roots into a single file that the runner points the
+// SSL_CERT_FILE variable of its own process at, so that every TLS client it constructs
+// trusts the bundle, including those created by the cloud SDKs.  The same file is exported
+// to experiments using the variables python, pip, and curl read.
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	caBundleOpt = flag.String("ca-bundle", "", "the file name of a PEM bundle of additional certificate authorities trusted by every HTTPS client of the runner and exported to experiments")
+
+	// systemRootFiles are the locations of the system roots checked in order, these are the
+	// same locations the go standard library uses on Linux
+	systemRootFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+
+	// caBundleFile is the combined bundle, empty when no ca-bundle was given
+	caBundleFile = ""
+
+	// caBundlePEM holds the certificates of the ca-bundle
+	caBundlePEM = []byte{}
+
+	// caBundleRoots holds the system roots and the ca-bundle, nil when no ca-bundle was given
+	// so that clients fall back to the system roots
+	caBundleRoots *x509.CertPool
+
+	// caBundleEnvs are the experiment variables pointed at the combined bundle
+	caBundleEnvs = []string{"SSL_CERT_FILE", "REQUESTS_CA_BUNDLE", "PIP_CERT", "CURL_CA_BUNDLE"}
+)
+
+// LoadCABundle validates the ca-bundle option and when set writes the combined bundle into
+// dir and has the runner trust it.  It is called at startup before any TLS connections are
+// made.  The name of the combined bundle is returned, empty if no bundle was given.
+//
+func LoadCABundle(dir string) (fn string, err errors.Error) {
+	if len(*caBundleOpt) == 0 {
+		return "", nil
+	}
+
+	bundle, errGo := ioutil.ReadFile(*caBundleOpt)
+	if errGo != nil {
+		return "", errors.Wrap(errGo, "ca-bundle could not be read").With("ca-bundle", *caBundleOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if err = validateCABundle(bundle); err != nil {
+		return "", err.With("ca-bundle", *caBundleOpt)
+	}
+
+	// The system roots come first so that the bundle only adds to them
+	combined := []byte{}
+	roots := append([]string{os.Getenv("SSL_CERT_FILE")}, systemRootFiles...)
+	for _, root := range roots {
+		if len(root) == 0 || root == caBundleFile {
+			continue
+		}
+		if data, errGo := ioutil.ReadFile(root); errGo == nil {
+			combined = append(data, '\n')
+			break
+		}
+	}
+	combined = append(combined, bundle...)
+
+	// The file is named using its contents so that runners sharing a directory agree on it
+	sum := sha256.Sum256(combined)
+	fn = filepath.Join(dir, fmt.Sprintf("ca-bundle-%x.pem", sum[:8]))
+	if err = writeCABundle(fn, combined); err != nil {
+		return "", err
+	}
+
+	// Clients using the system roots pick up the combined file, the default transport is
+	// also given the roots in case the system roots were loaded before this point
+	if errGo = os.Setenv("SSL_CERT_FILE", fn); errGo != nil {
+		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	pool, errGo := x509.SystemCertPool()
+	if errGo != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	pool.AppendCertsFromPEM(combined)
+
+	if transport, isTransport := http.DefaultTransport.(*http.Transport); isTransport {
+		config := &tls.Config{}
+		if transport.TLSClientConfig != nil {
+			config = transport.TLSClientConfig.Clone()
+		}
+		config.RootCAs = pool
+		transport.TLSClientConfig = config
+	}
+
+	caBundleFile = fn
+	caBundlePEM = bundle
+	caBundleRoots = pool
+	return fn, nil
+}
+
+// validateCABundle checks that every block of the bundle is a certificate that can be parsed
+// and that there is at least one
+//
+func validateCABundle(bundle []byte) (err errors.Error) {
+	certs := 0
+	for block, rest := pem.Decode(bundle); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certs++
+		if _, errGo := x509.ParseCertificate(block.Bytes); errGo != nil {
+			return errors.Wrap(errGo, "ca-bundle contains an invalid certificate").With("certificate", certs).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if certs == 0 {
+		return errors.New("ca-bundle contains no PEM certificates").With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// writeCABundle writes the combined bundle readable by experiments that run as other users
+//
+func writeCABundle(fn string, combined []byte) (err errors.Error) {
+	tmp, errGo := ioutil.TempFile(filepath.Dir(fn), ".ca-bundle-")
+	if errGo != nil {
+		return errors.Wrap(errGo).With("dir", filepath.Dir(fn)).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, errGo = tmp.Write(combined); errGo != nil {
+		tmp.Close()
+		return errors.Wrap(errGo).With("file", tmp.Name()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = tmp.Close(); errGo != nil {
+		return errors.Wrap(errGo).With("file", tmp.Name()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = os.Chmod(tmp.Name(), 0644); errGo != nil {
+		return errors.Wrap(errGo).With("file", tmp.Name()).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo = os.Rename(tmp.Name(), fn); errGo != nil {
+		return errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// appendCABundle adds the certificates of the ca-bundle to a pool built by a client that
+// does not use the system roots
+//
+func appendCABundle(pool *x509.CertPool) {
+	if len(caBundlePEM) != 0 {
+		pool.AppendCertsFromPEM(caBundlePEM)
+	}
+}
+
+// caBundleEnv returns the variables pointing experiments at the combined bundle
+//
+func caBundleEnv() (envs map[string]string) {
+	envs = map[string]string{}
+	if len(caBundleFile) == 0 {
+		return envs
+	}
+	for _, name := range caBundleEnvs {
+		envs[name] = caBundleFile
+	}
+	return envs
+}
@@ -0,0 +1,80 @@
+package runner
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCABundle checks that a server signed by a certificate from the ca-bundle is trusted by
+// the default HTTP client and that experiments are pointed at the combined bundle
+//
+func TestCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, errGo := ioutil.TempDir("", "cabundle")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	savedOpt, savedFile, savedPEM, savedRoots := *caBundleOpt, caBundleFile, caBundlePEM, caBundleRoots
+	savedEnv, hadEnv := os.LookupEnv("SSL_CERT_FILE")
+	transport := http.DefaultTransport.(*http.Transport)
+	savedConfig := transport.TLSClientConfig
+	defer func() {
+		*caBundleOpt, caBundleFile, caBundlePEM, caBundleRoots = savedOpt, savedFile, savedPEM, savedRoots
+		if hadEnv {
+			os.Setenv("SSL_CERT_FILE", savedEnv)
+		} else {
+			os.Unsetenv("SSL_CERT_FILE")
+		}
+		transport.TLSClientConfig = savedConfig
+		transport.CloseIdleConnections()
+	}()
+
+	// An invalid bundle is rejected
+	*caBundleOpt = filepath.Join(dir, "invalid.pem")
+	if errGo = ioutil.WriteFile(*caBundleOpt, []byte("not a certificate"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, err := LoadCABundle(dir); err == nil {
+		t.Fatal("invalid ca-bundle was accepted")
+	}
+
+	*caBundleOpt = filepath.Join(dir, "bundle.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if errGo = ioutil.WriteFile(*caBundleOpt, bundle, 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	fn, err := LoadCABundle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, errGo := http.Get(server.URL)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	resp.Body.Close()
+
+	found := map[string]bool{}
+	for _, kv := range ExperimentEnv(map[string]string{"PIP_CERT": "/override.pem"}) {
+		parts := strings.SplitN(kv, "=", 2)
+		found[kv] = true
+		if parts[0] == "PIP_CERT" && parts[1] != "/override.pem" {
+			t.Fatalf("experiment variable was replaced by the ca-bundle %s", kv)
+		}
+	}
+	for _, name := range []string{"SSL_CERT_FILE", "REQUESTS_CA_BUNDLE"} {
+		if !found[name+"="+fn] {
+			t.Fatalf("%s not exported to experiments", name)
+		}
+	}
+}
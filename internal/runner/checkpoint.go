@@ -0,0 +1,246 @@
+package runner
+
+// This file contains the implementation of the checkpoint directories experiments can name.
+// Frameworks typically write checkpoints into a directory of their own and rather than
+// snapshotting the whole workspace the runner copies the newest checkpoints into the
+// dedicated checkpoint artifact directory from which they are uploaded.  When the
+// experiment is run again the checkpoints downloaded using the artifact are restored into
+// the checkpoint directory of the workspace.
+//
+// The workspace belongs to the experiment which could replace the checkpoint directory, or the
+// checkpoints within it, with symbolic links to files of the host.  The checkpoint directory
+// is resolved and must remain inside of the workspace, and links within it are never followed
+// when checkpoints are staged or restored.
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	CheckpointGroup = "checkpoint" // The artifact the checkpoints of an experiment are returned using
+)
+
+// validateCheckpoint checks the checkpoint directory of a request, and that the request has a
+// checkpoint artifact that the checkpoints can be returned using
+//
+func validateCheckpoint(r *Request) (err errors.Error) {
+	checkpoint := r.Experiment.Checkpoint
+	if checkpoint == nil {
+		return nil
+	}
+	if dir := filepath.Clean(checkpoint.Dir); len(checkpoint.Dir) == 0 || filepath.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, ".."+string(os.PathSeparator)) {
+		return errors.New("checkpoint dir must be a directory within the workspace").With("experiment_id", r.Experiment.Key, "dir", checkpoint.Dir).
+			With("stack", stack.Trace().TrimRuntime())
+	}
+	if checkpoint.Keep < 0 {
+		return errors.New("checkpoint keep must not be negative").With("experiment_id", r.Experiment.Key, "keep", checkpoint.Keep).With("stack", stack.Trace().TrimRuntime())
+	}
+	if art, isPresent := r.Experiment.Artifacts[CheckpointGroup]; !isPresent || !art.Mutable || len(art.Qualified) == 0 {
+		return errors.New("checkpoint needs a mutable checkpoint artifact").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// CheckpointDir returns the checkpoint directory dir of the workspace with any symbolic links
+// resolved.  The directory need not exist yet, but it must not lead outside of the workspace.
+//
+func CheckpointDir(workspace string, dir string) (resolved string, err errors.Error) {
+	root, errGo := filepath.EvalSymlinks(workspace)
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("workspace", workspace).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// The longest part of the path that already exists is resolved and the remainder appended
+	existing, missing := filepath.Join(root, filepath.Clean(dir)), ""
+	for {
+		real, errGo := filepath.EvalSymlinks(existing)
+		if errGo == nil {
+			resolved = filepath.Join(real, missing)
+			break
+		}
+		if !os.IsNotExist(errGo) || existing == root {
+			return "", errors.Wrap(errGo).With("workspace", workspace, "dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+
+	if rel, errGo := filepath.Rel(root, resolved); errGo != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("checkpoint dir is outside of the workspace").With("workspace", workspace, "dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return resolved, nil
+}
+
+// SyncCheckpoints copies the newest checkpoints, the entries at the top of the src directory,
+// into the dest directory and removes any others from dest.  Entries modified within the
+// settle period are assumed to still be being written and are left for a later pass.
+// changed is true when dest was altered and so needs to be uploaded.
+//
+func SyncCheckpoints(src string, dest string, keep int, settle time.Duration) (changed bool, err errors.Error) {
+	if keep <= 0 {
+		keep = 1
+	}
+
+	entries, errGo := ioutil.ReadDir(src)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return false, nil
+		}
+		return false, errors.Wrap(errGo).With("dir", src).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	settled := time.Now().Add(-settle)
+	latest := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if entry.ModTime().Before(settled) {
+			latest = append(latest, entry)
+		}
+	}
+	if len(latest) == 0 {
+		return false, nil
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].ModTime().After(latest[j].ModTime()) })
+	if len(latest) > keep {
+		latest = latest[:keep]
+	}
+
+	if errGo = os.MkdirAll(dest, 0700); errGo != nil {
+		return false, errors.Wrap(errGo).With("dir", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	existing, errGo := ioutil.ReadDir(dest)
+	if errGo != nil {
+		return false, errors.Wrap(errGo).With("dir", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	kept := make(map[string]os.FileInfo, len(latest))
+	for _, entry := range latest {
+		kept[entry.Name()] = entry
+	}
+	copied := make(map[string]os.FileInfo, len(existing))
+	for _, entry := range existing {
+		if want, isPresent := kept[entry.Name()]; isPresent && want.ModTime().Equal(entry.ModTime()) && (want.IsDir() || want.Size() == entry.Size()) {
+			copied[entry.Name()] = entry
+			continue
+		}
+		if errGo = os.RemoveAll(filepath.Join(dest, entry.Name())); errGo != nil {
+			return changed, errors.Wrap(errGo).With("dir", dest, "name", entry.Name()).With("stack", stack.Trace().TrimRuntime())
+		}
+		changed = true
+	}
+
+	for _, entry := range latest {
+		if _, isPresent := copied[entry.Name()]; isPresent {
+			continue
+		}
+		if err = copyCheckpoint(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())); err != nil {
+			return changed, err
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// RestoreCheckpoints copies the checkpoints downloaded using the checkpoint artifact from the
+// src directory into the checkpoint directory of the workspace, returning the number restored
+//
+func RestoreCheckpoints(src string, dest string) (restored int, err errors.Error) {
+	entries, errGo := ioutil.ReadDir(src)
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return 0, nil
+		}
+		return 0, errors.Wrap(errGo).With("dir", src).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+	if errGo = os.MkdirAll(dest, 0700); errGo != nil {
+		return 0, errors.Wrap(errGo).With("dir", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+	for _, entry := range entries {
+		if entry.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+		if err = copyCheckpoint(filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())); err != nil {
+			return restored, err
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// copyCheckpoint copies a checkpoint file, or directory, keeping the modification times so that
+// the newest checkpoints can still be identified after the copy.  Symbolic links found in src
+// are skipped and those found in dest are refused rather than being followed.
+//
+func copyCheckpoint(src string, dest string) (err errors.Error) {
+	errGo := filepath.Walk(src, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil {
+			return errGo
+		}
+		rel, errGo := filepath.Rel(src, path)
+		if errGo != nil {
+			return errGo
+		}
+		target := filepath.Join(dest, rel)
+
+		if existing, errGo := os.Lstat(target); errGo == nil && existing.Mode()&os.ModeSymlink != 0 {
+			return errors.New("checkpoint destination is a symbolic link").With("target", target)
+		}
+
+		switch {
+		case info.IsDir():
+			if errGo = os.MkdirAll(target, 0700); errGo != nil {
+				return errGo
+			}
+		case info.Mode().IsRegular():
+			if errGo = copyFile(path, target, info.Mode()); errGo != nil {
+				return errGo
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("src", src, "dest", dest).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Directory times change as their contents are written so they are set once the copy is done
+	if info, errGo := os.Stat(src); errGo == nil && info.IsDir() {
+		os.Chtimes(dest, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// copyFile copies the contents of the src file to dest, neither of which may be a symbolic link
+//
+func copyFile(src string, dest string, mode os.FileMode) (errGo error) {
+	in, errGo := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if errGo != nil {
+		return errGo
+	}
+	defer in.Close()
+
+	out, errGo := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, mode.Perm())
+	if errGo != nil {
+		return errGo
+	}
+	if _, errGo = io.Copy(out, in); errGo != nil {
+		out.Close()
+		return errGo
+	}
+	return out.Close()
+}
@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestCheckpointSync checks that only the newest settled checkpoints are staged for uploading,
+// that unchanged checkpoints are not staged again, and that staged checkpoints are restored
+//
+func TestCheckpointSync(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "checkpoint")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "workspace", "ckpt")
+	staged := filepath.Join(dir, CheckpointGroup)
+	if errGo = os.MkdirAll(src, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	write := func(name string, age time.Duration) {
+		fn := filepath.Join(src, name)
+		if errGo := ioutil.WriteFile(fn, []byte(name), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+		when := time.Now().Add(-age)
+		if errGo := os.Chtimes(fn, when, when); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	names := func(dir string) (found []string) {
+		entries, _ := ioutil.ReadDir(dir)
+		for _, entry := range entries {
+			found = append(found, entry.Name())
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	write("step-1", 3*time.Hour)
+	write("step-2", 2*time.Hour)
+	write("step-3", time.Hour)
+	write("step-4", 0) // Still being written
+
+	changed, err := SyncCheckpoints(src, staged, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := names(staged); !changed || len(found) != 2 || found[0] != "step-2" || found[1] != "step-3" {
+		t.Fatalf("unexpected checkpoints staged %v", found)
+	}
+
+	if changed, err = SyncCheckpoints(src, staged, 2, time.Minute); err != nil || changed {
+		t.Fatalf("unchanged checkpoints were staged again %v", err)
+	}
+
+	// Once the experiment has stopped the newest checkpoint replaces the oldest
+	if changed, err = SyncCheckpoints(src, staged, 2, 0); err != nil || !changed {
+		t.Fatalf("new checkpoint not staged %v", err)
+	}
+	if found := names(staged); len(found) != 2 || found[0] != "step-3" || found[1] != "step-4" {
+		t.Fatalf("unexpected checkpoints staged %v", found)
+	}
+
+	restoreDir := filepath.Join(dir, "restored", "ckpt")
+	restored, err := RestoreCheckpoints(staged, restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := names(restoreDir); restored != 2 || len(found) != 2 || found[1] != "step-4" {
+		t.Fatalf("unexpected checkpoints restored %d %v", restored, found)
+	}
+
+	if restored, err = RestoreCheckpoints(filepath.Join(dir, "missing"), restoreDir); err != nil || restored != 0 {
+		t.Fatalf("missing checkpoint artifact not ignored %d %v", restored, err)
+	}
+}
+
+// TestCheckpointValidate checks that checkpoint directories must lie within the workspace and
+// that a mutable checkpoint artifact is present
+//
+func TestCheckpointValidate(t *testing.T) {
+	r := &Request{}
+	r.Experiment.Artifacts = map[string]Artifact{
+		CheckpointGroup: {Qualified: "s3://example.com/bucket/checkpoint.tar", Mutable: true},
+	}
+
+	for dir, valid := range map[string]bool{"ckpt": true, "models/ckpt": true, "": false, ".": false, "../ckpt": false, "/tmp/ckpt": false} {
+		r.Experiment.Checkpoint = &Checkpoint{Dir: dir}
+		if err := validateCheckpoint(r); (err == nil) != valid {
+			t.Fatalf("checkpoint dir %q validity expected %v, error %v", dir, valid, err)
+		}
+	}
+
+	r.Experiment.Checkpoint = &Checkpoint{Dir: "ckpt"}
+	r.Experiment.Artifacts[CheckpointGroup] = Artifact{Qualified: "s3://example.com/bucket/checkpoint.tar"}
+	if err := validateCheckpoint(r); err == nil {
+		t.Fatal("immutable checkpoint artifact accepted")
+	}
+}
+
+// TestCheckpointSymlinks checks that checkpoint directories linking outside of the workspace
+// are refused and that links are not followed when checkpoints are staged or restored
+//
+func TestCheckpointSymlinks(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "checkpoint")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	workspace := filepath.Join(dir, "workspace")
+	host := filepath.Join(dir, "host")
+	for _, d := range []string{workspace, host, filepath.Join(workspace, "models")} {
+		if errGo = os.MkdirAll(d, 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(host, "secret"), []byte("secret"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	if _, err := CheckpointDir(workspace, "models/ckpt"); err != nil {
+		t.Fatal(err)
+	}
+	if errGo = os.Symlink(host, filepath.Join(workspace, "ckpt")); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, err := CheckpointDir(workspace, "ckpt"); err == nil {
+		t.Fatal("checkpoint dir linked outside of the workspace accepted")
+	}
+	if _, err := CheckpointDir(workspace, "ckpt/sub"); err == nil {
+		t.Fatal("checkpoint dir beneath a link outside of the workspace accepted")
+	}
+
+	// Links inside of the checkpoint directory are not staged
+	src := filepath.Join(workspace, "models", "ckpt")
+	if errGo = os.MkdirAll(src, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = os.Symlink(filepath.Join(host, "secret"), filepath.Join(src, "step-1")); errGo != nil {
+		t.Fatal(errGo)
+	}
+	staged := filepath.Join(dir, CheckpointGroup)
+	if changed, err := SyncCheckpoints(src, staged, 2, 0); err != nil || changed {
+		t.Fatalf("linked checkpoint was staged %v %v", changed, err)
+	}
+
+	// Links in the restored directory are not written through
+	if errGo = os.MkdirAll(staged, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(staged, "step-1"), []byte("checkpoint"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, err := RestoreCheckpoints(staged, src); err == nil {
+		t.Fatal("checkpoint restored through a link")
+	}
+	if data, errGo := ioutil.ReadFile(filepath.Join(host, "secret")); errGo != nil || string(data) != "secret" {
+		t.Fatalf("file outside of the workspace was altered %q %v", string(data), errGo)
+	}
+}
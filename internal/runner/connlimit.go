@@ -0,0 +1,100 @@
+package runner
+
+// This file contains the implementation of the limits placed on the number of concurrent
+// connections made to each type of object store.  Many simultaneous artifact transfers
+// can exhaust connection pools, or exceed the concurrency allowed by the provider for an
+// account, leading to throttling.  The transports used by the storage clients acquire a
+// slot from a semaphore shared by all experiments on the runner before each request and
+// release it once the response has been consumed.
+
+import (
+	"flag"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var (
+	s3MaxConnsOpt = flag.Int("s3-max-connections", 0, "the maximum number of concurrent requests made to S3 and Minio object stores across all experiments, 0 is unlimited")
+	gsMaxConnsOpt = flag.Int("gs-max-connections", 0, "the maximum number of concurrent requests made to Google Cloud Storage across all experiments, 0 is unlimited")
+
+	connLimits = struct {
+		sync.Mutex
+		sems map[string]chan struct{}
+	}{
+		sems: map[string]chan struct{}{},
+	}
+)
+
+// connSemaphore returns the semaphore shared by the clients of a backend, nil is returned when
+// the connections to the backend are not limited
+//
+func connSemaphore(backend string, limit int) (sem chan struct{}) {
+	if limit <= 0 {
+		return nil
+	}
+
+	connLimits.Lock()
+	defer connLimits.Unlock()
+
+	if sem = connLimits.sems[backend]; sem == nil || cap(sem) != limit {
+		sem = make(chan struct{}, limit)
+		connLimits.sems[backend] = sem
+	}
+	return sem
+}
+
+// limitedTransport holds a slot in the semaphore of its backend for each request it makes
+//
+type limitedTransport struct {
+	base http.RoundTripper
+	sem  chan struct{}
+}
+
+// limitConnections wraps a transport so that the number of concurrent requests made to the
+// backend is capped, the transport is returned unchanged when there is no limit
+//
+func limitConnections(backend string, limit int, base http.RoundTripper) (transport http.RoundTripper) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	sem := connSemaphore(backend, limit)
+	if sem == nil {
+		return base
+	}
+	return &limitedTransport{base: base, sem: sem}
+}
+
+// RoundTrip waits for a slot before making the request, the slot is released once the body of
+// the response has been closed, or immediately if the request failed
+//
+func (t *limitedTransport) RoundTrip(req *http.Request) (resp *http.Response, errGo error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	release := &sync.Once{}
+	done := func() { release.Do(func() { <-t.sem }) }
+
+	if resp, errGo = t.base.RoundTrip(req); errGo != nil || resp.Body == nil {
+		done()
+		return resp, errGo
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: done}
+	return resp, nil
+}
+
+// releasingBody releases the slot of a request when the response body is closed
+//
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body *releasingBody) Close() (errGo error) {
+	errGo = body.ReadCloser.Close()
+	body.release()
+	return errGo
+}
@@ -0,0 +1,93 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConnectionLimit checks that the requests made using transports for the same backend share
+// a cap on concurrency, and that requests waiting for a slot can be cancelled
+//
+func TestConnectionLimit(t *testing.T) {
+
+	active := int32(0)
+	peak := int32(0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if now <= seen || atomic.CompareAndSwapInt32(&peak, seen, now) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// Two clients, as used by separate experiments, share the same limit
+	clients := []*http.Client{
+		{Transport: limitConnections("test", 2, nil)},
+		{Transport: limitConnections("test", 2, nil)},
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i != 8; i++ {
+		wg.Add(1)
+		go func(client *http.Client) {
+			defer wg.Done()
+			resp, errGo := client.Get(server.URL)
+			if errGo != nil {
+				t.Error(errGo)
+				return
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}(clients[i%len(clients)])
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Fatalf("%d concurrent requests were made, the limit was 2", peak)
+	}
+
+	// Hold both slots and check that a further request gives up when its context is done
+	held := []*http.Response{}
+	for i := 0; i != 2; i++ {
+		resp, errGo := clients[i].Get(server.URL)
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		held = append(held, resp)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if _, errGo := clients[0].Do(req.WithContext(ctx)); errGo == nil {
+		t.Fatal("request made while the connection limit was reached")
+	}
+
+	for _, resp := range held {
+		resp.Body.Close()
+	}
+	resp, errGo := clients[1].Get(server.URL)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	resp.Body.Close()
+
+	// Backends without a limit use the transport they were given
+	if transport := limitConnections("unlimited", 0, http.DefaultTransport); transport != http.DefaultTransport {
+		t.Fatal("transport wrapped when no limit was set")
+	}
+}
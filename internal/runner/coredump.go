@@ -0,0 +1,271 @@
+package runner
+
+// This file contains the implementation of the capture of core dumps from experiments that
+// crash, for example with a segfault inside of a C extension.  Capture is opt-in as cores
+// can be large and are kept in the experiment bucket.  When enabled the core file size limit
+// of the experiment is raised to the core-dump-max option once it has started, and after a
+// crash, seen as a core dumping signal in the exit status of the experiment, the cores it
+// left behind are moved into the cores directory of the experiment along with a document
+// describing them so that they can be returned as a debugging artifact.
+//
+// The kernel core_pattern is shared by the whole host, it must be a plain file name for cores
+// to be written into the working directory of the crashing process and so the directory of
+// the experiment.  The runner can set it at startup using the core-pattern option.
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	coreDumpsOpt   = flag.Bool("core-dumps", false, "captures the core dumps of experiments that crash and returns them as a debugging artifact beside the output artifact")
+	coreDumpMaxOpt = flag.String("core-dump-max", "4GiB", "the largest core dump written by an experiment when core-dumps is enabled, the kernel truncates cores at the limit")
+	corePatternOpt = flag.String("core-pattern", "", "the kernel core_pattern set by the runner at startup when core-dumps is enabled, for example core.%e.%p, empty leaves the pattern of the host unchanged")
+
+	coreDumpMax uint64
+	corePrefix  = "core"
+
+	// corePatternFN is the kernel setting naming the files cores are written to
+	corePatternFN = "/proc/sys/kernel/core_pattern"
+)
+
+const (
+	// CoreGroup is the artifact the core dumps of an experiment are returned as
+	CoreGroup = "cores"
+
+	// CoreIndexFile is the name of the document describing the core dumps captured
+	CoreIndexFile = "cores.json"
+)
+
+// CoreDumps describes the core dumps captured after an experiment crashed
+//
+type CoreDumps struct {
+	Signal    string     `json:"signal"`
+	Cores     []CoreDump `json:"cores"`
+	Discarded []CoreDump `json:"discarded,omitempty"` // Cores that exceeded the core-dump-max option
+}
+
+// CoreDump is a single core file left behind by an experiment
+//
+type CoreDump struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// ValidateCoreDumps checks the core dump options and when core dumps are enabled sets the
+// kernel core_pattern if requested, the largest core captured is returned, 0 when disabled
+//
+func ValidateCoreDumps() (max uint64, err errors.Error) {
+	coreDumpMax = 0
+	if !*coreDumpsOpt {
+		return 0, nil
+	}
+
+	max, errGo := humanize.ParseBytes(*coreDumpMaxOpt)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo, "core-dump-max is invalid").With("core-dump-max", *coreDumpMaxOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if max == 0 {
+		return 0, errors.New("core-dump-max must be positive").With("core-dump-max", *coreDumpMaxOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if len(*corePatternOpt) != 0 {
+		if strings.ContainsAny(*corePatternOpt, "/|") {
+			return 0, errors.New("core-pattern must be a file name").With("core-pattern", *corePatternOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		if errGo = ioutil.WriteFile(corePatternFN, []byte(*corePatternOpt+"\n"), 0644); errGo != nil {
+			return 0, errors.Wrap(errGo, "core-pattern could not be set").With("core-pattern", *corePatternOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	data, errGo := ioutil.ReadFile(corePatternFN)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo).With("file", corePatternFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	pattern := strings.TrimSpace(string(data))
+	if strings.ContainsAny(pattern, "/|") {
+		return 0, errors.New("the kernel core_pattern writes cores outside of the experiment directory, use the core-pattern option").With("core_pattern", pattern).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Cores are located using the text ahead of the first substitution in the pattern, when
+	// there is none only the contents of the files are used
+	corePrefix = strings.SplitN(pattern, "%", 2)[0]
+	coreDumpMax = max
+	return max, nil
+}
+
+// limitCores sets the core file size limit of a process that has just been started so that
+// it, and the processes it starts, can dump cores up to the core-dump-max option.  The limit
+// cannot be raised above the hard limit of the runner.
+//
+func limitCores(pid int) (err errors.Error) {
+	if coreDumpMax == 0 {
+		return nil
+	}
+
+	limit := syscall.Rlimit{}
+	if errGo := syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	limit.Cur = coreDumpMax
+	if limit.Cur > limit.Max {
+		limit.Cur = limit.Max
+	}
+	_, _, errNo := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), syscall.RLIMIT_CORE, uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errNo != 0 {
+		return errors.Wrap(errNo, "core file size limit could not be set").With("pid", pid).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// crashSignal returns the core dumping signal that stopped a process, experiments are run by
+// a shell that reports a child stopped by a signal using an exit status of 128 plus the signal
+//
+func crashSignal(state *os.ProcessState) (signal syscall.Signal, crashed bool) {
+	if state == nil {
+		return 0, false
+	}
+	status, isStatus := state.Sys().(syscall.WaitStatus)
+	if !isStatus {
+		return 0, false
+	}
+	switch {
+	case status.Signaled():
+		signal = status.Signal()
+	case status.Exited() && status.ExitStatus() > 128:
+		signal = syscall.Signal(status.ExitStatus() - 128)
+	default:
+		return 0, false
+	}
+
+	switch signal {
+	case syscall.SIGABRT, syscall.SIGBUS, syscall.SIGFPE, syscall.SIGILL, syscall.SIGQUIT,
+		syscall.SIGSEGV, syscall.SIGSYS, syscall.SIGTRAP, syscall.SIGXCPU, syscall.SIGXFSZ:
+		return signal, true
+	}
+	return 0, false
+}
+
+// captureCores moves the core dumps written since the experiment started into its cores
+// directory after it crashed, dir is the directory of the experiment and workDirs the
+// directories the experiment was run from, where cores are written.  nil is returned when
+// core dumps are disabled, the experiment did not crash, or it left no cores behind.
+//
+// The files searched belong to the experiment, which could replace them with links to files
+// of the host, so links are never followed and each core is checked again as it is moved.
+//
+func captureCores(dir string, workDirs []string, state *os.ProcessState, started time.Time) (dumps *CoreDumps, err errors.Error) {
+	if coreDumpMax == 0 {
+		return nil, nil
+	}
+	signal, crashed := crashSignal(state)
+	if !crashed {
+		return nil, nil
+	}
+
+	coreDir := filepath.Join(dir, CoreGroup)
+	found := map[string]os.FileInfo{}
+	for _, workDir := range workDirs {
+		errGo := filepath.Walk(workDir, func(path string, info os.FileInfo, errGo error) error {
+			if errGo != nil {
+				return nil
+			}
+			if info.IsDir() {
+				if path == coreDir {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() && strings.HasPrefix(info.Name(), corePrefix) && !info.ModTime().Before(started) && isCore(path) {
+				found[path] = info
+			}
+			return nil
+		})
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("dir", workDir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	if info, errGo := os.Lstat(coreDir); errGo == nil && !info.IsDir() {
+		return nil, errors.New("the cores directory of the experiment is not a directory").With("dir", coreDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	if errGo := os.MkdirAll(coreDir, 0700); errGo != nil {
+		return nil, errors.Wrap(errGo).With("dir", coreDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	dumps = &CoreDumps{Signal: signal.String()}
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		info, errGo := os.Lstat(path)
+		if errGo != nil || !info.Mode().IsRegular() || !os.SameFile(info, found[path]) {
+			continue
+		}
+		core := CoreDump{Name: filepath.Base(path), Size: info.Size(), Modified: info.ModTime()}
+		if uint64(info.Size()) > coreDumpMax {
+			os.Remove(path)
+			dumps.Discarded = append(dumps.Discarded, core)
+			continue
+		}
+		if errGo = os.Rename(path, filepath.Join(coreDir, core.Name)); errGo != nil {
+			return dumps, errors.Wrap(errGo).With("core", path).With("stack", stack.Trace().TrimRuntime())
+		}
+		dumps.Cores = append(dumps.Cores, core)
+	}
+
+	data, errGo := json.MarshalIndent(dumps, "", "  ")
+	if errGo != nil {
+		return dumps, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	index, errGo := os.OpenFile(filepath.Join(coreDir, CoreIndexFile), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, 0600)
+	if errGo != nil {
+		return dumps, errors.Wrap(errGo).With("dir", coreDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	_, errGo = index.Write(data)
+	if errClose := index.Close(); errGo == nil {
+		errGo = errClose
+	}
+	if errGo != nil {
+		return dumps, errors.Wrap(errGo).With("dir", coreDir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return dumps, nil
+}
+
+// isCore returns true when a file is an ELF core file, links are not followed
+//
+func isCore(path string) (core bool) {
+	f, errGo := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if errGo != nil {
+		return false
+	}
+	defer f.Close()
+
+	if info, errGo := f.Stat(); errGo != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	header, errGo := elf.NewFile(f)
+	if errGo != nil {
+		return false
+	}
+	return header.Type == elf.ET_CORE
+}
@@ -0,0 +1,133 @@
+package runner
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeCore writes a file with the header of an ELF core file
+//
+func writeCore(t *testing.T, fn string) {
+	hdr := elf.Header64{
+		Type:    uint16(elf.ET_CORE),
+		Machine: uint16(elf.EM_X86_64),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  64,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &hdr)
+	if errGo := ioutil.WriteFile(fn, buf.Bytes(), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+}
+
+// exitState returns the state of a shell that exited with the status supplied
+//
+func exitState(status string) (state *os.ProcessState) {
+	cmd := exec.Command("/bin/sh", "-c", "exit "+status)
+	cmd.Run()
+	return cmd.ProcessState
+}
+
+// TestCoreDumps checks that the cores left behind by an experiment that crashed are moved into
+// its cores directory, and that the size limit of the experiment allows them to be written
+//
+func TestCoreDumps(t *testing.T) {
+	saved := coreDumpMax
+	defer func() { coreDumpMax = saved }()
+	coreDumpMax = 1024 * 1024
+
+	dir, errGo := ioutil.TempDir("", "core-dumps")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "workspace"), 0700)
+
+	started := time.Now().Add(-time.Second)
+	workDirs := []string{filepath.Join(dir, "workspace")}
+	writeCore(t, filepath.Join(dir, "workspace", "core.1234"))
+
+	// Cores outside of the directories the experiment was run from, and links, are left alone
+	writeCore(t, filepath.Join(dir, "core.5678"))
+	if errGo = os.Symlink(filepath.Join(dir, "core.5678"), filepath.Join(dir, "workspace", "core.link")); errGo != nil {
+		t.Fatal(errGo)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "workspace", "core.py"), []byte("import os"), 0600)
+
+	// Failures that are not crashes leave the cores alone
+	if dumps, err := captureCores(dir, workDirs, exitState("1"), started); err != nil || dumps != nil {
+		t.Fatalf("cores captured for an experiment that failed without crashing %v %v", dumps, err)
+	}
+
+	// A segfault reported by the shell
+	dumps, err := captureCores(dir, workDirs, exitState("139"), started)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dumps == nil || len(dumps.Cores) != 1 || dumps.Cores[0].Name != "core.1234" || !strings.Contains(dumps.Signal, "segmentation") {
+		t.Fatalf("core not captured %+v", dumps)
+	}
+	if _, errGo = os.Stat(filepath.Join(dir, CoreGroup, "core.1234")); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if _, errGo = os.Stat(filepath.Join(dir, "workspace", "core.py")); errGo != nil {
+		t.Fatal("file that is not a core was moved")
+	}
+	if _, errGo = os.Stat(filepath.Join(dir, "core.5678")); errGo != nil {
+		t.Fatal("core outside of the workspace was moved")
+	}
+	index := CoreDumps{}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, CoreGroup, CoreIndexFile))
+	if errGo = json.Unmarshal(data, &index); errGo != nil || len(index.Cores) != 1 {
+		t.Fatalf("core index not written %q", string(data))
+	}
+
+	// The core file size limit is applied to running experiments
+	cmd := exec.Command("/bin/sh", "-c", "sleep 10")
+	if errGo = cmd.Start(); errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	if err = limitCores(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+	limit := syscall.Rlimit{}
+	if errGo = syscall.Getrlimit(syscall.RLIMIT_CORE, &limit); errGo != nil {
+		t.Fatal(errGo)
+	}
+	want := strconv.FormatUint(coreDumpMax, 10)
+	if limit.Max < coreDumpMax {
+		want = strconv.FormatUint(limit.Max, 10)
+	}
+	limits, errGo := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "limits"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	for _, line := range strings.Split(string(limits), "\n") {
+		if !strings.HasPrefix(line, "Max core file size") {
+			continue
+		}
+		if fields := strings.Fields(line); fields[4] != want {
+			t.Fatalf("core file size limit not applied %q", line)
+		}
+	}
+}
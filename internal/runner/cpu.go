@@ -110,6 +110,13 @@ func SetCPULimits(maxCores uint, maxMem uint64) (err errors.Error) {
 // and so this is soft accounting
 //
 func AllocCPU(maxCores uint, maxMem uint64) (alloc *CPUAllocated, err errors.Error) {
+	return AllocCPURange(maxCores, maxCores, maxMem, maxMem)
+}
+
+// AllocCPURange is used to allocate as many cores, and as much memory, up to the maximums as is
+// available providing the minimums can be met
+//
+func AllocCPURange(minCores uint, maxCores uint, minMem uint64, maxMem uint64) (alloc *CPUAllocated, err errors.Error) {
 
 	cpuTrack.Lock()
 	defer cpuTrack.Unlock()
@@ -118,23 +125,51 @@ func AllocCPU(maxCores uint, maxMem uint64) (alloc *CPUAllocated, err errors.Err
 		return nil, cpuTrack.InitErr
 	}
 
-	if maxCores+cpuTrack.AllocCores > cpuTrack.SoftMaxCores {
+	if minCores > maxCores {
+		minCores = maxCores
+	}
+	if minMem > maxMem {
+		minMem = maxMem
+	}
+
+	if minCores+cpuTrack.AllocCores > cpuTrack.SoftMaxCores {
 		return nil, errors.New("no available CPU slots found").With("stack", stack.Trace().TrimRuntime())
 	}
-	if maxMem+cpuTrack.AllocMem > cpuTrack.SoftMaxMem {
-		msg := fmt.Sprintf("insufficient available memory %s requested from pool of %s", humanize.Bytes(maxMem), humanize.Bytes(cpuTrack.SoftMaxMem))
+	if minMem+cpuTrack.AllocMem > cpuTrack.SoftMaxMem {
+		msg := fmt.Sprintf("insufficient available memory %s requested from pool of %s", humanize.Bytes(minMem), humanize.Bytes(cpuTrack.SoftMaxMem))
 		return nil, errors.New(msg).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	cpuTrack.AllocCores += maxCores
-	cpuTrack.AllocMem += maxMem
+	cores := maxCores
+	if freeCores := cpuTrack.SoftMaxCores - cpuTrack.AllocCores; cores > freeCores {
+		cores = freeCores
+	}
+	mem := maxMem
+	if freeMem := cpuTrack.SoftMaxMem - cpuTrack.AllocMem; mem > freeMem {
+		mem = freeMem
+	}
+
+	cpuTrack.AllocCores += cores
+	cpuTrack.AllocMem += mem
 
 	return &CPUAllocated{
-		cores: maxCores,
-		mem:   maxMem,
+		cores: cores,
+		mem:   mem,
 	}, nil
 }
 
+// Cores returns the number of cores that were allocated
+//
+func (cpu *CPUAllocated) Cores() (cores uint) {
+	return cpu.cores
+}
+
+// Mem returns the amount of memory that was allocated
+//
+func (cpu *CPUAllocated) Mem() (mem uint64) {
+	return cpu.mem
+}
+
 // Release is used to return a soft allocation to the system accounting
 //
 func (cpu *CPUAllocated) Release() {
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/dustin/go-humanize"
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 	"github.com/rs/xid"
@@ -49,6 +50,9 @@ type GPUTrack struct {
 	FreeMem    uint64              // The amount of free memory the GPU has
 	EccFailure *errors.Error       // Any Ecc failure related error messages, nil if no errors encountered
 	Tracking   map[string]struct{} // Used to validate allocations as they are release
+
+	Packed      uint // The number of experiments sharing the GPU using memory packing
+	PackedSlots uint // The slots withheld from whole board allocations while the GPU is packed
 }
 
 // GPUInventory can be used to extract a copy of the current state of the GPU hardware seen within the
@@ -326,6 +330,7 @@ type GPUAllocated struct {
 	uuid     string            // The device identifier this allocation was successful against
 	slots    uint              // The number of GPU slots given from the allocation
 	mem      uint64            // The amount of memory given to the allocation
+	packed   bool              // The allocation shares the device with other packed allocations
 	Env      map[string]string // Any environment variables the device allocator wants the runner to use
 }
 
@@ -359,7 +364,8 @@ func evens(start int, end int) (result []int) {
 // When allocations occur across multiple devices the units of allocation parameter
 // defines the grainularity that the cards must conform to in terms of slots.
 //
-// Any allocations will take an entire card, we do not break cards across experiments
+// Any allocations will take an entire card, we do not break cards across experiments, experiments
+// that are willing to share cards use PackGPU instead
 //
 // This receiver uses a user supplied pool which allows for unit tests to be written that use a
 // custom pool
@@ -532,9 +538,75 @@ func (allocator *gpuTracker) AllocGPU(maxGPU uint, maxGPUMem uint64, unitsOfAllo
 	return alloc, nil
 }
 
+// PackGPU will select the default allocation pool for GPUs and reserve memory on a single
+// device that can be shared with other packed allocations
+//
+func PackGPU(maxGPUMem uint64) (alloc GPUAllocations, err errors.Error) {
+	return gpuAllocs.PackGPU(maxGPUMem)
+}
+
+// PackGPU is used to reserve an amount of memory within a single GPU for an experiment that
+// is willing to share the device with other experiments.  A device can be shared only by
+// packed allocations, once the first packed allocation is made the slots of the device are
+// withheld from whole board allocations until all of the packed allocations are returned.
+//
+// Devices already being shared are preferred, and amongst them the device with the least
+// free memory that will fit the request is chosen, to leave whole boards and large amounts
+// of memory available for later requests.
+//
+func (allocator *gpuTracker) PackGPU(maxGPUMem uint64) (alloc GPUAllocations, err errors.Error) {
+
+	if maxGPUMem == 0 {
+		return nil, errors.New("gpu memory packing requires a gpuMem amount").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	allocator.Lock()
+	defer allocator.Unlock()
+
+	best := (*GPUTrack)(nil)
+	for _, dev := range allocator.Allocs {
+		if dev.EccFailure != nil || dev.Slots == 0 || dev.FreeMem < maxGPUMem {
+			continue
+		}
+		// Devices that have whole board allocations cannot be shared
+		if dev.Packed == 0 && dev.FreeSlots != dev.Slots {
+			continue
+		}
+		if best == nil ||
+			(dev.Packed != 0 && best.Packed == 0) ||
+			((dev.Packed != 0) == (best.Packed != 0) && dev.FreeMem < best.FreeMem) {
+			best = dev
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("insufficient GPU memory for packing").With("gpuMem", humanize.Bytes(maxGPUMem)).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if best.Packed == 0 {
+		best.PackedSlots = best.FreeSlots
+		best.FreeSlots = 0
+	}
+	best.Packed++
+	best.FreeMem -= maxGPUMem
+
+	tracking := xid.New().String()
+	best.Tracking[tracking] = struct{}{}
+
+	return GPUAllocations{
+		&GPUAllocated{
+			tracking: tracking,
+			uuid:     best.UUID,
+			mem:      maxGPUMem,
+			packed:   true,
+			Env:      map[string]string{"CUDA_VISIBLE_DEVICES": best.UUID},
+		},
+	}, nil
+}
+
 func (allocator *gpuTracker) ReturnGPU(alloc *GPUAllocated) (err errors.Error) {
 
-	if alloc.slots == 0 || alloc.mem == 0 {
+	if !alloc.packed && (alloc.slots == 0 || alloc.mem == 0) {
 		return nil
 	}
 
@@ -553,8 +625,17 @@ func (allocator *gpuTracker) ReturnGPU(alloc *GPUAllocated) (err errors.Error) {
 	delete(allocator.Allocs[alloc.uuid].Tracking, alloc.tracking)
 
 	// If valid pass back the resources that were consumed
-	allocator.Allocs[alloc.uuid].FreeSlots += alloc.slots
-	allocator.Allocs[alloc.uuid].FreeMem += alloc.mem
+	dev := allocator.Allocs[alloc.uuid]
+	dev.FreeSlots += alloc.slots
+	dev.FreeMem += alloc.mem
+
+	// The last of the packed allocations releases the device for whole board allocations
+	if alloc.packed && dev.Packed != 0 {
+		if dev.Packed--; dev.Packed == 0 {
+			dev.FreeSlots += dev.PackedSlots
+			dev.PackedSlots = 0
+		}
+	}
 
 	return nil
 }
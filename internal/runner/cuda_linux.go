@@ -118,3 +118,35 @@ func getCUDAInfo() (outDevs cudaDevices, err errors.Error) {
 	}
 	return outDevs, nil
 }
+
+// GPUUtilization samples the percentage of time over the last sample period that kernels
+// were executing on each of the GPUs in the system, keyed using the GPU UUID
+//
+func GPUUtilization() (utils map[string]uint, err errors.Error) {
+
+	nvmlOnce.Do(nvmlInit)
+
+	utils = map[string]uint{}
+
+	if initErr != nil {
+		return utils, initErr
+	}
+
+	devs, errGo := nvml.GetAllGPUs()
+	if errGo != nil {
+		return utils, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, dev := range devs {
+		uuid, errGo := dev.UUID()
+		if errGo != nil {
+			return utils, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		rates, errGo := dev.UtilizationRates()
+		if errGo != nil {
+			return utils, errors.Wrap(errGo).With("GPUID", uuid).With("stack", stack.Trace().TrimRuntime())
+		}
+		utils[uuid] = rates.Gpu
+	}
+	return utils, nil
+}
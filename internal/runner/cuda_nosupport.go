@@ -36,3 +36,10 @@ func getCUDAInfo() (outDevs cudaDevices, err errors.Error) {
 func HasCUDA() bool {
 	return len(simDevs.Devices) > 0
 }
+
+// GPUUtilization samples the utilization of the GPUs in the system, none are present when
+// CUDA is not supported
+//
+func GPUUtilization() (utils map[string]uint, err errors.Error) {
+	return map[string]uint{}, errors.New("CUDA not supported on this platform").With("stack", stack.Trace().TrimRuntime())
+}
@@ -0,0 +1,175 @@
+package runner
+
+// This file contains the implementation of a probe for the versions of the NVIDIA driver,
+// CUDA toolkit, and cuDNN library installed on a node.  The versions are used to report
+// the capabilities of the node and to avoid starting experiments that need a newer CUDA
+// runtime than the node has.
+//
+// The NVML binding used by the runner does not expose the system version queries, so the
+// driver version is read from the kernel module which is the same value NVML reports.  The
+// toolkit and cuDNN versions are read from the files installed with them.
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CUDAVersions holds the versions of the CUDA software installed on the node, versions that
+// could not be found are empty
+//
+type CUDAVersions struct {
+	Driver string `json:"driver,omitempty"`
+	CUDA   string `json:"cuda,omitempty"`
+	CuDNN  string `json:"cudnn,omitempty"`
+}
+
+var (
+	// cudaRoot is the prefix applied to the locations probed, and is changed when testing
+	cudaRoot = "/"
+
+	cudaVersions     *CUDAVersions
+	cudaVersionsOnce sync.Once
+
+	driverVersionRE = regexp.MustCompile(`Kernel Module\s+([0-9]+(\.[0-9]+)+)`)
+	toolkitTextRE   = regexp.MustCompile(`CUDA Version\s+([0-9]+(\.[0-9]+)+)`)
+	cudnnDefineRE   = regexp.MustCompile(`^#define\s+CUDNN_(MAJOR|MINOR|PATCHLEVEL)\s+([0-9]+)`)
+
+	versionRE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+)
+
+// GetCUDAVersions returns the versions of the CUDA software installed on the node, the
+// probe is done once as installing these while the runner is running is not supported
+//
+func GetCUDAVersions() (versions CUDAVersions) {
+	cudaVersionsOnce.Do(func() {
+		cudaVersions = probeCUDAVersions()
+	})
+	return *cudaVersions
+}
+
+func probeCUDAVersions() (versions *CUDAVersions) {
+	toolkits := []string{"usr/local/cuda"}
+	if home := os.Getenv("CUDA_HOME"); len(home) != 0 {
+		toolkits = append([]string{home}, toolkits...)
+	}
+
+	versions = &CUDAVersions{
+		Driver: probeDriverVersion(),
+	}
+	for _, toolkit := range toolkits {
+		if versions.CUDA = probeToolkitVersion(filepath.Join(cudaRoot, toolkit)); len(versions.CUDA) != 0 {
+			break
+		}
+	}
+
+	includes := []string{"usr/include", "usr/include/x86_64-linux-gnu"}
+	for _, toolkit := range toolkits {
+		includes = append(includes, filepath.Join(toolkit, "include"))
+	}
+	for _, include := range includes {
+		if versions.CuDNN = probeCuDNNVersion(filepath.Join(cudaRoot, include)); len(versions.CuDNN) != 0 {
+			break
+		}
+	}
+	return versions
+}
+
+// probeDriverVersion extracts the driver version from the NVIDIA kernel module
+//
+func probeDriverVersion() (version string) {
+	data, errGo := ioutil.ReadFile(filepath.Join(cudaRoot, "proc/driver/nvidia/version"))
+	if errGo != nil {
+		return ""
+	}
+	if matches := driverVersionRE.FindSubmatch(data); matches != nil {
+		return string(matches[1])
+	}
+	return ""
+}
+
+// probeToolkitVersion extracts the toolkit version from the version.json file of CUDA 11
+// and later, or the version.txt file of earlier releases
+//
+func probeToolkitVersion(toolkit string) (version string) {
+	if data, errGo := ioutil.ReadFile(filepath.Join(toolkit, "version.json")); errGo == nil {
+		doc := struct {
+			CUDA struct {
+				Version string `json:"version"`
+			} `json:"cuda"`
+		}{}
+		if errGo = json.Unmarshal(data, &doc); errGo == nil && len(doc.CUDA.Version) != 0 {
+			return doc.CUDA.Version
+		}
+	}
+	if data, errGo := ioutil.ReadFile(filepath.Join(toolkit, "version.txt")); errGo == nil {
+		if matches := toolkitTextRE.FindSubmatch(data); matches != nil {
+			return string(matches[1])
+		}
+	}
+	return ""
+}
+
+// probeCuDNNVersion extracts the cuDNN version from the cudnn_version.h header of cuDNN 8
+// and later, or the cudnn.h header of earlier releases
+//
+func probeCuDNNVersion(include string) (version string) {
+	for _, header := range []string{"cudnn_version.h", "cudnn.h"} {
+		file, errGo := os.Open(filepath.Join(include, header))
+		if errGo != nil {
+			continue
+		}
+
+		parts := map[string]string{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			if matches := cudnnDefineRE.FindStringSubmatch(strings.TrimSpace(scanner.Text())); matches != nil {
+				parts[matches[1]] = matches[2]
+			}
+		}
+		file.Close()
+
+		if len(parts["MAJOR"]) != 0 && len(parts["MINOR"]) != 0 {
+			version = parts["MAJOR"] + "." + parts["MINOR"]
+			if len(parts["PATCHLEVEL"]) != 0 {
+				version += "." + parts["PATCHLEVEL"]
+			}
+			return version
+		}
+	}
+	return ""
+}
+
+// VersionAtLeast tests a dotted version number against a minimum, missing components are
+// treated as zero so that 11 satisfies 11.0.  An empty version never satisfies the minimum.
+//
+func VersionAtLeast(version string, minimum string) (ok bool) {
+	if len(minimum) == 0 {
+		return true
+	}
+	if len(version) == 0 {
+		return false
+	}
+
+	have := strings.Split(version, ".")
+	want := strings.Split(minimum, ".")
+	for i := 0; i < len(have) || i < len(want); i++ {
+		h, w := 0, 0
+		if i < len(have) {
+			h, _ = strconv.Atoi(have[i])
+		}
+		if i < len(want) {
+			w, _ = strconv.Atoi(want[i])
+		}
+		if h != w {
+			return h > w
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestCUDAVersions checks the probing of the CUDA software versions using a simulated
+// installation, and the comparison of the versions found against those an experiment needs
+//
+func TestCUDAVersions(t *testing.T) {
+	root, errGo := ioutil.TempDir("", "cuda-versions")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		"proc/driver/nvidia/version":                   "NVRM version: NVIDIA UNIX x86_64 Kernel Module  470.82.01  Wed Oct 27 04:39:45 UTC 2021\n",
+		"usr/local/cuda/version.json":                  `{"cuda": {"name": "CUDA SDK", "version": "11.4.3"}}`,
+		"usr/include/x86_64-linux-gnu/cudnn_version.h": "#define CUDNN_MAJOR 8\n#define CUDNN_MINOR 2\n#define CUDNN_PATCHLEVEL 4\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(root, name)
+		if errGo = os.MkdirAll(filepath.Dir(path), 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo = ioutil.WriteFile(path, []byte(contents), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	origRoot := cudaRoot
+	cudaRoot = root
+	defer func() {
+		cudaRoot = origRoot
+	}()
+
+	expected := CUDAVersions{Driver: "470.82.01", CUDA: "11.4.3", CuDNN: "8.2.4"}
+	if versions := probeCUDAVersions(); *versions != expected {
+		t.Fatalf("expected versions %+v, got %+v", expected, *versions)
+	}
+
+	// Releases prior to CUDA 11 record the version as text
+	os.Remove(filepath.Join(root, "usr/local/cuda/version.json"))
+	ioutil.WriteFile(filepath.Join(root, "usr/local/cuda/version.txt"), []byte("CUDA Version 10.1.243\n"), 0600)
+	if version := probeToolkitVersion(filepath.Join(root, "usr/local/cuda")); version != "10.1.243" {
+		t.Fatalf("expected toolkit version 10.1.243, got %s", version)
+	}
+
+	node := &Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", Cuda: expected.CUDA, Cudnn: expected.CuDNN}
+	for minimum, fits := range map[string]bool{"": true, "10.2": true, "11": true, "11.4.3": true, "11.5": false, "12.0": false} {
+		rsc := &Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", Cuda: minimum}
+		if fit, err := rsc.Fit(node); err != nil || fit != fits {
+			t.Fatalf("cuda %s fit %v, expected %v, error %v", minimum, fit, fits, err)
+		}
+	}
+
+	// Nodes without CUDA cannot run experiments needing it
+	if fit, _ := (&Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", Cudnn: "7"}).Fit(&Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb"}); fit {
+		t.Fatal("experiment needing cudnn fitted a node without it")
+	}
+}
@@ -0,0 +1,260 @@
+package runner
+
+// This file contains the implementation of a queue that uses a local directory as its
+// source of work.  It is intended for air-gapped and local development scenarios where
+// studioML request JSON files are dropped into a directory rather than sent to a
+// queue server.
+//
+// Each subdirectory of the watched directory is treated as a queue and its name is
+// matched against the queue matching expression.  Pending requests are files with a
+// .json extension inside the queue directory.  Files are moved into a working
+// subdirectory while being processed and then into a done, or failed subdirectory
+// depending upon whether the handler completed the request, or dumped it.  Requests the
+// handler did not acknowledge are moved back into the queue directory to be retried.
+//
+// While a request is being processed its file in the working directory is touched
+// periodically.  Files in the working directory that have not been touched for a while
+// were left by a runner that stopped and are returned to the queue.
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	dirQueueWorking = "working"
+	dirQueueDone    = "done"
+	dirQueueFailed  = "failed"
+)
+
+var (
+	// dirQueueStale is the period after which a request in the working directory that has
+	// not been touched is considered abandoned and returned to the queue
+	dirQueueStale = 10 * time.Minute
+)
+
+// DirQueue encapsulates the directory being watched for request files
+//
+type DirQueue struct {
+	path string
+}
+
+// IsDirQueue is used to test if a project reference identifies a local directory
+// rather than a queue server
+//
+func IsDirQueue(project string) bool {
+	if strings.HasPrefix(project, "file://") {
+		return true
+	}
+	if !filepath.IsAbs(project) {
+		return false
+	}
+	info, errGo := os.Stat(project)
+	return errGo == nil && info.IsDir()
+}
+
+// NewDirQueue will validate the directory that work will be retrieved from and return
+// a task queue for it.  The path can be a plain path or a file:// URL.
+//
+func NewDirQueue(path string) (dq *DirQueue, err errors.Error) {
+
+	path = strings.TrimPrefix(path, "file://")
+
+	info, errGo := os.Stat(path)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+	if !info.IsDir() {
+		return nil, errors.New("queue path is not a directory").With("path", path).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return &DirQueue{
+		path: path,
+	}, nil
+}
+
+// pending returns the names of the request files waiting in a queue directory, oldest
+// file names first
+//
+func (dq *DirQueue) pending(queue string) (files []string, err errors.Error) {
+	infos, errGo := ioutil.ReadDir(filepath.Join(dq.path, queue))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("path", dq.path, "queue", queue).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	files = []string{}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		files = append(files, info.Name())
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Refresh lists the queue directories that match the caller supplied expression along
+// with the number of requests that are pending within each
+//
+func (dq *DirQueue) Refresh(ctx context.Context, matcher *regexp.Regexp) (known map[string]interface{}, err errors.Error) {
+
+	known = map[string]interface{}{}
+
+	infos, errGo := ioutil.ReadDir(dq.path)
+	if errGo != nil {
+		return known, errors.Wrap(errGo).With("path", dq.path).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if matcher != nil && !matcher.MatchString(info.Name()) {
+			continue
+		}
+		files, err := dq.pending(info.Name())
+		if err != nil {
+			return known, err
+		}
+		known[info.Name()] = len(files)
+	}
+	return known, nil
+}
+
+// Exists checks that the directory for a queue is still present
+//
+func (dq *DirQueue) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+	info, errGo := os.Stat(filepath.Join(dq.path, subscription))
+	if errGo != nil {
+		if os.IsNotExist(errGo) {
+			return false, nil
+		}
+		return false, errors.Wrap(errGo).With("path", dq.path, "queue", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+	return info.IsDir(), nil
+}
+
+// Work will claim the oldest pending request in the queue directory, present it to the
+// handler for processing, and then file it according to the result
+//
+func (dq *DirQueue) Work(ctx context.Context, qt *QueueTask) (msgCnt uint64, resource *Resource, err errors.Error) {
+
+	queueDir := filepath.Join(dq.path, qt.Subscription)
+
+	files, err := dq.pending(qt.Subscription)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, subDir := range []string{dirQueueWorking, dirQueueDone, dirQueueFailed} {
+		if errGo := os.MkdirAll(filepath.Join(queueDir, subDir), 0700); errGo != nil {
+			return 0, nil, errors.Wrap(errGo).With("path", queueDir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	// Requests abandoned by runners that stopped part way through are made available again
+	if recovered := dq.recover(queueDir); recovered != 0 {
+		if files, err = dq.pending(qt.Subscription); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	// Renames are atomic so the first request that can be moved into the working directory is
+	// ours, others might have been claimed by concurrent workers.  The file is touched before
+	// being moved so that it is not seen as abandoned once in the working directory.
+	claimed := ""
+	for _, file := range files {
+		now := time.Now()
+		if errGo := os.Chtimes(filepath.Join(queueDir, file), now, now); errGo != nil {
+			continue
+		}
+		if errGo := os.Rename(filepath.Join(queueDir, file), filepath.Join(queueDir, dirQueueWorking, file)); errGo == nil {
+			claimed = file
+			break
+		}
+	}
+	if len(claimed) == 0 {
+		return 0, nil, nil
+	}
+
+	working := filepath.Join(queueDir, dirQueueWorking, claimed)
+	msg, errGo := ioutil.ReadFile(working)
+	if errGo != nil {
+		os.Rename(working, filepath.Join(queueDir, dirQueueFailed, claimed))
+		return 0, nil, errors.Wrap(errGo).With("file", working).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	qt.Msg = msg
+	qt.Backlog = uint64(len(files) - 1)
+
+	stopTouchC := make(chan struct{})
+	go touch(working, dirQueueStale/4, stopTouchC)
+
+	rsc, ack := qt.Handler(ctx, qt)
+	close(stopTouchC)
+
+	dest := filepath.Join(queueDir, claimed)
+	if ack {
+		resource = rsc
+		dest = filepath.Join(queueDir, dirQueueDone, claimed)
+		if qt.Dumped {
+			dest = filepath.Join(queueDir, dirQueueFailed, claimed)
+		}
+	}
+
+	if errGo = os.Rename(working, dest); errGo != nil {
+		return 1, resource, errors.Wrap(errGo).With("file", working).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return 1, resource, nil
+}
+
+// touch updates the modification time of a request being processed until it is told to stop,
+// marking the request as not abandoned
+//
+func touch(fn string, interval time.Duration, stopC <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			os.Chtimes(fn, now, now)
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// recover moves requests in the working directory of a queue that have not been touched
+// recently back into the queue directory, returning the number moved
+//
+func (dq *DirQueue) recover(queueDir string) (recovered int) {
+	infos, errGo := ioutil.ReadDir(filepath.Join(queueDir, dirQueueWorking))
+	if errGo != nil {
+		return 0
+	}
+
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		if time.Since(info.ModTime()) < dirQueueStale {
+			continue
+		}
+		if errGo := os.Rename(filepath.Join(queueDir, dirQueueWorking, info.Name()), filepath.Join(queueDir, info.Name())); errGo == nil {
+			recovered++
+		}
+	}
+	return recovered
+}
@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// TestDirQueue exercises the retrieval of requests from a local directory and the filing
+// of them according to the handlers result
+//
+func TestDirQueue(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "dirqueue")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	queue := filepath.Join(dir, "rmq_local")
+	if errGo = os.MkdirAll(queue, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+	for _, file := range []string{"a.json", "b.json", "ignored.txt"} {
+		if errGo = ioutil.WriteFile(filepath.Join(queue, file), []byte(file), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	if !IsDirQueue("file://" + dir) {
+		t.Fatal("file URL was not detected as a directory queue")
+	}
+
+	tq, err := NewTaskQueue("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	known, err := tq.Refresh(context.Background(), regexp.MustCompile("^rmq_.*$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, isPresent := known["rmq_local"]; !isPresent || pending.(int) != 2 {
+		t.Fatalf("unexpected queues found %v", known)
+	}
+
+	// Requests that are not acknowledged are returned to the queue and retried, those that are
+	// dumped are filed as failures
+	for _, expected := range []struct {
+		file   string
+		ack    bool
+		dumped bool
+		dest   string
+	}{
+		{file: "a.json", ack: true, dest: dirQueueDone},
+		{file: "b.json", ack: false, dest: ""},
+		{file: "b.json", ack: true, dumped: true, dest: dirQueueFailed},
+	} {
+		qt := &QueueTask{
+			Subscription: "rmq_local",
+			Handler: func(ctx context.Context, qt *QueueTask) (resource *Resource, ack bool) {
+				if string(qt.Msg) != expected.file {
+					t.Fatalf("expected %s got %s", expected.file, string(qt.Msg))
+				}
+				qt.Dumped = expected.dumped
+				return nil, expected.ack
+			},
+		}
+		cnt, _, err := tq.Work(context.Background(), qt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cnt != 1 {
+			t.Fatalf("expected a request to be processed for %s", expected.file)
+		}
+		if _, errGo = os.Stat(filepath.Join(queue, expected.dest, expected.file)); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	if cnt, _, err := tq.Work(context.Background(), &QueueTask{Subscription: "rmq_local"}); err != nil || cnt != 0 {
+		t.Fatalf("expected an empty queue, %d %v", cnt, err)
+	}
+
+	// Requests left in the working directory by a runner that stopped are retried once they
+	// have not been touched for a while
+	abandoned := filepath.Join(queue, dirQueueWorking, "c.json")
+	if errGo = ioutil.WriteFile(abandoned, []byte("c.json"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if cnt, _, err := tq.Work(context.Background(), &QueueTask{Subscription: "rmq_local"}); err != nil || cnt != 0 {
+		t.Fatalf("a request being worked on was recovered, %d %v", cnt, err)
+	}
+
+	stale := time.Now().Add(-2 * dirQueueStale)
+	if errGo = os.Chtimes(abandoned, stale, stale); errGo != nil {
+		t.Fatal(errGo)
+	}
+	qt := &QueueTask{
+		Subscription: "rmq_local",
+		Handler: func(ctx context.Context, qt *QueueTask) (resource *Resource, ack bool) {
+			if string(qt.Msg) != "c.json" {
+				t.Fatalf("expected c.json got %s", string(qt.Msg))
+			}
+			return nil, true
+		},
+	}
+	if cnt, _, err := tq.Work(context.Background(), qt); err != nil || cnt != 1 {
+		t.Fatalf("the abandoned request was not recovered, %d %v", cnt, err)
+	}
+	if _, errGo = os.Stat(filepath.Join(queue, dirQueueDone, "c.json")); errGo != nil {
+		t.Fatal(errGo)
+	}
+}
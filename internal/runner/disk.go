@@ -3,6 +3,8 @@ package runner
 // This file contains functions and data used to deal with local disk space allocation
 
 import (
+	"os"
+	"strings"
 	"sync"
 	"syscall"
 
@@ -26,8 +28,23 @@ type diskTracker struct {
 
 var (
 	diskTrack = &diskTracker{}
+
+	// statfs is used to query the free space on devices and is replaced by tests
+	// that need to simulate devices that are full
+	statfs = syscall.Statfs
+)
+
+const (
+	outOfDisk = "out of disk"
 )
 
+// IsOutOfDisk can be used to determine if an error was the result of the local storage
+// being exhausted
+//
+func IsOutOfDisk(err errors.Error) bool {
+	return err != nil && (strings.Contains(err.Error(), outOfDisk) || strings.Contains(err.Error(), syscall.ENOSPC.Error()))
+}
+
 func initDiskResource(device string) (err errors.Error) {
 	_, diskTrack.InitErr = SetDiskLimits(device, 0)
 	return diskTrack.InitErr
@@ -41,12 +58,15 @@ func GetDiskFree() (free uint64) {
 	defer diskTrack.Unlock()
 
 	fs := syscall.Statfs_t{}
-	if err := syscall.Statfs(diskTrack.Device, &fs); err != nil {
+	if err := statfs(diskTrack.Device, &fs); err != nil {
 		return 0
 	}
 
 	hardwareFree := uint64(float64(fs.Bavail * uint64(fs.Bsize))) // Space available to user, allows for quotas etc, leave 15% headroom
 
+	if hardwareFree <= diskTrack.SoftMinFree+diskTrack.AllocSpace {
+		return 0
+	}
 	return hardwareFree - diskTrack.SoftMinFree - diskTrack.AllocSpace
 }
 
@@ -55,7 +75,7 @@ func GetDiskFree() (free uint64) {
 //
 func GetPathFree(path string) (free uint64, err errors.Error) {
 	fs := syscall.Statfs_t{}
-	if errGo := syscall.Statfs(path, &fs); errGo != nil {
+	if errGo := statfs(path, &fs); errGo != nil {
 		return 0, errors.Wrap(errGo).With("path", path).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -67,7 +87,7 @@ func GetPathFree(path string) (free uint64, err errors.Error) {
 func SetDiskLimits(device string, minFree uint64) (avail uint64, err errors.Error) {
 
 	fs := syscall.Statfs_t{}
-	if errGo := syscall.Statfs(device, &fs); err != nil {
+	if errGo := statfs(device, &fs); errGo != nil {
 		return 0, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -102,14 +122,14 @@ func AllocDisk(maxSpace uint64) (alloc *DiskAllocated, err errors.Error) {
 	defer diskTrack.Unlock()
 
 	fs := syscall.Statfs_t{}
-	if errGo := syscall.Statfs(diskTrack.Device, &fs); err != nil {
+	if errGo := statfs(diskTrack.Device, &fs); errGo != nil {
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
 	avail := fs.Bavail * uint64(fs.Bsize)
 	newAlloc := (diskTrack.AllocSpace + maxSpace)
-	if avail-newAlloc <= diskTrack.SoftMinFree {
-		return nil, errors.New("insufficient space for allocation").
+	if newAlloc >= avail || avail-newAlloc <= diskTrack.SoftMinFree {
+		return nil, errors.New(outOfDisk+", insufficient space for allocation").
 			With("available", humanize.Bytes(avail), "soft_min_free", humanize.Bytes(diskTrack.SoftMinFree),
 				"device", diskTrack.Device, "maxmimum_space", humanize.Bytes(maxSpace)).
 			With("stack", stack.Trace().TrimRuntime())
@@ -123,6 +143,33 @@ func AllocDisk(maxSpace uint64) (alloc *DiskAllocated, err errors.Error) {
 	return alloc, nil
 }
 
+// AllocStaging is used while an experiment is running to reserve space on the default disk
+// device for staging the contents of a directory, for example when it is being archived for
+// uploading.  An out of disk error is returned if the space is not available.
+//
+// The space already written into the experiment directory, exprDir, is no longer free on the
+// device but is also part of the reserved allocation of the experiment.  Only the space needed
+// beyond what has been written, up to the reservation, is allocated so that it is not
+// counted twice.
+//
+func AllocStaging(dir string, exprDir string, reserved uint64) (alloc *DiskAllocated, err errors.Error) {
+	size := diskUsage(dir)
+
+	written := diskUsage(exprDir)
+	if written > reserved {
+		written = reserved
+	}
+	need := uint64(0)
+	if size > written {
+		need = size - written
+	}
+
+	if alloc, err = AllocDisk(need); err != nil {
+		return nil, err.With("staging_dir", dir, "staging_size", humanize.Bytes(size))
+	}
+	return alloc, nil
+}
+
 // Release will return assigned disk space back to the free pool of disk space
 // for a default disk device.  If the allocation is not recognized then an
 // error is returned
@@ -149,3 +196,14 @@ func (alloc *DiskAllocated) Release() (err errors.Error) {
 
 	return nil
 }
+
+// ReclaimDir removes a directory tree from the default disk device returning the space that
+// was freed by doing so, once removed the space is available to new allocations
+//
+func ReclaimDir(dir string) (freed uint64, err errors.Error) {
+	freed = diskUsage(dir)
+	if errGo := os.RemoveAll(dir); errGo != nil {
+		return 0, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	return freed, nil
+}
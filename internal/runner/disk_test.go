@@ -0,0 +1,110 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// This file contains tests of the local disk allocation logic that use a simulated
+// device so that the behavior of a full device can be observed
+
+// simulateDisk replaces the device queries with one reporting the free space supplied, the
+// returned function restores the original tracking
+//
+func simulateDisk(free uint64) (restore func()) {
+	origStatfs := statfs
+
+	diskTrack.Lock()
+	device, allocSpace, softMinFree, initErr := diskTrack.Device, diskTrack.AllocSpace, diskTrack.SoftMinFree, diskTrack.InitErr
+	diskTrack.Device = "simulated"
+	diskTrack.AllocSpace = 0
+	diskTrack.SoftMinFree = 0
+	diskTrack.InitErr = nil
+	diskTrack.Unlock()
+
+	statfs = func(path string, fs *syscall.Statfs_t) (errGo error) {
+		fs.Bsize = 4096
+		fs.Bavail = free / 4096
+		return nil
+	}
+
+	return func() {
+		statfs = origStatfs
+
+		diskTrack.Lock()
+		diskTrack.Device = device
+		diskTrack.AllocSpace = allocSpace
+		diskTrack.SoftMinFree = softMinFree
+		diskTrack.InitErr = initErr
+		diskTrack.Unlock()
+	}
+}
+
+// TestDiskFull checks that allocations on a full device fail with an out of disk error
+// rather than the free space calculations wrapping around
+//
+func TestDiskFull(t *testing.T) {
+	restore := simulateDisk(0)
+	defer restore()
+
+	if free := GetDiskFree(); free != 0 {
+		t.Fatalf("full device reported %d bytes free", free)
+	}
+
+	alloc, err := AllocDisk(1024 * 1024)
+	if err == nil {
+		alloc.Release()
+		t.Fatal("allocation on a full device succeeded")
+	}
+	if !IsOutOfDisk(err) {
+		t.Fatalf("allocation on a full device was not out of disk, %v", err)
+	}
+}
+
+// TestDiskStagingFull checks that staging space for a directory is only given when the
+// device has room for the contents of the directory
+//
+func TestDiskStagingFull(t *testing.T) {
+	dir, errGo := ioutil.TempDir("", "disk-staging")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	if errGo = ioutil.WriteFile(filepath.Join(dir, "output"), make([]byte, 256*1024), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	restore := simulateDisk(1024 * 1024 * 1024)
+	alloc, err := AllocStaging(dir, dir, 0)
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	if err = alloc.Release(); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	restore()
+
+	// A device with less free space than the directory being staged
+	restore = simulateDisk(64 * 1024)
+	defer restore()
+
+	if alloc, err = AllocStaging(dir, dir, 0); err == nil {
+		alloc.Release()
+		t.Fatal("staging on a full device succeeded")
+	}
+	if !IsOutOfDisk(err) {
+		t.Fatalf("staging on a full device was not out of disk, %v", err)
+	}
+
+	// Output already written within the reservation of the experiment is not counted again
+	if alloc, err = AllocStaging(dir, dir, 1024*1024); err != nil {
+		t.Fatalf("staging output covered by the reservation of the experiment failed, %v", err)
+	}
+	alloc.Release()
+}
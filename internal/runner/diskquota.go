@@ -0,0 +1,90 @@
+package runner
+
+// This file contains the implementation of a monitor for the disk space consumed by an
+// experiment.  The logical allocations made in disk.go do not prevent an experiment
+// from writing more than it requested so the experiments directory is measured
+// periodically and the experiment stopped if it exceeds its allocation.  The virtualenv the
+// runner builds for the experiment is not counted as the experiment did not ask for it.
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	diskQuotaCheckOpt = flag.Duration("disk-quota-check", 30*time.Second, "the interval between checks of the disk space consumed by experiments against their hdd request, 0 disables checking")
+)
+
+const (
+	diskQuotaExceeded = "disk quota exceeded"
+)
+
+// IsDiskQuotaExceeded can be used to determine if an experiment failed because it exceeded
+// the disk space it requested
+//
+func IsDiskQuotaExceeded(err errors.Error) bool {
+	return err != nil && strings.Contains(err.Error(), diskQuotaExceeded)
+}
+
+// diskUsage returns the space consumed by the files within a directory tree, skipping the
+// directories excluded
+//
+func diskUsage(dir string, excluded ...string) (used uint64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+		if errGo != nil || info == nil {
+			return nil
+		}
+		if info.IsDir() {
+			for _, exclude := range excluded {
+				if path == exclude {
+					return filepath.SkipDir
+				}
+			}
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			used += uint64(st.Blocks) * 512
+		} else if info.Mode().IsRegular() {
+			used += uint64(info.Size())
+		}
+		return nil
+	})
+	return used
+}
+
+// monitorDiskQuota periodically measures the space used within dir, other than within the
+// excluded directories, and when it exceeds the quota will call the stop function with an
+// error explaining the issue.  The function returns when the context is done or the quota
+// was exceeded.
+//
+func monitorDiskQuota(ctx context.Context, dir string, quota uint64, stop func(err errors.Error), excluded ...string) {
+
+	if quota == 0 || *diskQuotaCheckOpt == 0 {
+		return
+	}
+
+	check := time.NewTicker(*diskQuotaCheckOpt)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-check.C:
+			if used := diskUsage(dir, excluded...); used > quota {
+				stop(errors.New(diskQuotaExceeded).With("dir", dir, "used", humanize.Bytes(used), "quota", humanize.Bytes(quota)).
+					With("stack", stack.Trace().TrimRuntime()))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestDiskUsageExcluded checks that the directories excluded from the disk usage of an
+// experiment, such as the virtualenv the runner built, are not counted
+//
+func TestDiskUsageExcluded(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "disk-usage")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	venv := filepath.Join(dir, "_runner")
+	for _, sub := range []string{venv, filepath.Join(dir, "output")} {
+		if errGo = os.MkdirAll(sub, 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo = ioutil.WriteFile(filepath.Join(sub, "data"), make([]byte, 64*1024), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+	}
+
+	all := diskUsage(dir)
+	experiment := diskUsage(dir, venv)
+	if experiment < 64*1024 || all < experiment+64*1024 {
+		t.Fatalf("excluded directory counted, %d bytes in total, %d by the experiment", all, experiment)
+	}
+}
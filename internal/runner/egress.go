@@ -0,0 +1,443 @@
+package runner
+
+// This file contains the implementation of restricting the network destinations experiments
+// can reach.  When restricted each experiment is given its own proxy, served by the runner on
+// the loopback interface, that only forwards to the hosts of the artifacts of the experiment
+// and to the package index hosts the operator allows.  The experiment is directed to the
+// proxy using the standard proxy environment variables, which carry credentials unique to
+// the proxy so that one experiment cannot use the proxy of another.  Tunnels are only made to
+// the HTTPS port, and plain requests only to the HTTP and HTTPS ports.  The artifact hosts
+// come from the experiment so the proxy only connects to them at public addresses, hosts
+// the operator allows, such as an object store on a private network, are trusted wherever
+// they resolve.  When the runner also runs experiments as an unprivileged user firewall
+// rules reject any traffic from that user other than connections to the ports of the egress
+// proxies, so that neither the proxy nor the other services of the runner listening on the
+// loopback interface can be reached.  Singularity experiments are given a proxy but are not
+// run as the run-as user, so for them the proxy is advisory.
+//
+// Experiments that do not need the network once their python environment is built can ask
+// to be isolated, after which their proxy refuses every destination.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	EgressOpen  = "open"  // Experiments can reach any destination
+	EgressProxy = "proxy" // Experiments can only reach their artifact hosts and the allowed hosts
+
+	NetworkIsolated = "none" // Requested by experiments that do not use the network once their environment is built
+
+	// egressChain is the firewall chain holding the rules applied to the run-as user
+	egressChain = "STUDIOML_EGRESS"
+
+	// egressProxyUser is the user name in the credentials of the egress proxies
+	egressProxyUser = "studioml"
+)
+
+var (
+	egressPolicyOpt = flag.String("egress-policy", EgressOpen, "the network destinations experiments can reach, 'open' for any destination, or 'proxy' to allow only the hosts of their artifacts and those in egress-allow, when run-as is also used a firewall rule stops experiments bypassing the proxy")
+	egressAllowOpt  = flag.String("egress-allow", "pypi.org,files.pythonhosted.org", "a comma separated list of the hosts experiments can reach in addition to their artifact hosts, such as the python package index, names starting with a '.' match any sub domain")
+
+	// egressFirewall is set once the firewall rules for the run-as user are in place, the
+	// port of each proxy is then opened to the user while the proxy is running
+	egressFirewall int32
+)
+
+// validateNetwork checks the network access an experiment asked for
+//
+func validateNetwork(r *Request) (err errors.Error) {
+	switch r.Experiment.Network {
+	case "", NetworkIsolated:
+		return nil
+	}
+	return errors.New("network must be empty, or 'none'").With("experiment_id", r.Experiment.Key, "network", r.Experiment.Network).With("stack", stack.Trace().TrimRuntime())
+}
+
+// ValidateEgress checks the egress-policy option and, when experiments are run as an
+// unprivileged user, installs the firewall rules that restrict the user to the ports of the
+// egress proxies.  It should be called during startup after the run-as user has been validated.
+// The returned policy is empty when experiments are unrestricted.
+//
+func ValidateEgress() (policy string, err errors.Error) {
+	switch *egressPolicyOpt {
+	case EgressOpen, "":
+		return "", nil
+	case EgressProxy:
+	default:
+		return "", errors.New("egress-policy must be 'open' or 'proxy'").With("egress-policy", *egressPolicyOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	u, err := getRunAs()
+	if err != nil {
+		return "", err
+	}
+	if u == nil {
+		return EgressProxy + " (advisory, run-as is not set)", nil
+	}
+	if err = installEgressFirewall(u.uid); err != nil {
+		return "", err
+	}
+	return EgressProxy, nil
+}
+
+// installEgressFirewall directs the traffic of the user through a chain that rejects
+// everything other than the connections the egress proxies open for themselves.  The chain is
+// created, or emptied of the rules of an earlier runner, and the IPv6 rules are only added
+// when ip6tables is installed.  The proxies listen on an IPv4 address so the IPv6 chain
+// rejects everything.
+//
+func installEgressFirewall(uid uint32) (err errors.Error) {
+	jump := []string{"OUTPUT", "-m", "owner", "--uid-owner", strconv.FormatUint(uint64(uid), 10), "-j", egressChain}
+
+	for _, tool := range []string{"iptables", "ip6tables"} {
+		if _, errGo := exec.LookPath(tool); errGo != nil {
+			if tool == "iptables" {
+				return errors.Wrap(errGo, "iptables is needed to restrict the egress of experiments").With("stack", stack.Trace().TrimRuntime())
+			}
+			continue
+		}
+		exec.Command(tool, "-N", egressChain).Run()
+		if err = firewall(tool, "-F", egressChain); err != nil {
+			return err
+		}
+		if err = firewall(tool, "-A", egressChain, "-j", "REJECT"); err != nil {
+			return err
+		}
+		if errGo := exec.Command(tool, append([]string{"-C"}, jump...)...).Run(); errGo == nil {
+			continue
+		}
+		if err = firewall(tool, append([]string{"-A"}, jump...)...); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&egressFirewall, 1)
+	return nil
+}
+
+// firewall runs an iptables command
+//
+func firewall(tool string, args ...string) (err errors.Error) {
+	if output, errGo := exec.Command(tool, args...).CombinedOutput(); errGo != nil {
+		return errors.Wrap(errGo, "egress firewall rule not changed").With("tool", tool, "args", strings.Join(args, " "), "output", strings.TrimSpace(string(output))).
+			With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// proxyRule returns the firewall rule that lets the run-as user connect to a proxy port
+//
+func proxyRule(port int) (rule []string) {
+	return []string{egressChain, "-o", "lo", "-p", "tcp", "-d", "127.0.0.1", "--dport", strconv.Itoa(port), "-j", "ACCEPT"}
+}
+
+// egressRestricted tests if the experiment is to be run behind an egress proxy
+//
+func egressRestricted(r *Request) (restricted bool) {
+	return *egressPolicyOpt == EgressProxy || r.Experiment.Network == NetworkIsolated
+}
+
+// egressAllowed returns the hosts the operator allows every experiment to reach
+//
+func egressAllowed() (hosts []string) {
+	hosts = []string{}
+	for _, host := range strings.Split(*egressAllowOpt, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); len(host) != 0 {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// egressHosts returns the hosts the experiment is permitted to reach, the hosts of its
+// artifacts along with the hosts the operator allows for every experiment
+//
+func egressHosts(r *Request) (hosts []string) {
+	unique := map[string]struct{}{}
+	for _, host := range egressAllowed() {
+		unique[host] = struct{}{}
+	}
+	for _, art := range r.Experiment.Artifacts {
+		uri, errGo := url.Parse(art.Qualified)
+		if errGo != nil {
+			continue
+		}
+		switch uri.Scheme {
+		case "gs":
+			unique["storage.googleapis.com"] = struct{}{}
+			unique["www.googleapis.com"] = struct{}{}
+			unique["oauth2.googleapis.com"] = struct{}{}
+		default:
+			if host := strings.ToLower(uri.Hostname()); len(host) != 0 {
+				unique[host] = struct{}{}
+			}
+		}
+	}
+
+	hosts = make([]string, 0, len(unique))
+	for host := range unique {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// egressProxy is an HTTP proxy that only forwards requests, and tunnels connections, to a
+// fixed set of hosts
+//
+type egressProxy struct {
+	hosts      []string
+	trusted    []string // Hosts the operator allows that can be reached at any address
+	isolated   int32
+	password   string
+	tunnelPort string
+	httpPorts  []string
+	port       int
+	listener   net.Listener
+	server     *http.Server
+	transport  *http.Transport
+}
+
+// startEgressProxy serves a proxy on the loopback interface for the experiment, nil is
+// returned when the experiment is not restricted
+//
+func startEgressProxy(r *Request) (proxy *egressProxy, err errors.Error) {
+	if !egressRestricted(r) {
+		return nil, nil
+	}
+	return newEgressProxy(egressHosts(r), egressAllowed())
+}
+
+func newEgressProxy(hosts []string, trusted []string) (proxy *egressProxy, err errors.Error) {
+	secret := make([]byte, 16)
+	if _, errGo := rand.Read(secret); errGo != nil {
+		return nil, errors.Wrap(errGo, "egress proxy credentials could not be generated").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "egress proxy could not be started").With("stack", stack.Trace().TrimRuntime())
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if atomic.LoadInt32(&egressFirewall) != 0 {
+		if err = firewall("iptables", append([]string{"-I"}, proxyRule(port)...)...); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	proxy = &egressProxy{
+		hosts:      hosts,
+		trusted:    trusted,
+		password:   hex.EncodeToString(secret),
+		tunnelPort: "443",
+		httpPorts:  []string{"80", "443"},
+		port:       port,
+		listener:   listener,
+	}
+	proxy.transport = &http.Transport{
+		DialContext:         proxy.dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	proxy.server = &http.Server{Handler: proxy}
+
+	go proxy.server.Serve(listener)
+
+	return proxy, nil
+}
+
+// isolate stops the proxy forwarding to any host
+//
+func (proxy *egressProxy) isolate() {
+	atomic.StoreInt32(&proxy.isolated, 1)
+}
+
+// hostListed tests if the host is in a list of hosts, names in the list starting with a '.'
+// match any sub domain
+//
+func hostListed(host string, hosts []string) (listed bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, permitted := range hosts {
+		if host == permitted {
+			return true
+		}
+		if strings.HasPrefix(permitted, ".") && (strings.HasSuffix(host, permitted) || host == permitted[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed tests if the proxy will forward to the host
+//
+func (proxy *egressProxy) allowed(host string) (allowed bool) {
+	if atomic.LoadInt32(&proxy.isolated) != 0 {
+		return false
+	}
+	return hostListed(host, proxy.hosts)
+}
+
+// dial connects to a host the proxy forwards to, refusing addresses that are not public
+// for hosts the operator has not allowed
+//
+func (proxy *egressProxy) dial(ctx context.Context, network string, addr string) (conn net.Conn, errGo error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if host, _, errGo := net.SplitHostPort(addr); errGo != nil || !hostListed(host, proxy.trusted) {
+		dialer.Control = PublicOnly
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// authorized tests if the request carries the credentials of the proxy
+//
+func (proxy *egressProxy) authorized(r *http.Request) (authorized bool) {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(egressProxyUser+":"+proxy.password))
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Proxy-Authorization")), []byte(expected)) == 1
+}
+
+// env returns the environment variables that direct the experiment to the proxy
+//
+func (proxy *egressProxy) env() (environ []string) {
+	address := "http://" + egressProxyUser + ":" + proxy.password + "@" + proxy.listener.Addr().String()
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		environ = append(environ, name+"="+address)
+	}
+	return append(environ, "NO_PROXY=localhost,127.0.0.1", "no_proxy=localhost,127.0.0.1")
+}
+
+// Close stops the proxy, tunnels that are open are closed when the experiment exits
+//
+func (proxy *egressProxy) Close() {
+	proxy.server.Close()
+	proxy.transport.CloseIdleConnections()
+
+	if atomic.LoadInt32(&egressFirewall) != 0 {
+		firewall("iptables", append([]string{"-D"}, proxyRule(proxy.port)...)...)
+	}
+}
+
+func (proxy *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !proxy.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="studioml"`)
+		http.Error(w, "[studioml] the egress proxy credentials of this experiment are required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	host := r.URL.Hostname()
+	if len(host) == 0 {
+		host, _, _ = net.SplitHostPort(r.Host)
+	}
+	if !proxy.allowed(host) {
+		http.Error(w, fmt.Sprintf("[studioml] network egress to %s is not permitted for this experiment", host), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		if _, port, _ := net.SplitHostPort(r.Host); port != proxy.tunnelPort {
+			http.Error(w, fmt.Sprintf("[studioml] tunnels to port %s are not permitted, only port %s", port, proxy.tunnelPort), http.StatusForbidden)
+			return
+		}
+		proxy.tunnel(w, r)
+		return
+	}
+
+	port := r.URL.Port()
+	if len(port) == 0 {
+		port = "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	permitted := false
+	for _, httpPort := range proxy.httpPorts {
+		permitted = permitted || port == httpPort
+	}
+	if !permitted {
+		http.Error(w, fmt.Sprintf("[studioml] requests to port %s are not permitted, only ports %s", port, strings.Join(proxy.httpPorts, ",")), http.StatusForbidden)
+		return
+	}
+
+	outbound := r.WithContext(context.Background())
+	outbound.RequestURI = ""
+	outbound.Header.Del("Proxy-Connection")
+	outbound.Header.Del("Proxy-Authorization")
+
+	resp, errGo := proxy.transport.RoundTrip(outbound)
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects the client to the host it asked for and copies data in both directions
+// until either side closes
+//
+func (proxy *egressProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, errGo := proxy.dial(r.Context(), "tcp", r.Host)
+	if errGo != nil {
+		http.Error(w, errGo.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunnelling is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, errGo := hijacker.Hijack()
+	if errGo != nil {
+		upstream.Close()
+		return
+	}
+	if _, errGo = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); errGo != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		client.Close()
+	}()
+	wg.Wait()
+}
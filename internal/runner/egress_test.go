@@ -0,0 +1,146 @@
+package runner
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestEgressHosts checks that experiments are permitted to reach their artifact hosts along
+// with the hosts allowed by the operator
+//
+func TestEgressHosts(t *testing.T) {
+	r := &Request{}
+	r.Experiment.Artifacts = map[string]Artifact{
+		"output":    {Qualified: "s3://minio.example.com:9000/bucket/output.tar"},
+		"workspace": {Qualified: "gs://bucket/workspace.tar"},
+	}
+
+	hosts := strings.Join(egressHosts(r), ",")
+	for _, expected := range []string{"minio.example.com", "storage.googleapis.com", "pypi.org", "files.pythonhosted.org"} {
+		if !strings.Contains(","+hosts+",", ","+expected+",") {
+			t.Fatalf("host %s not permitted, permitted hosts %s", expected, hosts)
+		}
+	}
+
+	for network, valid := range map[string]bool{"": true, NetworkIsolated: true, "host": false} {
+		r.Experiment.Network = network
+		if err := validateNetwork(r); (err == nil) != valid {
+			t.Fatalf("network %q validity expected %v, error %v", network, valid, err)
+		}
+	}
+}
+
+// TestEgressProxy checks that the proxy forwards requests and tunnels only to the permitted
+// hosts for clients holding its credentials, tunnels only to its tunnel port, and forwards
+// nothing once isolated
+//
+func TestEgressProxy(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer plain.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer secure.Close()
+
+	proxy, err := newEgressProxy([]string{"127.0.0.1"}, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	secureURL, errGo := url.Parse(secure.URL)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	plainURL, errGo := url.Parse(plain.URL)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	proxy.tunnelPort = secureURL.Port()
+	proxy.httpPorts = []string{plainURL.Port()}
+
+	proxyURL, errGo := url.Parse("http://" + egressProxyUser + ":" + proxy.password + "@" + proxy.listener.Addr().String())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	client := secure.Client()
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+
+	get := func(target string) (status int, body string) {
+		resp, errGo := client.Get(target)
+		if errGo != nil {
+			return 0, errGo.Error()
+		}
+		defer resp.Body.Close()
+		content, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(content)
+	}
+
+	if status, body := get(plain.URL); status != http.StatusOK || body != "plain" {
+		t.Fatalf("request to a permitted host failed %d %s", status, body)
+	}
+	if status, body := get(secure.URL); status != http.StatusOK || body != "secure" {
+		t.Fatalf("tunnel to a permitted host failed %d %s", status, body)
+	}
+	if status, _ := get("http://example.com/"); status != http.StatusForbidden {
+		t.Fatalf("request to a host that is not permitted was not refused %d", status)
+	}
+
+	// Tunnels to other ports on a permitted host are refused
+	proxy.tunnelPort = "443"
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	if status, body := get(secure.URL); status == http.StatusOK {
+		t.Fatalf("tunnel to a port that is not permitted was not refused %s", body)
+	}
+	proxy.tunnelPort = secureURL.Port()
+
+	// Plain requests to other ports on a permitted host are refused
+	proxy.httpPorts = []string{"80", "443"}
+	if status, body := get(plain.URL); status != http.StatusForbidden {
+		t.Fatalf("request to a port that is not permitted was not refused %d %s", status, body)
+	}
+	proxy.httpPorts = []string{plainURL.Port()}
+
+	// Hosts the operator has not allowed, such as artifact hosts, are refused at addresses
+	// that are not public
+	proxy.trusted = []string{}
+	proxy.transport.CloseIdleConnections()
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	if status, body := get(plain.URL); status == http.StatusOK {
+		t.Fatalf("request to a loopback address was not refused %s", body)
+	}
+	if status, body := get(secure.URL); status == http.StatusOK {
+		t.Fatalf("tunnel to a loopback address was not refused %s", body)
+	}
+	proxy.trusted = []string{"127.0.0.1"}
+
+	// Clients without the credentials of the proxy, such as another experiment, are refused
+	for _, user := range []*url.Userinfo{nil, url.UserPassword(egressProxyUser, "guessed")} {
+		anonymous := *proxyURL
+		anonymous.User = user
+		client.Transport.(*http.Transport).Proxy = http.ProxyURL(&anonymous)
+		if status, _ := get(plain.URL); status != http.StatusProxyAuthRequired {
+			t.Fatalf("request without the proxy credentials was not refused %d", status)
+		}
+	}
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+
+	proxy.isolate()
+	if status, _ := get(plain.URL); status != http.StatusForbidden {
+		t.Fatalf("request from an isolated experiment was not refused %d", status)
+	}
+
+	for _, kv := range proxy.env() {
+		if strings.HasPrefix(kv, "HTTPS_PROXY=") && kv != "HTTPS_PROXY="+proxyURL.String() {
+			t.Fatalf("unexpected proxy environment %s", kv)
+		}
+	}
+}
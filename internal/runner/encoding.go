@@ -0,0 +1,79 @@
+package runner
+
+// This file contains the implementation of content type and encoding handling for
+// message bodies.  Clients can compress or encode their requests, describing what was
+// done using the content-type and content-encoding properties of the message.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// DecodeBody will reverse the encodings listed in contentEncoding, which are listed in the
+// order they were applied, and then checks that the content type is one that the runner
+// understands
+//
+func DecodeBody(contentType string, contentEncoding string, body []byte) (decoded []byte, err errors.Error) {
+
+	if len(strings.TrimSpace(contentType)) != 0 {
+		mediaType, _, errGo := mime.ParseMediaType(contentType)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, corruptMessage+", content-type is invalid").With("content-type", contentType).With("stack", stack.Trace().TrimRuntime())
+		}
+		if !isRequestMediaType(mediaType) {
+			return nil, errors.New(corruptMessage+", content-type is not supported, application/json expected").With("content-type", contentType).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	decoded = body
+	encodings := strings.Split(contentEncoding, ",")
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoding := strings.ToLower(strings.TrimSpace(encodings[i]))
+		switch encoding {
+		case "", "identity":
+		case "base64":
+			buf := make([]byte, base64.StdEncoding.DecodedLen(len(decoded)))
+			n, errGo := base64.StdEncoding.Decode(buf, bytes.TrimSpace(decoded))
+			if errGo != nil {
+				return nil, errors.Wrap(errGo, corruptMessage+", base64 content could not be decoded").With("stack", stack.Trace().TrimRuntime())
+			}
+			decoded = buf[:n]
+		case "gzip", "x-gzip":
+			rdr, errGo := gzip.NewReader(bytes.NewReader(decoded))
+			if errGo != nil {
+				return nil, errors.Wrap(errGo, corruptMessage+", gzip content could not be decompressed").With("stack", stack.Trace().TrimRuntime())
+			}
+			if decoded, errGo = ioutil.ReadAll(rdr); errGo != nil {
+				return nil, errors.Wrap(errGo, corruptMessage+", gzip content could not be decompressed").With("stack", stack.Trace().TrimRuntime())
+			}
+		case "zstd":
+			// No zstd decompressor is available to the runner, the message is refused as it
+			// would be for any other encoding the runner does not support rather than being retried
+			return nil, errors.New(corruptMessage+", zstd content-encoding is refused, gzip should be used instead").With("content-encoding", contentEncoding).
+				With("stack", stack.Trace().TrimRuntime())
+		default:
+			return nil, errors.New(corruptMessage+", content-encoding is not supported, base64 or gzip expected").With("content-encoding", contentEncoding).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return decoded, nil
+}
+
+// isRequestMediaType is used to test content types that can hold JSON requests, including the
+// generic types some AMQP clients use by default
+//
+func isRequestMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/json", "text/json", "text/plain", "application/octet-stream":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json")
+}
@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"testing"
+)
+
+// TestDecodeBody checks that encoded message bodies are decoded and that unsupported
+// content types and encodings are rejected
+//
+func TestDecodeBody(t *testing.T) {
+
+	body := []byte(`{"experiment": {"key": "test"}}`)
+
+	zipped := bytes.Buffer{}
+	w := gzip.NewWriter(&zipped)
+	w.Write(body)
+	w.Close()
+
+	cases := []struct {
+		contentType string
+		encoding    string
+		msg         []byte
+		failed      bool
+	}{
+		{msg: body},
+		{contentType: "application/json; charset=utf-8", msg: body},
+		{encoding: "gzip", msg: zipped.Bytes()},
+		{encoding: "base64", msg: []byte(base64.StdEncoding.EncodeToString(body))},
+		{encoding: "gzip, base64", msg: []byte(base64.StdEncoding.EncodeToString(zipped.Bytes()))},
+		{contentType: "application/xml", msg: body, failed: true},
+		{encoding: "br", msg: body, failed: true},
+		{encoding: "zstd", msg: body, failed: true},
+		{encoding: "zstd, base64", msg: []byte(base64.StdEncoding.EncodeToString(body)), failed: true},
+		{encoding: "gzip", msg: body, failed: true},
+	}
+
+	for i, aCase := range cases {
+		decoded, err := DecodeBody(aCase.contentType, aCase.encoding, aCase.msg)
+		if aCase.failed {
+			if !IsCorruptMessage(err) {
+				t.Fatalf("case %d expected a corrupt message error, %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %d failed, %v", i, err)
+		}
+		if !bytes.Equal(decoded, body) {
+			t.Fatalf("case %d decoded to %s", i, string(decoded))
+		}
+	}
+}
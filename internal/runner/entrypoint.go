@@ -0,0 +1,63 @@
+package runner
+
+// This file contains the validation of the entry point of experiments.  The filename of an
+// experiment is run by python from within the workspace once the environment has been built,
+// so a missing file would only be reported by python after the time consuming pip installs.
+// Checking the file once the workspace has been downloaded allows the experiment to be failed
+// early with an error that names the file.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	entrypointMissing = "experiment filename not found in workspace"
+)
+
+// IsEntrypointMissing can be used to determine if an experiment failed because its filename
+// was not present in the workspace, or did not name a file within it
+//
+func IsEntrypointMissing(err errors.Error) bool {
+	return err != nil && strings.Contains(err.Error(), entrypointMissing)
+}
+
+// CheckEntrypoint ensures that filename resolves to a regular file inside of the workspace
+// directory
+//
+func CheckEntrypoint(workspace string, filename string) (err errors.Error) {
+	if len(filename) == 0 {
+		return errors.New(entrypointMissing + ", experiment filename is empty").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	root, errGo := filepath.EvalSymlinks(workspace)
+	if errGo != nil {
+		return errors.Wrap(errGo, entrypointMissing).With("workspace", workspace, "filename", filename).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	fn := filename
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(root, fn)
+	}
+	resolved, errGo := filepath.EvalSymlinks(fn)
+	if errGo != nil {
+		return errors.Wrap(errGo, entrypointMissing).With("workspace", workspace, "filename", filename).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if rel, errGo := filepath.Rel(root, resolved); errGo != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.New(entrypointMissing + ", experiment filename is outside of the workspace").With("workspace", workspace, "filename", filename).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	info, errGo := os.Stat(resolved)
+	if errGo != nil {
+		return errors.Wrap(errGo, entrypointMissing).With("workspace", workspace, "filename", filename).With("stack", stack.Trace().TrimRuntime())
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New(entrypointMissing + ", experiment filename is not a regular file").With("workspace", workspace, "filename", filename).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
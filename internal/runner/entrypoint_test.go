@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestCheckEntrypoint checks that experiment filenames are accepted only when they name a file
+// within the workspace
+//
+func TestCheckEntrypoint(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "entrypoint")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	workspace := filepath.Join(dir, "workspace")
+	if errGo = os.MkdirAll(filepath.Join(workspace, "src"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	for _, fn := range []string{filepath.Join(workspace, "src", "train.py"), filepath.Join(dir, "outside.py")} {
+		if errGo = ioutil.WriteFile(fn, []byte("print('hello')\n"), 0600); errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+
+	if err := CheckEntrypoint(workspace, "src/train.py"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckEntrypoint(workspace, filepath.Join(workspace, "src", "train.py")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := CheckEntrypoint(workspace, "missing.py")
+	if !IsEntrypointMissing(err) {
+		t.Fatalf("missing entrypoint was not reported, %v", err)
+	}
+
+	for _, filename := range []string{"", "src", "../outside.py"} {
+		if err := CheckEntrypoint(workspace, filename); !IsEntrypointMissing(err) {
+			t.Fatalf("invalid entrypoint %q was not reported, %v", filename, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package runner
+
+// This file contains the implementation of a limiter for the number of python environments
+// that are being built concurrently.  Environment builds run pip which is IO and CPU
+// intensive and when many experiments start at once can thrash the node.
+//
+// Builds that fail are also remembered for a period of time using a hash of the packages
+// that were being installed, experiments asking for the same packages can then be dumped
+// without repeating a build that is expected to fail in the same way.
+//
+// Builds that fail because the package index could not be reached are retried in place, the
+// output of pip is used to tell these transient failures apart from packages that cannot
+// be resolved, which would fail in the same way if retried.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	maxEnvBuildsOpt  = flag.Int("max-env-builds", runtime.NumCPU(), "the maximum number of experiments that can be building their python environments at the same time")
+	envFailureTTLOpt = flag.Duration("env-failure-ttl", 0, "the period of time after a python environment failed to build that experiments with the same packages are dumped rather than being built again, 0 disables this behavior")
+	envAttemptsOpt   = flag.Int("env-build-attempts", 3, "the number of times the python environment of an experiment is built when builds fail due to transient network failures, before the experiment is failed")
+	envBackoffOpt    = flag.Duration("env-build-backoff", 15*time.Second, "the period of time waited before the python environment of an experiment is built again after a transient network failure, doubled after each attempt")
+
+	envBuilds     chan struct{}
+	envBuildsOnce sync.Once
+
+	envFailures = &envFailureCache{
+		failures: map[string]envFailure{},
+	}
+
+	// envTransientFailures match the output of pip when the package index could not be reached
+	envTransientFailures = regexp.MustCompile(`(?i)(connection broken by|max retries exceeded|newconnectionerror|connecttimeouterror|readtimeouterror|` +
+		`read timed out|connection reset by peer|connection refused|temporary failure in name resolution|name or service not known|` +
+		`could not fetch url|incompleteread|http error 5\d\d|5\d\d server error|service unavailable|bad gateway|gateway time-?out)`)
+
+	// envResolutionFailures match the output of pip when the requested packages could not be
+	// resolved
+	envResolutionFailures = regexp.MustCompile(`(?i)(could not find a version that satisfies|no matching distribution found|resolutionimpossible|` +
+		`conflicting dependencies|double requirement given|is not a supported wheel|requires a different python)`)
+)
+
+const (
+	envBuildTransient  = "python environment build failed, transient network failure"
+	envBuildResolution = "python environment build failed, dependency resolution failure"
+	envBuildFailure    = "python environment build failed"
+)
+
+// IsEnvBuildTransient can be used to determine if an experiment failed because its python
+// environment could not be built due to a network failure that might not be seen again
+//
+func IsEnvBuildTransient(err errors.Error) bool {
+	return err != nil && strings.Contains(err.Error(), envBuildTransient)
+}
+
+// IsEnvBuildResolution can be used to determine if an experiment failed because the python
+// packages it asked for could not be resolved
+//
+func IsEnvBuildResolution(err errors.Error) bool {
+	return err != nil && strings.Contains(err.Error(), envBuildResolution)
+}
+
+// envBuildOutput tracks what the output of an environment build has revealed about why it
+// failed
+//
+type envBuildOutput struct {
+	transient  bool
+	resolution bool
+}
+
+// scan inspects a line of output from the build
+//
+func (out *envBuildOutput) scan(line string) {
+	if !out.transient && envTransientFailures.MatchString(line) {
+		out.transient = true
+	}
+	if !out.resolution && envResolutionFailures.MatchString(line) {
+		out.resolution = true
+	}
+}
+
+// failure wraps the error from a build that failed with the reason for the failure.  When
+// the index could not be reached pip also reports packages as not found, so any sign of a
+// network failure marks the build as a transient failure.
+//
+func (out *envBuildOutput) failure(err errors.Error) (wrapped errors.Error) {
+	if err == nil {
+		err = errors.New("script failed").With("stack", stack.Trace().TrimRuntime())
+	}
+	switch {
+	case out.transient:
+		return errors.Wrap(err, envBuildTransient).With("stack", stack.Trace().TrimRuntime())
+	case out.resolution:
+		return errors.Wrap(err, envBuildResolution).With("stack", stack.Trace().TrimRuntime())
+	default:
+		return errors.Wrap(err, envBuildFailure).With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+// envBuildBackoff returns the period waited before a build is attempted again, the first
+// attempt is 1
+//
+func envBuildBackoff(attempt int) (backoff time.Duration) {
+	backoff = *envBackoffOpt
+	for i := 1; i < attempt; i++ {
+		backoff *= 2
+	}
+	return backoff
+}
+
+// envFailure records the reason a python environment failed to build, and when it can
+// next be attempted
+//
+type envFailure struct {
+	msg   string
+	until time.Time
+}
+
+// envFailureCache holds recent python environment build failures keyed using the hash of
+// the packages being installed
+//
+type envFailureCache struct {
+	failures map[string]envFailure
+	sync.Mutex
+}
+
+// acquireEnvBuild blocks until the experiment is permitted to start building its environment.
+// The function returned must be called when the build is complete, it can safely be
+// called more than once.
+//
+func acquireEnvBuild(ctx context.Context) (release func(), err errors.Error) {
+
+	envBuildsOnce.Do(func() {
+		limit := *maxEnvBuildsOpt
+		if limit < 1 {
+			limit = 1
+		}
+		envBuilds = make(chan struct{}, limit)
+	})
+
+	select {
+	case envBuilds <- struct{}{}:
+	case <-ctx.Done():
+		return func() {}, errors.New("cancelled waiting to build the python environment").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			<-envBuilds
+		})
+	}, nil
+}
+
+// EnvRequirementsHash returns a hash of the python version and the packages an experiment
+// installs, in the order they are installed
+//
+func EnvRequirementsHash(rqst *Request) (hash string) {
+	h := sha256.New()
+	h.Write([]byte(rqst.Experiment.PythonVer.String()))
+	for _, pkgs := range [][]string{rqst.Experiment.Pythonenv, rqst.Config.Pip} {
+		h.Write([]byte{0})
+		for _, pkg := range pkgs {
+			h.Write([]byte(pkg))
+			h.Write([]byte{'\n'})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordEnvFailure remembers that the python environment for an experiment could not be
+// built, when enabled.  Transient failures are not remembered as they are not expected to
+// be seen again.
+//
+func recordEnvFailure(rqst *Request, err errors.Error) {
+	if *envFailureTTLOpt <= 0 || err == nil || IsEnvBuildTransient(err) {
+		return
+	}
+	envFailures.Lock()
+	defer envFailures.Unlock()
+
+	now := time.Now()
+	for hash, failure := range envFailures.failures {
+		if now.After(failure.until) {
+			delete(envFailures.failures, hash)
+		}
+	}
+	envFailures.failures[EnvRequirementsHash(rqst)] = envFailure{
+		msg:   err.Error(),
+		until: now.Add(*envFailureTTLOpt),
+	}
+}
+
+// EnvBuildFailed returns the error seen when the packages an experiment installs recently
+// failed to build, or nil if there is no recent failure
+//
+func EnvBuildFailed(rqst *Request) (err errors.Error) {
+	hash := EnvRequirementsHash(rqst)
+
+	envFailures.Lock()
+	defer envFailures.Unlock()
+
+	failure, isPresent := envFailures.failures[hash]
+	if !isPresent {
+		return nil
+	}
+	if time.Now().After(failure.until) {
+		delete(envFailures.failures, hash)
+		return nil
+	}
+	return errors.New("python environment recently failed to build with the same packages").
+		With("requirements_hash", hash, "retry_after", failure.until.Format(time.RFC3339), "build_error", failure.msg).
+		With("stack", stack.Trace().TrimRuntime())
+}
@@ -0,0 +1,98 @@
+package runner
+
+// This file contains the filtering of the environment experiments are started with.  Rather
+// than inheriting everything from the runner, which can include credentials and internal
+// endpoints, experiments start from the runner variables named in an allow list along with
+// any STUDIOML_ variables.  The variables the experiment asked for and those the runner sets
+// for the experiment are then added.
+
+import (
+	"flag"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	envAllowOpt = flag.String("env-allow", "", "a comma separated list of additional runner environment variable names, or glob patterns, that experiments inherit")
+
+	defaultEnvAllow = []string{
+		"PATH", "HOME", "USER", "LOGNAME", "SHELL", "HOSTNAME", "TERM", "TZ",
+		"LANG", "LANGUAGE", "LC_*",
+		"LD_LIBRARY_PATH", "CUDA_HOME", "SINGULARITY_*",
+		"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy",
+	}
+)
+
+// EnvSource is implemented by the callers of an executors Make that supply the variables an
+// experiment is run with in addition to the allowed runner environment
+//
+type EnvSource interface {
+	ExperimentEnvs() (envs map[string]string)
+}
+
+func envAllowList() (patterns []string) {
+	patterns = append([]string{}, defaultEnvAllow...)
+	for _, pattern := range strings.Split(*envAllowOpt, ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) != 0 {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// ValidateEnvAllow checks the patterns supplied using the env-allow option
+//
+func ValidateEnvAllow() (err errors.Error) {
+	for _, pattern := range envAllowList() {
+		if _, errGo := path.Match(pattern, ""); errGo != nil {
+			return errors.Wrap(errGo, "env-allow pattern is invalid").With("pattern", pattern).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// EnvAllowed tests if a runner environment variable can be inherited by experiments
+//
+func EnvAllowed(name string) (allowed bool) {
+	if strings.HasPrefix(name, "STUDIOML_") {
+		return true
+	}
+	for _, pattern := range envAllowList() {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ExperimentEnv builds the environment for an experiment process from the allowed variables
+// of the runners environment, the variables pointing at any additional CA bundle, and the
+// supplied variables, which take precedence
+//
+func ExperimentEnv(envs map[string]string) (environ []string) {
+	merged := map[string]string{}
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && EnvAllowed(parts[0]) {
+			merged[parts[0]] = parts[1]
+		}
+	}
+	for name, value := range caBundleEnv() {
+		merged[name] = value
+	}
+	for name, value := range envs {
+		merged[name] = value
+	}
+
+	environ = make([]string, 0, len(merged))
+	for name, value := range merged {
+		environ = append(environ, name+"="+value)
+	}
+	sort.Strings(environ)
+	return environ
+}
@@ -14,10 +14,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 
 	bzip2w "github.com/dsnet/compress/bzip2"
 
@@ -26,9 +28,11 @@ import (
 )
 
 type gsStorage struct {
-	project string
-	bucket  string
-	client  *storage.Client
+	project    string
+	bucket     string
+	client     *storage.Client
+	generation int64             // When non-zero the specific generation of objects that is to be used
+	tags       map[string]string // Custom metadata applied to uploaded objects
 }
 
 // NewGSstorage will initialize a receiver that operates with the google cloud storage platform
@@ -40,7 +44,21 @@ func NewGSstorage(ctx context.Context, projectID string, creds string, env map[s
 		bucket:  bucket,
 	}
 
-	client, errGo := storage.NewClient(ctx, option.WithCredentialsFile(creds))
+	opts := []option.ClientOption{option.WithCredentialsFile(creds)}
+
+	// Requests across all experiments share the connection limit for Google Cloud Storage, and
+	// uploads the upload bandwidth of the node, the authenticated HTTP client is built here so
+	// that its transport can be wrapped
+	if *gsMaxConnsOpt > 0 || uploadBucket != nil {
+		httpClient, _, errGo := htransport.NewClient(ctx, option.WithCredentialsFile(creds), option.WithScopes(storage.ScopeFullControl))
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		httpClient.Transport = limitUploads(limitConnections("gs", *gsMaxConnsOpt, httpClient.Transport))
+		opts = []option.ClientOption{option.WithHTTPClient(httpClient)}
+	}
+
+	client, errGo := storage.NewClient(ctx, opts...)
 	if errGo != nil {
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
@@ -73,18 +91,82 @@ func (s *gsStorage) Close() {
 	s.client.Close()
 }
 
+// pinVersion will restrict the objects retrieved to a specific generation
+//
+func (s *gsStorage) pinVersion(version string) (err errors.Error) {
+	if len(version) == 0 {
+		return nil
+	}
+	gen, errGo := strconv.ParseInt(version, 10, 64)
+	if errGo != nil {
+		return errors.Wrap(errGo, "invalid object generation").With("version", version).With("stack", stack.Trace().TrimRuntime())
+	}
+	s.generation = gen
+	return nil
+}
+
+// object returns a handle for the named object respecting any generation that has been pinned
+//
+func (s *gsStorage) object(name string) (obj *storage.ObjectHandle) {
+	obj = s.client.Bucket(s.bucket).Object(name)
+	if s.generation != 0 {
+		obj = obj.Generation(s.generation)
+	}
+	return obj
+}
+
+// versionErr adds information about any pinned generation to errors, including errors
+// caused by that generation no longer being present
+//
+func (s *gsStorage) versionErr(errGo error) (err errors.Error) {
+	err = errors.Wrap(errGo)
+	if s.generation != 0 {
+		if errGo == storage.ErrObjectNotExist {
+			err = errors.Wrap(errGo, "the requested object generation does not exist")
+		}
+		err = err.With("generation", s.generation)
+	}
+	return err.With("bucket", s.bucket).With("stack", stack.Trace().TrimRuntime())
+}
+
 // Hash returns an MD5 of the contents of the file that can be used by caching and other functions
 // to track storage changes etc
 //
 func (s *gsStorage) Hash(ctx context.Context, name string) (hash string, err errors.Error) {
 
-	attrs, errGo := s.client.Bucket(s.bucket).Object(name).Attrs(ctx)
+	attrs, errGo := s.object(name).Attrs(ctx)
 	if errGo != nil {
-		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return "", s.versionErr(errGo).With("name", name)
 	}
 	return hex.EncodeToString(attrs.MD5), nil
 }
 
+// getObject opens the named object for reading.  Reads that fail part way through the object
+// are resumed from the same generation of the object.
+//
+func (s *gsStorage) getObject(ctx context.Context, name string) (obj io.ReadCloser, err errors.Error) {
+	handle := s.object(name)
+	if *downloadResumesOpt > 0 && s.generation == 0 {
+		attrs, errGo := handle.Attrs(ctx)
+		if errGo != nil {
+			return nil, s.versionErr(errGo).With("name", name)
+		}
+		handle = handle.Generation(attrs.Generation)
+	}
+
+	reader, errGo := handle.NewReader(ctx)
+	if errGo != nil {
+		return nil, s.versionErr(errGo).With("name", name)
+	}
+	return resumable(ctx, reader, reader.Size(), func(ctx context.Context, offset int64) (body io.ReadCloser, err errors.Error) {
+		reader, errGo := handle.NewRangeReader(ctx, offset, -1)
+		if errGo != nil {
+			return nil, s.versionErr(errGo).With("name", name, "offset", offset)
+		}
+		return reader, nil
+	}), nil
+}
+
 // Gather is used to retrieve files prefixed with a specific key.  It is used to retrieve the individual files
 // associated with a previous Hoard operation
 //
@@ -119,9 +201,9 @@ func (s *gsStorage) Fetch(ctx context.Context, name string, unpack bool, output
 		warns = append(warns, w)
 	}
 
-	obj, errGo := s.client.Bucket(s.bucket).Object(name).NewReader(ctx)
-	if errGo != nil {
-		return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	obj, err := s.getObject(ctx, name)
+	if err != nil {
+		return warns, err.With("output", output).With("name", name)
 	}
 	defer obj.Close()
 
@@ -192,7 +274,7 @@ func (s *gsStorage) Fetch(ctx context.Context, name string, unpack bool, output
 				return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 			}
 
-			_, errGo = io.Copy(file, tarReader)
+			_, errGo = streamCopy(file, tarReader)
 			file.Close()
 			if errGo != nil {
 				return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
@@ -211,7 +293,7 @@ func (s *gsStorage) Fetch(ctx context.Context, name string, unpack bool, output
 		defer f.Close()
 
 		outf := bufio.NewWriter(f)
-		if _, errGo = io.Copy(outf, obj); errGo != nil {
+		if _, errGo = streamCopy(outf, obj); errGo != nil {
 			return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
 		outf.Flush()
@@ -236,6 +318,7 @@ func (s *gsStorage) Deposit(ctx context.Context, src string, dest string) (warns
 	}
 
 	obj := s.client.Bucket(s.bucket).Object(dest).NewWriter(ctx)
+	obj.Metadata = s.tags
 	defer obj.Close()
 
 	files, err := NewTarWriter(src)
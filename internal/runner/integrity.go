@@ -0,0 +1,111 @@
+package runner
+
+// This file contains the implementation of integrity checking for messages retrieved
+// from queues.  Clients can opt into checksum verification by adding a checksum
+// attribute, or header, to their messages.  Messages with a checksum that does not
+// match, or a body that cannot be parsed, are reported as corrupt so that they can be
+// dead-lettered rather than retried.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	requireChecksumOpt = flag.Bool("require-checksum", false, "reject messages that do not carry a checksum attribute")
+)
+
+const (
+	// ChecksumKey is the message attribute, or header, holding the checksum of the message
+	// body.  The value is a hex encoded digest optionally prefixed by the algorithm, for
+	// example sha256:9f86d081..., or md5:098f6bcd...
+	ChecksumKey = "studioml-checksum"
+
+	corruptMessage = "corrupt message"
+)
+
+// IsCorruptMessage can be used to determine if a message could not be used because it
+// was damaged
+//
+func IsCorruptMessage(err errors.Error) bool {
+	return err != nil && strings.Contains(err.Error(), corruptMessage)
+}
+
+// MessageDigest returns the checksum attribute value for a message body using sha256
+//
+func MessageDigest(msg []byte) string {
+	sum := sha256.Sum256(msg)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// VerifyMessage checks the body of a message against any checksum that accompanied it and
+// that the body is a well formed JSON document
+//
+func VerifyMessage(qt *QueueTask) (err errors.Error) {
+
+	if checksum, isPresent := qt.Attributes[ChecksumKey]; isPresent {
+		algo := ""
+		digest := strings.ToLower(strings.TrimSpace(checksum))
+		if parts := strings.SplitN(digest, ":", 2); len(parts) == 2 {
+			algo, digest = parts[0], parts[1]
+		}
+		if len(algo) == 0 {
+			switch len(digest) {
+			case hex.EncodedLen(md5.Size):
+				algo = "md5"
+			case hex.EncodedLen(sha256.Size):
+				algo = "sha256"
+			}
+		}
+
+		actual := ""
+		switch algo {
+		case "md5":
+			sum := md5.Sum(qt.Msg)
+			actual = hex.EncodeToString(sum[:])
+		case "sha256":
+			sum := sha256.Sum256(qt.Msg)
+			actual = hex.EncodeToString(sum[:])
+		default:
+			return errors.New(corruptMessage+", checksum algorithm not recognized").With("checksum", checksum).With("stack", stack.Trace().TrimRuntime())
+		}
+		if actual != digest {
+			return errors.New(corruptMessage+", checksum mismatch").With("checksum", checksum, "actual", algo+":"+actual, "length", len(qt.Msg)).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	} else if *requireChecksumOpt {
+		return errors.New(corruptMessage+", checksum missing").With("attribute", ChecksumKey).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if !json.Valid(qt.Msg) {
+		return errors.New(corruptMessage+", "+diagnoseBody(qt.Msg)).With("length", len(qt.Msg)).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// diagnoseBody looks for the common ways that message bodies are damaged in transit
+//
+func diagnoseBody(msg []byte) (diagnosis string) {
+	trimmed := bytes.TrimSpace(msg)
+	switch {
+	case len(trimmed) == 0:
+		return "body is empty"
+	case trimmed[0] != '{':
+		if decoded, errGo := base64.StdEncoding.DecodeString(string(trimmed)); errGo == nil && json.Valid(decoded) {
+			return "body is base64 encoded JSON"
+		}
+		return "body is not a JSON document"
+	case trimmed[len(trimmed)-1] != '}':
+		return "body is truncated"
+	}
+	return "body is not valid JSON"
+}
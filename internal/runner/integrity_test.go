@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+// TestVerifyMessage checks that damaged messages are detected and that messages without
+// a checksum are accepted
+//
+func TestVerifyMessage(t *testing.T) {
+
+	body := []byte(`{"experiment": {"key": "test"}}`)
+	md5Sum := md5.Sum(body)
+
+	cases := []struct {
+		msg     []byte
+		attrs   map[string]string
+		corrupt bool
+	}{
+		{msg: body},
+		{msg: body, attrs: map[string]string{ChecksumKey: MessageDigest(body)}},
+		{msg: body, attrs: map[string]string{ChecksumKey: hex.EncodeToString(md5Sum[:])}},
+		{msg: body[:len(body)-4], corrupt: true},
+		{msg: body[:len(body)-4], attrs: map[string]string{ChecksumKey: MessageDigest(body)}, corrupt: true},
+		{msg: body, attrs: map[string]string{ChecksumKey: "crc:1234"}, corrupt: true},
+		{msg: []byte(base64.StdEncoding.EncodeToString(body)), corrupt: true},
+		{msg: []byte{}, corrupt: true},
+	}
+
+	for i, aCase := range cases {
+		err := VerifyMessage(&QueueTask{Msg: aCase.msg, Attributes: aCase.attrs})
+		if aCase.corrupt != IsCorruptMessage(err) {
+			t.Fatalf("case %d expected corrupt %v, %v", i, aCase.corrupt, err)
+		}
+	}
+}
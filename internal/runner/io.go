@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"sync"
 
 	"github.com/karlmutch/circbuf"
 	"github.com/karlmutch/vtclean"
@@ -16,6 +17,28 @@ import (
 	"github.com/karlmutch/errors"
 )
 
+const copyBufferSize = 256 * 1024
+
+var (
+	copyBuffers = sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, copyBufferSize)
+			return &buf
+		},
+	}
+)
+
+// streamCopy copies from the source to the destination using a bounded buffer that is reused
+// across transfers, artifacts are always streamed between storage and disk so that the
+// memory used does not grow with the size of the artifact
+//
+func streamCopy(dst io.Writer, src io.Reader) (written int64, errGo error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
+
 // ReadLast will extract the last portion of data from a file up to a maximum specified by
 // the caller.
 //
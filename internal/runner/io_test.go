@@ -0,0 +1,93 @@
+package runner
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (n int, errGo error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// allocated returns the total bytes allocated by the process so far
+//
+func allocated() (total uint64) {
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	return stats.TotalAlloc
+}
+
+// TestStreamingTransfer checks that artifacts are moved without the memory used growing with the
+// size of the artifact, the artifact used is several times larger than the memory permitted
+// while remaining small enough not to burden the disk of the test machine
+//
+func TestStreamingTransfer(t *testing.T) {
+
+	const size = int64(64 * 1024 * 1024)
+	const bound = uint64(8 * 1024 * 1024)
+
+	before := allocated()
+	copied, errGo := streamCopy(ioutil.Discard, io.LimitReader(zeros{}, size))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if copied != size {
+		t.Fatalf("%d bytes copied, expected %d", copied, size)
+	}
+	if used := allocated() - before; used > bound {
+		t.Fatalf("streaming %d bytes allocated %d bytes", size, used)
+	}
+
+	dir, errGo := ioutil.TempDir("", "streaming")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	// A sparse object is used as the source so that only the fetched copy occupies disk
+	src := filepath.Join(dir, "dataset.bin")
+	f, errGo := os.Create(src)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if errGo = f.Truncate(size); errGo != nil {
+		t.Fatal(errGo)
+	}
+	f.Close()
+
+	output := filepath.Join(dir, "output")
+	if errGo = os.MkdirAll(output, 0700); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	storage, err := NewLocalStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before = allocated()
+	if _, err = storage.Fetch(context.Background(), src, false, output, nil); err != nil {
+		t.Fatal(err)
+	}
+	if used := allocated() - before; used > bound {
+		t.Fatalf("fetching %d bytes allocated %d bytes", size, used)
+	}
+
+	info, errGo := os.Stat(filepath.Join(output, "dataset.bin"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if info.Size() != size {
+		t.Fatalf("fetched %d bytes, expected %d", info.Size(), size)
+	}
+}
@@ -122,7 +122,7 @@ func (s *localStorage) Fetch(ctx context.Context, name string, unpack bool, outp
 				return warns, errors.Wrap(errGo).With("file", path).With("stack", stack.Trace().TrimRuntime())
 			}
 
-			_, errGo = io.Copy(file, tarReader)
+			_, errGo = streamCopy(file, tarReader)
 			file.Close()
 			if errGo != nil {
 				return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
@@ -137,7 +137,7 @@ func (s *localStorage) Fetch(ctx context.Context, name string, unpack bool, outp
 		defer f.Close()
 
 		outf := bufio.NewWriter(f)
-		if _, errGo = io.Copy(outf, obj); errGo != nil {
+		if _, errGo = streamCopy(outf, obj); errGo != nil {
 			return warns, errors.Wrap(errGo).With("outputFile", fn).With("stack", stack.Trace().TrimRuntime())
 		}
 		outf.Flush()
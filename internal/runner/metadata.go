@@ -0,0 +1,87 @@
+package runner
+
+// This file contains the handling of the custom metadata users can attach to experiments for
+// attribution purposes, such as the team or cost center responsible for an experiment.  The
+// metadata is emitted in the studioml telemetry produced by the experiment script and is
+// included in the completion events the runner sends.
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	metadataMaxEntries = 64
+	metadataMaxLen     = 256
+)
+
+// SanitizeMetadata returns a copy of the metadata with control characters removed and the
+// keys and values limited in length
+//
+func SanitizeMetadata(meta map[string]string) (clean map[string]string) {
+	if len(meta) == 0 {
+		return nil
+	}
+
+	sanitize := func(text string) string {
+		text = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, text)
+		if runes := []rune(text); len(runes) > metadataMaxLen {
+			text = string(runes[:metadataMaxLen])
+		}
+		return text
+	}
+
+	clean = make(map[string]string, len(meta))
+	for key, value := range meta {
+		clean[sanitize(key)] = sanitize(value)
+	}
+	return clean
+}
+
+// validateMetadata checks the number of metadata entries and that keys are present
+//
+func validateMetadata(meta map[string]string) (err errors.Error) {
+	if len(meta) > metadataMaxEntries {
+		return errors.New("too many metadata entries").With("entries", len(meta), "limit", metadataMaxEntries).With("stack", stack.Trace().TrimRuntime())
+	}
+	for key := range meta {
+		if len(strings.TrimSpace(key)) == 0 {
+			return errors.New("metadata keys must not be empty").With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// metadataTelemetry renders the metadata as a studioml telemetry document quoted for use as
+// a single argument within a bash script, an empty string is returned when there is no metadata
+//
+func metadataTelemetry(meta map[string]string) (quoted string, err errors.Error) {
+	clean := SanitizeMetadata(meta)
+	if len(clean) == 0 {
+		return "", nil
+	}
+
+	doc, errGo := json.Marshal(map[string]interface{}{"studioml": map[string]interface{}{"metadata": clean}})
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return shellQuote(string(doc)), nil
+}
+
+// shellQuote quotes a telemetry document for use by bash.  Single quotes prevent any
+// interpretation by bash of the document, single quotes inside the document close the
+// quoting, are escaped, and then reopen it
+//
+func shellQuote(doc string) (quoted string) {
+	return "'" + strings.Replace(doc, "'", `'\''`, -1) + "'"
+}
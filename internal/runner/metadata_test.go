@@ -0,0 +1,50 @@
+package runner
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+)
+
+// TestMetadataTelemetry checks that metadata containing characters that have meaning to bash
+// and JSON survive being echoed by the experiment script
+//
+func TestMetadataTelemetry(t *testing.T) {
+
+	meta := map[string]string{
+		"team":        "it's $(whoami) `date`",
+		"cost-center": "\"quoted\"\n\\ \x07bell",
+	}
+
+	quoted, err := metadataTelemetry(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, errGo := exec.Command("bash", "-c", "echo "+quoted).Output()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	doc := struct {
+		Studioml struct {
+			Metadata map[string]string `json:"metadata"`
+		} `json:"studioml"`
+	}{}
+	if errGo = json.Unmarshal(output, &doc); errGo != nil {
+		t.Fatal(errGo, string(output))
+	}
+
+	for key, expected := range SanitizeMetadata(meta) {
+		if doc.Studioml.Metadata[key] != expected {
+			t.Fatalf("metadata %s was %q, expected %q", key, doc.Studioml.Metadata[key], expected)
+		}
+	}
+	if doc.Studioml.Metadata["cost-center"] != "\"quoted\"\\ bell" {
+		t.Fatalf("control characters were not removed %q", doc.Studioml.Metadata["cost-center"])
+	}
+
+	if quoted, _ = metadataTelemetry(nil); len(quoted) != 0 {
+		t.Fatal("telemetry emitted for an experiment without metadata")
+	}
+}
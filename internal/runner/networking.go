@@ -1,7 +1,9 @@
 package runner
 
 import (
+	"fmt"
 	"net"
+	"syscall"
 
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
@@ -29,3 +31,44 @@ func GetFreePort(hint string) (port int, err errors.Error) {
 
 	return port, nil
 }
+
+var (
+	// nonPublicNets are the address ranges not covered by the net.IP tests that are not
+	// public, the current network and the carrier grade NAT range used by some metadata
+	// services
+	nonPublicNets = []*net.IPNet{
+		{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+		{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	}
+)
+
+// IsPublic tests if an address is a public one, rather than for example a loopback, private
+// network, or link local address such as those used by the metadata services of cloud providers
+//
+func IsPublic(ip net.IP) (public bool) {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, block := range nonPublicNets {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// PublicOnly can be used as the Control function of a net.Dialer to refuse connections to
+// addresses that are not public.  The address is checked once resolved so that a name cannot
+// be used to reach a private address.
+//
+func PublicOnly(network string, address string, c syscall.RawConn) (errGo error) {
+	host, _, errGo := net.SplitHostPort(address)
+	if errGo != nil {
+		return errGo
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublic(ip) {
+		return fmt.Errorf("address %s is not public", address)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package runner
+
+// This file contains the implementation of functions used to discover information about the
+// cloud node the runner is hosted on, such as the zone and instance details, for
+// inclusion in the experiment telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	nodeMetaTimeoutOpt = flag.Duration("node-metadata-timeout", 2*time.Second, "the maximum time to wait for cloud metadata endpoints when discovering node details")
+
+	nodeMeta     = NodeMeta{}
+	nodeMetaOnce sync.Once
+)
+
+// NodeMeta contains details of the cloud node the runner is hosted on.  Fields will be empty
+// when the details could not be discovered.
+//
+type NodeMeta struct {
+	Zone         string
+	InstanceType string
+	InstanceID   string
+}
+
+type metaEndpoint struct {
+	url    string
+	header map[string]string
+	base   bool // Only retain the last path element of the value returned
+}
+
+var (
+	awsMetaEndpoints = map[string]metaEndpoint{
+		"zone":          {url: "http://169.254.169.254/latest/meta-data/placement/availability-zone"},
+		"instance_type": {url: "http://169.254.169.254/latest/meta-data/instance-type"},
+		"instance_id":   {url: "http://169.254.169.254/latest/meta-data/instance-id"},
+	}
+
+	gcpMetaEndpoints = map[string]metaEndpoint{
+		"zone":          {url: "http://metadata.google.internal/computeMetadata/v1/instance/zone", header: map[string]string{"Metadata-Flavor": "Google"}, base: true},
+		"instance_type": {url: "http://metadata.google.internal/computeMetadata/v1/instance/machine-type", header: map[string]string{"Metadata-Flavor": "Google"}, base: true},
+		"instance_id":   {url: "http://metadata.google.internal/computeMetadata/v1/instance/id", header: map[string]string{"Metadata-Flavor": "Google"}},
+	}
+
+	// Environment variables that can be used to override, or supply, the node details
+	nodeMetaEnv = map[string]string{
+		"zone":          "STUDIOML_NODE_ZONE",
+		"instance_type": "STUDIOML_NODE_INSTANCE_TYPE",
+		"instance_id":   "STUDIOML_NODE_INSTANCE_ID",
+	}
+)
+
+func getMetaValue(ctx context.Context, client *http.Client, ep metaEndpoint) (value string) {
+	req, errGo := http.NewRequest("GET", ep.url, nil)
+	if errGo != nil {
+		return ""
+	}
+	for k, v := range ep.header {
+		req.Header.Set(k, v)
+	}
+
+	resp, errGo := client.Do(req.WithContext(ctx))
+	if errGo != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	body, errGo := ioutil.ReadAll(resp.Body)
+	if errGo != nil {
+		return ""
+	}
+	value = strings.TrimSpace(string(body))
+	if ep.base && len(value) != 0 {
+		value = path.Base(value)
+	}
+	return value
+}
+
+// queryNodeMeta will probe the known cloud metadata services for node details.  Probing
+// stops at the first cloud provider that responds.  Environment variables when set
+// will override any discovered values.
+//
+func queryNodeMeta(ctx context.Context, timeout time.Duration) (meta NodeMeta) {
+
+	values := map[string]string{}
+
+	// Only probe when at least one value has not been supplied using the environment
+	probe := false
+	for _, env := range nodeMetaEnv {
+		if len(os.Getenv(env)) == 0 {
+			probe = true
+			break
+		}
+	}
+
+	if probe {
+		client := &http.Client{Timeout: timeout}
+		for _, endpoints := range []map[string]metaEndpoint{awsMetaEndpoints, gcpMetaEndpoints} {
+			probeCtx, probeCancel := context.WithTimeout(ctx, timeout)
+			for item, ep := range endpoints {
+				if v := getMetaValue(probeCtx, client, ep); len(v) != 0 {
+					values[item] = v
+				}
+			}
+			probeCancel()
+			if len(values) != 0 {
+				break
+			}
+		}
+	}
+
+	for item, env := range nodeMetaEnv {
+		if v := os.Getenv(env); len(v) != 0 {
+			values[item] = v
+		}
+	}
+
+	return NodeMeta{
+		Zone:         values["zone"],
+		InstanceType: values["instance_type"],
+		InstanceID:   values["instance_id"],
+	}
+}
+
+// GetNodeMeta returns the details of the cloud node that the runner is hosted on.  The first call
+// will gather the details and will block for a period limited by the node-metadata-timeout option,
+// subsequent calls return the cached details.  When no metadata service is available
+// the details will be empty unless supplied via the environment.
+//
+func GetNodeMeta() (meta NodeMeta) {
+	nodeMetaOnce.Do(func() {
+		nodeMeta = queryNodeMeta(context.Background(), *nodeMetaTimeoutOpt)
+	})
+	return nodeMeta
+}
+
+// nodeTelemetry renders the details of the node as a studioml telemetry document quoted for use
+// as a single argument within a bash script.  The details can come from the environment of the
+// runner and so are not trusted to be free of characters meaningful to bash or JSON
+//
+func nodeTelemetry(meta NodeMeta) (quoted string, err errors.Error) {
+	doc, errGo := json.Marshal(map[string]interface{}{
+		"studioml": map[string]interface{}{
+			"node": map[string]string{
+				"zone":          meta.Zone,
+				"instance_type": meta.InstanceType,
+				"instance_id":   meta.InstanceID,
+			},
+		},
+	})
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return shellQuote(string(doc)), nil
+}
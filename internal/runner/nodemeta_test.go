@@ -0,0 +1,125 @@
+package runner
+
+// This file contains tests for the discovery of the cloud node details using metadata
+// services that are simulated using local HTTP servers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestNodeMeta checks that node details are gathered from the first metadata service
+// that responds, that the environment overrides discovered values, and that an
+// unavailable metadata service results in empty details
+//
+func TestNodeMeta(t *testing.T) {
+
+	// The AWS service is simulated as not being present
+	aws := httptest.NewServer(http.NotFoundHandler())
+	defer aws.Close()
+
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/zone":
+			w.Write([]byte("projects/123/zones/us-central1-a\n"))
+		case "/machine-type":
+			w.Write([]byte("projects/123/machineTypes/n1-standard-8"))
+		case "/id":
+			w.Write([]byte("4567"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer gcp.Close()
+
+	awsSaved, gcpSaved := awsMetaEndpoints, gcpMetaEndpoints
+	defer func() {
+		awsMetaEndpoints, gcpMetaEndpoints = awsSaved, gcpSaved
+	}()
+
+	awsMetaEndpoints = map[string]metaEndpoint{
+		"zone":          {url: aws.URL + "/placement/availability-zone"},
+		"instance_type": {url: aws.URL + "/instance-type"},
+		"instance_id":   {url: aws.URL + "/instance-id"},
+	}
+	header := map[string]string{"Metadata-Flavor": "Google"}
+	gcpMetaEndpoints = map[string]metaEndpoint{
+		"zone":          {url: gcp.URL + "/zone", header: header, base: true},
+		"instance_type": {url: gcp.URL + "/machine-type", header: header, base: true},
+		"instance_id":   {url: gcp.URL + "/id", header: header},
+	}
+
+	for _, env := range nodeMetaEnv {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+
+	expected := NodeMeta{Zone: "us-central1-a", InstanceType: "n1-standard-8", InstanceID: "4567"}
+	if meta := queryNodeMeta(context.Background(), 2*time.Second); meta != expected {
+		t.Fatalf("unexpected node details %+v, expected %+v", meta, expected)
+	}
+
+	// Values from the environment take precedence over those discovered
+	os.Setenv(nodeMetaEnv["zone"], "override-zone")
+	expected.Zone = "override-zone"
+	if meta := queryNodeMeta(context.Background(), 2*time.Second); meta != expected {
+		t.Fatalf("unexpected node details %+v, expected %+v", meta, expected)
+	}
+	os.Unsetenv(nodeMetaEnv["zone"])
+
+	// Neither metadata service being reachable should leave the details empty
+	aws.Close()
+	gcp.Close()
+	if meta := queryNodeMeta(context.Background(), 2*time.Second); meta != (NodeMeta{}) {
+		t.Fatalf("unexpected node details %+v when no metadata service was available", meta)
+	}
+}
+
+// TestNodeTelemetry checks that node details containing characters that have meaning to bash
+// and JSON survive being echoed by the experiment script
+//
+func TestNodeTelemetry(t *testing.T) {
+
+	meta := NodeMeta{
+		Zone:         "us-east-1a\"}} $(whoami)",
+		InstanceType: "it's `date`",
+		InstanceID:   "i-1234\\\n",
+	}
+
+	quoted, err := nodeTelemetry(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, errGo := exec.Command("bash", "-c", "echo "+quoted).Output()
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	doc := struct {
+		Studioml struct {
+			Node struct {
+				Zone         string `json:"zone"`
+				InstanceType string `json:"instance_type"`
+				InstanceID   string `json:"instance_id"`
+			} `json:"node"`
+		} `json:"studioml"`
+	}{}
+	if errGo = json.Unmarshal(output, &doc); errGo != nil {
+		t.Fatal(errGo, string(output))
+	}
+
+	if got := (NodeMeta{doc.Studioml.Node.Zone, doc.Studioml.Node.InstanceType, doc.Studioml.Node.InstanceID}); got != meta {
+		t.Fatalf("node details were echoed as %+v, expected %+v", got, meta)
+	}
+}
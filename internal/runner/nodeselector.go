@@ -0,0 +1,75 @@
+package runner
+
+// This file contains the labels a node advertises describing its hardware, and the matching
+// of the node selectors experiments use to ask for specific hardware against them.  Selectors
+// are matched in addition to the fitting of the resources an experiment needs.
+
+import (
+	"flag"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	nodeLabelsOpt = flag.String("node-labels", "", "a comma separated list of key=value labels describing the hardware of the node that experiment node selectors are matched against, for example gpu=a100,net=infiniband")
+)
+
+// parseLabels extracts the key=value labels from a comma separated list
+//
+func parseLabels(spec string) (labels map[string]string, err errors.Error) {
+	labels = map[string]string{}
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); len(item) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(key) == 0 {
+			return nil, errors.New("labels must be of the form key=value").With("label", item).With("stack", stack.Trace().TrimRuntime())
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// ValidateNodeLabels checks the labels supplied using the node-labels option
+//
+func ValidateNodeLabels() (err errors.Error) {
+	if _, err = parseLabels(*nodeLabelsOpt); err != nil {
+		return err.With("node-labels", *nodeLabelsOpt)
+	}
+	return nil
+}
+
+// NodeLabels returns the labels the node advertises
+//
+func NodeLabels() (labels map[string]string) {
+	labels, _ = parseLabels(*nodeLabelsOpt)
+	return labels
+}
+
+// SelectorMatch tests if every label in a selector is present with the same value in the
+// supplied labels, an empty selector matches any node
+//
+func SelectorMatch(selector map[string]string, labels map[string]string) (matched bool) {
+	for key, value := range selector {
+		if label, isPresent := labels[key]; !isPresent || label != value {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectorString formats labels, or a selector, as a sorted comma separated list
+//
+func SelectorString(labels map[string]string) (spec string) {
+	items := make([]string, 0, len(labels))
+	for key, value := range labels {
+		items = append(items, key+"="+value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
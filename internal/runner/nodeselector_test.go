@@ -0,0 +1,52 @@
+package runner
+
+import (
+	"testing"
+)
+
+// TestNodeSelector checks that experiments asking for labelled hardware only fit nodes that
+// advertise every label they select
+//
+func TestNodeSelector(t *testing.T) {
+
+	labels, err := parseLabels(" gpu=a100, net=infiniband,zone= ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec := SelectorString(labels); spec != "gpu=a100,net=infiniband,zone=" {
+		t.Fatalf("unexpected node labels %s", spec)
+	}
+	for _, spec := range []string{"gpu", "=a100", "gpu=a100,net"} {
+		if _, err := parseLabels(spec); err == nil {
+			t.Fatalf("invalid node labels %s were accepted", spec)
+		}
+	}
+
+	node := &Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", NodeSelector: labels}
+	for _, tc := range []struct {
+		selector map[string]string
+		fits     bool
+	}{
+		{selector: nil, fits: true},
+		{selector: map[string]string{"gpu": "a100"}, fits: true},
+		{selector: map[string]string{"gpu": "a100", "net": "infiniband"}, fits: true},
+		{selector: map[string]string{"zone": ""}, fits: true},
+		{selector: map[string]string{"gpu": "v100"}, fits: false},
+		{selector: map[string]string{"gpu": "a100", "ssd": "nvme"}, fits: false},
+	} {
+		rsc := &Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", NodeSelector: tc.selector}
+		if fit, err := rsc.Fit(node); err != nil || fit != tc.fits {
+			t.Fatalf("selector %s fit %v, expected %v, error %v", SelectorString(tc.selector), fit, tc.fits, err)
+		}
+	}
+
+	// Nodes without labels only run experiments that do not select any
+	if fit, _ := (&Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", NodeSelector: map[string]string{"gpu": "a100"}}).Fit(&Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb"}); fit {
+		t.Fatal("experiment selecting a gpu fitted an unlabelled node")
+	}
+
+	// The selector must survive being cloned into the subscription resources
+	if clone := (&Resource{NodeSelector: map[string]string{"gpu": "a100"}}).Clone(); clone == nil || clone.NodeSelector["gpu"] != "a100" {
+		t.Fatalf("node selector was not cloned %+v", clone)
+	}
+}
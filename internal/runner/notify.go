@@ -0,0 +1,89 @@
+package runner
+
+// This file contains the implementation of the destinations experiments name to be notified
+// at when they have finished.  Destinations are grouped by the type of notifier used to
+// reach them so that a single experiment can fan out to several channels.  The legacy
+// slack_destination, and callbackURL, fields are folded into the same structure.
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	NotifySlack   = "slack"   // Slack channels, or users, reached using the slack hook of the runner
+	NotifyWebhook = "webhook" // URLs the JSON completion event is POSTed to
+	NotifyTeams   = "teams"   // Microsoft Teams incoming webhook URLs
+)
+
+// Notify holds the destinations that are notified when an experiment has finished, keyed by
+// the type of notifier
+//
+type Notify map[string][]string
+
+// add appends a destination for a notifier, ignoring duplicates
+//
+func (n Notify) add(notifier string, dest string) {
+	dest = strings.TrimSpace(dest)
+	if len(dest) == 0 {
+		return
+	}
+	for _, existing := range n[notifier] {
+		if existing == dest {
+			return
+		}
+	}
+	n[notifier] = append(n[notifier], dest)
+}
+
+// Notifiers returns the types of notifier that have destinations in a stable order
+//
+func (n Notify) Notifiers() (notifiers []string) {
+	for notifier, dests := range n {
+		if len(dests) != 0 {
+			notifiers = append(notifiers, notifier)
+		}
+	}
+	sort.Strings(notifiers)
+	return notifiers
+}
+
+// NotifyDestinations returns all of the destinations the request asked to be notified at,
+// including those supplied using the legacy slack_destination and callbackURL fields
+//
+func (r *Request) NotifyDestinations() (dests Notify) {
+	dests = Notify{}
+	for _, notifier := range r.Config.Notify.Notifiers() {
+		for _, dest := range r.Config.Notify[notifier] {
+			dests.add(notifier, dest)
+		}
+	}
+	dests.add(NotifySlack, r.Config.Runner.SlackDest)
+	dests.add(NotifyWebhook, r.Config.CallbackURL)
+	return dests
+}
+
+// validateNotify checks the notification destinations of a request
+//
+func validateNotify(r *Request) (err errors.Error) {
+	for notifier, dests := range r.Config.Notify {
+		switch notifier {
+		case NotifySlack:
+		case NotifyWebhook, NotifyTeams:
+			for _, dest := range dests {
+				if hook, errGo := url.Parse(dest); errGo != nil || (hook.Scheme != "http" && hook.Scheme != "https") {
+					return errors.New("notify destinations must be http or https URLs").With("experiment_id", r.Experiment.Key, "notifier", notifier, "destination", dest).
+						With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+		default:
+			return errors.New("notify has an unknown notifier, expected slack, webhook, or teams").With("experiment_id", r.Experiment.Key, "notifier", notifier).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
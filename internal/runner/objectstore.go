@@ -48,8 +48,9 @@ func init() {
 }
 
 type ObjStore struct {
-	store  Storage
-	ErrorC chan errors.Error
+	store    Storage
+	ErrorC   chan errors.Error
+	resolved string // The hash of the object most recently fetched
 }
 
 func NewObjStore(ctx context.Context, spec *StoreOpts, errorC chan errors.Error) (os *ObjStore, err errors.Error) {
@@ -293,6 +294,17 @@ func CacheProbe(key string) bool {
 	return cache.Get(key) != nil && !cache.Get(key).Expired()
 }
 
+// CacheHolds returns true when the artifact cache currently holds the object with the hash
+// supplied, false is returned when the cache is not enabled
+//
+func CacheHolds(hash string) (held bool) {
+	if len(backingDir) == 0 || len(hash) == 0 {
+		return false
+	}
+	_, errGo := os.Stat(filepath.Join(backingDir, hash))
+	return errGo == nil
+}
+
 // Hash will return the hash of a stored file or other blob.  This method can be used
 // by a caching layer or by a client to obtain the unique content based identity of the
 // resource being stored.
@@ -309,6 +321,13 @@ func (s *ObjStore) Gather(ctx context.Context, keyPrefix string, outputDir strin
 	return s.store.Gather(ctx, keyPrefix, outputDir, nil)
 }
 
+// Resolved returns the hash, typically the ETag, of the object most recently fetched, this is
+// the version of the object that the content fetched came from
+//
+func (s *ObjStore) Resolved() (hash string) {
+	return s.resolved
+}
+
 // Fetch is used by client to retrieve resources from a concrete storage system.  This function will
 // invoke storage system logic that may retrieve resources from a cache.
 //
@@ -318,6 +337,7 @@ func (s *ObjStore) Fetch(ctx context.Context, name string, unpack bool, output s
 	if err != nil {
 		return warns, err
 	}
+	s.resolved = hash
 
 	// If there is no cache simply download the file, and so we supply a nil for the tap
 	// for our tap
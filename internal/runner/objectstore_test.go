@@ -0,0 +1,54 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestCacheHolds checks that only objects present in the artifact cache are reported as
+// being held, including after they have been evicted
+//
+func TestCacheHolds(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "cache-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	saved := backingDir
+	defer func() { backingDir = saved }()
+
+	hash := "d41d8cd98f00b204e9800998ecf8427e"
+
+	backingDir = ""
+	if CacheHolds(hash) {
+		t.Fatal("an object was held without the cache being enabled")
+	}
+
+	backingDir = dir
+	if CacheHolds(hash) {
+		t.Fatal("an object was held before being added to the cache")
+	}
+	if errGo = ioutil.WriteFile(filepath.Join(dir, hash), []byte{}, 0600); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !CacheHolds(hash) {
+		t.Fatal("an object in the cache was not held")
+	}
+	if CacheHolds("") {
+		t.Fatal("an artifact without a hash was held")
+	}
+
+	if errGo = os.Remove(filepath.Join(dir, hash)); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if CacheHolds(hash) {
+		t.Fatal("an object evicted from the cache was held")
+	}
+}
@@ -0,0 +1,90 @@
+package runner
+
+// This file contains the implementation of the limit placed upon the console output of
+// experiments that is captured into their output artifact.  Experiments that write more
+// than the limit continue to run however the remainder of their output is discarded.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	outputLimitOpt = flag.String("output-limit", "", "the maximum size of the console output captured for an experiment, for example 1GiB, output beyond this is discarded, empty for no limit")
+)
+
+// OutputCap tracks the console output written for an experiment against the limit
+// on the size of its output
+//
+type OutputCap struct {
+	limit     uint64
+	written   uint64
+	truncated int32
+}
+
+// ValidateOutputLimit checks that the configured output limit can be parsed
+//
+func ValidateOutputLimit() (err errors.Error) {
+	if len(*outputLimitOpt) == 0 {
+		return nil
+	}
+	if _, errGo := humanize.ParseBytes(*outputLimitOpt); errGo != nil {
+		return errors.Wrap(errGo, "output-limit is invalid").With("output-limit", *outputLimitOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// NewOutputCap returns a cap using the configured output limit, a nil cap is returned
+// when there is no limit
+//
+func NewOutputCap() (oc *OutputCap) {
+	if len(*outputLimitOpt) == 0 {
+		return nil
+	}
+	limit, errGo := humanize.ParseBytes(*outputLimitOpt)
+	if errGo != nil || limit == 0 {
+		return nil
+	}
+	return &OutputCap{limit: limit}
+}
+
+// Truncated returns true when output was discarded because the limit was reached
+//
+func (oc *OutputCap) Truncated() (truncated bool) {
+	if oc == nil {
+		return false
+	}
+	return atomic.LoadInt32(&oc.truncated) != 0
+}
+
+// write appends output to the file up to the limit, a marker is written once
+// when the limit is reached and the output that follows discarded
+//
+func (oc *OutputCap) write(f *os.File, output string) {
+	if oc == nil {
+		f.WriteString(output)
+		return
+	}
+	if oc.Truncated() {
+		return
+	}
+
+	if remaining := oc.limit - oc.written; uint64(len(output)) > remaining {
+		f.WriteString(output[:remaining])
+		f.WriteString(fmt.Sprintf("\n[studioml] output truncated after %s, the output-limit of the runner, the experiment continues to run but further output is discarded\n",
+			humanize.IBytes(oc.limit)))
+		oc.written = oc.limit
+		atomic.StoreInt32(&oc.truncated, 1)
+		return
+	}
+
+	f.WriteString(output)
+	oc.written += uint64(len(output))
+}
@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestOutputCap checks that experiment output beyond the output limit is discarded and
+// a marker written in its place
+//
+func TestOutputCap(t *testing.T) {
+	f, errGo := ioutil.TempFile("", "output-cap")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.Remove(f.Name())
+
+	outCap := &OutputCap{limit: 16}
+
+	stop, cancel := context.WithCancel(context.Background())
+	outC := make(chan []byte)
+	errC := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		tee, _ := NewOutputTee(f, outCap, nil)
+		procOutput(stop, tee, outC, errC)
+		tee.Close(*outputSinkWaitOpt)
+		close(done)
+	}()
+
+	errC <- "abcdefghij"
+	for _, r := range "0123456789\nlost output\n" {
+		outC <- []byte(string(r))
+	}
+	cancel()
+	<-done
+
+	if !outCap.Truncated() {
+		t.Fatal("output exceeding the limit was not reported as truncated")
+	}
+
+	output, errGo := ioutil.ReadFile(f.Name())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.HasPrefix(string(output), "abcdefghij\n01234\n[studioml] output truncated") {
+		t.Fatalf("unexpected output %q", string(output))
+	}
+	if strings.Contains(string(output), "lost output") {
+		t.Fatalf("output following the truncation was written %q", string(output))
+	}
+}
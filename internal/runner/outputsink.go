@@ -0,0 +1,382 @@
+package runner
+
+// This file contains the implementation of the destinations the console output of experiments
+// is sent to.  Output is always written to the output file of the experiment, which is
+// uploaded to the object store with the output artifact, and can also be forwarded to
+// the sinks configured for a deployment, such as log aggregation services.  Each of the
+// forwarding sinks has its own buffer so that a slow, or unavailable, destination does not
+// delay the experiment or the other destinations, output that does not fit into the
+// buffer of a sink is dropped for that sink only.
+//
+// There is no separate object store sink, the output file is part of the output artifact
+// and is uploaded to the object store while the experiment runs at the save workspace
+// frequency of the experiment, as well as when the experiment stops.
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	outputSinksOpt      = flag.String("output-sinks", "", "a comma separated list of destinations experiment output is forwarded to as well as the output file, http:// and https:// URLs receive lines using POST, syslog://host:port and syslog+tcp://host:port send lines to a syslog server, and file:// URLs name a directory into which a copy of the output is written")
+	outputSinkBufferOpt = flag.Int("output-sink-buffer", 1024, "the number of pieces of output held for each output sink, output is dropped for sinks that fall further behind than this")
+	outputSinkWaitOpt   = flag.Duration("output-sink-wait", 10*time.Second, "the maximum period of time output sinks are given to forward the output they hold once an experiment stops")
+)
+
+// outputSinkTimeout is the longest a sink waits to connect to, or send output to, its destination
+//
+const outputSinkTimeout = 10 * time.Second
+
+// OutputSink is implemented by the destinations experiment output is forwarded to
+//
+type OutputSink interface {
+	// Write sends a piece of output, containing one or more lines, to the destination
+	Write(output []byte) (err error)
+
+	// Close releases the destination once all output has been written
+	Close() (err error)
+}
+
+// ValidateOutputSinks checks that the output-sinks option can be used
+//
+func ValidateOutputSinks() (err errors.Error) {
+	for _, spec := range strings.Split(*outputSinksOpt, ",") {
+		if spec = strings.TrimSpace(spec); len(spec) == 0 {
+			continue
+		}
+		uri, errGo := url.Parse(spec)
+		if errGo != nil {
+			return errors.Wrap(errGo, "output-sinks contains an invalid URL").With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		switch uri.Scheme {
+		case "http", "https", "syslog", "syslog+tcp", "syslog+udp":
+			if len(uri.Host) == 0 {
+				return errors.New("output-sinks URL has no host").With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+		case "file":
+			if len(uri.Path) == 0 {
+				return errors.New("output-sinks URL has no directory").With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+			}
+		default:
+			return errors.New("output-sinks URL scheme not supported").With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if *outputSinkBufferOpt < 1 {
+		return errors.New("output-sink-buffer must be at least 1").With("output-sink-buffer", *outputSinkBufferOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// openOutputSink creates the sink for a destination taken from the output-sinks option
+//
+func openOutputSink(spec string, rqst *Request) (sink OutputSink, err errors.Error) {
+	uri, errGo := url.Parse(spec)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	key, project := "", ""
+	if rqst != nil {
+		key, project = rqst.Experiment.Key, rqst.Config.Database.ProjectId
+	}
+
+	switch uri.Scheme {
+	case "http", "https":
+		return &httpSink{
+			url:     spec,
+			key:     key,
+			project: project,
+			client:  &http.Client{Timeout: outputSinkTimeout},
+		}, nil
+	case "syslog", "syslog+tcp", "syslog+udp":
+		network := strings.TrimPrefix(strings.TrimPrefix(uri.Scheme, "syslog"), "+")
+		if len(network) == 0 {
+			network = "udp"
+		}
+		sink := &syslogSink{
+			network: network,
+			addr:    uri.Host,
+			tag:     "studioml/" + key,
+		}
+		if errGo := sink.connect(); errGo != nil {
+			return nil, errors.Wrap(errGo).With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		return sink, nil
+	case "file":
+		if errGo := os.MkdirAll(uri.Path, 0700); errGo != nil {
+			return nil, errors.Wrap(errGo).With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		name := key
+		if len(name) == 0 {
+			name = "experiment"
+		}
+		f, errGo := os.OpenFile(filepath.Join(uri.Path, filepath.Base(name)+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+		}
+		return &fileSink{f: f}, nil
+	}
+	return nil, errors.New("output sink scheme not supported").With("sink", spec).With("stack", stack.Trace().TrimRuntime())
+}
+
+// httpSink posts experiment output to an HTTP endpoint, the experiment is identified using
+// request headers
+//
+type httpSink struct {
+	url     string
+	key     string
+	project string
+	client  *http.Client
+}
+
+func (s *httpSink) Write(output []byte) (err error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(output))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("X-Studioml-Experiment", s.key)
+	req.Header.Set("X-Studioml-Project", s.project)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("output sink %s returned %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) Close() (err error) {
+	return nil
+}
+
+// syslogSink sends each line of experiment output to a syslog server using the message format
+// of the log/syslog package.  The log/syslog package is not used directly as it has no way of
+// limiting the time taken to connect to the server.
+//
+type syslogSink struct {
+	network string
+	addr    string
+	tag     string
+	conn    net.Conn
+}
+
+// connect establishes the connection to the syslog server, replacing any existing connection
+//
+func (s *syslogSink) connect() (err error) {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	conn, err := net.DialTimeout(s.network, s.addr, outputSinkTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// send writes a single line to the syslog server
+//
+func (s *syslogSink) send(line string) (err error) {
+	if s.conn == nil {
+		return fmt.Errorf("output sink %s://%s is not connected", s.network, s.addr)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(outputSinkTimeout))
+	_, err = fmt.Fprintf(s.conn, "<%d>%s %s %s[%d]: %s\n", syslog.LOG_INFO|syslog.LOG_USER, time.Now().Format(time.RFC3339), host, s.tag, os.Getpid(), line)
+	return err
+}
+
+func (s *syslogSink) Write(output []byte) (err error) {
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if err = s.send(line); err != nil {
+			// A connection the server dropped is replaced once before the output is given up on
+			if err = s.connect(); err != nil {
+				return err
+			}
+			if err = s.send(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() (err error) {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// fileSink writes a copy of experiment output to a local file, for example one watched by a
+// log shipper
+//
+type fileSink struct {
+	f *os.File
+}
+
+func (s *fileSink) Write(output []byte) (err error) {
+	_, err = s.f.Write(output)
+	return err
+}
+
+func (s *fileSink) Close() (err error) {
+	return s.f.Close()
+}
+
+// bufferedSink holds the output waiting to be written to a sink, output is dropped when the
+// sink falls behind by more than the size of the buffer
+//
+type bufferedSink struct {
+	sink    OutputSink
+	outputC chan []byte
+	doneC   chan struct{}
+	dropped uint64
+	failed  uint64
+}
+
+func newBufferedSink(sink OutputSink, size int) (buffered *bufferedSink) {
+	buffered = &bufferedSink{
+		sink:    sink,
+		outputC: make(chan []byte, size),
+		doneC:   make(chan struct{}),
+	}
+	go buffered.run()
+	return buffered
+}
+
+func (b *bufferedSink) run() {
+	defer close(b.doneC)
+	for output := range b.outputC {
+		if err := b.sink.Write(output); err != nil {
+			atomic.AddUint64(&b.failed, 1)
+		}
+	}
+}
+
+func (b *bufferedSink) send(output []byte) {
+	select {
+	case b.outputC <- output:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+// OutputTee writes experiment output to its output file, subject to any limit on the size of
+// the output, and forwards it to the configured output sinks
+//
+type OutputTee struct {
+	f      *os.File
+	outCap *OutputCap
+	sinks  []*bufferedSink
+}
+
+// NewOutputTee creates the destinations for the output of an experiment, sinks that cannot be
+// opened are skipped and returned as warnings
+//
+func NewOutputTee(f *os.File, outCap *OutputCap, rqst *Request) (tee *OutputTee, warns []errors.Error) {
+	tee = &OutputTee{
+		f:      f,
+		outCap: outCap,
+	}
+	for _, spec := range strings.Split(*outputSinksOpt, ",") {
+		if spec = strings.TrimSpace(spec); len(spec) == 0 {
+			continue
+		}
+		sink, err := openOutputSink(spec, rqst)
+		if err != nil {
+			warns = append(warns, err)
+			continue
+		}
+		tee.AddSink(sink)
+	}
+	return tee, warns
+}
+
+// AddSink adds a destination the output is forwarded to
+//
+func (tee *OutputTee) AddSink(sink OutputSink) {
+	tee.sinks = append(tee.sinks, newBufferedSink(sink, *outputSinkBufferOpt))
+}
+
+// write sends a piece of output to every destination
+//
+func (tee *OutputTee) write(output string) {
+	tee.outCap.write(tee.f, output)
+	for _, sink := range tee.sinks {
+		sink.send([]byte(output))
+	}
+}
+
+// Close waits for up to the period supplied for the sinks to write the output they hold and
+// closes the output file, the number of pieces of output dropped, or that could not be
+// written, is noted in the output file and returned
+//
+func (tee *OutputTee) Close(wait time.Duration) (lost uint64) {
+	defer tee.f.Close()
+
+	return tee.drain(wait)
+}
+
+// Finish forwards the result line of the experiment to the sinks, closes them as Close does,
+// and then appends the result line to the output file, bypassing any limit on its size, so
+// that the result is the last line of the output at every destination
+//
+func (tee *OutputTee) Finish(result ExperimentResult, wait time.Duration) (lost uint64, err errors.Error) {
+	defer tee.f.Close()
+
+	line := result.Line()
+	for _, sink := range tee.sinks {
+		sink.send([]byte(line))
+	}
+	lost = tee.drain(wait)
+
+	if _, errGo := tee.f.WriteString(line); errGo != nil {
+		return lost, errors.Wrap(errGo).With("output", tee.f.Name()).With("stack", stack.Trace().TrimRuntime())
+	}
+	return lost, nil
+}
+
+// drain waits for up to the period supplied for the sinks to write the output they hold, the
+// number of pieces of output dropped, or that could not be written, is noted in the output
+// file and returned
+//
+func (tee *OutputTee) drain(wait time.Duration) (lost uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+
+	for _, sink := range tee.sinks {
+		close(sink.outputC)
+	}
+	for _, sink := range tee.sinks {
+		select {
+		case <-sink.doneC:
+			sink.sink.Close()
+		case <-ctx.Done():
+			lost += uint64(len(sink.outputC))
+		}
+		lost += atomic.LoadUint64(&sink.dropped) + atomic.LoadUint64(&sink.failed)
+	}
+	if lost != 0 {
+		tee.f.WriteString(fmt.Sprintf("\n[studioml] %d pieces of output could not be forwarded to the output sinks of the runner\n", lost))
+	}
+	return lost
+}
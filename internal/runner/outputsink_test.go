@@ -0,0 +1,186 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockedSink is an output sink that does not complete any writes until it is released
+//
+type blockedSink struct {
+	releaseC chan struct{}
+}
+
+func (s *blockedSink) Write(output []byte) (err error) {
+	<-s.releaseC
+	return nil
+}
+
+func (s *blockedSink) Close() (err error) {
+	return nil
+}
+
+// TestOutputSinks checks that experiment output is forwarded to every configured sink, and that
+// a sink that is not keeping up drops output rather than holding up the experiment
+//
+func TestOutputSinks(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "output-sinks")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	received := []string{}
+	headers := http.Header{}
+	lock := sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		received = append(received, string(body))
+		headers = r.Header
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	syslogd, errGo := net.ListenPacket("udp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer syslogd.Close()
+
+	logged := []string{}
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, _, errGo := syslogd.ReadFrom(buf)
+			if errGo != nil {
+				return
+			}
+			lock.Lock()
+			logged = append(logged, string(buf[:n]))
+			lock.Unlock()
+		}
+	}()
+
+	saved := *outputSinksOpt
+	savedBuffer := *outputSinkBufferOpt
+	*outputSinksOpt = server.URL + ", file://" + filepath.Join(dir, "copies") + ", syslog+udp://" + syslogd.LocalAddr().String()
+	defer func() {
+		*outputSinksOpt = saved
+		*outputSinkBufferOpt = savedBuffer
+	}()
+
+	if err := ValidateOutputSinks(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, errGo := os.Create(filepath.Join(dir, "output"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	rqst := &Request{}
+	rqst.Experiment.Key = "sink-experiment"
+	rqst.Config.Database.ProjectId = "sink-project"
+
+	tee, warns := NewOutputTee(f, nil, rqst)
+	if len(warns) != 0 {
+		t.Fatal(warns)
+	}
+	// The buffer size is taken when a sink is added so the blocked sink can be given a small one
+	*outputSinkBufferOpt = 2
+	blocked := &blockedSink{releaseC: make(chan struct{})}
+	tee.AddSink(blocked)
+
+	stop, cancel := context.WithCancel(context.Background())
+	outC := make(chan []byte)
+	errC := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		procOutput(stop, tee, outC, errC)
+		tee.Close(*outputSinkWaitOpt)
+		close(done)
+	}()
+
+	// Error lines are written as they arrive, the blocked sink holds the first of them and
+	// buffers two more, the rest are dropped for it without the experiment waiting
+	lines := []string{"first line\n", "second line\n", "third line\n", "fourth line\n", "fifth line\n"}
+	sent := make(chan struct{})
+	go func() {
+		for _, line := range lines {
+			errC <- strings.TrimSuffix(line, "\n")
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("output was held up by a blocked sink")
+	}
+	cancel()
+	close(blocked.releaseC)
+	<-done
+
+	output, errGo := ioutil.ReadFile(f.Name())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if !strings.HasPrefix(string(output), strings.Join(lines, "")) {
+		t.Fatalf("unexpected output %q", string(output))
+	}
+	if !strings.Contains(string(output), "could not be forwarded") {
+		t.Fatalf("output dropped by a sink was not noted %q", string(output))
+	}
+
+	lock.Lock()
+	forwarded := strings.Join(received, "")
+	experiment := headers.Get("X-Studioml-Experiment")
+	lock.Unlock()
+	if forwarded != strings.Join(lines, "") || experiment != "sink-experiment" {
+		t.Fatalf("unexpected output forwarded using http %q for %s", forwarded, experiment)
+	}
+
+	copied, errGo := ioutil.ReadFile(filepath.Join(dir, "copies", "sink-experiment.log"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if string(copied) != strings.Join(lines, "") {
+		t.Fatalf("unexpected output copied to a file %q", string(copied))
+	}
+
+	// Datagrams are not acknowledged so wait for them to arrive
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		lock.Lock()
+		arrived := len(logged)
+		lock.Unlock()
+		if arrived >= len(lines) {
+			break
+		}
+	}
+	lock.Lock()
+	if len(logged) != len(lines) {
+		t.Fatalf("%d lines sent to syslog, expected %d", len(logged), len(lines))
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(logged[i], "<14>") || !strings.Contains(logged[i], " studioml/sink-experiment[") ||
+			!strings.HasSuffix(logged[i], ": "+line) {
+			t.Fatalf("unexpected syslog message %q", logged[i])
+		}
+	}
+	lock.Unlock()
+
+	*outputSinksOpt = "ftp://example.com/output"
+	if err := ValidateOutputSinks(); err == nil {
+		t.Fatal("unsupported output sink was accepted")
+	}
+}
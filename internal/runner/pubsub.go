@@ -20,6 +20,13 @@ import (
 
 var (
 	pubsubTimeoutOpt = flag.Duration("pubsub-timeout", time.Duration(5*time.Second), "the period of time discrete pubsub operations use for timeouts")
+	pubsubRetriesOpt = flag.Int("pubsub-retries", 4, "the number of attempts made to connect to pubsub and start receiving when transient network errors occur")
+
+	// Only one experiment is run at a time for each subscription, see busyQs, so by default
+	// pubsub is not allowed to pull messages that would be held, with their acks extended,
+	// waiting for the running experiment to finish
+	pubsubOutstandingOpt = flag.Int("pubsub-max-outstanding", 1, "the maximum number of pubsub messages that are pulled but not yet acknowledged for each subscription, this should match the number of experiments the runner runs from a subscription at a time")
+	pubsubGoroutinesOpt  = flag.Int("pubsub-goroutines", 1, "the number of goroutines pubsub uses to pull messages for each subscription")
 )
 
 type PubSub struct {
@@ -91,32 +98,56 @@ func (ps *PubSub) Exists(ctx context.Context, subscription string) (exists bool,
 //
 func (ps *PubSub) Work(ctx context.Context, qt *QueueTask) (msgs uint64, resource *Resource, err errors.Error) {
 
-	client, errGo := pubsub.NewClient(ctx, ps.project, option.WithCredentialsFile(ps.creds))
+	// Brief network interruptions are retried here rather than leaving the queue idle until the
+	// next time the producer checks it
+	client := (*pubsub.Client)(nil)
+	errGo := retryTransient(ctx, *pubsubRetriesOpt, time.Second, func() (errGo error) {
+		client, errGo = pubsub.NewClient(ctx, ps.project, option.WithCredentialsFile(ps.creds))
+		return errGo
+	})
 	if errGo != nil {
 		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("project", ps.project)
 	}
 	defer client.Close()
 
 	sub := client.Subscription(qt.Subscription)
+	// The client keeps extending the deadline of messages being worked on until MaxExtension
+	// is reached, a learnt window shorter than an experiment would see it redelivered while
+	// still running so the window is only used to extend the default
 	sub.ReceiveSettings.MaxExtension = time.Duration(12 * time.Hour)
+	if qt.AckWindow > sub.ReceiveSettings.MaxExtension {
+		sub.ReceiveSettings.MaxExtension = qt.AckWindow
+	}
+	sub.ReceiveSettings.MaxOutstandingMessages = *pubsubOutstandingOpt
+	sub.ReceiveSettings.NumGoroutines = *pubsubGoroutinesOpt
+
+	rcvErr := error(nil)
+	retryTransient(ctx, *pubsubRetriesOpt, time.Second, func() error {
+		rcvErr = sub.Receive(ctx,
+			func(ctx context.Context, msg *pubsub.Message) {
+
+				qt.Credentials = ps.creds
+				qt.Project = ps.project
+				qt.Msg = msg.Data
+				qt.Attributes = msg.Attributes
+
+				if rsc, ack := qt.Handler(ctx, qt); ack {
+					msg.Ack()
+					resource = rsc
+				} else {
+					msg.Nack()
+				}
+				atomic.AddUint64(&msgs, 1)
+			})
+		// Once messages have been handled a failure is no longer part of starting to receive
+		// and is not retried
+		if atomic.LoadUint64(&msgs) != 0 {
+			return nil
+		}
+		return rcvErr
+	})
 
-	errGo = sub.Receive(ctx,
-		func(ctx context.Context, msg *pubsub.Message) {
-
-			qt.Credentials = ps.creds
-			qt.Project = ps.project
-			qt.Msg = msg.Data
-
-			if rsc, ack := qt.Handler(ctx, qt); ack {
-				msg.Ack()
-				resource = rsc
-			} else {
-				msg.Nack()
-			}
-			atomic.AddUint64(&msgs, 1)
-		})
-
-	if errGo != nil {
+	if errGo = rcvErr; errGo != nil {
 		return msgs, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
@@ -7,6 +7,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -19,18 +20,62 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/dustin/go-humanize"
+
+	"go.opencensus.io/trace"
+
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
 
 var (
 	hostname string
+
+	scriptCheckOpt = flag.Bool("script-check", true, "check the syntax of the generated experiment script using the no-exec mode of its shell before it is run")
+
+	scriptShellOpt   = flag.String("script-shell", "/bin/bash", "the interpreter the generated experiment script is run with")
+	scriptOptionsOpt = flag.String("script-options", "-e -o pipefail", "the shell options set at the start of the generated experiment script")
+	scriptTraceOpt   = flag.Bool("script-trace", false, "trace the commands of the generated experiment script into the experiment output, intended for debugging")
+)
+
+const (
+	// envBuiltMarker is output by the script once the python environment is ready and the experiment
+	// is about to start
+	envBuiltMarker = `{"studioml":{"start_time":`
 )
 
 func init() {
 	hostname, _ = os.Hostname()
 }
 
+// ValidateScriptShell checks the interpreter and options supplied for the generated script
+//
+func ValidateScriptShell() (err errors.Error) {
+	if !filepath.IsAbs(*scriptShellOpt) {
+		return errors.New("script-shell must be an absolute path").With("script-shell", *scriptShellOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if _, errGo := exec.LookPath(*scriptShellOpt); errGo != nil {
+		return errors.Wrap(errGo, "script-shell is not executable").With("script-shell", *scriptShellOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	// Options are flags such as -e, or +x, and the -o, +o flags which are followed by a name
+	named := false
+	for _, option := range strings.Fields(*scriptOptionsOpt) {
+		switch {
+		case named:
+			named = false
+		case option == "-o" || option == "+o":
+			named = true
+		case len(option) < 2 || (option[0] != '-' && option[0] != '+'):
+			return errors.New("script-options must be set options such as -e or -o pipefail").With("script-options", *scriptOptionsOpt, "option", option).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	if named {
+		return errors.New("script-options is missing an option name").With("script-options", *scriptOptionsOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
 // VirtualEnv encapsulated the context that a python virtual environment is to be
 // instantiated from including items such as the list of pip installables that should
 // be loaded and shell script to run.
@@ -38,6 +83,14 @@ func init() {
 type VirtualEnv struct {
 	Request *Request
 	Script  string
+	Stderr  *StderrPolicy     // Optional policy for judging the experiment using its stderr output
+	Output  *OutputCap        // Optional limit on the size of the output captured from the experiment
+	Env     map[string]string // Variables for the experiment in addition to those allowed from the runners environment
+
+	Telemetry   *Telemetry   // The studioml telemetry lines output by the experiment
+	Utilization *Utilization // The resources consumed by the experiment over time, nil when not sampled
+
+	result *ExperimentResult // The final status of the experiment, nil until it has been run
 }
 
 // NewVirtualEnv builds the VirtualEnv data structure from data received across the wire
@@ -52,6 +105,10 @@ func NewVirtualEnv(rqst *Request, dir string) (env *VirtualEnv, err errors.Error
 	return &VirtualEnv{
 		Request: rqst,
 		Script:  filepath.Join(dir, "_runner", "runner.sh"),
+		Output:  NewOutputCap(),
+
+		Telemetry:   NewTelemetry(),
+		Utilization: NewUtilization(),
 	}, nil
 }
 
@@ -134,6 +191,12 @@ func (p *VirtualEnv) Make(alloc *Allocated, e interface{}) (err errors.Error) {
 
 	pips, cfgPips, studioPIP, tfVer := pythonModules(p.Request, alloc)
 
+	p.Utilization.SetGPUs(alloc.GPU.UUIDs())
+
+	if source, ok := e.(EnvSource); ok {
+		p.Env = source.ExperimentEnvs()
+	}
+
 	// The tensorflow versions 1.5.x and above all support cuda 9 and 1.4.x is cuda 8,
 	// c.f. https://www.tensorflow.org/install/install_sources#tested_source_configurations.
 	// Insert the appropriate version explicitly into the LD_LIBRARY_PATH before other paths
@@ -158,40 +221,72 @@ func (p *VirtualEnv) Make(alloc *Allocated, e interface{}) (err errors.Error) {
 		studioPIP = matches[len(matches)-1]
 	}
 
+	metadata, err := metadataTelemetry(p.Request.Experiment.Metadata)
+	if err != nil {
+		return err
+	}
+	allocation, err := allocationTelemetry(alloc, &p.Request.Experiment.Resource)
+	if err != nil {
+		return err
+	}
+	artifacts, err := artifactTelemetry(p.Request.Experiment.Artifacts)
+	if err != nil {
+		return err
+	}
+	node, err := nodeTelemetry(GetNodeMeta())
+	if err != nil {
+		return err
+	}
+
 	params := struct {
-		E         interface{}
-		Pips      []string
-		CfgPips   []string
-		StudioPIP string
-		CudaDir   string
-		Hostname  string
+		E          interface{}
+		Shell      string
+		Options    string
+		Trace      bool
+		Pips       []string
+		CfgPips    []string
+		StudioPIP  string
+		CudaDir    string
+		Hostname   string
+		Node       string
+		Metadata   string
+		Allocation string
+		Artifacts  []string
 	}{
-		E:         e,
-		Pips:      pips,
-		CfgPips:   cfgPips,
-		StudioPIP: studioPIP,
-		CudaDir:   cudaDir,
-		Hostname:  hostname,
+		E:          e,
+		Shell:      *scriptShellOpt,
+		Options:    strings.Join(strings.Fields(*scriptOptionsOpt), " "),
+		Trace:      *scriptTraceOpt,
+		Pips:       pips,
+		CfgPips:    cfgPips,
+		StudioPIP:  studioPIP,
+		CudaDir:    cudaDir,
+		Hostname:   hostname,
+		Node:       node,
+		Metadata:   metadata,
+		Allocation: allocation,
+		Artifacts:  artifacts,
 	}
 
 	// Create a shell script that will do everything needed to run
-	// the python environment in a virtual env
+	// the python environment in a virtual env.  Tracing of the commands run is only
+	// enabled when asked for, the exit code of the experiment is captured explicitly so
+	// that it is returned even when the script options stop on errors.  Commands that only
+	// report on the environment, such as the telemetry lines, are not allowed to stop the
+	// script should they fail
 	tmpl, errGo := template.New("pythonRunner").Parse(
-		`#!/bin/bash -x
-set -v
-date
+		`#!{{.Shell}}
+{{if .Options}}set {{.Options}}
+{{end}}{{if .Trace}}set -xv
+{{end}}date
 date -u
 export LC_ALL=en_US.utf8
-locale
+locale || true
 export LD_LIBRARY_PATH={{.CudaDir}}:$LD_LIBRARY_PATH:/usr/local/cuda/lib64/:/usr/lib/x86_64-linux-gnu:/lib/x86_64-linux-gnu/
-mkdir {{.E.RootDir}}/blob-cache
-mkdir {{.E.RootDir}}/queue
-mkdir {{.E.RootDir}}/artifact-mappings
-mkdir {{.E.RootDir}}/artifact-mappings/{{.E.Request.Experiment.Key}}
 virtualenv -p ` + "`" + `which python{{.E.Request.Experiment.PythonVer}}` + "`" + ` .
 set +x
 source bin/activate
-set -x
+{{if .Trace}}set -x{{end}}
 pip install pip==9.0.3 --force-reinstall
 {{if .StudioPIP}}
 pip install -I {{.StudioPIP}}
@@ -210,24 +305,28 @@ pip install {{range .CfgPips}} {{.}}{{end}}
 echo "finished installing cfg pips"
 {{end}}
 export STUDIOML_EXPERIMENT={{.E.ExprSubDir}}
-export STUDIOML_HOME={{.E.RootDir}}
+export STUDIOML_HOME={{.E.StudioDirs.Home}}
 cd {{.E.ExprDir}}/workspace
-pip freeze
+pip freeze || true
 set +x
-echo "{\"studioml\": { \"experiment\" : {\"key\": \"{{.E.Request.Experiment.Key}}\", \"project\": \"{{.E.Request.Experiment.Project}}\"}}}" | jq -c '.'
-{{range $key, $value := .E.Request.Experiment.Artifacts}}
-echo "{\"studioml\": { \"artifacts\" : {\"{{$key}}\": \"{{$value.Qualified}}\"}}}" | jq -c '.'
+echo "{\"studioml\": { \"experiment\" : {\"key\": \"{{.E.Request.Experiment.Key}}\", \"project\": \"{{.E.Request.Experiment.Project}}\"}}}" | jq -c '.' || true
+{{range .Artifacts}}
+echo {{.}} | jq -c '.' || true
+{{end}}
+echo "{\"studioml\": {\"pipdeptree\": ` + "`" + `pipdeptree --json` + "`" + `}}" | jq -c '.' || true
+echo "{\"studioml\": {\"start_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.' || true
+echo "{\"studioml\": {\"host\": \"{{.Hostname}}\"}}" | jq -c '.' || true
+echo {{.Node}} | jq -c '.' || true
+{{if .Metadata}}
+echo {{.Metadata}} | jq -c '.' || true
 {{end}}
-echo "{\"studioml\": {\"pipdeptree\": ` + "`" + `pipdeptree --json` + "`" + `}}" | jq -c '.'
-echo "{\"studioml\": {\"start_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.'
-echo "{\"studioml\": {\"host\": \"{{.Hostname}}\"}}" | jq -c '.'
-set -x
-python {{.E.Request.Experiment.Filename}} {{range .E.Request.Experiment.Args}}{{.}} {{end}}
-result=$?
-echo $result
-echo "{\"studioml\": {\"stop_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.'
+echo {{.Allocation}} | jq -c '.' || true
+{{if .Trace}}set -x{{end}}
+result=0
+python {{.E.Request.Experiment.Filename}} {{range .E.Request.Experiment.Args}}{{.}} {{end}} || result=$?
+echo "{\"studioml\": {\"stop_time\": \"` + "`" + `date '+%FT%T.%N%:z'` + "`" + `\"}}" | jq -c '.' || true
 cd -
-locale
+locale || true
 deactivate
 date
 date -u
@@ -250,15 +349,18 @@ exit $result
 	return nil
 }
 
-func procOutput(stopWriter context.Context, f *os.File, outC chan []byte, errC chan string) {
+// procOutput copies the output of an experiment into its output file, limiting the total
+// size of the file when a cap is supplied, and to the output sinks of the tee.  The tee is
+// left open for the caller to finish once the result of the experiment is known
+//
+func procOutput(stopWriter context.Context, tee *OutputTee, outC chan []byte, errC chan string) {
 
 	outLine := []byte{}
 
 	defer func() {
 		if len(outLine) != 0 {
-			f.WriteString(string(outLine))
+			tee.write(string(outLine))
 		}
-		f.Close()
 	}()
 
 	refresh := time.NewTicker(2 * time.Second)
@@ -268,7 +370,7 @@ func procOutput(stopWriter context.Context, f *os.File, outC chan []byte, errC c
 		select {
 		case <-refresh.C:
 			if len(outLine) != 0 {
-				f.WriteString(string(outLine))
+				tee.write(string(outLine))
 				outLine = []byte{}
 			}
 		case <-stopWriter.Done():
@@ -281,17 +383,35 @@ func procOutput(stopWriter context.Context, f *os.File, outC chan []byte, errC c
 				}
 			}
 			if len(outLine) != 0 {
-				f.WriteString(string(outLine))
+				tee.write(string(outLine))
 				outLine = []byte{}
 			}
 		case errLine := <-errC:
 			if len(errLine) != 0 {
-				f.WriteString(errLine + "\n")
+				tee.write(errLine + "\n")
 			}
 		}
 	}
 }
 
+// checkScript runs the shell in its no-exec mode over the generated script so that syntax errors,
+// typically from template or substitution problems, are reported before the script is run
+//
+func checkScript(ctx context.Context, script string) (err errors.Error) {
+	if !*scriptCheckOpt {
+		return nil
+	}
+
+	output, errGo := exec.CommandContext(ctx, *scriptShellOpt, "-n", script).CombinedOutput()
+	if errGo == nil {
+		return nil
+	}
+
+	contents, _ := ioutil.ReadFile(script)
+	return errors.Wrap(errGo, "generated script invalid").With("script", script, "syntax", strings.TrimSpace(string(output)), "contents", string(contents)).
+		With("stack", stack.Trace().TrimRuntime())
+}
+
 // Run will use a generated script file and will run it to completion while marshalling
 // results and files from the computation.  Run is a blocking call and will only return
 // upon completion or termination of the process it starts
@@ -304,27 +424,45 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact) (err
 	// the context heirarchy cancelling everything else
 	defer stopCopyCancel()
 
+	if err = checkScript(ctx, p.Script); err != nil {
+		return err.With("experiment_id", p.Request.Experiment.Key)
+	}
+
 	// Create a new TMPDIR because the python pip tends to leave dirt behind
-	// when doing pip builds etc
-	tmpDir, errGo := ioutil.TempDir("", p.Request.Experiment.Key)
-	if errGo != nil {
-		return errors.Wrap(errGo).With("experimentKey", p.Request.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+	// when doing pip builds etc, and so that experiments do not share temporary files
+	tmpDir, tmpRelease, err := provideTmp(filepath.Dir(path.Dir(p.Script)))
+	if err != nil {
+		return err.With("experimentKey", p.Request.Experiment.Key)
 	}
-	defer os.RemoveAll(tmpDir)
+	defer tmpRelease()
 
 	// Move to starting the process that we will monitor with the experiment running within
 	// it
 	//
-	cmd := exec.CommandContext(stopCopy, "/bin/bash", "-c", "export TMPDIR="+tmpDir+"; "+p.Script)
+	// Make sure the experiment has the shared memory it asked for
+	shmSize, err := ShmSize(&p.Request.Experiment.Resource)
+	if err != nil {
+		return err
+	}
+	shmDir, shmRelease, err := provideShm(tmpDir, shmSize)
+	if err != nil {
+		return err
+	}
+	defer shmRelease()
+
+	cmd := exec.CommandContext(stopCopy, *scriptShellOpt, "-c", tmpExports(tmpDir)+"export STUDIOML_SHM="+shmDir+"; "+p.Script)
 	cmd.Dir = path.Dir(p.Script)
+	cmd.Env = ExperimentEnv(p.Env)
 
-	stdout, errGo := cmd.StdoutPipe()
-	if errGo != nil {
-		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	// Restricted experiments reach the network through a proxy that only forwards to the
+	// hosts they are permitted to use
+	egress, err := startEgressProxy(p.Request)
+	if err != nil {
+		return err.With("experiment_id", p.Request.Experiment.Key)
 	}
-	stderr, errGo := cmd.StderrPipe()
-	if errGo != nil {
-		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	if egress != nil {
+		defer egress.Close()
+		cmd.Env = append(cmd.Env, egress.env()...)
 	}
 
 	outC := make(chan []byte)
@@ -332,85 +470,335 @@ func (p *VirtualEnv) Run(ctx context.Context, refresh map[string]Artifact) (err
 	errC := make(chan string)
 	defer close(errC)
 
+	// The output directory is normally created by the script however the output file is
+	// opened before the script runs so make sure the directory is present
 	outputFN := filepath.Join(cmd.Dir, "..", "output", "output")
+	if errGo := os.MkdirAll(filepath.Dir(outputFN), 0700); errGo != nil {
+		return errors.Wrap(errGo).With("output", outputFN).With("stack", stack.Trace().TrimRuntime())
+	}
+	// When configured run the experiment as an unprivileged user that owns only its own directories
+	runAs, err := getRunAs()
+	if err != nil {
+		return err
+	}
+	if runAs != nil {
+		if err = runAs.prepare(filepath.Dir(cmd.Dir), tmpDir); err != nil {
+			return err
+		}
+		cmd.SysProcAttr = runAs.credential()
+	}
+
 	f, errGo := os.Create(outputFN)
 	if errGo != nil {
-		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		return errors.Wrap(errGo).With("output", outputFN).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	go procOutput(stopCopy, f, outC, errC)
+	tee, warns := NewOutputTee(f, p.Output, p.Request)
+	for _, warn := range warns {
+		f.WriteString(fmt.Sprintf("[studioml] output sink not used %v\n", warn.Error()))
+	}
+	outputDone := make(chan struct{})
+	go func() {
+		procOutput(stopCopy, tee, outC, errC)
+		close(outputDone)
+	}()
 
-	if errGo = cmd.Start(); err != nil {
-		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	// The result line is written once the other output has been, even if the experiment was
+	// killed, so that it is always the last line of the output
+	defer func() {
+		stopCopyCancel()
+		<-outputDone
+		result := NewExperimentResult(ctx, err)
+		p.result = &result
+		if _, errResult := tee.Finish(result, *outputSinkWaitOpt); errResult != nil && err == nil {
+			err = errResult
+		}
+	}()
+
+	// The number of experiments building their environments at the same time is limited, the
+	// limit is released once the script reports it is starting the experiment, or stops
+	_, buildSpan := trace.StartSpan(ctx, "environment-build")
+	buildRelease, err := acquireEnvBuild(stopCopy)
+	if err != nil {
+		EndSpan(buildSpan, err)
+		return err
 	}
 
+	// The setup and run phases of the experiment can have their own timeouts
+	timeouts, err := parsePhaseTimeouts(p.Request, stopCopyCancel)
+	if err != nil {
+		buildRelease()
+		EndSpan(buildSpan, err)
+		return err
+	}
+
+	// Once the environment is built the remainder of the script is the experiment itself
+	execSpan := (*trace.Span)(nil)
+	built := false
+	buildOnce := sync.Once{}
+	buildDone := func() {
+		buildOnce.Do(func() {
+			built = true
+			timeouts.startRun()
+			buildRelease()
+			if egress != nil && p.Request.Experiment.Network == NetworkIsolated {
+				egress.isolate()
+			}
+			buildSpan.End()
+			_, execSpan = trace.StartSpan(ctx, "execute")
+		})
+	}
+	// The experiment stopping before its environment was built releases the build slot and
+	// records the failure against the build
+	buildFailed := false
+	defer func() {
+		buildOnce.Do(func() {
+			buildRelease()
+			EndSpan(buildSpan, err)
+			if buildFailed {
+				recordEnvFailure(p.Request, err)
+			}
+		})
+	}()
+
 	// Protect the err value when running multiple goroutines
 	errCheck := sync.Mutex{}
 
-	waitOnIO := sync.WaitGroup{}
-	waitOnIO.Add(2)
+	// Records the first stderr line that the stderr policy treats as a failure
+	stderrFailure := ""
+	stderrLine := ""
+	stderrLast := ""
 
-	go func() {
-		defer waitOnIO.Done()
+	// Stop the experiment should it consume more disk space than it asked for, the directory
+	// holding the script and the virtualenv built by the runner is not counted
+	quotaErr := errors.Error(nil)
+	if quota, errGo := humanize.ParseBytes(p.Request.Experiment.Resource.Hdd); errGo == nil {
+		go monitorDiskQuota(stopCopy, filepath.Dir(cmd.Dir), quota, func(err errors.Error) {
+			errCheck.Lock()
+			quotaErr = err
+			errCheck.Unlock()
+			stopCopyCancel()
+		}, cmd.Dir)
+	}
 
-		time.Sleep(time.Second)
-		s := bufio.NewScanner(stdout)
-		s.Split(bufio.ScanRunes)
-		for s.Scan() {
-			outC <- s.Bytes()
+	// The script is run again when the environment build fails due to a transient network
+	// failure, the workspace and artifacts are left in place so only the build is repeated
+	exitErr := error(nil)
+	buildOutput := &envBuildOutput{}
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		stdout, errGo := cmd.StdoutPipe()
+		if errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 		}
-		if errGo := s.Err(); errGo != nil {
-			errCheck.Lock()
-			defer errCheck.Unlock()
-			if err != nil {
-				err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		stderr, errGo := cmd.StderrPipe()
+		if errGo != nil {
+			return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		if errGo = startIsolated(cmd, tmpDir, shmDir); errGo != nil {
+			return errors.Wrap(errGo, "experiment could not be started").With("script", p.Script, "experiment_id", p.Request.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+		if attempt == 1 {
+			timeouts.startSetup()
+		}
+		if errCores := limitCores(cmd.Process.Pid); errCores != nil {
+			select {
+			case outC <- []byte(fmt.Sprintf("[studioml] core dumps not enabled %v\n", errCores.Error())):
+			case <-stopCopy.Done():
 			}
 		}
-	}()
 
-	go func() {
-		defer waitOnIO.Done()
+		// The resources consumed by the experiment are sampled until it stops
+		sampling, stopSampling := context.WithCancel(stopCopy)
+		utilizationDone := p.Utilization.Start(sampling, cmd.Process.Pid)
+
+		waitOnIO := sync.WaitGroup{}
+		waitOnIO.Add(2)
+
+		go func() {
+			defer waitOnIO.Done()
+
+			time.Sleep(time.Second)
+			s := bufio.NewScanner(stdout)
+			s.Split(bufio.ScanRunes)
+			line := []byte{}
+			for s.Scan() {
+				r := s.Bytes()
+				line = append(line, r...)
+				if bytes.Contains(r, []byte{'\n'}) {
+					if bytes.Contains(line, []byte(envBuiltMarker)) {
+						buildDone()
+					}
+					p.Telemetry.Scan(string(line))
+					line = line[:0]
+				}
+				outC <- r
+			}
+			p.Telemetry.Scan(string(line))
+			if errGo := s.Err(); errGo != nil {
+				errCheck.Lock()
+				defer errCheck.Unlock()
+				if err != nil {
+					err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+		}()
+
+		go func() {
+			defer waitOnIO.Done()
+
+			time.Sleep(time.Second)
+			s := bufio.NewScanner(stderr)
+			s.Split(bufio.ScanLines)
+			for s.Scan() {
+				line := s.Text()
+				p.Telemetry.Scan(line)
+				buildOutput.scan(line)
+				if len(strings.TrimSpace(line)) != 0 {
+					errCheck.Lock()
+					stderrLast = line
+					errCheck.Unlock()
+				}
+				if len(stderrFailure) == 0 {
+					if pattern := p.Stderr.failure(line); len(pattern) != 0 {
+						errCheck.Lock()
+						stderrFailure = pattern
+						stderrLine = line
+						errCheck.Unlock()
+					}
+				}
+				errC <- line
+			}
+			if errGo := s.Err(); errGo != nil {
+				errCheck.Lock()
+				defer errCheck.Unlock()
+				if err != nil {
+					err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+				}
+			}
+		}()
 
-		time.Sleep(time.Second)
-		s := bufio.NewScanner(stderr)
-		s.Split(bufio.ScanLines)
-		for s.Scan() {
-			errC <- s.Text()
-		}
-		if errGo := s.Err(); errGo != nil {
+		// Wait for the process to exit, and store any error code if possible
+		// before we continue to wait on the processes output devices finishing
+		exitErr = cmd.Wait()
+		if errGo = exitErr; errGo != nil {
 			errCheck.Lock()
-			defer errCheck.Unlock()
-			if err != nil {
+			if err == nil {
 				err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 			}
+			errCheck.Unlock()
 		}
-	}()
 
-	// Wait for the process to exit, and store any error code if possible
-	// before we continue to wait on the processes output devices finishing
-	if errGo = cmd.Wait(); errGo != nil {
+		// Wait for the IO to stop before continuing to tell the background
+		// writer to terminate. This means the IO for the process will
+		// be able to send on the channels until they have stopped.
+		waitOnIO.Wait()
+
+		stopSampling()
+		<-utilizationDone
+
 		errCheck.Lock()
-		if err == nil {
-			err = errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		retry := exitErr != nil && !built && buildOutput.transient && attempt < *envAttemptsOpt &&
+			stopCopy.Err() == nil && quotaErr == nil && !IsOutOfDisk(err)
+		errCheck.Unlock()
+		if !retry {
+			break
+		}
+
+		// The output writer stops once stopCopy is done so the notice is dropped rather than
+		// blocking should the experiment be stopped at this point
+		backoff := envBuildBackoff(attempt)
+		select {
+		case outC <- []byte(fmt.Sprintf("[studioml] python environment build failed due to a transient network failure, attempt %d of %d, retrying in %s\n",
+			attempt, *envAttemptsOpt, backoff.String())):
+		case <-stopCopy.Done():
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stopCopy.Done():
+		}
+		if stopCopy.Err() != nil {
+			break
 		}
+
+		// The failed attempt has no bearing on the outcome of the next
+		errCheck.Lock()
+		err = nil
+		stderrFailure, stderrLine, stderrLast = "", "", ""
 		errCheck.Unlock()
+		buildOutput = &envBuildOutput{}
+		cmd = rerunCmd(stopCopy, cmd)
 	}
 
-	// Wait for the IO to stop before continuing to tell the background
-	// writer to terminate. This means the IO for the process will
-	// be able to send on the channels until they have stopped.
-	waitOnIO.Wait()
-
 	errCheck.Lock()
+	// The script failing by itself, rather than being stopped, before the experiment started
+	// is a failure to build the python environment, the output of the build shows if the
+	// failure was transient and the last thing written to stderr is usually the reason for it
+	if exitErr != nil && stopCopy.Err() == nil && quotaErr == nil && !IsOutOfDisk(err) {
+		buildFailed = true
+		if !built {
+			err = buildOutput.failure(err)
+		}
+		if err != nil && len(stderrLast) != 0 {
+			err = err.With("stderr", stderrLast)
+		}
+	}
+	if quotaErr != nil {
+		err = quotaErr
+	}
+	// Cores left behind by an experiment that crashed are kept for debugging
+	if exitErr != nil && err != nil {
+		if cores, errCores := captureCores(filepath.Dir(cmd.Dir), []string{filepath.Join(filepath.Dir(cmd.Dir), "workspace"), cmd.Dir}, cmd.ProcessState, started); errCores != nil {
+			err = err.With("core_dump_error", errCores.Error())
+		} else if cores != nil {
+			err = err.With("core_dumps", len(cores.Cores), "signal", cores.Signal)
+		}
+	}
+	if timeoutErr := timeouts.finish(); timeoutErr != nil {
+		err = timeoutErr.With("experiment_id", p.Request.Experiment.Key)
+	}
 	if err == nil && stopCopy.Err() != nil {
 		err = errors.Wrap(stopCopy.Err()).With("stack", stack.Trace().TrimRuntime())
 	}
+	if err == nil && len(stderrFailure) != 0 {
+		err = errors.New("stderr output matched a failure pattern").With("pattern", stderrFailure, "line", stderrLine).With("stack", stack.Trace().TrimRuntime())
+	}
 	errCheck.Unlock()
 
+	// The output readers have stopped so the execution span can no longer be started
+	if execSpan != nil {
+		EndSpan(execSpan, err)
+	}
+
 	fmt.Println(stack.Trace().TrimRuntime())
 	return err
 }
 
+// rerunCmd returns a command that runs the script of a command that has finished again
+//
+func rerunCmd(ctx context.Context, cmd *exec.Cmd) (again *exec.Cmd) {
+	again = exec.CommandContext(ctx, cmd.Path, cmd.Args[1:]...)
+	again.Dir = cmd.Dir
+	again.Env = cmd.Env
+	again.SysProcAttr = cmd.SysProcAttr
+	return again
+}
+
+// OutputTruncated returns true when output from the experiment was discarded because it
+// exceeded the output limit
+//
+func (ve *VirtualEnv) OutputTruncated() (truncated bool) {
+	return ve.Output.Truncated()
+}
+
+// Result returns the final status of the experiment as written to its result line, nil is
+// returned when the experiment was not run
+//
+func (ve *VirtualEnv) Result() (result *ExperimentResult) {
+	return ve.result
+}
+
 // Close is used to close any resources which the encapsulated VirtualEnv may have consumed.
 //
 func (ve *VirtualEnv) Close() (err errors.Error) {
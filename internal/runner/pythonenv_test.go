@@ -0,0 +1,568 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+
+	"github.com/rs/xid"
+)
+
+// This file contains tests for the python virtualenv runtime that can be run without
+// python or any of the studioml tooling being present
+
+// TestVirtualEnvFreshDir runs a trivial script using a working directory that has only
+// had the runner directory created, validating that the output directory is created
+// by the Go side of the runner rather than relying on the script
+//
+func TestVirtualEnvFreshDir(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if errGo = ioutil.WriteFile(env.Script, []byte("#!/bin/bash\necho done\n"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err = env.Run(ctx, map[string]Artifact{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errGo = os.Stat(filepath.Join(dir, "output", "output")); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+}
+
+// TestVirtualEnvStderrPolicy runs a script that exits with a zero exit code after
+// writing a line to stderr that the policy treats as fatal
+//
+func TestVirtualEnvStderrPolicy(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Stderr, err = NewStderrPolicy([]string{"^FATAL"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The script lingers to give the output processing in Run time to start consuming stderr
+	if errGo = ioutil.WriteFile(env.Script, []byte("#!/bin/bash\necho 'FATAL out of cheese' 1>&2\nsleep 2\nexit 0\n"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err = env.Run(ctx, map[string]Artifact{}); err == nil {
+		t.Fatal("a stderr failure pattern was not detected")
+	}
+
+	// Without a policy stderr is not used to judge the experiment
+	env.Stderr = nil
+	if err = env.Run(ctx, map[string]Artifact{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestVirtualEnvScriptCheck checks that a generated script containing a syntax error is
+// rejected before it is run
+//
+func TestVirtualEnvScriptCheck(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The script would leave a marker behind if it had been run
+	marker := filepath.Join(dir, "ran")
+	if errGo = ioutil.WriteFile(env.Script, []byte("#!/bin/bash\ntouch "+marker+"\nif [ -z \"$HOME\" ]; then\necho missing\n"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	err = env.Run(ctx, map[string]Artifact{})
+	if err == nil || !strings.Contains(err.Error(), "generated script invalid") {
+		t.Fatalf("a script with a syntax error was not rejected, %v", err)
+	}
+	if _, errGo = os.Stat(marker); errGo == nil {
+		t.Fatal("a script with a syntax error was run")
+	}
+}
+
+// TestVirtualEnvPhaseTimeouts checks that experiments exceeding their setup, or run, timeouts
+// are stopped with an error identifying the phase
+//
+func TestVirtualEnvPhaseTimeouts(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// An environment that never finishes building exceeds the setup timeout
+	rqst.Experiment.SetupTimeout = "2s"
+	if errGo = ioutil.WriteFile(env.Script, []byte("#!/bin/bash\nsleep 20\n"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = env.Run(ctx, map[string]Artifact{}); !IsSetupTimeout(err) {
+		t.Fatalf("expected a setup timeout, got %v", err)
+	}
+
+	// Once the environment is built the setup timeout no longer applies, the run timeout does
+	rqst.Experiment.RunTimeout = "3s"
+	script := "#!/bin/bash\necho '" + envBuiltMarker + " 0}}'\nsleep 20\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = env.Run(ctx, map[string]Artifact{}); !IsRunTimeout(err) {
+		t.Fatalf("expected a run timeout, got %v", err)
+	}
+}
+
+// TestVirtualEnvEnvFilter checks that experiments only inherit the allowed variables from the
+// runners environment along with the variables supplied for the experiment
+//
+func TestVirtualEnvEnvFilter(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RUNNER_INTERNAL_SECRET", "leaked")
+	os.Setenv("STUDIOML_RUNNER_TEST", "inherited")
+	defer func() {
+		os.Unsetenv("RUNNER_INTERNAL_SECRET")
+		os.Unsetenv("STUDIOML_RUNNER_TEST")
+	}()
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Env = map[string]string{"EXPERIMENT_VAR": "requested"}
+
+	envFile := filepath.Join(dir, "env.txt")
+	if errGo = ioutil.WriteFile(env.Script, []byte("#!/bin/bash\nenv > "+envFile+"\n"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err = env.Run(ctx, map[string]Artifact{}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, errGo := ioutil.ReadFile(envFile)
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	vars := "\n" + string(output)
+	for _, expected := range []string{"\nPATH=", "\nSTUDIOML_RUNNER_TEST=inherited\n", "\nEXPERIMENT_VAR=requested\n"} {
+		if !strings.Contains(vars, expected) {
+			t.Fatalf("experiment environment is missing %q", strings.TrimSpace(expected))
+		}
+	}
+	if strings.Contains(vars, "RUNNER_INTERNAL_SECRET") {
+		t.Fatal("experiment inherited a runner variable that was not allowed")
+	}
+}
+
+// TestVirtualEnvPrivateTmp checks that experiments are given their own temporary directory and,
+// when the runner can create mount namespaces, that writes to /tmp do not reach the host
+//
+func TestVirtualEnvPrivateTmp(t *testing.T) {
+
+	// The experiment must live outside of /tmp for the private mount to be used
+	dir, errGo := ioutil.TempDir("/var/tmp", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marker := filepath.Join("/tmp", "private-tmp-"+rqst.Experiment.Key)
+	defer os.Remove(marker)
+
+	tmpFile := filepath.Join(dir, "tmpdir.txt")
+	script := "#!/bin/bash\necho -n $TMPDIR > " + tmpFile + "\ntouch " + marker + "\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if err = env.Run(ctx, map[string]Artifact{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir, errGo := ioutil.ReadFile(tmpFile)
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if string(tmpDir) != filepath.Join(dir, "_tmp") {
+		t.Fatalf("experiment TMPDIR was %q", string(tmpDir))
+	}
+	if _, errGo = os.Stat(string(tmpDir)); !os.IsNotExist(errGo) {
+		t.Fatal("experiment temporary directory was not removed")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("mount namespaces need the test to be run as root")
+	}
+	if _, errGo = os.Stat(marker); !os.IsNotExist(errGo) {
+		t.Fatal("experiment wrote to the hosts /tmp")
+	}
+}
+
+// TestVirtualEnvBuildFailureCache checks that a script failing before the experiment starts
+// is remembered against the packages it was installing, and that experiments failing after
+// their environment was built are not
+//
+func TestVirtualEnvBuildFailureCache(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	ttl := *envFailureTTLOpt
+	*envFailureTTLOpt = time.Minute
+	defer func() { *envFailureTTLOpt = ttl }()
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+	rqst.Experiment.Pythonenv = []string{"no-such-package-" + xid.New().String() + "==1.0"}
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Output is read from the script a second after it starts so it lives long enough for its
+	// stderr to be seen, as a real pip failure would
+	script := "#!/bin/bash\necho 'ERROR: No matching distribution found' 1>&2\nsleep 2\nexit 1\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = env.Run(ctx, map[string]Artifact{}); err == nil {
+		t.Fatal("failing environment build did not return an error")
+	}
+
+	err = EnvBuildFailed(rqst)
+	if err == nil {
+		t.Fatal("failed environment build was not remembered")
+	}
+	if !strings.Contains(err.Error(), "No matching distribution found") {
+		t.Fatalf("cached error is missing the build output %v", err)
+	}
+
+	// Experiments with other packages are not affected
+	other := &Request{}
+	other.Experiment.Pythonenv = []string{"numpy==1.19.0"}
+	if err = EnvBuildFailed(other); err != nil {
+		t.Fatalf("unrelated packages reported as failing %v", err)
+	}
+
+	// Experiments that fail after their environment was built do not mark it as broken
+	script = "#!/bin/bash\necho '" + envBuiltMarker + " 0}}'\nsleep 2\nexit 1\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	env.Request = other
+	if err = env.Run(ctx, map[string]Artifact{}); err == nil {
+		t.Fatal("failing experiment did not return an error")
+	}
+	if err = EnvBuildFailed(other); err != nil {
+		t.Fatalf("experiment failure recorded against its environment %v", err)
+	}
+
+	// Once the failure has expired the build is attempted again
+	envFailures.Lock()
+	hash := EnvRequirementsHash(rqst)
+	failure := envFailures.failures[hash]
+	failure.until = time.Now().Add(-time.Second)
+	envFailures.failures[hash] = failure
+	envFailures.Unlock()
+
+	if err = EnvBuildFailed(rqst); err != nil {
+		t.Fatalf("expired environment failure was still reported %v", err)
+	}
+}
+
+// TestVirtualEnvBuildRetry checks that environment builds failing due to network failures
+// are retried in place, and that builds failing to resolve their packages are not
+//
+func TestVirtualEnvBuildRetry(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	backoff := *envBackoffOpt
+	*envBackoffOpt = 100 * time.Millisecond
+	defer func() { *envBackoffOpt = backoff }()
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The first attempt cannot reach the index, the second builds and runs the experiment
+	attempts := filepath.Join(dir, "attempts")
+	script := "#!/bin/bash\necho attempt >> " + attempts + "\n" +
+		"if [ `wc -l < " + attempts + "` -eq 1 ]; then\n" +
+		"echo \"Retrying (Retry(total=4)) after connection broken by 'NewConnectionError'\" 1>&2\n" +
+		"echo 'ERROR: No matching distribution found for numpy' 1>&2\nsleep 2\nexit 1\nfi\n" +
+		"echo '" + envBuiltMarker + " 0}}'\nsleep 2\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = env.Run(ctx, map[string]Artifact{}); err != nil {
+		t.Fatalf("transient build failure was not retried %v", err)
+	}
+	if data, _ := ioutil.ReadFile(attempts); strings.Count(string(data), "attempt") != 2 {
+		t.Fatalf("build attempted %d times", strings.Count(string(data), "attempt"))
+	}
+
+	// Packages that cannot be resolved are not retried
+	os.Remove(attempts)
+	script = "#!/bin/bash\necho attempt >> " + attempts + "\necho 'ERROR: No matching distribution found for numpy' 1>&2\nsleep 2\nexit 1\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = env.Run(ctx, map[string]Artifact{}); !IsEnvBuildResolution(err) {
+		t.Fatalf("expected a dependency resolution failure, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(attempts); strings.Count(string(data), "attempt") != 1 {
+		t.Fatalf("unresolvable build attempted %d times", strings.Count(string(data), "attempt"))
+	}
+
+	// Builds that never reach the index are retried until the attempts run out
+	os.Remove(attempts)
+	script = "#!/bin/bash\necho attempt >> " + attempts + "\necho 'Temporary failure in name resolution' 1>&2\nsleep 2\nexit 1\n"
+	if errGo = ioutil.WriteFile(env.Script, []byte(script), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if err = env.Run(ctx, map[string]Artifact{}); !IsEnvBuildTransient(err) {
+		t.Fatalf("expected a transient failure, got %v", err)
+	}
+	if data, _ := ioutil.ReadFile(attempts); strings.Count(string(data), "attempt") != *envAttemptsOpt {
+		t.Fatalf("transient failure attempted %d times", strings.Count(string(data), "attempt"))
+	}
+}
+
+// TestVirtualEnvScriptShell checks that the interpreter and options of the generated script
+// come from the runner options, and that tracing is only enabled when asked for
+//
+func TestVirtualEnvScriptShell(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+	rqst.Experiment.Filename = "train.py"
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := NewStudioDirs(dir, rqst.Experiment.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := struct {
+		Request    *Request
+		RootDir    string
+		ExprDir    string
+		ExprSubDir string
+		StudioDirs *StudioDirs
+	}{
+		Request:    rqst,
+		RootDir:    dir,
+		ExprDir:    dir,
+		StudioDirs: dirs,
+	}
+
+	options, trace := *scriptOptionsOpt, *scriptTraceOpt
+	defer func() {
+		*scriptOptionsOpt, *scriptTraceOpt = options, trace
+	}()
+
+	if err = env.Make(&Allocated{}, e); err != nil {
+		t.Fatal(err)
+	}
+	script, errGo := ioutil.ReadFile(env.Script)
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !strings.HasPrefix(string(script), "#!/bin/bash\nset -e -o pipefail\ndate\n") {
+		t.Fatalf("unexpected script header %q", string(script[:64]))
+	}
+	if strings.Contains(string(script), "set -x") {
+		t.Fatal("script traces commands when tracing was not asked for")
+	}
+	// The exit code of the experiment must survive the script stopping on errors
+	if !strings.Contains(string(script), "python train.py  || result=$?\n") {
+		t.Fatal("script does not capture the exit code of the experiment")
+	}
+	// Commands reporting on the environment must not stop the script when they fail
+	for _, line := range strings.Split(string(script), "\n") {
+		if (strings.Contains(line, "| jq") || strings.HasPrefix(line, "pip freeze")) && !strings.HasSuffix(line, "|| true") {
+			t.Fatalf("optional command can stop the script %q", line)
+		}
+	}
+	// The studioml directories are created by the runner and not the script
+	if strings.Contains(string(script), "mkdir") || !strings.Contains(string(script), "export STUDIOML_HOME="+dir+"\n") {
+		t.Fatal("script does not use the studioml directories created by the runner")
+	}
+	if err = checkScript(context.Background(), env.Script); err != nil {
+		t.Fatal(err)
+	}
+
+	*scriptOptionsOpt = ""
+	*scriptTraceOpt = true
+	if err = env.Make(&Allocated{}, e); err != nil {
+		t.Fatal(err)
+	}
+	if script, errGo = ioutil.ReadFile(env.Script); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !strings.HasPrefix(string(script), "#!/bin/bash\nset -xv\ndate\n") {
+		t.Fatalf("unexpected traced script header %q", string(script[:64]))
+	}
+
+	for spec, valid := range map[string]bool{"-e -o pipefail": true, "": true, "-eu +o posix": true, "-o": false, "errexit": false} {
+		*scriptOptionsOpt = spec
+		if err = ValidateScriptShell(); (err == nil) != valid {
+			t.Fatalf("script options %q validity expected %v, error %v", spec, valid, err)
+		}
+	}
+}
+
+// TestVirtualEnvStartFailure checks that an experiment whose process cannot be started returns
+// the failure rather than waiting on a process that does not exist
+//
+func TestVirtualEnvStartFailure(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "venv-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	rqst := &Request{}
+	rqst.Experiment.Key = xid.New().String()
+
+	env, err := NewVirtualEnv(rqst, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errGo = ioutil.WriteFile(env.Script, []byte("#!/bin/bash\necho ran\n"), 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	// The script check would also fail with a missing interpreter so it is skipped to reach
+	// the start of the process
+	shell, check := *scriptShellOpt, *scriptCheckOpt
+	*scriptShellOpt = filepath.Join(dir, "no-such-shell")
+	*scriptCheckOpt = false
+	defer func() {
+		*scriptShellOpt, *scriptCheckOpt = shell, check
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	err = env.Run(ctx, map[string]Artifact{})
+	if err == nil || !strings.Contains(err.Error(), "experiment could not be started") {
+		t.Fatalf("a process that could not be started was not reported, %v", err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the start failure was only seen once the test timed out")
+	}
+}
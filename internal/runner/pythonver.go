@@ -0,0 +1,70 @@
+package runner
+
+// This file contains the implementation of the checks made on the python version an
+// experiment asks for.  The version is used to select the interpreter for the virtualenv
+// and studioml clients have encoded it in a number of ways, for example 3, 3.6, or 36.
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	pythonVersOpt = flag.String("python-versions", "2,2.7,3,3.5,3.6,3.7", "a comma separated list of the python versions that are installed for experiments to use")
+)
+
+// NormalizePythonVer will convert the encodings of python versions used by clients into the
+// form used by the interpreter name, for example 27 and 2.7 both become 2.7
+//
+func NormalizePythonVer(ver string) (normalized string, err errors.Error) {
+	ver = strings.TrimSpace(ver)
+	if len(ver) == 0 {
+		return "", errors.New("python version missing").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	parts := strings.Split(ver, ".")
+	switch len(parts) {
+	case 1:
+		// A concatenated major and minor version such as 27 or 36
+		if len(ver) > 1 {
+			parts = []string{ver[:1], ver[1:]}
+		}
+	case 2:
+	default:
+		return "", errors.New("python version not recognized").With("version", ver).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for i, part := range parts {
+		value, errGo := strconv.ParseUint(part, 10, 32)
+		if errGo != nil {
+			return "", errors.New("python version not recognized").With("version", ver).With("stack", stack.Trace().TrimRuntime())
+		}
+		parts[i] = strconv.FormatUint(value, 10)
+	}
+
+	if parts[0] != "2" && parts[0] != "3" {
+		return "", errors.New("python major version not recognized").With("version", ver).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return strings.Join(parts, "."), nil
+}
+
+// ValidatePythonVer will normalize the requested python version and then check that
+// it is one the operator has made available
+//
+func ValidatePythonVer(ver string) (normalized string, err errors.Error) {
+	if normalized, err = NormalizePythonVer(ver); err != nil {
+		return "", err
+	}
+
+	for _, supported := range strings.Split(*pythonVersOpt, ",") {
+		if supported, err := NormalizePythonVer(supported); err == nil && supported == normalized {
+			return normalized, nil
+		}
+	}
+	return "", errors.New("python version not supported").With("version", ver, "supported", *pythonVersOpt).With("stack", stack.Trace().TrimRuntime())
+}
@@ -0,0 +1,41 @@
+package runner
+
+import (
+	"testing"
+)
+
+// TestPythonVer checks the normalization and validation of the python versions
+// requested by experiments
+//
+func TestPythonVer(t *testing.T) {
+
+	cases := map[string]string{
+		"2":   "2",
+		"3":   "3",
+		"27":  "2.7",
+		"2.7": "2.7",
+		"36":  "3.6",
+		"3.6": "3.6",
+		"4":   "",
+		"0":   "",
+		"":    "",
+		"2.x": "",
+		"9.9": "",
+	}
+
+	for ver, expected := range cases {
+		normalized, err := ValidatePythonVer(ver)
+		if len(expected) == 0 {
+			if err == nil {
+				t.Fatalf("python version '%s' was accepted as '%s'", ver, normalized)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("python version '%s' was rejected, %v", ver, err)
+		}
+		if normalized != expected {
+			t.Fatalf("python version '%s' expected '%s' got '%s'", ver, expected, normalized)
+		}
+	}
+}
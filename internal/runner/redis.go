@@ -0,0 +1,435 @@
+package runner
+
+// This file contains the implementation of a queue that uses Redis streams as its source of
+// work.  Every stream whose key matches the queue matching expression is treated as a queue
+// and is read by the runners using a consumer group so that each request is delivered to a
+// single runner.  Requests are stream entries with the request JSON in a field named msg,
+// any other fields of the entry are passed to the handler as message attributes.
+//
+// Entries remain pending within the consumer group until they are acknowledged.  While a
+// runner is working on a request it regularly claims the entry for itself which resets the
+// time the entry has been idle.  Entries that have been idle for longer than the claim period,
+// because their runner failed or because the runner declined the work, are reclaimed by
+// other runners and redelivered.
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	redisGroupOpt = flag.String("redis-group", "studioml", "the consumer group runners use to read requests from redis streams")
+	redisClaimOpt = flag.Duration("redis-claim-idle", 5*time.Minute, "the period a pending redis stream request must be idle before it is reclaimed from the consumer that was delivered it")
+)
+
+const (
+	redisMsgField = "msg"
+	redisBlock    = 5 * time.Second
+)
+
+// RedisStreams encapsulates the redis server containing the streams being read
+//
+type RedisStreams struct {
+	addr     string
+	password string
+	db       int
+	tls      bool
+
+	group     string
+	consumer  string
+	claimIdle time.Duration
+}
+
+// redisEntry is a stream entry and its fields
+//
+type redisEntry struct {
+	id         string
+	fields     map[string]string
+	deliveries uint // The number of times the entry has been delivered to consumers
+}
+
+// NewRedisStreams will validate the redis URL and return a task queue for the streams
+// within it.  Credentials can be supplied using the creds parameter as a user:password pair,
+// or within the URL itself.
+//
+func NewRedisStreams(project string, creds string) (rs *RedisStreams, err errors.Error) {
+
+	redisURL, errGo := url.Parse(project)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	if redisURL.Scheme != "redis" && redisURL.Scheme != "rediss" {
+		return nil, errors.New("redis URL must use the redis or rediss scheme").With("scheme", redisURL.Scheme).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	rs = &RedisStreams{
+		addr:      redisURL.Host,
+		tls:       redisURL.Scheme == "rediss",
+		group:     *redisGroupOpt,
+		claimIdle: *redisClaimOpt,
+	}
+	if len(redisURL.Port()) == 0 {
+		rs.addr = net.JoinHostPort(redisURL.Hostname(), "6379")
+	}
+	if db := strings.Trim(redisURL.Path, "/"); len(db) != 0 {
+		if rs.db, errGo = strconv.Atoi(db); errGo != nil {
+			return nil, errors.New("redis URL path must be a database number").With("db", db).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	if redisURL.User != nil {
+		rs.password, _ = redisURL.User.Password()
+	}
+	if len(creds) != 0 {
+		creds, _ = url.PathUnescape(creds)
+		if parts := strings.SplitN(creds, ":", 2); len(parts) == 2 {
+			rs.password = parts[1]
+		} else {
+			rs.password = creds
+		}
+	}
+
+	// Consumers are named after the runner so that entries held by a runner that has gone
+	// can be seen in the consumer group
+	hostName, _ := os.Hostname()
+	rs.consumer = fmt.Sprintf("%s-%d", hostName, os.Getpid())
+
+	if rs.claimIdle <= 0 {
+		return nil, errors.New("redis-claim-idle must be positive").With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return rs, nil
+}
+
+// connect opens an authenticated connection to the redis server, the connection is
+// abandoned should the context be cancelled while it is being established
+//
+func (rs *RedisStreams) connect(ctx context.Context) (conn redis.Conn, err errors.Error) {
+
+	dialer := &net.Dialer{Timeout: 15 * time.Second, KeepAlive: 5 * time.Minute}
+	netDial := func(network string, addr string) (netConn net.Conn, errGo error) {
+		if netConn, errGo = dialer.DialContext(ctx, network, addr); errGo != nil {
+			return nil, errGo
+		}
+		// Bounds the TLS handshake and authentication, later commands set their own deadlines
+		netConn.SetDeadline(time.Now().Add(dialer.Timeout))
+		return netConn, nil
+	}
+
+	conn, errGo := redis.Dial("tcp", rs.addr,
+		redis.DialNetDial(netDial),
+		redis.DialReadTimeout(time.Minute),
+		redis.DialWriteTimeout(time.Minute),
+		redis.DialPassword(rs.password),
+		redis.DialDatabase(rs.db),
+		redis.DialUseTLS(rs.tls),
+		redis.DialTLSConfig(&tls.Config{RootCAs: caBundleRoots}),
+	)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("addr", rs.addr, "db", rs.db).With("stack", stack.Trace().TrimRuntime())
+	}
+	return conn, nil
+}
+
+// redisDo sends a command to the server and waits for its reply, waiting no longer than the
+// deadline of the context, or a minute when there is none
+//
+func redisDo(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (reply interface{}, errGo error) {
+	timeout := time.Minute
+	if deadline, isPresent := ctx.Deadline(); isPresent {
+		if timeout = time.Until(deadline); timeout < time.Millisecond {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	return redis.DoWithTimeout(conn, timeout, cmd, args...)
+}
+
+// redisEntries decodes the entries within a stream reply
+//
+func redisEntries(reply interface{}) (entries []redisEntry) {
+	items, _ := redis.Values(reply, nil)
+	for _, item := range items {
+		parts, errGo := redis.Values(item, nil)
+		if errGo != nil || len(parts) != 2 {
+			continue
+		}
+		entry := redisEntry{}
+		if entry.id, errGo = redis.String(parts[0], nil); errGo != nil {
+			continue
+		}
+
+		// Deleted entries that are still pending are returned without fields
+		if entry.fields, errGo = redis.StringMap(parts[1], nil); errGo != nil {
+			entry.fields = map[string]string{}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Refresh lists the streams that match the caller supplied expression
+//
+func (rs *RedisStreams) Refresh(ctx context.Context, matcher *regexp.Regexp) (known map[string]interface{}, err errors.Error) {
+
+	known = map[string]interface{}{}
+
+	conn, err := rs.connect(ctx)
+	if err != nil {
+		return known, err
+	}
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		page, errGo := redis.Values(redisDo(ctx, conn, "SCAN", cursor, "COUNT", 100))
+		if errGo != nil {
+			return known, errors.Wrap(errGo).With("command", "SCAN").With("stack", stack.Trace().TrimRuntime())
+		}
+		keys := []string{}
+		if _, errGo = redis.Scan(page, &cursor, &keys); errGo != nil {
+			return known, errors.Wrap(errGo, "unexpected redis SCAN reply").With("stack", stack.Trace().TrimRuntime())
+		}
+
+		for _, key := range keys {
+			if matcher != nil && !matcher.MatchString(key) {
+				continue
+			}
+			keyType, errGo := redis.String(redisDo(ctx, conn, "TYPE", key))
+			if errGo != nil {
+				return known, errors.Wrap(errGo).With("command", "TYPE", "key", key).With("stack", stack.Trace().TrimRuntime())
+			}
+			if keyType == "stream" {
+				known[key] = rs.group
+			}
+		}
+		if cursor == "0" || len(cursor) == 0 {
+			return known, nil
+		}
+	}
+}
+
+// Exists checks that the stream for a queue is still present
+//
+func (rs *RedisStreams) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
+
+	conn, err := rs.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	keyType, errGo := redis.String(redisDo(ctx, conn, "TYPE", subscription))
+	if errGo != nil {
+		return false, errors.Wrap(errGo).With("command", "TYPE", "stream", subscription).With("stack", stack.Trace().TrimRuntime())
+	}
+	return keyType == "stream", nil
+}
+
+// reclaim takes over the oldest entry that has been pending for longer than the claim period,
+// which will be an entry whose consumer has stopped or that a runner declined
+//
+func (rs *RedisStreams) reclaim(ctx context.Context, conn redis.Conn, stream string) (entry *redisEntry, err errors.Error) {
+
+	pending, errGo := redis.Values(redisDo(ctx, conn, "XPENDING", stream, rs.group, "-", "+", 10))
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("command", "XPENDING", "stream", stream).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	minIdle := int64(rs.claimIdle / time.Millisecond)
+	for _, item := range pending {
+		id, consumer, idle, delivered := "", "", int64(0), int64(0)
+		details, errGo := redis.Values(item, nil)
+		if errGo != nil {
+			continue
+		}
+		if _, errGo = redis.Scan(details, &id, &consumer, &idle, &delivered); errGo != nil {
+			continue
+		}
+		if time.Duration(idle)*time.Millisecond < rs.claimIdle {
+			continue
+		}
+
+		// Other runners might be reclaiming the same entry, the minimum idle time ensures that
+		// only one of them succeeds
+		reply, errGo := redisDo(ctx, conn, "XCLAIM", stream, rs.group, rs.consumer, minIdle, id)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("command", "XCLAIM", "stream", stream, "id", id).With("stack", stack.Trace().TrimRuntime())
+		}
+		entries := redisEntries(reply)
+		if len(entries) == 0 {
+			continue
+		}
+		if len(entries[0].fields) == 0 {
+			// The entry was deleted from the stream while pending so there is nothing to run
+			redisDo(ctx, conn, "XACK", stream, rs.group, id)
+			continue
+		}
+		// Claiming the entry counts as a delivery
+		entries[0].deliveries = uint(delivered) + 1
+		return &entries[0], nil
+	}
+	return nil, nil
+}
+
+// next retrieves the next entry for the runner, entries abandoned by other consumers take
+// precedence over new entries
+//
+func (rs *RedisStreams) next(ctx context.Context, conn redis.Conn, stream string) (entry *redisEntry, err errors.Error) {
+
+	// Create the consumer group starting with the oldest entries in the stream, if the
+	// group already exists this is harmless
+	if _, errGo := redisDo(ctx, conn, "XGROUP", "CREATE", stream, rs.group, "0"); errGo != nil && !strings.Contains(errGo.Error(), "BUSYGROUP") {
+		return nil, errors.Wrap(errGo).With("command", "XGROUP", "stream", stream, "group", rs.group).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if entry, err = rs.reclaim(ctx, conn, stream); entry != nil || err != nil {
+		return entry, err
+	}
+
+	block := redisBlock
+	if deadline, isPresent := ctx.Deadline(); isPresent {
+		if remaining := time.Until(deadline) - time.Second; remaining < block {
+			block = remaining
+		}
+	}
+	if block < time.Millisecond {
+		return nil, nil
+	}
+
+	streams, errGo := redis.Values(redisDo(ctx, conn, "XREADGROUP", "GROUP", rs.group, rs.consumer, "COUNT", 1,
+		"BLOCK", int64(block/time.Millisecond), "STREAMS", stream, ">"))
+	if errGo != nil {
+		if errGo == redis.ErrNil {
+			// Nothing arrived on the stream before the block period ended
+			return nil, nil
+		}
+		return nil, errors.Wrap(errGo).With("command", "XREADGROUP", "stream", stream).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, item := range streams {
+		parts, errGo := redis.Values(item, nil)
+		if errGo != nil || len(parts) != 2 {
+			continue
+		}
+		if entries := redisEntries(parts[1]); len(entries) != 0 {
+			entries[0].deliveries = 1
+			return &entries[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// hold regularly claims an entry for the runner, resetting its idle time, so that it is not
+// reclaimed by other runners while it is being worked on
+//
+func (rs *RedisStreams) hold(ctx context.Context, stream string, id string) {
+
+	refresh := time.NewTicker(rs.claimIdle / 3)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refresh.C:
+			func() {
+				ctx, cancel := context.WithTimeout(ctx, rs.claimIdle/3)
+				defer cancel()
+
+				conn, err := rs.connect(ctx)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				redisDo(ctx, conn, "XCLAIM", stream, rs.group, rs.consumer, 0, id, "JUSTID")
+			}()
+		}
+	}
+}
+
+// release makes an entry that was declined available to be reclaimed by other runners
+// immediately by marking it as having been idle for the claim period
+//
+func (rs *RedisStreams) release(ctx context.Context, conn redis.Conn, stream string, id string) (err errors.Error) {
+	if _, errGo := redisDo(ctx, conn, "XCLAIM", stream, rs.group, rs.consumer, 0, id,
+		"IDLE", int64(rs.claimIdle/time.Millisecond), "JUSTID"); errGo != nil {
+		return errors.Wrap(errGo).With("command", "XCLAIM", "stream", stream, "id", id).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
+// Work will retrieve a single request from the stream, present it to the handler for
+// processing, and then acknowledge it if the handler accepted it.  Requests that were
+// not accepted are left pending to be reclaimed by another runner.
+//
+func (rs *RedisStreams) Work(ctx context.Context, qt *QueueTask) (msgCnt uint64, resource *Resource, err errors.Error) {
+
+	conn, err := rs.connect(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	entry, err := rs.next(ctx, conn, qt.Subscription)
+	if err != nil || entry == nil {
+		return 0, nil, err
+	}
+
+	msg, isPresent := entry.fields[redisMsgField]
+	if !isPresent {
+		// Entries without a request can never be run so they are removed from the group
+		redisDo(ctx, conn, "XACK", qt.Subscription, rs.group, entry.id)
+		return 1, nil, errors.New("redis stream entry has no msg field").With("stream", qt.Subscription, "id", entry.id).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	qt.Msg = []byte(msg)
+	qt.Deliveries = entry.deliveries
+	qt.Attributes = map[string]string{}
+	for name, value := range entry.fields {
+		if name != redisMsgField {
+			qt.Attributes[name] = value
+		}
+	}
+
+	// The handler can run for much longer than the context used to retrieve the
+	// entry, so use fresh contexts for the work that follows
+	holdCtx, stopHold := context.WithCancel(context.Background())
+	go rs.hold(holdCtx, qt.Subscription, entry.id)
+
+	rsc, ack := qt.Handler(ctx, qt)
+	stopHold()
+
+	settleCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// The connection used to retrieve the entry could have been idle longer than the
+	// server allows so settle the entry using a new connection
+	settle, err := rs.connect(settleCtx)
+	if err != nil {
+		return 1, rsc, err
+	}
+	defer settle.Close()
+
+	if !ack {
+		return 1, rsc, rs.release(settleCtx, settle, qt.Subscription, entry.id)
+	}
+
+	if _, errGo := redisDo(settleCtx, settle, "XACK", qt.Subscription, rs.group, entry.id); errGo != nil {
+		return 1, rsc, errors.Wrap(errGo).With("command", "XACK", "stream", qt.Subscription, "id", entry.id).With("stack", stack.Trace().TrimRuntime())
+	}
+	return 1, rsc, nil
+}
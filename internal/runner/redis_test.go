@@ -0,0 +1,213 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis implements enough of the redis stream commands, for a single stream and consumer
+// group, to exercise the runners stream handling
+//
+type fakeRedis struct {
+	stream    string
+	entries   [][2]string          // id and msg field for each entry
+	delivered int                  // entries delivered to the group
+	pending   map[string]time.Time // entries delivered but not acknowledged, and when they were last claimed
+	sync.Mutex
+}
+
+func (fr *fakeRedis) serve(listener net.Listener) {
+	for {
+		conn, errGo := listener.Accept()
+		if errGo != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				args, errGo := readCommand(reader)
+				if errGo != nil {
+					return
+				}
+				fr.Lock()
+				reply := fr.reply(args)
+				fr.Unlock()
+				if _, errGo = conn.Write([]byte(reply)); errGo != nil {
+					return
+				}
+			}
+		}(conn)
+	}
+}
+
+// readCommand decodes a command sent by a client, which is an array of bulk strings
+//
+func readCommand(reader *bufio.Reader) (args []string, errGo error) {
+	line, errGo := reader.ReadString('\n')
+	if errGo != nil {
+		return nil, errGo
+	}
+	count, errGo := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(line), "*"))
+	if errGo != nil {
+		return nil, errGo
+	}
+	for i := 0; i != count; i++ {
+		if line, errGo = reader.ReadString('\n'); errGo != nil {
+			return nil, errGo
+		}
+		size, errGo := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(line), "$"))
+		if errGo != nil {
+			return nil, errGo
+		}
+		arg := make([]byte, size+2)
+		if _, errGo = io.ReadFull(reader, arg); errGo != nil {
+			return nil, errGo
+		}
+		args = append(args, string(arg[:size]))
+	}
+	return args, nil
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func (fr *fakeRedis) entry(id string) string {
+	for _, entry := range fr.entries {
+		if entry[0] == id {
+			return "*2\r\n" + bulk(entry[0]) + "*2\r\n" + bulk(redisMsgField) + bulk(entry[1])
+		}
+	}
+	return ""
+}
+
+func (fr *fakeRedis) reply(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "SCAN":
+		return "*2\r\n" + bulk("0") + "*2\r\n" + bulk(fr.stream) + bulk("other")
+	case "TYPE":
+		switch args[1] {
+		case fr.stream:
+			return "+stream\r\n"
+		case "other":
+			return "+string\r\n"
+		}
+		return "+none\r\n"
+	case "XGROUP":
+		return "+OK\r\n"
+	case "XREADGROUP":
+		if fr.delivered == len(fr.entries) {
+			return "*-1\r\n"
+		}
+		id := fr.entries[fr.delivered][0]
+		fr.delivered++
+		fr.pending[id] = time.Now()
+		return "*1\r\n*2\r\n" + bulk(fr.stream) + "*1\r\n" + fr.entry(id)
+	case "XACK":
+		delete(fr.pending, args[3])
+		return ":1\r\n"
+	case "XPENDING":
+		reply := ""
+		for id, claimed := range fr.pending {
+			reply += "*4\r\n" + bulk(id) + bulk("consumer") + fmt.Sprintf(":%d\r\n:1\r\n", time.Since(claimed)/time.Millisecond)
+		}
+		return fmt.Sprintf("*%d\r\n", len(fr.pending)) + reply
+	case "XCLAIM":
+		id := args[5]
+		claimed, isPending := fr.pending[id]
+		minIdle, _ := strconv.Atoi(args[4])
+		if !isPending || time.Since(claimed) < time.Duration(minIdle)*time.Millisecond {
+			return "*0\r\n"
+		}
+		fr.pending[id] = time.Now()
+		for i, arg := range args {
+			if arg == "IDLE" {
+				idle, _ := strconv.Atoi(args[i+1])
+				fr.pending[id] = time.Now().Add(-time.Duration(idle) * time.Millisecond)
+			}
+		}
+		if args[len(args)-1] == "JUSTID" {
+			return "*1\r\n" + bulk(id)
+		}
+		return "*1\r\n" + fr.entry(id)
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// TestRedisStreams checks that requests are read from matching streams, acknowledged when
+// the handler accepts them, and redelivered when the handler declines them
+//
+func TestRedisStreams(t *testing.T) {
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer listener.Close()
+
+	fake := &fakeRedis{
+		stream:  "rmq_redis",
+		entries: [][2]string{{"1-0", "first"}, {"2-0", "second"}},
+		pending: map[string]time.Time{},
+	}
+	go fake.serve(listener)
+
+	tq, err := NewTaskQueue("redis://"+listener.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	known, err := tq.Refresh(ctx, regexp.MustCompile("^rmq_.*$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isPresent := known[fake.stream]; !isPresent || len(known) != 1 {
+		t.Fatalf("unexpected streams found %v", known)
+	}
+
+	if exists, err := tq.Exists(ctx, "other"); err != nil || exists {
+		t.Fatalf("a key that is not a stream was treated as a queue, %v", err)
+	}
+
+	for _, expected := range []struct {
+		msg string
+		ack bool
+	}{
+		{msg: "first", ack: true},
+		{msg: "second", ack: false},
+		// A declined request is reclaimed and delivered again
+		{msg: "second", ack: true},
+	} {
+		qt := &QueueTask{
+			Subscription: fake.stream,
+			Handler: func(ctx context.Context, qt *QueueTask) (resource *Resource, ack bool) {
+				if string(qt.Msg) != expected.msg {
+					t.Fatalf("unexpected request %s, expected %s", string(qt.Msg), expected.msg)
+				}
+				return nil, expected.ack
+			},
+		}
+		if msgs, _, err := tq.Work(ctx, qt); err != nil || msgs != 1 {
+			t.Fatalf("request %s not processed, %v", expected.msg, err)
+		}
+	}
+
+	fake.Lock()
+	defer fake.Unlock()
+	if len(fake.pending) != 0 {
+		t.Fatalf("requests left unacknowledged %v", fake.pending)
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 
@@ -28,6 +31,25 @@ type Resource struct {
 	Hdd    string `json:"hdd"`
 	Ram    string `json:"ram"`
 	GpuMem string `json:"gpuMem"`
+	Shm    string `json:"shm,omitempty"` // Optional shared memory, this is provided using RAM
+
+	// MinCpus and MinRam are the optional smallest cores and RAM an experiment can run with, when
+	// used Cpus and Ram are the preferred amounts and experiments are given as much as is free
+	MinCpus uint   `json:"minCpus,omitempty"`
+	MinRam  string `json:"minRam,omitempty"`
+
+	// GpuShare is used by experiments willing to share a GPU with other experiments, gpuMem is
+	// then reserved within a single GPU rather than whole boards being allocated
+	GpuShare bool `json:"gpuShare,omitempty"`
+
+	// Cuda and Cudnn are the optional minimum versions of the CUDA toolkit, and cuDNN library
+	// an experiment needs, when used as a capacity they are the versions installed
+	Cuda  string `json:"cuda,omitempty"`
+	Cudnn string `json:"cudnn,omitempty"`
+
+	// NodeSelector holds the optional labels a node must advertise for the experiment to be run
+	// on it, when used as a capacity they are the labels of the node
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
 }
 
 // Fit determines is a supplied resource description acting as a request can
@@ -39,6 +61,12 @@ func (l *Resource) Fit(r *Resource) (didFit bool, err errors.Error) {
 	if errGo != nil {
 		return false, errors.New("left side RAM could not be parsed").With("stack", stack.Trace().TrimRuntime())
 	}
+	// Requests with a range fit when their minimum does
+	if len(l.MinRam) != 0 {
+		if lRam, errGo = humanize.ParseBytes(l.MinRam); errGo != nil {
+			return false, errors.New("left side minRam could not be parsed").With("stack", stack.Trace().TrimRuntime())
+		}
+	}
 
 	rRam, errGo := humanize.ParseBytes(r.Ram)
 	if errGo != nil {
@@ -71,7 +99,27 @@ func (l *Resource) Fit(r *Resource) (didFit bool, err errors.Error) {
 		}
 	}
 
-	return l.Cpus <= r.Cpus && l.Gpus <= r.Gpus && lHdd <= rHdd && lRam <= rRam && lGpuMem <= rGpuMem, nil
+	// Shared memory is held in RAM and so is added to the RAM requested
+	lShm, err := ShmSize(l)
+	if err != nil {
+		return false, err
+	}
+
+	// Experiments sharing a GPU are packed using memory alone and do not consume GPU slots
+	gpuFit := l.GpuShare || l.Gpus <= r.Gpus
+
+	// Experiments that need a CUDA runtime should not be started where it is missing or too old
+	cudaFit := VersionAtLeast(r.Cuda, l.Cuda) && VersionAtLeast(r.Cudnn, l.Cudnn)
+
+	// Experiments asking for specific hardware are only started on nodes labelled as having it
+	labelFit := SelectorMatch(l.NodeSelector, r.NodeSelector)
+
+	lCpus := l.Cpus
+	if l.MinCpus != 0 && l.MinCpus < lCpus {
+		lCpus = l.MinCpus
+	}
+
+	return lCpus <= r.Cpus && gpuFit && cudaFit && labelFit && lHdd <= rHdd && lRam+lShm <= rRam && lGpuMem <= rGpuMem, nil
 }
 
 // Clone will deep copy a resource and return the copy
@@ -104,10 +152,13 @@ type Config struct {
 	Env                    map[string]string `json:"env"`
 	Pip                    []string          `json:"pip"`
 	Runner                 RunnerCustom      `json:"runner"`
+	CallbackURL            string            `json:"callbackURL,omitempty"` // Optional URL the completion of the experiment is POSTed to
+	Notify                 Notify            `json:"notify,omitempty"`      // Optional destinations notified when the experiment has finished
 }
 
 // RunnerCustom defines a custom type of resource used by the go runner to implement a slack
-// notification mechanism
+// notification mechanism, the slack destination is now carried alongside the other
+// notification destinations in Config.Notify and this field is kept for older clients
 //
 type RunnerCustom struct {
 	SlackDest string `json:"slack_destination"`
@@ -136,14 +187,49 @@ type Experiment struct {
 	Metric             interface{}         `json:"metric"`
 	Project            interface{}         `json:"project"`
 	Pythonenv          []string            `json:"pythonenv"`
-	PythonVer          int64               `json:"pythonver"`
+	PythonVer          json.Number         `json:"pythonver"`
 	Resource           Resource            `json:"resources_needed"`
 	Status             string              `json:"status"`
 	TimeAdded          float64             `json:"time_added"`
 	MaxDuration        string              `json:"max_duration"`
+	SetupTimeout       string              `json:"setup_timeout,omitempty"` // Optional limit on building the python environment
+	RunTimeout         string              `json:"run_timeout,omitempty"`   // Optional limit on running the experiment once its environment is built
 	TimeFinished       interface{}         `json:"time_finished"`
 	TimeLastCheckpoint interface{}         `json:"time_last_checkpoint"`
 	TimeStarted        interface{}         `json:"time_started"`
+	Dependencies       *Dependencies       `json:"dependencies,omitempty"`
+	Metadata           map[string]string   `json:"metadata,omitempty"`    // Custom attribution details passed through to telemetry and result events
+	MaxRetries         *int                `json:"max_retries,omitempty"` // Optional number of retries after failures of the experiment itself, overriding the runners policy
+	Affinity           *Affinity           `json:"affinity,omitempty"`    // Optional hint naming the nodes preferred for running the experiment
+	Checkpoint         *Checkpoint         `json:"checkpoint,omitempty"`  // Optional directory of checkpoints returned using the checkpoint artifact
+	Network            string              `json:"network,omitempty"`     // Optionally 'none' when the experiment does not use the network once its environment is built
+}
+
+// Affinity names the nodes preferred for running an experiment, typically because they already
+// hold its inputs in their artifact cache.  Other nodes leave the experiment for the preferred
+// nodes for a limited period before running it themselves.
+//
+type Affinity struct {
+	Hosts   []string `json:"hosts"`             // The host names, or cloud instance IDs, of the preferred nodes
+	MaxWait string   `json:"maxWait,omitempty"` // The period after the experiment was added that other nodes leave it for the preferred nodes
+}
+
+// Checkpoint names the directory, relative to the workspace, that an experiment writes its
+// checkpoints into.  New checkpoints are uploaded to the checkpoint artifact as they appear
+// and the latest are restored into the directory when the experiment is run again.
+//
+type Checkpoint struct {
+	Dir  string `json:"dir"`            // The checkpoint directory relative to the workspace
+	Keep int    `json:"keep,omitempty"` // The number of the most recent checkpoints kept, defaults to 1
+}
+
+// Dependencies lists the experiments that must complete successfully before an experiment
+// can be started
+//
+type Dependencies struct {
+	Keys      []string `json:"keys"`                // The keys of the prerequisite experiments
+	StatusURL string   `json:"statusURL,omitempty"` // A URL returning the status of an experiment as JSON, {key} is replaced with the experiment key
+	MaxWait   string   `json:"maxWait,omitempty"`   // The period after the experiment was added that it will wait for its prerequisites
 }
 
 // Request marshalls the requests made by studioML under which all of the other
@@ -151,6 +237,8 @@ type Experiment struct {
 type Request struct {
 	Config     Config     `json:"config"`
 	Experiment Experiment `json:"experiment"`
+
+	shape string // The layout the client used for the request, see requestshape.go
 }
 
 // Info is a marshalled item from the studioML experiment definition that
@@ -169,20 +257,138 @@ type Artifact struct {
 	Mutable   bool   `json:"mutable"`
 	Unpack    bool   `json:"unpack"`
 	Qualified string `json:"qualified"`
+	Version   string `json:"version,omitempty"`  // Optional object version, an S3 versionId or a GCS generation
+	Optional  bool   `json:"optional,omitempty"` // The experiment can run without the artifact should its download fail
+	Retries   *int   `json:"retries,omitempty"`  // Optional number of times a failed download is retried, overriding the runner default
+	Timeout   string `json:"timeout,omitempty"`  // Optional maximum duration of each download attempt, overriding the runner default
+	Resolved  string `json:"-"`                  // The ETag, or hash, of the object that was downloaded, set once the artifact has been fetched
 }
 
 // UnmarshalRequest takes an encoded StudioML request and extracts it
-// into go data structures used by the go runner
+// into go data structures used by the go runner.  The different layouts used
+// by StudioML clients are recognized, the layout found is returned by r.Shape()
 //
 func UnmarshalRequest(data []byte) (r *Request, err errors.Error) {
-	r = &Request{}
-	errGo := json.Unmarshal(data, r)
+	r, errGo := decodeRequest(data)
 	if errGo != nil {
+		if !json.Valid(data) {
+			return nil, errors.Wrap(errGo, corruptMessage+", "+diagnoseBody(data)).With("stack", stack.Trace().TrimRuntime())
+		}
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 	return r, nil
 }
 
+// Validate checks the request for values that would prevent the experiment from being run.  Values
+// that have a number of valid encodings are converted to the form the runner uses.
+//
+func (r *Request) Validate() (err errors.Error) {
+	ver, err := ValidatePythonVer(r.Experiment.PythonVer.String())
+	if err != nil {
+		return err.With("experiment_id", r.Experiment.Key)
+	}
+	r.Experiment.PythonVer = json.Number(ver)
+
+	if len(r.Config.CallbackURL) != 0 {
+		callback, errGo := url.Parse(r.Config.CallbackURL)
+		if errGo != nil {
+			return errors.Wrap(errGo, "callbackURL is invalid").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+		if callback.Scheme != "http" && callback.Scheme != "https" {
+			return errors.New("callbackURL must be an http or https URL").With("experiment_id", r.Experiment.Key, "callbackURL", r.Config.CallbackURL).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	if err = validateNotify(r); err != nil {
+		return err
+	}
+
+	if _, err = parsePhaseTimeouts(r, nil); err != nil {
+		return err
+	}
+
+	for group, art := range r.Experiment.Artifacts {
+		if _, err = art.Policy(); err != nil {
+			return err.With("experiment_id", r.Experiment.Key, "group", group)
+		}
+	}
+
+	if err = validateMetadata(r.Experiment.Metadata); err != nil {
+		return err.With("experiment_id", r.Experiment.Key)
+	}
+
+	if r.Experiment.MaxRetries != nil && *r.Experiment.MaxRetries < 0 {
+		return errors.New("max_retries must not be negative").With("experiment_id", r.Experiment.Key, "max_retries", *r.Experiment.MaxRetries).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if deps := r.Experiment.Dependencies; deps != nil {
+		if len(deps.MaxWait) != 0 {
+			if _, errGo := time.ParseDuration(deps.MaxWait); errGo != nil {
+				return errors.Wrap(errGo, "dependencies maxWait is invalid").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		if len(deps.StatusURL) != 0 {
+			if status, errGo := url.Parse(deps.StatusURL); errGo != nil || (status.Scheme != "http" && status.Scheme != "https") {
+				return errors.New("dependencies statusURL must be an http or https URL").With("experiment_id", r.Experiment.Key, "statusURL", deps.StatusURL).
+					With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+	}
+
+	if affinity := r.Experiment.Affinity; affinity != nil && len(affinity.MaxWait) != 0 {
+		if _, errGo := time.ParseDuration(affinity.MaxWait); errGo != nil {
+			return errors.Wrap(errGo, "affinity maxWait is invalid").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	if err = validateCheckpoint(r); err != nil {
+		return err
+	}
+
+	if err = validateNetwork(r); err != nil {
+		return err
+	}
+
+	if rsc := r.Experiment.Resource; rsc.MinCpus > rsc.Cpus {
+		return errors.New("minCpus must not be greater than cpus").With("experiment_id", r.Experiment.Key, "minCpus", rsc.MinCpus, "cpus", rsc.Cpus).
+			With("stack", stack.Trace().TrimRuntime())
+	}
+	if rsc := r.Experiment.Resource; len(rsc.MinRam) != 0 {
+		minRam, errGo := humanize.ParseBytes(rsc.MinRam)
+		if errGo != nil {
+			return errors.Wrap(errGo, "minRam is invalid").With("experiment_id", r.Experiment.Key, "minRam", rsc.MinRam).With("stack", stack.Trace().TrimRuntime())
+		}
+		if ram, errGo := humanize.ParseBytes(rsc.Ram); errGo == nil && minRam > ram {
+			return errors.New("minRam must not be greater than ram").With("experiment_id", r.Experiment.Key, "minRam", rsc.MinRam, "ram", rsc.Ram).
+				With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	for name, version := range map[string]string{"cuda": r.Experiment.Resource.Cuda, "cudnn": r.Experiment.Resource.Cudnn} {
+		if len(version) != 0 && !versionRE.MatchString(version) {
+			return errors.New(name+" must be a dotted version number").With("experiment_id", r.Experiment.Key, name, version).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	for key := range r.Experiment.Resource.NodeSelector {
+		if len(strings.TrimSpace(key)) == 0 {
+			return errors.New("nodeSelector labels must have a key").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	for group, art := range r.Experiment.Artifacts {
+		if err = CheckArtifactAllowed(&art); err != nil {
+			return err.With("experiment_id", r.Experiment.Key, "group", group)
+		}
+	}
+
+	if r.Experiment.Resource.GpuShare && len(r.Experiment.Resource.GpuMem) == 0 {
+		return errors.New("gpuShare requires gpuMem to be specified").With("experiment_id", r.Experiment.Key).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
+
 // Marshal takes the go data structure used to define a StudioML experiment
 // request and serializes it as json to the byte array
 //
@@ -0,0 +1,127 @@
+package runner
+
+// This file contains the implementation of recognizing the different ways StudioML clients
+// have laid out their requests.  Most clients send the experiment and its configuration as
+// two top level keys, however some versions send the experiment at the root of the
+// document, nest the configuration within the experiment, or wrap the whole request within
+// an envelope key.  Each of these is normalized into the Request used by the runner rather
+// than yielding an empty experiment that fails in a confusing way later.
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	RequestShapeStandard     = "standard"      // {"config": {...}, "experiment": {...}}
+	RequestShapeNestedConfig = "nested-config" // {"experiment": {..., "config": {...}}}
+	RequestShapeRoot         = "root"          // {"key": ..., "filename": ..., "config": {...}}, the experiment at the root
+	RequestShapeUnrecognized = "unrecognized"  // No experiment could be found, the request is decoded as a standard request
+)
+
+var (
+	// requestEnvelopes are the keys some clients wrap the whole of their request within
+	requestEnvelopes = []string{"request", "payload", "data", "message"}
+)
+
+// Shape returns how the request was laid out by the client that sent it, for requests that
+// were wrapped within an envelope the name of the envelope key is included
+//
+func (r *Request) Shape() (shape string) {
+	return r.shape
+}
+
+// decodeRequest decodes a request using the layout it is detected to have
+//
+func decodeRequest(data []byte) (r *Request, errGo error) {
+	doc := map[string]json.RawMessage{}
+	if errGo = json.Unmarshal(data, &doc); errGo != nil {
+		return nil, errGo
+	}
+
+	// Envelopes are only recognized when they are the only key and hold a request
+	if len(doc) == 1 {
+		for _, envelope := range requestEnvelopes {
+			inner, isPresent := doc[envelope]
+			if !isPresent || !isRequestDoc(inner) {
+				continue
+			}
+			if r, errGo = decodeRequest(inner); errGo != nil {
+				return nil, errGo
+			}
+			r.shape = envelope + "/" + r.shape
+			return r, nil
+		}
+	}
+
+	r = &Request{}
+
+	if experiment, isPresent := doc["experiment"]; isPresent && !isNull(experiment) {
+		if errGo = json.Unmarshal(data, r); errGo != nil {
+			return nil, errGo
+		}
+		r.shape = RequestShapeStandard
+
+		if config, isPresent := doc["config"]; !isPresent || isNull(config) {
+			nested := map[string]json.RawMessage{}
+			if errGo = json.Unmarshal(experiment, &nested); errGo != nil {
+				return nil, errGo
+			}
+			if config, isPresent := nested["config"]; isPresent && !isNull(config) {
+				if errGo = json.Unmarshal(config, &r.Config); errGo != nil {
+					return nil, errGo
+				}
+				r.shape = RequestShapeNestedConfig
+			}
+		}
+		return r, nil
+	}
+
+	if isExperimentDoc(doc) {
+		if errGo = json.Unmarshal(data, &r.Experiment); errGo != nil {
+			return nil, errGo
+		}
+		if config, isPresent := doc["config"]; isPresent && !isNull(config) {
+			if errGo = json.Unmarshal(config, &r.Config); errGo != nil {
+				return nil, errGo
+			}
+		}
+		r.shape = RequestShapeRoot
+		return r, nil
+	}
+
+	if errGo = json.Unmarshal(data, r); errGo != nil {
+		return nil, errGo
+	}
+	r.shape = RequestShapeUnrecognized
+	return r, nil
+}
+
+// isExperimentDoc tests if a document is an experiment, experiments always have a key along
+// with the script they run or the artifacts they use
+//
+func isExperimentDoc(doc map[string]json.RawMessage) (isExperiment bool) {
+	if _, isPresent := doc["key"]; !isPresent {
+		return false
+	}
+	_, hasFilename := doc["filename"]
+	_, hasArtifacts := doc["artifacts"]
+	return hasFilename || hasArtifacts
+}
+
+// isRequestDoc tests if a value is an object holding a request in any of the recognized layouts
+//
+func isRequestDoc(value json.RawMessage) (isRequest bool) {
+	doc := map[string]json.RawMessage{}
+	if errGo := json.Unmarshal(value, &doc); errGo != nil {
+		return false
+	}
+	if experiment, isPresent := doc["experiment"]; isPresent && !isNull(experiment) {
+		return true
+	}
+	return isExperimentDoc(doc)
+}
+
+func isNull(value json.RawMessage) (null bool) {
+	return strings.TrimSpace(string(value)) == "null"
+}
@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestRequestShapes checks that requests laid out in each of the ways StudioML clients have
+// used are decoded into the same experiment and configuration
+//
+func TestRequestShapes(t *testing.T) {
+
+	for fixture, shape := range map[string]string{
+		"standard.json":      RequestShapeStandard,
+		"nested-config.json": RequestShapeNestedConfig,
+		"root.json":          RequestShapeRoot,
+		"envelope.json":      "request/" + RequestShapeStandard,
+	} {
+		data, errGo := ioutil.ReadFile(filepath.Join("testdata", "requests", fixture))
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		r, err := UnmarshalRequest(data)
+		if err != nil {
+			t.Fatalf("%s could not be decoded %v", fixture, err)
+		}
+		if r.Shape() != shape {
+			t.Fatalf("%s detected as %s, expected %s", fixture, r.Shape(), shape)
+		}
+		if r.Experiment.Key != "fixture" || r.Experiment.Filename != "train.py" || len(r.Experiment.Artifacts) != 2 {
+			t.Fatalf("%s experiment decoded incorrectly %+v", fixture, r.Experiment)
+		}
+		if r.Config.Database.ProjectId != "fixture-project" || r.Config.Lifetime != "30m" || r.Config.Env["AWS_DEFAULT_REGION"] != "us-west-2" {
+			t.Fatalf("%s config decoded incorrectly %+v", fixture, r.Config)
+		}
+		if err = r.Validate(); err != nil {
+			t.Fatalf("%s failed validation %v", fixture, err)
+		}
+	}
+
+	r, err := UnmarshalRequest([]byte(`{"studioml": {"key": "fixture"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Shape() != RequestShapeUnrecognized || len(r.Experiment.Key) != 0 {
+		t.Fatalf("request without an experiment detected as %s", r.Shape())
+	}
+
+	if _, err = UnmarshalRequest([]byte(`{"experiment": {"key": `)); !IsCorruptMessage(err) {
+		t.Fatalf("truncated request not reported as corrupt %v", err)
+	}
+}
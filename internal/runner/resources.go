@@ -5,6 +5,9 @@ package runner
 // behalf of an application
 
 import (
+	"sort"
+	"sync"
+
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
 )
@@ -26,26 +29,40 @@ type DiskAllocated struct {
 // tasks
 //
 type Allocated struct {
-	GPU  GPUAllocations
-	CPU  *CPUAllocated
-	Disk *DiskAllocated
+	Owner string
+	GPU   GPUAllocations
+	CPU   *CPUAllocated
+	Disk  *DiskAllocated
 }
 
 // AllocRequest is used by clients to make requests for specific types of machine resources
 //
 type AllocRequest struct {
+	MinCPU        uint // Optional smallest number of cores that can be accepted, less than MaxCPU for a range
 	MaxCPU        uint
+	MinMem        uint64 // Optional smallest amount of memory that can be accepted, less than MaxMem for a range
 	MaxMem        uint64
 	MaxGPU        uint   // GPUs are allocated using slots which approximate their throughput
 	GPUDivisibles []uint // The small quantity of slots that are permitted for allocation for when multiple cards must be used
 	MaxGPUMem     uint64
+	GPUPack       bool // Reserve MaxGPUMem within a single GPU that can be shared with other packed allocations
 	MaxDisk       uint64
+	Owner         string // Optional identifier for the consumer of the resources used when reporting
 }
 
 // Receiver for resource related methods
 //
 type Resources struct{}
 
+var (
+	// allocLock serializes allocations and releases across all of the resource trackers
+	// so that a consistent view of them can be obtained
+	allocLock = sync.Mutex{}
+
+	// liveAllocs contains all allocations that have not yet been released
+	liveAllocs = map[*Allocated]struct{}{}
+)
+
 // NewResources is used to get a receiver for dealing with the
 // resources being tracked by the studioml runner
 //
@@ -67,25 +84,43 @@ func NewResources(localDisk string) (rsc *Resources, err errors.Error) {
 //
 func (*Resources) AllocResources(rqst AllocRequest) (alloc *Allocated, err errors.Error) {
 
-	alloc = &Allocated{}
+	allocLock.Lock()
+	defer allocLock.Unlock()
+
+	alloc = &Allocated{
+		Owner: rqst.Owner,
+	}
 
 	// Allocate the GPU resources first, they are typically the least available
-	if alloc.GPU, err = AllocGPU(rqst.MaxGPU, rqst.MaxGPUMem, rqst.GPUDivisibles); err != nil {
+	if rqst.GPUPack {
+		if alloc.GPU, err = PackGPU(rqst.MaxGPUMem); err != nil {
+			return nil, err
+		}
+	} else if alloc.GPU, err = AllocGPU(rqst.MaxGPU, rqst.MaxGPUMem, rqst.GPUDivisibles); err != nil {
 		return nil, err
 	}
 
 	// CPU resources next
-	if alloc.CPU, err = AllocCPU(rqst.MaxCPU, rqst.MaxMem); err != nil {
-		alloc.Release()
+	minCPU, minMem := rqst.MinCPU, rqst.MinMem
+	if minCPU == 0 {
+		minCPU = rqst.MaxCPU
+	}
+	if minMem == 0 {
+		minMem = rqst.MaxMem
+	}
+	if alloc.CPU, err = AllocCPURange(minCPU, rqst.MaxCPU, minMem, rqst.MaxMem); err != nil {
+		alloc.release()
 		return nil, err
 	}
 
 	// Lastly, disk storage
 	if alloc.Disk, err = AllocDisk(rqst.MaxDisk); err != nil {
-		alloc.Release()
+		alloc.release()
 		return nil, err
 	}
 
+	liveAllocs[alloc] = struct{}{}
+
 	return alloc, nil
 }
 
@@ -93,12 +128,22 @@ func (*Resources) AllocResources(rqst AllocRequest) (alloc *Allocated, err error
 //
 func (a *Allocated) Release() (errs []errors.Error) {
 
-	errs = []errors.Error{}
-
 	if a == nil {
 		return []errors.Error{errors.New("unexpected nil supplied for the release of resources").With("stack", stack.Trace().TrimRuntime())}
 	}
 
+	allocLock.Lock()
+	defer allocLock.Unlock()
+
+	delete(liveAllocs, a)
+
+	return a.release()
+}
+
+func (a *Allocated) release() (errs []errors.Error) {
+
+	errs = []errors.Error{}
+
 	for _, gpuAlloc := range a.GPU {
 		if e := ReturnGPU(gpuAlloc); e != nil {
 			errs = append(errs, e)
@@ -117,3 +162,107 @@ func (a *Allocated) Release() (errs []errors.Error) {
 
 	return errs
 }
+
+// ResourceAmounts contains quantities for each of the dimensions of resources being tracked
+//
+type ResourceAmounts struct {
+	Cpus uint   `json:"cpus"`
+	Ram  uint64 `json:"ram"`
+	Gpus uint   `json:"gpus"`
+	Disk uint64 `json:"disk"`
+}
+
+// AllocationSnapshot describes the resources held by a single consumer
+//
+type AllocationSnapshot struct {
+	Owner      string          `json:"owner"`
+	Amounts    ResourceAmounts `json:"amounts"`
+	GPUDevices []string        `json:"gpu_devices"`
+}
+
+// ResourceSnapshot is a consistent view of the capacity, allocations, and free resources
+// across all of the resource trackers
+//
+type ResourceSnapshot struct {
+	Capacity    ResourceAmounts      `json:"capacity"`
+	Allocated   ResourceAmounts      `json:"allocated"`
+	Free        ResourceAmounts      `json:"free"`
+	Allocations []AllocationSnapshot `json:"allocations"`
+}
+
+// remaining subtracts used from total stopping at zero
+//
+func remaining(total uint, used uint) (left uint) {
+	if used >= total {
+		return 0
+	}
+	return total - used
+}
+
+// remaining64 subtracts used from total stopping at zero
+//
+func remaining64(total uint64, used uint64) (left uint64) {
+	if used >= total {
+		return 0
+	}
+	return total - used
+}
+
+// SnapshotResources returns the state of the resource trackers.  Allocations and releases
+// are blocked while the snapshot is taken so the values across the trackers agree
+// with each other.
+//
+func SnapshotResources() (snap *ResourceSnapshot) {
+
+	allocLock.Lock()
+	defer allocLock.Unlock()
+
+	snap = &ResourceSnapshot{
+		Allocations: make([]AllocationSnapshot, 0, len(liveAllocs)),
+	}
+
+	cpuTrack.Lock()
+	snap.Capacity.Cpus = cpuTrack.SoftMaxCores
+	snap.Capacity.Ram = cpuTrack.SoftMaxMem
+	snap.Allocated.Cpus = cpuTrack.AllocCores
+	snap.Allocated.Ram = cpuTrack.AllocMem
+	cpuTrack.Unlock()
+
+	snap.Capacity.Gpus, snap.Free.Gpus = GPUSlots()
+	snap.Allocated.Gpus = remaining(snap.Capacity.Gpus, snap.Free.Gpus)
+
+	snap.Free.Disk = GetDiskFree()
+	diskTrack.Lock()
+	snap.Allocated.Disk = diskTrack.AllocSpace
+	diskTrack.Unlock()
+	snap.Capacity.Disk = snap.Free.Disk + snap.Allocated.Disk
+
+	// The soft limits can be lowered below what is already allocated
+	snap.Free.Cpus = remaining(snap.Capacity.Cpus, snap.Allocated.Cpus)
+	snap.Free.Ram = remaining64(snap.Capacity.Ram, snap.Allocated.Ram)
+
+	for alloc := range liveAllocs {
+		item := AllocationSnapshot{
+			Owner:      alloc.Owner,
+			GPUDevices: []string{},
+		}
+		if alloc.CPU != nil {
+			item.Amounts.Cpus = alloc.CPU.cores
+			item.Amounts.Ram = alloc.CPU.mem
+		}
+		if alloc.Disk != nil {
+			item.Amounts.Disk = alloc.Disk.size
+		}
+		for _, gpu := range alloc.GPU {
+			item.Amounts.Gpus += gpu.slots
+			item.GPUDevices = append(item.GPUDevices, gpu.uuid)
+		}
+		snap.Allocations = append(snap.Allocations, item)
+	}
+
+	sort.Slice(snap.Allocations, func(i, j int) bool {
+		return snap.Allocations[i].Owner < snap.Allocations[j].Owner
+	})
+
+	return snap
+}
@@ -0,0 +1,30 @@
+package runner
+
+import (
+	"testing"
+)
+
+// TestSnapshotResourcesOvercommit checks that lowering the soft limits below what has already
+// been allocated reports nothing free rather than wrapping around
+//
+func TestSnapshotResourcesOvercommit(t *testing.T) {
+
+	cpuTrack.Lock()
+	softMaxCores, softMaxMem, allocCores, allocMem := cpuTrack.SoftMaxCores, cpuTrack.SoftMaxMem, cpuTrack.AllocCores, cpuTrack.AllocMem
+	cpuTrack.SoftMaxCores, cpuTrack.SoftMaxMem, cpuTrack.AllocCores, cpuTrack.AllocMem = 2, 1024, 4, 4096
+	cpuTrack.Unlock()
+
+	defer func() {
+		cpuTrack.Lock()
+		cpuTrack.SoftMaxCores, cpuTrack.SoftMaxMem, cpuTrack.AllocCores, cpuTrack.AllocMem = softMaxCores, softMaxMem, allocCores, allocMem
+		cpuTrack.Unlock()
+	}()
+
+	snap := SnapshotResources()
+	if snap.Free.Cpus != 0 || snap.Free.Ram != 0 {
+		t.Fatalf("overcommitted resources reported as free %+v", snap.Free)
+	}
+	if snap.Allocated.Cpus != 4 || snap.Allocated.Ram != 4096 {
+		t.Fatalf("unexpected allocations %+v", snap.Allocated)
+	}
+}
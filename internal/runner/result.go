@@ -0,0 +1,63 @@
+package runner
+
+// This file contains the implementation of the result line written as the last line of the
+// output of every experiment.  The line is written by the runner, rather than the script,
+// once all other output has been written so that it is present even when the experiment
+// was killed because of a timeout or cancellation, and tooling can find the final status
+// of the experiment without having to guess from the output of the experiment itself.  The
+// same result is returned to the runner for inclusion in the completion event of the
+// experiment.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"github.com/karlmutch/errors"
+)
+
+const (
+	ResultMarker = "STUDIOML_RESULT" // Prefixes the result line within the output of an experiment
+
+	ResultSuccess   = "success"   // The experiment exited with a zero exit code
+	ResultFailed    = "failed"    // The experiment exited with an error, or was stopped by the runner for a reason other than a timeout
+	ResultTimeout   = "timeout"   // The experiment was killed as it exceeded one of its time limits
+	ResultCancelled = "cancelled" // The experiment was killed as it was cancelled, or the runner was stopping
+)
+
+// ExperimentResult is the final status of an experiment as written to the result line
+//
+type ExperimentResult struct {
+	ExitCode int    `json:"exit_code"`
+	Status   string `json:"status"`
+}
+
+// NewExperimentResult determines the final status of an experiment from the error returned by
+// running it and the context it was run using
+//
+func NewExperimentResult(ctx context.Context, err errors.Error) (result ExperimentResult) {
+	if err == nil {
+		return ExperimentResult{ExitCode: 0, Status: ResultSuccess}
+	}
+
+	result = ExperimentResult{ExitCode: -1, Status: ResultFailed}
+	if exitErr, ok := errors.Cause(err).(*exec.ExitError); ok {
+		result.ExitCode = exitErr.ExitCode()
+	}
+
+	switch {
+	case IsSetupTimeout(err), IsRunTimeout(err), ctx.Err() == context.DeadlineExceeded:
+		result.Status = ResultTimeout
+	case ctx.Err() == context.Canceled:
+		result.Status = ResultCancelled
+	}
+	return result
+}
+
+// Line returns the result formatted as it appears in the output of the experiment
+//
+func (result ExperimentResult) Line() (line string) {
+	doc, _ := json.Marshal(result)
+	return fmt.Sprintf("%s %s\n", ResultMarker, doc)
+}
@@ -0,0 +1,113 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestExperimentResult checks the status given to experiments that exit, fail, time out, or are
+// cancelled, and that the result line is appended as the last line of the output and forwarded
+// to the output sinks
+//
+func TestExperimentResult(t *testing.T) {
+
+	exitErr := errors.Wrap(exec.Command("/bin/sh", "-c", "exit 3").Run()).With("stack", stack.Trace().TrimRuntime())
+
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	<-expired.Done()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, test := range []struct {
+		ctx      context.Context
+		err      errors.Error
+		expected ExperimentResult
+	}{
+		{ctx: context.Background(), err: nil, expected: ExperimentResult{ExitCode: 0, Status: ResultSuccess}},
+		{ctx: context.Background(), err: exitErr, expected: ExperimentResult{ExitCode: 3, Status: ResultFailed}},
+		{ctx: expired, err: errors.Wrap(expired.Err()), expected: ExperimentResult{ExitCode: -1, Status: ResultTimeout}},
+		{ctx: context.Background(), err: errors.New(runTimedOut), expected: ExperimentResult{ExitCode: -1, Status: ResultTimeout}},
+		{ctx: cancelled, err: errors.Wrap(cancelled.Err()), expected: ExperimentResult{ExitCode: -1, Status: ResultCancelled}},
+	} {
+		result := NewExperimentResult(test.ctx, test.err)
+		if result != test.expected {
+			t.Fatalf("unexpected result %+v for %v, expected %+v", result, test.err, test.expected)
+		}
+		parsed := ExperimentResult{}
+		line := strings.TrimSuffix(result.Line(), "\n")
+		if !strings.HasPrefix(line, ResultMarker+" ") {
+			t.Fatalf("result line %q is not prefixed by %s", line, ResultMarker)
+		}
+		if errGo := json.Unmarshal([]byte(strings.TrimPrefix(line, ResultMarker+" ")), &parsed); errGo != nil || parsed != result {
+			t.Fatalf("result line %q did not parse back to %+v", line, result)
+		}
+	}
+
+	dir, errGo := ioutil.TempDir("", "result")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	f, errGo := os.Create(filepath.Join(dir, "output"))
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	// Output beyond the limit is discarded however the result line is always written, and is
+	// forwarded to the sinks of the tee after the output that preceded it
+	sink := &recordingSink{}
+	tee, _ := NewOutputTee(f, &OutputCap{limit: 8}, nil)
+	tee.AddSink(sink)
+	tee.write("experiment output\n")
+	if _, err := tee.Finish(ExperimentResult{ExitCode: 3, Status: ResultFailed}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `STUDIOML_RESULT {"exit_code":3,"status":"failed"}`
+	output, errGo := ioutil.ReadFile(f.Name())
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if last := lines[len(lines)-1]; last != expected {
+		t.Fatalf("unexpected last line of output %q", last)
+	}
+
+	sink.Lock()
+	defer sink.Unlock()
+	if len(sink.received) != 2 || sink.received[0] != "experiment output\n" || sink.received[1] != expected+"\n" {
+		t.Fatalf("unexpected output forwarded to a sink %q", sink.received)
+	}
+}
+
+// recordingSink is an output sink that retains the output written to it
+//
+type recordingSink struct {
+	received []string
+	sync.Mutex
+}
+
+func (s *recordingSink) Write(output []byte) (err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.received = append(s.received, string(output))
+	return nil
+}
+
+func (s *recordingSink) Close() (err error) {
+	return nil
+}
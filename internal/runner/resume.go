@@ -0,0 +1,121 @@
+package runner
+
+// This file contains the implementation of resumable downloads.  Downloads of large artifacts
+// over flaky connections can fail part way through, rather than failing the attempt and
+// downloading the artifact again from the beginning the object is reopened using a range
+// request starting at the bytes already received and the download continues from there.
+// Readers above the download, such as those unpacking archives or writing the download to a
+// file, see a single uninterrupted stream.
+//
+// Resumed downloads are pinned to the version of the object first opened so that an object
+// replaced part way through a download is not spliced together from two versions.  Artifacts
+// with a hash are still checked against it once downloaded.  Stores that cannot read ranges
+// do not resume, their failed downloads are retried from the beginning.
+
+import (
+	"context"
+	"flag"
+	"io"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	downloadResumesOpt = flag.Int("download-resumes", 5, "the number of times a download that fails part way through is resumed from the bytes already received before the download fails, 0 restarts failed downloads from the beginning")
+)
+
+// rangeOpener opens an object for reading from the offset through to its end
+//
+type rangeOpener func(ctx context.Context, offset int64) (body io.ReadCloser, err errors.Error)
+
+// resumable wraps the body of a download so that reads failing part way through are resumed
+// using the opener.  The size of the object, when known, is used to detect bodies that end
+// early even when resumption is disabled, negative sizes are unknown.
+//
+func resumable(ctx context.Context, body io.ReadCloser, size int64, open rangeOpener) (reader io.ReadCloser) {
+	if size < 0 && open == nil {
+		return body
+	}
+	return &resumingReader{
+		ctx:  ctx,
+		body: body,
+		size: size,
+		open: open,
+	}
+}
+
+// resumingReader reads a download reopening the object at the offset reached when a read
+// fails
+//
+type resumingReader struct {
+	ctx     context.Context
+	body    io.ReadCloser
+	size    int64 // The size of the object, negative when it is not known
+	open    rangeOpener
+	offset  int64 // The number of bytes of the object read so far
+	resumes int
+}
+
+func (r *resumingReader) Read(p []byte) (n int, errGo error) {
+	for {
+		n, errGo = r.body.Read(p)
+		r.offset += int64(n)
+		// Some clients report a connection closed early as the end of the object
+		if errGo == io.EOF && r.size >= 0 && r.offset < r.size {
+			errGo = io.ErrUnexpectedEOF
+		}
+		if errGo == nil || errGo == io.EOF {
+			return n, errGo
+		}
+		// A failure once the whole object has been received, such as the connection dropping
+		// before it was closed, is the end of the object rather than a reason to resume
+		if r.size >= 0 && r.offset >= r.size {
+			return n, io.EOF
+		}
+		if r.open == nil || r.resumes >= *downloadResumesOpt || r.ctx.Err() != nil {
+			return n, errGo
+		}
+		r.resumes++
+
+		r.body.Close()
+		body, err := r.open(r.ctx, r.offset)
+		if err != nil {
+			// The read failure is reported along with the reason it could not be resumed
+			err = errors.Wrap(errGo).With("offset", r.offset, "resumes", r.resumes, "resume_error", err.Error()).With("stack", stack.Trace().TrimRuntime())
+			r.body = errReader{err: err}
+			return n, err
+		}
+		r.body = body
+
+		// Bytes read before the failure are passed on, otherwise the read is made again from
+		// the resumed body
+		if n != 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumingReader) Close() (errGo error) {
+	return r.body.Close()
+}
+
+// errReader is the body of a download that could not be resumed
+//
+type errReader struct {
+	err errors.Error
+}
+
+func (r errReader) Read(p []byte) (n int, errGo error) {
+	return 0, r.err
+}
+
+func (r errReader) Close() (errGo error) {
+	return nil
+}
+
+// errRangeUnsupported is returned when a store answered a range request with the whole object
+//
+func errRangeUnsupported(offset int64) (err errors.Error) {
+	return errors.New("download could not be resumed, the object store does not support range requests").With("offset", offset).With("stack", stack.Trace().TrimRuntime())
+}
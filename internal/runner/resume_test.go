@@ -0,0 +1,221 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/karlmutch/errors"
+)
+
+// fakeS3 serves a single object, whole requests are cut off part way through the object by
+// dropping the connection.  Range requests are only served when ranges is set.
+//
+type fakeS3 struct {
+	data    []byte
+	ranges  bool
+	resumed int
+	sync.Mutex
+}
+
+func (fs *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, isPresent := r.URL.Query()["location"]; isPresent {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`))
+		return
+	}
+
+	w.Header().Set("ETag", `"fake-etag"`)
+	w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+
+	if r.Method == http.MethodHead {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(fs.data))
+		return
+	}
+
+	fs.Lock()
+	resume := len(r.Header.Get("Range")) != 0 && fs.ranges
+	if resume {
+		fs.resumed++
+	}
+	fs.Unlock()
+
+	if resume {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(fs.data))
+		return
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprint(len(fs.data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(fs.data[:len(fs.data)/3])
+	w.(http.Flusher).Flush()
+
+	conn, _, errGo := w.(http.Hijacker).Hijack()
+	if errGo == nil {
+		conn.Close()
+	}
+}
+
+func (fs *fakeS3) resumes() (resumed int) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.resumed
+}
+
+// TestResumeDownload checks that a download cut off part way through is resumed from the
+// bytes already received, for both the latest and a pinned version of an object, and that
+// stores not supporting ranges fail the download so that it is retried from the beginning
+//
+func TestResumeDownload(t *testing.T) {
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	sum := sha256.Sum256(data)
+
+	for _, version := range []string{"", "v1"} {
+		fs := &fakeS3{data: data, ranges: true}
+		server := httptest.NewServer(fs)
+
+		env := map[string]string{
+			"MINIO_TEST_SERVER": strings.TrimPrefix(server.URL, "http://"),
+			"MINIO_ACCESS_KEY":  "access",
+			"MINIO_SECRET_KEY":  "secret",
+		}
+		s, err := NewS3storage(context.Background(), "project", "", env, "", "bucket", "data.bin", false, false)
+		if err != nil {
+			server.Close()
+			t.Fatal(err)
+		}
+		s.version = version
+
+		dir, errGo := ioutil.TempDir("", "resume")
+		if errGo != nil {
+			server.Close()
+			t.Fatal(errGo)
+		}
+
+		// The tap sees the same uninterrupted stream as the file written
+		tap := &bytes.Buffer{}
+		tapWriter := bufio.NewWriter(tap)
+		if _, err = s.Fetch(context.Background(), "data.bin", false, dir, tapWriter); err != nil {
+			t.Fatal(err, "version", version)
+		}
+		tapWriter.Flush()
+
+		if err = checkArtifactSum(filepath.Join(dir, "data.bin"), "sha256", hex.EncodeToString(sum[:])); err != nil {
+			t.Fatal(err, "version", version)
+		}
+		if !bytes.Equal(tap.Bytes(), data) {
+			t.Fatalf("tap received %d of %d bytes, version %q", tap.Len(), len(data), version)
+		}
+		if fs.resumes() == 0 {
+			t.Fatalf("download not resumed, version %q", version)
+		}
+		os.RemoveAll(dir)
+
+		// Without range support the download fails
+		fs.Lock()
+		fs.ranges = false
+		fs.Unlock()
+		dir, _ = ioutil.TempDir("", "resume")
+		if _, err = s.Fetch(context.Background(), "data.bin", false, dir, nil); err == nil {
+			t.Fatalf("download completed from a store without range support, version %q", version)
+		}
+		os.RemoveAll(dir)
+
+		server.Close()
+	}
+
+	// Disabling resumption fails the download at the first drop
+	saved := *downloadResumesOpt
+	defer func() { *downloadResumesOpt = saved }()
+	*downloadResumesOpt = 0
+
+	fs := &fakeS3{data: data, ranges: true}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	s, err := NewS3storage(context.Background(), "project", "", map[string]string{"MINIO_TEST_SERVER": strings.TrimPrefix(server.URL, "http://")}, "", "bucket", "data.bin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, _ := ioutil.TempDir("", "resume")
+	defer os.RemoveAll(dir)
+	if _, err = s.Fetch(context.Background(), "data.bin", false, dir, nil); err == nil {
+		t.Fatal("download completed with resumption disabled")
+	}
+	if fs.resumes() != 0 {
+		t.Fatal("download resumed with resumption disabled")
+	}
+}
+
+// failingBody returns its data and then fails with the error supplied
+//
+type failingBody struct {
+	data []byte
+	err  error
+}
+
+func (b *failingBody) Read(p []byte) (n int, errGo error) {
+	if len(b.data) == 0 {
+		return 0, b.err
+	}
+	n = copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *failingBody) Close() (errGo error) {
+	return nil
+}
+
+// TestResumeReader checks that a failure after the whole object was received ends the read
+// without resuming it, that a resumption failing reports the original read failure, and that
+// anonymous range requests are not presigned
+//
+func TestResumeReader(t *testing.T) {
+
+	dropped := fmt.Errorf("connection reset by peer")
+	opened := 0
+	open := func(ctx context.Context, offset int64) (body io.ReadCloser, err errors.Error) {
+		opened++
+		return nil, errors.New("access denied")
+	}
+
+	reader := resumable(context.Background(), &failingBody{data: []byte("0123456789"), err: dropped}, 10, open)
+	if data, errGo := ioutil.ReadAll(reader); errGo != nil || string(data) != "0123456789" || opened != 0 {
+		t.Fatalf("complete object read returned %q %v after %d resumes", string(data), errGo, opened)
+	}
+
+	reader = resumable(context.Background(), &failingBody{data: []byte("01234"), err: dropped}, 10, open)
+	_, errGo := ioutil.ReadAll(reader)
+	if errGo == nil || !strings.Contains(errGo.Error(), dropped.Error()) || !strings.Contains(errGo.Error(), "access denied") || opened != 1 {
+		t.Fatalf("failed resumption returned %v after %d resumes", errGo, opened)
+	}
+
+	s, err := NewS3storage(context.Background(), "project", "", map[string]string{"MINIO_TEST_SERVER": "127.0.0.1:9000"}, "", "bucket", "data.bin", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, errGo := s.objectURL(s.anonClient, "GET", "dir/data.bin", url.Values{})
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	if u.String() != "http://127.0.0.1:9000/bucket/dir/data.bin" {
+		t.Fatalf("unexpected anonymous URL %s", u.String())
+	}
+}
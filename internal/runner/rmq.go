@@ -94,7 +94,7 @@ func NewRabbitMQ(uri string, creds string) (rmq *RabbitMQ, err errors.Error) {
 
 func (rmq *RabbitMQ) attachQ() (conn *amqp.Connection, ch *amqp.Channel, err errors.Error) {
 
-	conn, errGo := amqp.Dial(rmq.url.String())
+	conn, errGo := amqp.DialConfig(rmq.url.String(), amqpConfig())
 	if errGo != nil {
 		return nil, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("uri", rmq.Identity)
 	}
@@ -267,13 +267,45 @@ func (rmq *RabbitMQ) Work(ctx context.Context, qt *QueueTask) (msgCnt uint64, re
 		return 0, nil, nil
 	}
 
-	qt.Msg = msg.Body
+	// Messages that cannot be decoded will never be processed and so are rejected without
+	// being requeued, they will be routed to any dead letter exchange configured for the queue
+	body, err := DecodeBody(msg.ContentType, msg.ContentEncoding, msg.Body)
+	if err != nil {
+		msg.Reject(false)
+		return 1, nil, err.With("subscription", qt.Subscription)
+	}
+
+	qt.Msg = body
+	qt.Attributes = map[string]string{}
+	for k, v := range msg.Headers {
+		if value, ok := v.(string); ok {
+			qt.Attributes[k] = value
+		}
+	}
+	qt.Backlog = uint64(msg.MessageCount)
+	// Quorum queues count the previous deliveries of messages that were returned
+	qt.Deliveries = 0
+	switch cnt := msg.Headers["x-delivery-count"].(type) {
+	case int64:
+		qt.Deliveries = uint(cnt) + 1
+	case int32:
+		qt.Deliveries = uint(cnt) + 1
+	default:
+		if !msg.Redelivered {
+			qt.Deliveries = 1
+		}
+	}
 
 	if rsc, ack := qt.Handler(ctx, qt); ack {
 		resource = rsc
 		if errGo := msg.Ack(false); errGo != nil {
 			return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("subscription", qt.Subscription)
 		}
+	} else if len(qt.Requeue) != 0 {
+		if err = requeueWith(ch, queue, msg, qt.Requeue); err != nil {
+			msg.Nack(false, true)
+			return 1, nil, err.With("subscription", qt.Subscription)
+		}
 	} else {
 		msg.Nack(false, true)
 	}
@@ -281,6 +313,64 @@ func (rmq *RabbitMQ) Work(ctx context.Context, qt *QueueTask) (msgCnt uint64, re
 	return 1, resource, nil
 }
 
+// requeuePublishing builds a copy of a delivered message with additional headers
+//
+func requeuePublishing(msg amqp.Delivery, headers map[string]string) (publishing amqp.Publishing) {
+	table := amqp.Table{}
+	for k, v := range msg.Headers {
+		table[k] = v
+	}
+	for k, v := range headers {
+		table[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         table,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// requeueWith returns a message to the back of its queue with additional headers.  RabbitMQ
+// does not allow a message being returned to be changed so a copy is published directly to
+// the queue, and once the broker has confirmed it the original is acknowledged.  The caller
+// returns the original unchanged when an error is returned
+//
+func requeueWith(ch *amqp.Channel, queue string, msg amqp.Delivery, headers map[string]string) (err errors.Error) {
+	if errGo := ch.Confirm(false); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	if errGo := ch.Publish("", queue, false, false, requeuePublishing(msg, headers)); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+	}
+
+	select {
+	case confirmed := <-confirms:
+		if !confirmed.Ack {
+			return errors.New("requeued message not confirmed").With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+		}
+	case <-time.After(15 * time.Second):
+		return errors.New("requeued message confirmation timed out").With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+	}
+
+	if errGo := msg.Ack(false); errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("queue", queue)
+	}
+	return nil
+}
+
 // This file contains the implementation of a test subsystem
 // for deploying rabbitMQ in test scenarios where it
 // has been installed for the purposes of running end-to-end
@@ -0,0 +1,36 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// TestRequeuePublishing checks that a message returned to a queue with additional headers keeps
+// its body, properties, and existing headers
+//
+func TestRequeuePublishing(t *testing.T) {
+
+	msg := amqp.Delivery{
+		Headers:         amqp.Table{"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "studioml-avoid-hosts": "old"},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		Priority:        3,
+		MessageId:       "message-1",
+		Body:            []byte("body"),
+	}
+
+	publishing := requeuePublishing(msg, map[string]string{"studioml-avoid-hosts": "new"})
+
+	if string(publishing.Body) != "body" || publishing.ContentType != msg.ContentType || publishing.ContentEncoding != msg.ContentEncoding ||
+		publishing.DeliveryMode != amqp.Persistent || publishing.Priority != 3 || publishing.MessageId != "message-1" {
+		t.Fatalf("message properties were not copied %+v", publishing)
+	}
+	if publishing.Headers["traceparent"] != msg.Headers["traceparent"] || publishing.Headers["studioml-avoid-hosts"] != "new" {
+		t.Fatalf("unexpected headers %v", publishing.Headers)
+	}
+	if msg.Headers["studioml-avoid-hosts"] != "old" {
+		t.Fatal("the headers of the delivered message were changed")
+	}
+}
@@ -0,0 +1,64 @@
+package runner
+
+// This file contains the implementation of the connection settings used for RabbitMQ.
+// Load balancers and NAT gateways silently drop connections that have been idle for some
+// minutes, AWS NAT gateways after 350 seconds and Azure load balancers after 4 minutes for
+// example, so TCP keepalives are sent well within these periods to keep the connection
+// open.  AMQP heartbeats are used to detect connections that have died so that the
+// operation using them fails promptly and the connection is dialed again, rather than
+// stalling until the operating system gives up on the connection.
+
+import (
+	"crypto/tls"
+	"flag"
+	"net"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	amqpHeartbeatOpt   = flag.Duration("amqp-heartbeat", 10*time.Second, "the interval between heartbeats on AMQP connections, a connection is closed after two heartbeats are missed, the smaller of this and the interval of the server is used")
+	amqpKeepaliveOpt   = flag.Duration("amqp-keepalive", 30*time.Second, "the interval between TCP keepalive probes on AMQP connections, 0 disables keepalives")
+	amqpDialTimeoutOpt = flag.Duration("amqp-dial-timeout", 30*time.Second, "the maximum period of time for connecting to an AMQP server, including the TLS and AMQP handshakes")
+)
+
+// amqpConfig returns the settings used for connections to RabbitMQ servers
+//
+func amqpConfig() (config amqp.Config) {
+	config = amqp.Config{
+		Heartbeat: *amqpHeartbeatOpt,
+		Locale:    "en_US",
+		Dial:      dialAMQP,
+	}
+	if caBundleRoots != nil {
+		config.TLSClientConfig = &tls.Config{RootCAs: caBundleRoots}
+	}
+	return config
+}
+
+// dialAMQP opens the TCP connection for AMQP using keepalives, a deadline is set for the
+// handshakes that the amqp package clears once the connection is established and its
+// heartbeats take over
+//
+func dialAMQP(network string, addr string) (conn net.Conn, errGo error) {
+	dialer := &net.Dialer{
+		Timeout:   *amqpDialTimeoutOpt,
+		KeepAlive: *amqpKeepaliveOpt,
+	}
+	if dialer.KeepAlive == 0 {
+		dialer.KeepAlive = -1
+	}
+
+	if conn, errGo = dialer.Dial(network, addr); errGo != nil {
+		return nil, errGo
+	}
+
+	if *amqpDialTimeoutOpt > 0 {
+		if errGo = conn.SetDeadline(time.Now().Add(*amqpDialTimeoutOpt)); errGo != nil {
+			conn.Close()
+			return nil, errGo
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TestAMQPDialTimeout checks that a server that accepts connections but never completes the
+// AMQP handshake is abandoned once the amqp-dial-timeout has passed
+//
+func TestAMQPDialTimeout(t *testing.T) {
+
+	listener, errGo := net.Listen("tcp", "127.0.0.1:0")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, errGo := listener.Accept()
+			if errGo != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	saved := *amqpDialTimeoutOpt
+	defer func() { *amqpDialTimeoutOpt = saved }()
+	*amqpDialTimeoutOpt = 250 * time.Millisecond
+
+	config := amqpConfig()
+	if config.Heartbeat != *amqpHeartbeatOpt {
+		t.Fatalf("heartbeat set to %v", config.Heartbeat)
+	}
+
+	started := time.Now()
+	if conn, errGo := amqp.DialConfig("amqp://guest:guest@"+listener.Addr().String()+"/", config); errGo == nil {
+		conn.Close()
+		t.Fatal("handshake with a silent server succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("silent server abandoned after %v", elapsed)
+	}
+}
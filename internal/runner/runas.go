@@ -0,0 +1,168 @@
+package runner
+
+// This file contains the implementation of running experiments as an unprivileged user.
+// When the runner is configured with a user the experiment process has its credentials
+// switched before it starts so that it cannot read the files the runner uses for its
+// own credentials, or write outside of its working directories.
+
+import (
+	"flag"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	runAsOpt      = flag.String("run-as", "", "the name, or numeric uid, of an unprivileged user that experiments will be run as, the runner must be started as root when this is used")
+	runAsGroupOpt = flag.String("run-as-group", "", "the name, or numeric gid, of the group that experiments will be run as, defaults to the primary group of the run-as user")
+
+	runAsOnce = sync.Once{}
+	runAs     *runAsUser
+	runAsErr  errors.Error
+)
+
+// runAsUser contains the resolved identity that experiments will be run under
+//
+type runAsUser struct {
+	name string
+	uid  uint32
+	gid  uint32
+}
+
+func lookupUser(spec string) (usr *user.User, errGo error) {
+	if _, errGo = strconv.ParseUint(spec, 10, 32); errGo == nil {
+		return user.LookupId(spec)
+	}
+	return user.Lookup(spec)
+}
+
+func lookupGroup(spec string) (grp *user.Group, errGo error) {
+	if _, errGo = strconv.ParseUint(spec, 10, 32); errGo == nil {
+		return user.LookupGroupId(spec)
+	}
+	return user.LookupGroup(spec)
+}
+
+func resolveRunAs() (u *runAsUser, err errors.Error) {
+	if len(*runAsOpt) == 0 {
+		return nil, nil
+	}
+
+	usr, errGo := lookupUser(*runAsOpt)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo, "run-as user not found").With("user", *runAsOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	uid, errGo := strconv.ParseUint(usr.Uid, 10, 32)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("user", *runAsOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+	if uid == 0 {
+		return nil, errors.New("run-as user must not be root").With("user", *runAsOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	gidSpec := usr.Gid
+	if len(*runAsGroupOpt) != 0 {
+		grp, errGo := lookupGroup(*runAsGroupOpt)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, "run-as group not found").With("group", *runAsGroupOpt).With("stack", stack.Trace().TrimRuntime())
+		}
+		gidSpec = grp.Gid
+	}
+	gid, errGo := strconv.ParseUint(gidSpec, 10, 32)
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("group", gidSpec).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	// Switching the credentials of a child process requires privileges
+	if os.Geteuid() != 0 {
+		return nil, errors.New("the runner must be run as root to start experiments as another user").With("user", *runAsOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	return &runAsUser{
+		name: usr.Username,
+		uid:  uint32(uid),
+		gid:  uint32(gid),
+	}, nil
+}
+
+// ValidateRunAs checks that the user experiments are configured to run as exists and can be
+// used, it should be called during startup so that misconfiguration is caught before work
+// is accepted.  The user name is returned, or an empty string if experiments run as the
+// same user as the runner.
+//
+func ValidateRunAs() (name string, err errors.Error) {
+	u, err := getRunAs()
+	if err != nil || u == nil {
+		return "", err
+	}
+	return u.name, nil
+}
+
+func getRunAs() (u *runAsUser, err errors.Error) {
+	runAsOnce.Do(func() {
+		runAs, runAsErr = resolveRunAs()
+	})
+	return runAs, runAsErr
+}
+
+// credential returns the process attributes needed to start a process as the user
+//
+func (u *runAsUser) credential() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{
+			Uid:    u.uid,
+			Gid:    u.gid,
+			Groups: []uint32{},
+		},
+	}
+}
+
+// prepare hands ownership of the experiments working directories to the user.  The
+// directories above the working directory are owned by the runner and are given
+// traverse only permission so that the user can reach its own directory without
+// being able to list or read anything else the runner has stored.
+//
+func (u *runAsUser) prepare(workDir string, tmpDir string) (err errors.Error) {
+
+	for _, dir := range []string{workDir, tmpDir} {
+		errGo := filepath.Walk(dir, func(path string, info os.FileInfo, errGo error) error {
+			if errGo != nil {
+				return errGo
+			}
+			return os.Lchown(path, int(u.uid), int(u.gid))
+		})
+		if errGo != nil {
+			return errors.Wrap(errGo).With("dir", dir, "user", u.name).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		info, errGo := os.Stat(dir)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Uid != u.uid {
+			return errors.New("working directory is not owned by the run-as user").With("dir", dir, "user", u.name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	// The experiments directory and the runners root directory sit above the working directory
+	parent := filepath.Dir(workDir)
+	for _, dir := range []string{parent, filepath.Dir(parent)} {
+		info, errGo := os.Stat(dir)
+		if errGo != nil {
+			return errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+		if info.Mode().Perm()&0001 != 0 {
+			continue
+		}
+		if errGo = os.Chmod(dir, info.Mode().Perm()|0001); errGo != nil {
+			return errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
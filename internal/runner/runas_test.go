@@ -0,0 +1,167 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestResolveRunAs checks that the user, and group, experiments are run as are found using
+// either names or numeric ids, and that root is refused
+//
+func TestResolveRunAs(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("running experiments as another user requires the test to be run as root")
+	}
+
+	usr, errGo := user.Lookup("nobody")
+	if errGo != nil {
+		t.Skip("the nobody user is not present", errGo)
+	}
+	grp, errGo := user.LookupGroup("daemon")
+	if errGo != nil {
+		t.Skip("the daemon group is not present", errGo)
+	}
+
+	savedUser, savedGroup := *runAsOpt, *runAsGroupOpt
+	defer func() {
+		*runAsOpt, *runAsGroupOpt = savedUser, savedGroup
+	}()
+
+	for _, tc := range []struct {
+		user  string
+		group string
+		uid   string
+		gid   string
+		fails bool
+	}{
+		{user: "nobody", uid: usr.Uid, gid: usr.Gid},
+		{user: usr.Uid, uid: usr.Uid, gid: usr.Gid},
+		{user: "nobody", group: "daemon", uid: usr.Uid, gid: grp.Gid},
+		{user: usr.Uid, group: grp.Gid, uid: usr.Uid, gid: grp.Gid},
+		{user: "root", fails: true},
+		{user: "0", fails: true},
+		{user: "no-such-user-for-runner", fails: true},
+		{user: "nobody", group: "no-such-group-for-runner", fails: true},
+	} {
+		*runAsOpt, *runAsGroupOpt = tc.user, tc.group
+
+		u, err := resolveRunAs()
+		if tc.fails {
+			if err == nil {
+				t.Fatalf("user %q group %q was accepted as %+v", tc.user, tc.group, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strconv.FormatUint(uint64(u.uid), 10) != tc.uid || strconv.FormatUint(uint64(u.gid), 10) != tc.gid || u.name != "nobody" {
+			t.Fatalf("user %q group %q resolved to %+v, expected uid %s gid %s", tc.user, tc.group, u, tc.uid, tc.gid)
+		}
+	}
+
+	// No user leaves experiments running as the runner
+	*runAsOpt, *runAsGroupOpt = "", ""
+	if u, err := resolveRunAs(); u != nil || err != nil {
+		t.Fatalf("a user %+v, or error %v, was returned without one being configured", u, err)
+	}
+}
+
+// TestRunAsPrepare checks that the working and temporary directories of an experiment are given
+// to the user without following links out of them, and that only the two directories above
+// the working directory are made traversable
+//
+func TestRunAsPrepare(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("changing the ownership of files requires the test to be run as root")
+	}
+
+	base, errGo := ioutil.TempDir("", "runas-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(base)
+
+	// base/above/root/exprs/work mirrors the runners directory layout with a directory above
+	// the runners root that must not be changed
+	above := filepath.Join(base, "above")
+	root := filepath.Join(above, "root")
+	exprs := filepath.Join(root, "exprs")
+	work := filepath.Join(exprs, "work")
+	tmp := filepath.Join(base, "tmp")
+	outside := filepath.Join(base, "outside")
+
+	for _, dir := range []string{filepath.Join(work, "sub"), tmp} {
+		if errGo = os.MkdirAll(dir, 0700); errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	for _, dir := range []string{above, root, exprs} {
+		if errGo = os.Chmod(dir, 0700); errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	for _, fn := range []string{filepath.Join(work, "sub", "data"), filepath.Join(tmp, "scratch"), outside} {
+		if errGo = ioutil.WriteFile(fn, []byte("data"), 0600); errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+	}
+	link := filepath.Join(work, "link")
+	if errGo = os.Symlink(outside, link); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	u := &runAsUser{name: "test", uid: 65534, gid: 65534}
+	if err := u.prepare(work, tmp); err != nil {
+		t.Fatal(err)
+	}
+
+	owner := func(fn string) (uid uint32) {
+		info, errGo := os.Lstat(fn)
+		if errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return info.Sys().(*syscall.Stat_t).Uid
+	}
+	mode := func(fn string) (perm os.FileMode) {
+		info, errGo := os.Stat(fn)
+		if errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		return info.Mode().Perm()
+	}
+
+	for _, fn := range []string{work, filepath.Join(work, "sub"), filepath.Join(work, "sub", "data"), link, tmp, filepath.Join(tmp, "scratch")} {
+		if uid := owner(fn); uid != u.uid {
+			t.Fatalf("%s is owned by %d rather than the run-as user", fn, uid)
+		}
+	}
+	if uid := owner(outside); uid != 0 {
+		t.Fatalf("the target of a link was given to the run-as user, owned by %d", uid)
+	}
+	for _, fn := range []string{exprs, root, above} {
+		if uid := owner(fn); uid != 0 {
+			t.Fatalf("%s above the working directory was given to the run-as user", fn)
+		}
+	}
+
+	if perm := mode(exprs); perm != 0701 {
+		t.Fatalf("the experiments directory has permissions %v, expected traverse only for others", perm)
+	}
+	if perm := mode(root); perm != 0701 {
+		t.Fatalf("the runners root directory has permissions %v, expected traverse only for others", perm)
+	}
+	if perm := mode(above); perm != 0700 {
+		t.Fatalf("the directory above the runners root was changed to %v", perm)
+	}
+}
@@ -6,18 +6,25 @@ package runner
 import (
 	"archive/tar"
 	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/md5"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -52,6 +59,12 @@ type s3Storage struct {
 	key        string
 	client     *minio.Client
 	anonClient *minio.Client
+	transport  http.RoundTripper // The transport used by the clients, used for requests made outside of minio
+	secure     bool              // Requests made outside of minio use https
+	region     string            // The region of the store, empty when it has none
+	version    string            // When set the specific version of objects that is to be used
+	tags       map[string]string // The tags applied to uploaded objects
+	untaggable bool              // Set once the store has been found not to support object tagging
 }
 
 // NewS3storage is used to initialize a client that will communicate with S3 compatible storage.
@@ -150,6 +163,9 @@ func NewS3storage(ctx context.Context, projectID string, creds string, env map[s
 		useSSL = true
 	}
 
+	s.secure = useSSL
+	s.region = region
+
 	// Using the BucketLookupPath strategy to avoid using DNS lookups for the buckets first
 	options := minio.Options{
 		Creds:        credentials.NewStaticV4(access, secret, ""),
@@ -188,19 +204,24 @@ func NewS3storage(ctx context.Context, projectID string, creds string, env map[s
 				return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 			}
 		}
+		appendCABundle(caCerts)
 
-		s.client.SetCustomTransport(&http.Transport{
-			TLSClientConfig: &tls.Config{
-				Certificates: []tls.Certificate{cert},
-				RootCAs:      caCerts,
-			},
-		})
-		s.anonClient.SetCustomTransport(&http.Transport{
+		s.transport = &http.Transport{
 			TLSClientConfig: &tls.Config{
 				Certificates: []tls.Certificate{cert},
 				RootCAs:      caCerts,
 			},
-		})
+		}
+		s.client.SetCustomTransport(s.transport)
+		s.anonClient.SetCustomTransport(s.transport)
+	}
+
+	// Requests across all experiments share the connection limit for S3, and uploads the
+	// upload bandwidth of the node
+	if *s3MaxConnsOpt > 0 || uploadBucket != nil {
+		s.transport = limitUploads(limitConnections("s3", *s3MaxConnsOpt, s.transport))
+		s.client.SetCustomTransport(s.transport)
+		s.anonClient.SetCustomTransport(s.transport)
 	}
 
 	return s, nil
@@ -223,6 +244,14 @@ func (s *s3Storage) Hash(ctx context.Context, name string) (hash string, err err
 	if len(key) == 0 {
 		key = s.key
 	}
+	if len(s.version) != 0 {
+		resp, err := s.versioned(ctx, "HEAD", key, 0)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		return strings.Trim(resp.Header.Get("ETag"), "\""), nil
+	}
 	info, errGo := s.client.StatObject(s.bucket, key, minio.StatObjectOptions{})
 	if errGo != nil {
 		if minio.ToErrorResponse(errGo).Code == "AccessDenied" {
@@ -236,6 +265,191 @@ func (s *s3Storage) Hash(ctx context.Context, name string) (hash string, err err
 	return info.ETag, nil
 }
 
+// getObject opens the object for reading, trying anonymous access if the credentials
+// supplied were rejected.  Reads that fail part way through the object are resumed from the
+// same version of the object.
+//
+func (s *s3Storage) getObject(ctx context.Context, key string) (obj io.ReadCloser, err errors.Error) {
+
+	if len(s.version) != 0 {
+		resp, err := s.versioned(ctx, "GET", key, 0)
+		if err != nil {
+			return nil, err
+		}
+		return resumable(ctx, resp.Body, resp.ContentLength, func(ctx context.Context, offset int64) (body io.ReadCloser, err errors.Error) {
+			resp, err := s.versioned(ctx, "GET", key, offset)
+			if err != nil {
+				return nil, err
+			}
+			return resp.Body, nil
+		}), nil
+	}
+
+	errCtx := errors.With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint)
+
+	aClient := s.client
+	info := minio.ObjectInfo{}
+	mObj, errGo := aClient.GetObjectWithContext(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if errGo == nil {
+		// Errors can be delayed until the first interaction with the storage platform so
+		// we exercise access to the meta data at least to validate the object we have
+		info, errGo = mObj.Stat()
+	}
+	if errGo != nil {
+		if minio.ToErrorResponse(errGo).Code == "AccessDenied" {
+			aClient = s.anonClient
+			mObj, errGo = aClient.GetObjectWithContext(ctx, s.bucket, key, minio.GetObjectOptions{})
+			if errGo == nil {
+				// Errors can be delayed until the first interaction with the storage platform so
+				// we exercise access to the meta data at least to validate the object we have
+				info, errGo = mObj.Stat()
+			}
+		}
+		if errGo != nil {
+			return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+
+	// Without an ETag a resumed read could not be tied to the object first read
+	open := rangeOpener(nil)
+	if len(info.ETag) != 0 {
+		open = func(ctx context.Context, offset int64) (body io.ReadCloser, err errors.Error) {
+			return s.readRange(ctx, aClient, key, offset, info.ETag)
+		}
+	}
+	return resumable(ctx, mObj, info.Size, open), nil
+}
+
+// objectURL returns the URL used to request an object outside of the minio client.  Requests
+// made using the credentials are presigned, anonymous requests are left unsigned as presigning
+// needs credentials.
+//
+func (s *s3Storage) objectURL(aClient *minio.Client, method string, key string, params url.Values) (u *url.URL, errGo error) {
+	if aClient != s.anonClient {
+		if method == "HEAD" {
+			return aClient.PresignedHeadObject(s.bucket, key, time.Hour, params)
+		}
+		return aClient.PresignedGetObject(s.bucket, key, time.Hour, params)
+	}
+
+	u = &url.URL{
+		Scheme:   "http",
+		Host:     s.endpoint,
+		Path:     "/" + s.bucket + "/" + key,
+		RawQuery: params.Encode(),
+	}
+	if s.secure {
+		u.Scheme = "https"
+	}
+	// Buckets outside of the default region are addressed using the regional endpoint
+	if s.endpoint == "s3.amazonaws.com" && len(s.region) != 0 && s.region != "us-east-1" {
+		u.Host = "s3." + s.region + ".amazonaws.com"
+	}
+	return u, nil
+}
+
+// readRange reads the object from the offset through to its end, failing if the object no
+// longer has the ETag supplied.  A presigned request is used as the minio client does not
+// report whether the store honoured the range.
+//
+func (s *s3Storage) readRange(ctx context.Context, aClient *minio.Client, key string, offset int64, etag string) (body io.ReadCloser, err errors.Error) {
+
+	errCtx := errors.With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint).With("offset", offset)
+
+	u, errGo := s.objectURL(aClient, "GET", key, url.Values{})
+	if errGo != nil {
+		return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	req, errGo := http.NewRequest("GET", u.String(), nil)
+	if errGo != nil {
+		return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Match", "\""+etag+"\"")
+
+	resp, errGo := (&http.Client{Transport: s.transport}).Do(req.WithContext(ctx))
+	if errGo != nil {
+		return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		resp.Body.Close()
+		return nil, errRangeUnsupported(offset).With("bucket", s.bucket, "key", key, "endpoint", s.endpoint)
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, errCtx.New("download could not be resumed, the object changed").With("etag", etag).With("stack", stack.Trace().TrimRuntime())
+	default:
+		resp.Body.Close()
+		return nil, errCtx.New("download could not be resumed").With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+	}
+}
+
+// versioned is used to make requests for a specific version of an object.  The minio client
+// does not support object versions for its high level operations so presigned requests
+// containing the version are used instead.
+//
+// A non zero offset requests the object from that offset through to its end.
+//
+// The caller is responsible for closing the body of the response that is returned.
+//
+func (s *s3Storage) versioned(ctx context.Context, method string, key string, offset int64) (resp *http.Response, err errors.Error) {
+
+	errCtx := errors.With("bucket", s.bucket).With("key", key).With("version", s.version).With("endpoint", s.endpoint)
+
+	params := url.Values{}
+	params.Set("versionId", s.version)
+
+	httpClient := &http.Client{Transport: s.transport}
+
+	for _, aClient := range []*minio.Client{s.client, s.anonClient} {
+		u, errGo := s.objectURL(aClient, method, key, params)
+		if errGo != nil {
+			return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		req, errGo := http.NewRequest(method, u.String(), nil)
+		if errGo != nil {
+			return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+		if offset != 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		if resp, errGo = httpClient.Do(req.WithContext(ctx)); errGo != nil {
+			return nil, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			if offset != 0 {
+				resp.Body.Close()
+				return nil, errRangeUnsupported(offset).With("bucket", s.bucket, "key", key, "version", s.version, "endpoint", s.endpoint)
+			}
+			return resp, nil
+		case http.StatusPartialContent:
+			if offset != 0 {
+				return resp, nil
+			}
+			resp.Body.Close()
+			return nil, errCtx.New("object version could not be retrieved").With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+		case http.StatusForbidden:
+			// Try accessing the artifact without any credentials
+			resp.Body.Close()
+			continue
+		case http.StatusNotFound, http.StatusBadRequest:
+			resp.Body.Close()
+			return nil, errCtx.New("the requested object version does not exist").With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+		default:
+			resp.Body.Close()
+			return nil, errCtx.New("object version could not be retrieved").With("status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil, errCtx.New("access denied to the requested object version").With("stack", stack.Trace().TrimRuntime())
+}
+
 func (s *s3Storage) listObjects(keyPrefix string) (names []string, warnings []errors.Error, err errors.Error) {
 	names = []string{}
 	isRecursive := true
@@ -256,6 +470,10 @@ func (s *s3Storage) listObjects(keyPrefix string) (names []string, warnings []er
 				}
 				return nil, nil, errors.Wrap(object.Err).With("bucket", s.bucket, "keyPrefix", keyPrefix).With("stack", stack.Trace().TrimRuntime())
 			}
+			// Tag sidecars describe the objects next to them and are not part of what was hoarded
+			if strings.HasSuffix(object.Key, tagsSidecarExt) {
+				continue
+			}
 			names = append(names, object.Key)
 		}
 	}
@@ -315,24 +533,9 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 		warns = append(warns, w)
 	}
 
-	obj, errGo := s.client.GetObjectWithContext(ctx, s.bucket, key, minio.GetObjectOptions{})
-	if errGo == nil {
-		// Errors can be delayed until the first interaction with the storage platform so
-		// we exercise access to the meta data at least to validate the object we have
-		_, errGo = obj.Stat()
-	}
-	if errGo != nil {
-		if minio.ToErrorResponse(errGo).Code == "AccessDenied" {
-			obj, errGo = s.anonClient.GetObjectWithContext(ctx, s.bucket, key, minio.GetObjectOptions{})
-			if errGo == nil {
-				// Errors can be delayed until the first interaction with the storage platform so
-				// we exercise access to the meta data at least to validate the object we have
-				_, errGo = obj.Stat()
-			}
-		}
-		if errGo != nil {
-			return warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
-		}
+	obj, err := s.getObject(ctx, key)
+	if err != nil {
+		return warns, err.With("output", output).With("name", name)
 	}
 	defer obj.Close()
 
@@ -419,7 +622,7 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 					return warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
 				}
 
-				_, errGo = io.Copy(file, tarReader)
+				_, errGo = streamCopy(file, tarReader)
 				file.Close()
 				if errGo != nil {
 					return warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
@@ -447,9 +650,9 @@ func (s *s3Storage) Fetch(ctx context.Context, name string, unpack bool, output
 			// the tap being able to send data to things like caches etc
 			//
 			// Second in the stack of readers after the TAP is a decompression reader
-			_, errGo = io.Copy(outf, io.TeeReader(obj, tap))
+			_, errGo = streamCopy(outf, io.TeeReader(obj, tap))
 		} else {
-			_, errGo = io.Copy(outf, obj)
+			_, errGo = streamCopy(outf, obj)
 		}
 		if errGo != nil {
 			return warns, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("path", path)
@@ -487,6 +690,103 @@ func (s *s3Storage) uploadFile(ctx context.Context, src string, dest string) (er
 	return nil
 }
 
+// s3Tagging is the document used to set the tags of an S3 object
+//
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Tags    []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// tagObject applies the upload tags to an object that has been uploaded.  Stores that do not
+// support object tagging, or credentials that may not tag objects, have the tags written to a
+// sidecar object next to the object instead.
+//
+func (s *s3Storage) tagObject(ctx context.Context, key string) (err errors.Error) {
+	if len(s.tags) == 0 {
+		return nil
+	}
+	if !s.untaggable {
+		supported := false
+		if supported, err = s.putTagging(ctx, key); supported || err != nil {
+			return err
+		}
+		s.untaggable = true
+	}
+	return s.putTagsSidecar(ctx, key)
+}
+
+// putTagging sets the tags of an object, supported is false when the store does not implement
+// object tagging.  The minio client does not support tagging and so a presigned request is used.
+//
+func (s *s3Storage) putTagging(ctx context.Context, key string) (supported bool, err errors.Error) {
+
+	errCtx := errors.With("bucket", s.bucket).With("key", key).With("endpoint", s.endpoint)
+
+	doc := s3Tagging{}
+	for k, v := range s.tags {
+		doc.Tags = append(doc.Tags, s3Tag{Key: k, Value: v})
+	}
+	sort.Slice(doc.Tags, func(i, j int) bool { return doc.Tags[i].Key < doc.Tags[j].Key })
+	body, errGo := xml.Marshal(&doc)
+	if errGo != nil {
+		return false, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	u, errGo := s.client.Presign("PUT", s.bucket, key, time.Hour, url.Values{"tagging": []string{""}})
+	if errGo != nil {
+		return false, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	req, errGo := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if errGo != nil {
+		return false, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	sum := md5.Sum(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, errGo := (&http.Client{Transport: s.transport}).Do(req.WithContext(ctx))
+	if errGo != nil {
+		return false, errCtx.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusNotImplemented, http.StatusMethodNotAllowed, http.StatusForbidden:
+		// Credentials without the s3:PutObjectTagging permission are treated in the same way
+		// as a store without tagging
+		return false, nil
+	}
+	// Some stores report the tagging API as missing using an error document
+	errResp := minio.ErrorResponse{}
+	if errGo = xml.NewDecoder(resp.Body).Decode(&errResp); errGo == nil && errResp.Code == "NotImplemented" {
+		return false, nil
+	}
+	return false, errCtx.New("object could not be tagged").With("status", resp.Status, "code", errResp.Code).With("stack", stack.Trace().TrimRuntime())
+}
+
+// putTagsSidecar writes the tags of an object as a JSON document to the sidecar object next to it
+//
+func (s *s3Storage) putTagsSidecar(ctx context.Context, key string) (err errors.Error) {
+	body, errGo := json.Marshal(s.tags)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("bucket", s.bucket, "key", key)
+	}
+	_, errGo = s.client.PutObjectWithContext(ctx, s.bucket, key+tagsSidecarExt, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
+		ContentType: "application/json",
+	})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("bucket", s.bucket, "key", key+tagsSidecarExt)
+	}
+	return nil
+}
+
 // Hoard is used to upload the contents of a directory to the storage server as individual files rather than a single
 // archive
 //
@@ -512,11 +812,16 @@ func (s *s3Storage) Hoard(ctx context.Context, srcDir string, keyPrefix string)
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
 
-	// Upload files
+	// Upload files, failing to tag a file does not fail the upload
+	untagged := []errors.Error{}
 	for _, aFile := range files {
 		key := filepath.Join(prefix, strings.TrimPrefix(aFile, srcDir))
 		if err = s.uploadFile(ctx, aFile, key); err != nil {
 			warnings = append(warnings, err)
+			continue
+		}
+		if err = s.tagObject(ctx, key); err != nil {
+			untagged = append(untagged, err)
 		}
 	}
 
@@ -524,7 +829,7 @@ func (s *s3Storage) Hoard(ctx context.Context, srcDir string, keyPrefix string)
 		err = errors.New("one or more uploads failed").With("stack", stack.Trace().TrimRuntime()).With("src", srcDir, "warnings", warnings)
 	}
 
-	return warnings, err
+	return append(warnings, untagged...), err
 }
 
 // Return directories as compressed artifacts to the AWS storage for an
@@ -550,54 +855,56 @@ func (s *s3Storage) Deposit(ctx context.Context, src string, dest string) (warns
 		return warns, nil
 	}
 
+	// Archives are spooled to disk and then uploaded with a known size, uploads of an unknown
+	// size are buffered in memory by the client one part at a time and parts can be hundreds
+	// of megabytes
+	spool, errGo := ioutil.TempFile(filepath.Dir(src), ".deposit-")
+	if errGo != nil {
+		return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("src", src)
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+
 	pr, pw := io.Pipe()
 
 	swErrorC := make(chan errors.Error)
 	go streamingWriter(pr, pw, files, dest, swErrorC)
 
-	s3ErrorC := make(chan errors.Error)
-	go s.s3Put(key, pr, s3ErrorC)
+	copyErrC := make(chan error, 1)
+	go func() {
+		_, errGo := streamCopy(spool, pr)
+		pr.Close()
+		copyErrC <- errGo
+	}()
 
-	finished := 2
-	for {
-		select {
-		case err = <-swErrorC:
-			if nil != err {
-				return warns, err
-			}
-			swErrorC = nil
-			finished--
-		case err = <-s3ErrorC:
-			if nil != err {
-				return warns, err
-			}
-			s3ErrorC = nil
-			finished--
-		}
-		if finished == 0 {
-			break
+	// The writer reports its errors while the archive is being written and closes the
+	// channel once it is done
+	failed := errors.Error(nil)
+	for err = range swErrorC {
+		if err != nil && failed == nil {
+			failed = err
 		}
 	}
+	errGo = <-copyErrC
+	if failed != nil {
+		return warns, failed
+	}
+	if errGo != nil {
+		return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("src", src, "spool", spool.Name())
+	}
+	if errGo = spool.Close(); errGo != nil {
+		return warns, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("src", src, "spool", spool.Name())
+	}
 
-	pr.Close()
-
-	return warns, nil
-}
-
-func (s *s3Storage) s3Put(key string, pr *io.PipeReader, errorC chan errors.Error) {
-
-	errS := errors.With("key", key).With("bucket", s.bucket)
-
-	defer func() {
-		if r := recover(); r != nil {
-			errorC <- errS.New(fmt.Sprint(r)).With("stack", stack.Trace().TrimRuntime())
-		}
-		close(errorC)
-	}()
-	if _, errGo := s.client.PutObject(s.bucket, key, pr, -1, minio.PutObjectOptions{}); errGo != nil {
-		errorC <- errS.Wrap(minio.ToErrorResponse(errGo)).With("stack", stack.Trace().TrimRuntime())
-		return
+	if err = s.uploadFile(ctx, spool.Name(), key); err != nil {
+		return warns, err
 	}
+	if err = s.tagObject(ctx, key); err != nil {
+		warns = append(warns, err)
+	}
+	return warns, nil
 }
 
 type errSender struct {
@@ -0,0 +1,90 @@
+package runner
+
+// This file contains the implementation of shared memory provisioning for experiments.
+// Frameworks such as PyTorch exchange data between worker processes using shared memory
+// and the small /dev/shm present in many containers results in bus errors.  When an
+// experiment asks for more shared memory than /dev/shm has free a private tmpfs of the
+// requested size is mounted for the experiment.  When the runner can create a private mount
+// namespace for the experiment, see tmpdir.go, the tmpfs is mounted over /dev/shm so that
+// frameworks use it unchanged, otherwise experiments must use the location passed to them
+// in the STUDIOML_SHM environment variable.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	defaultShmOpt = flag.String("default-shm", "", "the amount of shared memory provided to experiments that do not specify one, for example 2gb")
+
+	// devShm is the location of the shared memory conventionally used on Linux
+	devShm = "/dev/shm"
+)
+
+const (
+	shmUnavailable = "shared memory could not be provided"
+)
+
+// ShmSize returns the amount of shared memory the experiment requested, or the operator
+// configured default if the experiment did not specify any
+//
+func ShmSize(rsc *Resource) (size uint64, err errors.Error) {
+	shm := rsc.Shm
+	if len(shm) == 0 {
+		shm = *defaultShmOpt
+	}
+	if len(shm) == 0 {
+		return 0, nil
+	}
+	size, errGo := humanize.ParseBytes(shm)
+	if errGo != nil {
+		return 0, errors.Wrap(errGo, "shm value is invalid").With("shm", shm).With("stack", stack.Trace().TrimRuntime())
+	}
+	return size, nil
+}
+
+// shmFree returns the free space within a shared memory file system
+//
+func shmFree(dir string) (free uint64) {
+	fs := syscall.Statfs_t{}
+	if errGo := syscall.Statfs(dir, &fs); errGo != nil {
+		return 0
+	}
+	return fs.Bavail * uint64(fs.Bsize)
+}
+
+// provideShm ensures that the amount of shared memory requested is available to the experiment.
+// The returned release function must be called once the experiment has stopped.
+//
+func provideShm(baseDir string, size uint64) (dir string, release func(), err errors.Error) {
+
+	release = func() {}
+
+	if size == 0 || shmFree(devShm) >= size {
+		return devShm, release, nil
+	}
+
+	dir = filepath.Join(baseDir, "shm")
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return "", release, errors.Wrap(errGo, shmUnavailable).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	opts := fmt.Sprintf("size=%d,mode=1777", size)
+	if errGo := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, opts); errGo != nil {
+		return "", release, errors.Wrap(errGo, shmUnavailable).With("dir", dir, "shm", humanize.Bytes(size), "dev_shm_free", humanize.Bytes(shmFree(devShm))).
+			With("stack", stack.Trace().TrimRuntime())
+	}
+
+	release = func() {
+		syscall.Unmount(dir, syscall.MNT_DETACH)
+	}
+	return dir, release, nil
+}
@@ -0,0 +1,185 @@
+package runner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestShmSize checks that the shared memory of an experiment comes from its request, or the
+// runners default when it asks for none, and that invalid values are rejected
+//
+func TestShmSize(t *testing.T) {
+
+	saved := *defaultShmOpt
+	defer func() { *defaultShmOpt = saved }()
+
+	for _, tc := range []struct {
+		shm      string
+		fallback string
+		size     uint64
+		fails    bool
+	}{
+		{},
+		{fallback: "2gb", size: 2 * 1000 * 1000 * 1000},
+		{shm: "512MiB", fallback: "2gb", size: 512 * 1024 * 1024},
+		{shm: "lots", fails: true},
+		{fallback: "lots", fails: true},
+	} {
+		*defaultShmOpt = tc.fallback
+		size, err := ShmSize(&Resource{Shm: tc.shm})
+		if (err != nil) != tc.fails {
+			t.Fatalf("shm %q with default %q failed %v, expected %v", tc.shm, tc.fallback, err, tc.fails)
+		}
+		if size != tc.size {
+			t.Fatalf("shm %q with default %q was %d bytes, expected %d", tc.shm, tc.fallback, size, tc.size)
+		}
+	}
+}
+
+// TestShmFit checks that the shared memory of an experiment is counted against the RAM of the
+// node, as a tmpfs holds its files in RAM
+//
+func TestShmFit(t *testing.T) {
+
+	saved := *defaultShmOpt
+	defer func() { *defaultShmOpt = saved }()
+	*defaultShmOpt = ""
+
+	node := &Resource{Cpus: 4, Ram: "8gb", Hdd: "10gb"}
+
+	for _, tc := range []struct {
+		ram      string
+		shm      string
+		fallback string
+		fits     bool
+	}{
+		{ram: "6gb", fits: true},
+		{ram: "6gb", shm: "2gb", fits: true},
+		{ram: "6gb", shm: "3gb", fits: false},
+		{ram: "6gb", fallback: "3gb", fits: false},
+		{ram: "6gb", shm: "1gb", fallback: "3gb", fits: true},
+	} {
+		*defaultShmOpt = tc.fallback
+		fit, err := (&Resource{Cpus: 1, Ram: tc.ram, Hdd: "1gb", Shm: tc.shm}).Fit(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fit != tc.fits {
+			t.Fatalf("ram %s shm %q default %q fit %v, expected %v", tc.ram, tc.shm, tc.fallback, fit, tc.fits)
+		}
+	}
+
+	*defaultShmOpt = ""
+	if _, err := (&Resource{Cpus: 1, Ram: "1gb", Hdd: "1gb", Shm: "lots"}).Fit(node); err == nil {
+		t.Fatal("an invalid shm was fitted")
+	}
+}
+
+// TestProvideShm checks that experiments use /dev/shm when it has enough free space and are
+// otherwise given a private tmpfs of the size they asked for that is removed once released
+//
+func TestProvideShm(t *testing.T) {
+
+	base, errGo := ioutil.TempDir("", "shm-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(base)
+
+	saved := devShm
+	defer func() { devShm = saved }()
+	devShm = base
+
+	for _, size := range []uint64{0, 4096} {
+		dir, release, err := provideShm(base, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if dir != devShm {
+			t.Fatalf("%d bytes of shared memory was provided using %s rather than %s", size, dir, devShm)
+		}
+	}
+
+	// More than the free space forces a private tmpfs
+	size := shmFree(devShm) + 1024*1024
+	dir, release, err := provideShm(base, size)
+	if err != nil {
+		if os.Geteuid() != 0 || strings.Contains(err.Error(), syscall.EPERM.Error()) {
+			t.Skip("mounting a tmpfs requires privileges", err.Error())
+		}
+		t.Fatal(err)
+	}
+	if dir != filepath.Join(base, "shm") {
+		release()
+		t.Fatalf("private shared memory was provided using %s", dir)
+	}
+	fs := syscall.Statfs_t{}
+	if errGo = syscall.Statfs(dir, &fs); errGo != nil {
+		release()
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	release()
+
+	const tmpfsMagic = 0x01021994
+	if fs.Type != tmpfsMagic {
+		t.Fatalf("private shared memory was not a tmpfs, type %x", fs.Type)
+	}
+	if total := fs.Blocks * uint64(fs.Bsize); total < size {
+		t.Fatalf("private shared memory was %d bytes, expected at least %d", total, size)
+	}
+	if errGo = syscall.Statfs(dir, &fs); errGo == nil && fs.Type == tmpfsMagic {
+		t.Fatal("private shared memory was still mounted after being released")
+	}
+}
+
+// TestShmIsolated checks that private shared memory is placed over /dev/shm for the experiment
+// process while the runner continues to see the hosts /dev/shm
+//
+func TestShmIsolated(t *testing.T) {
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating a mount namespace requires privileges")
+	}
+
+	base, errGo := ioutil.TempDir("", "shm-isolated-test")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(base)
+
+	shmDir := filepath.Join(base, "shm")
+	if errGo = os.MkdirAll(shmDir, 0700); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	marker := "studioml-shm-marker"
+	if errGo = ioutil.WriteFile(filepath.Join(shmDir, marker), []byte{}, 0600); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	cmd := exec.Command("/bin/ls", devShm)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	if errGo = startIsolated(cmd, filepath.Join(base, "_tmp"), shmDir); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if errGo = cmd.Wait(); errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	if !strings.Contains(output.String(), marker) {
+		t.Skip("a mount namespace could not be created", output.String())
+	}
+
+	if _, errGo = os.Stat(filepath.Join(devShm, marker)); errGo == nil {
+		t.Fatal("the private shared memory was mounted over the runners /dev/shm")
+	}
+}
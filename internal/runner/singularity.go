@@ -27,6 +27,9 @@ type Singularity struct {
 	Request   *Request
 	BaseDir   string
 	BaseImage string
+	Output    *OutputCap // Optional limit on the size of the output captured from the experiment
+
+	result *ExperimentResult // The final status of the experiment, nil until it has been run
 }
 
 func NewSingularity(rqst *Request, dir string) (sing *Singularity, err errors.Error) {
@@ -34,6 +37,7 @@ func NewSingularity(rqst *Request, dir string) (sing *Singularity, err errors.Er
 	sing = &Singularity{
 		Request: rqst,
 		BaseDir: dir,
+		Output:  NewOutputCap(),
 	}
 
 	art, isPresent := rqst.Experiment.Artifacts["_singularity"]
@@ -122,7 +126,7 @@ ai.sentient.version 0.0
 {{range $key, $value := .E.Request.Config.Env}}
     echo 'export {{$key}}="{{$value}}"' >> $SINGULARITY_ENVIRONMENT
 {{end}}
-{{range $key, $value := .E.ExprEnvs}}
+{{range $key, $value := .E.ExperimentEnvs}}
     echo 'export {{$key}}="{{$value}}"' >> $SINGULARITY_ENVIRONMENT
 {{end}}
     echo 'export LD_LIBRARY_PATH=$LD_LIBRARY_PATH:/usr/local/cuda/lib64/:/usr/lib/x86_64-linux-gnu:/lib/x86_64-linux-gnu/' >> $SINGULARITY_ENVIRONMENT
@@ -225,22 +229,33 @@ func (s *Singularity) runBuildScript(script string) (err errors.Error) {
 		}
 	}()
 
-	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, reporterC)
+	// The result of building the image is not the result of the experiment and is only retained
+	// in the output
+	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, s.Output, s.Request, &ExperimentResult{}, reporterC)
 }
 
 func (s *Singularity) makeExecScript(e interface{}) (fn string, err errors.Error) {
 
 	fn = filepath.Join(s.BaseDir, "_runner", "exec.sh")
 
+	// Experiments are given their own directory in place of the hosts /tmp
+	tmpDir, _, err := provideTmp(s.BaseDir)
+	if err != nil {
+		return "", err
+	}
+
 	params := struct {
 		Dir string
+		Tmp string
 	}{
 		Dir: filepath.Join(s.BaseDir, "_runner"),
+		Tmp: tmpDir,
 	}
 
+	// Private shared memory provided when the experiment is run is bound over /dev/shm
 	tmpl, errGo := template.New("singularityRunner").Parse(
 		`#!/bin/bash -x
-singularity run --home {{.Dir}} -B /tmp:/tmp -B /usr/local/cuda:/usr/local/cuda -B /usr/lib/nvidia-384:/usr/lib/nvidia-384 --nv {{.Dir}}/runner.img
+singularity run --home {{.Dir}} -B {{.Tmp}}:/tmp ${STUDIOML_SHM:+-B ${STUDIOML_SHM}:/dev/shm} -B /usr/local/cuda:/usr/local/cuda -B /usr/lib/nvidia-384:/usr/lib/nvidia-384 --nv {{.Dir}}/runner.img
 `)
 
 	if errGo != nil {
@@ -294,6 +309,28 @@ func (s *Singularity) Run(ctx context.Context, refresh map[string]Artifact) (err
 	outputFN := filepath.Join(s.BaseDir, "output", "output")
 	script := filepath.Join(s.BaseDir, "_runner", "exec.sh")
 
+	// The space used by the experiments temporary files is released as soon as it stops
+	tmpDir, tmpRelease, err := provideTmp(s.BaseDir)
+	if err != nil {
+		return err
+	}
+	defer tmpRelease()
+
+	// Make sure the experiment has the shared memory it asked for, a private tmpfs is bound
+	// over /dev/shm inside the container by the exec script
+	shmSize, err := ShmSize(&s.Request.Experiment.Resource)
+	if err != nil {
+		return err
+	}
+	shmDir, shmRelease, err := provideShm(tmpDir, shmSize)
+	if err != nil {
+		return err
+	}
+	defer shmRelease()
+	if shmDir != devShm {
+		script = "export STUDIOML_SHM=" + shmDir + " SINGULARITYENV_STUDIOML_SHM=" + devShm + "; " + script
+	}
+
 	reporterC := make(chan *string)
 	defer close(reporterC)
 
@@ -308,10 +345,16 @@ func (s *Singularity) Run(ctx context.Context, refresh map[string]Artifact) (err
 		}
 	}()
 
-	return runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, reporterC)
+	result := ExperimentResult{}
+	err = runWait(ctx, script, filepath.Join(s.BaseDir, "_runner"), outputFN, s.Output, s.Request, &result, reporterC)
+	s.result = &result
+	return err
 }
 
-func runWait(ctx context.Context, script string, dir string, outputFN string, errorC chan *string) (err errors.Error) {
+// runWait runs the script and waits for it to stop, the final status of the experiment is
+// written to the result line of the output and into result
+//
+func runWait(ctx context.Context, script string, dir string, outputFN string, outCap *OutputCap, rqst *Request, result *ExperimentResult, errorC chan *string) (err errors.Error) {
 
 	stopCopy, stopCopyCancel := context.WithCancel(context.Background())
 	// defers are stacked in LIFO order so cancelling this context is the last
@@ -323,6 +366,19 @@ func runWait(ctx context.Context, script string, dir string, outputFN string, er
 	//
 	cmd := exec.Command("/bin/bash", "-c", script)
 	cmd.Dir = dir
+	cmd.Env = ExperimentEnv(nil)
+
+	// Restricted experiments reach the network through a proxy that only forwards to the
+	// hosts they are permitted to use, containers share the network of the host so the
+	// proxy on the loopback interface can be reached from within them
+	egress, err := startEgressProxy(rqst)
+	if err != nil {
+		return err.With("experiment_id", rqst.Experiment.Key)
+	}
+	if egress != nil {
+		defer egress.Close()
+		cmd.Env = append(cmd.Env, egress.env()...)
+	}
 
 	stdout, errGo := cmd.StdoutPipe()
 	if errGo != nil {
@@ -343,11 +399,34 @@ func runWait(ctx context.Context, script string, dir string, outputFN string, er
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("outputFN", outputFN)
 	}
 
-	go procOutput(stopCopy, f, outC, errC)
+	tee, warns := NewOutputTee(f, outCap, rqst)
+	for _, warn := range warns {
+		f.WriteString(fmt.Sprintf("[studioml] output sink not used %v\n", warn.Error()))
+	}
+	outputDone := make(chan struct{})
+	go func() {
+		procOutput(stopCopy, tee, outC, errC)
+		close(outputDone)
+	}()
+
+	// The result line is written once the other output has been, even if the experiment was
+	// killed, so that it is always the last line of the output
+	defer func() {
+		stopCopyCancel()
+		<-outputDone
+		*result = NewExperimentResult(ctx, err)
+		if _, errResult := tee.Finish(*result, *outputSinkWaitOpt); errResult != nil && err == nil {
+			err = errResult
+		}
+	}()
 
-	if errGo = cmd.Start(); err != nil {
+	started := time.Now()
+	if errGo = cmd.Start(); errGo != nil {
 		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
 	}
+	if errCores := limitCores(cmd.Process.Pid); errCores != nil {
+		errC <- "[studioml] core dumps not enabled " + errCores.Error()
+	}
 
 	waitOnIO := sync.WaitGroup{}
 	waitOnIO.Add(2)
@@ -412,6 +491,11 @@ func runWait(ctx context.Context, script string, dir string, outputFN string, er
 
 	waitOnIO.Wait()
 
+	// Cores left behind by an experiment that crashed are kept for debugging
+	if _, errCores := captureCores(filepath.Dir(dir), []string{filepath.Join(filepath.Dir(dir), "workspace"), dir}, cmd.ProcessState, started); errCores != nil {
+		errC <- "[studioml] core dumps not captured " + errCores.Error()
+	}
+
 	if err == nil && ctx.Err() != nil {
 		err = errors.Wrap(ctx.Err()).With("stack", stack.Trace().TrimRuntime())
 	}
@@ -419,6 +503,20 @@ func runWait(ctx context.Context, script string, dir string, outputFN string, er
 	return err
 }
 
+// OutputTruncated returns true when output from the experiment was discarded because it
+// exceeded the output limit
+//
+func (s *Singularity) OutputTruncated() (truncated bool) {
+	return s.Output.Truncated()
+}
+
+// Result returns the final status of the experiment as written to its result line, nil is
+// returned when the experiment was not run
+//
+func (s *Singularity) Result() (result *ExperimentResult) {
+	return s.result
+}
+
 func (*Singularity) Close() (err errors.Error) {
 	return nil
 }
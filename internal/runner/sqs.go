@@ -9,10 +9,13 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 
@@ -22,13 +25,21 @@ import (
 
 var (
 	sqsTimeoutOpt = flag.Duration("sqs-timeout", time.Duration(15*time.Second), "the period of time for discrete SQS operations to use for timeouts")
+	sqsBatchOpt   = flag.Int("sqs-batch", 1, "the maximum number of messages, up to 10, received from an SQS queue at a time, the experiments in a batch are run one after another")
 )
 
-// SQS encapsulates an AWS based SQS queue and associated it with a project
+// SQS encapsulates the AWS based SQS queues, across one or more accounts and regions, and
+// associates them with a project
 //
 type SQS struct {
 	project string
-	creds   *AWSCred
+	creds   []*AWSCred // The credentials of each account and region serviced
+
+	// The credentials each subscription was found using, and the subscriptions found using
+	// each set of credentials on the last refresh that succeeded
+	routes map[string]*AWSCred
+	found  map[*AWSCred][]string
+	sync.Mutex
 }
 
 // NewSQS creates an SQS data structure using set set of credentials (creds) for
@@ -36,9 +47,9 @@ type SQS struct {
 //
 func NewSQS(project string, creds string) (sqs *SQS, err errors.Error) {
 	// Use the creds directory to locate all of the credentials for AWS within
-	// a hierarchy of directories
-
-	awsCreds, err := AWSExtractCreds(strings.Split(creds, ","))
+	// a hierarchy of directories, each profile within the credentials becoming a distinct
+	// set of credentials for an account and region
+	awsCreds, err := AWSExtractCredSets(strings.Split(creds, ","))
 	if err != nil {
 		return nil, err
 	}
@@ -46,26 +57,37 @@ func NewSQS(project string, creds string) (sqs *SQS, err errors.Error) {
 	return &SQS{
 		project: project,
 		creds:   awsCreds,
+		routes:  map[string]*AWSCred{},
+		found:   map[*AWSCred][]string{},
 	}, nil
 }
 
-func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutput, err errors.Error) {
-
+// sqsService creates an SQS client for the account and region of a set of credentials
+//
+func sqsService(cred *AWSCred) (svc *sqs.SQS, err errors.Error) {
 	sess, errGo := session.NewSessionWithOptions(session.Options{
 		Config: aws.Config{
-			Region:                        aws.String(sq.creds.Region),
-			Credentials:                   sq.creds.Creds,
+			Region:                        aws.String(cred.Region),
+			Credentials:                   cred.Creds,
 			CredentialsChainVerboseErrors: aws.Bool(true),
 		},
-		Profile: "default",
+		Profile: cred.Profile,
 	})
 
 	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("region", cred.Region, "profile", cred.Profile)
 	}
 
 	// Create a SQS service client.
-	svc := sqs.New(sess)
+	return sqs.New(sess), nil
+}
+
+func (sq *SQS) listQueues(cred *AWSCred, qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutput, err errors.Error) {
+
+	svc, err := sqsService(cred)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), *sqsTimeoutOpt)
 	defer cancel()
@@ -74,7 +96,7 @@ func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutp
 
 	qs, errGo := svc.ListQueuesWithContext(ctx, listParam)
 	if errGo != nil {
-		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("region", cred.Region, "profile", cred.Profile)
 	}
 	if qNameMatch == nil {
 		return qs, nil
@@ -90,7 +112,7 @@ func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutp
 		}
 		fullURL, errGo := url.Parse(*qURL)
 		if errGo != nil {
-			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+			return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("region", cred.Region, "profile", cred.Profile)
 		}
 		paths := strings.Split(fullURL.Path, "/")
 		if qNameMatch.MatchString(paths[len(paths)-1]) {
@@ -100,11 +122,11 @@ func (sq *SQS) listQueues(qNameMatch *regexp.Regexp) (queues *sqs.ListQueuesOutp
 	return queues, nil
 }
 
-func (sq *SQS) refresh(qNameMatch *regexp.Regexp) (known []string, err errors.Error) {
+func (sq *SQS) refresh(cred *AWSCred, qNameMatch *regexp.Regexp) (known []string, err errors.Error) {
 
 	known = []string{}
 
-	result, err := sq.listQueues(qNameMatch)
+	result, err := sq.listQueues(cred, qNameMatch)
 	if err != nil {
 		return known, err
 	}
@@ -123,35 +145,81 @@ func (sq *SQS) refresh(qNameMatch *regexp.Regexp) (known []string, err errors.Er
 // Refresh uses a regular expression to obtain matching queues from
 // the configured SQS server on AWS (sqs).
 //
+// Every set of credentials is used in turn and the subscriptions are keyed using the region
+// and the queue URL, which contains the account.  A queue visible to more than one set of
+// credentials is serviced using the first of them.  Should listing the queues using one set
+// of credentials fail the queues it found on its last successful refresh are kept so that
+// the failure of one account does not stop the others from being serviced, an error is
+// only returned when there are no queues that can be reported for a failed set.
+//
 func (sq *SQS) Refresh(ctx context.Context, qNameMatch *regexp.Regexp) (known map[string]interface{}, err errors.Error) {
 
-	found, err := sq.refresh(qNameMatch)
-	if err != nil {
-		return known, err
-	}
+	sq.Lock()
+	defer sq.Unlock()
+
+	routes := map[string]*AWSCred{}
+	known = map[string]interface{}{}
+
+	for _, cred := range sq.creds {
+		found, errRefresh := sq.refresh(cred, qNameMatch)
+		if errRefresh != nil {
+			previous, isPresent := sq.found[cred]
+			if !isPresent {
+				return nil, errRefresh
+			}
+			found = previous
+		}
+		sq.found[cred] = found
 
-	known = make(map[string]interface{}, len(found))
-	for _, url := range found {
-		known[fmt.Sprintf("%s:%s", sq.creds.Region, url)] = sq.creds
+		for _, url := range found {
+			key := fmt.Sprintf("%s:%s", cred.Region, url)
+			if _, isPresent := routes[key]; isPresent {
+				continue
+			}
+			routes[key] = cred
+			known[key] = cred
+		}
 	}
+	sq.routes = routes
 
 	return known, nil
 }
 
+// credsFor returns the credentials used to service a subscription.  Subscriptions not yet
+// seen by a refresh use the first set of credentials for the region of the subscription.
+//
+func (sq *SQS) credsFor(subscription string) (cred *AWSCred, err errors.Error) {
+	sq.Lock()
+	defer sq.Unlock()
+
+	if cred, isPresent := sq.routes[subscription]; isPresent {
+		return cred, nil
+	}
+	region := strings.SplitN(subscription, ":", 2)[0]
+	for _, cred := range sq.creds {
+		if cred.Region == region {
+			return cred, nil
+		}
+	}
+	return nil, errors.New("no credentials for the region of the subscription").With("subscription", subscription, "region", region).With("stack", stack.Trace().TrimRuntime())
+}
+
 // Exists tests for the presence of a subscription, typically a queue name
 // on the configured sqs server.
 //
 func (sq *SQS) Exists(ctx context.Context, subscription string) (exists bool, err errors.Error) {
 
-	queues, err := sq.listQueues(nil)
-	if err != nil {
-		return true, err
-	}
+	for _, cred := range sq.creds {
+		queues, err := sq.listQueues(cred, nil)
+		if err != nil {
+			return true, err
+		}
 
-	for _, q := range queues.QueueUrls {
-		if q != nil {
-			if strings.HasSuffix(subscription, *q) {
-				return true, nil
+		for _, q := range queues.QueueUrls {
+			if q != nil {
+				if strings.HasSuffix(subscription, *q) {
+					return true, nil
+				}
 			}
 		}
 	}
@@ -164,23 +232,21 @@ func (sq *SQS) Exists(ctx context.Context, subscription string) (exists bool, er
 func (sq *SQS) Work(ctx context.Context, qt *QueueTask) (msgCnt uint64, resource *Resource, err errors.Error) {
 
 	regionUrl := strings.SplitN(qt.Subscription, ":", 2)
+	if len(regionUrl) != 2 {
+		return 0, nil, errors.New("subscription lacks a region").With("subscription", qt.Subscription).With("stack", stack.Trace().TrimRuntime())
+	}
 	url := regionUrl[1]
 
-	sess, errGo := session.NewSessionWithOptions(session.Options{
-		Config: aws.Config{
-			Region:                        aws.String(sq.creds.Region),
-			Credentials:                   sq.creds.Creds,
-			CredentialsChainVerboseErrors: aws.Bool(true),
-		},
-		Profile: "default",
-	})
-
-	if errGo != nil {
-		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+	// Messages are received using the credentials of the account and region the queue was
+	// found in
+	cred, err := sq.credsFor(qt.Subscription)
+	if err != nil {
+		return 0, nil, err
+	}
+	svc, err := sqsService(cred)
+	if err != nil {
+		return 0, nil, err
 	}
-
-	// Create a SQS service client.
-	svc := sqs.New(sess)
 
 	defer func() {
 		defer func() {
@@ -188,72 +254,224 @@ func (sq *SQS) Work(ctx context.Context, qt *QueueTask) (msgCnt uint64, resource
 		}()
 	}()
 
+	// SQS limits visibility timeouts to 12 hours, the extender below also needs a timeout of
+	// at least a couple of seconds
 	visTimeout := int64(30)
+	if qt.AckWindow != 0 {
+		visTimeout = int64(qt.AckWindow.Seconds())
+		if visTimeout > 12*60*60 {
+			visTimeout = 12 * 60 * 60
+		}
+		if visTimeout < 2 {
+			visTimeout = 2
+		}
+	}
 	waitTimeout := int64(5)
+	batchSize := int64(*sqsBatchOpt)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if batchSize > 10 {
+		batchSize = 10
+	}
 	msgs, errGo := svc.ReceiveMessageWithContext(ctx,
 		&sqs.ReceiveMessageInput{
-			QueueUrl:          &url,
-			VisibilityTimeout: &visTimeout,
-			WaitTimeSeconds:   &waitTimeout,
+			QueueUrl:              &url,
+			VisibilityTimeout:     &visTimeout,
+			WaitTimeSeconds:       &waitTimeout,
+			MaxNumberOfMessages:   &batchSize,
+			MessageAttributeNames: []*string{aws.String("All")},
+			AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount)},
 		})
 	if errGo != nil {
-		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
+		return 0, nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()).With("region", cred.Region, "profile", cred.Profile)
 	}
 	if len(msgs.Messages) == 0 {
 		return 0, nil, nil
 	}
 
-	// Make sure that the main ctx has not been Done with before continuing
-	select {
-	case <-ctx.Done():
-		return 0, nil, errors.New("queue worker cancel received").With("stack", stack.Trace().TrimRuntime()).With("credentials", sq.creds)
-	default:
+	// The messages in a batch are processed one after another, and the outcome of each is
+	// recorded so that once the batch is done only the messages that failed are returned
+	// to the queue
+	outcomes := make([]sqsOutcome, len(msgs.Messages))
+	for i, msg := range msgs.Messages {
+		outcomes[i].handle = msg.ReceiptHandle
 	}
+	outcomesLock := sync.Mutex{}
 
 	// Start a visbility timeout extender that runs until the work is done
 	// Changing the timeout restarts the timer on the SQS side, for more information
 	// see http://docs.aws.amazon.com/AWSSimpleQueueService/latest/SQSDeveloperGuide/sqs-visibility-timeout.html
 	//
+	// The extender is stopped, and waited for, on every return path so that it cannot continue
+	// to extend the messages after they have been dealt with
+	//
 	quitC := make(chan struct{})
+	doneC := make(chan struct{})
+	stopOnce := sync.Once{}
+	stopExtender := func() {
+		stopOnce.Do(func() {
+			close(quitC)
+			<-doneC
+		})
+	}
+	defer stopExtender()
+
 	go func() {
+		defer close(doneC)
+
 		timeout := time.Duration(int(visTimeout / 2))
 		for {
 			select {
 			case <-time.After(timeout * time.Second):
-				svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
-					QueueUrl:          &url,
-					ReceiptHandle:     msgs.Messages[0].ReceiptHandle,
-					VisibilityTimeout: &visTimeout,
-				})
+				outcomesLock.Lock()
+				handles := make([]*string, 0, len(outcomes))
+				for _, outcome := range outcomes {
+					handles = append(handles, outcome.handle)
+				}
+				outcomesLock.Unlock()
+				changeVisibility(ctx, svc, url, handles, visTimeout)
+			case <-ctx.Done():
+				return
 			case <-quitC:
 				return
 			}
 		}
 	}()
 
-	qt.Project = sq.project
-	qt.Subscription = url
-	qt.Msg = []byte(*msgs.Messages[0].Body)
+	for i, msg := range msgs.Messages {
+		// Make sure that the main ctx has not been Done with before continuing, messages
+		// that were not processed are returned to the queue
+		select {
+		case <-ctx.Done():
+			stopExtender()
+			if err := settleBatch(context.Background(), svc, url, outcomes); err != nil {
+				return msgCnt, resource, err
+			}
+			return msgCnt, resource, errors.New("queue worker cancel received").With("stack", stack.Trace().TrimRuntime()).With("region", cred.Region, "profile", cred.Profile)
+		default:
+		}
+
+		qt.Project = sq.project
+		qt.Subscription = url
+		qt.Msg = []byte(*msg.Body)
+		qt.Attributes = map[string]string{}
+		for k, v := range msg.MessageAttributes {
+			if v != nil && v.StringValue != nil {
+				qt.Attributes[k] = *v.StringValue
+			}
+		}
+		qt.Deliveries = 0
+		if cnt, isPresent := msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; isPresent && cnt != nil {
+			if deliveries, errGo := strconv.ParseUint(*cnt, 10, 32); errGo == nil {
+				qt.Deliveries = uint(deliveries)
+			}
+		}
+
+		rsc, ack := qt.Handler(ctx, qt)
+		msgCnt++
+
+		outcomesLock.Lock()
+		outcomes[i].ack = ack
+		outcomesLock.Unlock()
+
+		if ack {
+			resource = rsc
+		}
+	}
+	stopExtender()
+
+	return msgCnt, resource, settleBatch(context.Background(), svc, url, outcomes)
+}
+
+// sqsOutcome records the fate of a single message from a batch
+//
+type sqsOutcome struct {
+	handle *string
+	ack    bool
+}
+
+// sqsBatcher has the SQS operations used to deal with a batch of messages
+//
+type sqsBatcher interface {
+	DeleteMessageBatchWithContext(ctx aws.Context, input *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatchWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error)
+}
+
+// settleBatch deletes the messages from a batch that were acked, and returns to the queue, by
+// resetting their visibility, those that were not so that a single failure does not cause
+// the entire batch to be redelivered
+//
+func settleBatch(ctx context.Context, svc sqsBatcher, url string, outcomes []sqsOutcome) (err errors.Error) {
+	ctx, cancel := context.WithTimeout(ctx, *sqsTimeoutOpt)
+	defer cancel()
 
-	rsc, ack := qt.Handler(ctx, qt)
-	close(quitC)
+	acked := []*sqs.DeleteMessageBatchRequestEntry{}
+	for i, outcome := range outcomes {
+		if outcome.ack {
+			acked = append(acked, &sqs.DeleteMessageBatchRequestEntry{
+				Id:            aws.String(strconv.Itoa(i)),
+				ReceiptHandle: outcome.handle,
+			})
+		}
+	}
+	nacked := []*string{}
+	for _, outcome := range outcomes {
+		if !outcome.ack {
+			nacked = append(nacked, outcome.handle)
+		}
+	}
 
-	if ack {
-		// Delete the message
-		svc.DeleteMessage(&sqs.DeleteMessageInput{
-			QueueUrl:      &url,
-			ReceiptHandle: msgs.Messages[0].ReceiptHandle,
+	if len(acked) != 0 {
+		deleted, errGo := svc.DeleteMessageBatchWithContext(ctx, &sqs.DeleteMessageBatchInput{
+			QueueUrl: &url,
+			Entries:  acked,
 		})
-		resource = rsc
-	} else {
-		// Set visibility timeout to 0, in otherwords Nack the message
-		visTimeout = 0
-		svc.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
-			QueueUrl:          &url,
-			ReceiptHandle:     msgs.Messages[0].ReceiptHandle,
-			VisibilityTimeout: &visTimeout,
+		if errGo != nil {
+			err = errors.Wrap(errGo).With("queue", url).With("stack", stack.Trace().TrimRuntime())
+		} else if len(deleted.Failed) != 0 {
+			err = batchFailure("messages could not be deleted", url, deleted.Failed)
+		}
+	}
+
+	if len(nacked) != 0 {
+		// Set visibility timeout to 0, in otherwords Nack the messages
+		if nackErr := changeVisibility(ctx, svc, url, nacked, 0); nackErr != nil && err == nil {
+			err = nackErr
+		}
+	}
+	return err
+}
+
+// changeVisibility changes the visibility timeout of a set of messages, from the same
+// receive, using a single request
+//
+func changeVisibility(ctx context.Context, svc sqsBatcher, url string, handles []*string, timeout int64) (err errors.Error) {
+	entries := make([]*sqs.ChangeMessageVisibilityBatchRequestEntry, 0, len(handles))
+	for i, handle := range handles {
+		entries = append(entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     handle,
+			VisibilityTimeout: aws.Int64(timeout),
 		})
 	}
+	changed, errGo := svc.ChangeMessageVisibilityBatchWithContext(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: &url,
+		Entries:  entries,
+	})
+	if errGo != nil {
+		return errors.Wrap(errGo).With("queue", url).With("stack", stack.Trace().TrimRuntime())
+	}
+	if len(changed.Failed) != 0 {
+		return batchFailure("message visibility could not be changed", url, changed.Failed)
+	}
+	return nil
+}
 
-	return 1, resource, nil
+func batchFailure(msg string, url string, failed []*sqs.BatchResultErrorEntry) (err errors.Error) {
+	codes := make([]string, 0, len(failed))
+	for _, entry := range failed {
+		codes = append(codes, aws.StringValue(entry.Code))
+	}
+	return errors.New(msg).With("queue", url, "failed", len(failed), "codes", strings.Join(codes, ",")).With("stack", stack.Trace().TrimRuntime())
 }
@@ -0,0 +1,181 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// fakeBatcher records the batch operations requested of SQS, failing those receipt handles
+// that it has been told to
+//
+type fakeBatcher struct {
+	deleted   []string
+	nacked    []string
+	rejecting map[string]bool
+}
+
+func (fb *fakeBatcher) DeleteMessageBatchWithContext(ctx aws.Context, input *sqs.DeleteMessageBatchInput, opts ...request.Option) (*sqs.DeleteMessageBatchOutput, error) {
+	out := &sqs.DeleteMessageBatchOutput{}
+	for _, entry := range input.Entries {
+		if fb.rejecting[*entry.ReceiptHandle] {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{Id: entry.Id, Code: aws.String("ReceiptHandleIsInvalid")})
+			continue
+		}
+		fb.deleted = append(fb.deleted, *entry.ReceiptHandle)
+	}
+	return out, nil
+}
+
+func (fb *fakeBatcher) ChangeMessageVisibilityBatchWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityBatchInput, opts ...request.Option) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	for _, entry := range input.Entries {
+		if *entry.VisibilityTimeout == 0 {
+			fb.nacked = append(fb.nacked, *entry.ReceiptHandle)
+		}
+	}
+	return &sqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+func sqsOutcomes(acks ...bool) (outcomes []sqsOutcome) {
+	handles := []string{"a", "b", "c", "d", "e"}
+	for i, ack := range acks {
+		outcomes = append(outcomes, sqsOutcome{handle: aws.String(handles[i]), ack: ack})
+	}
+	return outcomes
+}
+
+// TestSQSSettleBatch checks that a batch with a mix of outcomes deletes only the messages
+// that succeeded and returns only those that failed to the queue
+//
+func TestSQSSettleBatch(t *testing.T) {
+	fb := &fakeBatcher{}
+	if err := settleBatch(context.Background(), fb, "queue", sqsOutcomes(true, false, true, false, false)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.deleted) != 2 || fb.deleted[0] != "a" || fb.deleted[1] != "c" {
+		t.Fatalf("unexpected messages deleted %v", fb.deleted)
+	}
+	if len(fb.nacked) != 3 || fb.nacked[0] != "b" || fb.nacked[1] != "d" || fb.nacked[2] != "e" {
+		t.Fatalf("unexpected messages returned to the queue %v", fb.nacked)
+	}
+
+	// Batches with a single outcome use only the one operation
+	fb = &fakeBatcher{}
+	if err := settleBatch(context.Background(), fb, "queue", sqsOutcomes(true, true)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.deleted) != 2 || len(fb.nacked) != 0 {
+		t.Fatalf("successful batch deleted %v, returned %v", fb.deleted, fb.nacked)
+	}
+
+	fb = &fakeBatcher{}
+	if err := settleBatch(context.Background(), fb, "queue", sqsOutcomes(false, false)); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.deleted) != 0 || len(fb.nacked) != 2 {
+		t.Fatalf("failed batch deleted %v, returned %v", fb.deleted, fb.nacked)
+	}
+
+	// Entries SQS fails within a batch are reported while the remainder are still settled
+	fb = &fakeBatcher{rejecting: map[string]bool{"a": true}}
+	if err := settleBatch(context.Background(), fb, "queue", sqsOutcomes(true, true, false)); err == nil {
+		t.Fatal("a failed delete was not reported")
+	}
+	if len(fb.deleted) != 1 || fb.deleted[0] != "b" || len(fb.nacked) != 1 || fb.nacked[0] != "c" {
+		t.Fatalf("partially failed batch deleted %v, returned %v", fb.deleted, fb.nacked)
+	}
+}
+
+// TestSQSCredSets checks that every profile of the credential files supplied to SQS becomes a
+// set of credentials with its own region, and that subscriptions use the credentials of the
+// account and region they were found in
+//
+func TestSQSCredSets(t *testing.T) {
+
+	dir, errGo := ioutil.TempDir("", "sqs-creds")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(fn string, content string) string {
+		fn = filepath.Join(dir, fn)
+		if errGo := os.MkdirAll(filepath.Dir(fn), 0700); errGo != nil {
+			t.Fatal(errGo)
+		}
+		if errGo := ioutil.WriteFile(fn, []byte(content), 0600); errGo != nil {
+			t.Fatal(errGo)
+		}
+		return fn
+	}
+
+	files := []string{
+		write("multi/config", "[default]\nregion = us-west-2\n\n[profile eu]\nregion=eu-west-1\n\n[profile shared]\noutput = json\n"),
+		write("multi/credentials", "[eu]\naws_access_key_id = EU\naws_secret_access_key = eu\n[default]\naws_access_key_id = US\naws_secret_access_key = us\n[shared]\naws_access_key_id = SH\naws_secret_access_key = sh\n"),
+		write("legacy/credentials", "[default]\naws_access_key_id = AP\naws_secret_access_key = ap\n"),
+		write("legacy/config", "region=ap-south-1\n"),
+	}
+
+	sq, err := NewSQS("project", strings.Join(files, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		profile string
+		region  string
+		key     string
+	}{
+		{profile: "default", region: "us-west-2", key: "US"},
+		{profile: "eu", region: "eu-west-1", key: "EU"},
+		{profile: "shared", region: "us-west-2", key: "SH"},
+		{profile: "default", region: "ap-south-1", key: "AP"},
+	}
+	if len(sq.creds) != len(expected) {
+		t.Fatalf("expected %d sets of credentials, found %d", len(expected), len(sq.creds))
+	}
+	for i, cred := range sq.creds {
+		if cred.Profile != expected[i].profile || cred.Region != expected[i].region {
+			t.Fatalf("unexpected credentials %d %s %s, expected %+v", i, cred.Profile, cred.Region, expected[i])
+		}
+		value, errGo := cred.Creds.Get()
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		if value.AccessKeyID != expected[i].key {
+			t.Fatalf("credentials %d loaded access key %s, expected %s", i, value.AccessKeyID, expected[i].key)
+		}
+	}
+
+	// Subscriptions found by a refresh use the credentials that found them, a queue in another
+	// account of the same region is not confused with it
+	eu := "eu-west-1:https://sqs.eu-west-1.amazonaws.com/222222222222/rmq_eu"
+	shared := "us-west-2:https://sqs.us-west-2.amazonaws.com/333333333333/rmq_shared"
+	sq.routes = map[string]*AWSCred{eu: sq.creds[1], shared: sq.creds[2]}
+
+	for subscription, want := range map[string]*AWSCred{
+		eu:     sq.creds[1],
+		shared: sq.creds[2],
+		"us-west-2:https://sqs.us-west-2.amazonaws.com/111111111111/rmq_new":  sq.creds[0],
+		"ap-south-1:https://sqs.ap-south-1.amazonaws.com/444444444444/rmq_ap": sq.creds[3],
+	} {
+		cred, err := sq.credsFor(subscription)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred != want {
+			t.Fatalf("subscription %s used the %s %s credentials", subscription, cred.Profile, cred.Region)
+		}
+	}
+
+	if _, err = sq.credsFor("sa-east-1:https://sqs.sa-east-1.amazonaws.com/555555555555/rmq_sa"); err == nil {
+		t.Fatal("subscription in a region without credentials was serviced")
+	}
+}
@@ -0,0 +1,51 @@
+package runner
+
+// This file contains the implementation of a policy used to decide if output
+// written by an experiment to stderr should be treated as a failure
+
+import (
+	"regexp"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// StderrPolicy controls how lines written to stderr by an experiment influence the
+// success of the experiment.  Any line matching one of the Fail expressions will cause
+// the experiment to fail even when the exit code was zero, without a policy stderr is
+// never used to judge the experiment.
+//
+type StderrPolicy struct {
+	Fail []*regexp.Regexp
+}
+
+// NewStderrPolicy compiles the supplied regular expressions into a policy
+//
+func NewStderrPolicy(patterns []string) (policy *StderrPolicy, err errors.Error) {
+	policy = &StderrPolicy{
+		Fail: make([]*regexp.Regexp, 0, len(patterns)),
+	}
+	for _, pattern := range patterns {
+		re, errGo := regexp.Compile(pattern)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo).With("pattern", pattern).With("stack", stack.Trace().TrimRuntime())
+		}
+		policy.Fail = append(policy.Fail, re)
+	}
+	return policy, nil
+}
+
+// failure returns the expression that the line matched when the line should cause the
+// experiment to be considered as having failed, or an empty string otherwise
+//
+func (policy *StderrPolicy) failure(line string) (pattern string) {
+	if policy == nil {
+		return ""
+	}
+	for _, re := range policy.Fail {
+		if re.MatchString(line) {
+			return re.String()
+		}
+	}
+	return ""
+}
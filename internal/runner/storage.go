@@ -56,6 +56,7 @@ type StoreOpts struct {
 	Creds     string // The credentials file name
 	Env       map[string]string
 	Validate  bool
+	Tags      map[string]string // The tags applied to uploaded objects, see UploadTags
 }
 
 // NewStorage is used to create a receiver for a storage implementation
@@ -66,6 +67,11 @@ func NewStorage(ctx context.Context, spec *StoreOpts) (stor Storage, err errors.
 		return nil, errors.Wrap(err, "empty specification supplied").With("stack", stack.Trace().TrimRuntime())
 	}
 
+	// Transfers using buckets that operators have not approved are refused
+	if err = CheckArtifactAllowed(spec.Art); err != nil {
+		return nil, err
+	}
+
 	uri, errGo := url.ParseRequestURI(spec.Art.Qualified)
 	if errGo != nil {
 		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
@@ -73,7 +79,15 @@ func NewStorage(ctx context.Context, spec *StoreOpts) (stor Storage, err errors.
 
 	switch uri.Scheme {
 	case "gs":
-		return NewGSstorage(ctx, spec.ProjectID, spec.Creds, spec.Env, spec.Art.Bucket, spec.Validate)
+		s, err := NewGSstorage(ctx, spec.ProjectID, spec.Creds, spec.Env, spec.Art.Bucket, spec.Validate)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.pinVersion(spec.Art.Version); err != nil {
+			return nil, err
+		}
+		s.tags = spec.Tags
+		return s, nil
 	case "s3":
 		uriPath := strings.Split(uri.EscapedPath(), "/")
 		if len(spec.Art.Key) == 0 {
@@ -89,8 +103,14 @@ func NewStorage(ctx context.Context, spec *StoreOpts) (stor Storage, err errors.
 
 		useSSL := uri.Scheme == "https"
 
-		return NewS3storage(ctx, spec.ProjectID, spec.Creds, spec.Env, uri.Host,
+		s, err := NewS3storage(ctx, spec.ProjectID, spec.Creds, spec.Env, uri.Host,
 			spec.Art.Bucket, spec.Art.Key, spec.Validate, useSSL)
+		if err != nil {
+			return nil, err
+		}
+		s.version = spec.Art.Version
+		s.tags = spec.Tags
+		return s, nil
 
 	case "file":
 		return NewLocalStorage()
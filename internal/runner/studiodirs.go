@@ -0,0 +1,65 @@
+package runner
+
+// This file contains the implementation of the directory layout studioml expects beneath its
+// home directory.  The directories are created by the runner, rather than by the scripts
+// it generates, so that failures are reported as errors and the directories used only by
+// a single experiment are removed along with its working directory.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// StudioDirs are the directories used by studioml within experiments
+//
+type StudioDirs struct {
+	Home      string // The STUDIOML_HOME directory shared by the experiments on the runner
+	BlobCache string // Cache of blobs shared by the experiments on the runner
+	Queue     string // The local queue directory shared by the experiments on the runner
+	Mappings  string // The artifact mappings directory of the experiment
+}
+
+// NewStudioDirs creates the studioml directory layout beneath the home directory for the
+// experiment
+//
+func NewStudioDirs(home string, key string) (dirs *StudioDirs, err errors.Error) {
+	if len(key) == 0 {
+		return nil, errors.New("experiment key missing").With("home", home).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	dirs = &StudioDirs{
+		Home:      home,
+		BlobCache: filepath.Join(home, "blob-cache"),
+		Queue:     filepath.Join(home, "queue"),
+	}
+
+	mappings := filepath.Join(home, "artifact-mappings")
+	dirs.Mappings = filepath.Join(mappings, key)
+	if !strings.HasPrefix(dirs.Mappings, mappings+string(os.PathSeparator)) {
+		return nil, errors.New("experiment key is not usable as a directory name").With("key", key).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	for _, dir := range []string{dirs.BlobCache, dirs.Queue, dirs.Mappings} {
+		if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+			return nil, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return dirs, nil
+}
+
+// Remove deletes the directories used only by the experiment, those shared with other
+// experiments are kept
+//
+func (dirs *StudioDirs) Remove() (err errors.Error) {
+	if dirs == nil || len(dirs.Mappings) == 0 {
+		return nil
+	}
+	if errGo := os.RemoveAll(dirs.Mappings); errGo != nil {
+		return errors.Wrap(errGo).With("dir", dirs.Mappings).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestStudioDirs checks that the studioml directory layout is created for an experiment, that
+// only the directories belonging to the experiment are removed, and that keys which would
+// escape the layout are rejected
+//
+func TestStudioDirs(t *testing.T) {
+
+	home, errGo := ioutil.TempDir("", "studio-dirs")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(home)
+
+	dirs, err := NewStudioDirs(home, "experiment-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{dirs.BlobCache, dirs.Queue, dirs.Mappings} {
+		info, errGo := os.Stat(dir)
+		if errGo != nil {
+			t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+		}
+		if !info.IsDir() || info.Mode().Perm() != 0700 {
+			t.Fatalf("unexpected studioml directory %s %v", dir, info.Mode())
+		}
+	}
+	if dirs.Mappings != filepath.Join(home, "artifact-mappings", "experiment-1") {
+		t.Fatalf("unexpected artifact mappings directory %s", dirs.Mappings)
+	}
+
+	if err = dirs.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, errGo = os.Stat(dirs.Mappings); !os.IsNotExist(errGo) {
+		t.Fatal("artifact mappings of the experiment were not removed")
+	}
+	for _, dir := range []string{dirs.BlobCache, dirs.Queue} {
+		if _, errGo = os.Stat(dir); errGo != nil {
+			t.Fatalf("shared studioml directory %s was removed", dir)
+		}
+	}
+
+	for _, key := range []string{"", "..", "../../escape"} {
+		if _, err = NewStudioDirs(home, key); err == nil {
+			t.Fatalf("experiment key %q was accepted", key)
+		}
+	}
+}
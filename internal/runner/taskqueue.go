@@ -6,6 +6,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/go-stack/stack"
 	"github.com/karlmutch/errors"
@@ -20,7 +21,13 @@ type QueueTask struct {
 	Subscription string
 	Credentials  string
 	Msg          []byte
+	Attributes   map[string]string // Message attributes, or headers, supplied by the queue such as trace context
+	Deliveries   uint              // The number of times the queue has delivered the message including this one, 0 if the queue does not report it
+	Backlog      uint64            // The number of messages waiting on the queue behind this one, 0 if the queue does not report it
 	Handler      MsgHandler
+	AckWindow    time.Duration     // A period learnt from previous work for which messages should be held, 0 to use the queue default
+	Dumped       bool              // Set by the handler when a message is consumed without its work having succeeded
+	Requeue      map[string]string // Attributes the handler wants added to a message it did not ack, queues that cannot change returned messages ignore them
 }
 
 // MsgHandler defines the function signature for a generic message handler for a specified queue implementation
@@ -52,6 +59,10 @@ func NewTaskQueue(project string, creds string) (tq TaskQueue, err errors.Error)
 		return NewPubSub(project, creds)
 	case strings.HasPrefix(project, "amqp://"):
 		return NewRabbitMQ(project, creds)
+	case strings.HasPrefix(project, "redis://") || strings.HasPrefix(project, "rediss://"):
+		return NewRedisStreams(project, creds)
+	case IsDirQueue(project):
+		return NewDirQueue(project)
 	default:
 		files := strings.Split(creds, ",")
 		for _, file := range files {
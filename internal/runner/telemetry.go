@@ -0,0 +1,185 @@
+package runner
+
+// This file contains the collection of the studioml telemetry an experiment script outputs.
+// The script writes JSON lines tagged using a studioml key, for example the experiment
+// host, its timings, the artifacts, and the python packages installed, mixed in with the
+// other output of the experiment.  The lines are left in the output and are also gathered
+// into a single document so that consumers do not need to search the output for them.
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TelemetryFile is the name of the document the telemetry of an experiment is saved to
+const TelemetryFile = "telemetry.json"
+
+// Telemetry gathers the studioml tagged JSON lines output by an experiment into a single
+// document, lines that carry the tag but are not valid JSON are counted and skipped
+//
+type Telemetry struct {
+	doc       map[string]interface{}
+	malformed int
+	sync.Mutex
+}
+
+// NewTelemetry returns an empty telemetry document
+//
+func NewTelemetry() (telemetry *Telemetry) {
+	return &Telemetry{
+		doc: map[string]interface{}{},
+	}
+}
+
+// Scan examines a line of experiment output and merges it into the document when it is a
+// studioml telemetry line
+//
+func (t *Telemetry) Scan(line string) {
+	if t == nil {
+		return
+	}
+	line = strings.TrimSpace(line)
+	if len(line) < 2 || line[0] != '{' || !strings.Contains(line, `"studioml"`) {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	tagged := map[string]interface{}{}
+	if errGo := json.Unmarshal([]byte(line), &tagged); errGo != nil {
+		t.malformed++
+		return
+	}
+	value, isPresent := tagged["studioml"]
+	if !isPresent {
+		return
+	}
+	fields, isObject := value.(map[string]interface{})
+	if !isObject {
+		t.malformed++
+		return
+	}
+	mergeTelemetry(t.doc, fields)
+}
+
+// mergeTelemetry copies the fields of a telemetry line into the document, objects present in
+// both are merged and other values replace those seen earlier
+//
+func mergeTelemetry(doc map[string]interface{}, fields map[string]interface{}) {
+	for key, value := range fields {
+		if update, isObject := value.(map[string]interface{}); isObject {
+			if existing, isObject := doc[key].(map[string]interface{}); isObject {
+				mergeTelemetry(existing, update)
+				continue
+			}
+		}
+		doc[key] = value
+	}
+}
+
+// Record merges fields observed by the runner itself, rather than output by the experiment,
+// into the document
+//
+func (t *Telemetry) Record(fields map[string]interface{}) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	mergeTelemetry(t.doc, fields)
+}
+
+// Empty returns true when no telemetry lines have been seen
+//
+func (t *Telemetry) Empty() (empty bool) {
+	if t == nil {
+		return true
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	return len(t.doc) == 0 && t.malformed == 0
+}
+
+// Marshal returns the telemetry as a JSON document
+//
+func (t *Telemetry) Marshal() (doc []byte, err errors.Error) {
+	t.Lock()
+	defer t.Unlock()
+
+	telemetry := struct {
+		Studioml  map[string]interface{} `json:"studioml"`
+		Malformed int                    `json:"malformed_lines,omitempty"`
+	}{
+		Studioml:  t.doc,
+		Malformed: t.malformed,
+	}
+	doc, errGo := json.MarshalIndent(telemetry, "", "  ")
+	if errGo != nil {
+		return nil, errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+	return doc, nil
+}
+
+// Save writes the telemetry document into the supplied directory
+//
+func (t *Telemetry) Save(dir string) (fn string, err errors.Error) {
+	doc, err := t.Marshal()
+	if err != nil {
+		return "", err
+	}
+
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return "", errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	fn = filepath.Join(dir, TelemetryFile)
+	if errGo := ioutil.WriteFile(fn, append(doc, '\n'), 0600); errGo != nil {
+		return "", errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return fn, nil
+}
+
+// artifactTelemetry renders the studioml telemetry lines describing the artifacts of an
+// experiment quoted for use as single arguments within a bash script.  Each artifact has its
+// location recorded, artifacts that were fetched also have the version pinned by the experiment,
+// if any, and the ETag of the object that was downloaded recorded.
+//
+func artifactTelemetry(arts map[string]Artifact) (quoted []string, err errors.Error) {
+	labels := make([]string, 0, len(arts))
+	for label := range arts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	quoted = make([]string, 0, len(labels))
+	for _, label := range labels {
+		art := arts[label]
+		docs := []map[string]interface{}{
+			{"artifacts": map[string]string{label: art.Qualified}},
+		}
+		if len(art.Resolved) != 0 {
+			if len(art.Version) != 0 {
+				docs = append(docs, map[string]interface{}{"artifact_versions": map[string]string{label: art.Version}})
+			}
+			docs = append(docs, map[string]interface{}{"artifact_etags": map[string]string{label: art.Resolved}})
+		}
+		for _, doc := range docs {
+			line, errGo := json.Marshal(map[string]interface{}{"studioml": doc})
+			if errGo != nil {
+				return nil, errors.Wrap(errGo).With("artifact", label).With("stack", stack.Trace().TrimRuntime())
+			}
+			quoted = append(quoted, shellQuote(string(line)))
+		}
+	}
+	return quoted, nil
+}
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestTelemetry checks that the studioml tagged lines of an experiments output are merged into
+// a single document while other output, and tagged lines that are not valid JSON, are skipped
+//
+func TestTelemetry(t *testing.T) {
+
+	telemetry := NewTelemetry()
+	if !telemetry.Empty() {
+		t.Fatal("new telemetry was not empty")
+	}
+
+	for _, line := range []string{
+		`+ pip freeze`,
+		`{"studioml":{"experiment":{"key":"exp-1"}}}`,
+		`  {"studioml": { "artifacts" : {"output": "s3://bucket/output.tar"}}}  `,
+		`{"studioml": { "artifacts" : {"modeldir": "s3://bucket/modeldir.tar"}}}`,
+		`{"studioml":{"start_time":"2020-01-02T03:04:05+00:00"}}`,
+		`{"studioml":{"host":"node-1"}}`,
+		`{"studioml":{"pipdeptree": [{"package": {"key": "numpy"}}]}}`,
+		`{"studioml":{"host": truncated`,
+		`{"studioml": "not an object"}`,
+		`{"loss": 0.5}`,
+		`{"studioml":{"stop_time":"2020-01-02T03:05:05+00:00"}}`,
+	} {
+		telemetry.Scan(line)
+	}
+
+	dir, errGo := ioutil.TempDir("", "telemetry")
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+	defer os.RemoveAll(dir)
+
+	fn, err := telemetry.Save(filepath.Join(dir, "telemetry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime()))
+	}
+
+	doc := struct {
+		Studioml struct {
+			Experiment struct {
+				Key string `json:"key"`
+			} `json:"experiment"`
+			Artifacts  map[string]string        `json:"artifacts"`
+			Host       string                   `json:"host"`
+			StartTime  string                   `json:"start_time"`
+			StopTime   string                   `json:"stop_time"`
+			Pipdeptree []map[string]interface{} `json:"pipdeptree"`
+		} `json:"studioml"`
+		Malformed int `json:"malformed_lines"`
+	}{}
+	if errGo = json.Unmarshal(data, &doc); errGo != nil {
+		t.Fatal(errGo, string(data))
+	}
+
+	if doc.Studioml.Experiment.Key != "exp-1" || doc.Studioml.Host != "node-1" || len(doc.Studioml.Pipdeptree) != 1 {
+		t.Fatalf("unexpected telemetry %s", string(data))
+	}
+	if len(doc.Studioml.Artifacts) != 2 || doc.Studioml.Artifacts["output"] != "s3://bucket/output.tar" {
+		t.Fatalf("artifact lines were not merged %s", string(data))
+	}
+	if len(doc.Studioml.StartTime) == 0 || len(doc.Studioml.StopTime) == 0 {
+		t.Fatalf("timing lines missing %s", string(data))
+	}
+	if doc.Malformed != 2 {
+		t.Fatalf("expected 2 malformed lines, got %d", doc.Malformed)
+	}
+}
+
+// TestArtifactTelemetry checks that artifact locations and versions containing characters that
+// have meaning to bash and JSON survive being echoed by the experiment script, and that versions
+// are only recorded for artifacts that were fetched
+//
+func TestArtifactTelemetry(t *testing.T) {
+
+	arts := map[string]Artifact{
+		"workspace": {Qualified: `s3://host/bucket/it's "$(whoami)".tar`, Version: `v"1'$HOME`, Resolved: `"etag-1"`},
+		"output":    {Qualified: "s3://host/bucket/output.tar", Version: "v2"},
+	}
+	quoted, err := artifactTelemetry(arts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	telemetry := NewTelemetry()
+	for _, line := range quoted {
+		output, errGo := exec.Command("bash", "-c", "echo "+line).Output()
+		if errGo != nil {
+			t.Fatal(errGo)
+		}
+		telemetry.Scan(string(output))
+	}
+	doc, err := telemetry.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := struct {
+		Studioml struct {
+			Artifacts map[string]string `json:"artifacts"`
+			Versions  map[string]string `json:"artifact_versions"`
+			ETags     map[string]string `json:"artifact_etags"`
+		} `json:"studioml"`
+	}{}
+	if errGo := json.Unmarshal(doc, &result); errGo != nil {
+		t.Fatal(errGo, string(doc))
+	}
+	for label, art := range arts {
+		if result.Studioml.Artifacts[label] != art.Qualified {
+			t.Fatalf("artifact %s location was %q", label, result.Studioml.Artifacts[label])
+		}
+	}
+	if result.Studioml.Versions["workspace"] != arts["workspace"].Version || result.Studioml.ETags["workspace"] != arts["workspace"].Resolved {
+		t.Fatalf("fetched artifact version not recorded %+v", result.Studioml)
+	}
+	if _, isPresent := result.Studioml.Versions["output"]; isPresent {
+		t.Fatalf("version recorded for an artifact that was not fetched %+v", result.Studioml)
+	}
+}
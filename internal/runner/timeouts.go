@@ -0,0 +1,117 @@
+package runner
+
+// This file contains the implementation of the separate timeouts experiments can use for
+// building their environment, typically dominated by pip installs, and for running the
+// experiment once its environment is ready.
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+const (
+	setupTimedOut = "experiment setup timeout exceeded"
+	runTimedOut   = "experiment run timeout exceeded"
+)
+
+// IsSetupTimeout is used to test an error to see if the experiment was stopped while its
+// environment was being built because its setup timeout was exceeded
+//
+func IsSetupTimeout(err error) bool {
+	return err != nil && strings.Contains(err.Error(), setupTimedOut)
+}
+
+// IsRunTimeout is used to test an error to see if the experiment was stopped because its run
+// timeout was exceeded
+//
+func IsRunTimeout(err error) bool {
+	return err != nil && strings.Contains(err.Error(), runTimedOut)
+}
+
+// phaseTimeouts enforces the setup and run timeouts of an experiment, a zero timeout is not
+// enforced
+//
+type phaseTimeouts struct {
+	setup time.Duration
+	run   time.Duration
+	stop  func()
+
+	timer *time.Timer
+	err   errors.Error
+	sync.Mutex
+}
+
+func newPhaseTimeouts(setup time.Duration, run time.Duration, stop func()) (pt *phaseTimeouts) {
+	return &phaseTimeouts{
+		setup: setup,
+		run:   run,
+		stop:  stop,
+	}
+}
+
+// parsePhaseTimeouts extracts the optional timeouts from an experiment
+//
+func parsePhaseTimeouts(rqst *Request, stop func()) (pt *phaseTimeouts, err errors.Error) {
+	timeouts := map[string]time.Duration{}
+	for name, value := range map[string]string{"setup_timeout": rqst.Experiment.SetupTimeout, "run_timeout": rqst.Experiment.RunTimeout} {
+		if len(value) == 0 {
+			continue
+		}
+		timeout, errGo := time.ParseDuration(value)
+		if errGo != nil {
+			return nil, errors.Wrap(errGo, name+" is invalid").With("experiment_id", rqst.Experiment.Key, name, value).With("stack", stack.Trace().TrimRuntime())
+		}
+		timeouts[name] = timeout
+	}
+	return newPhaseTimeouts(timeouts["setup_timeout"], timeouts["run_timeout"], stop), nil
+}
+
+func (pt *phaseTimeouts) start(timeout time.Duration, msg string) {
+	if pt.timer != nil {
+		pt.timer.Stop()
+		pt.timer = nil
+	}
+	if timeout <= 0 || pt.err != nil {
+		return
+	}
+	pt.timer = time.AfterFunc(timeout, func() {
+		pt.Lock()
+		if pt.err == nil {
+			pt.err = errors.New(msg).With("timeout", timeout.String()).With("stack", stack.Trace().TrimRuntime())
+		}
+		pt.Unlock()
+		pt.stop()
+	})
+}
+
+// startSetup begins timing the building of the environment
+//
+func (pt *phaseTimeouts) startSetup() {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.start(pt.setup, setupTimedOut)
+}
+
+// startRun stops timing the setup and begins timing the experiment itself
+//
+func (pt *phaseTimeouts) startRun() {
+	pt.Lock()
+	defer pt.Unlock()
+	pt.start(pt.run, runTimedOut)
+}
+
+// finish stops timing and returns the error for any timeout that was exceeded
+//
+func (pt *phaseTimeouts) finish() (err errors.Error) {
+	pt.Lock()
+	defer pt.Unlock()
+	if pt.timer != nil {
+		pt.timer.Stop()
+		pt.timer = nil
+	}
+	return pt.err
+}
@@ -0,0 +1,123 @@
+package runner
+
+// This file contains the implementation of the private temporary directories given to
+// experiments.  Each experiment has a temporary directory inside of its own working
+// directory, so that the space it uses is counted against the disk the experiment was
+// allocated and is released along with the rest of the experiment.  The directory is
+// exported using the TMPDIR, TMP and TEMP environment variables and, when the runner is able
+// to create mount namespaces, is also mounted over /tmp for the experiment process so that
+// experiments writing to /tmp directly cannot see, or clobber, each others files.  The same
+// namespace is used to place any private shared memory provided to the experiment over
+// /dev/shm.
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	privateTmpOpt = flag.Bool("private-tmp", true, "mount the temporary directory of experiments over /tmp using a private mount namespace, when the runner has the privileges to do so")
+)
+
+// provideTmp creates the temporary directory for an experiment inside its working directory.
+// The returned release function removes the directory and must be called once the experiment
+// has stopped.
+//
+func provideTmp(exprDir string) (dir string, release func(), err errors.Error) {
+	release = func() {}
+
+	dir = filepath.Join(exprDir, "_tmp")
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return "", release, errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	release = func() {
+		os.RemoveAll(dir)
+	}
+	return dir, release, nil
+}
+
+// tmpExports returns the shell statements that point the common temporary directory
+// environment variables at dir
+//
+func tmpExports(dir string) (exports string) {
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		exports += "export " + name + "=" + dir + "; "
+	}
+	return exports
+}
+
+// startIsolated starts the command with dir mounted over /tmp, and any private shared memory
+// mounted over /dev/shm, within a private mount namespace.  The namespace is created on a
+// thread dedicated to starting the command, the child inherits it and the thread is discarded
+// once the command has started, leaving the rest of the runner unaffected.  When a namespace
+// cannot be created the command is started without one and relies upon the exported TMPDIR
+// and STUDIOML_SHM alone.  /tmp is not replaced when the experiment itself lives within /tmp
+// and would be hidden by the mount.
+//
+func startIsolated(cmd *exec.Cmd, dir string, shmDir string) (errGo error) {
+	if !*privateTmpOpt || withinTmp(filepath.Dir(dir)) {
+		dir = ""
+	}
+	if shmDir == devShm {
+		shmDir = ""
+	}
+	if len(dir) == 0 && len(shmDir) == 0 {
+		return cmd.Start()
+	}
+
+	startC := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked so that it exits along with this goroutine rather than
+		// being returned to the scheduler, possibly in the private namespace
+		runtime.LockOSThread()
+
+		// Failing to isolate leaves the command to be started with the environment alone
+		_ = isolateMounts(dir, shmDir)
+		startC <- cmd.Start()
+	}()
+	return <-startC
+}
+
+// withinTmp tests if dir is inside the hosts /tmp directory
+//
+func withinTmp(dir string) (within bool) {
+	if resolved, errGo := filepath.EvalSymlinks(dir); errGo == nil {
+		dir = resolved
+	}
+	tmp := "/tmp"
+	if resolved, errGo := filepath.EvalSymlinks(tmp); errGo == nil {
+		tmp = resolved
+	}
+	rel, errGo := filepath.Rel(tmp, dir)
+	return errGo == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// isolateMounts moves the calling thread into a new mount namespace with dir mounted over /tmp
+// and shmDir mounted over /dev/shm, either can be empty to leave the host directory in place
+//
+func isolateMounts(dir string, shmDir string) (errGo error) {
+	if errGo = syscall.Unshare(syscall.CLONE_NEWNS); errGo != nil {
+		return errGo
+	}
+	// Stop the mounts that follow from propagating back into the namespace of the host
+	if errGo = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); errGo != nil {
+		return errGo
+	}
+	if len(shmDir) != 0 {
+		if errGo = syscall.Mount(shmDir, devShm, "", syscall.MS_BIND, ""); errGo != nil {
+			return errGo
+		}
+	}
+	if len(dir) != 0 {
+		return syscall.Mount(dir, "/tmp", "", syscall.MS_BIND, "")
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package runner
+
+// This file contains the implementation of distributed tracing for experiments.  Spans
+// are created using the opencensus trace API and exported to an OpenTelemetry collector
+// using the OTLP/HTTP JSON encoding.  Trace context arriving with a message in a W3C
+// traceparent attribute, or header, is used as the parent of the span for the experiment
+// so that runs can be correlated with the systems that submitted them.
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	otlpEndpointOpt = flag.String("otlp-endpoint", "", "the base URL of an OpenTelemetry collector accepting OTLP/HTTP, for example http://localhost:4318, traces are not exported when not set")
+	traceSampleOpt  = flag.Float64("trace-sample", 1.0, "the fraction of experiments, between 0 and 1, that are traced when no sampling decision arrives with the message")
+)
+
+const (
+	// TraceParentKey is the W3C trace context attribute that is extracted from messages
+	TraceParentKey = "traceparent"
+
+	otlpBatchSize = 256
+)
+
+// InitTracing will start the export of spans to the OTLP endpoint if one was configured.  The
+// exporter flushes periodically until the context is cancelled.
+//
+func InitTracing(ctx context.Context, service string) (err errors.Error) {
+	if len(*otlpEndpointOpt) == 0 {
+		return nil
+	}
+
+	if *traceSampleOpt < 0 || *traceSampleOpt > 1 {
+		return errors.New("trace-sample must be between 0 and 1").With("trace-sample", *traceSampleOpt).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(*traceSampleOpt)})
+
+	exp := &otlpExporter{
+		url:     strings.TrimSuffix(*otlpEndpointOpt, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make([]*trace.SpanData, 0, otlpBatchSize),
+	}
+	trace.RegisterExporter(exp)
+
+	go exp.run(ctx)
+
+	return nil
+}
+
+// ParseTraceParent extracts the trace context from a W3C traceparent value, for example
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+//
+func ParseTraceParent(value string) (sc trace.SpanContext, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if parts[0] == "ff" {
+		return sc, false
+	}
+	traceID, errGo := hex.DecodeString(parts[1])
+	if errGo != nil {
+		return sc, false
+	}
+	spanID, errGo := hex.DecodeString(parts[2])
+	if errGo != nil {
+		return sc, false
+	}
+	flags, errGo := strconv.ParseUint(parts[3], 16, 8)
+	if errGo != nil {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.TraceOptions = trace.TraceOptions(flags & 0x01)
+
+	if sc.TraceID == (trace.TraceID{}) || sc.SpanID == (trace.SpanID{}) {
+		return sc, false
+	}
+	return sc, true
+}
+
+// StartMsgSpan will start the span that covers the handling of a message, using any trace
+// context that arrived with the message as its parent
+//
+func StartMsgSpan(ctx context.Context, qt *QueueTask) (spanCtx context.Context, span *trace.Span) {
+	opts := trace.StartOptions{SpanKind: trace.SpanKindServer}
+
+	if parent, ok := ParseTraceParent(qt.Attributes[TraceParentKey]); ok {
+		span = trace.NewSpanWithRemoteParent("experiment", parent, opts)
+	} else {
+		span = trace.NewSpan("experiment", nil, opts)
+	}
+	span.AddAttributes(
+		trace.StringAttribute("queue.project", qt.Project),
+		trace.StringAttribute("queue.subscription", qt.Subscription),
+	)
+	return trace.WithSpan(ctx, span), span
+}
+
+// TraceIDs returns the hex encoded trace and span identifiers of the span within the context, if
+// any, so that they can be included in logs
+//
+func TraceIDs(ctx context.Context) (traceID string, spanID string) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return "", ""
+	}
+	sc := span.SpanContext()
+	return hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:])
+}
+
+// EndSpan will record the outcome of the work a span covered and then end it
+//
+func EndSpan(span *trace.Span, err errors.Error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.SetStatus(trace.Status{Code: 2, Message: err.Error()})
+	}
+	span.End()
+}
+
+// otlpExporter batches completed spans and sends them to an OTLP/HTTP collector
+//
+type otlpExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   []*trace.SpanData
+	sync.Mutex
+}
+
+// ExportSpan implements the opencensus exporter interface
+//
+func (exp *otlpExporter) ExportSpan(s *trace.SpanData) {
+	exp.Lock()
+	exp.spans = append(exp.spans, s)
+	full := len(exp.spans) >= otlpBatchSize
+	exp.Unlock()
+
+	if full {
+		go exp.flush()
+	}
+}
+
+func (exp *otlpExporter) run(ctx context.Context) {
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			exp.flush()
+			return
+		case <-tick.C:
+			exp.flush()
+		}
+	}
+}
+
+func (exp *otlpExporter) flush() {
+	exp.Lock()
+	spans := exp.spans
+	exp.spans = make([]*trace.SpanData, 0, otlpBatchSize)
+	exp.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	if err := exp.send(spans); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) (result []otlpAttribute) {
+	result = make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		attr := otlpAttribute{Key: k}
+		switch value := v.(type) {
+		case string:
+			attr.Value.StringValue = &value
+		case bool:
+			attr.Value.BoolValue = &value
+		case int64:
+			intValue := strconv.FormatInt(value, 10)
+			attr.Value.IntValue = &intValue
+		default:
+			strValue := fmt.Sprint(value)
+			attr.Value.StringValue = &strValue
+		}
+		result = append(result, attr)
+	}
+	return result
+}
+
+func (exp *otlpExporter) send(spans []*trace.SpanData) (err errors.Error) {
+
+	converted := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(s.TraceID[:]),
+			SpanID:     hex.EncodeToString(s.SpanID[:]),
+			Name:       s.Name,
+			Kind:       1, // Internal
+			Start:      strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			End:        strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes: otlpAttributes(s.Attributes),
+		}
+		if s.ParentSpanID != (trace.SpanID{}) {
+			span.ParentSpanID = hex.EncodeToString(s.ParentSpanID[:])
+		}
+		if s.SpanKind == trace.SpanKindServer {
+			span.Kind = 2
+		}
+		if s.Status.Code != 0 {
+			span.Status = otlpStatus{Code: 2, Message: s.Status.Message}
+		}
+		converted = append(converted, span)
+	}
+
+	service := exp.service
+	doc := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						{Key: "service.name", Value: otlpValue{StringValue: &service}},
+						{Key: "host.name", Value: otlpValue{StringValue: &hostname}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "studio-go-runner"},
+						"spans": converted,
+					},
+				},
+			},
+		},
+	}
+
+	body, errGo := json.Marshal(doc)
+	if errGo != nil {
+		return errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	resp, errGo := exp.client.Post(exp.url, "application/json", bytes.NewReader(body))
+	if errGo != nil {
+		return errors.Wrap(errGo).With("url", exp.url).With("stack", stack.Trace().TrimRuntime())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("trace export failed").With("url", exp.url, "status", resp.Status).With("stack", stack.Trace().TrimRuntime())
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package runner
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// TestParseTraceParent checks that valid W3C traceparent values are decoded, including the
+// sampled flag, and that invalid values are rejected
+//
+func TestParseTraceParent(t *testing.T) {
+
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	spanID := trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}
+
+	for _, tc := range []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ok: true, sampled: true},
+		{value: " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", ok: true, sampled: false},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", ok: true, sampled: true},
+		// Later versions can append fields that are ignored
+		{value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ok: true, sampled: true},
+		{value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b-01"},
+		{value: "000-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0g"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{value: ""},
+	} {
+		sc, ok := ParseTraceParent(tc.value)
+		if ok != tc.ok {
+			t.Fatalf("traceparent %q was accepted %v, expected %v", tc.value, ok, tc.ok)
+		}
+		if !ok {
+			continue
+		}
+		if sc.TraceID != traceID || sc.SpanID != spanID {
+			t.Fatalf("traceparent %q decoded to %v %v", tc.value, sc.TraceID, sc.SpanID)
+		}
+		if sc.IsSampled() != tc.sampled {
+			t.Fatalf("traceparent %q was sampled %v, expected %v", tc.value, sc.IsSampled(), tc.sampled)
+		}
+	}
+}
+
+// TestOTLPSend checks that spans are sent to the collector using the OTLP/HTTP JSON encoding
+// with hex encoded identifiers, their kind and status, and the attributes of the resource
+//
+func TestOTLPSend(t *testing.T) {
+
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		doc := map[string]interface{}{}
+		if errGo := json.Unmarshal(body, &doc); errGo != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- doc
+	}))
+	defer collector.Close()
+
+	exp := &otlpExporter{
+		url:     collector.URL + "/v1/traces",
+		service: "runner-test",
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+
+	start := time.Unix(1600000000, 5)
+	span := &trace.SpanData{
+		SpanContext: trace.SpanContext{
+			TraceID: trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+			SpanID:  trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		},
+		ParentSpanID: trace.SpanID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		SpanKind:     trace.SpanKindServer,
+		Name:         "experiment",
+		StartTime:    start,
+		EndTime:      start.Add(time.Second),
+		Attributes:   map[string]interface{}{"queue.project": "project", "retried": true, "attempt": int64(2)},
+		Status:       trace.Status{Code: 2, Message: "failed"},
+	}
+	internal := &trace.SpanData{
+		SpanContext: trace.SpanContext{TraceID: span.TraceID, SpanID: trace.SpanID{0x10}},
+		Name:        "download",
+		StartTime:   start,
+		EndTime:     start,
+	}
+
+	if err := exp.send([]*trace.SpanData{span, internal}); err != nil {
+		t.Fatal(err)
+	}
+
+	doc := <-received
+
+	// The document is decoded generically, as a collector would see it
+	resourceSpans := doc["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := map[string]string{}
+	for _, attr := range resourceSpans["resource"].(map[string]interface{})["attributes"].([]interface{}) {
+		kv := attr.(map[string]interface{})
+		resource[kv["key"].(string)] = kv["value"].(map[string]interface{})["stringValue"].(string)
+	}
+	if resource["service.name"] != "runner-test" || resource["host.name"] != hostname {
+		t.Fatalf("unexpected resource attributes %v", resource)
+	}
+
+	spans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("%d spans were sent, expected 2", len(spans))
+	}
+
+	sent := spans[0].(map[string]interface{})
+	for key, expected := range map[string]interface{}{
+		"traceId":           "4bf92f3577b34da6a3ce929d0e0e4736",
+		"spanId":            "00f067aa0ba902b7",
+		"parentSpanId":      "0102030405060708",
+		"name":              "experiment",
+		"kind":              float64(2),
+		"startTimeUnixNano": "1600000000000000005",
+		"endTimeUnixNano":   "1600000001000000005",
+	} {
+		if sent[key] != expected {
+			t.Fatalf("span %s was %v, expected %v", key, sent[key], expected)
+		}
+	}
+	if status := sent["status"].(map[string]interface{}); status["code"] != float64(2) || status["message"] != "failed" {
+		t.Fatalf("unexpected span status %v", status)
+	}
+	attrs := map[string]map[string]interface{}{}
+	for _, attr := range sent["attributes"].([]interface{}) {
+		kv := attr.(map[string]interface{})
+		attrs[kv["key"].(string)] = kv["value"].(map[string]interface{})
+	}
+	if attrs["queue.project"]["stringValue"] != "project" || attrs["retried"]["boolValue"] != true || attrs["attempt"]["intValue"] != "2" {
+		t.Fatalf("unexpected span attributes %v", attrs)
+	}
+
+	// Spans that are not servers are internal, and those without a parent or an error omit them
+	sent = spans[1].(map[string]interface{})
+	if sent["kind"] != float64(1) || sent["parentSpanId"] != nil {
+		t.Fatalf("unexpected internal span %v", sent)
+	}
+	if status := sent["status"].(map[string]interface{}); status["code"] != float64(0) {
+		t.Fatalf("unexpected internal span status %v", status)
+	}
+
+	// Exported spans are held until they are flushed as a single batch
+	exp.ExportSpan(span)
+	exp.ExportSpan(internal)
+	exp.flush()
+	doc = <-received
+	resourceSpans = doc["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	if spans = resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{}); len(spans) != 2 {
+		t.Fatalf("%d spans were flushed, expected 2", len(spans))
+	}
+	exp.flush()
+	select {
+	case <-received:
+		t.Fatal("spans were sent again by a flush without new spans")
+	default:
+	}
+
+	// A collector refusing the spans is reported
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	exp.url = unavailable.URL + "/v1/traces"
+	if err := exp.send([]*trace.SpanData{internal}); err == nil {
+		t.Fatal("a failed export was not reported")
+	}
+}
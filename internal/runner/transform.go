@@ -0,0 +1,153 @@
+package runner
+
+// This file contains the implementation of the transforms applied to messages from queues
+// whose messages carry the StudioML request inside another envelope, for example an SNS
+// notification delivered through an SQS subscription.  Transforms are named and applied
+// in order to the body of the message before it is decoded as a request.
+//
+// Two forms of transform are built in, sns which unwraps the Message field of an SNS
+// notification, and field:<path> which extracts the field at a dot separated path, the
+// field can be either a JSON object or a string holding the encoded request.  Others can be
+// added using RegisterTransform from the init function of a file added to the runner.
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// MsgTransform converts the body of a message as it arrived on a queue into the body it
+// carries, which is the StudioML request once all of the transforms of a queue are applied
+//
+type MsgTransform func(msg []byte) (body []byte, err errors.Error)
+
+const (
+	malformedEnvelope = "malformed envelope"
+
+	fieldTransform = "field:"
+)
+
+var (
+	transforms = map[string]MsgTransform{
+		"sns": unwrapSNS,
+	}
+	transformsLock sync.Mutex
+)
+
+// RegisterTransform adds a named transform that queues can be configured to use
+//
+func RegisterTransform(name string, transform MsgTransform) (err errors.Error) {
+	if len(name) == 0 || strings.Contains(name, ":") {
+		return errors.New("transform names must be non empty and not contain a colon").With("transform", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	if transform == nil {
+		return errors.New("transform missing").With("transform", name).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	transformsLock.Lock()
+	defer transformsLock.Unlock()
+
+	if _, isPresent := transforms[name]; isPresent {
+		return errors.New("transform already registered").With("transform", name).With("stack", stack.Trace().TrimRuntime())
+	}
+	transforms[name] = transform
+	return nil
+}
+
+// lookupTransform returns the transform with the name, nil if there is none
+//
+func lookupTransform(name string) (transform MsgTransform) {
+	if strings.HasPrefix(name, fieldTransform) {
+		path := strings.TrimPrefix(name, fieldTransform)
+		if len(path) == 0 {
+			return nil
+		}
+		return func(msg []byte) (body []byte, err errors.Error) {
+			return extractField(path, msg)
+		}
+	}
+
+	transformsLock.Lock()
+	defer transformsLock.Unlock()
+
+	return transforms[name]
+}
+
+// ValidateTransforms checks that the named transforms are known
+//
+func ValidateTransforms(names []string) (err errors.Error) {
+	for _, name := range names {
+		if lookupTransform(name) == nil {
+			return errors.New("transform not recognized").With("transform", name).With("stack", stack.Trace().TrimRuntime())
+		}
+	}
+	return nil
+}
+
+// TransformMsg applies the named transforms in order to the body of a message
+//
+func TransformMsg(names []string, msg []byte) (body []byte, err errors.Error) {
+	body = msg
+	for _, name := range names {
+		transform := lookupTransform(name)
+		if transform == nil {
+			return nil, errors.New("transform not recognized").With("transform", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		if body, err = transform(body); err != nil {
+			return nil, err.With("transform", name)
+		}
+	}
+	return body, nil
+}
+
+// unwrapSNS extracts the message published to an SNS topic from the notification SNS
+// delivers to its subscribers
+//
+func unwrapSNS(msg []byte) (body []byte, err errors.Error) {
+	notification := struct {
+		Type    string  `json:"Type"`
+		Message *string `json:"Message"`
+	}{}
+	if errGo := json.Unmarshal(msg, &notification); errGo != nil {
+		return nil, errors.Wrap(errGo, malformedEnvelope+", not an SNS notification").With("stack", stack.Trace().TrimRuntime())
+	}
+	if notification.Type != "Notification" {
+		return nil, errors.New(malformedEnvelope+", not an SNS notification").With("type", notification.Type).With("stack", stack.Trace().TrimRuntime())
+	}
+	if notification.Message == nil {
+		return nil, errors.New(malformedEnvelope+", SNS notification has no Message").With("stack", stack.Trace().TrimRuntime())
+	}
+	return []byte(*notification.Message), nil
+}
+
+// extractField returns the field at the dot separated path, a string field is returned as
+// its contents
+//
+func extractField(path string, msg []byte) (body []byte, err errors.Error) {
+	raw := json.RawMessage(msg)
+	for _, name := range strings.Split(path, ".") {
+		fields := map[string]json.RawMessage{}
+		if errGo := json.Unmarshal(raw, &fields); errGo != nil {
+			return nil, errors.Wrap(errGo, malformedEnvelope+", not a JSON object").With("path", path, "field", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		field, isPresent := fields[name]
+		if !isPresent {
+			return nil, errors.New(malformedEnvelope+", field missing").With("path", path, "field", name).With("stack", stack.Trace().TrimRuntime())
+		}
+		raw = field
+	}
+
+	raw = bytes.TrimSpace(raw)
+	if len(raw) != 0 && raw[0] == '"' {
+		contents := ""
+		if errGo := json.Unmarshal(raw, &contents); errGo != nil {
+			return nil, errors.Wrap(errGo, malformedEnvelope).With("path", path).With("stack", stack.Trace().TrimRuntime())
+		}
+		return []byte(contents), nil
+	}
+	return raw, nil
+}
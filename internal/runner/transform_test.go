@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/karlmutch/errors"
+)
+
+// TestTransformMsg checks that transforms are applied in order and that envelopes that do not
+// hold what is expected are rejected
+//
+func TestTransformMsg(t *testing.T) {
+	request := `{"experiment": {"key": "transform-experiment"}}`
+
+	// An SNS notification whose message wraps the request in an object holding routing fields
+	msg := []byte(`{"Type": "Notification", "Message": "{\"route\": \"gpu\", \"payload\": {\"studioml\": ` +
+		`{\"experiment\": {\"key\": \"transform-experiment\"}}}}"}`)
+	body, err := TransformMsg([]string{"sns", "field:payload.studioml"}, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != request {
+		t.Fatalf("request not extracted, got %s", string(body))
+	}
+
+	// Fields holding the encoded request as a string are decoded
+	if body, err = TransformMsg([]string{"field:body"}, []byte(`{"body": `+strconv.Quote(request)+`}`)); err != nil || string(body) != request {
+		t.Fatalf("string field not decoded, got %s %v", string(body), err)
+	}
+
+	for _, bad := range [][]string{{"sns"}, {"field:missing"}, {"field:experiment.key.deeper"}} {
+		if _, err := TransformMsg(bad, []byte(request)); err == nil {
+			t.Fatalf("malformed envelope accepted by %v", bad)
+		}
+	}
+
+	if err := ValidateTransforms([]string{"sns", "field:a.b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"unknown", "field:"} {
+		if err := ValidateTransforms([]string{bad}); err == nil {
+			t.Fatalf("transform %s accepted", bad)
+		}
+	}
+}
+
+// TestRegisterTransform checks custom transforms can be added and used by name
+//
+func TestRegisterTransform(t *testing.T) {
+	err := RegisterTransform("test-trim", func(msg []byte) (body []byte, err errors.Error) {
+		return bytes.TrimPrefix(msg, []byte("studioml:")), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		transformsLock.Lock()
+		delete(transforms, "test-trim")
+		transformsLock.Unlock()
+	}()
+
+	if body, err := TransformMsg([]string{"test-trim"}, []byte("studioml:{}")); err != nil || string(body) != "{}" {
+		t.Fatalf("registered transform not applied, got %s %v", string(body), err)
+	}
+	if err = RegisterTransform("sns", unwrapSNS); err == nil {
+		t.Fatal("transform registered twice")
+	}
+	if err = RegisterTransform("field:x", unwrapSNS); err == nil {
+		t.Fatal("transform with a colon in its name registered")
+	}
+}
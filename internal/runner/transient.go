@@ -0,0 +1,149 @@
+package runner
+
+// This file contains the implementation of a classifier for errors that are the result
+// of brief network interruptions, along with a helper for retrying operations that
+// encounter them, and a classifier for errors caused by the runner not being permitted
+// to use a service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/streadway/amqp"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/karlmutch/errors"
+)
+
+var (
+	// transientMessages contains fragments of error messages for transient failures
+	// that are not otherwise typed by the libraries that produce them
+	transientMessages = []string{
+		"connection refused",
+		"connection reset",
+		"no such host",
+		"i/o timeout",
+		"temporary failure in name resolution",
+		"service unavailable",
+		"transport is closing",
+	}
+
+	// authMessages contains fragments of error messages for authentication and authorization
+	// failures that are not otherwise typed by the libraries that produce them
+	authMessages = []string{
+		"access denied",
+		"accessdenied",
+		"access_refused",
+		"invalidclienttokenid",
+		"expiredtoken",
+		"signaturedoesnotmatch",
+		"unrecognizedclientexception",
+		"noauth",
+		"wrongpass",
+		"invalid password",
+		"unauthorized",
+	}
+)
+
+// IsTransient is used to determine if an error was caused by a condition such as a DNS failure,
+// a refused connection, or a service returning 503 that is likely to clear by itself.  Errors
+// such as authentication failures, or missing resources are not transient.
+//
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+
+	switch e := cause.(type) {
+	case *net.DNSError:
+		return true
+	case net.Error:
+		if e.Timeout() {
+			return true
+		}
+	case *googleapi.Error:
+		return e.Code == http.StatusServiceUnavailable || e.Code == http.StatusGatewayTimeout || e.Code == http.StatusTooManyRequests
+	case syscall.Errno:
+		return e == syscall.ECONNREFUSED || e == syscall.ECONNRESET
+	}
+
+	if s, ok := status.FromError(cause); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+			return true
+		case codes.Unauthenticated, codes.PermissionDenied, codes.NotFound, codes.InvalidArgument:
+			return false
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range transientMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAuthFailure is used to determine if an error was caused by the credentials of the runner
+// being rejected, or not permitting the operation, by a service
+//
+func IsAuthFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	cause := errors.Cause(err)
+
+	switch e := cause.(type) {
+	case *googleapi.Error:
+		return e.Code == http.StatusUnauthorized || e.Code == http.StatusForbidden
+	case awserr.RequestFailure:
+		return e.StatusCode() == http.StatusUnauthorized || e.StatusCode() == http.StatusForbidden
+	case *amqp.Error:
+		return e.Code == amqp.AccessRefused
+	}
+
+	if s, ok := status.FromError(cause); ok {
+		switch s.Code() {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return true
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, fragment := range authMessages {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransient will invoke the operation until it succeeds, fails with an error that is not
+// transient, or the number of attempts is exhausted.  The delay between attempts doubles
+// after each failure.
+//
+func retryTransient(ctx context.Context, attempts int, delay time.Duration, op func() error) (errGo error) {
+	for attempt := 1; ; attempt++ {
+		if errGo = op(); errGo == nil || !IsTransient(errGo) || attempt >= attempts {
+			return errGo
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return errGo
+		}
+	}
+}
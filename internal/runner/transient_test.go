@@ -0,0 +1,117 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/streadway/amqp"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+// TestIsTransient checks the classification of network interruptions and of permanent
+// failures such as authentication and missing resources
+//
+func TestIsTransient(t *testing.T) {
+
+	cases := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{&net.DNSError{Err: "no such host", Name: "pubsub.googleapis.com"}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{syscall.ECONNRESET, true},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, true},
+		{&googleapi.Error{Code: http.StatusForbidden}, false},
+		{status.Error(codes.Unavailable, "transport is closing"), true},
+		{status.Error(codes.Unauthenticated, "bad credentials"), false},
+		{status.Error(codes.NotFound, "subscription not found"), false},
+		{errors.Wrap(&net.DNSError{Err: "no such host"}).With("stack", stack.Trace().TrimRuntime()), true},
+		{fmt.Errorf("dial tcp 10.0.0.1:443: i/o timeout"), true},
+		{fmt.Errorf("invalid credentials file"), false},
+	}
+
+	for i, aCase := range cases {
+		if transient := IsTransient(aCase.err); transient != aCase.transient {
+			t.Fatalf("case %d %v was classified as transient %v, expected %v", i, aCase.err, transient, aCase.transient)
+		}
+	}
+}
+
+// TestIsAuthFailure checks the classification of credentials being rejected by services and
+// that network interruptions and other failures are not treated as authentication failures
+//
+func TestIsAuthFailure(t *testing.T) {
+
+	cases := []struct {
+		err  error
+		auth bool
+	}{
+		{nil, false},
+		{&googleapi.Error{Code: http.StatusForbidden}, true},
+		{&googleapi.Error{Code: http.StatusServiceUnavailable}, false},
+		{status.Error(codes.Unauthenticated, "bad credentials"), true},
+		{status.Error(codes.PermissionDenied, "denied"), true},
+		{status.Error(codes.Unavailable, "transport is closing"), false},
+		{awserr.NewRequestFailure(awserr.New("InvalidClientTokenId", "token invalid", nil), http.StatusForbidden, "1"), true},
+		{awserr.NewRequestFailure(awserr.New("AWS.SimpleQueueService.NonExistentQueue", "no queue", nil), http.StatusBadRequest, "2"), false},
+		{&amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED"}, true},
+		{errors.Wrap(status.Error(codes.PermissionDenied, "denied")).With("stack", stack.Trace().TrimRuntime()), true},
+		{fmt.Errorf("WRONGPASS invalid username-password pair"), true},
+		{&net.DNSError{Err: "no such host", Name: "sqs.us-west-2.amazonaws.com"}, false},
+		{fmt.Errorf("unexpected end of JSON input"), false},
+	}
+
+	for i, aCase := range cases {
+		if auth := IsAuthFailure(aCase.err); auth != aCase.auth {
+			t.Fatalf("case %d %v was classified as an authentication failure %v, expected %v", i, aCase.err, auth, aCase.auth)
+		}
+	}
+}
+
+// TestRetryTransient checks that transient failures are retried up to the number of attempts
+// and that permanent failures are returned immediately
+//
+func TestRetryTransient(t *testing.T) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	refused := syscall.ECONNREFUSED
+
+	calls := 0
+	if errGo := retryTransient(ctx, 3, time.Millisecond, func() error { calls++; return refused }); errGo != refused || calls != 3 {
+		t.Fatalf("a transient failure was attempted %d times returning %v, expected 3 attempts", calls, errGo)
+	}
+
+	calls = 0
+	errGo := retryTransient(ctx, 3, time.Millisecond, func() error {
+		calls++
+		if calls == 1 {
+			return refused
+		}
+		return nil
+	})
+	if errGo != nil || calls != 2 {
+		t.Fatalf("a recovered transient failure was attempted %d times returning %v, expected 2 attempts", calls, errGo)
+	}
+
+	permanent := status.Error(codes.PermissionDenied, "denied")
+	calls = 0
+	if errGo = retryTransient(ctx, 3, time.Millisecond, func() error { calls++; return permanent }); errGo != permanent || calls != 1 {
+		t.Fatalf("a permanent failure was attempted %d times returning %v, expected a single attempt", calls, errGo)
+	}
+}
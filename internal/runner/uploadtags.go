@@ -0,0 +1,115 @@
+package runner
+
+// This file contains the implementation of the tags applied to the artifacts uploaded to object
+// stores.  Tags describing the experiment an artifact came from allow bucket lifecycle rules,
+// and cost reports, to key off the experiment, project, and upload time.  S3 objects are given
+// object tags and Google Cloud Storage objects custom metadata.  S3 compatible stores that do
+// not support object tagging have the tags written to a sidecar object next to the artifact.
+// Tagging is only done when the upload-tags option is set.
+//
+// The tag set is a comma separated list of key=value pairs in which the values can contain
+// the placeholders {experiment}, {project}, {group}, {host}, and {timestamp}, the timestamp
+// being the time of the upload in RFC 3339 format.
+
+import (
+	"flag"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	uploadTagsOpt = flag.String("upload-tags", "", "a comma separated list of key=value tags applied to uploaded artifacts, values can contain the placeholders {experiment}, {project}, {group}, {host}, and {timestamp}, for example studioml-experiment={experiment},studioml-project={project}, by default artifacts are not tagged")
+
+	uploadTags = []uploadTag{}
+
+	uploadTagFields      = regexp.MustCompile(`\{([^{}]*)\}`)
+	uploadTagUnsupported = regexp.MustCompile(`[^\pL\pN\s_.:/=+\-@]`)
+)
+
+const (
+	// maxUploadTags is the most tags S3 allows on an object
+	maxUploadTags = 10
+
+	maxUploadTagKey   = 128
+	maxUploadTagValue = 256
+
+	// tagsSidecarExt is appended to the key of an artifact to name the object its tags are
+	// written to on stores that do not support tagging
+	tagsSidecarExt = ".tags.json"
+)
+
+// uploadTag is a single entry from the upload-tags option
+//
+type uploadTag struct {
+	key   string
+	value string
+}
+
+// ValidateUploadTags parses the upload-tags option and returns the keys of the tags that will
+// be applied to uploads
+//
+func ValidateUploadTags() (keys []string, err errors.Error) {
+	uploadTags = []uploadTag{}
+	if len(strings.TrimSpace(*uploadTagsOpt)) == 0 {
+		return nil, nil
+	}
+
+	tags := []uploadTag{}
+	for _, entry := range strings.Split(*uploadTagsOpt, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || len(key) == 0 {
+			return nil, errors.New("upload-tags entries must be key=value").With("entry", entry).With("stack", stack.Trace().TrimRuntime())
+		}
+		if len(key) > maxUploadTagKey || uploadTagUnsupported.MatchString(key) || strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return nil, errors.New("upload-tags key is invalid").With("key", key).With("stack", stack.Trace().TrimRuntime())
+		}
+		for _, field := range uploadTagFields.FindAllStringSubmatch(parts[1], -1) {
+			switch field[1] {
+			case "experiment", "project", "group", "host", "timestamp":
+			default:
+				return nil, errors.New("upload-tags placeholder is unknown").With("key", key, "placeholder", field[0]).With("stack", stack.Trace().TrimRuntime())
+			}
+		}
+		tags = append(tags, uploadTag{key: key, value: strings.TrimSpace(parts[1])})
+		keys = append(keys, key)
+	}
+	if len(tags) > maxUploadTags {
+		return nil, errors.New("upload-tags has too many tags").With("tags", len(tags), "max", maxUploadTags).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	uploadTags = tags
+	return keys, nil
+}
+
+// UploadTags returns the tags for an upload with the placeholders of the upload-tags option
+// replaced using the fields supplied, nil is returned when tagging is disabled.  Characters
+// that object stores do not accept in tags are replaced with underscores.
+//
+func UploadTags(fields map[string]string) (tags map[string]string) {
+	if len(uploadTags) == 0 {
+		return nil
+	}
+
+	values := map[string]string{"timestamp": time.Now().UTC().Format(time.RFC3339)}
+	for name, value := range fields {
+		values[name] = value
+	}
+
+	tags = make(map[string]string, len(uploadTags))
+	for _, tag := range uploadTags {
+		value := uploadTagFields.ReplaceAllStringFunc(tag.value, func(field string) string {
+			return values[strings.Trim(field, "{}")]
+		})
+		value = uploadTagUnsupported.ReplaceAllString(value, "_")
+		if len(value) > maxUploadTagValue {
+			value = value[:maxUploadTagValue]
+		}
+		tags[tag.key] = value
+	}
+	return tags
+}
@@ -0,0 +1,176 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeTaggingS3 accepts uploads, recording the objects and the tags set on them.  Tagging
+// requests are refused as not implemented unless tagging is set.
+//
+type fakeTaggingS3 struct {
+	tagging bool
+	denied  bool // Tagging requests are refused as the credentials lack the permission
+	objects map[string][]byte
+	tags    map[string]map[string]string
+	sync.Mutex
+}
+
+func (fs *fakeTaggingS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, isPresent := r.URL.Query()["location"]; isPresent {
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`))
+		return
+	}
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	fs.Lock()
+	defer fs.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = unchunk(body)
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+
+	if _, isPresent := r.URL.Query()["tagging"]; !isPresent {
+		fs.objects[key] = body
+		w.Header().Set("ETag", `"fake-etag"`)
+		return
+	}
+
+	if fs.denied {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code></Error>`))
+		return
+	}
+	if !fs.tagging {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NotImplemented</Code></Error>`))
+		return
+	}
+	doc := s3Tagging{}
+	if errGo := xml.Unmarshal(body, &doc); errGo != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fs.tags[key] = map[string]string{}
+	for _, tag := range doc.Tags {
+		fs.tags[key][tag.Key] = tag.Value
+	}
+}
+
+// unchunk removes the chunk signatures from a body sent using aws-chunked encoding
+//
+func unchunk(chunked []byte) (body []byte) {
+	for {
+		line := bytes.SplitN(chunked, []byte("\r\n"), 2)
+		if len(line) != 2 {
+			return body
+		}
+		size, errGo := strconv.ParseInt(string(bytes.SplitN(line[0], []byte(";"), 2)[0]), 16, 64)
+		if errGo != nil || size == 0 || int64(len(line[1])) < size {
+			return body
+		}
+		body = append(body, line[1][:size]...)
+		chunked = bytes.TrimPrefix(line[1][size:], []byte("\r\n"))
+	}
+}
+
+// TestUploadTags checks that uploaded archives are tagged with the experiment they came from,
+// and that the tags are written to a sidecar object on stores that do not support tagging
+//
+func TestUploadTags(t *testing.T) {
+	saved := *uploadTagsOpt
+	defer func() {
+		*uploadTagsOpt = saved
+		ValidateUploadTags()
+	}()
+
+	for _, invalid := range []string{"experiment", "aws:key={project}", "key={unknown}"} {
+		*uploadTagsOpt = invalid
+		if _, err := ValidateUploadTags(); err == nil {
+			t.Fatalf("invalid upload-tags %q accepted", invalid)
+		}
+	}
+
+	*uploadTagsOpt = "experiment={experiment},owner=team {project}!,uploaded={timestamp}"
+	keys, err := ValidateUploadTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("unexpected upload-tags keys %v", keys)
+	}
+	tags := UploadTags(map[string]string{"experiment": "exp-1", "project": "proj"})
+	if tags["experiment"] != "exp-1" || tags["owner"] != "team proj_" || len(tags["uploaded"]) == 0 {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+
+	src, errGo := ioutil.TempDir("", "upload-tags")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(src)
+	if errGo = ioutil.WriteFile(filepath.Join(src, "model.h5"), []byte("model"), 0600); errGo != nil {
+		t.Fatal(errGo)
+	}
+
+	for _, fs := range []*fakeTaggingS3{{tagging: true}, {tagging: false}, {tagging: true, denied: true}} {
+		fs.objects = map[string][]byte{}
+		fs.tags = map[string]map[string]string{}
+		tagging := fs.tagging && !fs.denied
+		server := httptest.NewServer(fs)
+
+		env := map[string]string{
+			"MINIO_TEST_SERVER": strings.TrimPrefix(server.URL, "http://"),
+			"MINIO_ACCESS_KEY":  "access",
+			"MINIO_SECRET_KEY":  "secret",
+		}
+		s, err := NewS3storage(context.Background(), "project", "", env, "", "bucket", "modeldir.tar", false, false)
+		if err != nil {
+			server.Close()
+			t.Fatal(err)
+		}
+		s.tags = tags
+
+		warns, err := s.Deposit(context.Background(), src, "exp-1/modeldir.tar")
+		server.Close()
+		if err != nil {
+			t.Fatal(err, "tagging", tagging)
+		}
+		if len(warns) != 0 {
+			t.Fatal(warns, "tagging", tagging)
+		}
+
+		fs.Lock()
+		if _, isPresent := fs.objects["exp-1/modeldir.tar"]; !isPresent {
+			t.Fatalf("artifact not uploaded, tagging %v", tagging)
+		}
+		sidecar, isSidecar := fs.objects["exp-1/modeldir.tar"+tagsSidecarExt]
+		if tagging {
+			if isSidecar || fs.tags["exp-1/modeldir.tar"]["experiment"] != "exp-1" {
+				t.Fatalf("artifact not tagged %v", fs.tags)
+			}
+		} else {
+			sidecarTags := map[string]string{}
+			if errGo := json.Unmarshal(sidecar, &sidecarTags); errGo != nil || sidecarTags["owner"] != "team proj_" {
+				t.Fatalf("tags sidecar not written %q", string(sidecar))
+			}
+		}
+		fs.Unlock()
+	}
+}
@@ -0,0 +1,334 @@
+package runner
+
+// This file contains the implementation of the sampling of the resources consumed by an
+// experiment while it runs.  The CPU time and resident memory of the processes started for the
+// experiment are read from /proc, and the utilization of the GPUs allocated to the experiment
+// from the GPU management library, at a fixed interval.  Samples are kept as columns of values
+// to keep the document compact, and once the number of samples reaches a limit adjacent pairs
+// are averaged and the interval doubled so that long running experiments produce a document of
+// a bounded size.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stack/stack"
+	"github.com/karlmutch/errors"
+)
+
+var (
+	utilizationIntervalOpt = flag.Duration("utilization-interval", 0, "the interval at which the CPU, RAM, and GPU utilization of experiments is sampled and uploaded as a metrics artifact, for example 30s, 0 disables sampling")
+)
+
+const (
+	// UtilizationFile is the name of the document the utilization of an experiment is saved to
+	UtilizationFile = "utilization.json"
+
+	// utilizationMaxSamples is the number of samples at which they are halved by averaging pairs
+	utilizationMaxSamples = 1024
+
+	// clockTicks is the unit of the CPU times in /proc, USER_HZ is 100 on all the architectures
+	// the runner is used with
+	clockTicks = 100
+)
+
+// UtilizationPeak holds the highest values seen in any single sample, these are recorded
+// before samples are averaged together
+//
+type UtilizationPeak struct {
+	CPUCores   float64 `json:"cpu_cores"`
+	RAMBytes   uint64  `json:"ram_bytes"`
+	GPUPercent uint    `json:"gpu_percent,omitempty"`
+}
+
+// Utilization is a time-series of the resources consumed by an experiment
+//
+type Utilization struct {
+	Interval   string          `json:"interval"`
+	StartedAt  time.Time       `json:"started_at"`
+	GPUs       []string        `json:"gpus,omitempty"`
+	Offsets    []float64       `json:"offset_secs"`
+	CPUCores   []float64       `json:"cpu_cores"`
+	RAMBytes   []uint64        `json:"ram_bytes"`
+	GPUPercent []uint          `json:"gpu_percent,omitempty"`
+	Peak       UtilizationPeak `json:"peak"`
+
+	interval time.Duration
+	sync.Mutex
+}
+
+// NewUtilization returns a time-series that samples at the interval of the
+// utilization-interval option, nil is returned when sampling is disabled
+//
+func NewUtilization() (u *Utilization) {
+	if *utilizationIntervalOpt <= 0 {
+		return nil
+	}
+	return &Utilization{
+		interval: *utilizationIntervalOpt,
+		Interval: utilizationIntervalOpt.String(),
+	}
+}
+
+// SetGPUs records the GPUs allocated to the experiment whose utilization is sampled
+//
+func (u *Utilization) SetGPUs(uuids []string) {
+	if u == nil {
+		return
+	}
+	u.Lock()
+	defer u.Unlock()
+
+	u.GPUs = uuids
+}
+
+// Start samples the processes descended from pid, including pid itself, until the context
+// is done.  The returned channel is closed once sampling has stopped.  Starting again, for
+// a process that replaced the first, continues the same time-series.
+//
+func (u *Utilization) Start(ctx context.Context, pid int) (doneC chan struct{}) {
+	doneC = make(chan struct{})
+	if u == nil {
+		close(doneC)
+		return doneC
+	}
+
+	u.Lock()
+	if u.StartedAt.IsZero() {
+		u.StartedAt = time.Now()
+	}
+	gpus := u.GPUs
+	interval := u.interval
+	u.Unlock()
+
+	go func() {
+		defer close(doneC)
+
+		tick := time.NewTicker(interval)
+		defer func() {
+			tick.Stop()
+		}()
+
+		lastAt := time.Now()
+		lastTicks, _ := procTreeUsage(pid)
+		for {
+			select {
+			case <-tick.C:
+				ticks, rss := procTreeUsage(pid)
+				at := time.Now()
+
+				cores := 0.0
+				if elapsed := at.Sub(lastAt).Seconds(); elapsed > 0 && ticks > lastTicks {
+					cores = float64(ticks-lastTicks) / clockTicks / elapsed
+				}
+				lastAt, lastTicks = at, ticks
+
+				// Once samples have been halved they are taken less often to match
+				if current := u.add(at, cores, rss, gpuUtilization(gpus)); current != interval {
+					interval = current
+					tick.Stop()
+					tick = time.NewTicker(interval)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return doneC
+}
+
+// gpuUtilization returns the mean utilization of the identified GPUs, or -1 when there are
+// none or they could not be sampled
+//
+func gpuUtilization(uuids []string) (util int) {
+	if len(uuids) == 0 {
+		return -1
+	}
+	utils, err := GPUUtilization()
+	if err != nil {
+		return -1
+	}
+	total := uint(0)
+	for _, uuid := range uuids {
+		total += utils[uuid]
+	}
+	return int(total / uint(len(uuids)))
+}
+
+// add appends a sample to the time-series halving the samples when the limit is reached, the
+// interval samples are to be taken at from then on is returned
+//
+func (u *Utilization) add(at time.Time, cores float64, rss uint64, gpu int) (interval time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+
+	cores = math.Round(cores*100) / 100
+
+	u.Offsets = append(u.Offsets, math.Round(at.Sub(u.StartedAt).Seconds()))
+	u.CPUCores = append(u.CPUCores, cores)
+	u.RAMBytes = append(u.RAMBytes, rss)
+	if gpu >= 0 {
+		u.GPUPercent = append(u.GPUPercent, uint(gpu))
+		if uint(gpu) > u.Peak.GPUPercent {
+			u.Peak.GPUPercent = uint(gpu)
+		}
+	}
+	if cores > u.Peak.CPUCores {
+		u.Peak.CPUCores = cores
+	}
+	if rss > u.Peak.RAMBytes {
+		u.Peak.RAMBytes = rss
+	}
+
+	if len(u.Offsets) >= utilizationMaxSamples {
+		u.halve()
+	}
+	return u.interval
+}
+
+// halve averages adjacent pairs of samples and doubles the interval between them, an odd
+// sample at the end is kept as it is
+//
+func (u *Utilization) halve() {
+	half := len(u.Offsets) / 2
+	for i := 0; i < half; i++ {
+		u.Offsets[i] = u.Offsets[2*i+1]
+		u.CPUCores[i] = math.Round((u.CPUCores[2*i]+u.CPUCores[2*i+1])*50) / 100
+		u.RAMBytes[i] = (u.RAMBytes[2*i] + u.RAMBytes[2*i+1]) / 2
+	}
+	gpuHalf := len(u.GPUPercent) / 2
+	for i := 0; i < gpuHalf; i++ {
+		u.GPUPercent[i] = (u.GPUPercent[2*i] + u.GPUPercent[2*i+1]) / 2
+	}
+	if len(u.Offsets)%2 != 0 {
+		u.Offsets[half] = u.Offsets[len(u.Offsets)-1]
+		u.CPUCores[half] = u.CPUCores[len(u.CPUCores)-1]
+		u.RAMBytes[half] = u.RAMBytes[len(u.RAMBytes)-1]
+		half++
+	}
+	if len(u.GPUPercent)%2 != 0 {
+		u.GPUPercent[gpuHalf] = u.GPUPercent[len(u.GPUPercent)-1]
+		gpuHalf++
+	}
+	u.Offsets = u.Offsets[:half]
+	u.CPUCores = u.CPUCores[:half]
+	u.RAMBytes = u.RAMBytes[:half]
+	u.GPUPercent = u.GPUPercent[:gpuHalf]
+
+	u.interval *= 2
+	u.Interval = u.interval.String()
+}
+
+// Empty returns true when no samples were taken
+//
+func (u *Utilization) Empty() (empty bool) {
+	if u == nil {
+		return true
+	}
+	u.Lock()
+	defer u.Unlock()
+
+	return len(u.Offsets) == 0
+}
+
+// Save writes the utilization document into the supplied directory
+//
+func (u *Utilization) Save(dir string) (fn string, err errors.Error) {
+	u.Lock()
+	doc, errGo := json.Marshal(u)
+	u.Unlock()
+	if errGo != nil {
+		return "", errors.Wrap(errGo).With("stack", stack.Trace().TrimRuntime())
+	}
+
+	if errGo := os.MkdirAll(dir, 0700); errGo != nil {
+		return "", errors.Wrap(errGo).With("dir", dir).With("stack", stack.Trace().TrimRuntime())
+	}
+	fn = filepath.Join(dir, UtilizationFile)
+	if errGo := ioutil.WriteFile(fn, append(doc, '\n'), 0600); errGo != nil {
+		return "", errors.Wrap(errGo).With("file", fn).With("stack", stack.Trace().TrimRuntime())
+	}
+	return fn, nil
+}
+
+// procStat holds the fields of /proc/[pid]/stat used for sampling
+//
+type procStat struct {
+	ppid  int
+	ticks uint64 // The user and system time of the process and its waited for children
+	rss   uint64 // Resident pages
+}
+
+// readProcStat parses the stat file of a process, the command name can contain spaces and
+// parentheses so fields are counted from the last closing parenthesis
+//
+func readProcStat(pid string) (stat procStat, ok bool) {
+	data, errGo := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if errGo != nil {
+		return stat, false
+	}
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return stat, false
+	}
+	// Fields following the name start with the state, field 3 in the proc man page
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return stat, false
+	}
+	stat.ppid, _ = strconv.Atoi(fields[1])
+	for _, field := range fields[11:15] {
+		ticks, _ := strconv.ParseUint(field, 10, 64)
+		stat.ticks += ticks
+	}
+	stat.rss, _ = strconv.ParseUint(fields[21], 10, 64)
+	return stat, true
+}
+
+// procTreeUsage returns the CPU ticks consumed and the resident memory, in bytes, of a
+// process and all of its descendants
+//
+func procTreeUsage(pid int) (ticks uint64, rss uint64) {
+	entries, errGo := ioutil.ReadDir("/proc")
+	if errGo != nil {
+		return 0, 0
+	}
+
+	stats := make(map[int]procStat, len(entries))
+	children := map[int][]int{}
+	for _, entry := range entries {
+		child, errGo := strconv.Atoi(entry.Name())
+		if errGo != nil {
+			continue
+		}
+		if stat, ok := readProcStat(entry.Name()); ok {
+			stats[child] = stat
+			children[stat.ppid] = append(children[stat.ppid], child)
+		}
+	}
+
+	pageSize := uint64(os.Getpagesize())
+	pending := []int{pid}
+	for len(pending) != 0 {
+		next := pending[0]
+		pending = pending[1:]
+
+		stat, isPresent := stats[next]
+		if !isPresent {
+			continue
+		}
+		ticks += stat.ticks
+		rss += stat.rss * pageSize
+		pending = append(pending, children[next]...)
+	}
+	return ticks, rss
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestUtilization checks that the CPU and memory of a process and its children are sampled
+// and saved as a time-series
+//
+func TestUtilization(t *testing.T) {
+
+	saved := *utilizationIntervalOpt
+	defer func() { *utilizationIntervalOpt = saved }()
+	*utilizationIntervalOpt = 100 * time.Millisecond
+
+	// The shell starts a child that spins consuming CPU, both are stopped using their process group
+	cmd := exec.Command("/bin/sh", "-c", "sh -c 'while :; do :; done' & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if errGo := cmd.Start(); errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+	}()
+
+	u := NewUtilization()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	<-u.Start(ctx, cmd.Process.Pid)
+
+	if u.Empty() || len(u.CPUCores) != len(u.Offsets) || len(u.RAMBytes) != len(u.Offsets) || len(u.GPUPercent) != 0 {
+		t.Fatalf("samples not collected %+v", u)
+	}
+	if u.Peak.CPUCores < 0.5 || u.Peak.RAMBytes == 0 {
+		t.Fatalf("spinning child not sampled %+v", u.Peak)
+	}
+
+	dir, errGo := ioutil.TempDir("", "utilization")
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	defer os.RemoveAll(dir)
+
+	fn, err := u.Save(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, errGo := ioutil.ReadFile(fn)
+	if errGo != nil {
+		t.Fatal(errGo)
+	}
+	doc := map[string]interface{}{}
+	if errGo = json.Unmarshal(data, &doc); errGo != nil {
+		t.Fatal(errGo)
+	}
+	if doc["interval"] != "100ms" || doc["peak"] == nil {
+		t.Fatalf("unexpected document %s", string(data))
+	}
+}
+
+// TestUtilizationHalve checks that samples are averaged in pairs once the limit is reached
+//
+func TestUtilizationHalve(t *testing.T) {
+	u := &Utilization{interval: time.Second, Interval: "1s", StartedAt: time.Now()}
+	for i := 0; i < utilizationMaxSamples; i++ {
+		u.add(u.StartedAt.Add(time.Duration(i+1)*time.Second), float64(i%2), uint64(i%2)*100, 50)
+	}
+	if len(u.Offsets) != utilizationMaxSamples/2 || u.Interval != "2s" || u.interval != 2*time.Second {
+		t.Fatalf("samples not halved, %d samples at %s", len(u.Offsets), u.Interval)
+	}
+	if u.CPUCores[0] != 0.5 || u.RAMBytes[0] != 50 || u.GPUPercent[0] != 50 || u.Offsets[0] != 2 {
+		t.Fatalf("samples not averaged %v %v %v %v", u.Offsets[0], u.CPUCores[0], u.RAMBytes[0], u.GPUPercent[0])
+	}
+	if u.Peak.CPUCores != 1 || u.Peak.RAMBytes != 100 {
+		t.Fatalf("peak lost when halving %+v", u.Peak)
+	}
+}
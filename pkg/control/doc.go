@@ -0,0 +1,8 @@
+//go:generate protoc --go_out=plugins=grpc:. control.proto
+
+package control
+
+// This package contains the gRPC management interface of the runner, generated from the
+// control.proto file.  The interface is served by runners started using the grpc-control
+// option and can be used by tooling to drain runners, pause and resume queues, cancel
+// experiments, and query the state of a runner.